@@ -0,0 +1,153 @@
+package apply
+
+import (
+	"bytes"
+	"net"
+
+	"github.com/fastcat/wirelink/fact"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// AllowedIPOwners maps an AllowedIP, in the same binary key form used for
+// fact values, to the peer that should hold it in the wireguard config.
+// Only AllowedIPs that are claimed by more than one peer are present.
+type AllowedIPOwners map[string]wgtypes.Key
+
+// OwnerOf returns the peer that should hold the given AllowedIP, if it is
+// contested between multiple peers.
+func (o AllowedIPOwners) OwnerOf(aip fact.Value) (owner wgtypes.Key, ok bool) {
+	if o == nil {
+		return
+	}
+	owner, ok = o[fvKey(aip)]
+	return
+}
+
+// OwnerOfIPNet is the same as OwnerOf, but for an AllowedIP from the
+// wireguard config instead of a fact value.
+func (o AllowedIPOwners) OwnerOfIPNet(aip net.IPNet) (owner wgtypes.Key, ok bool) {
+	if o == nil {
+		return
+	}
+	owner, ok = o[ipNetKey(aip)]
+	return
+}
+
+// ChooseAllowedIPOwners resolves AllowedIPs that more than one peer claims,
+// such as redundant routers all advertising the same network, to the single
+// peer that should hold each of them. Wireguard only allows a given CIDR to be
+// assigned to one peer, so without this every configuration pass would move
+// the CIDR back and forth between the claimants.
+//
+// The current holder of an AllowedIP keeps it as long as it is healthy and
+// alive. If it is not, the AllowedIP fails over to the claimant that has been
+// healthy and alive the longest. If no claimant is usable, the current holder
+// (or failing that the claimant with the lowest key) is kept so that the
+// choice is stable.
+func ChooseAllowedIPOwners(
+	peers []wgtypes.Peer,
+	factsByPeer map[wgtypes.Key][]*fact.Fact,
+	states func(wgtypes.Key) (*PeerConfigState, bool),
+) AllowedIPOwners {
+	claimants := make(map[string][]wgtypes.Key)
+	for peer, facts := range factsByPeer {
+		seen := make(map[string]bool)
+		for _, f := range facts {
+			if f.Attribute != fact.AttributeAllowedCidrV4 && f.Attribute != fact.AttributeAllowedCidrV6 {
+				continue
+			}
+			key := fvKey(f.Value)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			claimants[key] = append(claimants[key], peer)
+		}
+	}
+
+	holders := make(map[string]wgtypes.Key)
+	for _, p := range peers {
+		for _, aip := range p.AllowedIPs {
+			holders[ipNetKey(aip)] = p.PublicKey
+		}
+	}
+
+	ret := make(AllowedIPOwners)
+	for key, candidates := range claimants {
+		if len(candidates) < 2 {
+			continue
+		}
+		holder, held := holders[key]
+		if held && !containsKey(candidates, holder) {
+			held = false
+		}
+
+		var best *wgtypes.Key
+		var bestState *PeerConfigState
+		for i := range candidates {
+			c := &candidates[i]
+			state, _ := states(*c)
+			if !usableForAllowedIPs(state) {
+				continue
+			}
+			if held && *c == holder {
+				// sticky: don't move an AIP away from a working peer
+				best = c
+				break
+			}
+			if best == nil || preferAliveLonger(state, bestState, c, best) {
+				best = c
+				bestState = state
+			}
+		}
+
+		if best != nil {
+			ret[key] = *best
+		} else if held {
+			ret[key] = holder
+		} else {
+			ret[key] = lowestKey(candidates)
+		}
+	}
+
+	return ret
+}
+
+// usableForAllowedIPs checks if a peer looks like it can carry traffic,
+// mirroring the conditions under which we add AllowedIPs to a peer
+func usableForAllowedIPs(state *PeerConfigState) bool {
+	return state.IsHealthy() && (state.IsAlive() || state.IsBasic())
+}
+
+// preferAliveLonger returns true if the left peer should be preferred over the
+// right peer based on how long each has been alive, using the key as a
+// tie-breaker so that the result is deterministic
+func preferAliveLonger(l, r *PeerConfigState, lk, rk *wgtypes.Key) bool {
+	ls, rs := l.AliveSince(), r.AliveSince()
+	if ls.Before(rs) {
+		return true
+	} else if rs.Before(ls) {
+		return false
+	}
+	return bytes.Compare(lk[:], rk[:]) < 0
+}
+
+func containsKey(keys []wgtypes.Key, key wgtypes.Key) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func lowestKey(keys []wgtypes.Key) wgtypes.Key {
+	ret := keys[0]
+	for _, k := range keys[1:] {
+		if bytes.Compare(k[:], ret[:]) < 0 {
+			ret = k
+		}
+	}
+	return ret
+}
@@ -0,0 +1,210 @@
+package apply
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/internal/testutils"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChooseAllowedIPOwners(t *testing.T) {
+	now := time.Now()
+
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	k3 := testutils.MustKey(t)
+	lowK := lowestKey([]wgtypes.Key{k1, k2})
+	aip1 := makeIPNet(t)
+	aip2 := makeIPNet(t)
+
+	alive := func(since time.Time) *PeerConfigState {
+		return &PeerConfigState{lastHealthy: true, lastAlive: true, aliveSince: since}
+	}
+	dead := &PeerConfigState{}
+
+	type args struct {
+		peers       []wgtypes.Peer
+		factsByPeer map[wgtypes.Key][]*fact.Fact
+		states      map[wgtypes.Key]*PeerConfigState
+	}
+	tests := []struct {
+		name string
+		args args
+		want AllowedIPOwners
+	}{
+		{
+			"empty",
+			args{},
+			AllowedIPOwners{},
+		},
+		{
+			"uncontested",
+			args{
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{
+					k1: {aipFact(k1, aip1)},
+					k2: {aipFact(k2, aip2)},
+				},
+				states: map[wgtypes.Key]*PeerConfigState{
+					k1: alive(now),
+					k2: alive(now),
+				},
+			},
+			AllowedIPOwners{},
+		},
+		{
+			"sticky to healthy holder",
+			args{
+				peers: []wgtypes.Peer{
+					{PublicKey: k1},
+					{PublicKey: k2, AllowedIPs: []net.IPNet{aip1}},
+				},
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{
+					k1: {aipFact(k1, aip1)},
+					k2: {aipFact(k2, aip1)},
+				},
+				states: map[wgtypes.Key]*PeerConfigState{
+					k1: alive(now.Add(-time.Hour)),
+					k2: alive(now),
+				},
+			},
+			AllowedIPOwners{ipNetKey(aip1): k2},
+		},
+		{
+			"fails over from dead holder",
+			args{
+				peers: []wgtypes.Peer{
+					{PublicKey: k1, AllowedIPs: []net.IPNet{aip1}},
+					{PublicKey: k2},
+					{PublicKey: k3},
+				},
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{
+					k1: {aipFact(k1, aip1)},
+					k2: {aipFact(k2, aip1)},
+					k3: {aipFact(k3, aip1)},
+				},
+				states: map[wgtypes.Key]*PeerConfigState{
+					k1: dead,
+					k2: alive(now),
+					k3: alive(now.Add(-time.Minute)),
+				},
+			},
+			AllowedIPOwners{ipNetKey(aip1): k3},
+		},
+		{
+			"ignores holder that is not a claimant",
+			args{
+				peers: []wgtypes.Peer{
+					{PublicKey: k3, AllowedIPs: []net.IPNet{aip1}},
+				},
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{
+					k1: {aipFact(k1, aip1)},
+					k2: {aipFact(k2, aip1)},
+				},
+				states: map[wgtypes.Key]*PeerConfigState{
+					k1: alive(now),
+					k2: alive(now.Add(-time.Minute)),
+					k3: alive(now.Add(-time.Hour)),
+				},
+			},
+			AllowedIPOwners{ipNetKey(aip1): k2},
+		},
+		{
+			"tie breaks on key",
+			args{
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{
+					k1: {aipFact(k1, aip1)},
+					k2: {aipFact(k2, aip1)},
+				},
+				states: map[wgtypes.Key]*PeerConfigState{
+					k1: alive(now),
+					k2: alive(now),
+				},
+			},
+			AllowedIPOwners{ipNetKey(aip1): lowK},
+		},
+		{
+			"keeps dead holder if nobody is usable",
+			args{
+				peers: []wgtypes.Peer{
+					{PublicKey: k1, AllowedIPs: []net.IPNet{aip1}},
+				},
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{
+					k1: {aipFact(k1, aip1)},
+					k2: {aipFact(k2, aip1)},
+				},
+			},
+			AllowedIPOwners{ipNetKey(aip1): k1},
+		},
+		{
+			"lowest key if nobody is usable or holding",
+			args{
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{
+					k1: {aipFact(k1, aip1)},
+					k2: {aipFact(k2, aip1)},
+				},
+			},
+			AllowedIPOwners{ipNetKey(aip1): lowK},
+		},
+		{
+			"basic peers are usable",
+			args{
+				peers: []wgtypes.Peer{
+					{PublicKey: k1, AllowedIPs: []net.IPNet{aip1}},
+				},
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{
+					k1: {aipFact(k1, aip1)},
+					k2: {aipFact(k2, aip1)},
+				},
+				states: map[wgtypes.Key]*PeerConfigState{
+					k1: dead,
+					k2: {
+						lastHealthy: true,
+						metadata:    map[fact.MemberAttribute]string{fact.MemberIsBasic: string([]byte{1})},
+					},
+				},
+			},
+			AllowedIPOwners{ipNetKey(aip1): k2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			states := func(k wgtypes.Key) (*PeerConfigState, bool) {
+				s, ok := tt.args.states[k]
+				return s, ok
+			}
+			got := ChooseAllowedIPOwners(tt.args.peers, tt.args.factsByPeer, states)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestAllowedIPOwners_OwnerOf(t *testing.T) {
+	k := testutils.MustKey(t)
+	aip1 := makeIPNet(t)
+	aip2 := makeIPNet(t)
+	owners := AllowedIPOwners{ipNetKey(aip1): k}
+
+	owner, ok := owners.OwnerOf(&fact.IPNetValue{IPNet: aip1})
+	assert.True(t, ok)
+	assert.Equal(t, k, owner)
+	owner, ok = owners.OwnerOfIPNet(aip1)
+	assert.True(t, ok)
+	assert.Equal(t, k, owner)
+
+	_, ok = owners.OwnerOf(&fact.IPNetValue{IPNet: aip2})
+	assert.False(t, ok)
+	_, ok = owners.OwnerOfIPNet(aip2)
+	assert.False(t, ok)
+
+	var nilOwners AllowedIPOwners
+	_, ok = nilOwners.OwnerOf(&fact.IPNetValue{IPNet: aip1})
+	assert.False(t, ok)
+	_, ok = nilOwners.OwnerOfIPNet(aip1)
+	assert.False(t, ok)
+}
@@ -5,7 +5,6 @@ import (
 
 	"github.com/fastcat/wirelink/autopeer"
 	"github.com/fastcat/wirelink/fact"
-	"github.com/fastcat/wirelink/log"
 	"github.com/fastcat/wirelink/util"
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
@@ -45,12 +44,16 @@ func keyIPNet(key string) net.IPNet {
 
 // EnsureAllowedIPs updates the device config if needed to add all the
 // AllowedIPs from the facts to the peer. This assumes that facts have already
-// been filtered to be just the trusted ones.
+// been filtered to be just the trusted ones. AllowedIPs which are contested
+// with other peers are only added if `owners` says this peer should hold them,
+// and are otherwise treated as invalid for this peer.
 func EnsureAllowedIPs(
 	peer *wgtypes.Peer,
 	facts []*fact.Fact,
 	cfg *wgtypes.PeerConfig,
 	allowDeconfigure bool,
+	owners AllowedIPOwners,
+	scheme *autopeer.Scheme,
 ) *wgtypes.PeerConfig {
 	aipFlags := make(map[string]allowedIPFlag)
 	for _, aip := range peer.AllowedIPs {
@@ -62,13 +65,17 @@ func EnsureAllowedIPs(
 		}
 	}
 	// autoaddr is always valid
-	aipFlags[ipNetKey(autopeer.AutoAddressNet(peer.PublicKey))] |= aipValid
+	aipFlags[ipNetKey(scheme.AddressNet(peer.PublicKey))] |= aipValid
 
 	for _, f := range facts {
 		switch f.Attribute {
 		case fact.AttributeAllowedCidrV4:
 			fallthrough
 		case fact.AttributeAllowedCidrV6:
+			if owner, ok := owners.OwnerOf(f.Value); ok && owner != peer.PublicKey {
+				// another peer is the better home for this AIP right now
+				continue
+			}
 			key := fvKey(f.Value)
 			aipFlags[key] |= aipValid
 			if aipFlags[key]&aipAlreadyMask != aipNone {
@@ -81,7 +88,7 @@ func EnsureAllowedIPs(
 				cfg.AllowedIPs = append(cfg.AllowedIPs, ipn.IPNet)
 				aipFlags[key] |= aipAdding
 			} else {
-				log.Error("AIP Fact has wrong value type: %v => %T: %v", f.Attribute, f.Value, f.Value)
+				logger.Error("AIP Fact has wrong value type: %v => %T: %v", f.Attribute, f.Value, f.Value)
 			}
 		}
 	}
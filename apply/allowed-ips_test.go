@@ -33,6 +33,7 @@ func aipFact(key wgtypes.Key, aip net.IPNet) (aipFact *fact.Fact) {
 
 func TestEnsureAllowedIPs(t *testing.T) {
 	k := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
 	autoIP := autopeer.AutoAddressNet(k)
 	aip1 := makeIPNet(t)
 	aip2 := makeIPNet(t)
@@ -43,6 +44,7 @@ func TestEnsureAllowedIPs(t *testing.T) {
 		facts            []*fact.Fact
 		cfg              *wgtypes.PeerConfig
 		allowDeconfigure bool
+		owners           AllowedIPOwners
 	}
 	tests := []struct {
 		name string
@@ -136,10 +138,54 @@ func TestEnsureAllowedIPs(t *testing.T) {
 				AllowedIPs: []net.IPNet{aip1, aip2},
 			},
 		},
+		{
+			"adds contested aip it owns",
+			args{
+				peer:   &wgtypes.Peer{PublicKey: k},
+				facts:  []*fact.Fact{aipFact(k, aip1)},
+				owners: AllowedIPOwners{ipNetKey(aip1): k},
+			},
+			&wgtypes.PeerConfig{
+				PublicKey:  k,
+				AllowedIPs: []net.IPNet{aip1},
+			},
+		},
+		{
+			"skips contested aip owned by another peer",
+			args{
+				peer: &wgtypes.Peer{PublicKey: k},
+				facts: []*fact.Fact{
+					aipFact(k, aip1),
+					aipFact(k, aip2),
+				},
+				owners: AllowedIPOwners{ipNetKey(aip1): k2},
+			},
+			&wgtypes.PeerConfig{
+				PublicKey:  k,
+				AllowedIPs: []net.IPNet{aip2},
+			},
+		},
+		{
+			"removes contested aip owned by another peer",
+			args{
+				peer: &wgtypes.Peer{
+					PublicKey:  k,
+					AllowedIPs: []net.IPNet{autoIP, aip1},
+				},
+				facts:            []*fact.Fact{aipFact(k, aip1)},
+				allowDeconfigure: true,
+				owners:           AllowedIPOwners{ipNetKey(aip1): k2},
+			},
+			&wgtypes.PeerConfig{
+				PublicKey:         k,
+				ReplaceAllowedIPs: true,
+				AllowedIPs:        []net.IPNet{autoIP},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := EnsureAllowedIPs(tt.args.peer, tt.args.facts, tt.args.cfg, tt.args.allowDeconfigure)
+			got := EnsureAllowedIPs(tt.args.peer, tt.args.facts, tt.args.cfg, tt.args.allowDeconfigure, tt.args.owners, nil)
 			// have to sort the AIP lists for the equality to work
 			if got != nil {
 				util.SortIPNetSlice(got.AllowedIPs)
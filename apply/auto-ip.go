@@ -12,12 +12,24 @@ import (
 )
 
 // EnsurePeersAutoIP updates the config of the device, if needed, to ensure all
-// peers have their IPv6-LL IP listed in their AllowedIPs.
+// peers have their automatic address listed in their AllowedIPs. Peers whose
+// address collides with another peer's, or ours, are left alone, as the address
+// can only be routed to one of them.
 // It returns the number of peers modified and any error that happens
-func EnsurePeersAutoIP(ctrl internal.WgClient, dev *wgtypes.Device) (int, error) {
+func EnsurePeersAutoIP(ctrl internal.WgClient, dev *wgtypes.Device, scheme *autopeer.Scheme) (int, error) {
+	keys := make([]wgtypes.Key, 0, len(dev.Peers)+1)
+	keys = append(keys, dev.PublicKey)
+	for _, peer := range dev.Peers {
+		keys = append(keys, peer.PublicKey)
+	}
+	colliding := scheme.Collisions(keys...)
+
 	var cfg wgtypes.Config
 	for _, peer := range dev.Peers {
-		pcfg, _ := EnsurePeerAutoIP(&peer, nil)
+		if colliding[peer.PublicKey] {
+			continue
+		}
+		pcfg, _ := EnsurePeerAutoIP(&peer, nil, scheme)
 		if pcfg != nil {
 			cfg.Peers = append(cfg.Peers, *pcfg)
 		}
@@ -30,7 +42,7 @@ func EnsurePeersAutoIP(ctrl internal.WgClient, dev *wgtypes.Device) (int, error)
 	err := ctrl.ConfigureDevice(dev.Name, cfg)
 	if err != nil {
 		return 0, errors.Wrapf(err,
-			"Unable to configure %s with %d new peer IPv6-LL AllowedIPs", dev.Name, len(cfg.Peers))
+			"Unable to configure %s with %d new peer auto address AllowedIPs", dev.Name, len(cfg.Peers))
 	}
 
 	return len(cfg.Peers), nil
@@ -40,7 +52,7 @@ func hasAutoIP(autoaddr net.IP, aips []net.IPNet) bool {
 	for _, aip := range aips {
 		if aip.IP.Equal(autoaddr) {
 			ones, bits := aip.Mask.Size()
-			if ones == 8*net.IPv6len && bits == 8*net.IPv6len {
+			if ones == bits && bits == 8*len(autoaddr) {
 				return true
 			}
 		}
@@ -49,9 +61,9 @@ func hasAutoIP(autoaddr net.IP, aips []net.IPNet) bool {
 }
 
 // EnsurePeerAutoIP ensures that the config (if any) for the given peer key includes
-// its automatic IPv6-LL address.
-func EnsurePeerAutoIP(peer *wgtypes.Peer, cfg *wgtypes.PeerConfig) (peerConfig *wgtypes.PeerConfig, added bool) {
-	autoaddr := autopeer.AutoAddress(peer.PublicKey)
+// its automatic address.
+func EnsurePeerAutoIP(peer *wgtypes.Peer, cfg *wgtypes.PeerConfig, scheme *autopeer.Scheme) (peerConfig *wgtypes.PeerConfig, added bool) {
+	autoaddr := scheme.Address(peer.PublicKey)
 	hasNow := hasAutoIP(autoaddr, peer.AllowedIPs)
 	var alreadyAdding bool
 	var rebuilding bool
@@ -70,19 +82,17 @@ func EnsurePeerAutoIP(peer *wgtypes.Peer, cfg *wgtypes.PeerConfig) (peerConfig *
 		}
 	}
 
-	cfg.AllowedIPs = append(cfg.AllowedIPs, net.IPNet{
-		IP:   autoaddr,
-		Mask: net.CIDRMask(8*net.IPv6len, 8*net.IPv6len),
-	})
+	cfg.AllowedIPs = append(cfg.AllowedIPs, scheme.AddressNet(peer.PublicKey))
 	// don't "say" we added it (for logging purposes) if we are "re-adding" it
 	// as part of a rebuild
 	return cfg, !hasNow
 }
 
-// OnlyAutoIP configures a peer to have _only_ its IPv6-LL IP in its AllowedIPs
+// OnlyAutoIP configures a peer to have _only_ its automatic address in its
+// AllowedIPs
 // it returns whether a change was attempted and any error that happens
-func OnlyAutoIP(peer *wgtypes.Peer, cfg *wgtypes.PeerConfig) *wgtypes.PeerConfig {
-	autoaddr := autopeer.AutoAddress(peer.PublicKey)
+func OnlyAutoIP(peer *wgtypes.Peer, cfg *wgtypes.PeerConfig, scheme *autopeer.Scheme) *wgtypes.PeerConfig {
+	autoaddr := scheme.Address(peer.PublicKey)
 	// don't bother checking for not needing a change, just always set it up
 	if cfg != nil && cfg.ReplaceAllowedIPs && len(cfg.AllowedIPs) == 1 && hasAutoIP(autoaddr, cfg.AllowedIPs) {
 		// already set to apply this config
@@ -103,10 +113,7 @@ func OnlyAutoIP(peer *wgtypes.Peer, cfg *wgtypes.PeerConfig) *wgtypes.PeerConfig
 		cfg = &wgtypes.PeerConfig{PublicKey: peer.PublicKey}
 	}
 	cfg.ReplaceAllowedIPs = true
-	cfg.AllowedIPs = []net.IPNet{{
-		IP:   autoaddr,
-		Mask: net.CIDRMask(8*net.IPv6len, 8*net.IPv6len),
-	}}
+	cfg.AllowedIPs = []net.IPNet{scheme.AddressNet(peer.PublicKey)}
 
 	return cfg
 }
@@ -32,9 +32,14 @@ func TestEnsurePeersAutoIP(t *testing.T) {
 	}
 	iface := fmt.Sprintf("wg%d", rand.Int31())
 
+	v4ll, err := autopeer.ParseScheme(autopeer.SchemeIPv4LinkLocal)
+	require.NoError(t, err)
+	c1, c2 := testutils.MustCollidingKeys(t, v4ll.Address)
+
 	type args struct {
-		ctrl func(*testing.T) *mocks.WgClient
-		dev  *wgtypes.Device
+		ctrl   func(*testing.T) *mocks.WgClient
+		dev    *wgtypes.Device
+		scheme *autopeer.Scheme
 	}
 	tests := []struct {
 		name    string
@@ -155,6 +160,65 @@ func TestEnsurePeersAutoIP(t *testing.T) {
 			0,
 			true,
 		},
+		{
+			"ipv4 scheme",
+			args{
+				ctrl: func(t *testing.T) *mocks.WgClient {
+					ctrl := &mocks.WgClient{}
+					ctrl.On("ConfigureDevice", iface, wgtypes.Config{
+						Peers: []wgtypes.PeerConfig{
+							{
+								PublicKey:         k1,
+								ReplaceAllowedIPs: false,
+								AllowedIPs:        []net.IPNet{v4ll.AddressNet(k1)},
+							},
+						},
+					}).Return(nil)
+					return ctrl
+				},
+				dev: &wgtypes.Device{
+					Name: iface,
+					Peers: []wgtypes.Peer{
+						{
+							PublicKey:  k1,
+							AllowedIPs: []net.IPNet{k1aip},
+						},
+					},
+				},
+				scheme: v4ll,
+			},
+			1,
+			false,
+		},
+		{
+			"colliding peers skipped",
+			args{
+				ctrl: func(t *testing.T) *mocks.WgClient {
+					ctrl := &mocks.WgClient{}
+					ctrl.On("ConfigureDevice", iface, wgtypes.Config{
+						Peers: []wgtypes.PeerConfig{
+							{
+								PublicKey:         k2,
+								ReplaceAllowedIPs: false,
+								AllowedIPs:        []net.IPNet{v4ll.AddressNet(k2)},
+							},
+						},
+					}).Return(nil)
+					return ctrl
+				},
+				dev: &wgtypes.Device{
+					Name: iface,
+					Peers: []wgtypes.Peer{
+						{PublicKey: c1},
+						{PublicKey: k2},
+						{PublicKey: c2},
+					},
+				},
+				scheme: v4ll,
+			},
+			1,
+			false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -163,7 +227,7 @@ func TestEnsurePeersAutoIP(t *testing.T) {
 				ctrl = tt.args.ctrl(t)
 				ctrl.Test(t)
 			}
-			got, err := EnsurePeersAutoIP(ctrl, tt.args.dev)
+			got, err := EnsurePeersAutoIP(ctrl, tt.args.dev, tt.args.scheme)
 			if ctrl != nil {
 				ctrl.AssertExpectations(t)
 			}
@@ -182,9 +246,15 @@ func TestEnsurePeerAutoIP(t *testing.T) {
 	aip1 := autopeer.AutoAddressNet(p1.PublicKey)
 	p1.AllowedIPs = append(p1.AllowedIPs, aip1)
 
+	ula, err := autopeer.ParseScheme("fd12:3456:789a::/48")
+	require.NoError(t, err)
+	v4ll, err := autopeer.ParseScheme(autopeer.SchemeIPv4LinkLocal)
+	require.NoError(t, err)
+
 	type args struct {
-		peer *wgtypes.Peer
-		cfg  *wgtypes.PeerConfig
+		peer   *wgtypes.Peer
+		cfg    *wgtypes.PeerConfig
+		scheme *autopeer.Scheme
 	}
 	tests := []struct {
 		name           string
@@ -208,10 +278,46 @@ func TestEnsurePeerAutoIP(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"ula add",
+			args{
+				peer:   p1,
+				scheme: ula,
+			},
+			&wgtypes.PeerConfig{
+				PublicKey:  p1.PublicKey,
+				AllowedIPs: []net.IPNet{ula.AddressNet(p1.PublicKey)},
+			},
+			true,
+		},
+		{
+			"ipv4 add",
+			args{
+				peer:   p1,
+				scheme: v4ll,
+			},
+			&wgtypes.PeerConfig{
+				PublicKey:  p1.PublicKey,
+				AllowedIPs: []net.IPNet{v4ll.AddressNet(p1.PublicKey)},
+			},
+			true,
+		},
+		{
+			"ipv4 present",
+			args{
+				peer: &wgtypes.Peer{
+					PublicKey:  p1.PublicKey,
+					AllowedIPs: []net.IPNet{v4ll.AddressNet(p1.PublicKey)},
+				},
+				scheme: v4ll,
+			},
+			nil,
+			false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotPeerConfig, gotAdded := EnsurePeerAutoIP(tt.args.peer, tt.args.cfg)
+			gotPeerConfig, gotAdded := EnsurePeerAutoIP(tt.args.peer, tt.args.cfg, tt.args.scheme)
 			assert.Equal(t, tt.wantPeerConfig, gotPeerConfig, "EnsurePeerAutoIP() peerConfig")
 			assert.Equal(t, tt.wantAdded, gotAdded, "EnsurePeerAutoIP() added")
 		})
@@ -302,7 +408,7 @@ func TestOnlyAutoIP(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := OnlyAutoIP(tt.args.peer, tt.args.cfg)
+			got := OnlyAutoIP(tt.args.peer, tt.args.cfg, nil)
 			assert.Equal(t, tt.want, got)
 		})
 	}
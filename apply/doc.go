@@ -1,3 +1,8 @@
 // Package apply contains code for applying changes to network interfaces and
 // wireguard configurations.
 package apply
+
+import "github.com/fastcat/wirelink/log"
+
+// logger is used for all logging in the apply package
+var logger = log.For("apply")
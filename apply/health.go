@@ -30,13 +30,13 @@ const HandshakeValidity = HandshakeValidityBase + HealthHysteresisBandaid
 // we should consider updating its config to try to find a working setup.
 // note that this is separate from being "Alive", which means that we have heard
 // fact packet(s) from it recently
-func isHealthy(state *PeerConfigState, peer *wgtypes.Peer) bool {
+func isHealthy(state *PeerConfigState, peer *wgtypes.Peer, now time.Time) bool {
 	// if the peer doesn't have an endpoint, it's not healthy
 	if peer.Endpoint == nil {
 		return false
 	}
 	// if the peer handshake is still valid, the peer is healthy
-	if peer.LastHandshakeTime.Add(HandshakeValidity).After(time.Now()) {
+	if peer.LastHandshakeTime.Add(HandshakeValidity).After(now) {
 		return true
 	}
 	// if the peer handshake has moved forwards since we last saw it, probably healthy
@@ -48,6 +48,6 @@ func isHealthy(state *PeerConfigState, peer *wgtypes.Peer) bool {
 
 // IsHandshakeHealthy returns whether the handshake looks recent enough that the
 // peer is likely to be in communication.
-func IsHandshakeHealthy(lastHandshake time.Time) bool {
-	return lastHandshake.Add(HandshakeValidity).After(time.Now())
+func IsHandshakeHealthy(lastHandshake, now time.Time) bool {
+	return lastHandshake.Add(HandshakeValidity).After(now)
 }
@@ -74,7 +74,7 @@ func Test_isHealthy(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := isHealthy(tt.args.state, tt.args.peer)
+			got := isHealthy(tt.args.state, tt.args.peer, now)
 			t.Logf("deltas: %v, %v, %v", now.Sub(then), now.Sub(longAgo), now.Sub(longLongAgo))
 			assert.Equal(t, tt.want, got)
 		})
@@ -100,7 +100,7 @@ func TestIsHandshakeHealthy(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := IsHandshakeHealthy(tt.args.lastHandshake)
+			got := IsHandshakeHealthy(tt.args.lastHandshake, now)
 			assert.Equal(t, tt.want, got)
 		})
 	}
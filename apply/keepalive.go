@@ -0,0 +1,56 @@
+package apply
+
+import (
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// NATKeepalive is the PersistentKeepaliveInterval we set for peers when we are
+// behind NAT, which is the value recommended by wireguard for keeping NAT
+// mappings open
+const NATKeepalive = 25 * time.Second
+
+// EnsureKeepalive ensures that the config (if any) for the given peer sets or
+// clears its PersistentKeepaliveInterval, depending on whether it should have
+// one. It returns a cloned PeerConfigState that records when it sets the
+// keepalive, and it only ever clears one it set itself, so a keepalive
+// configured outside wirelink is never changed, even if it has the same value.
+// The returned state should only be kept once the config has been applied.
+// NOTE: It is safe to call this on a `nil` pointer, it will return a new state.
+func (pcs *PeerConfigState) EnsureKeepalive(
+	peer *wgtypes.Peer,
+	cfg *wgtypes.PeerConfig,
+	keepalive bool,
+) (state *PeerConfigState, peerConfig *wgtypes.PeerConfig, changed bool) {
+	state = pcs.EnsureNotNil()
+	var interval time.Duration
+	if keepalive {
+		if peer.PersistentKeepaliveInterval != 0 {
+			return state, cfg, false
+		}
+		interval = NATKeepalive
+	} else {
+		if !state.keepaliveSet {
+			return state, cfg, false
+		}
+		// whatever happens, it's no longer ours to clear
+		state = state.Clone()
+		state.keepaliveSet = false
+		if peer.PersistentKeepaliveInterval != NATKeepalive {
+			// someone else changed it since we set it
+			return state, cfg, false
+		}
+	}
+	if cfg == nil {
+		cfg = &wgtypes.PeerConfig{
+			PublicKey: peer.PublicKey,
+		}
+	}
+	cfg.PersistentKeepaliveInterval = &interval
+	if state.keepaliveSet != keepalive {
+		state = state.Clone()
+		state.keepaliveSet = keepalive
+	}
+	return state, cfg, true
+}
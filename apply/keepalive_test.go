@@ -0,0 +1,143 @@
+package apply
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/internal/testutils"
+
+	"github.com/stretchr/testify/assert"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestPeerConfigState_EnsureKeepalive(t *testing.T) {
+	k := testutils.MustKey(t)
+	ep := testutils.RandUDP4Addr(t)
+	on := NATKeepalive
+	off := time.Duration(0)
+
+	tests := []struct {
+		name        string
+		set         bool
+		peer        *wgtypes.Peer
+		cfg         *wgtypes.PeerConfig
+		keepalive   bool
+		wantConfig  *wgtypes.PeerConfig
+		wantChanged bool
+		wantSet     bool
+	}{
+		{
+			"add",
+			false,
+			&wgtypes.Peer{PublicKey: k},
+			nil,
+			true,
+			&wgtypes.PeerConfig{PublicKey: k, PersistentKeepaliveInterval: &on},
+			true,
+			true,
+		},
+		{
+			"add to existing config",
+			false,
+			&wgtypes.Peer{PublicKey: k},
+			&wgtypes.PeerConfig{PublicKey: k, Endpoint: ep},
+			true,
+			&wgtypes.PeerConfig{PublicKey: k, Endpoint: ep, PersistentKeepaliveInterval: &on},
+			true,
+			true,
+		},
+		{
+			"already set by us",
+			true,
+			&wgtypes.Peer{PublicKey: k, PersistentKeepaliveInterval: NATKeepalive},
+			nil,
+			true,
+			nil,
+			false,
+			true,
+		},
+		{
+			"already set by someone else",
+			false,
+			&wgtypes.Peer{PublicKey: k, PersistentKeepaliveInterval: NATKeepalive},
+			nil,
+			true,
+			nil,
+			false,
+			false,
+		},
+		{
+			"keep custom",
+			false,
+			&wgtypes.Peer{PublicKey: k, PersistentKeepaliveInterval: time.Second},
+			nil,
+			true,
+			nil,
+			false,
+			false,
+		},
+		{
+			"remove ours",
+			true,
+			&wgtypes.Peer{PublicKey: k, PersistentKeepaliveInterval: NATKeepalive},
+			nil,
+			false,
+			&wgtypes.PeerConfig{PublicKey: k, PersistentKeepaliveInterval: &off},
+			true,
+			false,
+		},
+		{
+			"don't remove one configured with the same value",
+			false,
+			&wgtypes.Peer{PublicKey: k, PersistentKeepaliveInterval: NATKeepalive},
+			nil,
+			false,
+			nil,
+			false,
+			false,
+		},
+		{
+			"don't remove custom",
+			false,
+			&wgtypes.Peer{PublicKey: k, PersistentKeepaliveInterval: time.Second},
+			nil,
+			false,
+			nil,
+			false,
+			false,
+		},
+		{
+			"don't remove ours changed by someone else",
+			true,
+			&wgtypes.Peer{PublicKey: k, PersistentKeepaliveInterval: time.Second},
+			nil,
+			false,
+			nil,
+			false,
+			false,
+		},
+		{
+			"already off",
+			false,
+			&wgtypes.Peer{PublicKey: k},
+			nil,
+			false,
+			nil,
+			false,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pcs := (*PeerConfigState)(nil).EnsureNotNil()
+			pcs.keepaliveSet = tt.set
+			gotState, gotConfig, gotChanged := pcs.EnsureKeepalive(tt.peer, tt.cfg, tt.keepalive)
+			assert.Equal(t, tt.wantConfig, gotConfig)
+			assert.Equal(t, tt.wantChanged, gotChanged)
+			assert.Equal(t, tt.wantSet, gotState.keepaliveSet)
+			// the input state is never modified
+			assert.Equal(t, tt.set, pcs.keepaliveSet)
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package apply
+
+import (
+	"fmt"
+	"time"
+)
+
+// LinkQuality summarizes the results of echo probes sent to a peer
+type LinkQuality struct {
+	// Samples is how many probe replies have been received
+	Samples int
+	// RTT is the smoothed round trip time
+	RTT time.Duration
+	// Jitter is the smoothed variation in round trip time between consecutive
+	// probes
+	Jitter time.Duration
+	// Loss is the fraction of recent probes that got no reply, from 0 to 1
+	Loss float64
+}
+
+// IsMeasured returns whether there is any data in the LinkQuality
+func (lq LinkQuality) IsMeasured() bool {
+	return lq.Samples > 0
+}
+
+func (lq LinkQuality) String() string {
+	if !lq.IsMeasured() {
+		return "unmeasured"
+	}
+	return fmt.Sprintf("rtt %v±%v loss %.0f%%",
+		lq.RTT.Truncate(time.Microsecond*100),
+		lq.Jitter.Truncate(time.Microsecond*100),
+		lq.Loss*100,
+	)
+}
+
+// LinkQuality returns the last recorded LinkQuality for the peer
+func (pcs *PeerConfigState) LinkQuality() LinkQuality {
+	if pcs == nil {
+		return LinkQuality{}
+	}
+	return pcs.linkQuality
+}
+
+// WithLinkQuality returns a cloned PeerConfigState with the given LinkQuality
+// recorded in it.
+// NOTE: It is safe to call this on a `nil` pointer, it will return a new state.
+func (pcs *PeerConfigState) WithLinkQuality(lq LinkQuality) *PeerConfigState {
+	pcs = pcs.EnsureNotNil().Clone()
+	pcs.linkQuality = lq
+	return pcs
+}
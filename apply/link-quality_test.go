@@ -0,0 +1,52 @@
+package apply
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinkQuality_String(t *testing.T) {
+	tests := []struct {
+		name string
+		lq   LinkQuality
+		want string
+	}{
+		{"zero", LinkQuality{}, "unmeasured"},
+		{"no samples", LinkQuality{Loss: 1}, "unmeasured"},
+		{
+			"measured",
+			LinkQuality{Samples: 1, RTT: 1234567 * time.Nanosecond, Jitter: 56789 * time.Nanosecond},
+			"rtt 1.2ms±0s loss 0%",
+		},
+		{
+			"lossy",
+			LinkQuality{Samples: 5, RTT: 100 * time.Millisecond, Jitter: 20 * time.Millisecond, Loss: 0.5},
+			"rtt 100ms±20ms loss 50%",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.lq.String())
+		})
+	}
+}
+
+func TestPeerConfigState_WithLinkQuality(t *testing.T) {
+	lq := LinkQuality{Samples: 1, RTT: time.Millisecond}
+
+	var nilPCS *PeerConfigState
+	assert.Equal(t, LinkQuality{}, nilPCS.LinkQuality())
+	got := nilPCS.WithLinkQuality(lq)
+	if assert.NotNil(t, got) {
+		assert.Equal(t, lq, got.LinkQuality())
+	}
+
+	pcs := &PeerConfigState{lastHealthy: true}
+	got = pcs.WithLinkQuality(lq)
+	assert.Equal(t, lq, got.LinkQuality())
+	assert.True(t, got.IsHealthy())
+	// original must not be modified
+	assert.Equal(t, LinkQuality{}, pcs.LinkQuality())
+}
@@ -7,41 +7,88 @@ import (
 
 	"github.com/fastcat/wirelink/autopeer"
 	"github.com/fastcat/wirelink/internal/networking"
-	"github.com/fastcat/wirelink/log"
-	"github.com/fastcat/wirelink/util"
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-// EnsureLocalAutoIP makes sure that the automatic IPv6 link-local IP is
-// present on the interface that matches the device
+// EnsureLocalAutoIP makes sure that the automatic address is present on the
+// interface that matches the device
 // It returns whether it had to add it, and if any errors happened
-func EnsureLocalAutoIP(env networking.Environment, dev *wgtypes.Device) (bool, error) {
+func EnsureLocalAutoIP(env networking.Environment, dev *wgtypes.Device, scheme *autopeer.Scheme) (bool, error) {
+	iface, found, err := findLocalAutoIP(env, dev, scheme)
+	if err != nil || found {
+		return false, err
+	}
+
+	autoaddr := scheme.LocalNet(dev.PublicKey)
+	err = iface.AddAddr(autoaddr)
+	if err != nil {
+		return false, errors.Wrapf(err, "Unable to add %v to %s", autoaddr.IP, dev.Name)
+	}
+
+	logger.Debug("Added local auto address %v to %s", autoaddr.IP, dev.Name)
+
+	return true, nil
+}
+
+// HasLocalAutoIP checks if the automatic address is present on the interface
+// that matches the device, without changing anything
+func HasLocalAutoIP(env networking.Environment, dev *wgtypes.Device, scheme *autopeer.Scheme) (bool, error) {
+	_, found, err := findLocalAutoIP(env, dev, scheme)
+	return found, err
+}
+
+func findLocalAutoIP(env networking.Environment, dev *wgtypes.Device, scheme *autopeer.Scheme) (networking.Interface, bool, error) {
 	iface, err := env.InterfaceByName(dev.Name)
 	if err != nil {
-		return false, errors.Wrapf(err, "Unable to get interface info for %s", dev.Name)
+		return nil, false, errors.Wrapf(err, "Unable to get interface info for %s", dev.Name)
 	}
 	addrs, err := iface.Addrs()
 	if err != nil {
-		return false, errors.Wrapf(err, "Unable to get addresses for %s", dev.Name)
+		return nil, false, errors.Wrapf(err, "Unable to get addresses for %s", dev.Name)
 	}
 
-	autoaddr := autopeer.AutoAddress(dev.PublicKey)
+	autoaddr := scheme.LocalNet(dev.PublicKey)
+	expectedOnes, expectedBits := autoaddr.Mask.Size()
 	for _, addr := range addrs {
-		if util.IsIPv6LLMatch(autoaddr, &addr, true) {
-			return false, nil
+		ones, bits := addr.Mask.Size()
+		if ones == expectedOnes && bits == expectedBits && autoaddr.IP.Equal(addr.IP) {
+			return iface, true, nil
 		}
 	}
+	return iface, false, nil
+}
 
-	err = iface.AddAddr(net.IPNet{
-		IP:   autoaddr,
-		Mask: net.CIDRMask(4*net.IPv6len, 8*net.IPv6len),
-	})
+// EnsureLocalAddrs makes sure that the given addresses are present on the
+// interface that matches the device.
+// It returns the addresses it had to add, and if any errors happened
+func EnsureLocalAddrs(env networking.Environment, dev *wgtypes.Device, addrs []net.IPNet) (added []net.IPNet, err error) {
+	iface, err := env.InterfaceByName(dev.Name)
 	if err != nil {
-		return false, errors.Wrapf(err, "Unable to add %v to %s", autoaddr, dev.Name)
+		return nil, errors.Wrapf(err, "Unable to get interface info for %s", dev.Name)
+	}
+	current, err := iface.Addrs()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to get addresses for %s", dev.Name)
 	}
 
-	log.Debug("Added local IPv6-LL %v to %s", autoaddr, dev.Name)
+	for _, addr := range addrs {
+		found := false
+		for _, c := range current {
+			if c.IP.Equal(addr.IP) {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		if err = iface.AddAddr(addr); err != nil {
+			return added, errors.Wrapf(err, "Unable to add %v to %s", addr, dev.Name)
+		}
+		logger.Debug("Added local address %v to %s", addr, dev.Name)
+		added = append(added, addr)
+	}
 
-	return true, nil
+	return added, nil
 }
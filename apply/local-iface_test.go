@@ -20,9 +20,15 @@ func TestEnsureLocalAutoIP(t *testing.T) {
 	in1 := fmt.Sprintf("wg%d", rand.Int31())
 	k1 := testutils.MustKey(t)
 
+	ula, err := autopeer.ParseScheme("fd12:3456:789a::/48")
+	require.NoError(t, err)
+	v4ll, err := autopeer.ParseScheme(autopeer.SchemeIPv4LinkLocal)
+	require.NoError(t, err)
+
 	type args struct {
-		env func(*testing.T) *mocks.Environment
-		dev *wgtypes.Device
+		env    func(*testing.T) *mocks.Environment
+		dev    *wgtypes.Device
+		scheme *autopeer.Scheme
 	}
 	tests := []struct {
 		name    string
@@ -73,12 +79,168 @@ func TestEnsureLocalAutoIP(t *testing.T) {
 			true,
 			false,
 		},
+		{
+			"already configured ula",
+			args{
+				env: func(t *testing.T) *mocks.Environment {
+					ret := &mocks.Environment{}
+					ret.WithSimpleInterfaces(map[string]net.IPNet{
+						in1: ula.LocalNet(k1),
+					})
+					return ret
+				},
+				dev: &wgtypes.Device{
+					Name:      in1,
+					PublicKey: k1,
+				},
+				scheme: ula,
+			},
+			false,
+			false,
+		},
+		{
+			"do configure ipv4",
+			args{
+				env: func(t *testing.T) *mocks.Environment {
+					ret := &mocks.Environment{}
+					ii := ret.WithSimpleInterfaces(map[string]net.IPNet{
+						in1: {
+							IP:   autopeer.AutoAddress(k1),
+							Mask: net.CIDRMask(64, 128),
+						},
+					})
+					ii[in1].On("AddAddr", net.IPNet{
+						IP:   v4ll.Address(k1),
+						Mask: net.CIDRMask(16, 32),
+					}).Return(nil)
+					return ret
+				},
+				dev: &wgtypes.Device{
+					Name:      in1,
+					PublicKey: k1,
+				},
+				scheme: v4ll,
+			},
+			true,
+			false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			env := tt.args.env(t)
 			env.Test(t)
-			got, err := EnsureLocalAutoIP(env, tt.args.dev)
+			got, err := EnsureLocalAutoIP(env, tt.args.dev, tt.args.scheme)
+			if tt.wantErr {
+				require.NotNil(t, err)
+			} else {
+				require.Nil(t, err)
+			}
+			assert.Equal(t, tt.want, got)
+			env.AssertExpectations(t)
+		})
+	}
+}
+
+func TestHasLocalAutoIP(t *testing.T) {
+	in1 := fmt.Sprintf("wg%d", rand.Int31())
+	k1 := testutils.MustKey(t)
+	dev := &wgtypes.Device{
+		Name:      in1,
+		PublicKey: k1,
+	}
+	v4ll, err := autopeer.ParseScheme(autopeer.SchemeIPv4LinkLocal)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		addr    net.IPNet
+		scheme  *autopeer.Scheme
+		want    bool
+		wantErr bool
+	}{
+		{
+			"present",
+			net.IPNet{
+				IP:   autopeer.AutoAddress(k1),
+				Mask: net.CIDRMask(64, 128),
+			},
+			nil,
+			true,
+			false,
+		},
+		{
+			"missing",
+			testutils.RandIPNet(t, net.IPv4len, nil, nil, 24),
+			nil,
+			false,
+			false,
+		},
+		{
+			"ipv4 present",
+			v4ll.LocalNet(k1),
+			v4ll,
+			true,
+			false,
+		},
+		{
+			"ipv4 wrong mask",
+			net.IPNet{
+				IP:   v4ll.Address(k1),
+				Mask: net.CIDRMask(32, 32),
+			},
+			v4ll,
+			false,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := &mocks.Environment{}
+			env.Test(t)
+			// no AddAddr mock: it must not try to add the address
+			env.WithSimpleInterfaces(map[string]net.IPNet{in1: tt.addr})
+			got, err := HasLocalAutoIP(env, dev, tt.scheme)
+			if tt.wantErr {
+				require.NotNil(t, err)
+			} else {
+				require.Nil(t, err)
+			}
+			assert.Equal(t, tt.want, got)
+			env.AssertExpectations(t)
+		})
+	}
+}
+
+func TestEnsureLocalAddrs(t *testing.T) {
+	in1 := fmt.Sprintf("wg%d", rand.Int31())
+	dev := &wgtypes.Device{
+		Name:      in1,
+		PublicKey: testutils.MustKey(t),
+	}
+	present := testutils.MakeIPv4Net(10, 1, 0, 1, 32)
+	missing := testutils.MakeIPv4Net(10, 1, 0, 2, 32)
+
+	tests := []struct {
+		name    string
+		addrs   []net.IPNet
+		addErr  error
+		want    []net.IPNet
+		wantErr bool
+	}{
+		{"nothing", nil, nil, nil, false},
+		{"present", []net.IPNet{present}, nil, nil, false},
+		{"missing", []net.IPNet{present, missing}, nil, []net.IPNet{missing}, false},
+		{"add fails", []net.IPNet{missing}, fmt.Errorf("boom"), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := &mocks.Environment{}
+			env.Test(t)
+			ii := env.WithSimpleInterfaces(map[string]net.IPNet{in1: present})
+			if len(tt.want) != 0 || tt.addErr != nil {
+				ii[in1].On("AddAddr", missing).Return(tt.addErr)
+			}
+			got, err := EnsureLocalAddrs(env, dev, tt.addrs)
 			if tt.wantErr {
 				require.NotNil(t, err)
 			} else {
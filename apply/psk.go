@@ -0,0 +1,78 @@
+package apply
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// pskLabel separates the preshared key derivation from any other use of the
+// network secret
+const pskLabel = "wirelink psk v1\x00"
+
+// PSKEpoch is the number of the rotation period that contains now
+func PSKEpoch(now time.Time, period time.Duration) uint64 {
+	return uint64(now.UnixNano() / int64(period))
+}
+
+// PSKGrace is how close to the boundary between two rotation periods the keys
+// for both of them are acceptable, so that a pair of peers can still agree on
+// one if their clocks differ by less than this. It is capped at a quarter of
+// the rotation period.
+const PSKGrace = 5 * time.Minute
+
+// PSKEpochs returns the rotation epochs whose keys are acceptable at now: the
+// ones either side of the nearest boundary, if it is within PSKGrace, or else
+// just the current one, as both results.
+func PSKEpochs(now time.Time, period time.Duration) (first, last uint64) {
+	grace := PSKGrace
+	if grace > period/4 {
+		grace = period / 4
+	}
+	epoch := PSKEpoch(now, period)
+	if before := PSKEpoch(now.Add(-grace), period); before != epoch {
+		return before, epoch
+	}
+	if after := PSKEpoch(now.Add(grace), period); after != epoch {
+		return epoch, after
+	}
+	return epoch, epoch
+}
+
+// PairPSK derives the preshared key for a pair of peers from the network
+// secret, for the given rotation epoch. It is the same regardless of which
+// order the peers are given.
+func PairPSK(secret []byte, a, b wgtypes.Key, epoch uint64) wgtypes.Key {
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b = b, a
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(pskLabel))
+	mac.Write(a[:])
+	mac.Write(b[:])
+	var epochBytes [8]byte
+	binary.BigEndian.PutUint64(epochBytes[:], epoch)
+	mac.Write(epochBytes[:])
+	var ret wgtypes.Key
+	copy(ret[:], mac.Sum(nil))
+	return ret
+}
+
+// EnsurePSK ensures that the config (if any) for the given peer sets its
+// preshared key to the given value, if it doesn't have it already.
+func EnsurePSK(peer *wgtypes.Peer, cfg *wgtypes.PeerConfig, psk wgtypes.Key) (peerConfig *wgtypes.PeerConfig, changed bool) {
+	if peer.PresharedKey == psk {
+		return cfg, false
+	}
+	if cfg == nil {
+		cfg = &wgtypes.PeerConfig{
+			PublicKey: peer.PublicKey,
+		}
+	}
+	cfg.PresharedKey = &psk
+	return cfg, true
+}
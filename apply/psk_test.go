@@ -0,0 +1,108 @@
+package apply
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/internal/testutils"
+
+	"github.com/stretchr/testify/assert"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestPSKEpoch(t *testing.T) {
+	period := time.Hour
+	start := time.Unix(0, 0).Add(1000 * period)
+	assert.Equal(t, uint64(1000), PSKEpoch(start, period))
+	assert.Equal(t, uint64(1000), PSKEpoch(start.Add(period-time.Nanosecond), period))
+	assert.Equal(t, uint64(1001), PSKEpoch(start.Add(period), period))
+}
+
+func TestPSKEpochs(t *testing.T) {
+	period := time.Hour
+	start := time.Unix(0, 0).Add(1000 * period)
+	tests := []struct {
+		name        string
+		now         time.Time
+		first, last uint64
+	}{
+		{"boundary", start, 999, 1000},
+		{"just after", start.Add(PSKGrace - time.Nanosecond), 999, 1000},
+		{"after grace", start.Add(PSKGrace), 1000, 1000},
+		{"middle", start.Add(period / 2), 1000, 1000},
+		{"before grace", start.Add(period - PSKGrace - time.Nanosecond), 1000, 1000},
+		{"just before", start.Add(period - PSKGrace), 1000, 1001},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, last := PSKEpochs(tt.now, period)
+			assert.Equal(t, tt.first, first)
+			assert.Equal(t, tt.last, last)
+		})
+	}
+
+	// grace is capped for short periods
+	first, last := PSKEpochs(start.Add(PSKGrace/2), 2*PSKGrace)
+	assert.Equal(t, first, last)
+}
+
+func TestPairPSK(t *testing.T) {
+	secret := testutils.MustRandBytes(t, make([]byte, 32))
+	otherSecret := testutils.MustRandBytes(t, make([]byte, 32))
+	a := testutils.MustKey(t)
+	b := testutils.MustKey(t)
+	c := testutils.MustKey(t)
+
+	psk := PairPSK(secret, a, b, 1)
+	assert.NotEqual(t, wgtypes.Key{}, psk)
+	// both ends derive the same key
+	assert.Equal(t, psk, PairPSK(secret, b, a, 1))
+	// but it is different for every pair, epoch, and secret
+	assert.NotEqual(t, psk, PairPSK(secret, a, c, 1))
+	assert.NotEqual(t, psk, PairPSK(secret, a, b, 2))
+	assert.NotEqual(t, psk, PairPSK(otherSecret, a, b, 1))
+}
+
+func TestEnsurePSK(t *testing.T) {
+	k := testutils.MustKey(t)
+	psk := testutils.MustKey(t)
+	ep := testutils.RandUDP4Addr(t)
+
+	tests := []struct {
+		name        string
+		peer        *wgtypes.Peer
+		cfg         *wgtypes.PeerConfig
+		wantConfig  *wgtypes.PeerConfig
+		wantChanged bool
+	}{
+		{
+			"already set",
+			&wgtypes.Peer{PublicKey: k, PresharedKey: psk},
+			nil,
+			nil,
+			false,
+		},
+		{
+			"new config",
+			&wgtypes.Peer{PublicKey: k},
+			nil,
+			&wgtypes.PeerConfig{PublicKey: k, PresharedKey: &psk},
+			true,
+		},
+		{
+			"existing config",
+			&wgtypes.Peer{PublicKey: k, PresharedKey: testutils.MustKey(t)},
+			&wgtypes.PeerConfig{PublicKey: k, Endpoint: ep},
+			&wgtypes.PeerConfig{PublicKey: k, Endpoint: ep, PresharedKey: &psk},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotConfig, gotChanged := EnsurePSK(tt.peer, tt.cfg, psk)
+			assert.Equal(t, tt.wantConfig, gotConfig)
+			assert.Equal(t, tt.wantChanged, gotChanged)
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package apply
+
+import (
+	"time"
+
+	"github.com/fastcat/wirelink/detect"
+	"github.com/fastcat/wirelink/fact"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// RelayCandidates finds the peers that could relay traffic for others, and
+// the peers which need a relay, as used by ChooseRelays.
+//
+// Targets are peers that are not healthy, are not routers, and have
+// AllowedIPs beyond their automatic address. Candidate relays are peers that
+// advertise the relay flag (or for which `isRelay` returns true), are healthy
+// and alive (or basic), and are not routers. Whether a peer is a router is
+// judged from its AllowedIP facts, not its current config, since relays will
+// pick up other peers' AllowedIPs.
+func RelayCandidates(
+	peers []wgtypes.Peer,
+	factsByPeer map[wgtypes.Key][]*fact.Fact,
+	states func(wgtypes.Key) (*PeerConfigState, bool),
+	isRelay func(wgtypes.Key) bool,
+) (relays, targets []*wgtypes.Peer) {
+	for i := range peers {
+		p := &peers[i]
+		state, _ := states(p.PublicKey)
+		if !state.IsRelay() && !isRelay(p.PublicKey) {
+			continue
+		}
+		if !usableForAllowedIPs(state) || claimsRouterAIPs(p.PublicKey, factsByPeer[p.PublicKey]) {
+			continue
+		}
+		relays = append(relays, p)
+	}
+	if len(relays) == 0 {
+		return nil, nil
+	}
+
+	for i := range peers {
+		p := &peers[i]
+		state, _ := states(p.PublicKey)
+		aips := relayableAllowedIPs(factsByPeer[p.PublicKey])
+		if state.IsHealthy() || len(aips) == 0 || claimsRouterAIPs(p.PublicKey, aips) {
+			continue
+		}
+		targets = append(targets, p)
+	}
+	return relays, targets
+}
+
+// ChooseRelays picks, for each peer that is configured locally but which we
+// cannot currently reach directly, a relay peer that should carry its
+// AllowedIPs instead, so that traffic to it goes through a nearby relay
+// instead of falling back to whatever router covers those addresses.
+//
+// Targets and candidate relays are found with RelayCandidates. A candidate is
+// only used for a target if `reach` says the relay has reported a healthy link
+// to it, along with the quality of that link. Candidates are ranked by the
+// quality of the whole path, combining the `quality` of our link to the relay
+// with what it reported: lowest loss first, then lowest RTT, with paths that
+// have not been measured ranked last. Ties go to the relay that has been
+// healthy and alive the longest. If a candidate already holds one of the
+// target's AllowedIPs it is kept, unless another has a path with lower loss.
+//
+// The return maps target keys to the key of the chosen relay. Targets for which
+// no relay is available are omitted.
+func ChooseRelays(
+	peers []wgtypes.Peer,
+	factsByPeer map[wgtypes.Key][]*fact.Fact,
+	states func(wgtypes.Key) (*PeerConfigState, bool),
+	isRelay func(wgtypes.Key) bool,
+	quality func(wgtypes.Key) LinkQuality,
+	reach func(relay, target wgtypes.Key) (LinkQuality, bool),
+) map[wgtypes.Key]wgtypes.Key {
+	relays, targets := RelayCandidates(peers, factsByPeer, states, isRelay)
+	if len(relays) == 0 {
+		return nil
+	}
+
+	ret := make(map[wgtypes.Key]wgtypes.Key)
+	for _, p := range targets {
+		aips := relayableAllowedIPs(factsByPeer[p.PublicKey])
+
+		var best, holder *wgtypes.Peer
+		var bestState *PeerConfigState
+		var bestPath, holderPath relayPath
+		for _, r := range relays {
+			if r.PublicKey == p.PublicKey {
+				continue
+			}
+			reported, ok := reach(r.PublicKey, p.PublicKey)
+			if !ok {
+				continue
+			}
+			path := makeRelayPath(quality(r.PublicKey), reported)
+			if holder == nil && holdsAnyAllowedIP(r, aips) {
+				holder, holderPath = r, path
+			}
+			rState, _ := states(r.PublicKey)
+			if best == nil || path.better(bestPath) ||
+				!bestPath.better(path) && preferAliveLonger(rState, bestState, &r.PublicKey, &best.PublicKey) {
+				best, bestState, bestPath = r, rState, path
+			}
+		}
+		// sticky: don't move the target between relays needlessly
+		if holder != nil && !bestPath.lessLossy(holderPath) {
+			best = holder
+		}
+		if best != nil {
+			ret[p.PublicKey] = best.PublicKey
+		}
+	}
+
+	return ret
+}
+
+// relayPath summarizes the quality of the path to a target through a relay
+type relayPath struct {
+	measured bool
+	loss     float64
+	rtt      time.Duration
+}
+
+func makeRelayPath(toRelay, fromRelay LinkQuality) relayPath {
+	if !toRelay.IsMeasured() || !fromRelay.IsMeasured() {
+		return relayPath{}
+	}
+	return relayPath{
+		measured: true,
+		loss:     1 - (1-toRelay.Loss)*(1-fromRelay.Loss),
+		rtt:      toRelay.RTT + fromRelay.RTT,
+	}
+}
+
+// better checks if rp is a strictly better path than other
+func (rp relayPath) better(other relayPath) bool {
+	if rp.measured != other.measured {
+		return rp.measured
+	}
+	if rp.loss != other.loss {
+		return rp.loss < other.loss
+	}
+	return rp.rtt < other.rtt
+}
+
+// lessLossy checks if rp has strictly lower loss than other, treating
+// unmeasured paths as worse than any measured one
+func (rp relayPath) lessLossy(other relayPath) bool {
+	if rp.measured != other.measured {
+		return rp.measured
+	}
+	return rp.measured && rp.loss < other.loss
+}
+
+// RelayFacts rewrites the AllowedIP facts for each relayed target so that they
+// can be passed to EnsureAllowedIPs for the relay peer, returning the extra
+// facts to add for each relay.
+func RelayFacts(
+	relays map[wgtypes.Key]wgtypes.Key,
+	factsByPeer map[wgtypes.Key][]*fact.Fact,
+) map[wgtypes.Key][]*fact.Fact {
+	if len(relays) == 0 {
+		return nil
+	}
+	ret := make(map[wgtypes.Key][]*fact.Fact)
+	for target, relay := range relays {
+		for _, f := range relayableAllowedIPs(factsByPeer[target]) {
+			ret[relay] = append(ret[relay], &fact.Fact{
+				Attribute: f.Attribute,
+				Subject:   &fact.PeerSubject{Key: relay},
+				Value:     f.Value,
+				Expires:   f.Expires,
+			})
+		}
+	}
+	return ret
+}
+
+func relayableAllowedIPs(facts []*fact.Fact) []*fact.Fact {
+	var ret []*fact.Fact
+	for _, f := range facts {
+		if f.Attribute == fact.AttributeAllowedCidrV4 || f.Attribute == fact.AttributeAllowedCidrV6 {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// claimsRouterAIPs checks if the facts for a peer would make it look like a
+// router. This is used instead of checking the current device config, as that
+// will change for relays once they start carrying traffic for other peers.
+func claimsRouterAIPs(key wgtypes.Key, facts []*fact.Fact) bool {
+	peer := &wgtypes.Peer{PublicKey: key}
+	for _, f := range relayableAllowedIPs(facts) {
+		if ipn, ok := f.Value.(*fact.IPNetValue); ok {
+			peer.AllowedIPs = append(peer.AllowedIPs, ipn.IPNet)
+		}
+	}
+	return detect.IsPeerRouter(peer)
+}
+
+func holdsAnyAllowedIP(peer *wgtypes.Peer, aipFacts []*fact.Fact) bool {
+	for _, aip := range peer.AllowedIPs {
+		key := ipNetKey(aip)
+		for _, f := range aipFacts {
+			if fvKey(f.Value) == key {
+				return true
+			}
+		}
+	}
+	return false
+}
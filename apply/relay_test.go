@@ -0,0 +1,438 @@
+package apply
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/internal/testutils"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChooseRelays(t *testing.T) {
+	now := time.Now()
+
+	target := testutils.MustKey(t)
+	relay1 := testutils.MustKey(t)
+	relay2 := testutils.MustKey(t)
+	// some tests need to know which relay wins a tie
+	if bytes.Compare(relay1[:], relay2[:]) > 0 {
+		relay1, relay2 = relay2, relay1
+	}
+	leaf := testutils.MustKey(t)
+	targetAIP := testutils.RandIPNet(t, net.IPv4len, []byte{10}, nil, 32)
+	routerAIP := testutils.RandIPNet(t, net.IPv4len, []byte{10}, nil, 8)
+	relayAIP := testutils.RandIPNet(t, net.IPv4len, []byte{10}, nil, 32)
+
+	relayState := func(since time.Time) *PeerConfigState {
+		return &PeerConfigState{
+			lastHealthy: true,
+			lastAlive:   true,
+			aliveSince:  since,
+			metadata:    map[fact.MemberAttribute]string{fact.MemberIsRelay: string([]byte{1})},
+		}
+	}
+	healthy := &PeerConfigState{lastHealthy: true, lastAlive: true, aliveSince: now}
+	dead := &PeerConfigState{}
+	deadRelay := &PeerConfigState{
+		metadata: map[fact.MemberAttribute]string{fact.MemberIsRelay: string([]byte{1})},
+	}
+
+	targetFacts := []*fact.Fact{aipFact(target, targetAIP)}
+
+	good := LinkQuality{Samples: 10, RTT: 10 * time.Millisecond}
+	slow := LinkQuality{Samples: 10, RTT: 100 * time.Millisecond}
+	lossy := LinkQuality{Samples: 10, RTT: 10 * time.Millisecond, Loss: 0.5}
+	// reports says the given relays have an unmeasured healthy link to the target
+	reports := func(relays ...wgtypes.Key) map[wgtypes.Key]LinkQuality {
+		ret := make(map[wgtypes.Key]LinkQuality, len(relays))
+		for _, r := range relays {
+			ret[r] = LinkQuality{}
+		}
+		return ret
+	}
+
+	type args struct {
+		peers       []wgtypes.Peer
+		factsByPeer map[wgtypes.Key][]*fact.Fact
+		states      map[wgtypes.Key]*PeerConfigState
+		configured  map[wgtypes.Key]bool
+		// quality is our link to each peer
+		quality map[wgtypes.Key]LinkQuality
+		// reach is what each relay reported about its link to the target
+		reach map[wgtypes.Key]LinkQuality
+	}
+	tests := []struct {
+		name string
+		args args
+		want map[wgtypes.Key]wgtypes.Key
+	}{
+		{
+			"no relays",
+			args{
+				peers:       []wgtypes.Peer{{PublicKey: target}, {PublicKey: leaf}},
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{target: targetFacts},
+				states:      map[wgtypes.Key]*PeerConfigState{target: dead, leaf: healthy},
+			},
+			nil,
+		},
+		{
+			"relay dead target",
+			args{
+				peers:       []wgtypes.Peer{{PublicKey: target}, {PublicKey: relay1}},
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{target: targetFacts},
+				states:      map[wgtypes.Key]*PeerConfigState{target: dead, relay1: relayState(now)},
+				reach:       reports(relay1),
+			},
+			map[wgtypes.Key]wgtypes.Key{target: relay1},
+		},
+		{
+			"relay from config",
+			args{
+				peers:       []wgtypes.Peer{{PublicKey: target}, {PublicKey: leaf}},
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{target: targetFacts},
+				states:      map[wgtypes.Key]*PeerConfigState{target: dead, leaf: healthy},
+				configured:  map[wgtypes.Key]bool{leaf: true},
+				reach:       reports(leaf),
+			},
+			map[wgtypes.Key]wgtypes.Key{target: leaf},
+		},
+		{
+			"don't relay healthy target",
+			args{
+				peers:       []wgtypes.Peer{{PublicKey: target}, {PublicKey: relay1}},
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{target: targetFacts},
+				states:      map[wgtypes.Key]*PeerConfigState{target: healthy, relay1: relayState(now)},
+				reach:       reports(relay1),
+			},
+			map[wgtypes.Key]wgtypes.Key{},
+		},
+		{
+			"don't relay target without AIPs",
+			args{
+				peers:  []wgtypes.Peer{{PublicKey: target}, {PublicKey: relay1}},
+				states: map[wgtypes.Key]*PeerConfigState{target: dead, relay1: relayState(now)},
+			},
+			map[wgtypes.Key]wgtypes.Key{},
+		},
+		{
+			"don't relay router target",
+			args{
+				peers: []wgtypes.Peer{{PublicKey: target}, {PublicKey: relay1}},
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{
+					target: {aipFact(target, routerAIP)},
+				},
+				states: map[wgtypes.Key]*PeerConfigState{target: dead, relay1: relayState(now)},
+			},
+			map[wgtypes.Key]wgtypes.Key{},
+		},
+		{
+			"don't use dead relay",
+			args{
+				peers:       []wgtypes.Peer{{PublicKey: target}, {PublicKey: relay1}},
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{target: targetFacts},
+				states:      map[wgtypes.Key]*PeerConfigState{target: dead, relay1: deadRelay},
+				reach:       reports(relay1),
+			},
+			nil,
+		},
+		{
+			"don't use router as relay",
+			args{
+				peers: []wgtypes.Peer{{PublicKey: target}, {PublicKey: relay1}},
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{
+					target: targetFacts,
+					relay1: {aipFact(relay1, routerAIP)},
+				},
+				states: map[wgtypes.Key]*PeerConfigState{target: dead, relay1: relayState(now)},
+				reach:  reports(relay1),
+			},
+			nil,
+		},
+		{
+			"relay holding target AIPs is not a router",
+			args{
+				peers: []wgtypes.Peer{
+					{PublicKey: target},
+					{PublicKey: relay1, AllowedIPs: []net.IPNet{targetAIP, routerAIP}},
+				},
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{
+					target: targetFacts,
+					relay1: {aipFact(relay1, relayAIP)},
+				},
+				states: map[wgtypes.Key]*PeerConfigState{target: dead, relay1: relayState(now)},
+				reach:  reports(relay1),
+			},
+			map[wgtypes.Key]wgtypes.Key{target: relay1},
+		},
+		{
+			"prefer relay alive longer",
+			args{
+				peers: []wgtypes.Peer{
+					{PublicKey: target},
+					{PublicKey: relay1},
+					{PublicKey: relay2},
+				},
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{target: targetFacts},
+				states: map[wgtypes.Key]*PeerConfigState{
+					target: dead,
+					relay1: relayState(now),
+					relay2: relayState(now.Add(-time.Minute)),
+				},
+				reach: reports(relay1, relay2),
+			},
+			map[wgtypes.Key]wgtypes.Key{target: relay2},
+		},
+		{
+			"sticky to current relay",
+			args{
+				peers: []wgtypes.Peer{
+					{PublicKey: target},
+					{PublicKey: relay1, AllowedIPs: []net.IPNet{targetAIP}},
+					{PublicKey: relay2},
+				},
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{target: targetFacts},
+				states: map[wgtypes.Key]*PeerConfigState{
+					target: dead,
+					relay1: relayState(now),
+					relay2: relayState(now.Add(-time.Minute)),
+				},
+				reach: reports(relay1, relay2),
+			},
+			map[wgtypes.Key]wgtypes.Key{target: relay1},
+		},
+		{
+			"don't use relay that can't reach target",
+			args{
+				peers: []wgtypes.Peer{
+					{PublicKey: target},
+					{PublicKey: relay1},
+					{PublicKey: relay2},
+				},
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{target: targetFacts},
+				states: map[wgtypes.Key]*PeerConfigState{
+					target: dead,
+					relay1: relayState(now),
+					relay2: relayState(now),
+				},
+				reach: reports(relay2),
+			},
+			map[wgtypes.Key]wgtypes.Key{target: relay2},
+		},
+		{
+			"avoid lossy relay",
+			args{
+				peers: []wgtypes.Peer{
+					{PublicKey: target},
+					{PublicKey: relay1},
+					{PublicKey: relay2},
+				},
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{target: targetFacts},
+				states: map[wgtypes.Key]*PeerConfigState{
+					target: dead,
+					relay1: relayState(now),
+					relay2: relayState(now),
+				},
+				quality: map[wgtypes.Key]LinkQuality{relay1: good, relay2: good},
+				reach:   map[wgtypes.Key]LinkQuality{relay1: lossy, relay2: good},
+			},
+			map[wgtypes.Key]wgtypes.Key{target: relay2},
+		},
+		{
+			"avoid lossy link to relay",
+			args{
+				peers: []wgtypes.Peer{
+					{PublicKey: target},
+					{PublicKey: relay1},
+					{PublicKey: relay2},
+				},
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{target: targetFacts},
+				states: map[wgtypes.Key]*PeerConfigState{
+					target: dead,
+					relay1: relayState(now),
+					relay2: relayState(now),
+				},
+				quality: map[wgtypes.Key]LinkQuality{relay1: lossy, relay2: good},
+				reach:   map[wgtypes.Key]LinkQuality{relay1: good, relay2: good},
+			},
+			map[wgtypes.Key]wgtypes.Key{target: relay2},
+		},
+		{
+			"prefer lower RTT",
+			args{
+				peers: []wgtypes.Peer{
+					{PublicKey: target},
+					{PublicKey: relay1},
+					{PublicKey: relay2},
+				},
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{target: targetFacts},
+				states: map[wgtypes.Key]*PeerConfigState{
+					target: dead,
+					relay1: relayState(now),
+					relay2: relayState(now),
+				},
+				quality: map[wgtypes.Key]LinkQuality{relay1: good, relay2: good},
+				reach:   map[wgtypes.Key]LinkQuality{relay1: slow, relay2: good},
+			},
+			map[wgtypes.Key]wgtypes.Key{target: relay2},
+		},
+		{
+			"prefer measured path",
+			args{
+				peers: []wgtypes.Peer{
+					{PublicKey: target},
+					{PublicKey: relay1},
+					{PublicKey: relay2},
+				},
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{target: targetFacts},
+				states: map[wgtypes.Key]*PeerConfigState{
+					target: dead,
+					relay1: relayState(now),
+					relay2: relayState(now),
+				},
+				quality: map[wgtypes.Key]LinkQuality{relay2: good},
+				reach:   map[wgtypes.Key]LinkQuality{relay1: good, relay2: slow},
+			},
+			map[wgtypes.Key]wgtypes.Key{target: relay2},
+		},
+		{
+			"move from lossy current relay",
+			args{
+				peers: []wgtypes.Peer{
+					{PublicKey: target},
+					{PublicKey: relay1, AllowedIPs: []net.IPNet{targetAIP}},
+					{PublicKey: relay2},
+				},
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{target: targetFacts},
+				states: map[wgtypes.Key]*PeerConfigState{
+					target: dead,
+					relay1: relayState(now),
+					relay2: relayState(now),
+				},
+				quality: map[wgtypes.Key]LinkQuality{relay1: good, relay2: good},
+				reach:   map[wgtypes.Key]LinkQuality{relay1: lossy, relay2: good},
+			},
+			map[wgtypes.Key]wgtypes.Key{target: relay2},
+		},
+		{
+			"stay on slower current relay",
+			args{
+				peers: []wgtypes.Peer{
+					{PublicKey: target},
+					{PublicKey: relay1, AllowedIPs: []net.IPNet{targetAIP}},
+					{PublicKey: relay2},
+				},
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{target: targetFacts},
+				states: map[wgtypes.Key]*PeerConfigState{
+					target: dead,
+					relay1: relayState(now),
+					relay2: relayState(now),
+				},
+				quality: map[wgtypes.Key]LinkQuality{relay1: good, relay2: good},
+				reach:   map[wgtypes.Key]LinkQuality{relay1: slow, relay2: good},
+			},
+			map[wgtypes.Key]wgtypes.Key{target: relay1},
+		},
+		{
+			"move from current relay that can't reach target",
+			args{
+				peers: []wgtypes.Peer{
+					{PublicKey: target},
+					{PublicKey: relay1, AllowedIPs: []net.IPNet{targetAIP}},
+					{PublicKey: relay2},
+				},
+				factsByPeer: map[wgtypes.Key][]*fact.Fact{target: targetFacts},
+				states: map[wgtypes.Key]*PeerConfigState{
+					target: dead,
+					relay1: relayState(now),
+					relay2: relayState(now),
+				},
+				reach: reports(relay2),
+			},
+			map[wgtypes.Key]wgtypes.Key{target: relay2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			states := func(k wgtypes.Key) (*PeerConfigState, bool) {
+				s, ok := tt.args.states[k]
+				return s, ok
+			}
+			isRelay := func(k wgtypes.Key) bool {
+				return tt.args.configured[k]
+			}
+			quality := func(k wgtypes.Key) LinkQuality {
+				return tt.args.quality[k]
+			}
+			reach := func(r, tg wgtypes.Key) (LinkQuality, bool) {
+				if tg != target {
+					return LinkQuality{}, false
+				}
+				lq, ok := tt.args.reach[r]
+				return lq, ok
+			}
+			got := ChooseRelays(tt.args.peers, tt.args.factsByPeer, states, isRelay, quality, reach)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRelayFacts(t *testing.T) {
+	now := time.Now()
+	target1 := testutils.MustKey(t)
+	target2 := testutils.MustKey(t)
+	relay := testutils.MustKey(t)
+	aip1 := makeIPNet(t)
+	aip2 := makeIPNet(t)
+
+	type args struct {
+		relays      map[wgtypes.Key]wgtypes.Key
+		factsByPeer map[wgtypes.Key][]*fact.Fact
+	}
+	tests := []struct {
+		name string
+		args args
+		want map[wgtypes.Key][]*fact.Fact
+	}{
+		{"nil", args{}, nil},
+		{
+			"two targets",
+			args{
+				map[wgtypes.Key]wgtypes.Key{target1: relay, target2: relay},
+				map[wgtypes.Key][]*fact.Fact{
+					target1: {
+						{Attribute: fact.AttributeMember, Subject: &fact.PeerSubject{Key: target1}, Value: &fact.EmptyValue{}, Expires: now},
+						{Attribute: fact.AttributeAllowedCidrV4, Subject: &fact.PeerSubject{Key: target1}, Value: &fact.IPNetValue{IPNet: aip1}, Expires: now},
+					},
+					target2: {
+						{Attribute: fact.AttributeAllowedCidrV4, Subject: &fact.PeerSubject{Key: target2}, Value: &fact.IPNetValue{IPNet: aip2}, Expires: now},
+					},
+				},
+			},
+			map[wgtypes.Key][]*fact.Fact{
+				relay: {
+					{Attribute: fact.AttributeAllowedCidrV4, Subject: &fact.PeerSubject{Key: relay}, Value: &fact.IPNetValue{IPNet: aip1}, Expires: now},
+					{Attribute: fact.AttributeAllowedCidrV4, Subject: &fact.PeerSubject{Key: relay}, Value: &fact.IPNetValue{IPNet: aip2}, Expires: now},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := RelayFacts(tt.args.relays, tt.args.factsByPeer)
+			if tt.want == nil {
+				assert.Nil(t, got)
+				return
+			}
+			assert.Len(t, got, len(tt.want))
+			for k, v := range tt.want {
+				assert.ElementsMatch(t, v, got[k])
+			}
+		})
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"github.com/google/uuid"
 
 	"github.com/fastcat/wirelink/fact"
-	"github.com/fastcat/wirelink/log"
 	"github.com/fastcat/wirelink/util"
 
 	"golang.zx2c4.com/wireguard/device"
@@ -27,6 +26,10 @@ type PeerConfigState struct {
 	// the string key is really just the bytes value
 	endpointLastUsed map[string]time.Time
 	metadata         map[fact.MemberAttribute]string
+	linkQuality      LinkQuality
+	// keepaliveSet records that we set the PersistentKeepaliveInterval on the
+	// peer, and so may clear it again
+	keepaliveSet bool
 }
 
 // EnsureNotNil returns either its receiver if not nil, or else a new object suitable to be its receiver
@@ -75,7 +78,7 @@ func (pcs *PeerConfigState) Update(
 	// clone before updates to prevent data races
 	pcs = pcs.Clone()
 	pcs.lastHandshake = peer.LastHandshakeTime
-	newHealthy := isHealthy(pcs, peer)
+	newHealthy := isHealthy(pcs, peer, now)
 	bootChanged := bootID != nil && pcs.lastBootID != nil && *bootID != *pcs.lastBootID
 	firstBoot := bootID != nil && pcs.lastBootID == nil
 	changed := newHealthy != pcs.lastHealthy || newAlive != pcs.lastAlive || bootChanged
@@ -123,9 +126,9 @@ func (pcs *PeerConfigState) Update(
 	}
 	// don't log the first boot as a reboot
 	if bootChanged && !firstBoot {
-		log.Info("Peer %s is now %s (rebooted)", name, pcs.Describe(now))
+		logger.Info("Peer %s is now %s (rebooted)", name, pcs.Describe(now))
 	} else if changed {
-		log.Info("Peer %s is now %s", name, pcs.Describe(now))
+		logger.Info("Peer %s is now %s", name, pcs.Describe(now))
 	}
 	return pcs
 }
@@ -138,16 +141,22 @@ func (pcs *PeerConfigState) Describe(now time.Time) string {
 	}
 	hsAge := now.Sub(pcs.lastHandshake).Truncate(time.Millisecond)
 	aliveFor := pcs.aliveUntil.Sub(now).Truncate(time.Millisecond)
+	var ret string
 	if pcs.lastHealthy {
 		if pcs.lastAlive {
-			return fmt.Sprintf("%s (%v -> %v)", "healthy and alive", hsAge, aliveFor)
+			ret = fmt.Sprintf("%s (%v -> %v)", "healthy and alive", hsAge, aliveFor)
+		} else {
+			ret = fmt.Sprintf("%s (%s)", "healthy but not alive", hsAge)
 		}
-		return fmt.Sprintf("%s (%s)", "healthy but not alive", hsAge)
 	} else if pcs.lastAlive {
-		return fmt.Sprintf("%s (%v -> %v)", "unhealthy but alive?", hsAge, aliveFor)
+		ret = fmt.Sprintf("%s (%v -> %v)", "unhealthy but alive?", hsAge, aliveFor)
 	} else {
-		return fmt.Sprintf("%s (%s)", "unhealthy", hsAge)
+		ret = fmt.Sprintf("%s (%s)", "unhealthy", hsAge)
 	}
+	if pcs.linkQuality.IsMeasured() {
+		ret += " [" + pcs.linkQuality.String() + "]"
+	}
+	return ret
 }
 
 // IsHealthy returns if the peer looked healthy on the last call to `Update`
@@ -199,11 +208,21 @@ func (pcs *PeerConfigState) IsBasic() bool {
 	return value[0] != 0
 }
 
+// IsRelay checks if there is a MemberIsRelay attribute present and its value
+// is truthy. If no attribute is present, it returns false.
+func (pcs *PeerConfigState) IsRelay() bool {
+	value, ok := pcs.TryGetMetadata(fact.MemberIsRelay)
+	if !ok || len(value) == 0 {
+		return false
+	}
+	return value[0] != 0
+}
+
 const endpointInterval = device.RekeyTimeout + device.KeepaliveTimeout
 
 // TimeForNextEndpoint returns if we should try another endpoint for the peer
 // (or if we should wait for the current endpoint to test out)
-func (pcs *PeerConfigState) TimeForNextEndpoint() bool {
+func (pcs *PeerConfigState) TimeForNextEndpoint(now time.Time) bool {
 	if pcs == nil {
 		// if we know nothing about the peer, we don't have an endpoint configured,
 		// and so we should definitely try to make one
@@ -227,7 +246,7 @@ func (pcs *PeerConfigState) TimeForNextEndpoint() bool {
 
 	// if it's been REKEY_TIMEOUT + KEEPALIVE since the last time we tried a new
 	// ep (i.e. wireguard thinks it's time to retry the handshake), try another
-	return timeOfLastEp.Add(endpointInterval).Before(time.Now())
+	return timeOfLastEp.Add(endpointInterval).Before(now)
 }
 
 // NextEndpoint recommends the next endpoint to try configuring on the peer,
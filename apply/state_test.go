@@ -214,6 +214,7 @@ func TestPeerConfigState_Describe(t *testing.T) {
 		lastBootID       *uuid.UUID
 		aliveSince       time.Time
 		endpointLastUsed map[string]time.Time
+		linkQuality      LinkQuality
 	}
 	tests := []struct {
 		name    string
@@ -249,7 +250,18 @@ func TestPeerConfigState_Describe(t *testing.T) {
 			"dead",
 			fields{lastHealthy: false, lastAlive: false},
 			[]string{"unhealthy"},
-			[]string{"?"},
+			[]string{"?", "rtt"},
+		},
+		{
+			"measured",
+			fields{
+				lastHealthy:   true,
+				lastAlive:     true,
+				lastHandshake: now,
+				linkQuality:   LinkQuality{Samples: 3, RTT: 12 * time.Millisecond, Jitter: time.Millisecond, Loss: 0.25},
+			},
+			[]string{"healthy", "alive", "rtt 12ms±1ms loss 25%"},
+			[]string{"unhealthy", "?"},
 		},
 	}
 	for _, tt := range tests {
@@ -261,6 +273,7 @@ func TestPeerConfigState_Describe(t *testing.T) {
 				lastBootID:       tt.fields.lastBootID,
 				aliveSince:       tt.fields.aliveSince,
 				endpointLastUsed: tt.fields.endpointLastUsed,
+				linkQuality:      tt.fields.linkQuality,
 			}
 			if tt.fields.nil {
 				pcs = nil
@@ -354,7 +367,7 @@ func TestPeerConfigState_TimeForNextEndpoint(t *testing.T) {
 			if tt.fields.nil {
 				pcs = nil
 			}
-			got := pcs.TimeForNextEndpoint()
+			got := pcs.TimeForNextEndpoint(now)
 			t.Logf("deltas: %v, %v, %v", now.Sub(t1), t1.Sub(t2), t2.Sub(t3))
 			assert.Equal(t, tt.want, got)
 		})
@@ -658,3 +671,23 @@ func TestPeerConfigState_AliveSince(t *testing.T) {
 		})
 	}
 }
+
+func TestPeerConfigState_IsRelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[fact.MemberAttribute]string
+		want     bool
+	}{
+		{"no metadata", nil, false},
+		{"no flag", map[fact.MemberAttribute]string{fact.MemberName: "foo"}, false},
+		{"empty flag", map[fact.MemberAttribute]string{fact.MemberIsRelay: ""}, false},
+		{"false", map[fact.MemberAttribute]string{fact.MemberIsRelay: string([]byte{0})}, false},
+		{"true", map[fact.MemberAttribute]string{fact.MemberIsRelay: string([]byte{1})}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pcs := &PeerConfigState{metadata: tt.metadata}
+			assert.Equal(t, tt.want, pcs.IsRelay())
+		})
+	}
+}
@@ -0,0 +1,239 @@
+// Package audit provides a record of the changes wirelink makes to the
+// wireguard device configuration, and the facts that caused them.
+package audit
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/util"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Action describes what kind of change an Entry records
+type Action string
+
+const (
+	// PeerAdded is for a peer being added to the device
+	PeerAdded Action = "peer-added"
+	// PeerRemoved is for a peer being removed from the device
+	PeerRemoved Action = "peer-removed"
+	// EndpointChanged is for a change to the endpoint of a peer
+	EndpointChanged Action = "endpoint-changed"
+	// AllowedIPsChanged is for a change to the AllowedIPs of a peer
+	AllowedIPsChanged Action = "allowed-ips-changed"
+	// PresharedKeyChanged is for a change to the preshared key of a peer. The
+	// key itself is never recorded.
+	PresharedKeyChanged Action = "preshared-key-changed"
+	// KeepaliveChanged is for a change to the PersistentKeepaliveInterval of a
+	// peer
+	KeepaliveChanged Action = "keepalive-changed"
+)
+
+// Entry is a single change to the device config
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Action   Action    `json:"action"`
+	Peer     string    `json:"peer"`
+	PeerName string    `json:"peerName,omitempty"`
+	// Reason is a short description of why the change was made
+	Reason string `json:"reason,omitempty"`
+	// Previous and Current are the values before and after the change, which
+	// will be a single endpoint or a list of AllowedIPs
+	Previous []string `json:"previous,omitempty"`
+	Current  []string `json:"current,omitempty"`
+	// Added and Removed are the AllowedIPs that were changed
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	// Facts are the facts that caused the change
+	Facts []string `json:"facts,omitempty"`
+	// Sources are where the facts came from
+	Sources []string `json:"sources,omitempty"`
+}
+
+func (e *Entry) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %s", e.Action, e.PeerName)
+	if len(e.Previous) > 0 || len(e.Current) > 0 {
+		fmt.Fprintf(&sb, " %v -> %v", e.Previous, e.Current)
+	}
+	if e.Reason != "" {
+		fmt.Fprintf(&sb, " (%s)", e.Reason)
+	}
+	return sb.String()
+}
+
+// Recorder is something that can record audit entries
+type Recorder interface {
+	Record(*Entry)
+}
+
+// Changes computes the audit entries for applying pcfg to a peer. The peer is
+// the state before the change, or nil if the peer is being added. The facts
+// are the ones for the peer that were used to build the config, and the ones
+// relevant to each change are attached to its entry, formatted with describe,
+// along with the names of their sources, if `sources` is not nil.
+// The returned entries are missing the Time, PeerName, and Reason, which the
+// caller is expected to fill in.
+func Changes(
+	peer *wgtypes.Peer,
+	pcfg *wgtypes.PeerConfig,
+	facts []*fact.Fact,
+	describe func(*fact.Fact) string,
+	sources func(*fact.Fact) []string,
+) []*Entry {
+	if describe == nil {
+		describe = func(f *fact.Fact) string { return f.String() }
+	}
+	attach := func(e *Entry, match func(*fact.Fact) bool) *Entry {
+		for _, f := range facts {
+			if !match(f) {
+				continue
+			}
+			e.Facts = append(e.Facts, describe(f))
+			if sources != nil {
+				e.Sources = append(e.Sources, sources(f)...)
+			}
+		}
+		e.Sources = unique(e.Sources)
+		return e
+	}
+	key := pcfg.PublicKey.String()
+	var prevAIPs []net.IPNet
+	var prevEndpoint *net.UDPAddr
+	if peer != nil {
+		prevAIPs = peer.AllowedIPs
+		prevEndpoint = peer.Endpoint
+	}
+
+	if pcfg.Remove {
+		if peer == nil {
+			return nil
+		}
+		return []*Entry{{
+			Action:   PeerRemoved,
+			Peer:     key,
+			Previous: ipNetStrings(prevAIPs),
+		}}
+	}
+
+	var ret []*Entry
+	if peer == nil {
+		ret = append(ret, attach(&Entry{
+			Action: PeerAdded,
+			Peer:   key,
+		}, func(f *fact.Fact) bool {
+			return f.Attribute == fact.AttributeMember || f.Attribute == fact.AttributeMemberMetadata
+		}))
+	}
+
+	if pcfg.Endpoint != nil && !util.UDPEqualIPPort(pcfg.Endpoint, prevEndpoint) {
+		e := attach(&Entry{
+			Action:  EndpointChanged,
+			Peer:    key,
+			Current: []string{pcfg.Endpoint.String()},
+		}, func(f *fact.Fact) bool {
+			ipp, ok := f.Value.(*fact.IPPortValue)
+			return ok && ipp.IP.Equal(pcfg.Endpoint.IP) && ipp.Port == pcfg.Endpoint.Port
+		})
+		if prevEndpoint != nil {
+			e.Previous = []string{prevEndpoint.String()}
+		}
+		ret = append(ret, e)
+	}
+
+	prev := ipNetStrings(prevAIPs)
+	var next []string
+	if !pcfg.ReplaceAllowedIPs {
+		next = append(next, prev...)
+	}
+	next = append(next, ipNetStrings(pcfg.AllowedIPs)...)
+	next = unique(next)
+	added, removed := diff(prev, next), diff(next, prev)
+	if len(added) > 0 || len(removed) > 0 {
+		addedSet := make(map[string]bool, len(added))
+		for _, a := range added {
+			addedSet[a] = true
+		}
+		ret = append(ret, attach(&Entry{
+			Action:   AllowedIPsChanged,
+			Peer:     key,
+			Previous: prev,
+			Current:  next,
+			Added:    added,
+			Removed:  removed,
+		}, func(f *fact.Fact) bool {
+			ipn, ok := f.Value.(*fact.IPNetValue)
+			return ok && addedSet[ipn.IPNet.String()]
+		}))
+	}
+
+	var prevKeepalive time.Duration
+	if peer != nil {
+		prevKeepalive = peer.PersistentKeepaliveInterval
+	}
+	if pcfg.PersistentKeepaliveInterval != nil && *pcfg.PersistentKeepaliveInterval != prevKeepalive {
+		ret = append(ret, &Entry{
+			Action:   KeepaliveChanged,
+			Peer:     key,
+			Previous: []string{prevKeepalive.String()},
+			Current:  []string{pcfg.PersistentKeepaliveInterval.String()},
+		})
+	}
+
+	if pcfg.PresharedKey != nil && (peer == nil || *pcfg.PresharedKey != peer.PresharedKey) {
+		ret = append(ret, &Entry{
+			Action: PresharedKeyChanged,
+			Peer:   key,
+		})
+	}
+
+	return ret
+}
+
+func ipNetStrings(ipns []net.IPNet) []string {
+	if len(ipns) == 0 {
+		return nil
+	}
+	ret := make([]string, 0, len(ipns))
+	for _, ipn := range ipns {
+		ret = append(ret, ipn.String())
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// unique sorts and de-duplicates a list of strings
+func unique(values []string) []string {
+	if len(values) == 0 {
+		return nil
+	}
+	sort.Strings(values)
+	ret := values[:1]
+	for _, v := range values[1:] {
+		if v != ret[len(ret)-1] {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// diff returns the values in b that are not in a
+func diff(a, b []string) []string {
+	in := make(map[string]bool, len(a))
+	for _, v := range a {
+		in[v] = true
+	}
+	var ret []string
+	for _, v := range b {
+		if !in[v] {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
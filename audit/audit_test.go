@@ -0,0 +1,178 @@
+package audit
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/internal/testutils"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChanges(t *testing.T) {
+	now := time.Now()
+	key := testutils.MustKey(t)
+	aip1 := testutils.MakeIPv4Net(10, 0, 0, 1, 32)
+	aip2 := testutils.MakeIPv4Net(10, 2, 0, 0, 16)
+	ep1 := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51820}
+	ep2 := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 51820}
+	psk1 := testutils.MustKey(t)
+	psk2 := testutils.MustKey(t)
+	keepalive := 25 * time.Second
+
+	memberFact := &fact.Fact{
+		Attribute: fact.AttributeMember,
+		Subject:   &fact.PeerSubject{Key: key},
+		Value:     fact.EmptyValue{},
+		Expires:   now,
+	}
+	epFact := &fact.Fact{
+		Attribute: fact.AttributeEndpointV4,
+		Subject:   &fact.PeerSubject{Key: key},
+		Value:     &fact.IPPortValue{IP: ep2.IP, Port: ep2.Port},
+		Expires:   now,
+	}
+	aipFact := &fact.Fact{
+		Attribute: fact.AttributeAllowedCidrV4,
+		Subject:   &fact.PeerSubject{Key: key},
+		Value:     &fact.IPNetValue{IPNet: aip2},
+		Expires:   now,
+	}
+	facts := []*fact.Fact{memberFact, epFact, aipFact}
+	describe := func(f *fact.Fact) string { return string(f.Attribute) }
+	sources := func(f *fact.Fact) []string {
+		if f == aipFact {
+			return []string{"local", "bob"}
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name string
+		peer *wgtypes.Peer
+		pcfg *wgtypes.PeerConfig
+		want []*Entry
+	}{
+		{
+			"no change",
+			&wgtypes.Peer{PublicKey: key, AllowedIPs: []net.IPNet{aip1}},
+			&wgtypes.PeerConfig{PublicKey: key, AllowedIPs: []net.IPNet{aip1}},
+			nil,
+		},
+		{
+			"remove",
+			&wgtypes.Peer{PublicKey: key, AllowedIPs: []net.IPNet{aip1}},
+			&wgtypes.PeerConfig{PublicKey: key, Remove: true},
+			[]*Entry{{Action: PeerRemoved, Peer: key.String(), Previous: []string{aip1.String()}}},
+		},
+		{
+			"remove missing",
+			nil,
+			&wgtypes.PeerConfig{PublicKey: key, Remove: true},
+			nil,
+		},
+		{
+			"add",
+			nil,
+			&wgtypes.PeerConfig{PublicKey: key, AllowedIPs: []net.IPNet{aip1}, ReplaceAllowedIPs: true},
+			[]*Entry{
+				{Action: PeerAdded, Peer: key.String(), Facts: []string{"m"}},
+				{
+					Action:  AllowedIPsChanged,
+					Peer:    key.String(),
+					Current: []string{aip1.String()},
+					Added:   []string{aip1.String()},
+				},
+			},
+		},
+		{
+			"endpoint",
+			&wgtypes.Peer{PublicKey: key, Endpoint: ep1},
+			&wgtypes.PeerConfig{PublicKey: key, Endpoint: ep2},
+			[]*Entry{{
+				Action:   EndpointChanged,
+				Peer:     key.String(),
+				Previous: []string{ep1.String()},
+				Current:  []string{ep2.String()},
+				Facts:    []string{"e"},
+			}},
+		},
+		{
+			"same endpoint",
+			&wgtypes.Peer{PublicKey: key, Endpoint: ep1},
+			&wgtypes.PeerConfig{PublicKey: key, Endpoint: ep1},
+			nil,
+		},
+		{
+			"add aip",
+			&wgtypes.Peer{PublicKey: key, AllowedIPs: []net.IPNet{aip1}},
+			&wgtypes.PeerConfig{PublicKey: key, AllowedIPs: []net.IPNet{aip2}},
+			[]*Entry{{
+				Action:   AllowedIPsChanged,
+				Peer:     key.String(),
+				Previous: []string{aip1.String()},
+				Current:  []string{aip1.String(), aip2.String()},
+				Added:    []string{aip2.String()},
+				Facts:    []string{"a"},
+				Sources:  []string{"bob", "local"},
+			}},
+		},
+		{
+			"replace aips",
+			&wgtypes.Peer{PublicKey: key, AllowedIPs: []net.IPNet{aip1, aip2}},
+			&wgtypes.PeerConfig{PublicKey: key, AllowedIPs: []net.IPNet{aip2}, ReplaceAllowedIPs: true},
+			[]*Entry{{
+				Action:   AllowedIPsChanged,
+				Peer:     key.String(),
+				Previous: []string{aip1.String(), aip2.String()},
+				Current:  []string{aip2.String()},
+				Removed:  []string{aip1.String()},
+			}},
+		},
+		{
+			"preshared key",
+			&wgtypes.Peer{PublicKey: key, PresharedKey: psk1},
+			&wgtypes.PeerConfig{PublicKey: key, PresharedKey: &psk2},
+			[]*Entry{{Action: PresharedKeyChanged, Peer: key.String()}},
+		},
+		{
+			"keepalive",
+			&wgtypes.Peer{PublicKey: key},
+			&wgtypes.PeerConfig{PublicKey: key, PersistentKeepaliveInterval: &keepalive},
+			[]*Entry{{Action: KeepaliveChanged, Peer: key.String(), Previous: []string{"0s"}, Current: []string{"25s"}}},
+		},
+		{
+			"same keepalive",
+			&wgtypes.Peer{PublicKey: key, PersistentKeepaliveInterval: keepalive},
+			&wgtypes.PeerConfig{PublicKey: key, PersistentKeepaliveInterval: &keepalive},
+			nil,
+		},
+		{
+			"same preshared key",
+			&wgtypes.Peer{PublicKey: key, PresharedKey: psk1},
+			&wgtypes.PeerConfig{PublicKey: key, PresharedKey: &psk1},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Changes(tt.peer, tt.pcfg, facts, describe, sources)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestEntry_String(t *testing.T) {
+	e := &Entry{
+		Action:   AllowedIPsChanged,
+		PeerName: "bob",
+		Previous: []string{"10.0.0.1/32"},
+		Current:  []string{"10.0.0.1/32", "10.2.0.0/16"},
+		Reason:   "peer is healthy",
+	}
+	assert.Equal(t, "allowed-ips-changed bob [10.0.0.1/32] -> [10.0.0.1/32 10.2.0.0/16] (peer is healthy)", e.String())
+}
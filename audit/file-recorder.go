@@ -0,0 +1,138 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/fastcat/wirelink/log"
+)
+
+// DefaultMaxSize is the default size at which audit files are rotated
+const DefaultMaxSize = 10 * 1024 * 1024
+
+// DefaultKeep is the default number of rotated audit files to keep
+const DefaultKeep = 5
+
+// FileRecorder writes audit entries to a file as JSON lines, rotating it when
+// it gets too big. Rotated files have `.1`, `.2`, etc. appended, with `.1`
+// being the most recent.
+type FileRecorder struct {
+	access  sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+	file    *os.File
+	size    int64
+}
+
+var _ Recorder = &FileRecorder{}
+
+// NewFileRecorder opens (or creates) the audit file at path
+func NewFileRecorder(path string, maxSize int64, keep int) (*FileRecorder, error) {
+	r := &FileRecorder{
+		path:    path,
+		maxSize: maxSize,
+		keep:    keep,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *FileRecorder) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to open audit file %s", r.path)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		//nolint:errcheck // already reporting a more important error
+		file.Close()
+		return errors.Wrapf(err, "Unable to stat audit file %s", r.path)
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+func (r *FileRecorder) rotatedName(n int) string {
+	return fmt.Sprintf("%s.%d", r.path, n)
+}
+
+// rotate moves the current file to `.1`, shifting any older files up and
+// deleting the oldest, and then opens a fresh file
+func (r *FileRecorder) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return errors.Wrapf(err, "Unable to close audit file %s", r.path)
+	}
+	r.file = nil
+	if r.keep <= 0 {
+		if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "Unable to remove audit file %s", r.path)
+		}
+		return r.open()
+	}
+	if err := os.Remove(r.rotatedName(r.keep)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Unable to remove old audit file %s", r.rotatedName(r.keep))
+	}
+	for n := r.keep - 1; n >= 1; n-- {
+		if err := os.Rename(r.rotatedName(n), r.rotatedName(n+1)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "Unable to rotate audit file %s", r.rotatedName(n))
+		}
+	}
+	if err := os.Rename(r.path, r.rotatedName(1)); err != nil {
+		return errors.Wrapf(err, "Unable to rotate audit file %s", r.path)
+	}
+	return r.open()
+}
+
+// Record writes the entry to the file, rotating it first if needed. Errors
+// are logged, as there isn't much else useful to do with them.
+func (r *FileRecorder) Record(e *Entry) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Error("Unable to encode audit entry %v: %v", e, err)
+		return
+	}
+	line = append(line, '\n')
+
+	r.access.Lock()
+	defer r.access.Unlock()
+	if r.file == nil {
+		// a previous rotate failed, try to recover
+		if err = r.open(); err != nil {
+			log.Error("Unable to write audit entry %v: %v", e, err)
+			return
+		}
+	}
+	if r.size > 0 && r.size+int64(len(line)) > r.maxSize {
+		if err = r.rotate(); err != nil {
+			log.Error("Unable to rotate audit file: %v", err)
+			if r.file == nil {
+				return
+			}
+		}
+	}
+	n, err := r.file.Write(line)
+	r.size += int64(n)
+	if err != nil {
+		log.Error("Unable to write audit entry %v: %v", e, err)
+	}
+}
+
+// Close closes the audit file
+func (r *FileRecorder) Close() error {
+	r.access.Lock()
+	defer r.access.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
@@ -0,0 +1,72 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readEntries(t *testing.T, path string) []*Entry {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	var ret []*Entry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e := &Entry{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), e))
+		ret = append(ret, e)
+	}
+	require.NoError(t, scanner.Err())
+	return ret
+}
+
+func TestFileRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wirelink-audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	now := time.Now().UTC().Round(time.Second)
+	entry := func(peer string) *Entry {
+		return &Entry{Time: now, Action: PeerAdded, Peer: peer}
+	}
+	line, err := json.Marshal(entry("p0"))
+	require.NoError(t, err)
+
+	// room for two entries per file
+	r, err := NewFileRecorder(path, int64(2*(len(line)+1)), 2)
+	require.NoError(t, err)
+	for _, p := range []string{"p0", "p1", "p2", "p3", "p4", "p5", "p6"} {
+		r.Record(entry(p))
+	}
+	require.NoError(t, r.Close())
+
+	assert.Equal(t, []*Entry{entry("p6")}, readEntries(t, path))
+	assert.Equal(t, []*Entry{entry("p4"), entry("p5")}, readEntries(t, path+".1"))
+	assert.Equal(t, []*Entry{entry("p2"), entry("p3")}, readEntries(t, path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err), "should not keep more than 2 rotated files")
+
+	// re-opening appends
+	r, err = NewFileRecorder(path, DefaultMaxSize, DefaultKeep)
+	require.NoError(t, err)
+	r.Record(entry("p7"))
+	require.NoError(t, r.Close())
+	assert.Equal(t, []*Entry{entry("p6"), entry("p7")}, readEntries(t, path))
+
+	// closing twice is harmless
+	assert.NoError(t, r.Close())
+}
+
+func TestNewFileRecorder_bad(t *testing.T) {
+	_, err := NewFileRecorder(filepath.Join(os.TempDir(), "wirelink-no-such-dir", "audit.log"), DefaultMaxSize, DefaultKeep)
+	assert.Error(t, err)
+}
@@ -0,0 +1,39 @@
+package audit
+
+import (
+	"strings"
+
+	"github.com/fastcat/wirelink/log"
+)
+
+// logRecorder writes audit entries to the structured log
+type logRecorder struct {
+	logger *log.Logger
+}
+
+// NewLogRecorder creates a Recorder that writes audit entries to the log,
+// under the `audit` subsystem
+func NewLogRecorder() Recorder {
+	return &logRecorder{logger: log.For("audit")}
+}
+
+func (r *logRecorder) Record(e *Entry) {
+	fields := log.Fields{
+		"action": string(e.Action),
+		"key":    e.Peer,
+	}
+	add := func(name string, value string) {
+		if value != "" {
+			fields[name] = value
+		}
+	}
+	add("peer", e.PeerName)
+	add("reason", e.Reason)
+	add("previous", strings.Join(e.Previous, ","))
+	add("current", strings.Join(e.Current, ","))
+	add("added", strings.Join(e.Added, ","))
+	add("removed", strings.Join(e.Removed, ","))
+	add("facts", strings.Join(e.Facts, "; "))
+	add("sources", strings.Join(e.Sources, ","))
+	r.logger.With(fields).Info("Audit: %s", e)
+}
@@ -1,28 +1,187 @@
-// Package autopeer provides code to compute a peer's automatic IPv6-LL address
+// Package autopeer provides code to compute a peer's automatic address
 // derived from its public key.
 package autopeer
 
 import (
 	"crypto/sha1"
+	"encoding/binary"
 	"net"
 
+	"github.com/pkg/errors"
+
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-// AutoAddress returns the IPv6 link-local address that should be assigned to
-// peer based on its public key
-func AutoAddress(key wgtypes.Key) net.IP {
+// Names for the built in auto address schemes
+const (
+	// SchemeLinkLocal is the default scheme, using IPv6 link-local addresses in
+	// fe80::/64
+	SchemeLinkLocal = "link-local"
+	// SchemeIPv4LinkLocal uses IPv4 link-local addresses in 169.254.0.0/16
+	SchemeIPv4LinkLocal = "ipv4-link-local"
+)
+
+var linkLocalPrefix = net.IPNet{
+	IP:   net.ParseIP("fe80::"),
+	Mask: net.CIDRMask(64, 8*net.IPv6len),
+}
+
+var ipv4LinkLocalPrefix = net.IPNet{
+	IP:   net.IPv4(169, 254, 0, 0).To4(),
+	Mask: net.CIDRMask(16, 8*net.IPv4len),
+}
+
+var ulaPrefix = net.IPNet{
+	IP:   net.ParseIP("fc00::"),
+	Mask: net.CIDRMask(7, 8*net.IPv6len),
+}
+
+// ipv4LinkLocalReserved is how many addresses at each end of 169.254.0.0/16
+// are reserved by RFC 3927, and so not used for auto addresses
+const ipv4LinkLocalReserved = 256
+
+// Scheme describes how the automatic address of a peer is derived from its
+// public key, by filling in the host part of a network prefix from a hash of
+// the key. A nil *Scheme is the default IPv6 link-local scheme.
+type Scheme struct {
+	prefix net.IPNet
+}
+
+// ParseScheme parses the name of a built in scheme, or an IPv6 unique local
+// (ULA) prefix for the addresses, e.g. "fd12:3456:789a::/64". An empty string
+// gives the default scheme.
+func ParseScheme(value string) (*Scheme, error) {
+	switch value {
+	case "", SchemeLinkLocal:
+		return nil, nil
+	case SchemeIPv4LinkLocal:
+		return &Scheme{prefix: ipv4LinkLocalPrefix}, nil
+	}
+	_, prefix, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid auto address scheme %q", value)
+	}
+	ones, bits := prefix.Mask.Size()
+	if bits == 8*net.IPv4len {
+		if prefix.String() != ipv4LinkLocalPrefix.String() {
+			return nil, errors.Errorf("Invalid auto address prefix %v: IPv4 auto addresses must use %v", prefix, &ipv4LinkLocalPrefix)
+		}
+		return &Scheme{prefix: ipv4LinkLocalPrefix}, nil
+	}
+	if !ulaPrefix.Contains(prefix.IP) || ones < 8 {
+		return nil, errors.Errorf("Invalid auto address prefix %v: must be within %v", prefix, &ulaPrefix)
+	}
+	if ones > 64 {
+		return nil, errors.Errorf("Invalid auto address prefix %v: must be /64 or shorter", prefix)
+	}
+	return &Scheme{prefix: *prefix}, nil
+}
+
+func (s *Scheme) getPrefix() net.IPNet {
+	if s == nil {
+		return linkLocalPrefix
+	}
+	return s.prefix
+}
+
+// IsIPv4 returns whether the scheme gives IPv4 addresses
+func (s *Scheme) IsIPv4() bool {
+	return len(s.getPrefix().IP) == net.IPv4len
+}
+
+// Network returns the network to use for listening for UDP on the addresses
+// in the scheme
+func (s *Scheme) Network() string {
+	if s.IsIPv4() {
+		return "udp4"
+	}
+	return "udp6"
+}
+
+// Zone returns the zone to use with addresses in the scheme on the given
+// interface, which is only needed for IPv6 link-local addresses
+func (s *Scheme) Zone(iface string) string {
+	if prefix := s.getPrefix(); !s.IsIPv4() && prefix.IP.IsLinkLocalUnicast() {
+		return iface
+	}
+	return ""
+}
+
+// Address returns the automatic address for the peer with the given key
+func (s *Scheme) Address(key wgtypes.Key) net.IP {
 	keySum := sha1.Sum(key[:])
-	ip := make(net.IP, 16)
-	copy(ip[0:2], []byte{0xfe, 0x80})
-	copy(ip[8:], keySum[:8])
+	prefix := s.getPrefix()
+	if s.IsIPv4() {
+		// the hash is mapped onto the usable range, as there are not enough host
+		// bits to just avoid the reserved ones
+		host := ipv4LinkLocalReserved + int(binary.BigEndian.Uint16(keySum[:2]))%(1<<16-2*ipv4LinkLocalReserved)
+		return net.IPv4(prefix.IP[0], prefix.IP[1], byte(host>>8), byte(host)).To4()
+	}
+	ones, _ := prefix.Mask.Size()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP)
+	for i, j := ones/8, 0; i < net.IPv6len; i, j = i+1, j+1 {
+		ip[i] = ip[i]&prefix.Mask[i] | keySum[j]&^prefix.Mask[i]
+	}
 	return ip
 }
 
-// AutoAddressNet returns the peer's AutoAddress with a /128 netmask
-func AutoAddressNet(key wgtypes.Key) net.IPNet {
+// AddressNet returns the peer's Address with a host netmask, as used for its
+// AllowedIPs
+func (s *Scheme) AddressNet(key wgtypes.Key) net.IPNet {
+	ip := s.Address(key)
 	return net.IPNet{
-		IP:   AutoAddress(key),
-		Mask: net.CIDRMask(8*net.IPv6len, 8*net.IPv6len),
+		IP:   ip,
+		Mask: net.CIDRMask(8*len(ip), 8*len(ip)),
 	}
 }
+
+// LocalNet returns the peer's Address with the netmask of the scheme, as used
+// for the local interface
+func (s *Scheme) LocalNet(key wgtypes.Key) net.IPNet {
+	return net.IPNet{
+		IP:   s.Address(key),
+		Mask: s.getPrefix().Mask,
+	}
+}
+
+// Collisions returns the set of keys that are given the same address as
+// another of the keys
+func (s *Scheme) Collisions(keys ...wgtypes.Key) map[wgtypes.Key]bool {
+	var ret map[wgtypes.Key]bool
+	byAddr := make(map[string]wgtypes.Key, len(keys))
+	for _, key := range keys {
+		addr := string(s.Address(key).To16())
+		if other, ok := byAddr[addr]; ok && other != key {
+			if ret == nil {
+				ret = make(map[wgtypes.Key]bool)
+			}
+			ret[key] = true
+			ret[other] = true
+		} else {
+			byAddr[addr] = key
+		}
+	}
+	return ret
+}
+
+func (s *Scheme) String() string {
+	if s == nil {
+		return SchemeLinkLocal
+	}
+	if s.IsIPv4() {
+		return SchemeIPv4LinkLocal
+	}
+	return s.prefix.String()
+}
+
+// AutoAddress returns the IPv6 link-local address that should be assigned to
+// peer based on its public key, using the default scheme
+func AutoAddress(key wgtypes.Key) net.IP {
+	return (*Scheme)(nil).Address(key)
+}
+
+// AutoAddressNet returns the peer's AutoAddress with a /128 netmask
+func AutoAddressNet(key wgtypes.Key) net.IPNet {
+	return (*Scheme)(nil).AddressNet(key)
+}
@@ -4,6 +4,8 @@ import (
 	"net"
 	"testing"
 
+	"github.com/fastcat/wirelink/internal/testutils"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -38,3 +40,107 @@ func TestAutoAddressNet(t *testing.T) {
 		})
 	}
 }
+
+func TestParseScheme(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		wantString  string
+		wantNetwork string
+		wantZone    string
+		wantErr     bool
+	}{
+		{"default", "", SchemeLinkLocal, "udp6", "wg0", false},
+		{"link-local", SchemeLinkLocal, SchemeLinkLocal, "udp6", "wg0", false},
+		{"ipv4 link-local", SchemeIPv4LinkLocal, SchemeIPv4LinkLocal, "udp4", "", false},
+		{"ipv4 link-local prefix", "169.254.0.0/16", SchemeIPv4LinkLocal, "udp4", "", false},
+		{"ula /64", "fd12:3456:789a:1::/64", "fd12:3456:789a:1::/64", "udp6", "", false},
+		{"ula /48", "fd12:3456:789a::/48", "fd12:3456:789a::/48", "udp6", "", false},
+		{"garbage", "bogus", "", "", "", true},
+		{"other ipv4", "10.0.0.0/8", "", "", "", true},
+		{"partial ipv4 link-local", "169.254.1.0/24", "", "", "", true},
+		{"global ipv6", "2001:db8::/64", "", "", "", true},
+		{"ipv6 link-local prefix", "fe80::/64", "", "", "", true},
+		{"ula too long", "fd12:3456:789a:1::/96", "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseScheme(tt.value)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, tt.wantString, got.String())
+			assert.Equal(t, tt.wantNetwork, got.Network())
+			assert.Equal(t, tt.wantZone, got.Zone("wg0"))
+		})
+	}
+}
+
+func TestScheme_Address(t *testing.T) {
+	key, err := wgtypes.ParseKey("6X/iz1GyW9euj9JIdP7PUl14eoWyoQiAa+BDTB38GhE=")
+	require.Nil(t, err)
+	scheme := func(value string) *Scheme {
+		s, err := ParseScheme(value)
+		require.Nil(t, err)
+		return s
+	}
+	np := func(ip string) net.IPNet {
+		i, n, err := net.ParseCIDR(ip)
+		require.Nil(t, err)
+		if i4 := i.To4(); i4 != nil {
+			i = i4
+		}
+		n.IP = i
+		return *n
+	}
+
+	tests := []struct {
+		name      string
+		scheme    *Scheme
+		wantNet   net.IPNet
+		wantLocal net.IPNet
+	}{
+		{"default", nil, np("fe80::afec:ee83:716b:51ac/128"), np("fe80::afec:ee83:716b:51ac/64")},
+		{"ula /64", scheme("fd12:3456:789a:1::/64"), np("fd12:3456:789a:1:afec:ee83:716b:51ac/128"), np("fd12:3456:789a:1:afec:ee83:716b:51ac/64")},
+		{"ula /48", scheme("fd12:3456:789a::/48"), np("fd12:3456:789a:afec:ee83:716b:51ac:fb57/128"), np("fd12:3456:789a:afec:ee83:716b:51ac:fb57/48")},
+		{"ipv4 link-local", scheme(SchemeIPv4LinkLocal), np("169.254.176.236/32"), np("169.254.176.236/16")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wantNet, tt.scheme.AddressNet(key))
+			assert.Equal(t, tt.wantLocal, tt.scheme.LocalNet(key))
+			assert.True(t, tt.scheme.Address(key).Equal(tt.wantNet.IP))
+		})
+	}
+}
+
+func TestScheme_Address_IPv4Reserved(t *testing.T) {
+	s, err := ParseScheme(SchemeIPv4LinkLocal)
+	require.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		k, err := wgtypes.GenerateKey()
+		require.Nil(t, err)
+		ip := s.Address(k)
+		require.Len(t, ip, net.IPv4len)
+		assert.True(t, ipv4LinkLocalPrefix.Contains(ip))
+		assert.NotEqual(t, byte(0), ip[2], "should not use reserved addresses")
+		assert.NotEqual(t, byte(255), ip[2], "should not use reserved addresses")
+	}
+}
+
+func TestScheme_Collisions(t *testing.T) {
+	s, err := ParseScheme(SchemeIPv4LinkLocal)
+	require.Nil(t, err)
+
+	// this won't take long in the small IPv4 space
+	k1, k2 := testutils.MustCollidingKeys(t, s.Address)
+	k3, err := wgtypes.GenerateKey()
+	require.Nil(t, err)
+
+	assert.Empty(t, s.Collisions(k1, k3))
+	assert.Empty(t, s.Collisions(k1, k1), "same key should not collide with itself")
+	assert.Equal(t, map[wgtypes.Key]bool{k1: true, k2: true}, s.Collisions(k1, k3, k2))
+	assert.Empty(t, (*Scheme)(nil).Collisions(k1, k2, k3))
+}
@@ -81,12 +81,14 @@ func (w *WirelinkCmd) Run() error {
 	w.signals = make(chan os.Signal, 5)
 
 	w.Server.AddHandler(func(ctx context.Context) error {
-		signal.Notify(w.signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
+		signal.Notify(w.signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2)
 		for {
 			select {
 			case sig := <-w.signals:
 				if sig == syscall.SIGUSR1 {
 					w.Server.RequestPrint()
+				} else if sig == syscall.SIGUSR2 {
+					w.Server.ClearSafetyHold()
 				} else {
 					log.Info("Received signal %v, stopping", sig)
 					// this will just initiate the shutdown, not block waiting for it
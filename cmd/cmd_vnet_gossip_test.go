@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/internal/networking/vnet"
+	"github.com/fastcat/wirelink/internal/testutils"
+	"github.com/fastcat/wirelink/server"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gossipRingResult is the measurements from one run of runGossipRing
+type gossipRingResult struct {
+	converged bool
+	// meshTime is how long it took to form the full mesh, or the whole run if it
+	// didn't
+	meshTime time.Duration
+	// packets and bytes are the totals sent by all the hosts during the run
+	packets int64
+	bytes   int64
+	gossip  server.GossipStats
+}
+
+// runGossipRing runs a ring of leaves with no router, where each leaf is
+// configured with the membership of all the others, but only knows the
+// endpoint of the next leaf in the ring. As leaves that aren't special only
+// ping each other, the only way for them to learn the endpoints of the leaves
+// further around the ring is gossip, or being chatty. It runs for a fixed time
+// so that the traffic of different modes can be compared.
+func runGossipRing(t *testing.T, numLeaves int, gossip, chatty bool) gossipRingResult {
+	// time is simulated with a fake clock, see Test_Cmd_VNet1
+	chunkPeriod := server.DefaultChunkPeriod
+	factTTL := 3 * chunkPeriod
+	runTime := 20 * chunkPeriod
+	step := chunkPeriod / 5
+
+	w := vnet.NewWorld()
+	internet := w.CreateNetwork("internet")
+
+	hosts := make([]*vnet.Host, numLeaves)
+	tuns := make([]*vnet.Tunnel, numLeaves)
+	pubs := make([]wgtypes.Key, numLeaves)
+	for i := range hosts {
+		hosts[i] = w.CreateHost(fmt.Sprintf("leaf%d", i+1))
+		defer hosts[i].Close()
+		e0 := hosts[i].AddPhy("eth0")
+		e0.AddAddr(net.IPNet{IP: net.IPv4(100, 1, 1, byte(1+i)), Mask: net.CIDRMask(24, 32)})
+		e0.AttachToNetwork(internet)
+		tuns[i] = hosts[i].AddTun("wg0")
+		_, pubs[i] = tuns[i].GenerateKeys()
+		tuns[i].AddAddr(net.IPNet{IP: net.IPv4(192, 168, 0, byte(1+i)), Mask: net.CIDRMask(24, 32)})
+		tuns[i].Listen(wgPort)
+	}
+
+	cmds := make([]*WirelinkCmd, numLeaves)
+	for i := range cmds {
+		cmds[i] = New([]string{"wirevlink", "--iface=wg0", "--router=false"})
+		require.NoError(t, cmds[i].Init(hosts[i].Wrap()))
+		for j := range hosts {
+			if j == i {
+				continue
+			}
+			p := &config.Peer{
+				Name:       hosts[j].Name() + "@" + hosts[i].Name(),
+				AllowedIPs: []net.IPNet{{IP: net.IPv4(192, 168, 0, byte(1+j)), Mask: net.CIDRMask(32, 32)}},
+			}
+			if j == (i+1)%numLeaves {
+				p.Endpoints = []config.PeerEndpoint{{
+					Host: fmt.Sprintf("100.1.1.%d", 1+j),
+					Port: wgPort,
+				}}
+			}
+			cmds[i].Config.Peers[pubs[j]] = p
+		}
+		cmds[i].Config.Chatty = chatty
+		cmds[i].Config.Gossip = gossip
+		cmds[i].Config.GossipFanout = 2
+		cmds[i].Server.FactTTL = factTTL
+		cmds[i].Server.ChunkPeriod = chunkPeriod
+		cmds[i].Server.AlivePeriod = chunkPeriod / 2
+		cmds[i].Server.ProbePeriod = chunkPeriod
+	}
+
+	fc := useFakeClock(w, cmds...)
+
+	// the mesh has converged when every leaf has a live connection to every
+	// other leaf
+	converged := func() bool {
+		for i, tun := range tuns {
+			wgp := tun.Peers()
+			for j, pub := range pubs {
+				if i == j {
+					continue
+				}
+				p, ok := wgp[pub.String()]
+				if !ok || p.Endpoint() == nil || fc.Since(p.LastReceive()) > chunkPeriod {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	eg := &errgroup.Group{}
+	for _, c := range cmds {
+		eg.Go(c.Run)
+	}
+
+	// each server has a chunk and a probe ticker
+	waitForTickers(t, fc, 2*numLeaves)
+	ret := gossipRingResult{}
+	start := fc.Now()
+	end := start.Add(runTime)
+	for fc.Now().Before(end) {
+		if !ret.converged && converged() {
+			ret.converged = true
+			ret.meshTime = fc.Since(start)
+		}
+		simulate(t, fc, step, step)
+	}
+	if !ret.converged {
+		ret.meshTime = fc.Since(start)
+	}
+
+	for i, c := range cmds {
+		traffic := hosts[i].Traffic()
+		ret.packets += traffic.PacketsSent
+		ret.bytes += traffic.BytesSent
+		stats := c.Server.GossipStats()
+		ret.gossip.Rounds += stats.Rounds
+		ret.gossip.Groups += stats.Groups
+		ret.gossip.FactsSent += stats.FactsSent
+		ret.gossip.FactsReceived += stats.FactsReceived
+	}
+
+	for _, c := range cmds {
+		c.Server.RequestStop()
+	}
+	assert.NoError(t, eg.Wait())
+	return ret
+}
+
+// Test_Cmd_VNetGossip compares how a ring of leaves converges with gossip off,
+// with gossip on, and with every leaf being chatty: without gossip the leaves
+// never learn each other's endpoints, with it they do, at a lower cost than
+// every leaf sending all its facts to every other.
+func Test_Cmd_VNetGossip(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping slow vnet test in short mode")
+	}
+
+	os.Setenv("WIREVLINK_CONFIG_PATH", testutils.SrcDirectory())
+	defer os.Unsetenv("WIREVLINK_CONFIG_PATH")
+
+	const numLeaves = 5
+
+	off := runGossipRing(t, numLeaves, false, false)
+	t.Logf("gossip off: converged=%v in %v, %d packets, %d bytes", off.converged, off.meshTime, off.packets, off.bytes)
+	on := runGossipRing(t, numLeaves, true, false)
+	t.Logf("gossip on: converged=%v in %v, %d packets, %d bytes: %+v", on.converged, on.meshTime, on.packets, on.bytes, on.gossip)
+	chatty := runGossipRing(t, numLeaves, false, true)
+	t.Logf("chatty: converged=%v in %v, %d packets, %d bytes", chatty.converged, chatty.meshTime, chatty.packets, chatty.bytes)
+
+	assert.False(t, off.converged, "mesh should not converge without gossip")
+	assert.Zero(t, off.gossip, "should not gossip when it is off")
+	assert.True(t, on.converged, "mesh should converge with gossip")
+	assert.Less(t, int64(on.meshTime), int64(off.meshTime), "gossip should converge faster")
+	assert.NotZero(t, on.gossip.Rounds)
+	assert.LessOrEqual(t, on.gossip.FactsReceived, on.gossip.FactsSent)
+	// gossip costs something over not exchanging facts at all, but less than
+	// exchanging all of them
+	assert.Greater(t, on.bytes, off.bytes, "gossip should send more than pings alone")
+	assert.True(t, chatty.converged, "mesh should converge with chatty leaves")
+	assert.Less(t, on.bytes, chatty.bytes, "gossip should send less than chatty leaves")
+}
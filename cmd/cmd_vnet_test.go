@@ -10,11 +10,13 @@ import (
 
 	"golang.org/x/sync/errgroup"
 
+	"github.com/fastcat/wirelink/apply"
 	"github.com/fastcat/wirelink/config"
-	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/internal/clock"
 	"github.com/fastcat/wirelink/internal/networking/vnet"
 	"github.com/fastcat/wirelink/internal/testutils"
 	"github.com/fastcat/wirelink/log"
+	"github.com/fastcat/wirelink/server"
 	"github.com/fastcat/wirelink/trust"
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
@@ -25,12 +27,40 @@ import (
 
 const wgPort = 51820
 
-func Test_Cmd_VNet1(t *testing.T) {
-	// use a 100ms time quantum for this test so we can run things on shorter timers
-	fact.ScaleExpirationQuantumForTests(20) // 50ms quantum
-	quantum := time.Second / 20
-	defer fact.ScaleExpirationQuantumForTests(1)
+// vnetIdleTimeout is how long simulate waits in real time for the servers to
+// finish the work each step of the fake clock triggered, before it gives up
+const vnetIdleTimeout = 10 * time.Second
+
+// useFakeClock makes the world and all the servers use a new fake clock
+func useFakeClock(w *vnet.World, cmds ...*WirelinkCmd) *clock.Fake {
+	fc := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	w.UseClock(fc)
+	for _, c := range cmds {
+		c.Server.UseClock(fc)
+	}
+	return fc
+}
+
+// waitForTickers waits for the servers to start at least n tickers on the fake
+// clock, so that advancing it will reach them, and then for them to finish
+// starting up
+func waitForTickers(t *testing.T, fc *clock.Fake, n int) {
+	for i := 0; fc.Tickers() < n; i++ {
+		require.Less(t, i, 1000, "servers should start their tickers")
+		time.Sleep(time.Millisecond)
+	}
+	require.True(t, fc.WaitIdle(vnetIdleTimeout), "servers should finish starting")
+}
+
+// simulate advances the fake clock by d, in steps of step, letting the servers
+// finish all the work each tick triggers before the next one
+func simulate(t *testing.T, fc *clock.Fake, d, step time.Duration) {
+	for end := fc.Now().Add(d); fc.Now().Before(end); {
+		require.True(t, fc.AdvanceWhenIdle(step, vnetIdleTimeout), "servers should finish their work")
+	}
+}
 
+func Test_Cmd_VNet1(t *testing.T) {
 	// setup our config path
 	os.Setenv("WIREVLINK_CONFIG_PATH", testutils.SrcDirectory())
 	defer os.Unsetenv("WIREVLINK_CONFIG_PATH")
@@ -103,17 +133,20 @@ func Test_Cmd_VNet1(t *testing.T) {
 	require.NoError(t, client1cmd.Init(client1.Wrap()))
 	require.NoError(t, client2cmd.Init(client2.Wrap()))
 
-	// use shortened timing for the tests
-	// in order for things to work properly, we need the chunk period, the fact ttl,
-	// and the expiration quantum to all be integer multiples with quantum < period < ttl
-	chunkPeriod := 3 * quantum // 150ms
-	factTTL := 3 * chunkPeriod // 450ms
+	// time in this test is simulated with a fake clock, so we can use realistic
+	// timings, but still make the fact ttl short relative to the chunk period
+	// so that it doesn't take too many steps to reach expiration
+	fc := useFakeClock(w, host1cmd, client1cmd, client2cmd)
+	chunkPeriod := server.DefaultChunkPeriod
+	factTTL := 3 * chunkPeriod
+	step := chunkPeriod / 5
 
 	for _, c := range []*WirelinkCmd{host1cmd, client1cmd, client2cmd} {
 		c.Server.FactTTL = factTTL
 		c.Server.ChunkPeriod = chunkPeriod
 		// send alive packets aggressively so our connectivity assertions are simple
 		c.Server.AlivePeriod = chunkPeriod / 2
+		c.Server.ProbePeriod = chunkPeriod
 	}
 
 	c1pub := client1.Interface("wg1").(*vnet.Tunnel).PublicKey()
@@ -172,7 +205,9 @@ func Test_Cmd_VNet1(t *testing.T) {
 		}
 	}
 
-	time.Sleep(chunkPeriod / 2)
+	// each server has a chunk and a probe ticker
+	waitForTickers(t, fc, 6)
+	simulate(t, fc, chunkPeriod/2, step)
 	printAll("Printing state 0: startup")
 
 	// connect the clients to the internet after a delay
@@ -187,7 +222,7 @@ func Test_Cmd_VNet1(t *testing.T) {
 			p := wgp[ps]
 			assert.NotNil(t, p.Endpoint(), "%s: should have an endpoint")
 			// can't use greater/less with durations nicely
-			receiveAge := time.Since(p.LastReceive())
+			receiveAge := fc.Since(p.LastReceive())
 			assert.True(t, receiveAge <= chunkPeriod, "%s: should have recent data from peer: %v > %v", msg, receiveAge, chunkPeriod)
 			if aip {
 				pa := p.Addrs()
@@ -210,7 +245,7 @@ func Test_Cmd_VNet1(t *testing.T) {
 			p := wgp[ps]
 			assert.NotNil(t, p.Endpoint(), "%s: should have an endpoint")
 			// can't use greater/less with durations nicely
-			receiveAge := time.Since(p.LastReceive())
+			receiveAge := fc.Since(p.LastReceive())
 			assert.True(t, receiveAge > chunkPeriod, "%s: should not have recent data from peer", msg)
 			pa := p.Addrs()
 			if aip != nil {
@@ -237,7 +272,7 @@ func Test_Cmd_VNet1(t *testing.T) {
 	// they will ping server at 1c
 	// server may not notice them and ping back until 2c
 	// server likely has AIPs for clients live here, but not vice versa
-	time.Sleep(chunkPeriod * 2) // after 2c
+	simulate(t, fc, chunkPeriod*2, step) // after 2c
 	printAll("Printing state 1a: host/client handshakes")
 	assertHealthy(host1, "wg0", c1pub, false, "1a: h knows c1")
 	assertHealthy(host1, "wg0", c2pub, false, "1a: h knows c2")
@@ -247,7 +282,7 @@ func Test_Cmd_VNet1(t *testing.T) {
 	// one more cycle after pings, AIPs should be alive in both directions
 	// peers should have added endpoints for each other and pinged,
 	// but may not have registered that yet, depending on race conditions
-	time.Sleep(chunkPeriod) // after 3c
+	simulate(t, fc, chunkPeriod, step) // after 3c
 	printAll("Printing state 1b: host/client AIPs")
 	assertHealthy(host1, "wg0", c1pub, true, "1b: h knows c1")
 	assertHealthy(host1, "wg0", c2pub, true, "1b: h knows c2")
@@ -257,7 +292,7 @@ func Test_Cmd_VNet1(t *testing.T) {
 	// assertHealthy(client2, "wg1", c1pub, false, "1b: c2 knows c1")
 
 	// one more cycle clients should definitely have handshakes and may have AIPs
-	time.Sleep(chunkPeriod) // after 4c
+	simulate(t, fc, chunkPeriod, step) // after 4c
 	printAll("Printing state 2a: host/client AIPs and client/client handshakes")
 	assertHealthy(host1, "wg0", c1pub, true, "2a: h knows c1")
 	assertHealthy(host1, "wg0", c2pub, true, "2a: h knows c2")
@@ -267,7 +302,7 @@ func Test_Cmd_VNet1(t *testing.T) {
 	assertHealthy(client2, "wg1", c1pub, false, "2a: c2 knows c1")
 
 	// one more cycle should definitely have AIPs
-	time.Sleep(chunkPeriod) // after 5c
+	simulate(t, fc, chunkPeriod, step) // after 5c
 	printAll("Printing state 2b: full AIPs")
 	assertHealthy(host1, "wg0", c1pub, true, "2b: h knows c1")
 	assertHealthy(host1, "wg0", c2pub, true, "2b: h knows c2")
@@ -290,7 +325,7 @@ func Test_Cmd_VNet1(t *testing.T) {
 	log.Debug("Adding bogus peer %s", badPub)
 	client1.Interface("wg1").(*vnet.Tunnel).AddPeer("badpeer", badPub, nil, nil)
 
-	time.Sleep(factTTL*2 + chunkPeriod) // ...?
+	simulate(t, fc, factTTL*2+chunkPeriod, step) // ...?
 	printAll("Printing state 3: delete clients")
 	// assert client2 and badpub have been evicted
 	assertHealthy(host1, "wg0", c1pub, true, "3: h knows c1")
@@ -298,12 +333,9 @@ func Test_Cmd_VNet1(t *testing.T) {
 	assertHealthy(client1, "wg1", h1pub, true, "3: c1 knows h")
 	// c2 should no longer have an alive connection to h,
 	// and thus should have forgotten its AIPs, but not removed the static trust source.
-	// however, because h is healthy (HandshakeValidity is not adjusted for the test timing here),
+	// however, because the handshake with h is still within HandshakeValidity,
 	// it may or may not have reconfigured it to remove the AIPs from the device
-	// which way it goes is a race condition of precise results from time.Now()
-	// due to this expiring at exactly the same time, so we ignore the results in this case
-	// in the real world, eventually the handshake would expire and h@c2 would be
-	// reset to LL-only mode
+	// yet, so we check that in state 4 once the handshake has aged out
 	assertUnhealthy(client2, "wg1", h1pub, nil, "3: c2 blocked from h")
 	assertNotKnows(client1, "wg1", c2pub, "3: c1 removed c2")
 	// c2 no longer gets data, so it shouldn't think it's safe to delete peers,
@@ -314,6 +346,16 @@ func Test_Cmd_VNet1(t *testing.T) {
 	assertNotKnows(host1, "wg0", badPub, "3: h never knows badpub")
 	assertNotKnows(client2, "wg1", badPub, "3: c2 never knows badpub")
 
+	// let the handshakes c2 had age out, which would take minutes in real time
+	simulate(t, fc, 2*apply.HandshakeValidity, chunkPeriod)
+	printAll("Printing state 4: aged handshakes")
+	assertHealthy(host1, "wg0", c1pub, true, "4: h knows c1")
+	assertHealthy(client1, "wg1", h1pub, true, "4: c1 knows h")
+	// with no healthy handshake, c2 resets h to LL-only mode
+	assertUnhealthy(client2, "wg1", h1pub, boolPtr(false), "4: c2 blocked from h")
+	// c2 has no facts left about c1, so leaves its config alone
+	assertUnhealthy(client2, "wg1", c1pub, nil, "4: c2 retains c1")
+
 	// make sure the prints above came through
 	time.Sleep(100 * time.Millisecond)
 	log.Debug("Stopping servers")
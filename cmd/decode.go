@@ -0,0 +1,277 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"github.com/fastcat/wirelink/autopeer"
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/internal/pcap"
+	"github.com/fastcat/wirelink/signing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// DecodeCommand is the name of the subcommand to decode captured packets
+const DecodeCommand = "decode"
+
+// DecodeCmd represents an instance of the command line to decode captured
+// wirelink packets and print the facts in them
+type DecodeCmd struct {
+	args []string
+	in   io.Reader
+	out  io.Writer
+
+	hex    bool
+	port   int
+	peers  config.Peers
+	scheme *autopeer.Scheme
+	signer *signing.Signer
+}
+
+// NewDecode creates a new decode command instance using the given os.Args
+// value, which includes the subcommand name, reading from stdin when no files
+// are given, and printing to out
+func NewDecode(args []string, in io.Reader, out io.Writer) *DecodeCmd {
+	return &DecodeCmd{
+		args: args,
+		in:   in,
+		out:  out,
+	}
+}
+
+// Run parses the command line and decodes all the inputs
+func (d *DecodeCmd) Run() error {
+	flags := pflag.NewFlagSet(fmt.Sprintf("%s %s", d.args[0], DecodeCommand), pflag.ContinueOnError)
+	flags.SetOutput(d.out)
+	flags.BoolVar(&d.hex, "hex", false, "Inputs are hex dumps with one packet per line, instead of raw bytes")
+	flags.IntVar(&d.port, "port", 0, "Only decode packets captured to or from this port (default any)")
+	configFile := flags.StringP("config", "c", "", "Config file to read peer names and the auto address scheme from")
+	keyFile := flags.StringP("key", "k", "", "File with a private key to verify signatures with")
+	flags.Usage = func() {
+		fmt.Fprintf(d.out, "Usage: %s %s [flags] [packet or pcap files...]\n", d.args[0], DecodeCommand)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(d.args[2:]); err != nil {
+		return err
+	}
+
+	if *configFile != "" {
+		var err error
+		if d.peers, d.scheme, err = readPeerConfig(*configFile); err != nil {
+			return err
+		}
+	}
+	if *keyFile != "" {
+		keyData, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to read private key")
+		}
+		key, err := wgtypes.ParseKey(strings.TrimSpace(string(keyData)))
+		if err != nil {
+			return errors.Wrapf(err, "Unable to parse private key")
+		}
+		d.signer = signing.New(&key)
+	}
+
+	if flags.NArg() == 0 {
+		return d.decodeInput("stdin", d.in)
+	}
+	for _, name := range flags.Args() {
+		if name == "-" {
+			if err := d.decodeInput("stdin", d.in); err != nil {
+				return err
+			}
+			continue
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to open input")
+		}
+		err = d.decodeInput(name, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readPeerConfig loads the peers from a config file, for their names and keys,
+// and the auto address scheme, to know which addresses they use
+func readPeerConfig(path string) (config.Peers, *autopeer.Scheme, error) {
+	vcfg := viper.New()
+	vcfg.SetConfigFile(path)
+	if err := vcfg.ReadInConfig(); err != nil {
+		return nil, nil, errors.Wrap(err, "Unable to read config file")
+	}
+	var data config.ServerData
+	if err := vcfg.Unmarshal(&data); err != nil {
+		return nil, nil, errors.Wrap(err, "Unable to parse config")
+	}
+	ret := make(config.Peers, len(data.Peers))
+	for _, peerDatum := range data.Peers {
+		key, peerConf, err := peerDatum.Parse()
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "Cannot parse peer config from %+v", peerDatum)
+		}
+		ret[key] = &peerConf
+	}
+	scheme, err := autopeer.ParseScheme(data.AutoAddress)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Bad AutoAddress")
+	}
+	return ret, scheme, nil
+}
+
+func (d *DecodeCmd) decodeInput(name string, r io.Reader) error {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(4)
+	switch {
+	case pcap.IsPcap(head):
+		pr, err := pcap.NewReader(br)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to read %s", name)
+		}
+		for i := 1; ; i++ {
+			p, err := pr.Next()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return errors.Wrapf(err, "Unable to read %s", name)
+			}
+			if d.port != 0 && p.Src.Port != d.port && p.Dst.Port != d.port {
+				continue
+			}
+			d.decodePacket(fmt.Sprintf("%s #%d", name, i), p)
+		}
+	case d.hex:
+		scanner := bufio.NewScanner(br)
+		scanner.Buffer(nil, 2*fact.UDPMaxPayload*2)
+		for i := 1; scanner.Scan(); i++ {
+			line := strings.Join(strings.Fields(scanner.Text()), "")
+			if line == "" {
+				continue
+			}
+			data, err := hex.DecodeString(line)
+			if err != nil {
+				fmt.Fprintf(d.out, "%s line %d: invalid hex: %v\n", name, i, err)
+				continue
+			}
+			d.decodePacket(fmt.Sprintf("%s line %d", name, i), &pcap.Packet{Time: time.Now(), Payload: data})
+		}
+		return errors.Wrapf(scanner.Err(), "Unable to read %s", name)
+	default:
+		data, err := ioutil.ReadAll(br)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to read %s", name)
+		}
+		d.decodePacket(name, &pcap.Packet{Time: time.Now(), Payload: data})
+		return nil
+	}
+}
+
+// peerName formats a key with its configured name, if any
+func (d *DecodeCmd) peerName(key wgtypes.Key) string {
+	if name := d.peers.Name(key); name != "" {
+		return name
+	}
+	return key.String()
+}
+
+func (d *DecodeCmd) formatSubject(s fact.Subject) string {
+	if ps, ok := s.(*fact.PeerSubject); ok {
+		return d.peerName(ps.Key)
+	}
+	return s.String()
+}
+
+// peerAt finds the configured peer whose automatic address is the given one
+func (d *DecodeCmd) peerAt(addr *net.UDPAddr) (wgtypes.Key, bool) {
+	if addr == nil {
+		return wgtypes.Key{}, false
+	}
+	for key := range d.peers {
+		if d.scheme.Address(key).Equal(addr.IP) {
+			return key, true
+		}
+	}
+	return wgtypes.Key{}, false
+}
+
+// verify checks the signature on a group, if we have a key to do so
+func (d *DecodeCmd) verify(sender wgtypes.Key, sgv *fact.SignedGroupValue, dst *net.UDPAddr) string {
+	if d.signer == nil {
+		return "not verified"
+	}
+	// the shared key is the same for both sides, but if we are the sender, we
+	// need to figure out who the recipient was
+	peer := sender
+	if sender == d.signer.PublicKey {
+		var ok bool
+		if peer, ok = d.peerAt(dst); !ok {
+			return "not verified: unknown recipient"
+		}
+	}
+	if _, err := d.signer.VerifyFrom(sgv.Nonce, sgv.Tag, sgv.InnerBytes, &peer); err != nil {
+		return fmt.Sprintf("INVALID: %v", err)
+	}
+	return "verified"
+}
+
+func (d *DecodeCmd) decodePacket(label string, p *pcap.Packet) {
+	fmt.Fprintf(d.out, "%s", label)
+	if p.Src != nil && p.Dst != nil {
+		fmt.Fprintf(d.out, " %s %v -> %v", p.Time.UTC().Format(time.RFC3339Nano), p.Src, p.Dst)
+	}
+	fmt.Fprintf(d.out, " (%d bytes)\n", len(p.Payload))
+
+	f := &fact.Fact{}
+	if err := f.DecodeFrom(len(p.Payload), p.Time, bytes.NewBuffer(p.Payload)); err != nil {
+		fmt.Fprintf(d.out, "  unable to decode fact: %v\n", err)
+		return
+	}
+	if f.Attribute != fact.AttributeSignedGroup {
+		fmt.Fprintf(d.out, "  unsigned fact: %s\n", f.FancyString(d.formatSubject, p.Time))
+		return
+	}
+	ps, ok := f.Subject.(*fact.PeerSubject)
+	if !ok {
+		fmt.Fprintf(d.out, "  signed group has non-peer subject: %v\n", f.Subject)
+		return
+	}
+	sgv, ok := f.Value.(*fact.SignedGroupValue)
+	if !ok {
+		fmt.Fprintf(d.out, "  signed group has wrong value type: %T\n", f.Value)
+		return
+	}
+	inner, compact, err := sgv.ParseInnerWithEncoding(p.Time)
+	kind := "signed group"
+	if compact {
+		kind = "compact signed group"
+	}
+	fmt.Fprintf(d.out, "  %s from %s, %d facts, %s\n", kind, d.peerName(ps.Key), len(inner), d.verify(ps.Key, sgv, p.Dst))
+	if p.Src != nil && !d.scheme.Address(ps.Key).Equal(p.Src.IP) {
+		fmt.Fprintf(d.out, "  source address does not match sender, expected %v\n", d.scheme.Address(ps.Key))
+	}
+	for _, innerFact := range inner {
+		fmt.Fprintf(d.out, "    %s\n", innerFact.FancyString(d.formatSubject, p.Time))
+	}
+	if err != nil {
+		fmt.Fprintf(d.out, "  unable to parse rest of group: %v\n", err)
+	}
+}
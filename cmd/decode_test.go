@@ -0,0 +1,256 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/fastcat/wirelink/autopeer"
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/internal/pcap"
+	"github.com/fastcat/wirelink/internal/testutils"
+	"github.com/fastcat/wirelink/signing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeCmd_Run(t *testing.T) {
+	alicePriv, alicePub := testutils.MustKeyPair(t)
+	bobPriv, bobPub := testutils.MustKeyPair(t)
+	_, evePub := testutils.MustKeyPair(t)
+	now := time.Now().Truncate(time.Microsecond)
+
+	ga := fact.NewAccumulator(fact.SignedGroupMaxSafeInnerLength, now)
+	require.NoError(t, ga.AddFact(&fact.Fact{
+		Attribute: fact.AttributeEndpointV4,
+		Subject:   &fact.PeerSubject{Key: bobPub},
+		Value:     &fact.IPPortValue{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 51820},
+		Expires:   now.Add(30 * time.Second),
+	}))
+	groups, err := ga.MakeSignedGroups(signing.New(&alicePriv), &bobPub)
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+	packet, err := groups[0].MarshalBinaryNow(now)
+	require.NoError(t, err)
+	cga := fact.NewAccumulator(fact.SignedGroupMaxSafeInnerLength, now)
+	cga.SetCompact(true)
+	for _, port := range []int{51820, 51821} {
+		require.NoError(t, cga.AddFact(&fact.Fact{
+			Attribute: fact.AttributeEndpointV4,
+			Subject:   &fact.PeerSubject{Key: bobPub},
+			Value:     &fact.IPPortValue{IP: net.IPv4(192, 0, 2, 1).To4(), Port: port},
+			Expires:   now.Add(30 * time.Second),
+		}))
+	}
+	groups, err = cga.MakeSignedGroups(signing.New(&alicePriv), &bobPub)
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+	compactPacket, err := groups[0].MarshalBinaryNow(now)
+	require.NoError(t, err)
+	tampered := append([]byte(nil), packet...)
+	tampered[len(tampered)-1] ^= 0xff
+
+	dir, err := ioutil.TempDir("", "wirelink-decode")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	writeFile := func(name string, data []byte) string {
+		p := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(p, data, 0600))
+		return p
+	}
+	v4ll, err := autopeer.ParseScheme(autopeer.SchemeIPv4LinkLocal)
+	require.NoError(t, err)
+	writePcap := func(name string, src net.IP, payloads ...[]byte) string {
+		// the recipient must be in the same address family as the sender
+		dst := autopeer.AutoAddress(bobPub)
+		if src.To4() != nil {
+			dst = v4ll.Address(bobPub)
+		}
+		var buf bytes.Buffer
+		w, err := pcap.NewWriter(&buf)
+		require.NoError(t, err)
+		for _, payload := range payloads {
+			require.NoError(t, w.WritePacket(&pcap.Packet{
+				Time:    now,
+				Src:     &net.UDPAddr{IP: src, Port: 51821},
+				Dst:     &net.UDPAddr{IP: dst, Port: 51821},
+				Payload: payload,
+			}))
+		}
+		return writeFile(name, buf.Bytes())
+	}
+
+	configFile := writeFile("wirelink.json", []byte(fmt.Sprintf(
+		`{"Peers":[{"PublicKey":%q,"Name":"alice"},{"PublicKey":%q,"Name":"bob"}]}`,
+		alicePub, bobPub,
+	)))
+	v4ConfigFile := writeFile("wirelink-v4.json", []byte(fmt.Sprintf(
+		`{"AutoAddress":"ipv4-link-local","Peers":[{"PublicKey":%q,"Name":"alice"},{"PublicKey":%q,"Name":"bob"}]}`,
+		alicePub, bobPub,
+	)))
+	badConfigFile := writeFile("wirelink-bad.json", []byte(`{"AutoAddress":"10.0.0.0/8"}`))
+	aliceKeyFile := writeFile("alice.key", []byte(alicePriv.String()+"\n"))
+	bobKeyFile := writeFile("bob.key", []byte(bobPriv.String()+"\n"))
+
+	tests := []struct {
+		name      string
+		args      []string
+		stdin     []byte
+		assertion require.ErrorAssertionFunc
+		contains  []string
+		excludes  []string
+	}{
+		{
+			"help",
+			[]string{"--help"},
+			nil,
+			func(t require.TestingT, err error, msgAndArgs ...interface{}) {
+				require.Equal(t, pflag.ErrHelp, err, msgAndArgs...)
+			},
+			[]string{"Usage:", "--hex"},
+			nil,
+		},
+		{
+			"raw stdin, no config",
+			nil,
+			packet,
+			require.NoError,
+			[]string{
+				"stdin (",
+				fmt.Sprintf("signed group from %s, 1 facts, not verified", alicePub),
+				fmt.Sprintf("s:%s v:192.0.2.1:51820", bobPub),
+			},
+			[]string{"source address"},
+		},
+		{
+			"raw file with names, verified by recipient",
+			[]string{"--config", configFile, "--key", bobKeyFile, writeFile("raw.bin", packet)},
+			nil,
+			require.NoError,
+			[]string{"signed group from alice, 1 facts, verified", "{a:e s:bob v:192.0.2.1:51820 ttl:30.000}"},
+			nil,
+		},
+		{
+			"compact group",
+			[]string{"--config", configFile, "--key", bobKeyFile, writeFile("compact.bin", compactPacket)},
+			nil,
+			require.NoError,
+			[]string{
+				"compact signed group from alice, 2 facts, verified",
+				"{a:e s:bob v:192.0.2.1:51820 ttl:30.000}",
+				"{a:e s:bob v:192.0.2.1:51821 ttl:30.000}",
+			},
+			nil,
+		},
+		{
+			"pcap verified by sender",
+			[]string{"-c", configFile, "-k", aliceKeyFile, writePcap("good.pcap", autopeer.AutoAddress(alicePub), packet)},
+			nil,
+			require.NoError,
+			[]string{
+				fmt.Sprintf("good.pcap #1 %s", now.UTC().Format(time.RFC3339Nano)),
+				"signed group from alice, 1 facts, verified",
+				"s:bob",
+			},
+			[]string{"source address"},
+		},
+		{
+			"pcap spoofed source and tampered packet",
+			[]string{"-c", configFile, "-k", bobKeyFile, writePcap("bad.pcap", autopeer.AutoAddress(evePub), tampered)},
+			nil,
+			require.NoError,
+			[]string{"INVALID", "source address does not match sender"},
+			nil,
+		},
+		{
+			"pcap with ipv4 auto address",
+			[]string{"-c", v4ConfigFile, writePcap("v4.pcap", v4ll.Address(alicePub), packet)},
+			nil,
+			require.NoError,
+			[]string{"signed group from alice, 1 facts, not verified"},
+			[]string{"source address"},
+		},
+		{
+			"pcap with ipv4 auto address, default scheme",
+			[]string{"-c", configFile, writePcap("v4-default.pcap", v4ll.Address(alicePub), packet)},
+			nil,
+			require.NoError,
+			[]string{"source address does not match sender"},
+			nil,
+		},
+		{
+			"bad auto address config",
+			[]string{"-c", badConfigFile, writeFile("bad-config.bin", packet)},
+			nil,
+			require.Error,
+			nil,
+			[]string{"signed group"},
+		},
+		{
+			"pcap filtered by port",
+			[]string{"--port", "1234", writePcap("filtered.pcap", autopeer.AutoAddress(alicePub), packet)},
+			nil,
+			require.NoError,
+			nil,
+			[]string{"signed group"},
+		},
+		{
+			"hex lines",
+			[]string{"--hex", "-"},
+			[]byte("garbage\n\n" + hex.EncodeToString(packet[:10]) + " " + hex.EncodeToString(packet[10:]) + "\n"),
+			require.NoError,
+			[]string{"stdin line 1: invalid hex", "stdin line 3 (", "signed group from"},
+			nil,
+		},
+		{
+			"truncated packet",
+			nil,
+			packet[:20],
+			require.NoError,
+			[]string{"unable to decode fact"},
+			nil,
+		},
+		{
+			"missing file",
+			[]string{filepath.Join(dir, "nonexistent")},
+			nil,
+			require.Error,
+			nil,
+			nil,
+		},
+		{
+			"bad key",
+			[]string{"--key", configFile},
+			nil,
+			require.Error,
+			nil,
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			args := append([]string{"wirelink", DecodeCommand}, tt.args...)
+			d := NewDecode(args, bytes.NewReader(tt.stdin), &out)
+			tt.assertion(t, d.Run())
+			output := out.String()
+			for _, s := range tt.contains {
+				assert.Contains(t, output, s)
+			}
+			for _, s := range tt.excludes {
+				assert.False(t, strings.Contains(output, s), "output should not contain %q:\n%s", s, output)
+			}
+		})
+	}
+}
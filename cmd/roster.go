@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/spf13/pflag"
+
+	"github.com/fastcat/wirelink/roster"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// RosterCommand is the name of the subcommand to manage signed rosters
+const RosterCommand = "roster"
+
+// DefaultRosterValidity is how long a signed roster is valid for, unless
+// another time is given when signing it
+const DefaultRosterValidity = 30 * 24 * time.Hour
+
+// RosterCmd represents an instance of the command line to generate roster
+// keys and sign rosters
+type RosterCmd struct {
+	args []string
+	in   io.Reader
+	out  io.Writer
+}
+
+// RosterData is the JSON format of the roster input to sign
+type RosterData struct {
+	Members []RosterMemberData
+}
+
+// RosterMemberData is the JSON format of a single member to put in the roster
+type RosterMemberData struct {
+	PublicKey  string
+	Name       string
+	AllowedIPs []string
+}
+
+// NewRoster creates a new roster command instance using the given os.Args
+// value, which includes the subcommand name, reading keys and rosters from in
+// when no files are given, and printing to out
+func NewRoster(args []string, in io.Reader, out io.Writer) *RosterCmd {
+	return &RosterCmd{
+		args: args,
+		in:   in,
+		out:  out,
+	}
+}
+
+func (r *RosterCmd) usage() {
+	fmt.Fprintf(r.out, "Usage: %s %s genkey|pubkey|sign [flags] [roster.json]\n", r.args[0], RosterCommand)
+	fmt.Fprintf(r.out, "  genkey: print a new root private key\n")
+	fmt.Fprintf(r.out, "  pubkey: print the public key for the private key on stdin\n")
+	fmt.Fprintf(r.out, "  sign:   print the signed pages of a JSON roster\n")
+}
+
+// Run parses the command line and runs the roster subcommand
+func (r *RosterCmd) Run() error {
+	if len(r.args) < 3 {
+		r.usage()
+		return pflag.ErrHelp
+	}
+	switch r.args[2] {
+	case "genkey":
+		priv, err := roster.GenerateKey()
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(r.out, roster.EncodePrivateKey(priv))
+		return err
+	case "pubkey":
+		priv, err := readRosterKey(r.in)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(r.out, roster.EncodePublicKey(priv.Public().(ed25519.PublicKey)))
+		return err
+	case "sign":
+		return r.sign()
+	case "-h", "--help", "help":
+		r.usage()
+		return pflag.ErrHelp
+	default:
+		r.usage()
+		return errors.Errorf("Unknown roster command '%s'", r.args[2])
+	}
+}
+
+func (r *RosterCmd) sign() error {
+	flags := pflag.NewFlagSet(fmt.Sprintf("%s %s sign", r.args[0], RosterCommand), pflag.ContinueOnError)
+	flags.SetOutput(r.out)
+	keyFile := flags.StringP("key", "k", "", "File with the root private key to sign with (required)")
+	serial := flags.Uint64P("serial", "s", 0, "Serial number of the roster, must be larger than the previous one (required)")
+	valid := flags.DurationP("valid", "v", DefaultRosterValidity, "How long the roster is valid for before it must be signed again")
+	flags.Usage = func() {
+		fmt.Fprintf(r.out, "Usage: %s %s sign [flags] [roster.json]\n", r.args[0], RosterCommand)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(r.args[3:]); err != nil {
+		return err
+	}
+	if *keyFile == "" || *serial == 0 {
+		flags.Usage()
+		return errors.New("Signing a roster requires a key file and a serial")
+	}
+	if *valid <= 0 {
+		return errors.Errorf("Roster validity must be positive, not %v", *valid)
+	}
+
+	keyData, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		return errors.Wrap(err, "Unable to read roster key")
+	}
+	priv, err := roster.ParsePrivateKey(strings.TrimSpace(string(keyData)))
+	if err != nil {
+		return err
+	}
+
+	var input []byte
+	if flags.NArg() == 0 || flags.Arg(0) == "-" {
+		input, err = ioutil.ReadAll(r.in)
+	} else {
+		input, err = ioutil.ReadFile(flags.Arg(0))
+	}
+	if err != nil {
+		return errors.Wrap(err, "Unable to read roster")
+	}
+	var data RosterData
+	if err = json.Unmarshal(input, &data); err != nil {
+		return errors.Wrap(err, "Unable to parse roster")
+	}
+	members, err := data.Parse()
+	if err != nil {
+		return err
+	}
+
+	pages, err := roster.Sign(priv, *serial, time.Now().Add(*valid), members)
+	if err != nil {
+		return err
+	}
+	return roster.Write(r.out, pages)
+}
+
+// Parse validates the roster data and converts it to roster members
+func (d *RosterData) Parse() ([]roster.Member, error) {
+	ret := make([]roster.Member, 0, len(d.Members))
+	seen := make(map[wgtypes.Key]bool, len(d.Members))
+	for _, md := range d.Members {
+		key, err := wgtypes.ParseKey(md.PublicKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Bad PublicKey for roster member '%s'", md.Name)
+		}
+		if seen[key] {
+			return nil, errors.Errorf("Duplicate roster member %s", key)
+		}
+		seen[key] = true
+		m := roster.Member{PublicKey: key, Name: md.Name}
+		for _, aip := range md.AllowedIPs {
+			_, ipn, err := net.ParseCIDR(aip)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Bad AllowedIP '%s' for roster member '%s'", aip, md.Name)
+			}
+			m.AllowedIPs = append(m.AllowedIPs, *ipn)
+		}
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+// readRosterKey reads a root private key
+func readRosterKey(in io.Reader) (ed25519.PrivateKey, error) {
+	keyData, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read roster key")
+	}
+	return roster.ParsePrivateKey(strings.TrimSpace(string(keyData)))
+}
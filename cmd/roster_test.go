@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/fastcat/wirelink/internal/testutils"
+	"github.com/fastcat/wirelink/roster"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRosterCmd_Run(t *testing.T) {
+	run := func(in string, args ...string) (string, error) {
+		out := &bytes.Buffer{}
+		err := NewRoster(append([]string{"wirelink", RosterCommand}, args...), strings.NewReader(in), out).Run()
+		return out.String(), err
+	}
+
+	privText, err := run("", "genkey")
+	require.NoError(t, err)
+	priv, err := roster.ParsePrivateKey(strings.TrimSpace(privText))
+	require.NoError(t, err)
+	pub := priv.Public().(ed25519.PublicKey)
+
+	pubText, err := run(privText, "pubkey")
+	require.NoError(t, err)
+	assert.Equal(t, roster.EncodePublicKey(pub)+"\n", pubText)
+
+	dir, err := ioutil.TempDir("", "wirelink-roster")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	keyFile := filepath.Join(dir, "root.key")
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte(privText), 0600))
+
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	rosterJSON := fmt.Sprintf(`{"Members":[
+		{"PublicKey":"%s","Name":"alice","AllowedIPs":["10.1.0.0/16","fd00::1/64"]},
+		{"PublicKey":"%s","Name":"bob"}
+	]}`, k1, k2)
+	rosterFile := filepath.Join(dir, "roster.json")
+	require.NoError(t, ioutil.WriteFile(rosterFile, []byte(rosterJSON), 0600))
+
+	for _, tt := range []struct {
+		args  []string
+		valid time.Duration
+	}{
+		{[]string{"sign", "-k", keyFile, "-s", "4", rosterFile}, DefaultRosterValidity},
+		{[]string{"sign", "--key", keyFile, "--serial", "4", "--valid", "48h", "-"}, 48 * time.Hour},
+	} {
+		args := tt.args
+		now := time.Now()
+		pagesText, err := run(rosterJSON, args...)
+		require.NoError(t, err, "args: %v", args)
+		pages, err := roster.Read(strings.NewReader(pagesText), pub)
+		require.NoError(t, err)
+		require.NotEmpty(t, pages)
+		assert.WithinDuration(t, now.Add(tt.valid), pages[0].NotAfter, 2*time.Second)
+		serial, members, ok := roster.Current(pages, now)
+		require.True(t, ok)
+		assert.Equal(t, uint64(4), serial)
+		require.Len(t, members, 2)
+		assert.Equal(t, k1, members[0].PublicKey)
+		assert.Equal(t, "alice", members[0].Name)
+		require.Len(t, members[0].AllowedIPs, 2)
+		assert.Equal(t, "10.1.0.0/16", members[0].AllowedIPs[0].String())
+		assert.Equal(t, "fd00::/64", members[0].AllowedIPs[1].String())
+		assert.Equal(t, k2, members[1].PublicKey)
+	}
+
+	tests := []struct {
+		name string
+		in   string
+		args []string
+	}{
+		{"no command", "", nil},
+		{"unknown command", "", []string{"frob"}},
+		{"bad private key", "nope", []string{"pubkey"}},
+		{"sign without key", rosterJSON, []string{"sign", "-s", "1"}},
+		{"sign without serial", rosterJSON, []string{"sign", "-k", keyFile}},
+		{"sign already expired", rosterJSON, []string{"sign", "-k", keyFile, "-s", "1", "-v", "-1h"}},
+		{"sign missing key file", rosterJSON, []string{"sign", "-k", filepath.Join(dir, "missing"), "-s", "1"}},
+		{"sign bad json", "{", []string{"sign", "-k", keyFile, "-s", "1"}},
+		{"sign bad member key", `{"Members":[{"PublicKey":"nope"}]}`, []string{"sign", "-k", keyFile, "-s", "1"}},
+		{"sign bad allowed ip", fmt.Sprintf(`{"Members":[{"PublicKey":"%s","AllowedIPs":["10.1"]}]}`, k1),
+			[]string{"sign", "-k", keyFile, "-s", "1"}},
+		{"sign duplicate member", fmt.Sprintf(`{"Members":[{"PublicKey":"%s"},{"PublicKey":"%s"}]}`, k1, k1),
+			[]string{"sign", "-k", keyFile, "-s", "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := run(tt.in, tt.args...)
+			assert.Error(t, err)
+		})
+	}
+
+	_, err = run("", "help")
+	assert.Equal(t, pflag.ErrHelp, err)
+}
@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/enroll"
+	"github.com/fastcat/wirelink/internal/networking"
+)
+
+// TokenCommand is the name of the subcommand to manage join tokens
+const TokenCommand = "token"
+
+// TokenCmd represents an instance of the command line to create join tokens
+type TokenCmd struct {
+	args []string
+	env  networking.Environment
+	out  io.Writer
+	now  func() time.Time
+}
+
+// NewToken creates a new token command instance using the given os.Args
+// value, which includes the subcommand name, reading the local wireguard
+// device from env, and printing to out
+func NewToken(args []string, env networking.Environment, out io.Writer) *TokenCmd {
+	return &TokenCmd{
+		args: args,
+		env:  env,
+		out:  out,
+		now:  time.Now,
+	}
+}
+
+func (tc *TokenCmd) usage() {
+	fmt.Fprintf(tc.out, "Usage: %s %s create [flags]\n", tc.args[0], TokenCommand)
+	fmt.Fprintf(tc.out, "  create: print a new one-time join token for this node\n")
+}
+
+// Run parses the command line and runs the token subcommand
+func (tc *TokenCmd) Run() error {
+	if len(tc.args) < 3 {
+		tc.usage()
+		return pflag.ErrHelp
+	}
+	switch tc.args[2] {
+	case "create":
+		return tc.create()
+	case "-h", "--help", "help":
+		tc.usage()
+		return pflag.ErrHelp
+	default:
+		tc.usage()
+		return errors.Errorf("Unknown token command '%s'", tc.args[2])
+	}
+}
+
+func (tc *TokenCmd) create() error {
+	flags := pflag.NewFlagSet(fmt.Sprintf("%s %s create", tc.args[0], TokenCommand), pflag.ContinueOnError)
+	flags.SetOutput(tc.out)
+	configFile := flags.StringP("config", "c", "", "Config file of the wirelink instance that will accept the token (required)")
+	endpoint := flags.StringP("endpoint", "e", "", "Public host[:port] new nodes can reach this node at (required)")
+	name := flags.StringP("name", "n", "", "Name to give the node that joins with the token")
+	aips := flags.StringSlice("allowed-ips", nil, "AllowedIPs to give the node that joins with the token")
+	ttl := flags.Duration("ttl", enroll.DefaultTokenTTL, "How long the token may be used for")
+	flags.Usage = func() {
+		fmt.Fprintf(tc.out, "Usage: %s %s create [flags]\n", tc.args[0], TokenCommand)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(tc.args[3:]); err != nil {
+		return err
+	}
+	if *configFile == "" || *endpoint == "" {
+		flags.Usage()
+		return errors.New("Config file and endpoint are required")
+	}
+	if *ttl <= 0 {
+		return errors.Errorf("Invalid token TTL %v", *ttl)
+	}
+
+	vcfg := viper.New()
+	vcfg.SetConfigFile(*configFile)
+	if err := vcfg.ReadInConfig(); err != nil {
+		return errors.Wrap(err, "Unable to read config file")
+	}
+	var data config.ServerData
+	if err := vcfg.Unmarshal(&data); err != nil {
+		return errors.Wrap(err, "Unable to parse config")
+	}
+	if data.TokenKeyFile == "" {
+		return errors.New("Config does not set TokenKeyFile, so it cannot accept join tokens")
+	}
+	if data.Iface == "" {
+		data.Iface = "wg0"
+	}
+
+	var allowedIPs []net.IPNet
+	for _, aip := range *aips {
+		_, ipn, err := net.ParseCIDR(aip)
+		if err != nil {
+			return errors.Wrapf(err, "Bad AllowedIP '%s'", aip)
+		}
+		allowedIPs = append(allowedIPs, *ipn)
+	}
+
+	ctrl, err := tc.env.NewWgClient()
+	if err != nil {
+		return errors.Wrap(err, "Unable to open wireguard control")
+	}
+	defer ctrl.Close()
+	device, err := ctrl.Device(data.Iface)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to read wireguard device %s", data.Iface)
+	}
+
+	// these defaults match those the server uses
+	if _, _, err := net.SplitHostPort(*endpoint); err != nil {
+		*endpoint = net.JoinHostPort(*endpoint, strconv.Itoa(device.ListenPort))
+	}
+	joinPort := data.JoinPort
+	if joinPort <= 0 {
+		port := data.Port
+		if port <= 0 {
+			port = device.ListenPort + 1
+		}
+		joinPort = port + 1
+	}
+
+	secret, err := enroll.LoadOrCreateSecret(data.TokenKeyFile)
+	if err != nil {
+		return err
+	}
+	token, err := enroll.NewToken(device.PublicKey, *endpoint, joinPort, *name, allowedIPs, tc.now().Add(*ttl))
+	if err != nil {
+		return err
+	}
+	encoded, err := token.Sign(secret)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(tc.out, encoded)
+	return err
+}
@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/enroll"
+	"github.com/fastcat/wirelink/internal/mocks"
+	netmocks "github.com/fastcat/wirelink/internal/networking/mocks"
+	"github.com/fastcat/wirelink/internal/testutils"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenCmd_Run(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wirelink-token")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "token.key")
+	enrollFile := filepath.Join(dir, "enrolled.json")
+	configFile := filepath.Join(dir, "wirelink.wg0.json")
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(fmt.Sprintf(
+		`{"TokenKeyFile": %q, "EnrollmentFile": %q}`, keyFile, enrollFile,
+	)), 0600))
+	noKeyFile := filepath.Join(dir, "nokey.json")
+	require.NoError(t, ioutil.WriteFile(noKeyFile, []byte(`{}`), 0600))
+
+	routerKey := testutils.MustKey(t)
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    func(*testing.T, *enroll.Token)
+		wantErr bool
+	}{
+		{
+			"defaults",
+			[]string{"create", "-c", configFile, "-e", "example.com"},
+			func(t *testing.T, token *enroll.Token) {
+				assert.Equal(t, routerKey, token.Router)
+				assert.Equal(t, "example.com:51820", token.Endpoint)
+				assert.Equal(t, 51822, token.JoinPort)
+				assert.Empty(t, token.Name)
+				assert.Empty(t, token.AllowedIPs)
+				assert.True(t, token.Expires.Equal(now.Add(enroll.DefaultTokenTTL).Truncate(time.Second)))
+			},
+			false,
+		},
+		{
+			"everything",
+			[]string{
+				"create", "-c", configFile, "-e", "example.com:1234",
+				"--name", "newbie", "--allowed-ips", "192.168.1.0/24,fd00::/64", "--ttl", "5m",
+			},
+			func(t *testing.T, token *enroll.Token) {
+				assert.Equal(t, "example.com:1234", token.Endpoint)
+				assert.Equal(t, 51822, token.JoinPort)
+				assert.Equal(t, "newbie", token.Name)
+				if assert.Len(t, token.AllowedIPs, 2) {
+					assert.Equal(t, "192.168.1.0/24", token.AllowedIPs[0].String())
+					assert.Equal(t, "fd00::/64", token.AllowedIPs[1].String())
+				}
+				assert.True(t, token.Expires.Equal(now.Add(5*time.Minute).Truncate(time.Second)))
+			},
+			false,
+		},
+		{
+			"missing endpoint",
+			[]string{"create", "-c", configFile},
+			nil,
+			true,
+		},
+		{
+			"no token key",
+			[]string{"create", "-c", noKeyFile, "-e", "example.com"},
+			nil,
+			true,
+		},
+		{
+			"bad allowed ip",
+			[]string{"create", "-c", configFile, "-e", "example.com", "--allowed-ips", "bogus"},
+			nil,
+			true,
+		},
+		{
+			"unknown command",
+			[]string{"revoke"},
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := &mocks.WgClient{}
+			ctrl.Test(t)
+			ctrl.On("Device", "wg0").Return(&wgtypes.Device{
+				Name:       "wg0",
+				PublicKey:  routerKey,
+				ListenPort: 51820,
+			}, nil).Maybe()
+			ctrl.On("Close").Return(nil).Maybe()
+			env := &netmocks.Environment{}
+			env.Test(t)
+			env.On("NewWgClient").Return(ctrl, nil).Maybe()
+
+			out := &bytes.Buffer{}
+			tc := NewToken(append([]string{"wirelink", TokenCommand}, tt.args...), env, out)
+			tc.now = func() time.Time { return now }
+			err := tc.Run()
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			token, err := enroll.ParseToken(strings.TrimSpace(out.String()))
+			require.NoError(t, err)
+			secret, err := enroll.LoadOrCreateSecret(keyFile)
+			require.NoError(t, err)
+			assert.NoError(t, token.Verify(secret))
+			tt.want(t, token)
+			ctrl.AssertExpectations(t)
+			env.AssertExpectations(t)
+		})
+	}
+}
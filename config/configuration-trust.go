@@ -21,15 +21,25 @@ type configEvaluator struct {
 var _ trust.Evaluator = &configEvaluator{}
 
 // CreateTrustEvaluator maps a peer config map into an evaluator that returns the
-// configured trust levels
-func CreateTrustEvaluator(peers Peers) trust.Evaluator {
+// configured trust levels, recognizing peers by their address in the given
+// auto address scheme. Addresses shared by more than one peer are ignored,
+// since we can't tell which of them a packet came from.
+func CreateTrustEvaluator(peers Peers, scheme *autopeer.Scheme) trust.Evaluator {
 	ret := &configEvaluator{
 		Peers:    peers,
 		ipToPeer: make(map[[net.IPv6len]byte]wgtypes.Key, len(peers)),
 		// peerIPs:  make(map[wgtypes.Key]net.IP, len(peers)),
 	}
+	keys := make([]wgtypes.Key, 0, len(peers))
 	for peer := range peers {
-		pip := autopeer.AutoAddress(peer)
+		keys = append(keys, peer)
+	}
+	colliding := scheme.Collisions(keys...)
+	for peer := range peers {
+		if colliding[peer] {
+			continue
+		}
+		pip := scheme.Address(peer)
 		ret.ipToPeer[util.IPToBytes(pip)] = peer
 		// ret.peerIPs[peer] = pip
 	}
@@ -42,7 +52,7 @@ func (c *configEvaluator) IsKnown(subject fact.Subject) bool {
 }
 
 // TrustLevel looks up the fact's source IP in the list of known peers'
-// IPv6-LL addresses, and returns the configured trust level for that peer,
+// automatic addresses, and returns the configured trust level for that peer,
 // if found and configured
 func (c *configEvaluator) TrustLevel(f *fact.Fact, source net.UDPAddr) *trust.Level {
 	// we evaluate the trust level based on the _source_, not the _subject_
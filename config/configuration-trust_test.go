@@ -10,6 +10,7 @@ import (
 	"github.com/fastcat/wirelink/trust"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_configEvaluator_TrustLevel(t *testing.T) {
@@ -19,6 +20,15 @@ func Test_configEvaluator_TrustLevel(t *testing.T) {
 
 	u1 := testutils.RandUDP4Addr(t)
 
+	ula, err := autopeer.ParseScheme("fd12:3456:789a::/48")
+	require.NoError(t, err)
+	k1ula := &net.UDPAddr{IP: ula.Address(k1)}
+
+	v4ll, err := autopeer.ParseScheme(autopeer.SchemeIPv4LinkLocal)
+	require.NoError(t, err)
+	c1, c2 := testutils.MustCollidingKeys(t, v4ll.Address)
+	c1u := &net.UDPAddr{IP: v4ll.Address(c1)}
+
 	// type fields struct {
 	// 	Peers    Peers
 	// 	ipToPeer map[[net.IPv6len]byte]wgtypes.Key
@@ -30,31 +40,57 @@ func Test_configEvaluator_TrustLevel(t *testing.T) {
 	tests := []struct {
 		name string
 		// fields fields
-		peers Peers
-		args  args
-		want  *trust.Level
+		peers  Peers
+		scheme *autopeer.Scheme
+		args   args
+		want   *trust.Level
 	}{
 		{
 			"no known peers",
 			Peers{},
+			nil,
 			args{source: *u1},
 			nil,
 		},
 		{
 			"known peer un-configured",
 			Peers{k1: &Peer{}},
+			nil,
 			args{source: *k1u},
 			nil,
 		},
 		{
 			"known peer configured",
 			Peers{k1: &Peer{Trust: trust.Ptr(trust.Membership)}},
+			nil,
 			args{source: *k1u},
 			trust.Ptr(trust.Membership),
 		},
+		{
+			"known peer ula",
+			Peers{k1: &Peer{Trust: trust.Ptr(trust.Membership)}},
+			ula,
+			args{source: *k1ula},
+			trust.Ptr(trust.Membership),
+		},
+		{
+			"known peer wrong scheme",
+			Peers{k1: &Peer{Trust: trust.Ptr(trust.Membership)}},
+			ula,
+			args{source: *k1u},
+			nil,
+		},
+		{
+			"colliding peers",
+			Peers{c1: &Peer{Trust: trust.Ptr(trust.Membership)}, c2: &Peer{}},
+			v4ll,
+			args{source: *c1u},
+			nil,
+		},
 		{
 			"unknown peer",
 			Peers{k2: &Peer{Trust: trust.Ptr(trust.Membership)}},
+			nil,
 			args{source: *k1u},
 			nil,
 		},
@@ -65,7 +101,7 @@ func Test_configEvaluator_TrustLevel(t *testing.T) {
 			// 	Peers:    tt.fields.Peers,
 			// 	ipToPeer: tt.fields.ipToPeer,
 			// }
-			c := CreateTrustEvaluator(tt.peers)
+			c := CreateTrustEvaluator(tt.peers, tt.scheme)
 			got := c.TrustLevel(tt.args.f, tt.args.source)
 			assert.Equal(t, tt.want, got)
 		})
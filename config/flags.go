@@ -27,6 +27,21 @@ const HelpFlag = "help"
 // DebugFlag enables debug logging
 const DebugFlag = "debug"
 
+// LogFormatFlag is the name of the flag to set the log output format
+const LogFormatFlag = "log-format"
+
+// LogLevelFlag is the name of the flag to set per-subsystem log levels
+const LogLevelFlag = "log-level"
+
+// AuditFileFlag is the name of the flag to set the audit log file
+const AuditFileFlag = "audit-file"
+
+// DryRunFlag is the name of the flag to observe without changing the device
+const DryRunFlag = "dry-run"
+
+// JoinFlag is the name of the flag to give a join token to enroll with
+const JoinFlag = "join"
+
 // RouterFlag is the name of the flag to set router mode
 const RouterFlag = "router"
 
@@ -39,6 +54,12 @@ const ConfigPathFlag = "config-path"
 // ChattyFlag is the name of the setting to enable chatty mode
 const ChattyFlag = "chatty"
 
+// GossipFlag is the name of the setting to enable gossip
+const GossipFlag = "gossip"
+
+// GossipFanoutFlag is the name of the setting for how many peers to gossip to
+const GossipFanoutFlag = "gossip-fanout"
+
 func programName(args []string) string {
 	base := path.Base(args[0])
 	ext := path.Ext(base)
@@ -67,6 +88,13 @@ func Init(args []string) (flags *pflag.FlagSet, vcfg *viper.Viper) {
 	vcfg.SetDefault(ConfigPathFlag, "/etc/wireguard")
 	// no flag for config-path for now, only env
 	flags.BoolP(DebugFlag, "d", false, "Enable debug logging output")
+	flags.String(LogFormatFlag, "", "Log output format: text, json, or journald (default text)")
+	flags.String(AuditFileFlag, "", "File to write the audit log of device changes to (default is the main log)")
+	flags.Bool(DryRunFlag, false, "Log changes to the wireguard device instead of making them")
+	flags.String(JoinFlag, "", "Join token to enroll this node in a network with")
+	flags.Bool(GossipFlag, false, "Forward recently learned facts to a few random peers each round")
+	flags.Int(GossipFanoutFlag, 0, fmt.Sprintf("How many peers to gossip to each round (default %d)", DefaultGossipFanout))
+	flags.String(LogLevelFlag, "", "Log levels, e.g. 'info,trust=debug' (subsystems: server, apply, trust, fact)")
 
 	err := vcfg.BindPFlags(flags)
 	// this should never happen, flags are constant
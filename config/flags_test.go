@@ -57,6 +57,14 @@ func TestParse(t *testing.T) {
 			nil,
 			require.NoError,
 		},
+		{
+			"log flags",
+			[]string{"--log-format", "json", "--log-level", "info,trust=debug"},
+			nil,
+			&ServerData{Iface: "wg0", LogFormat: "json", LogLevel: "info,trust=debug"},
+			nil,
+			require.NoError,
+		},
 		{
 			"help",
 			[]string{"--help"},
@@ -102,6 +110,22 @@ func TestParse(t *testing.T) {
 			nil,
 			require.NoError,
 		},
+		{
+			"gossip flags",
+			[]string{"--gossip", "--gossip-fanout", "5"},
+			nil,
+			&ServerData{Iface: "wg0", Gossip: true, GossipFanout: 5},
+			nil,
+			require.NoError,
+		},
+		{
+			"env gossip fanout",
+			nil,
+			[][]string{envArg("gossip_fanout", "2")},
+			&ServerData{Iface: "wg0", GossipFanout: 2},
+			nil,
+			require.NoError,
+		},
 		// TODO: more tests
 	}
 	for _, tt := range tests {
@@ -47,6 +47,18 @@ func (p Peers) AnyTrustedAt(level trust.Level) bool {
 	return false
 }
 
+// CountTrustedAt returns how many peers are configured with a trust level of
+// at least the given level
+func (p Peers) CountTrustedAt(level trust.Level) int {
+	ret := 0
+	for _, c := range p {
+		if c.Trust != nil && *c.Trust >= level {
+			ret++
+		}
+	}
+	return ret
+}
+
 // IsFactExchanger returns true if the peer is configured as a FactExchanger
 func (p Peers) IsFactExchanger(peer wgtypes.Key) bool {
 	config, ok := p[peer]
@@ -60,6 +72,13 @@ func (p Peers) IsBasic(peer wgtypes.Key) bool {
 	return ok && config.Basic
 }
 
+// IsRelay returns true if the peer is explicitly configured as willing to
+// relay traffic for other peers, or false otherwise
+func (p Peers) IsRelay(peer wgtypes.Key) bool {
+	config, ok := p[peer]
+	return ok && config.Relay
+}
+
 // AllowedIPs returns the array of AllowedIPs explicitly configured for the peer, if any
 func (p Peers) AllowedIPs(peer wgtypes.Key) []net.IPNet {
 	if config, ok := p[peer]; ok {
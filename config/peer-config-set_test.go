@@ -126,6 +126,47 @@ func TestPeers_AnyTrustedAt(t *testing.T) {
 	}
 }
 
+func TestPeers_CountTrustedAt(t *testing.T) {
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	k3 := testutils.MustKey(t)
+
+	tests := []struct {
+		name  string
+		p     Peers
+		level trust.Level
+		want  int
+	}{
+		{"empty", Peers{}, trust.Untrusted, 0},
+		{"no set", Peers{k1: &Peer{}}, trust.Untrusted, 0},
+		{
+			"some",
+			Peers{
+				k1: &Peer{Trust: trust.Ptr(trust.Membership)},
+				k2: &Peer{Trust: trust.Ptr(trust.AllowedIPs)},
+				k3: &Peer{Trust: trust.Ptr(trust.Membership)},
+			},
+			trust.Membership,
+			2,
+		},
+		{
+			"over-match",
+			Peers{
+				k1: &Peer{Trust: trust.Ptr(trust.Membership)},
+				k2: &Peer{Trust: trust.Ptr(trust.AllowedIPs)},
+				k3: &Peer{},
+			},
+			trust.Endpoint,
+			2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.p.CountTrustedAt(tt.level))
+		})
+	}
+}
+
 func TestPeers_IsFactExchanger(t *testing.T) {
 	k1 := testutils.MustKey(t)
 	k2 := testutils.MustKey(t)
@@ -182,6 +223,34 @@ func TestPeers_IsBasic(t *testing.T) {
 	}
 }
 
+func TestPeers_IsRelay(t *testing.T) {
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+
+	type args struct {
+		peer wgtypes.Key
+	}
+	tests := []struct {
+		name string
+		p    Peers
+		args args
+		want bool
+	}{
+		{"nil peers", nil, args{k1}, false},
+		{"empty peers", make(Peers), args{k1}, false},
+		{"other peer", Peers{k2: &Peer{Relay: true}}, args{k1}, false},
+		{"configured false", Peers{k1: &Peer{Relay: false}, k2: &Peer{Relay: true}}, args{k1}, false},
+		{"configured true", Peers{k1: &Peer{Relay: true}, k2: &Peer{Relay: false}}, args{k1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.p.IsRelay(tt.args.peer); got != tt.want {
+				t.Errorf("Peers.IsRelay() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestPeers_AllowedIPs(t *testing.T) {
 	k1 := testutils.MustKey(t)
 	k2 := testutils.MustKey(t)
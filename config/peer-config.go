@@ -22,6 +22,7 @@ type Peer struct {
 	Endpoints     []PeerEndpoint
 	AllowedIPs    []net.IPNet
 	Basic         bool
+	Relay         bool
 }
 
 func (p *Peer) String() string {
@@ -29,6 +30,6 @@ func (p *Peer) String() string {
 	if p.Trust != nil {
 		trustStr = p.Trust.String()
 	}
-	return fmt.Sprintf("{Name:%s Trust:%s Exch:%v EPs:%d AIPs:%d B:%t}",
-		p.Name, trustStr, p.FactExchanger, len(p.Endpoints), len(p.AllowedIPs), p.Basic)
+	return fmt.Sprintf("{Name:%s Trust:%s Exch:%v EPs:%d AIPs:%d B:%t R:%t}",
+		p.Name, trustStr, p.FactExchanger, len(p.Endpoints), len(p.AllowedIPs), p.Basic, p.Relay)
 }
@@ -19,6 +19,7 @@ type PeerData struct {
 	Endpoints     []string
 	AllowedIPs    []string
 	Basic         bool
+	Relay         bool
 }
 
 // Parse validates the info in the PeerData and returns the parsed tuple + error
@@ -93,6 +94,7 @@ func (p *PeerData) Parse() (key wgtypes.Key, peer Peer, err error) {
 	}
 
 	peer.Basic = p.Basic
+	peer.Relay = p.Relay
 
 	return
 }
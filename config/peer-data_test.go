@@ -34,6 +34,7 @@ func TestPeerData_Parse(t *testing.T) {
 		Endpoints     []string
 		AllowedIPs    []string
 		Basic         bool
+		Relay         bool
 	}
 	tests := []struct {
 		name     string
@@ -254,6 +255,20 @@ func TestPeerData_Parse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"relay peer",
+			fields{
+				PublicKey: k.String(),
+				Relay:     true,
+			},
+			k,
+			Peer{
+				Endpoints:  []PeerEndpoint{},
+				AllowedIPs: []net.IPNet{},
+				Relay:      true,
+			},
+			false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -265,6 +280,7 @@ func TestPeerData_Parse(t *testing.T) {
 				Endpoints:     tt.fields.Endpoints,
 				AllowedIPs:    tt.fields.AllowedIPs,
 				Basic:         tt.fields.Basic,
+				Relay:         tt.fields.Relay,
 			}
 			gotKey, gotPeer, err := p.Parse()
 
@@ -1,16 +1,44 @@
 package config
 
 import (
+	"crypto/ed25519"
 	"path/filepath"
+	"time"
 
+	"github.com/fastcat/wirelink/autopeer"
+	"github.com/fastcat/wirelink/enroll"
+	"github.com/fastcat/wirelink/ipam"
 	"github.com/fastcat/wirelink/log"
+	"github.com/fastcat/wirelink/roster"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+// DefaultGossipFanout is how many peers we gossip to each round if gossip is
+// enabled without setting the fanout
+const DefaultGossipFanout = 3
+
+// DefaultRemovalWindow is the time window for the safety limits on removals if
+// limits are set without a window
+const DefaultRemovalWindow = 10 * time.Minute
+
+// DefaultSuccessionGrace is how long after a successor key first comes up
+// before the key it replaced is removed, if not configured
+const DefaultSuccessionGrace = 10 * time.Minute
+
+// DefaultPSKRotation is how often pairwise preshared keys change, if a PSK
+// secret is configured without a rotation period
+const DefaultPSKRotation = 24 * time.Hour
+
 // Server describes the configuration for the server, after parsing from various sources
 type Server struct {
 	Iface  string
 	Port   int
 	Chatty bool
+	// Gossip enables forwarding recently learned facts to GossipFanout random
+	// healthy peers each round
+	Gossip       bool
+	GossipFanout int
 
 	AutoDetectRouter bool
 	IsRouterNow      bool
@@ -20,9 +48,87 @@ type Server struct {
 
 	Peers Peers
 
+	// AuditFile is where to write the audit log, if empty it goes to the main log
+	AuditFile string
+	// DryRun makes the server log the changes it would make to the device,
+	// instead of making them
+	DryRun bool
+
+	// MembershipQuorum is how many of the peers with Membership trust must
+	// assert a peer is a member before it is added. Values below 2 mean any one
+	// of them is enough.
+	MembershipQuorum int
+
+	// RosterKey is the network root key which signs the membership roster. If
+	// it is set, peers listed in a verified roster are treated as members.
+	RosterKey ed25519.PublicKey
+	// RosterSerialFile is where the newest roster serial used is recorded, so
+	// that older rosters are rejected even after a restart
+	RosterSerialFile string
+	// Roster is the locally configured roster pages, which we distribute to
+	// other peers
+	Roster []*roster.Page
+
+	// TokenKeyFile and EnrollmentFile enable issuing join tokens, and
+	// accepting join requests on JoinPort (default Port+1)
+	TokenKeyFile   string
+	EnrollmentFile string
+	JoinPort       int
+	// Join is the token this node is enrolling with, if any
+	Join *enroll.Token
+
+	// AddressPools are where to allocate host addresses from for members without
+	// AllowedIPs, at most one per address family, recording the allocations in
+	// AddressFile
+	AddressPools []*ipam.Pool
+	AddressFile  string
+	// AssignAddress makes the server add host addresses it is allocated to the
+	// local interface
+	AssignAddress bool
+
+	// Successor is the new key this node announces it is switching to
+	Successor *wgtypes.Key
+	// SuccessionGrace is how long after a successor key first comes up before
+	// the key it replaced is removed, or zero for DefaultSuccessionGrace
+	SuccessionGrace time.Duration
+
+	// PSKSecret is the network secret from which the preshared key for each
+	// pair of peers is derived, which changes every PSKRotation. If it is
+	// empty, wirelink leaves preshared keys alone.
+	PSKSecret   []byte
+	PSKRotation time.Duration
+
+	// AutoAddress is the scheme for deriving each peer's automatic address
+	// from its key, nil for the default IPv6 link-local scheme
+	AutoAddress *autopeer.Scheme
+
+	// Safety limits how many destructive changes we will make to the device
+	Safety SafetyLimits
+	// SafetyHoldFile is where a safety hold is recorded, so that it lasts until
+	// an operator clears it, even across restarts
+	SafetyHoldFile string
+
 	Debug bool
 }
 
+// SafetyLimits bounds how many peers and AllowedIPs may be removed from the
+// device within a time window. If a change would exceed a limit, the server
+// stops making any destructive changes until an operator clears the hold.
+type SafetyLimits struct {
+	// MaxPeerRemovals is the most peers that may be removed per Window, or zero
+	// for no limit
+	MaxPeerRemovals int
+	// MaxAIPRemovals is the most AllowedIPs that may be removed per Window,
+	// or zero for no limit
+	MaxAIPRemovals int
+	Window         time.Duration
+}
+
+// Enabled returns whether any limits are set
+func (l SafetyLimits) Enabled() bool {
+	return l.MaxPeerRemovals > 0 || l.MaxAIPRemovals > 0
+}
+
 // ShouldReportIface checks a given local network interface name against the config
 // for whether we should tell other peers about our configuration on it
 func (s *Server) ShouldReportIface(name string) bool {
@@ -2,15 +2,27 @@ package config
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/spf13/viper"
 
+	"github.com/fastcat/wirelink/autopeer"
+	"github.com/fastcat/wirelink/enroll"
 	"github.com/fastcat/wirelink/internal"
+	"github.com/fastcat/wirelink/ipam"
 	"github.com/fastcat/wirelink/log"
+	"github.com/fastcat/wirelink/roster"
+	"github.com/fastcat/wirelink/trust"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 // ServerData represents the raw data from the config for the server,
@@ -20,16 +32,78 @@ type ServerData struct {
 	Port   int
 	Router *bool
 	Chatty bool
+	// Gossip enables forwarding recently learned facts to a few random peers
+	// each round, GossipFanout sets how many
+	Gossip       bool
+	GossipFanout int `mapstructure:"gossip-fanout"`
+
+	// MembershipQuorum is how many Membership trusted peers must agree a peer
+	// is a member to add it
+	MembershipQuorum int
+
+	// RosterKey is the base64 ed25519 public key that signs the membership
+	// roster, RosterSerialFile is where the newest roster serial used is
+	// recorded, and RosterFile is an optional file of signed roster pages to
+	// distribute
+	RosterKey        string
+	RosterSerialFile string
+	RosterFile       string
+
+	// TokenKeyFile is the secret for join tokens this node issues, and
+	// EnrollmentFile is where it records the nodes that joined with them.
+	// Setting them enables listening for join requests on JoinPort.
+	TokenKeyFile   string
+	EnrollmentFile string
+	JoinPort       int
+
+	// AddressPoolV4 and AddressPoolV6 are the CIDRs to allocate host addresses
+	// from for members without AllowedIPs, and AddressFile is where the
+	// allocations are recorded. AssignAddress makes a leaf add the host
+	// address it was allocated to its interface.
+	AddressPoolV4 string
+	AddressPoolV6 string
+	AddressFile   string
+	AssignAddress bool
+
+	// Successor is the new public key this node is switching to, which it
+	// announces to its peers. SuccessionGrace is how long after a successor
+	// first comes up before the key it replaced is removed.
+	Successor       string
+	SuccessionGrace time.Duration
+
+	// PSKFile is a network secret, in the format from `wg genpsk`, from which a
+	// unique preshared key is derived for each pair of peers, and changed every
+	// PSKRotation
+	PSKFile     string
+	PSKRotation time.Duration
+
+	// AutoAddress is the scheme for the address derived from each peer's key:
+	// `link-local` (the default), `ipv4-link-local`, or a ULA prefix
+	AutoAddress string
+
+	// MaxPeerRemovals and MaxAIPRemovals are the safety limits on how many
+	// peers and AllowedIPs may be removed from the device per RemovalWindow,
+	// and SafetyHoldFile is where a hold is recorded so that it lasts across
+	// restarts
+	MaxPeerRemovals int
+	MaxAIPRemovals  int
+	RemovalWindow   time.Duration
+	SafetyHoldFile  string
 
 	Peers []PeerData
 
 	ReportIfaces []string
 	HideIfaces   []string
 
-	Debug   bool
-	Dump    bool
-	Help    bool
-	Version bool
+	Debug     bool
+	LogFormat string `mapstructure:"log-format"`
+	LogLevel  string `mapstructure:"log-level"`
+	AuditFile string `mapstructure:"audit-file"`
+	DryRun    bool   `mapstructure:"dry-run"`
+	Join      string
+	Dump      bool
+	Help      bool
+	Version   bool
 
 	// this prop is here for compat, but is ignored because it's how we find the
 	// config file, so the config file can't use it to point at a different config
@@ -43,12 +117,39 @@ func (s *ServerData) Parse(vcfg *viper.Viper, wgc internal.WgClient) (ret *Serve
 	if s.Debug {
 		log.SetDebug(s.Debug)
 	}
+	if err = s.applyLogSettings(); err != nil {
+		return nil, err
+	}
 
 	ret = new(Server)
 	//TODO: validate Iface is not empty
 	ret.Iface = s.Iface
 	ret.Port = s.Port
 	ret.Chatty = s.Chatty
+	if s.Gossip {
+		ret.Gossip = true
+		ret.GossipFanout = s.GossipFanout
+		if ret.GossipFanout <= 0 {
+			ret.GossipFanout = DefaultGossipFanout
+		}
+	}
+	ret.AuditFile = s.AuditFile
+	ret.DryRun = s.DryRun
+	if s.MaxPeerRemovals < 0 || s.MaxAIPRemovals < 0 || s.RemovalWindow < 0 {
+		return nil, errors.Errorf("Safety limits must not be negative")
+	}
+	ret.Safety = SafetyLimits{
+		MaxPeerRemovals: s.MaxPeerRemovals,
+		MaxAIPRemovals:  s.MaxAIPRemovals,
+		Window:          s.RemovalWindow,
+	}
+	if ret.Safety.Enabled() && ret.Safety.Window == 0 {
+		ret.Safety.Window = DefaultRemovalWindow
+	}
+	if ret.Safety.Enabled() && s.SafetyHoldFile == "" {
+		return nil, errors.Errorf("Safety limits require a SafetyHoldFile to record holds in")
+	}
+	ret.SafetyHoldFile = s.SafetyHoldFile
 
 	// validate all the globs
 	// have to pass a non-empty candidate string to actually get error checking
@@ -80,6 +181,117 @@ func (s *ServerData) Parse(vcfg *viper.Viper, wgc internal.WgClient) (ret *Serve
 			log.Info("Configured peer '%s': %s", key, &peerConf)
 		}
 	}
+	if s.MembershipQuorum < 0 {
+		return nil, errors.Errorf("MembershipQuorum must not be negative")
+	} else if sources := ret.Peers.CountTrustedAt(trust.Membership); s.MembershipQuorum > 1 && s.MembershipQuorum > sources {
+		return nil, errors.Errorf("MembershipQuorum of %d needs at least that many peers with Membership trust, have %d",
+			s.MembershipQuorum, sources)
+	}
+	ret.MembershipQuorum = s.MembershipQuorum
+
+	if s.RosterKey != "" {
+		if ret.RosterKey, err = roster.ParsePublicKey(s.RosterKey); err != nil {
+			return nil, errors.Wrap(err, "Bad RosterKey")
+		}
+		if s.RosterSerialFile == "" {
+			return nil, errors.Errorf("RosterKey requires a RosterSerialFile to record the newest roster in")
+		}
+		ret.RosterSerialFile = s.RosterSerialFile
+	}
+	if s.RosterFile != "" {
+		if ret.RosterKey == nil {
+			return nil, errors.Errorf("RosterFile requires a RosterKey to verify it")
+		}
+		if ret.Roster, err = roster.ReadFile(s.RosterFile, ret.RosterKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.TokenKeyFile != "" || s.EnrollmentFile != "" {
+		if s.TokenKeyFile == "" || s.EnrollmentFile == "" {
+			return nil, errors.Errorf("TokenKeyFile and EnrollmentFile must be set together")
+		}
+		ret.TokenKeyFile = s.TokenKeyFile
+		ret.EnrollmentFile = s.EnrollmentFile
+	}
+	if s.JoinPort < 0 || s.JoinPort > 65535 {
+		return nil, errors.Errorf("Invalid JoinPort %d", s.JoinPort)
+	}
+	ret.JoinPort = s.JoinPort
+
+	for _, pd := range []struct {
+		name, cidr string
+		v4         bool
+	}{
+		{"AddressPoolV4", s.AddressPoolV4, true},
+		{"AddressPoolV6", s.AddressPoolV6, false},
+	} {
+		if pd.cidr == "" {
+			continue
+		}
+		_, ipn, err := net.ParseCIDR(pd.cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Bad %s", pd.name)
+		}
+		pool, err := ipam.NewPool(*ipn)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Bad %s", pd.name)
+		}
+		if pool.IsV4() != pd.v4 {
+			return nil, errors.Errorf("%s %s is the wrong address family", pd.name, pd.cidr)
+		}
+		ret.AddressPools = append(ret.AddressPools, pool)
+	}
+	if len(ret.AddressPools) != 0 && s.AddressFile == "" {
+		return nil, errors.Errorf("Address pools require an AddressFile to record allocations in")
+	}
+	ret.AddressFile = s.AddressFile
+	ret.AssignAddress = s.AssignAddress
+
+	if s.Successor != "" {
+		successor, err := wgtypes.ParseKey(s.Successor)
+		if err != nil {
+			return nil, errors.Wrap(err, "Bad Successor key")
+		}
+		ret.Successor = &successor
+	}
+	if s.SuccessionGrace < 0 {
+		return nil, errors.Errorf("Invalid SuccessionGrace %v", s.SuccessionGrace)
+	}
+	ret.SuccessionGrace = s.SuccessionGrace
+
+	if s.PSKRotation < 0 {
+		return nil, errors.Errorf("Invalid PSKRotation %v", s.PSKRotation)
+	}
+	if s.PSKFile != "" {
+		if ret.PSKSecret, err = readPSKSecret(s.PSKFile); err != nil {
+			return nil, err
+		}
+		ret.PSKRotation = s.PSKRotation
+		if ret.PSKRotation == 0 {
+			ret.PSKRotation = DefaultPSKRotation
+		}
+	}
+
+	if ret.AutoAddress, err = autopeer.ParseScheme(s.AutoAddress); err != nil {
+		return nil, errors.Wrap(err, "Bad AutoAddress")
+	}
+
+	if s.Join != "" {
+		if ret.Join, err = enroll.ParseToken(s.Join); err != nil {
+			return nil, errors.Wrap(err, "Bad join token")
+		}
+		// the node that issued the token is how we reach the network, and is
+		// trusted to tell us who else is in it
+		if !ret.Peers.Has(ret.Join.Router) {
+			host, port, _ := net.SplitHostPort(ret.Join.Endpoint)
+			portNum, _ := strconv.Atoi(port)
+			ret.Peers[ret.Join.Router] = &Peer{
+				Trust:     trust.Ptr(trust.Membership),
+				Endpoints: []PeerEndpoint{{Host: host, Port: portNum}},
+			}
+		}
+	}
 
 	ret.Debug = s.Debug
 
@@ -102,6 +314,26 @@ func (s *ServerData) Parse(vcfg *viper.Viper, wgc internal.WgClient) (ret *Serve
 		if s.Router == nil {
 			delete(all, RouterFlag)
 		}
+		// and hide the log settings if they are just the defaults
+		if s.LogFormat == "" {
+			delete(all, LogFormatFlag)
+		}
+		if s.LogLevel == "" {
+			delete(all, LogLevelFlag)
+		}
+		if s.AuditFile == "" {
+			delete(all, AuditFileFlag)
+		}
+		if !s.DryRun {
+			delete(all, DryRunFlag)
+		}
+		if !s.Gossip {
+			delete(all, GossipFlag)
+			delete(all, GossipFanoutFlag)
+		}
+		if s.Join == "" {
+			delete(all, JoinFlag)
+		}
 		// this still leaves a few settings in the output that wouldn't _normally_
 		// be there, and which might not work fully in a config file:
 		// `config-path`, `debug`, and `iface` at least.
@@ -119,3 +351,38 @@ func (s *ServerData) Parse(vcfg *viper.Viper, wgc internal.WgClient) (ret *Serve
 
 	return
 }
+
+// readPSKSecret reads the network secret for preshared keys from a file
+func readPSKSecret(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read PSKFile")
+	}
+	key, err := wgtypes.ParseKey(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Bad secret in PSKFile %s", path)
+	}
+	return key[:], nil
+}
+
+// applyLogSettings configures the log package from the log format and level
+// settings
+func (s *ServerData) applyLogSettings() error {
+	if s.LogLevel != "" {
+		if err := log.SetLevels(s.LogLevel); err != nil {
+			return errors.Wrapf(err, "Bad log-level config")
+		}
+	}
+	if s.LogFormat != "" {
+		format, err := log.ParseFormat(s.LogFormat)
+		if err != nil {
+			return errors.Wrapf(err, "Bad log-format config")
+		}
+		if format != log.GetFormat() {
+			if err = log.SetFormat(format); err != nil {
+				return errors.Wrapf(err, "Unable to set log format")
+			}
+		}
+	}
+	return nil
+}
@@ -1,16 +1,25 @@
 package config
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/fastcat/wirelink/autopeer"
+	"github.com/fastcat/wirelink/enroll"
 	"github.com/fastcat/wirelink/internal"
 	"github.com/fastcat/wirelink/internal/testutils"
+	"github.com/fastcat/wirelink/ipam"
+	"github.com/fastcat/wirelink/roster"
 	"github.com/fastcat/wirelink/trust"
 
 	"github.com/spf13/viper"
@@ -29,16 +38,78 @@ func TestServerData_Parse(t *testing.T) {
 	chatty := boolean()
 	fe := boolean()
 	basic := boolean()
+	auditFile := fmt.Sprintf("/var/log/wirelink-%d.audit", rand.Int31())
+
+	rosterPriv, err := roster.GenerateKey()
+	require.NoError(t, err)
+	rosterPub := rosterPriv.Public().(ed25519.PublicKey)
+	rosterPages, err := roster.Sign(rosterPriv, 1, time.Now().Add(time.Hour), []roster.Member{{PublicKey: k1, Name: name}})
+	require.NoError(t, err)
+	rosterDir, err := ioutil.TempDir("", "wirelink-roster")
+	require.NoError(t, err)
+	defer os.RemoveAll(rosterDir)
+	rosterFile := filepath.Join(rosterDir, "roster")
+	rosterData := &bytes.Buffer{}
+	require.NoError(t, roster.Write(rosterData, rosterPages))
+	require.NoError(t, ioutil.WriteFile(rosterFile, rosterData.Bytes(), 0644))
+	rosterPages, err = roster.ReadFile(rosterFile, rosterPub)
+	require.NoError(t, err)
+	otherRosterKey, err := roster.GenerateKey()
+	require.NoError(t, err)
+
+	successor := testutils.MustKey(t)
+	pskSecret := testutils.MustKey(t)
+	pskFile := filepath.Join(rosterDir, "psk")
+	require.NoError(t, ioutil.WriteFile(pskFile, []byte(pskSecret.String()+"\n"), 0600))
+	ulaScheme, err := autopeer.ParseScheme("fd12:3456:789a::/48")
+	require.NoError(t, err)
+
+	badPSKFile := filepath.Join(rosterDir, "bad-psk")
+	require.NoError(t, ioutil.WriteFile(badPSKFile, []byte("nope\n"), 0600))
+	joinRouter := testutils.MustKey(t)
+	joinToken, err := enroll.NewToken(joinRouter, "vpn.example.com:51820", 51822, "", nil, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	joinTokenStr, err := joinToken.Sign(testutils.MustRandBytes(t, make([]byte, 32)))
+	require.NoError(t, err)
+	joinToken, err = enroll.ParseToken(joinTokenStr)
+	require.NoError(t, err)
 
 	type fields struct {
 		Iface        string
 		Port         int
 		Router       *bool
 		Chatty       bool
+		Gossip       bool
+		GossipFanout int
+		Quorum       int
+		RosterKey    string
+		RosterSerial string
+		RosterFile   string
+		TokenKey     string
+		Enrollments  string
+		JoinPort     int
+		PoolV4       string
+		PoolV6       string
+		AddressFile  string
+		Assign       bool
+		Successor    string
+		Grace        time.Duration
+		PSKFile      string
+		PSKRotation  time.Duration
+		AutoAddress  string
+		Join         string
+		MaxPeers     int
+		MaxAIPs      int
+		Window       time.Duration
+		HoldFile     string
 		Peers        []PeerData
 		ReportIfaces []string
 		HideIfaces   []string
 		Debug        bool
+		LogFormat    string
+		LogLevel     string
+		AuditFile    string
+		DryRun       bool
 		Dump         bool
 		Help         bool
 		Version      bool
@@ -77,6 +148,346 @@ func TestServerData_Parse(t *testing.T) {
 			nil,
 			true,
 		},
+		{
+			"bad log level",
+			fields{
+				Iface:    iface,
+				Port:     port,
+				LogLevel: "trust=loud",
+			},
+			args{nil, nil},
+			nil,
+			true,
+		},
+		{
+			"bad log format",
+			fields{
+				Iface:     iface,
+				Port:      port,
+				LogFormat: "xml",
+			},
+			args{nil, nil},
+			nil,
+			true,
+		},
+		{
+			"bad safety limit",
+			fields{
+				Iface:    iface,
+				Port:     port,
+				MaxPeers: -1,
+			},
+			args{nil, nil},
+			nil,
+			true,
+		},
+		{
+			"bad roster key",
+			fields{
+				Iface:     iface,
+				Port:      port,
+				RosterKey: "not a key",
+			},
+			args{nil, nil},
+			nil,
+			true,
+		},
+		{
+			"roster file without key",
+			fields{
+				Iface:      iface,
+				Port:       port,
+				RosterFile: rosterFile,
+			},
+			args{nil, nil},
+			nil,
+			true,
+		},
+		{
+			"missing roster file",
+			fields{
+				Iface:        iface,
+				Port:         port,
+				RosterKey:    roster.EncodePublicKey(rosterPub),
+				RosterSerial: filepath.Join(rosterDir, "serial"),
+				RosterFile:   filepath.Join(rosterDir, "missing"),
+			},
+			args{nil, nil},
+			nil,
+			true,
+		},
+		{
+			"roster signed by another key",
+			fields{
+				Iface:        iface,
+				Port:         port,
+				RosterKey:    roster.EncodePublicKey(otherRosterKey.Public().(ed25519.PublicKey)),
+				RosterSerial: filepath.Join(rosterDir, "serial"),
+				RosterFile:   rosterFile,
+			},
+			args{nil, nil},
+			nil,
+			true,
+		},
+		{
+			"roster key without serial file",
+			fields{
+				Iface:     iface,
+				Port:      port,
+				RosterKey: roster.EncodePublicKey(rosterPub),
+			},
+			args{nil, nil},
+			nil,
+			true,
+		},
+		{
+			"token key without enrollment file",
+			fields{
+				Iface:    iface,
+				Port:     port,
+				TokenKey: "/etc/wireguard/token.key",
+			},
+			args{nil, nil},
+			nil,
+			true,
+		},
+		{
+			"address pool without file",
+			fields{
+				Iface:  iface,
+				Port:   port,
+				PoolV4: "10.10.0.0/16",
+			},
+			args{nil, nil},
+			nil,
+			true,
+		},
+		{
+			"address pool wrong family",
+			fields{
+				Iface:       iface,
+				Port:        port,
+				PoolV4:      "fd00:10::/64",
+				AddressFile: "/var/lib/wirelink/addresses.json",
+			},
+			args{nil, nil},
+			nil,
+			true,
+		},
+		{
+			"address pool too small",
+			fields{
+				Iface:       iface,
+				Port:        port,
+				PoolV6:      "fd00:10::/127",
+				AddressFile: "/var/lib/wirelink/addresses.json",
+			},
+			args{nil, nil},
+			nil,
+			true,
+		},
+		{
+			"bad successor",
+			fields{
+				Iface:     iface,
+				Port:      port,
+				Successor: "nope",
+			},
+			args{nil, nil},
+			nil,
+			true,
+		},
+		{
+			"bad succession grace",
+			fields{
+				Iface: iface,
+				Port:  port,
+				Grace: -time.Second,
+			},
+			args{nil, nil},
+			nil,
+			true,
+		},
+		{
+			"missing psk file",
+			fields{
+				Iface:   iface,
+				Port:    port,
+				PSKFile: filepath.Join(rosterDir, "missing"),
+			},
+			args{nil, nil},
+			nil,
+			true,
+		},
+		{
+			"bad psk file",
+			fields{
+				Iface:   iface,
+				Port:    port,
+				PSKFile: badPSKFile,
+			},
+			args{nil, nil},
+			nil,
+			true,
+		},
+		{
+			"bad psk rotation",
+			fields{
+				Iface:       iface,
+				Port:        port,
+				PSKFile:     pskFile,
+				PSKRotation: -time.Hour,
+			},
+			args{nil, nil},
+			nil,
+			true,
+		},
+		{
+			"psk default rotation",
+			fields{
+				Iface:   iface,
+				Port:    port,
+				PSKFile: pskFile,
+			},
+			args{nil, nil},
+			&Server{
+				Iface:            iface,
+				Port:             port,
+				AutoDetectRouter: true,
+				Peers:            Peers{},
+				PSKSecret:        pskSecret[:],
+				PSKRotation:      DefaultPSKRotation,
+			},
+			false,
+		},
+		{
+			"bad auto address",
+			fields{
+				Iface:       iface,
+				Port:        port,
+				AutoAddress: "10.0.0.0/8",
+			},
+			args{nil, nil},
+			nil,
+			true,
+		},
+		{
+			"ula auto address",
+			fields{
+				Iface:       iface,
+				Port:        port,
+				AutoAddress: "fd12:3456:789a::/48",
+			},
+			args{nil, nil},
+			&Server{
+				Iface:            iface,
+				Port:             port,
+				AutoDetectRouter: true,
+				Peers:            Peers{},
+				AutoAddress:      ulaScheme,
+			},
+			false,
+		},
+		{
+			"bad join port",
+			fields{
+				Iface:    iface,
+				Port:     port,
+				JoinPort: 70000,
+			},
+			args{nil, nil},
+			nil,
+			true,
+		},
+		{
+			"bad join token",
+			fields{
+				Iface: iface,
+				Port:  port,
+				Join:  "nope",
+			},
+			args{nil, nil},
+			nil,
+			true,
+		},
+		{
+			"join token",
+			fields{
+				Iface: iface,
+				Port:  port,
+				Join:  joinTokenStr,
+			},
+			args{nil, nil},
+			&Server{
+				Iface:            iface,
+				Port:             port,
+				AutoDetectRouter: true,
+				Join:             joinToken,
+				Peers: Peers{
+					joinRouter: &Peer{
+						Trust:     trust.Ptr(trust.Membership),
+						Endpoints: []PeerEndpoint{{Host: "vpn.example.com", Port: 51820}},
+					},
+				},
+			},
+			false,
+		},
+		{
+			"negative quorum",
+			fields{
+				Iface:  iface,
+				Port:   port,
+				Quorum: -1,
+			},
+			args{nil, nil},
+			nil,
+			true,
+		},
+		{
+			"quorum without enough sources",
+			fields{
+				Iface:  iface,
+				Port:   port,
+				Quorum: 2,
+				Peers: []PeerData{
+					{PublicKey: k1.String(), Trust: trust.Names[trust.Membership]},
+				},
+			},
+			args{nil, nil},
+			nil,
+			true,
+		},
+		{
+			"safety limit with window",
+			fields{
+				Iface:    iface,
+				Port:     port,
+				MaxAIPs:  10,
+				Window:   time.Hour,
+				HoldFile: "/var/lib/wirelink/safety-hold.json",
+			},
+			args{nil, nil},
+			&Server{
+				Iface:            iface,
+				Port:             port,
+				AutoDetectRouter: true,
+				Safety:           SafetyLimits{MaxAIPRemovals: 10, Window: time.Hour},
+				SafetyHoldFile:   "/var/lib/wirelink/safety-hold.json",
+				Peers:            Peers{},
+			},
+			false,
+		},
+		{
+			"safety limit without hold file",
+			fields{
+				Iface:   iface,
+				Port:    port,
+				MaxAIPs: 10,
+			},
+			args{nil, nil},
+			nil,
+			true,
+		},
 		{
 			"forced router true",
 			fields{
@@ -111,6 +522,44 @@ func TestServerData_Parse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"gossip default fanout",
+			fields{
+				Iface:  iface,
+				Port:   port,
+				Router: boolPtr(false),
+				Gossip: true,
+			},
+			args{nil, nil},
+			&Server{
+				Iface:            iface,
+				Port:             port,
+				Gossip:           true,
+				GossipFanout:     DefaultGossipFanout,
+				AutoDetectRouter: false,
+				IsRouterNow:      false,
+				Peers:            Peers{},
+			},
+			false,
+		},
+		{
+			"gossip fanout ignored when disabled",
+			fields{
+				Iface:        iface,
+				Port:         port,
+				Router:       boolPtr(false),
+				GossipFanout: 5,
+			},
+			args{nil, nil},
+			&Server{
+				Iface:            iface,
+				Port:             port,
+				AutoDetectRouter: false,
+				IsRouterNow:      false,
+				Peers:            Peers{},
+			},
+			false,
+		},
 		{
 			"bad peer",
 			fields{
@@ -133,8 +582,29 @@ func TestServerData_Parse(t *testing.T) {
 				Port:         port,
 				Router:       nil,
 				Chatty:       chatty,
+				Gossip:       true,
+				GossipFanout: 5,
 				ReportIfaces: []string{wan},
 				HideIfaces:   []string{docker},
+				AuditFile:    auditFile,
+				DryRun:       true,
+				Quorum:       1,
+				RosterKey:    roster.EncodePublicKey(rosterPub),
+				RosterSerial: "/var/lib/wirelink/roster-serial.json",
+				RosterFile:   rosterFile,
+				TokenKey:     "/etc/wireguard/token.key",
+				Enrollments:  "/var/lib/wirelink/enrolled.json",
+				JoinPort:     51900,
+				PoolV4:       "10.10.0.0/16",
+				PoolV6:       "fd00:10::/64",
+				AddressFile:  "/var/lib/wirelink/addresses.json",
+				Assign:       true,
+				Successor:    successor.String(),
+				Grace:        time.Hour,
+				PSKFile:      pskFile,
+				PSKRotation:  time.Hour,
+				MaxPeers:     3,
+				HoldFile:     "/var/lib/wirelink/safety-hold.json",
 				Peers: []PeerData{
 					{
 						PublicKey:     k1.String(),
@@ -154,8 +624,31 @@ func TestServerData_Parse(t *testing.T) {
 				AutoDetectRouter: true,
 				IsRouterNow:      false,
 				Chatty:           chatty,
+				Gossip:           true,
+				GossipFanout:     5,
 				ReportIfaces:     []string{wan},
 				HideIfaces:       []string{docker},
+				AuditFile:        auditFile,
+				DryRun:           true,
+				MembershipQuorum: 1,
+				RosterKey:        rosterPub,
+				RosterSerialFile: "/var/lib/wirelink/roster-serial.json",
+				Roster:           rosterPages,
+				TokenKeyFile:     "/etc/wireguard/token.key",
+				EnrollmentFile:   "/var/lib/wirelink/enrolled.json",
+				JoinPort:         51900,
+				AddressPools: []*ipam.Pool{
+					{IPNet: testutils.MakeIPv4Net(10, 10, 0, 0, 16)},
+					{IPNet: testutils.MakeIPv6Net([]byte{0xfd, 0, 0, 0x10}, nil, 64)},
+				},
+				AddressFile:     "/var/lib/wirelink/addresses.json",
+				AssignAddress:   true,
+				Successor:       &successor,
+				SuccessionGrace: time.Hour,
+				PSKSecret:       pskSecret[:],
+				PSKRotation:     time.Hour,
+				Safety:          SafetyLimits{MaxPeerRemovals: 3, Window: DefaultRemovalWindow},
+				SafetyHoldFile:  "/var/lib/wirelink/safety-hold.json",
 				Peers: Peers{
 					k1: &Peer{
 						Name:          name,
@@ -177,18 +670,45 @@ func TestServerData_Parse(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &ServerData{
-				Iface:        tt.fields.Iface,
-				Port:         tt.fields.Port,
-				Router:       tt.fields.Router,
-				Chatty:       tt.fields.Chatty,
-				Peers:        tt.fields.Peers,
-				ReportIfaces: tt.fields.ReportIfaces,
-				HideIfaces:   tt.fields.HideIfaces,
-				Debug:        tt.fields.Debug,
-				Dump:         tt.fields.Dump,
-				Help:         tt.fields.Help,
-				Version:      tt.fields.Version,
-				configPath:   tt.fields.configPath,
+				Iface:            tt.fields.Iface,
+				Port:             tt.fields.Port,
+				Router:           tt.fields.Router,
+				Chatty:           tt.fields.Chatty,
+				Gossip:           tt.fields.Gossip,
+				GossipFanout:     tt.fields.GossipFanout,
+				MembershipQuorum: tt.fields.Quorum,
+				RosterKey:        tt.fields.RosterKey,
+				RosterSerialFile: tt.fields.RosterSerial,
+				RosterFile:       tt.fields.RosterFile,
+				TokenKeyFile:     tt.fields.TokenKey,
+				EnrollmentFile:   tt.fields.Enrollments,
+				JoinPort:         tt.fields.JoinPort,
+				AddressPoolV4:    tt.fields.PoolV4,
+				AddressPoolV6:    tt.fields.PoolV6,
+				AddressFile:      tt.fields.AddressFile,
+				AssignAddress:    tt.fields.Assign,
+				Successor:        tt.fields.Successor,
+				SuccessionGrace:  tt.fields.Grace,
+				PSKFile:          tt.fields.PSKFile,
+				PSKRotation:      tt.fields.PSKRotation,
+				AutoAddress:      tt.fields.AutoAddress,
+				Join:             tt.fields.Join,
+				MaxPeerRemovals:  tt.fields.MaxPeers,
+				MaxAIPRemovals:   tt.fields.MaxAIPs,
+				RemovalWindow:    tt.fields.Window,
+				SafetyHoldFile:   tt.fields.HoldFile,
+				Peers:            tt.fields.Peers,
+				ReportIfaces:     tt.fields.ReportIfaces,
+				HideIfaces:       tt.fields.HideIfaces,
+				Debug:            tt.fields.Debug,
+				LogFormat:        tt.fields.LogFormat,
+				LogLevel:         tt.fields.LogLevel,
+				AuditFile:        tt.fields.AuditFile,
+				DryRun:           tt.fields.DryRun,
+				Dump:             tt.fields.Dump,
+				Help:             tt.fields.Help,
+				Version:          tt.fields.Version,
+				configPath:       tt.fields.configPath,
 			}
 			gotRet, err := s.Parse(tt.args.vcfg, tt.args.wgc)
 			if tt.wantErr {
@@ -248,6 +768,18 @@ func TestServerData_Dump(t *testing.T) {
 				"iface":       wgIface,
 			},
 		},
+		{
+			"log settings",
+			[]string{"--log-format", "text", "--log-level", "trust=debug"},
+			nil,
+			map[string]interface{}{
+				"config-path": configPath,
+				"debug":       false,
+				"iface":       "wg0",
+				"log-format":  "text",
+				"log-level":   "trust=debug",
+			},
+		},
 		// TODO: more
 	}
 	for _, tt := range tests {
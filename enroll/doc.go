@@ -0,0 +1,4 @@
+// Package enroll provides join tokens, which let a new node enroll itself as a
+// member of the network by sending a signed join request to a trusted node,
+// and the persistent record of the enrollments made with them.
+package enroll
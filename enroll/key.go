@@ -0,0 +1,47 @@
+package enroll
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// secretLen is the size of the secret used to authenticate tokens
+const secretLen = 32
+
+// LoadSecret reads the token secret from the given file
+func LoadSecret(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to read token secret %s", path)
+	}
+	secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to decode token secret %s", path)
+	} else if len(secret) < secretLen {
+		return nil, errors.Errorf("Token secret %s is too short", path)
+	}
+	return secret, nil
+}
+
+// LoadOrCreateSecret reads the token secret from the given file, creating it
+// with a new random secret if it doesn't exist
+func LoadOrCreateSecret(path string) ([]byte, error) {
+	secret, err := LoadSecret(path)
+	if !os.IsNotExist(errors.Cause(err)) {
+		return secret, err
+	}
+	secret = make([]byte, secretLen)
+	if _, err = rand.Read(secret); err != nil {
+		return nil, errors.Wrap(err, "Unable to generate token secret")
+	}
+	encoded := base64.StdEncoding.EncodeToString(secret) + "\n"
+	if err = ioutil.WriteFile(path, []byte(encoded), 0600); err != nil {
+		return nil, errors.Wrapf(err, "Unable to write token secret %s", path)
+	}
+	return secret, nil
+}
@@ -0,0 +1,59 @@
+package enroll
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadOrCreateSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wirelink-enroll")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token.key")
+
+	secret, err := LoadOrCreateSecret(path)
+	require.NoError(t, err)
+	assert.Len(t, secret, secretLen)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	again, err := LoadOrCreateSecret(path)
+	require.NoError(t, err)
+	assert.Equal(t, secret, again)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("c2hvcnQ="), 0600))
+	_, err = LoadOrCreateSecret(path)
+	assert.Error(t, err)
+	require.NoError(t, ioutil.WriteFile(path, []byte("!!!"), 0600))
+	_, err = LoadOrCreateSecret(path)
+	assert.Error(t, err)
+	_, err = LoadOrCreateSecret(filepath.Join(dir, "missing", "token.key"))
+	assert.Error(t, err)
+}
+
+func TestLoadSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wirelink-enroll")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token.key")
+
+	// doesn't create a missing secret
+	_, err = LoadSecret(path)
+	assert.True(t, os.IsNotExist(errors.Cause(err)))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	secret, err := LoadOrCreateSecret(path)
+	require.NoError(t, err)
+	loaded, err := LoadSecret(path)
+	require.NoError(t, err)
+	assert.Equal(t, secret, loaded)
+}
@@ -0,0 +1,86 @@
+package enroll
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/signing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// requestTTL is the TTL on the join request fact, it is not stored, so this
+// just needs to be non-zero
+const requestTTL = time.Minute
+
+// MakeRequest builds the packet for a join request to the issuer of the
+// token, signed with the new node's key to prove it holds it. The request only
+// has a proof of the token, not the token itself.
+func MakeRequest(signer *signing.Signer, token *Token, now time.Time) ([]byte, error) {
+	proof, err := token.Proof(signer.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	ga := fact.NewAccumulator(fact.SignedGroupMaxSafeInnerLength, now)
+	err = ga.AddFact(&fact.Fact{
+		Attribute: fact.AttributeJoinRequest,
+		Subject:   &fact.PeerSubject{Key: signer.PublicKey},
+		Value:     &fact.JoinValue{Data: []byte(proof)},
+		Expires:   now.Add(requestTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+	groups, err := ga.MakeSignedGroups(signer, &token.Router)
+	if err != nil {
+		return nil, err
+	} else if len(groups) != 1 {
+		return nil, errors.Errorf("Join request does not fit in one packet")
+	}
+	return groups[0].MarshalBinaryNow(now)
+}
+
+// ParseRequest verifies a join request packet sent to the signer, and returns
+// the key of the node asking to join, the token it is joining with, and its
+// proof that it holds the token. It does not check the token or the proof,
+// which VerifyProof does.
+func ParseRequest(signer *signing.Signer, data []byte, now time.Time) (wgtypes.Key, *Token, []byte, error) {
+	sg := &fact.Fact{}
+	if err := sg.DecodeFrom(len(data), now, bytes.NewBuffer(data)); err != nil {
+		return wgtypes.Key{}, nil, nil, errors.Wrap(err, "Unable to decode join request")
+	}
+	ps, ok := sg.Subject.(*fact.PeerSubject)
+	sgv, ok2 := sg.Value.(*fact.SignedGroupValue)
+	if sg.Attribute != fact.AttributeSignedGroup || !ok || !ok2 {
+		return wgtypes.Key{}, nil, nil, errors.Errorf("Join request is not a signed group")
+	}
+	if _, err := signer.VerifyFrom(sgv.Nonce, sgv.Tag, sgv.InnerBytes, &ps.Key); err != nil {
+		return wgtypes.Key{}, nil, nil, errors.Wrap(err, "Join request has a bad signature")
+	}
+	inner, err := sgv.ParseInner(now)
+	if err != nil {
+		return wgtypes.Key{}, nil, nil, errors.Wrap(err, "Unable to parse join request")
+	}
+	for _, f := range inner {
+		if f.Attribute != fact.AttributeJoinRequest {
+			continue
+		}
+		// the request must be for the key that signed it
+		if js, ok := f.Subject.(*fact.PeerSubject); !ok || js.Key != ps.Key {
+			return wgtypes.Key{}, nil, nil, errors.Errorf("Join request subject does not match sender %s", ps.Key)
+		}
+		jv, ok := f.Value.(*fact.JoinValue)
+		if !ok {
+			return wgtypes.Key{}, nil, nil, errors.Errorf("Join request has wrong value type: %T", f.Value)
+		}
+		token, proof, err := ParseProof(string(jv.Data))
+		if err != nil {
+			return wgtypes.Key{}, nil, nil, err
+		}
+		return ps.Key, token, proof, nil
+	}
+	return wgtypes.Key{}, nil, nil, errors.Errorf("Signed group from %s has no join request", ps.Key)
+}
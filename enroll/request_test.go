@@ -0,0 +1,75 @@
+package enroll
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/internal/testutils"
+	"github.com/fastcat/wirelink/signing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequest(t *testing.T) {
+	now := time.Now()
+	secret := testutils.MustRandBytes(t, make([]byte, secretLen))
+	routerPriv, routerPub := testutils.MustKeyPair(t)
+	nodePriv, nodePub := testutils.MustKeyPair(t)
+	otherPriv, otherPub := testutils.MustKeyPair(t)
+	router := signing.New(&routerPriv)
+	node := signing.New(&nodePriv)
+
+	token, err := NewToken(routerPub, "192.0.2.1:51820", 51822, "laptop", nil, now.Add(time.Hour))
+	require.NoError(t, err)
+	_, err = token.Sign(secret)
+	require.NoError(t, err)
+
+	packet, err := MakeRequest(node, token, now)
+	require.NoError(t, err)
+
+	key, got, proof, err := ParseRequest(router, packet, now)
+	require.NoError(t, err)
+	assert.Equal(t, nodePub, key)
+	assert.Equal(t, token.ID, got.ID)
+	assert.NoError(t, got.VerifyProof(secret, nodePub, proof))
+	assert.Error(t, got.VerifyProof(secret, otherPub, proof), "proof only works for the sender's key")
+
+	// the token itself must not be on the wire, as anyone could use it
+	mac := strings.Split(token.String(), ".")[1]
+	assert.NotContains(t, string(packet), mac)
+	rawMAC, err := base64.RawURLEncoding.DecodeString(mac)
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(packet, rawMAC))
+
+	// only the router can verify it
+	_, _, _, err = ParseRequest(signing.New(&otherPriv), packet, now)
+	assert.Error(t, err)
+
+	tampered := append([]byte(nil), packet...)
+	tampered[len(tampered)-1] ^= 1
+	_, _, _, err = ParseRequest(router, tampered, now)
+	assert.Error(t, err)
+
+	_, _, _, err = ParseRequest(router, []byte{1, 2, 3}, now)
+	assert.Error(t, err)
+
+	// a signed group without a join request
+	ga := fact.NewAccumulator(fact.SignedGroupMaxSafeInnerLength, now)
+	require.NoError(t, ga.AddFact(&fact.Fact{
+		Attribute: fact.AttributeMember,
+		Subject:   &fact.PeerSubject{Key: nodePub},
+		Value:     &fact.EmptyValue{},
+		Expires:   now.Add(time.Minute),
+	}))
+	groups, err := ga.MakeSignedGroups(node, &routerPub)
+	require.NoError(t, err)
+	other, err := groups[0].MarshalBinaryNow(now)
+	require.NoError(t, err)
+	_, _, _, err = ParseRequest(router, other, now)
+	assert.Error(t, err)
+}
@@ -0,0 +1,147 @@
+package enroll
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/fastcat/wirelink/util"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Enrollment records a node that joined with a token
+type Enrollment struct {
+	PublicKey  wgtypes.Key
+	Name       string
+	AllowedIPs []net.IPNet
+	TokenID    string
+	Enrolled   time.Time
+}
+
+// enrollmentData is the JSON form of an Enrollment
+type enrollmentData struct {
+	PublicKey  string
+	Name       string   `json:",omitempty"`
+	AllowedIPs []string `json:",omitempty"`
+	TokenID    string
+	Enrolled   time.Time
+}
+
+type storeData struct {
+	Enrollments []enrollmentData
+}
+
+// Store is the persistent set of enrollments
+type Store struct {
+	file        *util.StoreFile
+	enrollments []*Enrollment
+}
+
+// LoadStore reads the enrollments from the given file. A missing file is
+// treated as having no enrollments.
+func LoadStore(path string) (*Store, error) {
+	s := &Store{file: util.NewStoreFile(path)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Unable to read enrollments %s", path)
+	}
+	var sd storeData
+	if err = json.Unmarshal(data, &sd); err != nil {
+		return nil, errors.Wrapf(err, "Unable to parse enrollments %s", path)
+	}
+	for _, ed := range sd.Enrollments {
+		e := &Enrollment{Name: ed.Name, TokenID: ed.TokenID, Enrolled: ed.Enrolled}
+		if e.PublicKey, err = wgtypes.ParseKey(ed.PublicKey); err != nil {
+			return nil, errors.Wrapf(err, "Bad enrollment key '%s'", ed.PublicKey)
+		}
+		for _, aip := range ed.AllowedIPs {
+			_, ipn, err := net.ParseCIDR(aip)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Bad enrollment AllowedIP '%s'", aip)
+			}
+			e.AllowedIPs = append(e.AllowedIPs, *ipn)
+		}
+		s.enrollments = append(s.enrollments, e)
+	}
+	return s, nil
+}
+
+// MemoryOnly stops new enrollments from being written to the file, so that a
+// node that joins during a dry run has to join again once it is over
+func (s *Store) MemoryOnly() {
+	s.file.MemoryOnly()
+}
+
+// Enrollments returns the current enrollments
+func (s *Store) Enrollments() []*Enrollment {
+	return s.enrollments
+}
+
+// Enroll records a node joining with a verified token, and saves the store.
+// Each token can only be used by one node, but the same node may repeat its
+// request, in which case it returns false.
+func (s *Store) Enroll(key wgtypes.Key, token *Token, now time.Time) (bool, error) {
+	id := token.IDString()
+	for _, e := range s.enrollments {
+		if e.TokenID != id {
+			continue
+		}
+		if e.PublicKey != key {
+			return false, errors.Errorf("Join token %s was already used by %s", id, e.PublicKey)
+		}
+		return false, nil
+	}
+	s.enrollments = append(s.enrollments, &Enrollment{
+		PublicKey:  key,
+		Name:       token.Name,
+		AllowedIPs: token.AllowedIPs,
+		TokenID:    id,
+		Enrolled:   now,
+	})
+	if err := s.save(); err != nil {
+		// don't keep an enrollment we couldn't persist
+		s.enrollments = s.enrollments[:len(s.enrollments)-1]
+		return false, err
+	}
+	return true, nil
+}
+
+// Used checks whether a token has already been used
+func (s *Store) Used(token *Token) (wgtypes.Key, bool) {
+	id := token.IDString()
+	for _, e := range s.enrollments {
+		if e.TokenID == id {
+			return e.PublicKey, true
+		}
+	}
+	return wgtypes.Key{}, false
+}
+
+// save writes the store to its file
+func (s *Store) save() error {
+	var sd storeData
+	for _, e := range s.enrollments {
+		ed := enrollmentData{
+			PublicKey: e.PublicKey.String(),
+			Name:      e.Name,
+			TokenID:   e.TokenID,
+			Enrolled:  e.Enrolled,
+		}
+		for _, aip := range e.AllowedIPs {
+			ed.AllowedIPs = append(ed.AllowedIPs, aip.String())
+		}
+		sd.Enrollments = append(sd.Enrollments, ed)
+	}
+	data, err := json.MarshalIndent(&sd, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Unable to encode enrollments")
+	}
+	return errors.Wrapf(s.file.Save(data), "Unable to save enrollments %s", s.file.Path())
+}
@@ -0,0 +1,96 @@
+package enroll
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/internal/testutils"
+	"github.com/fastcat/wirelink/util"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	secret := testutils.MustRandBytes(t, make([]byte, secretLen))
+	dir, err := ioutil.TempDir("", "wirelink-enroll")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "enrolled.json")
+
+	s, err := LoadStore(path)
+	require.NoError(t, err)
+	assert.Empty(t, s.Enrollments())
+
+	aips := []net.IPNet{testutils.MakeIPv4Net(10, 0, 0, 5, 32)}
+	token := mustToken(t, secret, "laptop", aips, now.Add(time.Hour))
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+
+	_, used := s.Used(token)
+	assert.False(t, used)
+	added, err := s.Enroll(k1, token, now)
+	require.NoError(t, err)
+	assert.True(t, added)
+	user, used := s.Used(token)
+	assert.True(t, used)
+	assert.Equal(t, k1, user)
+
+	// repeats are fine, other keys are not
+	added, err = s.Enroll(k1, token, now)
+	require.NoError(t, err)
+	assert.False(t, added)
+	_, err = s.Enroll(k2, token, now)
+	assert.Error(t, err)
+
+	loaded, err := LoadStore(path)
+	require.NoError(t, err)
+	require.Len(t, loaded.Enrollments(), 1)
+	e := loaded.Enrollments()[0]
+	assert.Equal(t, k1, e.PublicKey)
+	assert.Equal(t, "laptop", e.Name)
+	assert.Equal(t, aips, e.AllowedIPs)
+	assert.Equal(t, token.IDString(), e.TokenID)
+	assert.True(t, now.Equal(e.Enrolled))
+
+	// failing to save doesn't keep the enrollment
+	bad := &Store{file: util.NewStoreFile(filepath.Join(dir, "missing", "enrolled.json"))}
+	_, err = bad.Enroll(k2, mustToken(t, secret, "", nil, now.Add(time.Hour)), now)
+	assert.Error(t, err)
+	assert.Empty(t, bad.Enrollments())
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("{"), 0600))
+	_, err = LoadStore(path)
+	assert.Error(t, err)
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"Enrollments":[{"PublicKey":"x"}]}`), 0600))
+	_, err = LoadStore(path)
+	assert.Error(t, err)
+}
+
+func TestStore_MemoryOnly(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	secret := testutils.MustRandBytes(t, make([]byte, secretLen))
+	dir, err := ioutil.TempDir("", "wirelink-enroll")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "enrolled.json")
+
+	s, err := LoadStore(path)
+	require.NoError(t, err)
+	s.MemoryOnly()
+	k1 := testutils.MustKey(t)
+	token := mustToken(t, secret, "laptop", nil, now.Add(time.Hour))
+	added, err := s.Enroll(k1, token, now)
+	require.NoError(t, err)
+	assert.True(t, added)
+	assert.Len(t, s.Enrollments(), 1)
+
+	// nothing was written
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,253 @@
+package enroll
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// DefaultTokenTTL is how long a token is valid for if not specified
+const DefaultTokenTTL = time.Hour
+
+// TokenIDLen is the length of the random token identifier
+const TokenIDLen = 16
+
+// Token is a one-time credential for a new node to join the network. It tells
+// the new node how to reach the node that issued it, and is authenticated with
+// a secret that only the issuer knows.
+type Token struct {
+	ID      [TokenIDLen]byte
+	Expires time.Time
+	// Router is the public key of the issuing node
+	Router wgtypes.Key
+	// Endpoint is the wireguard host:port of the issuing node
+	Endpoint string
+	// JoinPort is the port on the Endpoint host to send join requests to
+	JoinPort int
+	// Name and AllowedIPs are assigned to the new node when it joins
+	Name       string
+	AllowedIPs []net.IPNet
+
+	// encoded is the token in the form that was signed
+	encoded string
+}
+
+// tokenData is the JSON form of the Token
+type tokenData struct {
+	ID         string
+	Expires    int64
+	Router     string
+	Endpoint   string
+	JoinPort   int
+	Name       string   `json:",omitempty"`
+	AllowedIPs []string `json:",omitempty"`
+}
+
+// NewToken creates a new token with a random ID
+func NewToken(
+	router wgtypes.Key,
+	endpoint string,
+	joinPort int,
+	name string,
+	allowedIPs []net.IPNet,
+	expires time.Time,
+) (*Token, error) {
+	if _, _, err := net.SplitHostPort(endpoint); err != nil {
+		return nil, errors.Wrapf(err, "Bad endpoint for token '%s'", endpoint)
+	}
+	t := &Token{
+		Expires:    expires,
+		Router:     router,
+		Endpoint:   endpoint,
+		JoinPort:   joinPort,
+		Name:       name,
+		AllowedIPs: allowedIPs,
+	}
+	if _, err := rand.Read(t.ID[:]); err != nil {
+		return nil, errors.Wrap(err, "Unable to generate token ID")
+	}
+	return t, nil
+}
+
+// IDString formats the token ID for display and storage
+func (t *Token) IDString() string {
+	return hex.EncodeToString(t.ID[:])
+}
+
+// JoinAddr is the host:port to send join requests to
+func (t *Token) JoinAddr() string {
+	host, _, _ := net.SplitHostPort(t.Endpoint)
+	return net.JoinHostPort(host, strconv.Itoa(t.JoinPort))
+}
+
+func tokenMAC(secret []byte, body string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(body))
+	return mac.Sum(nil)
+}
+
+// Sign encodes the token and authenticates it with the secret, setting the
+// value returned by String
+func (t *Token) Sign(secret []byte) (string, error) {
+	td := tokenData{
+		ID:       t.IDString(),
+		Expires:  t.Expires.Unix(),
+		Router:   t.Router.String(),
+		Endpoint: t.Endpoint,
+		JoinPort: t.JoinPort,
+		Name:     t.Name,
+	}
+	for _, aip := range t.AllowedIPs {
+		td.AllowedIPs = append(td.AllowedIPs, aip.String())
+	}
+	data, err := json.Marshal(&td)
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to encode token")
+	}
+	body := base64.RawURLEncoding.EncodeToString(data)
+	t.encoded = body + "." + base64.RawURLEncoding.EncodeToString(tokenMAC(secret, body))
+	return t.encoded, nil
+}
+
+// String gives the encoded form of the token, if it has been signed or parsed
+func (t *Token) String() string {
+	return t.encoded
+}
+
+// ParseToken decodes a token without checking its authenticity, which only
+// the issuer can do
+func ParseToken(s string) (*Token, error) {
+	s = strings.TrimSpace(s)
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("Malformed join token")
+	}
+	t, err := parseBody(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	t.encoded = s
+	return t, nil
+}
+
+// parseBody decodes the signed body of a token
+func parseBody(body string) (*Token, error) {
+	data, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to decode join token")
+	}
+	var td tokenData
+	if err = json.Unmarshal(data, &td); err != nil {
+		return nil, errors.Wrap(err, "Unable to parse join token")
+	}
+	t := &Token{
+		Expires:  time.Unix(td.Expires, 0),
+		Endpoint: td.Endpoint,
+		JoinPort: td.JoinPort,
+		Name:     td.Name,
+		encoded:  body,
+	}
+	id, err := hex.DecodeString(td.ID)
+	if err != nil || len(id) != TokenIDLen {
+		return nil, errors.Errorf("Bad join token ID '%s'", td.ID)
+	}
+	copy(t.ID[:], id)
+	if t.Router, err = wgtypes.ParseKey(td.Router); err != nil {
+		return nil, errors.Wrap(err, "Bad router key in join token")
+	}
+	if _, _, err = net.SplitHostPort(td.Endpoint); err != nil {
+		return nil, errors.Wrap(err, "Bad endpoint in join token")
+	}
+	if td.JoinPort <= 0 || td.JoinPort > 65535 {
+		return nil, errors.Errorf("Bad join port in join token: %d", td.JoinPort)
+	}
+	for _, aip := range td.AllowedIPs {
+		_, ipn, err := net.ParseCIDR(aip)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Bad AllowedIP in join token '%s'", aip)
+		}
+		t.AllowedIPs = append(t.AllowedIPs, *ipn)
+	}
+	return t, nil
+}
+
+// Verify checks that the token was issued with the secret
+func (t *Token) Verify(secret []byte) error {
+	parts := strings.Split(t.encoded, ".")
+	if len(parts) != 2 {
+		return errors.New("Join token is not signed")
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(mac, tokenMAC(secret, parts[0])) {
+		return errors.New("Join token has a bad signature")
+	}
+	return nil
+}
+
+// proofMAC binds a joining key to a token, keyed by the token's MAC, which
+// only the issuer and the holder of the token know
+func proofMAC(tokenMAC []byte, key wgtypes.Key) []byte {
+	mac := hmac.New(sha256.New, tokenMAC)
+	mac.Write(key[:])
+	return mac.Sum(nil)
+}
+
+// Proof encodes the token to send in a join request from the given key. It is
+// the body of the token, with its MAC replaced by a proof that the sender holds
+// the token, which only works for that key. This way the token itself, which
+// anyone could use, never appears on the wire.
+func (t *Token) Proof(key wgtypes.Key) (string, error) {
+	parts := strings.Split(t.encoded, ".")
+	if len(parts) != 2 {
+		return "", errors.New("Join token is not signed")
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to decode join token signature")
+	}
+	return parts[0] + "." + base64.RawURLEncoding.EncodeToString(proofMAC(mac, key)), nil
+}
+
+// ParseProof decodes the token and proof from a join request, without checking
+// either, which only the issuer can do with VerifyProof
+func ParseProof(s string) (*Token, []byte, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 {
+		return nil, nil, errors.New("Malformed join token proof")
+	}
+	t, err := parseBody(parts[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	proof, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Unable to decode join token proof")
+	}
+	return t, proof, nil
+}
+
+// VerifyProof checks that the proof was made for the key by the holder of the
+// token, and that the token was issued with the secret
+func (t *Token) VerifyProof(secret []byte, key wgtypes.Key, proof []byte) error {
+	body := strings.Split(t.encoded, ".")[0]
+	if !hmac.Equal(proof, proofMAC(tokenMAC(secret, body), key)) {
+		return errors.Errorf("Join token %s proof is not valid for %s", t.IDString(), key)
+	}
+	return nil
+}
+
+// Expired checks whether the token can no longer be used to join
+func (t *Token) Expired(now time.Time) bool {
+	return now.After(t.Expires)
+}
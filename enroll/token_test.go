@@ -0,0 +1,149 @@
+package enroll
+
+import (
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/internal/testutils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func mustToken(t *testing.T, secret []byte, name string, aips []net.IPNet, expires time.Time) *Token {
+	token, err := NewToken(testutils.MustKey(t), "vpn.example.com:51820", 51822, name, aips, expires)
+	require.NoError(t, err)
+	_, err = token.Sign(secret)
+	require.NoError(t, err)
+	return token
+}
+
+func TestToken_SignParse(t *testing.T) {
+	now := time.Now()
+	secret := testutils.MustRandBytes(t, make([]byte, secretLen))
+	aips := []net.IPNet{testutils.MakeIPv4Net(10, 0, 0, 5, 32)}
+
+	token := mustToken(t, secret, "laptop", aips, now.Add(time.Hour))
+	assert.Equal(t, "vpn.example.com:51822", token.JoinAddr())
+
+	parsed, err := ParseToken(" " + token.String() + "\n")
+	require.NoError(t, err)
+	assert.Equal(t, token.ID, parsed.ID)
+	assert.Equal(t, token.Expires.Unix(), parsed.Expires.Unix())
+	assert.Equal(t, token.Router, parsed.Router)
+	assert.Equal(t, token.Endpoint, parsed.Endpoint)
+	assert.Equal(t, token.JoinPort, parsed.JoinPort)
+	assert.Equal(t, "laptop", parsed.Name)
+	assert.Equal(t, aips, parsed.AllowedIPs)
+	assert.Equal(t, token.String(), parsed.String())
+
+	assert.NoError(t, parsed.Verify(secret))
+	assert.Error(t, parsed.Verify(testutils.MustRandBytes(t, make([]byte, secretLen))))
+	assert.False(t, parsed.Expired(now))
+	assert.True(t, parsed.Expired(now.Add(2*time.Hour)))
+
+	// changing the body breaks the signature
+	other := mustToken(t, secret, "other", nil, now.Add(time.Hour))
+	forged, err := ParseToken(strings.Split(other.String(), ".")[0] + "." + strings.Split(token.String(), ".")[1])
+	require.NoError(t, err)
+	assert.Error(t, forged.Verify(secret))
+
+	unsigned := &Token{}
+	assert.Error(t, unsigned.Verify(secret))
+
+	_, err = NewToken(token.Router, "no-port", 1, "", nil, now)
+	assert.Error(t, err)
+}
+
+func TestToken_Proof(t *testing.T) {
+	now := time.Now()
+	secret := testutils.MustRandBytes(t, make([]byte, secretLen))
+	otherSecret := testutils.MustRandBytes(t, make([]byte, secretLen))
+	key := testutils.MustKey(t)
+	otherKey := testutils.MustKey(t)
+	token := mustToken(t, secret, "laptop", nil, now.Add(time.Hour))
+
+	proofText, err := token.Proof(key)
+	require.NoError(t, err)
+	assert.NotContains(t, proofText, strings.Split(token.String(), ".")[1])
+
+	got, proof, err := ParseProof(proofText)
+	require.NoError(t, err)
+	assert.Equal(t, token.ID, got.ID)
+	assert.Equal(t, token.Name, got.Name)
+
+	tests := []struct {
+		name    string
+		secret  []byte
+		key     wgtypes.Key
+		proof   []byte
+		wantErr bool
+	}{
+		{"valid", secret, key, proof, false},
+		{"other key", secret, otherKey, proof, true},
+		{"other secret", otherSecret, key, proof, true},
+		{"empty proof", secret, key, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := got.VerifyProof(tt.secret, tt.key, tt.proof)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	unsigned, err := NewToken(token.Router, token.Endpoint, token.JoinPort, "", nil, now)
+	require.NoError(t, err)
+	_, err = unsigned.Proof(key)
+	assert.Error(t, err)
+}
+
+func TestParseProof_errors(t *testing.T) {
+	tests := []struct {
+		name  string
+		proof string
+	}{
+		{"empty", ""},
+		{"no proof", "abc"},
+		{"bad body", "!!!.abc"},
+		{"bad proof", encodeBody(`{"ID":"00112233445566778899aabbccddeeff","Router":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=","Endpoint":"a:1","JoinPort":1}`) + "!"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := ParseProof(tt.proof)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestParseToken_errors(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"empty", ""},
+		{"no mac", "abc"},
+		{"bad base64", "!!!.abc"},
+		{"bad json", "e30K!.abc"},
+		{"bad id", encodeBody(`{"ID":"12","Router":"","Endpoint":"a:1","JoinPort":1}`)},
+		{"bad router", encodeBody(`{"ID":"00112233445566778899aabbccddeeff","Router":"x","Endpoint":"a:1","JoinPort":1}`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseToken(tt.token)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func encodeBody(body string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(body)) + ".mac"
+}
@@ -15,7 +15,24 @@ import (
 type GroupAccumulator struct {
 	maxGroupLen int
 	groups      [][]byte
-	now         time.Time
+	// contents has the facts that were added to each group
+	contents [][]*Fact
+	// header is prepended to every group
+	header []byte
+	// compact enables putting facts in subject groups
+	compact bool
+	// run is the subject group open at the end of the last group, if any
+	run *subjectRun
+	now time.Time
+}
+
+// subjectRun tracks the subject group that facts with the same subject can be
+// added to without repeating it
+type subjectRun struct {
+	subject wgtypes.Key
+	// countAt is the offset of the fact count in the group
+	countAt int
+	count   int
 }
 
 // NewAccumulator initializes a new GroupAccumulator with a given max inner
@@ -24,41 +41,105 @@ func NewAccumulator(maxGroupLen int, now time.Time) *GroupAccumulator {
 	return &GroupAccumulator{
 		maxGroupLen: maxGroupLen,
 		groups:      make([][]byte, 1),
+		contents:    make([][]*Fact, 1),
 		now:         now,
 	}
 }
 
+// SetHeader sets a fact to be put at the start of every group, which is not
+// included in the group contents. It must be called before any facts are added.
+func (ga *GroupAccumulator) SetHeader(f *Fact) error {
+	b, err := f.MarshalBinaryNow(ga.now)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to convert header fact to packet bytes")
+	}
+	ga.header = b
+	return nil
+}
+
+// SetCompact sets whether facts are put in subject groups, so that the subject
+// of consecutive facts about the same peer is only sent once. This should only
+// be enabled for peers that understand it. It must be called before any facts
+// are added.
+func (ga *GroupAccumulator) SetCompact(compact bool) {
+	ga.compact = compact
+}
+
 // AddFact appends the given fact into the accumulator
 func (ga *GroupAccumulator) AddFact(f *Fact) error {
-	b, err := f.MarshalBinaryNow(ga.now)
+	b, ps, err := ga.marshal(f)
 	if err != nil {
 		return errors.Wrapf(err, "Unable to convert fact to packet bytes")
 	}
-	lgi := len(ga.groups) - 1
-	lg := ga.groups[lgi]
-	if len(lg)+len(b) > ga.maxGroupLen {
+	if !ga.fits(b, ps) {
 		// make another group
-		ga.groups = append(ga.groups, b)
-	} else {
-		ga.groups[lgi] = append(lg, b...)
+		ga.groups = append(ga.groups, nil)
+		ga.contents = append(ga.contents, nil)
+		ga.run = nil
 	}
+	ga.append(f, b, ps)
 	return nil
 }
 
 // AddFactIfRoom conditionally adds the fact if and only if it won't result in
 // creating a new group
 func (ga *GroupAccumulator) AddFactIfRoom(f *Fact) (added bool, err error) {
-	b, err := f.MarshalBinaryNow(ga.now)
+	b, ps, err := ga.marshal(f)
 	if err != nil {
 		return false, errors.Wrapf(err, "Unable to convert fact to packet bytes")
 	}
+	if len(ga.groups[len(ga.groups)-1]) == 0 || !ga.fits(b, ps) {
+		return false, nil
+	}
+	ga.append(f, b, ps)
+	return true, nil
+}
+
+// marshal converts the fact to packet bytes. If it is going in a subject
+// group, the subject is left out of the bytes, and returned separately.
+func (ga *GroupAccumulator) marshal(f *Fact) ([]byte, *PeerSubject, error) {
+	if ga.compact {
+		if ps, ok := f.Subject.(*PeerSubject); ok {
+			b, err := f.marshal(ga.now, false)
+			return b, ps, err
+		}
+	}
+	b, err := f.MarshalBinaryNow(ga.now)
+	return b, nil, err
+}
+
+// extendsRun returns whether a fact with the given subject can be added to the
+// open subject group
+func (ga *GroupAccumulator) extendsRun(ps *PeerSubject) bool {
+	return ps != nil && ga.run != nil && ga.run.subject == ps.Key && ga.run.count < subjectGroupMaxFacts
+}
+
+// fits returns whether the marshalled fact will fit in the last group
+func (ga *GroupAccumulator) fits(b []byte, ps *PeerSubject) bool {
+	l := len(ga.header) + len(ga.groups[len(ga.groups)-1]) + len(b)
+	if ps != nil && !ga.extendsRun(ps) {
+		l += subjectGroupHeaderLen
+	}
+	return l <= ga.maxGroupLen
+}
+
+// append adds the marshalled fact to the last group, starting or extending a
+// subject group if needed
+func (ga *GroupAccumulator) append(f *Fact, b []byte, ps *PeerSubject) {
 	lgi := len(ga.groups) - 1
 	lg := ga.groups[lgi]
-	if len(lg)+len(b) > ga.maxGroupLen || len(lg) == 0 {
-		return false, nil
+	if ps == nil {
+		ga.run = nil
+	} else if ga.extendsRun(ps) {
+		ga.run.count++
+		lg[ga.run.countAt] = byte(ga.run.count)
+	} else {
+		var countAt int
+		lg, countAt = appendSubjectGroupHeader(lg, ps)
+		ga.run = &subjectRun{subject: ps.Key, countAt: countAt, count: 1}
 	}
 	ga.groups[lgi] = append(lg, b...)
-	return true, nil
+	ga.contents[lgi] = append(ga.contents[lgi], f)
 }
 
 // MakeSignedGroups converts all the accumulated facts into SignedGroups of no
@@ -67,29 +148,60 @@ func (ga *GroupAccumulator) MakeSignedGroups(
 	s *signing.Signer,
 	recipient *wgtypes.Key,
 ) ([]*Fact, error) {
-	ret := make([]*Fact, 0, len(ga.groups))
-	subject := PeerSubject{Key: s.PublicKey}
-	for _, g := range ga.groups {
+	ret, _, err := ga.MakeSignedGroupsWithContents(s, recipient)
+	return ret, err
+}
+
+// MakeSignedGroupsWithContents is like MakeSignedGroups, but also returns the
+// facts that were put into each of the returned groups, in the same order.
+func (ga *GroupAccumulator) MakeSignedGroupsWithContents(
+	s *signing.Signer,
+	recipient *wgtypes.Key,
+) (ret []*Fact, contents [][]*Fact, err error) {
+	ret = make([]*Fact, 0, len(ga.groups))
+	contents = make([][]*Fact, 0, len(ga.groups))
+	for i, g := range ga.groups {
 		if len(g) == 0 {
 			continue
 		}
-		// TODO: have signer cache shared key
-		nonce, tag, err := s.SignFor(g, recipient)
+		if len(ga.header) != 0 {
+			g = append(append(make([]byte, 0, len(ga.header)+len(g)), ga.header...), g...)
+		}
+		sg, err := signGroup(s, recipient, g)
 		if err != nil {
-			return nil, errors.Wrapf(err, "Unable to sign group data")
+			return nil, nil, err
 		}
-		value := SignedGroupValue{
+		ret = append(ret, sg)
+		contents = append(contents, ga.contents[i])
+	}
+	return ret, contents, nil
+}
+
+// MakeCompactHello makes a signed group with just an empty subject group,
+// which peers that understand subject groups parse as having no facts, and
+// older peers reject. It is used to find out which peers understand them.
+func MakeCompactHello(s *signing.Signer, recipient *wgtypes.Key) (*Fact, error) {
+	g, countAt := appendSubjectGroupHeader(nil, &PeerSubject{Key: s.PublicKey})
+	g[countAt] = 0
+	return signGroup(s, recipient, g)
+}
+
+// signGroup signs the inner bytes for a group, and wraps them in a fact
+func signGroup(s *signing.Signer, recipient *wgtypes.Key, g []byte) (*Fact, error) {
+	// TODO: have signer cache shared key
+	nonce, tag, err := s.SignFor(g, recipient)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to sign group data")
+	}
+	return &Fact{
+		Attribute: AttributeSignedGroup,
+		// zero time will turn into a TTL of zero
+		Expires: time.Time{},
+		Subject: &PeerSubject{Key: s.PublicKey},
+		Value: &SignedGroupValue{
 			Nonce:      nonce,
 			Tag:        tag,
 			InnerBytes: g,
-		}
-		ret = append(ret, &Fact{
-			Attribute: AttributeSignedGroup,
-			// zero time will turn into a TTL of zero
-			Expires: time.Time{},
-			Subject: &subject,
-			Value:   &value,
-		})
-	}
-	return ret, nil
+		},
+	}, nil
 }
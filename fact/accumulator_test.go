@@ -11,6 +11,8 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 func TestAccumulatorLimits(t *testing.T) {
@@ -67,6 +69,73 @@ func TestAccumulatorSigning(t *testing.T) {
 	}
 }
 
+func TestGroupAccumulator_MakeSignedGroupsWithContents(t *testing.T) {
+	ef, ep := mustMockAlivePacket(t, nil, nil)
+
+	a := NewAccumulator(len(ep)*4-1, time.Now())
+	for i := 0; i < 4; i++ {
+		err := a.AddFact(ef)
+		require.Nil(t, err)
+	}
+	added, err := a.AddFactIfRoom(ef)
+	require.Nil(t, err)
+	require.True(t, added)
+
+	priv, _ := testutils.MustKeyPair(t)
+	_, pub := testutils.MustKeyPair(t)
+	s := signing.New(&priv)
+
+	facts, contents, err := a.MakeSignedGroupsWithContents(s, &pub)
+	require.Nil(t, err)
+	require.Len(t, facts, 2)
+	require.Len(t, contents, 2)
+	assert.Len(t, contents[0], 3)
+	assert.Len(t, contents[1], 2)
+	for _, c := range contents {
+		for _, f := range c {
+			assert.Same(t, ef, f)
+		}
+	}
+}
+
+func TestGroupAccumulator_SetHeader(t *testing.T) {
+	ef, ep := mustMockAlivePacket(t, nil, nil)
+	hf := &Fact{
+		Attribute: AttributeGossip,
+		Subject:   &PeerSubject{testutils.MustKey(t)},
+		Value:     &GossipValue{Hops: 2},
+		Expires:   time.Now(),
+	}
+	hp, err := hf.MarshalBinary()
+	require.Nil(t, err)
+
+	// room for the header and 3 facts
+	a := NewAccumulator(len(hp)+len(ep)*4-1, time.Now())
+	require.Nil(t, a.SetHeader(hf))
+	for i := 0; i < 4; i++ {
+		err := a.AddFact(ef)
+		require.Nil(t, err)
+	}
+
+	priv, _ := testutils.MustKeyPair(t)
+	_, pub := testutils.MustKeyPair(t)
+	s := signing.New(&priv)
+
+	facts, contents, err := a.MakeSignedGroupsWithContents(s, &pub)
+	require.Nil(t, err)
+	require.Len(t, facts, 2)
+	assert.Len(t, contents[0], 3, "header should not be in contents")
+	assert.Len(t, contents[1], 1, "header should not be in contents")
+	for _, sf := range facts {
+		inner, err := sf.Value.(*SignedGroupValue).ParseInner(time.Now())
+		require.Nil(t, err)
+		if assert.NotEmpty(t, inner) {
+			assert.Equal(t, AttributeGossip, inner[0].Attribute, "header should be first in every group")
+			assert.Equal(t, hf.Value, inner[0].Value)
+		}
+	}
+}
+
 func TestGroupAccumulator_AddFactIfRoom_OneByteTooSmall(t *testing.T) {
 	f := &Fact{
 		Attribute: AttributeAlive,
@@ -108,3 +177,118 @@ func TestGroupAccumulator_AddFactIfRoom_JustRight(t *testing.T) {
 	require.Nil(t, err)
 	assert.True(t, added)
 }
+
+func TestGroupAccumulator_SetCompact(t *testing.T) {
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	a1, ap := mustMockAlivePacket(t, &k1, nil)
+	a2, _ := mustMockAlivePacket(t, &k1, nil)
+	a3, _ := mustMockAlivePacket(t, &k1, nil)
+	b1, _ := mustMockAlivePacket(t, &k2, nil)
+	a4, _ := mustMockAlivePacket(t, &k1, nil)
+	// each fact is sent without its subject
+	tupleLen := len(ap) - wgtypes.KeyLen
+
+	priv, _ := testutils.MustKeyPair(t)
+	_, pub := testutils.MustKeyPair(t)
+	s := signing.New(&priv)
+
+	tests := []struct {
+		name        string
+		maxGroupLen int
+		facts       []*Fact
+		wantLens    []int
+	}{
+		{
+			"runs",
+			1000,
+			[]*Fact{a1, a2, a3, b1, a4},
+			[]int{subjectGroupHeaderLen*3 + tupleLen*5},
+		},
+		{
+			"split",
+			subjectGroupHeaderLen + tupleLen*2,
+			[]*Fact{a1, a2, a3},
+			[]int{subjectGroupHeaderLen + tupleLen*2, subjectGroupHeaderLen + tupleLen},
+		},
+		{
+			"too many for one run",
+			10000,
+			func() []*Fact {
+				ret := make([]*Fact, subjectGroupMaxFacts+1)
+				for i := range ret {
+					ret[i] = a1
+				}
+				return ret
+			}(),
+			[]int{subjectGroupHeaderLen*2 + tupleLen*(subjectGroupMaxFacts+1)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			a := NewAccumulator(tt.maxGroupLen, now)
+			a.SetCompact(true)
+			for _, f := range tt.facts {
+				require.Nil(t, a.AddFact(f))
+			}
+			groups, contents, err := a.MakeSignedGroupsWithContents(s, &pub)
+			require.Nil(t, err)
+			require.Len(t, groups, len(tt.wantLens))
+			var parsed []*Fact
+			for i, g := range groups {
+				sgv := g.Value.(*SignedGroupValue)
+				assert.Len(t, sgv.InnerBytes, tt.wantLens[i])
+				inner, compact, err := sgv.ParseInnerWithEncoding(now)
+				require.Nil(t, err)
+				assert.True(t, compact)
+				assert.Len(t, inner, len(contents[i]))
+				parsed = append(parsed, inner...)
+			}
+			require.Len(t, parsed, len(tt.facts))
+			for i, f := range parsed {
+				assert.Equal(t, tt.facts[i].Attribute, f.Attribute)
+				assert.Equal(t, tt.facts[i].Subject, f.Subject)
+				assert.Equal(t, tt.facts[i].Value, f.Value)
+			}
+		})
+	}
+}
+
+func TestGroupAccumulator_SetCompact_AddFactIfRoom(t *testing.T) {
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	a1, ap := mustMockAlivePacket(t, &k1, nil)
+	b1, _ := mustMockAlivePacket(t, &k2, nil)
+	tupleLen := len(ap) - wgtypes.KeyLen
+
+	ga := NewAccumulator(subjectGroupHeaderLen+tupleLen*2, time.Now())
+	ga.SetCompact(true)
+	require.Nil(t, ga.AddFact(a1))
+
+	// another subject needs another header, which won't fit
+	added, err := ga.AddFactIfRoom(b1)
+	require.Nil(t, err)
+	assert.False(t, added)
+
+	// but the same subject will
+	added, err = ga.AddFactIfRoom(a1)
+	require.Nil(t, err)
+	assert.True(t, added)
+}
+
+func TestMakeCompactHello(t *testing.T) {
+	priv, signer := testutils.MustKeyPair(t)
+	_, pub := testutils.MustKeyPair(t)
+	s := signing.New(&priv)
+
+	hello, err := MakeCompactHello(s, &pub)
+	require.Nil(t, err)
+	assert.Equal(t, AttributeSignedGroup, hello.Attribute)
+	assert.Equal(t, &PeerSubject{Key: signer}, hello.Subject)
+	sgv := hello.Value.(*SignedGroupValue)
+	inner, compact, err := sgv.ParseInnerWithEncoding(time.Now())
+	require.Nil(t, err)
+	assert.True(t, compact)
+	assert.Empty(t, inner)
+}
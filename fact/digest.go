@@ -0,0 +1,135 @@
+package fact
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/fastcat/wirelink/util"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// digestLen is how many bytes of the hash are kept in a DigestValue
+const digestLen = 16
+
+// DigestValue is a compact summary of all the facts known about a subject,
+// used to detect when two peers disagree about them without sending the facts
+// themselves. The expiration times of the facts are not included.
+type DigestValue struct {
+	Hash [digestLen]byte
+}
+
+// DigestValue must implement Value
+var _ Value = &DigestValue{}
+
+// MarshalBinary implements BinaryMarshaler
+func (dv *DigestValue) MarshalBinary() ([]byte, error) {
+	return util.CloneBytes(dv.Hash[:]), nil
+}
+
+// UnmarshalBinary implements BinaryUnmarshaler
+func (dv *DigestValue) UnmarshalBinary(data []byte) error {
+	if len(data) != digestLen {
+		return errors.Errorf("digest value should be %d bytes, not %d", digestLen, len(data))
+	}
+	copy(dv.Hash[:], data)
+	return nil
+}
+
+// DecodeFrom implements Decodable
+func (dv *DigestValue) DecodeFrom(lengthHint int, reader io.Reader) error {
+	return util.DecodeFrom(dv, digestLen, reader)
+}
+
+func (dv *DigestValue) String() string {
+	return fmt.Sprintf("%x", dv.Hash[:])
+}
+
+// Digestible checks if a fact should be included in digests: only facts that
+// are stored and forwarded are, and alive and successor facts are excluded as
+// they are handled separately by every peer.
+func Digestible(f *Fact) bool {
+	switch f.Attribute {
+	case AttributeEndpointV4, AttributeEndpointV6,
+		AttributeAllowedCidrV4, AttributeAllowedCidrV6,
+		AttributeMember, AttributeMemberMetadata,
+		AttributeRoster:
+		return true
+	default:
+		return false
+	}
+}
+
+// Digests computes the digest for each peer subject in the list of facts.
+// Subjects with no digestible facts are not included.
+func Digests(facts []*Fact) map[wgtypes.Key]DigestValue {
+	keys := make(map[wgtypes.Key][]Key)
+	seen := make(map[Key]bool, len(facts))
+	for _, f := range facts {
+		ps, ok := f.Subject.(*PeerSubject)
+		if !ok || !Digestible(f) {
+			continue
+		}
+		k := KeyOf(f)
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		keys[ps.Key] = append(keys[ps.Key], k)
+	}
+
+	ret := make(map[wgtypes.Key]DigestValue, len(keys))
+	for subject, sk := range keys {
+		sort.Slice(sk, func(i, j int) bool {
+			if sk[i].attribute != sk[j].attribute {
+				return sk[i].attribute < sk[j].attribute
+			}
+			return sk[i].value < sk[j].value
+		})
+		h := sha256.New()
+		var lenBuf [binary.MaxVarintLen64]byte
+		for _, k := range sk {
+			h.Write([]byte{byte(k.attribute)})
+			n := binary.PutUvarint(lenBuf[:], uint64(len(k.value)))
+			h.Write(lenBuf[:n])
+			h.Write([]byte(k.value))
+		}
+		var dv DigestValue
+		copy(dv.Hash[:], h.Sum(nil))
+		ret[subject] = dv
+	}
+	return ret
+}
+
+// DigestHorizons finds, for each peer subject in the list of facts, the
+// earliest expiration of the facts that go into its digest. A peer whose digest
+// for a subject matches has all those facts until at least this time.
+func DigestHorizons(facts []*Fact) map[wgtypes.Key]time.Time {
+	ret := make(map[wgtypes.Key]time.Time)
+	for _, f := range facts {
+		ps, ok := f.Subject.(*PeerSubject)
+		if !ok || !Digestible(f) {
+			continue
+		}
+		if h, ok := ret[ps.Key]; !ok || f.Expires.Before(h) {
+			ret[ps.Key] = f.Expires
+		}
+	}
+	return ret
+}
+
+// HasSubject checks if the fact key is for the given subject
+func (k Key) HasSubject(subject Subject) bool {
+	return k.subject == string(util.MustBytes(subject.MarshalBinary()))
+}
+
+// IsAttribute checks if the fact key is for the given attribute
+func (k Key) IsAttribute(attr Attribute) bool {
+	return k.attribute == attr
+}
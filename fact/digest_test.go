@@ -0,0 +1,117 @@
+package fact
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/fastcat/wirelink/internal/testutils"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDigests(t *testing.T) {
+	now := time.Now()
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+
+	ep := func(k wgtypes.Key, port int, expires time.Time) *Fact {
+		return &Fact{
+			Attribute: AttributeEndpointV4,
+			Subject:   &PeerSubject{k},
+			Value:     &IPPortValue{IP: net.IPv4(192, 168, 0, 1).To4(), Port: port},
+			Expires:   expires,
+		}
+	}
+	alive := &Fact{
+		Attribute: AttributeAlive,
+		Subject:   &PeerSubject{k1},
+		Value:     &UUIDValue{uuid.Must(uuid.NewRandom())},
+		Expires:   now,
+	}
+	member := &Fact{
+		Attribute: AttributeMember,
+		Subject:   &PeerSubject{k1},
+		Value:     &EmptyValue{},
+		Expires:   now,
+	}
+
+	base := Digests([]*Fact{ep(k1, 1, now), ep(k1, 2, now), member})
+	assert.Len(t, base, 1)
+	assert.Contains(t, base, k1)
+
+	tests := []struct {
+		name      string
+		facts     []*Fact
+		wantSame  bool
+		wantCount int
+	}{
+		{"reordered", []*Fact{member, ep(k1, 2, now), ep(k1, 1, now)}, true, 1},
+		{"different expiration", []*Fact{ep(k1, 1, now.Add(time.Hour)), ep(k1, 2, now), member}, true, 1},
+		{"duplicates", []*Fact{ep(k1, 1, now), ep(k1, 1, now.Add(time.Hour)), ep(k1, 2, now), member}, true, 1},
+		{"alive ignored", []*Fact{ep(k1, 1, now), ep(k1, 2, now), member, alive}, true, 1},
+		{"other subject", []*Fact{ep(k1, 1, now), ep(k1, 2, now), member, ep(k2, 1, now)}, true, 2},
+		{"missing fact", []*Fact{ep(k1, 1, now), member}, false, 1},
+		{"different value", []*Fact{ep(k1, 1, now), ep(k1, 3, now), member}, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Digests(tt.facts)
+			assert.Len(t, got, tt.wantCount)
+			if tt.wantSame {
+				assert.Equal(t, base[k1], got[k1])
+			} else {
+				assert.NotEqual(t, base[k1], got[k1])
+			}
+		})
+	}
+
+	assert.Empty(t, Digests([]*Fact{alive}))
+}
+
+func TestDigestHorizons(t *testing.T) {
+	now := time.Now()
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+
+	ep := func(k wgtypes.Key, port int, expires time.Time) *Fact {
+		return &Fact{
+			Attribute: AttributeEndpointV4,
+			Subject:   &PeerSubject{k},
+			Value:     &IPPortValue{IP: net.IPv4(192, 168, 0, 1).To4(), Port: port},
+			Expires:   expires,
+		}
+	}
+	alive := &Fact{
+		Attribute: AttributeAlive,
+		Subject:   &PeerSubject{k2},
+		Value:     &UUIDValue{uuid.Must(uuid.NewRandom())},
+		Expires:   now,
+	}
+
+	got := DigestHorizons([]*Fact{
+		ep(k1, 1, now.Add(time.Hour)),
+		ep(k1, 2, now.Add(time.Minute)),
+		ep(k1, 3, now.Add(2*time.Minute)),
+		alive,
+	})
+	assert.Equal(t, map[wgtypes.Key]time.Time{k1: now.Add(time.Minute)}, got)
+}
+
+func TestKey_HasSubject(t *testing.T) {
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	key := KeyOf(&Fact{
+		Attribute: AttributeMember,
+		Subject:   &PeerSubject{k1},
+		Value:     &EmptyValue{},
+	})
+	assert.True(t, key.HasSubject(&PeerSubject{k1}))
+	assert.False(t, key.HasSubject(&PeerSubject{k2}))
+	assert.True(t, key.IsAttribute(AttributeMember))
+	assert.False(t, key.IsAttribute(AttributeAlive))
+}
@@ -1,3 +1,8 @@
 // Package fact provides the core code for representing facts, and their
 // serialization and deserialization.
 package fact
+
+import "github.com/fastcat/wirelink/log"
+
+// logger is used for all logging in the fact package
+var logger = log.For("fact")
@@ -3,6 +3,7 @@ package fact
 import (
 	"sort"
 	"time"
+	"unsafe"
 
 	"github.com/fastcat/wirelink/util"
 )
@@ -26,11 +27,17 @@ func KeyOf(fact *Fact) Key {
 	}
 	return Key{
 		attribute: fact.Attribute,
-		subject:   string(util.MustBytes(fact.Subject.MarshalBinary())),
+		subject:   subjectKey(fact.Subject),
 		value:     string(valueBytes),
 	}
 }
 
+// Size estimates how much memory the key uses, for measuring how much memory
+// tracking facts takes
+func (k Key) Size() int {
+	return int(unsafe.Sizeof(k)) + len(k.subject) + len(k.value)
+}
+
 // factSet is used to map fact keys to the "best" fact for that key
 type factSet map[Key]*Fact
 
@@ -32,6 +32,18 @@ func TestFactKeyEquality(t *testing.T) {
 	assert.Exactly(t, factKey1, factKey2, "Keys for same fact should be equal")
 }
 
+func TestKey_Size(t *testing.T) {
+	f := &Fact{
+		Attribute: AttributeEndpointV4,
+		Subject:   &PeerSubject{Key: testutils.MustKey(t)},
+		Value:     &IPPortValue{IP: net.IPv4(127, 0, 0, 1), Port: 51820},
+	}
+	k := KeyOf(f)
+	// 32 bytes for the key, 4+2 for the endpoint, plus the struct itself
+	assert.Greater(t, k.Size(), 32+6)
+	assert.Less(t, k.Size(), 32+6+64)
+}
+
 func TestMergeList(t *testing.T) {
 	key := testutils.MustKey(t)
 	now := time.Now()
@@ -23,6 +23,51 @@ const (
 	AttributeAllowedCidrV6  Attribute = 'A'
 	AttributeMember         Attribute = 'm'
 	AttributeMemberMetadata Attribute = 'M'
+	// Echo requests and replies are used to measure link quality between
+	// peers. They are handled as they arrive and never stored or forwarded.
+	AttributeEchoRequest Attribute = '?'
+	AttributeEchoReply   Attribute = '='
+	// Path probes are padded to test whether packets of a given size get
+	// through to a peer, which replies with just the size. Like echoes, they
+	// are handled as they arrive and never stored or forwarded.
+	AttributePathProbe      Attribute = 'P'
+	AttributePathProbeReply Attribute = 'p'
+	// Reach requests ask a relay whether it has a healthy link to the peer in
+	// the value, which it answers with the quality of that link only if it
+	// does. Like echoes, they are handled as they arrive and never stored or
+	// forwarded.
+	AttributeReachRequest Attribute = 'h'
+	AttributeReachReply   Attribute = 'H'
+	// Acks confirm receipt of a signed group, identified by its nonce. Like
+	// echoes, they are handled as they arrive and never stored or forwarded.
+	AttributeAck Attribute = '+'
+	// Digests summarize all the facts a peer knows about a subject, so peers
+	// can detect and repair differences in what they know.
+	AttributeDigest Attribute = '#'
+	// A gossip marker is sent at the start of a signed group of facts that are
+	// being gossiped, to say how many hops they have traveled.
+	AttributeGossip Attribute = '~'
+	// A roster page lists members of the network, signed offline by the network
+	// root key, which is the subject. It is verified by the receiver, so any
+	// peer may relay it.
+	AttributeRoster Attribute = 'R'
+	// A join request asks a node to enroll the subject as a member, using a
+	// join token. It is only sent to the join port, never stored or forwarded.
+	AttributeJoinRequest Attribute = 'J'
+	// A successor fact says the subject's key has been replaced by the key in
+	// the value. It is only trusted from the subject itself, or from a
+	// Membership source.
+	AttributeSuccessor Attribute = '>'
+	// A vote is a Membership source's own assertion that the peer in the value
+	// is a member, for counting towards a membership quorum. It is only sent
+	// directly by the source, which is the subject, and never stored or
+	// forwarded, so that relaying another source's membership facts can't count
+	// as a vote.
+	AttributeVote Attribute = 'v'
+	// A subject group is not a fact, but a marker in a signed group, followed
+	// by a subject and then several facts about it without their subjects.
+	// It is only sent to peers that have shown they understand it.
+	AttributeSubjectGroup Attribute = 'G'
 	// A signed group is a bit different from other facts
 	// in this case, the subject is actually the source,
 	// and the value is a signed aggregate of other facts.
@@ -71,6 +116,12 @@ func (f *Fact) MarshalBinary() ([]byte, error) {
 // MarshalBinaryNow is like MarshalBinary, except it uses a provided value of
 // `now` so that the output is deterministic
 func (f *Fact) MarshalBinaryNow(now time.Time) ([]byte, error) {
+	return f.marshal(now, true)
+}
+
+// marshal serializes a Fact, leaving out the subject if it is going into a
+// subject group
+func (f *Fact) marshal(now time.Time, withSubject bool) ([]byte, error) {
 	var buf bytes.Buffer
 	var tmp [binary.MaxVarintLen64]byte
 	var tmpLen int
@@ -92,12 +143,14 @@ func (f *Fact) MarshalBinaryNow(now time.Time) ([]byte, error) {
 
 	// these should never return errors, but ...
 
-	subjectData, err := f.Subject.MarshalBinary()
-	if err != nil {
-		return buf.Bytes(), errors.Wrap(err, "Failed to marshal Subject")
-	}
-	if n, err := buf.Write(subjectData); err != nil || n != len(subjectData) {
-		return buf.Bytes(), util.WrapOrNewf(err, "Failed to write subject to buffer, wrote %d of %d", n, len(subjectData))
+	if withSubject {
+		subjectData, err := f.Subject.MarshalBinary()
+		if err != nil {
+			return buf.Bytes(), errors.Wrap(err, "Failed to marshal Subject")
+		}
+		if n, err := buf.Write(subjectData); err != nil || n != len(subjectData) {
+			return buf.Bytes(), util.WrapOrNewf(err, "Failed to write subject to buffer, wrote %d of %d", n, len(subjectData))
+		}
 	}
 
 	valueData, err := f.Value.MarshalBinary()
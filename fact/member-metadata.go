@@ -10,7 +10,6 @@ import (
 
 	"github.com/pkg/errors"
 
-	"github.com/fastcat/wirelink/log"
 	"github.com/fastcat/wirelink/util"
 )
 
@@ -23,6 +22,9 @@ const (
 	// MemberIsBasic flags if the member is a "basic" member which only runs
 	// wireguard and not wirelink
 	MemberIsBasic MemberAttribute = 'b'
+	// MemberIsRelay flags if the member is willing to relay traffic for other
+	// members that cannot reach each other directly
+	MemberIsRelay MemberAttribute = 'r'
 )
 
 // MemberMetadata represents a set of attributes and their values for a single
@@ -44,15 +46,20 @@ var memberMetadataValidators map[MemberAttribute]stringValidator = map[MemberAtt
 		}
 		return nil
 	},
-	MemberIsBasic: func(value string) error {
+	MemberIsBasic: boolValidator("MemberIsBasic"),
+	MemberIsRelay: boolValidator("MemberIsRelay"),
+}
+
+func boolValidator(attrName string) stringValidator {
+	return func(value string) error {
 		if len(value) != 1 {
-			return errors.Errorf("Invalid boolean for MemberIsBasic, len=%d", len(value))
+			return errors.Errorf("Invalid boolean for %s, len=%d", attrName, len(value))
 		}
 		if value[0] != 0 && value[0] != 1 {
-			return errors.Errorf("Invalid boolean for MemberIsBasic, value=%d", int(value[0]))
+			return errors.Errorf("Invalid boolean for %s, value=%d", attrName, int(value[0]))
 		}
 		return nil
-	},
+	}
 }
 
 // MarshalBinary implements BinaryEncoder
@@ -77,7 +84,7 @@ func (mm *MemberMetadata) MarshalBinary() ([]byte, error) {
 			}
 		} else {
 			// this is at debug because we re-send stuff we got from elsewhere
-			log.Debug("Encoding unrecognized member attribute %d", int(a))
+			logger.Debug("Encoding unrecognized member attribute %d", int(a))
 		}
 		buf = append(buf, byte(a))
 		l = binary.PutUvarint(tmp, uint64(len(v)))
@@ -160,7 +167,7 @@ func (mm *MemberMetadata) DecodeFrom(lengthHint int, reader io.Reader) error {
 			}
 		} else {
 			// not an error, we'll just ignore this value
-			log.Info("Decoding unrecognized member attribute %d", int(a))
+			logger.Info("Decoding unrecognized member attribute %d", int(a))
 		}
 
 		mm.attributes[a] = v
@@ -226,11 +233,17 @@ func (mm *MemberMetadata) ForEach(visitor func(MemberAttribute, string)) {
 
 // BuildMemberMetadata creates a metadata structure with the MemberName
 // attribute set to the given value.
-func BuildMemberMetadata(name string, basic bool) *MemberMetadata {
-	return &MemberMetadata{
+func BuildMemberMetadata(name string, basic, relay bool) *MemberMetadata {
+	ret := &MemberMetadata{
 		attributes: map[MemberAttribute]string{
 			MemberName:    name,
 			MemberIsBasic: util.Ternary(basic, string(byte(1)), string(byte(0))).(string),
 		},
 	}
+	// only include the relay flag when it is set, to avoid older peers logging
+	// about an unrecognized attribute for every member
+	if relay {
+		ret.attributes[MemberIsRelay] = string(byte(1))
+	}
+	return ret
 }
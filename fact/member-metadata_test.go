@@ -124,6 +124,14 @@ func TestMemberMetadata_MarshalBinary(t *testing.T) {
 			[][]byte{nil},
 			assert.Error,
 		},
+		{
+			"invalid relay value",
+			fields{map[MemberAttribute]string{
+				MemberIsRelay: "\x02",
+			}},
+			[][]byte{nil},
+			assert.Error,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -305,6 +313,7 @@ func TestBuildMemberMetadata(t *testing.T) {
 	type args struct {
 		name  string
 		basic bool
+		relay bool
 	}
 	tests := []struct {
 		name string
@@ -313,7 +322,7 @@ func TestBuildMemberMetadata(t *testing.T) {
 	}{
 		{
 			"named and not basic",
-			args{"foo", false},
+			args{"foo", false, false},
 			&MemberMetadata{map[MemberAttribute]string{
 				MemberName:    "foo",
 				MemberIsBasic: string([]byte{0}),
@@ -321,16 +330,25 @@ func TestBuildMemberMetadata(t *testing.T) {
 		},
 		{
 			"named and basic",
-			args{"foo", true},
+			args{"foo", true, false},
 			&MemberMetadata{map[MemberAttribute]string{
 				MemberName:    "foo",
 				MemberIsBasic: string([]byte{1}),
 			}},
 		},
+		{
+			"named and relay",
+			args{"foo", false, true},
+			&MemberMetadata{map[MemberAttribute]string{
+				MemberName:    "foo",
+				MemberIsBasic: string([]byte{0}),
+				MemberIsRelay: string([]byte{1}),
+			}},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			assert.Equal(t, tt.want, BuildMemberMetadata(tt.args.name, tt.args.basic))
+			assert.Equal(t, tt.want, BuildMemberMetadata(tt.args.name, tt.args.basic, tt.args.relay))
 		})
 	}
 }
@@ -340,8 +358,9 @@ func TestMemberMetadata_Equality(t *testing.T) {
 	for i := 0; i < 50; i++ {
 		name := fmt.Sprintf("foo%d", i)
 		basic := i%2 == 0
-		mm1 := BuildMemberMetadata(name, basic)
-		mm2 := BuildMemberMetadata(name, basic)
+		relay := i%3 == 0
+		mm1 := BuildMemberMetadata(name, basic, relay)
+		mm2 := BuildMemberMetadata(name, basic, relay)
 
 		require.Equal(t, mm1, mm2)
 
@@ -14,6 +14,8 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/fastcat/wirelink/internal/testutils"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 func TestParseSignedGroup_Trivial(t *testing.T) {
@@ -162,3 +164,125 @@ func TestParseSignedGroup_Inner(t *testing.T) {
 		}
 	}
 }
+
+func TestUDPPayloadForMTU(t *testing.T) {
+	tests := []struct {
+		name string
+		mtu  int
+		want int
+	}{
+		{"unknown", 0, UDPMaxSafePayload},
+		{"ipv6 minimum", 1280, 1232},
+		{"wireguard default", 1420, 1372},
+		{"jumbo", 65535, UDPMaxPayload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, UDPPayloadForMTU(tt.mtu))
+		})
+	}
+	assert.Equal(t, SignedGroupMaxSafeInnerLength, SignedGroupMaxInnerLength(UDPMaxSafePayload))
+}
+
+func TestSignedGroupValue_ParseInnerWithEncoding(t *testing.T) {
+	now := time.Now()
+	k1 := testutils.MustKey(t)
+	a1, p1 := mustMockAlivePacket(t, &k1, nil)
+	a2, p2 := mustMockAlivePacket(t, &k1, nil)
+	a3, p3 := mustMockAlivePacket(t, nil, nil)
+	header := append([]byte{byte(AttributeSubjectGroup)}, k1[:]...)
+	// the facts in a subject group leave out the subject
+	tuple := func(p []byte) []byte {
+		return append(append([]byte{}, p[:2]...), p[2+wgtypes.KeyLen:]...)
+	}
+	concat := func(parts ...[]byte) []byte {
+		var ret []byte
+		for _, p := range parts {
+			ret = append(ret, p...)
+		}
+		return ret
+	}
+
+	tests := []struct {
+		name        string
+		inner       []byte
+		want        []*Fact
+		wantCompact bool
+		wantErr     bool
+	}{
+		{
+			"standard",
+			concat(p1, p2),
+			[]*Fact{a1, a2},
+			false,
+			false,
+		},
+		{
+			"compact",
+			concat(header, []byte{2}, tuple(p1), tuple(p2)),
+			[]*Fact{a1, a2},
+			true,
+			false,
+		},
+		{
+			"mixed",
+			concat(p3, header, []byte{1}, tuple(p1), p2),
+			[]*Fact{a3, a1, a2},
+			true,
+			false,
+		},
+		{
+			"empty subject group",
+			concat(header, []byte{0}),
+			nil,
+			true,
+			false,
+		},
+		{
+			"truncated subject group",
+			concat(header, []byte{2}, tuple(p1)),
+			[]*Fact{},
+			true,
+			true,
+		},
+		{
+			"missing count",
+			header,
+			[]*Fact{},
+			true,
+			true,
+		},
+		{
+			"nested signed group",
+			concat(header, []byte{1, byte(AttributeSignedGroup), 0}, k1[:]),
+			[]*Fact{},
+			true,
+			true,
+		},
+		{
+			"nested subject group",
+			concat(header, []byte{1}, header, []byte{0}),
+			[]*Fact{},
+			true,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sgv := &SignedGroupValue{InnerBytes: tt.inner}
+			got, compact, err := sgv.ParseInnerWithEncoding(now)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+			} else {
+				require.Nil(t, err)
+			}
+			assert.Equal(t, tt.wantCompact, compact)
+			require.Len(t, got, len(tt.want))
+			for i, f := range got {
+				assert.Equal(t, tt.want[i].Attribute, f.Attribute)
+				assert.Equal(t, tt.want[i].Subject, f.Subject)
+				assert.Equal(t, tt.want[i].Value, f.Value)
+			}
+		})
+	}
+}
@@ -54,6 +54,84 @@ var decodeHints map[Attribute]decodeHinter = map[Attribute]decodeHinter{
 		return 0
 	},
 
+	AttributeEchoRequest: func(f *Fact) int {
+		f.Subject = &PeerSubject{}
+		f.Value = &EchoValue{}
+		return echoValueLen
+	},
+	AttributeEchoReply: func(f *Fact) int {
+		f.Subject = &PeerSubject{}
+		f.Value = &EchoValue{}
+		return echoValueLen
+	},
+
+	AttributePathProbe: func(f *Fact) int {
+		f.Subject = &PeerSubject{}
+		f.Value = &PathProbeValue{}
+		// the padding is length prefixed
+		return 0
+	},
+	AttributePathProbeReply: func(f *Fact) int {
+		f.Subject = &PeerSubject{}
+		f.Value = &PathProbeValue{}
+		return 0
+	},
+
+	AttributeReachRequest: func(f *Fact) int {
+		f.Subject = &PeerSubject{}
+		f.Value = &ReachValue{}
+		return reachValueLen
+	},
+	AttributeReachReply: func(f *Fact) int {
+		f.Subject = &PeerSubject{}
+		f.Value = &ReachValue{}
+		return reachValueLen
+	},
+
+	AttributeAck: func(f *Fact) int {
+		f.Subject = &PeerSubject{}
+		f.Value = &AckValue{}
+		return ackValueLen
+	},
+
+	AttributeDigest: func(f *Fact) int {
+		f.Subject = &PeerSubject{}
+		f.Value = &DigestValue{}
+		return digestLen
+	},
+
+	AttributeGossip: func(f *Fact) int {
+		f.Subject = &PeerSubject{}
+		f.Value = &GossipValue{}
+		return gossipValueLen
+	},
+
+	AttributeRoster: func(f *Fact) int {
+		f.Subject = &PeerSubject{}
+		f.Value = &RosterValue{}
+		// the value is length prefixed
+		return 0
+	},
+
+	AttributeJoinRequest: func(f *Fact) int {
+		f.Subject = &PeerSubject{}
+		f.Value = &JoinValue{}
+		// the value is length prefixed
+		return 0
+	},
+
+	AttributeSuccessor: func(f *Fact) int {
+		f.Subject = &PeerSubject{}
+		f.Value = &SuccessorValue{}
+		return successorValueLen
+	},
+
+	AttributeVote: func(f *Fact) int {
+		f.Subject = &PeerSubject{}
+		f.Value = &VoteValue{}
+		return voteValueLen
+	},
+
 	AttributeSignedGroup: func(f *Fact) int {
 		f.Subject = &PeerSubject{}
 		f.Value = &SignedGroupValue{}
@@ -70,6 +148,12 @@ func (f *Fact) DecodeFrom(lengthHint int, now time.Time, reader io.Reader) error
 	if buf, ok = reader.(*bytes.Buffer); !ok {
 		return errors.Errorf("Reading Fact is only supported from a Buffer, not a %T", reader)
 	}
+	return f.decode(now, buf, nil)
+}
+
+// decode reads a Fact from the buffer. If subject is not nil, the fact is in a
+// subject group, and so has no subject of its own on the wire.
+func (f *Fact) decode(now time.Time, buf *bytes.Buffer, subject *PeerSubject) error {
 	var err error
 
 	attrByte, err := buf.ReadByte()
@@ -98,9 +182,17 @@ func (f *Fact) DecodeFrom(lengthHint int, now time.Time, reader io.Reader) error
 	}
 	valueLength := hinter(f)
 
-	err = f.Subject.DecodeFrom(0, buf)
-	if err != nil {
-		return errors.Wrapf(err, "Failed to unmarshal fact subject from packet for %v", f.Attribute)
+	if subject != nil {
+		ps, ok := f.Subject.(*PeerSubject)
+		if !ok {
+			return errors.Errorf("Attribute %v cannot be in a subject group", f.Attribute)
+		}
+		*ps = *subject
+	} else {
+		err = f.Subject.DecodeFrom(0, buf)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to unmarshal fact subject from packet for %v", f.Attribute)
+		}
 	}
 	err = f.Value.DecodeFrom(valueLength, buf)
 	if err != nil {
@@ -216,6 +216,284 @@ func TestParseMember(t *testing.T) {
 	assert.IsType(t, &EmptyValue{}, f.Value)
 }
 
+func TestParseEcho(t *testing.T) {
+	now := time.Now()
+
+	key := testutils.MustKey(t)
+	ev := &EchoValue{
+		Sequence: rand.Uint32(),
+		Sent:     now.Add(-time.Duration(rand.Intn(1000)) * time.Millisecond),
+	}
+
+	for _, attr := range []Attribute{AttributeEchoRequest, AttributeEchoReply} {
+		_, p := mustSerialize(t, &Fact{
+			Attribute: attr,
+			Expires:   time.Time{},
+			Subject:   &PeerSubject{Key: key},
+			Value:     ev,
+		})
+
+		f := mustDeserialize(t, p, now)
+
+		assert.Equal(t, attr, f.Attribute)
+
+		if assert.IsType(t, &PeerSubject{}, f.Subject) {
+			assert.Equal(t, key, f.Subject.(*PeerSubject).Key)
+		}
+
+		if assert.IsType(t, &EchoValue{}, f.Value) {
+			assert.Equal(t, ev.Sequence, f.Value.(*EchoValue).Sequence)
+			// monotonic clock info is lost on the wire
+			assert.True(t, ev.Sent.Equal(f.Value.(*EchoValue).Sent))
+		}
+	}
+}
+
+func TestParsePathProbe(t *testing.T) {
+	now := time.Now()
+
+	key := testutils.MustKey(t)
+	tests := []struct {
+		name string
+		attr Attribute
+		pv   *PathProbeValue
+	}{
+		{"request", AttributePathProbe, &PathProbeValue{Size: 1400, Padding: make([]byte, 1300)}},
+		{"large request", AttributePathProbe, &PathProbeValue{Size: UDPMaxPayload, Padding: make([]byte, UDPMaxPayload-100)}},
+		{"reply", AttributePathProbeReply, &PathProbeValue{Size: 1400}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, p := mustSerialize(t, &Fact{
+				Attribute: tt.attr,
+				Expires:   time.Time{},
+				Subject:   &PeerSubject{Key: key},
+				Value:     tt.pv,
+			})
+
+			f := mustDeserialize(t, p, now)
+
+			assert.Equal(t, tt.attr, f.Attribute)
+			if assert.IsType(t, &PeerSubject{}, f.Subject) {
+				assert.Equal(t, key, f.Subject.(*PeerSubject).Key)
+			}
+			assert.Equal(t, tt.pv, f.Value)
+		})
+	}
+}
+
+func TestParseAck(t *testing.T) {
+	now := time.Now()
+
+	key := testutils.MustKey(t)
+	av := &AckValue{}
+	_, err := rand.Read(av.Nonce[:])
+	require.Nil(t, err)
+
+	_, p := mustSerialize(t, &Fact{
+		Attribute: AttributeAck,
+		Expires:   time.Time{},
+		Subject:   &PeerSubject{Key: key},
+		Value:     av,
+	})
+
+	f := mustDeserialize(t, p, now)
+
+	assert.Equal(t, AttributeAck, f.Attribute)
+
+	if assert.IsType(t, &PeerSubject{}, f.Subject) {
+		assert.Equal(t, key, f.Subject.(*PeerSubject).Key)
+	}
+
+	if assert.IsType(t, &AckValue{}, f.Value) {
+		assert.Equal(t, av.Nonce, f.Value.(*AckValue).Nonce)
+	}
+}
+
+func TestParseDigest(t *testing.T) {
+	now := time.Now()
+
+	key := testutils.MustKey(t)
+	dv := &DigestValue{}
+	_, err := rand.Read(dv.Hash[:])
+	require.Nil(t, err)
+
+	_, p := mustSerialize(t, &Fact{
+		Attribute: AttributeDigest,
+		Expires:   time.Time{},
+		Subject:   &PeerSubject{Key: key},
+		Value:     dv,
+	})
+
+	f := mustDeserialize(t, p, now)
+
+	assert.Equal(t, AttributeDigest, f.Attribute)
+
+	if assert.IsType(t, &PeerSubject{}, f.Subject) {
+		assert.Equal(t, key, f.Subject.(*PeerSubject).Key)
+	}
+
+	if assert.IsType(t, &DigestValue{}, f.Value) {
+		assert.Equal(t, dv.Hash, f.Value.(*DigestValue).Hash)
+	}
+}
+
+func TestParseGossip(t *testing.T) {
+	now := time.Now()
+
+	key := testutils.MustKey(t)
+	gv := &GossipValue{Hops: uint8(rand.Intn(256))}
+
+	_, p := mustSerialize(t, &Fact{
+		Attribute: AttributeGossip,
+		Expires:   time.Time{},
+		Subject:   &PeerSubject{Key: key},
+		Value:     gv,
+	})
+
+	f := mustDeserialize(t, p, now)
+
+	assert.Equal(t, AttributeGossip, f.Attribute)
+
+	if assert.IsType(t, &PeerSubject{}, f.Subject) {
+		assert.Equal(t, key, f.Subject.(*PeerSubject).Key)
+	}
+
+	assert.Equal(t, gv, f.Value)
+}
+
+func TestParseRoster(t *testing.T) {
+	now := time.Now()
+
+	key := testutils.MustKey(t)
+	rv := &RosterValue{Data: testutils.MustRandBytes(t, make([]byte, 200))}
+
+	_, p := mustSerialize(t, &Fact{
+		Attribute: AttributeRoster,
+		Expires:   now.Add(time.Minute),
+		Subject:   &PeerSubject{Key: key},
+		Value:     rv,
+	})
+
+	f := mustDeserialize(t, p, now)
+
+	assert.Equal(t, AttributeRoster, f.Attribute)
+
+	if assert.IsType(t, &PeerSubject{}, f.Subject) {
+		assert.Equal(t, key, f.Subject.(*PeerSubject).Key)
+	}
+
+	assert.Equal(t, rv, f.Value)
+}
+
+func TestParseJoinRequest(t *testing.T) {
+	now := time.Now()
+
+	key := testutils.MustKey(t)
+	jv := &JoinValue{Data: []byte("token.proof")}
+
+	_, p := mustSerialize(t, &Fact{
+		Attribute: AttributeJoinRequest,
+		Expires:   now.Add(time.Minute),
+		Subject:   &PeerSubject{Key: key},
+		Value:     jv,
+	})
+
+	f := mustDeserialize(t, p, now)
+
+	assert.Equal(t, AttributeJoinRequest, f.Attribute)
+
+	if assert.IsType(t, &PeerSubject{}, f.Subject) {
+		assert.Equal(t, key, f.Subject.(*PeerSubject).Key)
+	}
+
+	assert.Equal(t, jv, f.Value)
+}
+
+func TestParseSuccessor(t *testing.T) {
+	now := time.Now()
+
+	key := testutils.MustKey(t)
+	sv := &SuccessorValue{Key: testutils.MustKey(t)}
+
+	_, p := mustSerialize(t, &Fact{
+		Attribute: AttributeSuccessor,
+		Expires:   now.Add(time.Minute),
+		Subject:   &PeerSubject{Key: key},
+		Value:     sv,
+	})
+
+	f := mustDeserialize(t, p, now)
+
+	assert.Equal(t, AttributeSuccessor, f.Attribute)
+
+	if assert.IsType(t, &PeerSubject{}, f.Subject) {
+		assert.Equal(t, key, f.Subject.(*PeerSubject).Key)
+	}
+
+	assert.Equal(t, sv, f.Value)
+}
+
+func TestParseVote(t *testing.T) {
+	now := time.Now()
+
+	key := testutils.MustKey(t)
+	vv := &VoteValue{Key: testutils.MustKey(t)}
+
+	_, p := mustSerialize(t, &Fact{
+		Attribute: AttributeVote,
+		Expires:   now.Add(time.Minute),
+		Subject:   &PeerSubject{Key: key},
+		Value:     vv,
+	})
+
+	f := mustDeserialize(t, p, now)
+
+	assert.Equal(t, AttributeVote, f.Attribute)
+
+	if assert.IsType(t, &PeerSubject{}, f.Subject) {
+		assert.Equal(t, key, f.Subject.(*PeerSubject).Key)
+	}
+
+	assert.Equal(t, vv, f.Value)
+}
+
+func TestParseReach(t *testing.T) {
+	now := time.Now()
+
+	key := testutils.MustKey(t)
+	target := testutils.MustKey(t)
+
+	tests := []struct {
+		name string
+		attr Attribute
+		rv   *ReachValue
+	}{
+		{"request", AttributeReachRequest, &ReachValue{Target: target}},
+		{"unmeasured reply", AttributeReachReply, &ReachValue{Target: target}},
+		{"measured reply", AttributeReachReply, &ReachValue{Target: target, Measured: true, RTT: 1500 * time.Microsecond, Loss: 0.25}},
+		{"perfect reply", AttributeReachReply, &ReachValue{Target: target, Measured: true, RTT: time.Millisecond}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, p := mustSerialize(t, &Fact{
+				Attribute: tt.attr,
+				Expires:   now.Add(time.Minute),
+				Subject:   &PeerSubject{Key: key},
+				Value:     tt.rv,
+			})
+
+			f := mustDeserialize(t, p, now)
+
+			assert.Equal(t, tt.attr, f.Attribute)
+			if assert.IsType(t, &PeerSubject{}, f.Subject) {
+				assert.Equal(t, key, f.Subject.(*PeerSubject).Key)
+			}
+			assert.Equal(t, tt.rv, f.Value)
+		})
+	}
+}
+
 func TestFact_DecodeFrom(t *testing.T) {
 	now := time.Now()
 
@@ -0,0 +1,174 @@
+package fact
+
+import (
+	"sort"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// SourceKind identifies the general type of a Source
+type SourceKind byte
+
+const (
+	// SourceLocal is for facts derived from the local device and network
+	SourceLocal SourceKind = iota + 1
+	// SourceConfig is for facts derived from the static config
+	SourceConfig
+	// SourcePeer is for facts received from another peer
+	SourcePeer
+)
+
+// Source identifies where a fact came from
+type Source struct {
+	Kind SourceKind
+	// Peer is the key of the peer that sent the fact, for SourcePeer
+	Peer wgtypes.Key
+}
+
+// LocalSource is the Source for facts derived from the local device
+var LocalSource = Source{Kind: SourceLocal}
+
+// ConfigSource is the Source for facts derived from the static config
+var ConfigSource = Source{Kind: SourceConfig}
+
+// PeerSource returns the Source for facts received from the given peer
+func PeerSource(peer wgtypes.Key) Source {
+	return Source{Kind: SourcePeer, Peer: peer}
+}
+
+// IsLocal checks if the source is the local device or the static config
+func (s Source) IsLocal() bool {
+	return s.Kind == SourceLocal || s.Kind == SourceConfig
+}
+
+func (s Source) String() string {
+	switch s.Kind {
+	case SourceLocal:
+		return "local"
+	case SourceConfig:
+		return "config"
+	case SourcePeer:
+		return s.Peer.String()
+	default:
+		return "unknown"
+	}
+}
+
+// SourceExpiry is a Source along with when its assertion of a fact expires
+type SourceExpiry struct {
+	Source  Source
+	Expires time.Time
+}
+
+// Provenance tracks which sources have asserted each fact in a set, and until
+// when. Facts are matched by their Key, so the same fact from different
+// sources, with different expiration times, is tracked as one entry.
+type Provenance map[Key]map[Source]time.Time
+
+// Add records that the source asserted the fact, keeping the later expiration
+// if it was already recorded
+func (p Provenance) Add(f *Fact, source Source) {
+	key := KeyOf(f)
+	sources, ok := p[key]
+	if !ok {
+		sources = make(map[Source]time.Time)
+		p[key] = sources
+	}
+	if prev, ok := sources[source]; !ok || f.Expires.After(prev) {
+		sources[source] = f.Expires
+	}
+}
+
+// Remove forgets that the source asserted the fact
+func (p Provenance) Remove(f *Fact, source Source) {
+	key := KeyOf(f)
+	if sources, ok := p[key]; ok {
+		delete(sources, source)
+		if len(sources) == 0 {
+			delete(p, key)
+		}
+	}
+}
+
+// Sources returns the sources that have asserted the fact, sorted with local
+// sources first, and then by peer key
+func (p Provenance) Sources(f *Fact) []SourceExpiry {
+	sources := p[KeyOf(f)]
+	if len(sources) == 0 {
+		return nil
+	}
+	ret := make([]SourceExpiry, 0, len(sources))
+	for s, e := range sources {
+		ret = append(ret, SourceExpiry{s, e})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Source.Kind != ret[j].Source.Kind {
+			return ret[i].Source.Kind < ret[j].Source.Kind
+		}
+		return ret[i].Source.Peer.String() < ret[j].Source.Peer.String()
+	})
+	return ret
+}
+
+// Expires returns the latest expiration of any source for the fact, and
+// whether there were any
+func (p Provenance) Expires(f *Fact) (ret time.Time, ok bool) {
+	for _, e := range p[KeyOf(f)] {
+		if !ok || e.After(ret) {
+			ret = e
+			ok = true
+		}
+	}
+	return
+}
+
+// Expire removes any sources whose assertions have expired
+func (p Provenance) Expire(now time.Time) {
+	for key, sources := range p {
+		for s, e := range sources {
+			if !now.Before(e) {
+				delete(sources, s)
+			}
+		}
+		if len(sources) == 0 {
+			delete(p, key)
+		}
+	}
+}
+
+// Trim removes the provenance for any facts not in the list
+func (p Provenance) Trim(facts []*Fact) {
+	keep := make(map[Key]bool, len(facts))
+	for _, f := range facts {
+		keep[KeyOf(f)] = true
+	}
+	for key := range p {
+		if !keep[key] {
+			delete(p, key)
+		}
+	}
+}
+
+// Merge adds all the sources from other into p
+func (p Provenance) Merge(other Provenance) {
+	for key, sources := range other {
+		mine, ok := p[key]
+		if !ok {
+			mine = make(map[Source]time.Time, len(sources))
+			p[key] = mine
+		}
+		for s, e := range sources {
+			if prev, ok := mine[s]; !ok || e.After(prev) {
+				mine[s] = e
+			}
+		}
+	}
+}
+
+// Clone makes a deep copy of the Provenance, which is safe to call on nil
+func (p Provenance) Clone() Provenance {
+	ret := make(Provenance, len(p))
+	ret.Merge(p)
+	return ret
+}
@@ -0,0 +1,84 @@
+package fact
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/internal/testutils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSource_String(t *testing.T) {
+	key := testutils.MustKey(t)
+	assert.Equal(t, "local", LocalSource.String())
+	assert.Equal(t, "config", ConfigSource.String())
+	assert.Equal(t, key.String(), PeerSource(key).String())
+	assert.Equal(t, "unknown", Source{}.String())
+	assert.True(t, LocalSource.IsLocal())
+	assert.True(t, ConfigSource.IsLocal())
+	assert.False(t, PeerSource(key).IsLocal())
+}
+
+func TestProvenance(t *testing.T) {
+	now := time.Now()
+	subject := testutils.MustKey(t)
+	peer1 := testutils.MustKey(t)
+	peer2 := testutils.MustKey(t)
+	makeFact := func(port int, expires time.Time) *Fact {
+		return &Fact{
+			Attribute: AttributeEndpointV4,
+			Subject:   &PeerSubject{Key: subject},
+			Value:     &IPPortValue{IP: net.IPv4(192, 0, 2, 1), Port: port},
+			Expires:   expires,
+		}
+	}
+	f1 := makeFact(1, now.Add(time.Minute))
+	f2 := makeFact(2, now.Add(time.Minute))
+
+	var nilProv Provenance
+	assert.Nil(t, nilProv.Sources(f1))
+	_, ok := nilProv.Expires(f1)
+	assert.False(t, ok)
+	nilProv.Remove(f1, LocalSource)
+	assert.Equal(t, Provenance{}, nilProv.Clone())
+
+	p := make(Provenance)
+	p.Add(f1, PeerSource(peer1))
+	p.Add(makeFact(1, now.Add(2*time.Minute)), PeerSource(peer2))
+	p.Add(f1, LocalSource)
+	// earlier expiration from the same source doesn't replace a later one
+	p.Add(makeFact(1, now.Add(time.Second)), LocalSource)
+	p.Add(f2, ConfigSource)
+
+	sources := p.Sources(f1)
+	if assert.Len(t, sources, 3) {
+		assert.Equal(t, SourceExpiry{LocalSource, now.Add(time.Minute)}, sources[0])
+		assert.ElementsMatch(t, []SourceExpiry{
+			{PeerSource(peer1), now.Add(time.Minute)},
+			{PeerSource(peer2), now.Add(2 * time.Minute)},
+		}, sources[1:])
+	}
+	expires, ok := p.Expires(f1)
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(2*time.Minute), expires)
+
+	clone := p.Clone()
+	assert.Equal(t, p, clone)
+	clone.Remove(f1, LocalSource)
+	assert.Len(t, p.Sources(f1), 3, "clone should be deep")
+	assert.Len(t, clone.Sources(f1), 2)
+
+	p.Expire(now.Add(90 * time.Second))
+	assert.Equal(t, []SourceExpiry{{PeerSource(peer2), now.Add(2 * time.Minute)}}, p.Sources(f1))
+	assert.Nil(t, p.Sources(f2))
+	assert.Len(t, p, 1)
+
+	clone.Trim([]*Fact{f2})
+	assert.Nil(t, clone.Sources(f1))
+	assert.Len(t, clone.Sources(f2), 1)
+
+	clone.Remove(f2, ConfigSource)
+	assert.Empty(t, clone)
+}
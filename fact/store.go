@@ -0,0 +1,281 @@
+package fact
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/fastcat/wirelink/util"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// ChangeKind identifies how a fact in a Store changed
+type ChangeKind int
+
+const (
+	// ChangeAdded is for a fact that was not previously in the store
+	ChangeAdded ChangeKind = iota + 1
+	// ChangeRenewed is for a fact that was already in the store, whose
+	// expiration time changed
+	ChangeRenewed
+	// ChangeExpired is for a fact that was removed from the store because it
+	// expired
+	ChangeExpired
+	// ChangeRemoved is for a fact that was explicitly removed from the store
+	// before it expired
+	ChangeRemoved
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeAdded:
+		return "added"
+	case ChangeRenewed:
+		return "renewed"
+	case ChangeExpired:
+		return "expired"
+	case ChangeRemoved:
+		return "removed"
+	default:
+		return "unknown"
+	}
+}
+
+// Change is a notification of a change to a fact in a Store. For renewals,
+// Fact is the new version, and for removals it is the last version that was in
+// the store.
+type Change struct {
+	Kind ChangeKind
+	Fact *Fact
+}
+
+// storeEntry is a fact in a Store, along with its bookkeeping
+type storeEntry struct {
+	key  Key
+	fact *Fact
+	// index is the position of the entry in the expiration heap
+	index int
+}
+
+// expirationHeap is a min-heap of store entries by expiration time
+type expirationHeap []*storeEntry
+
+func (h expirationHeap) Len() int { return len(h) }
+func (h expirationHeap) Less(i, j int) bool {
+	return h[i].fact.Expires.Before(h[j].fact.Expires)
+}
+func (h expirationHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *expirationHeap) Push(x interface{}) {
+	e := x.(*storeEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *expirationHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.index = -1
+	*h = old[:n-1]
+	return e
+}
+
+// Store holds a set of facts, keeping only the latest expiration for each
+// unique fact, indexed by subject and attribute, and tracking the changes made
+// to it so that consumers can process them incrementally instead of comparing
+// whole fact sets.
+//
+// A Store is not safe for concurrent use.
+type Store struct {
+	entries     map[Key]*storeEntry
+	bySubject   map[string]map[Key]*storeEntry
+	byAttribute map[Attribute]map[Key]*storeEntry
+	expirations expirationHeap
+	changes     []Change
+}
+
+// NewStore creates a new, empty, Store
+func NewStore() *Store {
+	return &Store{
+		entries:     make(map[Key]*storeEntry),
+		bySubject:   make(map[string]map[Key]*storeEntry),
+		byAttribute: make(map[Attribute]map[Key]*storeEntry),
+	}
+}
+
+// Len returns the number of facts in the store
+func (s *Store) Len() int {
+	return len(s.entries)
+}
+
+// Get returns the stored version of the given fact, if any
+func (s *Store) Get(f *Fact) (*Fact, bool) {
+	e, ok := s.entries[KeyOf(f)]
+	if !ok {
+		return nil, false
+	}
+	return e.fact, true
+}
+
+// Upsert adds the fact to the store, or renews the stored version if the new
+// one expires later, returning whether the store changed
+func (s *Store) Upsert(f *Fact) bool {
+	key := KeyOf(f)
+	e, ok := s.entries[key]
+	if !ok {
+		s.add(key, f)
+		return true
+	}
+	if !e.fact.Expires.Before(f.Expires) {
+		return false
+	}
+	s.update(e, f)
+	return true
+}
+
+// Replace puts the fact in the store, even if the stored version expires
+// later, returning whether the store changed
+func (s *Store) Replace(f *Fact) bool {
+	key := KeyOf(f)
+	e, ok := s.entries[key]
+	if !ok {
+		s.add(key, f)
+		return true
+	}
+	if e.fact.Expires.Equal(f.Expires) {
+		// still replace the value, as alive facts may differ in that despite
+		// having the same key
+		e.fact = f
+		return false
+	}
+	s.update(e, f)
+	return true
+}
+
+// Remove removes the fact from the store, returning whether it was present
+func (s *Store) Remove(f *Fact) bool {
+	e, ok := s.entries[KeyOf(f)]
+	if !ok {
+		return false
+	}
+	heap.Remove(&s.expirations, e.index)
+	s.unindex(e)
+	s.changes = append(s.changes, Change{ChangeRemoved, e.fact})
+	return true
+}
+
+// Expire removes all facts that have expired as of the given time, returning
+// how many were removed
+func (s *Store) Expire(now time.Time) int {
+	count := 0
+	for len(s.expirations) > 0 && !now.Before(s.expirations[0].fact.Expires) {
+		e := heap.Pop(&s.expirations).(*storeEntry)
+		s.unindex(e)
+		s.changes = append(s.changes, Change{ChangeExpired, e.fact})
+		count++
+	}
+	return count
+}
+
+// Facts returns all the facts in the store, in no particular order
+func (s *Store) Facts() []*Fact {
+	ret := make([]*Fact, 0, len(s.entries))
+	for _, e := range s.entries {
+		ret = append(ret, e.fact)
+	}
+	return ret
+}
+
+// BySubject returns all the facts in the store with the given subject, in no
+// particular order
+func (s *Store) BySubject(subject Subject) []*Fact {
+	return collect(s.bySubject[subjectKey(subject)])
+}
+
+// ByAttribute returns all the facts in the store with the given attribute, in
+// no particular order
+func (s *Store) ByAttribute(attr Attribute) []*Fact {
+	return collect(s.byAttribute[attr])
+}
+
+// GroupByPeer returns the facts in the store grouped by the key of their
+// PeerSubject. Facts with other subject types are left out.
+func (s *Store) GroupByPeer() map[wgtypes.Key][]*Fact {
+	ret := make(map[wgtypes.Key][]*Fact, len(s.bySubject))
+	for _, entries := range s.bySubject {
+		for _, e := range entries {
+			if ps, ok := e.fact.Subject.(*PeerSubject); ok {
+				ret[ps.Key] = collect(entries)
+			}
+			// all the entries have the same subject
+			break
+		}
+	}
+	return ret
+}
+
+// Changes returns the changes made to the store since the last call, in the
+// order they happened
+func (s *Store) Changes() []Change {
+	ret := s.changes
+	s.changes = nil
+	return ret
+}
+
+func (s *Store) add(key Key, f *Fact) {
+	e := &storeEntry{key: key, fact: f}
+	s.entries[key] = e
+	bySubject, ok := s.bySubject[key.subject]
+	if !ok {
+		bySubject = make(map[Key]*storeEntry)
+		s.bySubject[key.subject] = bySubject
+	}
+	bySubject[key] = e
+	byAttribute, ok := s.byAttribute[key.attribute]
+	if !ok {
+		byAttribute = make(map[Key]*storeEntry)
+		s.byAttribute[key.attribute] = byAttribute
+	}
+	byAttribute[key] = e
+	heap.Push(&s.expirations, e)
+	s.changes = append(s.changes, Change{ChangeAdded, f})
+}
+
+func (s *Store) update(e *storeEntry, f *Fact) {
+	e.fact = f
+	heap.Fix(&s.expirations, e.index)
+	s.changes = append(s.changes, Change{ChangeRenewed, f})
+}
+
+func (s *Store) unindex(e *storeEntry) {
+	delete(s.entries, e.key)
+	if m := s.bySubject[e.key.subject]; m != nil {
+		delete(m, e.key)
+		if len(m) == 0 {
+			delete(s.bySubject, e.key.subject)
+		}
+	}
+	if m := s.byAttribute[e.key.attribute]; m != nil {
+		delete(m, e.key)
+		if len(m) == 0 {
+			delete(s.byAttribute, e.key.attribute)
+		}
+	}
+}
+
+// subjectKey converts a subject to the form used in Key
+func subjectKey(subject Subject) string {
+	return string(util.MustBytes(subject.MarshalBinary()))
+}
+
+func collect(entries map[Key]*storeEntry) []*Fact {
+	ret := make([]*Fact, 0, len(entries))
+	for _, e := range entries {
+		ret = append(ret, e.fact)
+	}
+	return ret
+}
@@ -0,0 +1,149 @@
+package fact
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/internal/testutils"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	now := time.Now()
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	ep := func(k wgtypes.Key, port int, expires time.Duration) *Fact {
+		return &Fact{
+			Attribute: AttributeEndpointV4,
+			Subject:   &PeerSubject{Key: k},
+			Value:     &IPPortValue{IP: net.IPv4(127, 0, 0, 1), Port: port},
+			Expires:   now.Add(expires),
+		}
+	}
+	aip := func(k wgtypes.Key, expires time.Duration) *Fact {
+		return &Fact{
+			Attribute: AttributeAllowedCidrV4,
+			Subject:   &PeerSubject{Key: k},
+			Value:     &IPNetValue{IPNet: net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(32, 32)}},
+			Expires:   now.Add(expires),
+		}
+	}
+
+	s := NewStore()
+	assert.Zero(t, s.Len())
+	assert.Empty(t, s.Changes())
+
+	ep1 := ep(k1, 1, 3*time.Second)
+	ep1Early := ep(k1, 1, time.Second)
+	ep1Late := ep(k1, 1, 5*time.Second)
+	ep2 := ep(k1, 2, 2*time.Second)
+	aip1 := aip(k1, 4*time.Second)
+	aip2 := aip(k2, 6*time.Second)
+
+	assert.True(t, s.Upsert(ep1))
+	assert.False(t, s.Upsert(ep1Early), "should keep the later expiration")
+	assert.True(t, s.Upsert(ep2))
+	assert.True(t, s.Upsert(aip1))
+	assert.True(t, s.Upsert(aip2))
+	assert.Equal(t, 4, s.Len())
+	assert.Equal(t, []Change{
+		{ChangeAdded, ep1},
+		{ChangeAdded, ep2},
+		{ChangeAdded, aip1},
+		{ChangeAdded, aip2},
+	}, s.Changes())
+	assert.Empty(t, s.Changes(), "changes should only be returned once")
+
+	got, ok := s.Get(ep(k1, 1, 0))
+	assert.True(t, ok)
+	assert.Same(t, ep1, got)
+	_, ok = s.Get(ep(k2, 1, 0))
+	assert.False(t, ok)
+
+	assert.ElementsMatch(t, []*Fact{ep1, ep2, aip1, aip2}, s.Facts())
+	assert.ElementsMatch(t, []*Fact{ep1, ep2, aip1}, s.BySubject(&PeerSubject{Key: k1}))
+	assert.ElementsMatch(t, []*Fact{aip2}, s.BySubject(&PeerSubject{Key: k2}))
+	assert.ElementsMatch(t, []*Fact{aip1, aip2}, s.ByAttribute(AttributeAllowedCidrV4))
+	assert.Empty(t, s.ByAttribute(AttributeAlive))
+	grouped := s.GroupByPeer()
+	assert.Len(t, grouped, 2)
+	assert.ElementsMatch(t, []*Fact{ep1, ep2, aip1}, grouped[k1])
+	assert.ElementsMatch(t, []*Fact{aip2}, grouped[k2])
+
+	// renewing moves the fact later in the expiration order
+	assert.True(t, s.Upsert(ep1Late))
+	assert.Equal(t, []Change{{ChangeRenewed, ep1Late}}, s.Changes())
+
+	// replacing can shorten the expiration
+	assert.True(t, s.Replace(ep1Early))
+	assert.False(t, s.Replace(ep1Early))
+	assert.Equal(t, []Change{{ChangeRenewed, ep1Early}}, s.Changes())
+
+	assert.True(t, s.Remove(aip1))
+	assert.False(t, s.Remove(aip1))
+	assert.Equal(t, []Change{{ChangeRemoved, aip1}}, s.Changes())
+	assert.ElementsMatch(t, []*Fact{aip2}, s.ByAttribute(AttributeAllowedCidrV4))
+
+	// expiration is inclusive of the expiration time, and goes in order
+	assert.Zero(t, s.Expire(now))
+	assert.Equal(t, 2, s.Expire(ep2.Expires))
+	assert.Equal(t, []Change{{ChangeExpired, ep1Early}, {ChangeExpired, ep2}}, s.Changes())
+	assert.Empty(t, s.BySubject(&PeerSubject{Key: k1}))
+	assert.NotContains(t, s.bySubject, subjectKey(&PeerSubject{Key: k1}), "should clean up empty indexes")
+
+	assert.Equal(t, 1, s.Expire(now.Add(time.Hour)))
+	assert.Zero(t, s.Len())
+	require.Empty(t, s.expirations)
+	assert.Empty(t, s.byAttribute)
+}
+
+func TestStore_heapOrder(t *testing.T) {
+	now := time.Now()
+	k := testutils.MustKey(t)
+	s := NewStore()
+	// insert in a scrambled order, and renew some, to exercise the heap
+	for i, offset := range []int{7, 3, 9, 1, 5, 8, 2, 6, 4} {
+		s.Upsert(&Fact{
+			Attribute: AttributeEndpointV4,
+			Subject:   &PeerSubject{Key: k},
+			Value:     &IPPortValue{IP: net.IPv4(127, 0, 0, 1), Port: i},
+			Expires:   now.Add(time.Duration(offset) * time.Second),
+		})
+	}
+	s.Upsert(&Fact{
+		Attribute: AttributeEndpointV4,
+		Subject:   &PeerSubject{Key: k},
+		Value:     &IPPortValue{IP: net.IPv4(127, 0, 0, 1), Port: 3},
+		Expires:   now.Add(10 * time.Second),
+	})
+	s.Changes()
+
+	var last time.Time
+	for i := 1; i <= 10; i++ {
+		n := s.Expire(now.Add(time.Duration(i) * time.Second))
+		if i == 1 {
+			// port 3 was renewed from 1s to 10s
+			assert.Zero(t, n)
+			continue
+		}
+		assert.Equal(t, 1, n, "at %ds", i)
+		for _, c := range s.Changes() {
+			assert.False(t, c.Fact.Expires.Before(last))
+			last = c.Fact.Expires
+		}
+	}
+	assert.Zero(t, s.Len())
+}
+
+func TestChangeKind_String(t *testing.T) {
+	assert.Equal(t, "added", ChangeAdded.String())
+	assert.Equal(t, "renewed", ChangeRenewed.String())
+	assert.Equal(t, "expired", ChangeExpired.String())
+	assert.Equal(t, "removed", ChangeRemoved.String())
+	assert.Equal(t, "unknown", ChangeKind(0).String())
+}
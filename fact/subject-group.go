@@ -0,0 +1,50 @@
+package fact
+
+import (
+	"bytes"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// subjectGroupHeaderLen is the length of the marker, subject, and fact count
+// at the start of a subject group
+const subjectGroupHeaderLen = 1 + wgtypes.KeyLen + 1
+
+// subjectGroupMaxFacts is the most facts that can be put in one subject group
+const subjectGroupMaxFacts = math.MaxUint8
+
+// appendSubjectGroupHeader appends the start of a subject group with a single
+// fact to the data, returning the new data and the offset of the fact count
+func appendSubjectGroupHeader(data []byte, subject *PeerSubject) ([]byte, int) {
+	data = append(data, byte(AttributeSubjectGroup))
+	data = append(data, subject.Key[:]...)
+	return append(data, 1), len(data)
+}
+
+// decodeSubjectGroup reads the facts in a subject group, after its marker
+func decodeSubjectGroup(now time.Time, buf *bytes.Buffer) ([]*Fact, error) {
+	subject := &PeerSubject{}
+	if err := subject.DecodeFrom(0, buf); err != nil {
+		return nil, errors.Wrap(err, "Unable to read subject group subject")
+	}
+	count, err := buf.ReadByte()
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read subject group length")
+	}
+	ret := make([]*Fact, 0, count)
+	for i := 0; i < int(count); i++ {
+		if buf.Len() != 0 && buf.Bytes()[0] == byte(AttributeSignedGroup) {
+			return nil, errors.Errorf("SignedGroups must not be nested at subject group #%d", i)
+		}
+		next := &Fact{}
+		if err := next.decode(now, buf, subject); err != nil {
+			return nil, errors.Wrapf(err, "Unable to decode subject group #%d", i)
+		}
+		ret = append(ret, next)
+	}
+	return ret, nil
+}
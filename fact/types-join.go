@@ -0,0 +1,27 @@
+package fact
+
+import "io"
+
+// JoinValue is the proof of a join token sent in a join request. Like a
+// roster page, it is opaque at this level.
+type JoinValue struct {
+	Data []byte
+}
+
+// JoinValue must implement Value
+var _ Value = &JoinValue{}
+
+// MarshalBinary implements BinaryMarshaler
+func (jv *JoinValue) MarshalBinary() ([]byte, error) {
+	return marshalLengthPrefixed(jv.Data, "join token")
+}
+
+// DecodeFrom implements Decodable
+func (jv *JoinValue) DecodeFrom(lengthHint int, reader io.Reader) (err error) {
+	jv.Data, err = decodeLengthPrefixed(reader, "join token")
+	return
+}
+
+func (jv *JoinValue) String() string {
+	return "join token"
+}
@@ -0,0 +1,47 @@
+package fact
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// PathProbeValue is the payload size being tested by a path probe, along with
+// the padding that makes the probe packet that size. Replies have no padding.
+type PathProbeValue struct {
+	Size    uint16
+	Padding []byte
+}
+
+// PathProbeValue must implement Value
+var _ Value = &PathProbeValue{}
+
+// MarshalBinary implements BinaryMarshaler
+func (pv *PathProbeValue) MarshalBinary() ([]byte, error) {
+	padding, err := marshalLengthPrefixed(pv.Padding, "path probe padding")
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]byte, 2, 2+len(padding))
+	binary.BigEndian.PutUint16(ret, pv.Size)
+	return append(ret, padding...), nil
+}
+
+// DecodeFrom implements Decodable
+func (pv *PathProbeValue) DecodeFrom(lengthHint int, reader io.Reader) (err error) {
+	var sizeBytes [2]byte
+	if _, err = io.ReadFull(reader, sizeBytes[:]); err != nil {
+		return errors.Wrap(err, "Unable to read path probe size")
+	}
+	pv.Size = binary.BigEndian.Uint16(sizeBytes[:])
+	if pv.Padding, err = decodeLengthPrefixed(reader, "path probe padding"); len(pv.Padding) == 0 {
+		pv.Padding = nil
+	}
+	return
+}
+
+func (pv *PathProbeValue) String() string {
+	return fmt.Sprintf("path probe %d (%d padding)", pv.Size, len(pv.Padding))
+}
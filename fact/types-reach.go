@@ -0,0 +1,84 @@
+package fact
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/fastcat/wirelink/util"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// target key + rtt micros + loss per-mille
+const reachValueLen = wgtypes.KeyLen + 4 + 2
+
+// reachUnmeasured is the loss value sent when the link has not been measured
+const reachUnmeasured = math.MaxUint16
+
+// ReachValue is the payload of a reach request or reply. Requests only use the
+// Target, replies also carry the quality of the replying peer's link to it.
+type ReachValue struct {
+	Target wgtypes.Key
+	// Measured is false if the replying peer has no link quality data
+	Measured bool
+	RTT      time.Duration
+	// Loss is the fraction of probes lost, from 0 to 1
+	Loss float64
+}
+
+// ReachValue must implement Value
+var _ Value = &ReachValue{}
+
+// MarshalBinary implements BinaryMarshaler
+func (rv *ReachValue) MarshalBinary() ([]byte, error) {
+	ret := make([]byte, reachValueLen)
+	copy(ret, rv.Target[:])
+	rtt := rv.RTT / time.Microsecond
+	if rtt > math.MaxUint32 {
+		rtt = math.MaxUint32
+	} else if rtt < 0 {
+		rtt = 0
+	}
+	binary.BigEndian.PutUint32(ret[wgtypes.KeyLen:], uint32(rtt))
+	loss := uint16(reachUnmeasured)
+	if rv.Measured {
+		loss = uint16(math.Round(math.Max(0, math.Min(1, rv.Loss)) * 1000))
+	}
+	binary.BigEndian.PutUint16(ret[wgtypes.KeyLen+4:], loss)
+	return ret, nil
+}
+
+// UnmarshalBinary implements BinaryUnmarshaler
+func (rv *ReachValue) UnmarshalBinary(data []byte) error {
+	if len(data) != reachValueLen {
+		return errors.Errorf("reach value should be %d bytes, not %d", reachValueLen, len(data))
+	}
+	copy(rv.Target[:], data)
+	rv.RTT = time.Duration(binary.BigEndian.Uint32(data[wgtypes.KeyLen:])) * time.Microsecond
+	loss := binary.BigEndian.Uint16(data[wgtypes.KeyLen+4:])
+	if loss == reachUnmeasured {
+		rv.Measured, rv.Loss = false, 0
+	} else if loss > 1000 {
+		return errors.Errorf("reach value has invalid loss %d", loss)
+	} else {
+		rv.Measured, rv.Loss = true, float64(loss)/1000
+	}
+	return nil
+}
+
+// DecodeFrom implements Decodable
+func (rv *ReachValue) DecodeFrom(lengthHint int, reader io.Reader) error {
+	return util.DecodeFrom(rv, reachValueLen, reader)
+}
+
+func (rv *ReachValue) String() string {
+	if !rv.Measured {
+		return "reach " + rv.Target.String()
+	}
+	return fmt.Sprintf("reach %s rtt %v loss %.1f%%", rv.Target, rv.RTT, rv.Loss*100)
+}
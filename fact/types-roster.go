@@ -0,0 +1,64 @@
+package fact
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// RosterValue is the signed data for a page of a membership roster. It is
+// opaque at this level: parsing and verifying it is done by the roster
+// package.
+type RosterValue struct {
+	Data []byte
+}
+
+// RosterValue must implement Value
+var _ Value = &RosterValue{}
+
+// MarshalBinary implements BinaryMarshaler
+func (rv *RosterValue) MarshalBinary() ([]byte, error) {
+	return marshalLengthPrefixed(rv.Data, "roster page")
+}
+
+// DecodeFrom implements Decodable
+func (rv *RosterValue) DecodeFrom(lengthHint int, reader io.Reader) (err error) {
+	rv.Data, err = decodeLengthPrefixed(reader, "roster page")
+	return
+}
+
+// marshalLengthPrefixed encodes opaque data with a uvarint length prefix
+func marshalLengthPrefixed(data []byte, what string) ([]byte, error) {
+	ret := make([]byte, binary.MaxVarintLen16, binary.MaxVarintLen16+len(data))
+	l := binary.PutUvarint(ret, uint64(len(data)))
+	if l > binary.MaxVarintLen16 {
+		return nil, errors.Errorf("%s length overflow: %d > 65535", what, len(data))
+	}
+	return append(ret[:l], data...), nil
+}
+
+// decodeLengthPrefixed reads the opaque data written by marshalLengthPrefixed
+func decodeLengthPrefixed(reader io.Reader, what string) ([]byte, error) {
+	var br io.ByteReader
+	var ok bool
+	if br, ok = reader.(io.ByteReader); !ok {
+		return nil, errors.New("Cannot decode without a ByteReader")
+	}
+	dataLen, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to read %s length", what)
+	} else if dataLen > UDPMaxPayload {
+		return nil, errors.Errorf("%s length too long: %d", what, dataLen)
+	}
+	data := make([]byte, dataLen)
+	if n, err := io.ReadFull(reader, data); err != nil {
+		return nil, errors.Wrapf(err, "Unable to read %s, got %d of %d bytes", what, n, dataLen)
+	}
+	return data, nil
+}
+
+func (rv *RosterValue) String() string {
+	return fmt.Sprintf("roster page (%d bytes)", len(rv.Data))
+}
@@ -33,6 +33,28 @@ const sgvOverhead = chacha20poly1305.NonceSizeX + poly1305.TagSize
 // we only need to worry about IPv6 for this
 const UDPMaxSafePayload = 1212
 
+// ipv6UDPOverhead is the IPv6 and UDP header size, which is what we need to
+// subtract from the interface MTU to get the UDP payload size
+const ipv6UDPOverhead = 40 + 8
+
+// UDPMaxPayload is the largest payload size of a UDP packet we will send, if
+// the path to a peer is shown to support it, which fits a tunnel over jumbo
+// frames. Packets up to this size are accepted from peers.
+const UDPMaxPayload = 9000 - ipv6UDPOverhead
+
+// UDPPayloadForMTU computes the largest UDP payload that can be sent through
+// an interface with the given MTU, limited to UDPMaxPayload. If the MTU is not
+// known, it returns UDPMaxSafePayload.
+func UDPPayloadForMTU(mtu int) int {
+	if mtu <= ipv6UDPOverhead {
+		return UDPMaxSafePayload
+	}
+	if payload := mtu - ipv6UDPOverhead; payload < UDPMaxPayload {
+		return payload
+	}
+	return UDPMaxPayload
+}
+
 // attribute + ttl varint worst case + subject (key) length
 const sgvFactOverhead = 1 + binary.MaxVarintLen16 + wgtypes.KeyLen
 
@@ -41,6 +63,12 @@ const sgvFactOverhead = 1 + binary.MaxVarintLen16 + wgtypes.KeyLen
 // on the max safe UDP payload for IPv6, minus the fact & crypto overheads.
 const SignedGroupMaxSafeInnerLength = UDPMaxSafePayload - sgvFactOverhead - sgvOverhead
 
+// SignedGroupMaxInnerLength is the maximum length for `InnerBytes` that will
+// fit in a UDP packet with the given payload size
+func SignedGroupMaxInnerLength(payload int) int {
+	return payload - sgvFactOverhead - sgvOverhead
+}
+
 // MarshalBinary gives the on-wire form of the value
 func (sgv *SignedGroupValue) MarshalBinary() ([]byte, error) {
 	ret := make([]byte, 0, len(sgv.Nonce)+len(sgv.Tag)+len(sgv.InnerBytes))
@@ -79,12 +107,30 @@ func (sgv *SignedGroupValue) DecodeFrom(lengthHint int, reader io.Reader) error
 // Validating the signature must be done separately, and should be done before
 // calling this method.
 func (sgv *SignedGroupValue) ParseInner(now time.Time) (ret []*Fact, err error) {
+	ret, _, err = sgv.ParseInnerWithEncoding(now)
+	return
+}
+
+// ParseInnerWithEncoding is like ParseInner, but also returns whether the group
+// used the compact encoding, where facts are put in subject groups.
+func (sgv *SignedGroupValue) ParseInnerWithEncoding(now time.Time) (ret []*Fact, compact bool, err error) {
 	buf := bytes.NewBuffer(sgv.InnerBytes)
 	for buf.Len() != 0 {
 		// TODO: bytes[0] or readbyte/unreadbyte?
-		if buf.Bytes()[0] == byte(AttributeSignedGroup) {
+		switch Attribute(buf.Bytes()[0]) {
+		case AttributeSignedGroup:
 			err = errors.Errorf("SignedGroups must not be nested at #%d @%d", len(ret), buf.Len()-len(sgv.InnerBytes))
 			return
+		case AttributeSubjectGroup:
+			compact = true
+			buf.Next(1)
+			var group []*Fact
+			if group, err = decodeSubjectGroup(now, buf); err != nil {
+				err = errors.Wrapf(err, "Unable to decode SignedGroupValue inner #%d @%d", len(ret), buf.Len()-len(sgv.InnerBytes))
+				return
+			}
+			ret = append(ret, group...)
+			continue
 		}
 		next := &Fact{}
 		if err = next.DecodeFrom(0, now, buf); err != nil {
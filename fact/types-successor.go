@@ -0,0 +1,44 @@
+package fact
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/fastcat/wirelink/util"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const successorValueLen = wgtypes.KeyLen
+
+// SuccessorValue is the new key that replaces the subject's key
+type SuccessorValue struct {
+	wgtypes.Key
+}
+
+// SuccessorValue must implement Value
+var _ Value = &SuccessorValue{}
+
+// MarshalBinary implements BinaryMarshaler
+func (sv *SuccessorValue) MarshalBinary() ([]byte, error) {
+	return sv.Key[:], nil
+}
+
+// UnmarshalBinary implements BinaryUnmarshaler
+func (sv *SuccessorValue) UnmarshalBinary(data []byte) error {
+	if len(data) != successorValueLen {
+		return errors.Errorf("data len wrong for successor value")
+	}
+	copy(sv.Key[:], data)
+	return nil
+}
+
+// DecodeFrom implements Decodable
+func (sv *SuccessorValue) DecodeFrom(lengthHint int, reader io.Reader) error {
+	return util.DecodeFrom(sv, successorValueLen, reader)
+}
+
+func (sv *SuccessorValue) String() string {
+	return "succeeded by " + sv.Key.String()
+}
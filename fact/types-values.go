@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 
+	"golang.org/x/crypto/chacha20poly1305"
+
 	"github.com/fastcat/wirelink/util"
 )
 
@@ -151,3 +154,111 @@ func (u *UUIDValue) DecodeFrom(lengthHint int, reader io.Reader) error {
 }
 
 // UUIDValue inherits its String(er) from UUID
+
+// EchoValue is the payload of an echo request or reply, identifying the probe
+// and when it was sent. Replies echo back the value from the request.
+type EchoValue struct {
+	Sequence uint32
+	Sent     time.Time
+}
+
+// sequence number + unix nanos timestamp
+const echoValueLen = 4 + 8
+
+// EchoValue must implement Value
+var _ Value = &EchoValue{}
+
+// MarshalBinary implements BinaryMarshaler
+func (ev *EchoValue) MarshalBinary() ([]byte, error) {
+	ret := make([]byte, echoValueLen)
+	binary.BigEndian.PutUint32(ret, ev.Sequence)
+	binary.BigEndian.PutUint64(ret[4:], uint64(ev.Sent.UnixNano()))
+	return ret, nil
+}
+
+// UnmarshalBinary implements BinaryUnmarshaler
+func (ev *EchoValue) UnmarshalBinary(data []byte) error {
+	if len(data) != echoValueLen {
+		return errors.Errorf("echo value should be %d bytes, not %d", echoValueLen, len(data))
+	}
+	ev.Sequence = binary.BigEndian.Uint32(data)
+	ev.Sent = time.Unix(0, int64(binary.BigEndian.Uint64(data[4:])))
+	return nil
+}
+
+// DecodeFrom implements Decodable
+func (ev *EchoValue) DecodeFrom(lengthHint int, reader io.Reader) error {
+	return util.DecodeFrom(ev, echoValueLen, reader)
+}
+
+func (ev *EchoValue) String() string {
+	return fmt.Sprintf("#%d@%s", ev.Sequence, ev.Sent.Format(time.RFC3339Nano))
+}
+
+// AckValue is the payload of an ack, identifying the signed group being
+// acknowledged by its nonce.
+type AckValue struct {
+	Nonce [chacha20poly1305.NonceSizeX]byte
+}
+
+const ackValueLen = chacha20poly1305.NonceSizeX
+
+// AckValue must implement Value
+var _ Value = &AckValue{}
+
+// MarshalBinary implements BinaryMarshaler
+func (av *AckValue) MarshalBinary() ([]byte, error) {
+	return util.CloneBytes(av.Nonce[:]), nil
+}
+
+// UnmarshalBinary implements BinaryUnmarshaler
+func (av *AckValue) UnmarshalBinary(data []byte) error {
+	if len(data) != ackValueLen {
+		return errors.Errorf("ack value should be %d bytes, not %d", ackValueLen, len(data))
+	}
+	copy(av.Nonce[:], data)
+	return nil
+}
+
+// DecodeFrom implements Decodable
+func (av *AckValue) DecodeFrom(lengthHint int, reader io.Reader) error {
+	return util.DecodeFrom(av, ackValueLen, reader)
+}
+
+func (av *AckValue) String() string {
+	return fmt.Sprintf("%x", av.Nonce[:])
+}
+
+// GossipValue is the payload of a gossip marker, saying how many hops the facts
+// that follow it have traveled from where they were first learned.
+type GossipValue struct {
+	Hops uint8
+}
+
+const gossipValueLen = 1
+
+// GossipValue must implement Value
+var _ Value = &GossipValue{}
+
+// MarshalBinary implements BinaryMarshaler
+func (gv *GossipValue) MarshalBinary() ([]byte, error) {
+	return []byte{gv.Hops}, nil
+}
+
+// UnmarshalBinary implements BinaryUnmarshaler
+func (gv *GossipValue) UnmarshalBinary(data []byte) error {
+	if len(data) != gossipValueLen {
+		return errors.Errorf("gossip value should be %d bytes, not %d", gossipValueLen, len(data))
+	}
+	gv.Hops = data[0]
+	return nil
+}
+
+// DecodeFrom implements Decodable
+func (gv *GossipValue) DecodeFrom(lengthHint int, reader io.Reader) error {
+	return util.DecodeFrom(gv, gossipValueLen, reader)
+}
+
+func (gv *GossipValue) String() string {
+	return fmt.Sprintf("%d hops", gv.Hops)
+}
@@ -0,0 +1,44 @@
+package fact
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/fastcat/wirelink/util"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const voteValueLen = wgtypes.KeyLen
+
+// VoteValue is the key of the peer that the subject votes to be a member
+type VoteValue struct {
+	wgtypes.Key
+}
+
+// VoteValue must implement Value
+var _ Value = &VoteValue{}
+
+// MarshalBinary implements BinaryMarshaler
+func (vv *VoteValue) MarshalBinary() ([]byte, error) {
+	return vv.Key[:], nil
+}
+
+// UnmarshalBinary implements BinaryUnmarshaler
+func (vv *VoteValue) UnmarshalBinary(data []byte) error {
+	if len(data) != voteValueLen {
+		return errors.Errorf("data len wrong for vote value")
+	}
+	copy(vv.Key[:], data)
+	return nil
+}
+
+// DecodeFrom implements Decodable
+func (vv *VoteValue) DecodeFrom(lengthHint int, reader io.Reader) error {
+	return util.DecodeFrom(vv, voteValueLen, reader)
+}
+
+func (vv *VoteValue) String() string {
+	return "votes for " + vv.Key.String()
+}
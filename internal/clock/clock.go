@@ -0,0 +1,51 @@
+// Package clock abstracts reading the current time and waiting for time to
+// pass, so that tests and simulations can control time instead of waiting for
+// it.
+package clock
+
+import "time"
+
+// Clock is a source of the current time and of tickers
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+	// Since returns the time elapsed since t
+	Since(t time.Time) time.Duration
+	// NewTicker returns a Ticker that ticks every d, which must be positive
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks at regular intervals, like time.Ticker
+type Ticker interface {
+	// Chan returns the channel on which the ticks are delivered
+	Chan() <-chan time.Time
+	// Stop turns off the ticker, it does not close the channel
+	Stop()
+}
+
+// Real is the Clock that uses the system time
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                  { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration { return time.Since(t) }
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) Chan() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()                  { t.t.Stop() }
+
+// Or returns c if it is not nil, or else Real, so that structs that are
+// created without a clock will use the system time
+func Or(c Clock) Clock {
+	if c == nil {
+		return Real
+	}
+	return c
+}
@@ -0,0 +1,30 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOr(t *testing.T) {
+	assert.Equal(t, Real, Or(nil))
+	f := NewFake(time.Now())
+	assert.Equal(t, f, Or(f))
+}
+
+func TestReal(t *testing.T) {
+	before := time.Now()
+	now := Real.Now()
+	assert.False(t, now.Before(before))
+	assert.True(t, Real.Since(before) >= 0)
+
+	ticker := Real.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	select {
+	case tick := <-ticker.Chan():
+		assert.True(t, tick.After(before))
+	case <-time.After(time.Second):
+		assert.Fail(t, "ticker didn't tick")
+	}
+}
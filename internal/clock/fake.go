@@ -0,0 +1,219 @@
+package clock
+
+import (
+	"bytes"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Fake is a Clock whose time only changes when it is told to, so that tests
+// can simulate long periods of time quickly and deterministically.
+// It is safe for concurrent use.
+type Fake struct {
+	m       sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+var _ Clock = &Fake{}
+
+// NewFake creates a Fake clock that starts at the given time
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now implements Clock
+func (f *Fake) Now() time.Time {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.now
+}
+
+// Since implements Clock
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+// NewTicker implements Clock
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	t := &fakeTicker{
+		f:      f,
+		c:      make(chan time.Time, 1),
+		period: d,
+		next:   f.now.Add(d),
+	}
+	f.tickers = append(f.tickers, t)
+	return t
+}
+
+// Tickers returns how many tickers are running, so that tests can wait for
+// the code under test to start its tickers before advancing the clock
+func (f *Fake) Tickers() int {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return len(f.tickers)
+}
+
+// Advance moves the clock forwards by d, firing any tickers that come due
+// along the way in time order. Like time.Ticker, ticks are dropped if the
+// previous one has not been received yet.
+func (f *Fake) Advance(d time.Duration) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	target := f.now.Add(d)
+	for f._tick(target) {
+	}
+	f.now = target
+}
+
+// AdvanceWhenIdle moves the clock forwards by d like Advance, but fires one
+// tick at a time, and before each one, and at the end, waits up to timeout
+// (in real time) for the process to go idle, see WaitIdle. It returns false if
+// it didn't go idle in time, leaving the clock where it got to.
+func (f *Fake) AdvanceWhenIdle(d time.Duration, timeout time.Duration) bool {
+	f.m.Lock()
+	target := f.now.Add(d)
+	f.m.Unlock()
+	for {
+		if !f.WaitIdle(timeout) {
+			return false
+		}
+		f.m.Lock()
+		ticked := f._tick(target)
+		if !ticked {
+			f.now = target
+		}
+		f.m.Unlock()
+		if !ticked {
+			return f.WaitIdle(timeout)
+		}
+	}
+}
+
+// _tick fires the next ticker that is due no later than target, if any,
+// moving the clock to its time. It must be called with the lock held.
+func (f *Fake) _tick(target time.Time) bool {
+	var next *fakeTicker
+	for _, t := range f.tickers {
+		if !t.next.After(target) && (next == nil || t.next.Before(next.next)) {
+			next = t
+		}
+	}
+	if next == nil {
+		return false
+	}
+	f.now = next.next
+	select {
+	case next.c <- f.now:
+	default:
+	}
+	next.next = next.next.Add(next.period)
+	return true
+}
+
+// idlePollPeriod is how often WaitIdle checks whether the process is idle
+const idlePollPeriod = 100 * time.Microsecond
+
+// WaitIdle waits up to timeout (in real time) for every other goroutine in the
+// process to be blocked, such as on a channel or in a select, returning
+// whether they were. Once they are, nothing more will happen until the clock
+// is advanced, or something outside the process happens.
+func (f *Fake) WaitIdle(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	var buf []byte
+	for {
+		buf = stacks(buf)
+		if allBlocked(buf) {
+			return true
+		}
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(idlePollPeriod)
+	}
+}
+
+// stacks gets the stacks of all the goroutines, reusing buf if it is big
+// enough
+func stacks(buf []byte) []byte {
+	if len(buf) == 0 {
+		buf = make([]byte, 64*1024)
+	}
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// blockedStates are the goroutine states in a stack dump that wait for another
+// goroutine, rather than running or being about to run
+var blockedStates = map[string]bool{
+	"chan receive":            true,
+	"chan receive (nil chan)": true,
+	"chan send":               true,
+	"chan send (nil chan)":    true,
+	"select":                  true,
+	"select (no cases)":       true,
+	"sync.Cond.Wait":          true,
+	"sync.WaitGroup.Wait":     true,
+	"IO wait":                 true,
+	"finalizer wait":          true,
+}
+
+// allBlocked checks whether every goroutine in a dump from runtime.Stack is in
+// one of the blockedStates, except the first, which is the one that took it
+func allBlocked(dump []byte) bool {
+	stanzas := bytes.Split(dump, []byte("\n\n"))
+	for _, g := range stanzas[1:] {
+		// each stanza starts with a line like
+		// "goroutine 1 [chan receive, 5 minutes]:"
+		start := bytes.IndexByte(g, '[')
+		end := bytes.IndexByte(g, ']')
+		if start < 0 || end < start {
+			return false
+		}
+		state := g[start+1 : end]
+		if i := bytes.IndexByte(state, ','); i >= 0 {
+			state = state[:i]
+		}
+		if !blockedStates[string(state)] && !waitingForSignal(string(state), g) {
+			return false
+		}
+	}
+	return true
+}
+
+// waitingForSignal checks whether a goroutine is the one os/signal runs to wait
+// for signals, which the runtime reports as being in a syscall
+func waitingForSignal(state string, stack []byte) bool {
+	return state == "syscall" && bytes.Contains(stack, []byte("\nos/signal.signal_recv("))
+}
+
+type fakeTicker struct {
+	f      *Fake
+	c      chan time.Time
+	period time.Duration
+	next   time.Time
+}
+
+func (t *fakeTicker) Chan() <-chan time.Time { return t.c }
+
+func (t *fakeTicker) Stop() {
+	t.f.m.Lock()
+	defer t.f.m.Unlock()
+	for i, o := range t.f.tickers {
+		if o == t {
+			t.f.tickers = append(t.f.tickers[:i], t.f.tickers[i+1:]...)
+			return
+		}
+	}
+}
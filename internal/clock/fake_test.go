@@ -0,0 +1,142 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func drain(c <-chan time.Time) []time.Time {
+	var ret []time.Time
+	for {
+		select {
+		case t := <-c:
+			ret = append(ret, t)
+		default:
+			return ret
+		}
+	}
+}
+
+func TestFake(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+	assert.Equal(t, start, f.Now())
+
+	f.Advance(time.Hour)
+	assert.Equal(t, start.Add(time.Hour), f.Now())
+	assert.Equal(t, time.Hour, f.Since(start))
+
+	assert.Panics(t, func() { f.NewTicker(0) })
+	t1 := f.NewTicker(10 * time.Second)
+	t2 := f.NewTicker(15 * time.Second)
+	assert.Equal(t, 2, f.Tickers())
+	base := f.Now()
+
+	f.Advance(9 * time.Second)
+	assert.Empty(t, drain(t1.Chan()))
+	assert.Empty(t, drain(t2.Chan()))
+
+	f.Advance(time.Second)
+	assert.Equal(t, []time.Time{base.Add(10 * time.Second)}, drain(t1.Chan()))
+	assert.Empty(t, drain(t2.Chan()))
+
+	// ticks are dropped if they aren't received, keeping the first
+	f.Advance(time.Minute)
+	assert.Equal(t, []time.Time{base.Add(20 * time.Second)}, drain(t1.Chan()))
+	assert.Equal(t, []time.Time{base.Add(15 * time.Second)}, drain(t2.Chan()))
+	assert.Equal(t, base.Add(70*time.Second), f.Now())
+
+	t1.Stop()
+	assert.Equal(t, 1, f.Tickers())
+	f.Advance(20 * time.Second)
+	assert.Empty(t, drain(t1.Chan()))
+	assert.Equal(t, []time.Time{base.Add(75 * time.Second)}, drain(t2.Chan()))
+	t2.Stop()
+	assert.Zero(t, f.Tickers())
+}
+
+func TestFake_tickOrder(t *testing.T) {
+	f := NewFake(time.Time{})
+	fast := f.NewTicker(time.Second)
+	slow := f.NewTicker(3 * time.Second)
+	// receive ticks as they happen to check they are delivered in time order
+	var ticks []string
+	for i := 0; i < 6; i++ {
+		f.Advance(time.Second)
+		for range drain(fast.Chan()) {
+			ticks = append(ticks, "fast")
+		}
+		for range drain(slow.Chan()) {
+			ticks = append(ticks, "slow")
+		}
+	}
+	assert.Equal(t, []string{"fast", "fast", "fast", "slow", "fast", "fast", "fast", "slow"}, ticks)
+}
+
+func TestFake_WaitIdle(t *testing.T) {
+	f := NewFake(time.Time{})
+	assert.True(t, f.WaitIdle(0))
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+	}()
+	assert.False(t, f.WaitIdle(time.Millisecond))
+	close(stop)
+	<-done
+	assert.True(t, f.WaitIdle(time.Second))
+}
+
+func TestFake_AdvanceWhenIdle(t *testing.T) {
+	f := NewFake(time.Time{})
+	ticker := f.NewTicker(time.Second)
+	var ticks []time.Time
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			tick := <-ticker.Chan()
+			// hand some work off that someone else finishes
+			work := make(chan struct{})
+			go func() {
+				time.Sleep(time.Millisecond)
+				close(work)
+			}()
+			<-work
+			ticks = append(ticks, tick)
+		}
+	}()
+	// with no dropped ticks, every one is received
+	assert.True(t, f.AdvanceWhenIdle(3*time.Second, time.Second))
+	<-done
+	assert.Equal(t, []time.Time{
+		time.Time{}.Add(time.Second),
+		time.Time{}.Add(2 * time.Second),
+		time.Time{}.Add(3 * time.Second),
+	}, ticks)
+
+	// something that never blocks keeps it from advancing
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+	}()
+	assert.False(t, f.AdvanceWhenIdle(2*time.Second, time.Millisecond))
+	close(stop)
+	assert.Equal(t, time.Time{}.Add(3*time.Second), f.Now())
+}
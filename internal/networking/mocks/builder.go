@@ -59,6 +59,11 @@ func (i *Interface) WithAddrs(addrs ...net.IPNet) {
 	i.On("Addrs").Return(addrs, nil).Maybe()
 }
 
+// WithMTU mocks the interface to return the given MTU
+func (i *Interface) WithMTU(mtu int) {
+	i.On("MTU").Return(mtu).Maybe()
+}
+
 // WithSimpleInterfaces sets up a simple map of interface name to ip address
 func (_m *Environment) WithSimpleInterfaces(ifaces map[string]net.IPNet) map[string]*Interface {
 	ret := make(map[string]*Interface, len(ifaces))
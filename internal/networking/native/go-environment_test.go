@@ -73,6 +73,7 @@ func TestGoEnvironment_InterfaceByName(t *testing.T) {
 				require.NotNil(t, iface)
 				assert.Equal(t, iface.Name(), "lo")
 				assert.True(t, iface.IsUp())
+				assert.True(t, iface.MTU() > 0)
 			},
 		},
 		{
@@ -21,6 +21,11 @@ func (i *GoInterface) IsUp() bool {
 	return i.Flags&net.FlagUp == net.FlagUp
 }
 
+// MTU implements Interface, gets the MTU
+func (i *GoInterface) MTU() int {
+	return i.Interface.MTU
+}
+
 // Addrs implements Interface, looks up the IP addresses for the interface
 func (i *GoInterface) Addrs() ([]net.IPNet, error) {
 	addrs, err := i.Interface.Addrs()
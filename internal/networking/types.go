@@ -31,6 +31,8 @@ type Interface interface {
 	IsUp() bool
 	Addrs() ([]net.IPNet, error)
 	AddAddr(net.IPNet) error
+	// MTU gets the interface's MTU, or zero if it is not known
+	MTU() int
 }
 
 // UDPConn abstracts net.UDPConn
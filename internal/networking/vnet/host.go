@@ -16,6 +16,8 @@ type Host struct {
 
 	// host sockets are not listening on any specific interface
 	sockets map[string]*Socket
+
+	traffic *trafficCounter
 }
 
 // Name gets the Host's Name, AKA id
@@ -91,6 +93,7 @@ func (h *Host) DelInterface(name string) Interface {
 func (h *Host) AddSocket(a *net.UDPAddr) *Socket {
 	ret := &Socket{
 		m:      &sync.Mutex{},
+		host:   h,
 		sender: h,
 		addr:   a,
 	}
@@ -6,6 +6,13 @@ import (
 	"github.com/fastcat/wirelink/internal/networking"
 )
 
+// PhyMTU is the MTU of all physical interfaces in the virtual network
+const PhyMTU = 1500
+
+// TunnelMTU is the MTU of all tunnel interfaces in the virtual network, the
+// same as the wireguard default
+const TunnelMTU = 1420
+
 type wrappedPhy struct {
 	i *PhysicalInterface
 }
@@ -40,6 +47,11 @@ func (i *wrappedPhy) Addrs() ([]net.IPNet, error) {
 	return ret, nil
 }
 
+// MTU implements Interface
+func (i *wrappedPhy) MTU() int {
+	return PhyMTU
+}
+
 // AddAddr implements Interface
 func (i *wrappedPhy) AddAddr(addr net.IPNet) error {
 	i.i.AddAddr(addr)
@@ -80,6 +92,11 @@ func (t *wrappedTun) Addrs() ([]net.IPNet, error) {
 	return ret, nil
 }
 
+// MTU implements Interface
+func (t *wrappedTun) MTU() int {
+	return TunnelMTU
+}
+
 // AddAddr implements Interface
 func (t *wrappedTun) AddAddr(addr net.IPNet) error {
 	t.t.AddAddr(addr)
@@ -67,6 +67,7 @@ func (i *BaseInterface) AddAddr(a net.IPNet) {
 func (i *BaseInterface) AddSocket(a *net.UDPAddr) *Socket {
 	ret := &Socket{
 		m:      &sync.Mutex{},
+		host:   i.host,
 		sender: i.self,
 		addr:   a,
 	}
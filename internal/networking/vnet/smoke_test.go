@@ -3,7 +3,9 @@ package vnet
 import (
 	"net"
 	"testing"
+	"time"
 
+	"github.com/fastcat/wirelink/internal/clock"
 	"github.com/fastcat/wirelink/internal/testutils"
 
 	"github.com/stretchr/testify/assert"
@@ -148,6 +150,8 @@ func Test_Smoke_Direct(t *testing.T) {
 func Test_Smoke_Tunnel(t *testing.T) {
 	ss := initSmoke(t)
 	defer ss.Close()
+	fc := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	ss.w.UseClock(fc)
 
 	// verify host-to-host communication over "internet"
 	s1 := ss.host1wg0.AddSocket(&net.UDPAddr{
@@ -175,6 +179,8 @@ func Test_Smoke_Tunnel(t *testing.T) {
 		assert.Equal(t, len(payload), n)
 		assert.Equal(t, payload, readBuf[:len(payload)])
 		assert.Equal(t, &net.UDPAddr{IP: ss.host1wg0ip, Port: wgPort + 1}, addr)
+		// receive times come from the world's clock
+		assert.Equal(t, fc.Now(), ss.host2wg0p1.LastReceive())
 	}
 
 	// should fail to send if there's no peer with a matching AIP
@@ -232,6 +238,10 @@ func Test_Smoke_Wrap(t *testing.T) {
 		assert.Equal(t, len(payload), n)
 		assert.Equal(t, payload, readBuf[:len(payload)])
 		assert.Equal(t, &net.UDPAddr{IP: ss.host1wg0ip, Port: wgPort + 1}, addr)
+
+		// only the application traffic is counted, not the encapsulation
+		assert.Equal(t, TrafficStats{PacketsSent: 1, BytesSent: int64(len(payload))}, ss.host1.Traffic())
+		assert.Equal(t, TrafficStats{PacketsReceived: 1, BytesReceived: int64(len(payload))}, ss.host2.Traffic())
 	}
 }
 
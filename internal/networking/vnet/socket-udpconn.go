@@ -7,6 +7,7 @@ import (
 
 	"github.com/pkg/errors"
 
+	"github.com/fastcat/wirelink/internal/clock"
 	"github.com/fastcat/wirelink/internal/networking"
 	"github.com/fastcat/wirelink/util"
 )
@@ -15,6 +16,7 @@ import (
 type socketUDPConn struct {
 	s       *Socket
 	inbound chan *Packet
+	clock   clock.Clock
 }
 
 var _ networking.UDPConn = &socketUDPConn{}
@@ -23,9 +25,15 @@ var _ networking.UDPConn = &socketUDPConn{}
 // networking.UDPConn.
 func (s *Socket) Connect() networking.UDPConn {
 	ret := &socketUDPConn{
-		s: s,
-		// make this reasonably deep to avoid accidental deadlocks
-		inbound: make(chan *Packet, 10),
+		s:     s,
+		clock: clock.Real,
+		// make this reasonably deep to avoid accidental deadlocks, and so that
+		// busy hosts don't drop packets much sooner than a real socket buffer
+		// would
+		inbound: make(chan *Packet, 256),
+	}
+	if s.host != nil {
+		ret.clock = s.host.world.Clock()
 	}
 	rx := func(p *Packet) bool {
 		// TODO: can't find a way to avoid data races on the channel without
@@ -36,9 +44,20 @@ func (s *Socket) Connect() networking.UDPConn {
 			s.m.Unlock()
 			return false
 		}
-		ret.inbound <- p
-		s.m.Unlock()
-		return true
+		// like a real UDP socket, drop packets if the receive buffer is full,
+		// instead of blocking the sender, which may be the reader for another
+		// socket that we are in turn blocking
+		select {
+		case ret.inbound <- p:
+			s.m.Unlock()
+			if s.host != nil {
+				s.host.traffic.received(len(p.data))
+			}
+			return true
+		default:
+			s.m.Unlock()
+			return false
+		}
 	}
 	s.m.Lock()
 	s.rx = rx
@@ -109,6 +128,9 @@ func (sc *socketUDPConn) WriteToUDP(p []byte, addr *net.UDPAddr) (n int, err err
 	}
 	sent := sc.s.OutboundPacket(packet)
 	if sent {
+		if sc.s.host != nil {
+			sc.s.host.traffic.sent(len(p))
+		}
 		return len(p), nil
 	}
 	// TODO: dropped / un-routable packets shouldn't be an error
@@ -138,7 +160,7 @@ func (sc *socketUDPConn) ReadPackets(
 				return nil
 			}
 			output <- &networking.UDPPacket{
-				Time: time.Now(),
+				Time: sc.clock.Now(),
 				Addr: p.src,
 				Data: p.data,
 			}
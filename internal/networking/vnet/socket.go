@@ -9,6 +9,7 @@ import (
 // Packets
 type Socket struct {
 	m      *sync.Mutex
+	host   *Host
 	sender SocketOwner
 	addr   *net.UDPAddr
 	rx     func(*Packet) bool
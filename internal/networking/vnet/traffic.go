@@ -0,0 +1,46 @@
+package vnet
+
+import "sync"
+
+// TrafficStats counts the UDP traffic sent and received by sockets opened on a
+// Host through its networking.Environment, i.e. the traffic of the application
+// running on it, not including the encapsulation done by tunnels
+type TrafficStats struct {
+	PacketsSent     int64
+	BytesSent       int64
+	PacketsReceived int64
+	BytesReceived   int64
+}
+
+// trafficCounter accumulates TrafficStats safely across goroutines
+type trafficCounter struct {
+	m     sync.Mutex
+	stats TrafficStats
+}
+
+func (tc *trafficCounter) sent(bytes int) {
+	if tc == nil {
+		return
+	}
+	tc.m.Lock()
+	tc.stats.PacketsSent++
+	tc.stats.BytesSent += int64(bytes)
+	tc.m.Unlock()
+}
+
+func (tc *trafficCounter) received(bytes int) {
+	if tc == nil {
+		return
+	}
+	tc.m.Lock()
+	tc.stats.PacketsReceived++
+	tc.stats.BytesReceived += int64(bytes)
+	tc.m.Unlock()
+}
+
+// Traffic returns the traffic counts for the host so far
+func (h *Host) Traffic() TrafficStats {
+	h.traffic.m.Lock()
+	defer h.traffic.m.Unlock()
+	return h.traffic.stats
+}
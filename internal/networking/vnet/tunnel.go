@@ -190,7 +190,7 @@ func (t *Tunnel) receiveEncapsulated(p *Packet) bool {
 
 	// update the peer's source endpoint like wireguard does
 	srcPeer.endpoint = p.src
-	srcPeer.lastReceive = time.Now()
+	srcPeer.lastReceive = t.world.Clock().Now()
 	t.m.Unlock()
 
 	// try to deliver it to a socket
@@ -3,6 +3,8 @@ package vnet
 import (
 	"net"
 	"sync"
+
+	"github.com/fastcat/wirelink/internal/clock"
 )
 
 // A World represents a global set of networks, hosts, and their interfaces.
@@ -10,6 +12,7 @@ type World struct {
 	m        *sync.Mutex
 	networks map[string]*Network
 	hosts    map[string]*Host
+	clock    clock.Clock
 }
 
 // NewWorld initializes a new empty world to which hosts and networks can be
@@ -19,10 +22,27 @@ func NewWorld() *World {
 		m:        &sync.Mutex{},
 		networks: map[string]*Network{},
 		hosts:    map[string]*Host{},
+		clock:    clock.Real,
 	}
 	return ret
 }
 
+// UseClock replaces the source of time for the world, which is used for
+// handshake and packet receive times, so that simulations can control how
+// time passes. It should be called before any traffic is sent.
+func (w *World) UseClock(c clock.Clock) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	w.clock = c
+}
+
+// Clock returns the source of time for the world
+func (w *World) Clock() clock.Clock {
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.clock
+}
+
 // CreateNetwork creates and attaches a new Network with the given id to the
 // world
 func (w *World) CreateNetwork(id string) *Network {
@@ -51,6 +71,7 @@ func (w *World) CreateEmptyHost(id string) *Host {
 		world:      w,
 		interfaces: map[string]Interface{},
 		sockets:    map[string]*Socket{},
+		traffic:    &trafficCounter{},
 	}
 	// TODO: more host initialization
 	w.hosts[id] = ret
@@ -0,0 +1,219 @@
+// Package pcap reads and writes the UDP packets in classic pcap capture files,
+// as written by tcpdump, so that captured wirelink traffic can be inspected.
+// Only as much of the format as is needed for that is supported.
+package pcap
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	magicMicros        = 0xa1b2c3d4
+	magicNanos         = 0xa1b23c4d
+	globalHeaderLength = 24
+	recordHeaderLength = 16
+	udpHeaderLength    = 8
+	protocolUDP        = 17
+	// maxRecordLength is the largest record we will read, whatever the capture
+	// header says, so that a corrupt capture can't make us allocate gigabytes.
+	// It is the largest snaplen tcpdump uses.
+	maxRecordLength = 256 * 1024
+)
+
+// LinkType identifies the framing of the packets in a capture
+type LinkType uint32
+
+const (
+	// LinkTypeNull is the BSD loopback framing
+	LinkTypeNull LinkType = 0
+	// LinkTypeEthernet is ethernet framing
+	LinkTypeEthernet LinkType = 1
+	// LinkTypeRaw is bare IP packets, which is what is captured on wireguard
+	// interfaces
+	LinkTypeRaw LinkType = 101
+	// LinkTypeLinuxSLL is the Linux "cooked" framing used when capturing on the
+	// "any" interface
+	LinkTypeLinuxSLL LinkType = 113
+)
+
+// IsPcap checks if the data looks like the start of a pcap file
+func IsPcap(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(data) {
+		case magicMicros, magicNanos:
+			return true
+		}
+	}
+	return false
+}
+
+// Packet is a UDP packet read from a capture
+type Packet struct {
+	Time    time.Time
+	Src     *net.UDPAddr
+	Dst     *net.UDPAddr
+	Payload []byte
+}
+
+// Reader reads UDP packets from a pcap capture
+type Reader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	nanos    bool
+	linkType LinkType
+	// snapLen is the largest record length we accept
+	snapLen uint32
+}
+
+// NewReader creates a Reader, reading the capture header from r
+func NewReader(r io.Reader) (*Reader, error) {
+	var header [globalHeaderLength]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, errors.Wrap(err, "Unable to read pcap header")
+	}
+	ret := &Reader{r: r}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(header[:]) {
+		case magicMicros:
+			ret.order = order
+		case magicNanos:
+			ret.order = order
+			ret.nanos = true
+		}
+	}
+	if ret.order == nil {
+		return nil, errors.Errorf("Not a pcap file, bad magic %x", header[:4])
+	}
+	// some writers leave the snaplen zero
+	ret.snapLen = ret.order.Uint32(header[16:])
+	if ret.snapLen == 0 || ret.snapLen > maxRecordLength {
+		ret.snapLen = maxRecordLength
+	}
+	ret.linkType = LinkType(ret.order.Uint32(header[20:]))
+	switch ret.linkType {
+	case LinkTypeNull, LinkTypeEthernet, LinkTypeRaw, LinkTypeLinuxSLL:
+	default:
+		return nil, errors.Errorf("Unsupported pcap link type %d", ret.linkType)
+	}
+	return ret, nil
+}
+
+// Next returns the next UDP packet in the capture, skipping any other
+// packets, or io.EOF when there are no more
+func (r *Reader) Next() (*Packet, error) {
+	for {
+		var header [recordHeaderLength]byte
+		if _, err := io.ReadFull(r.r, header[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, errors.Wrap(err, "Truncated pcap record header")
+			}
+			return nil, err
+		}
+		sec := r.order.Uint32(header[0:])
+		frac := r.order.Uint32(header[4:])
+		capLen := r.order.Uint32(header[8:])
+		if capLen > r.snapLen {
+			return nil, errors.Errorf("Corrupt pcap record: length %d is more than the limit of %d", capLen, r.snapLen)
+		}
+		data := make([]byte, capLen)
+		if _, err := io.ReadFull(r.r, data); err != nil {
+			return nil, errors.Wrap(err, "Truncated pcap record")
+		}
+		if !r.nanos {
+			frac *= 1000
+		}
+		p, ok := parseUDP(r.linkType, data)
+		if !ok {
+			continue
+		}
+		p.Time = time.Unix(int64(sec), int64(frac))
+		return p, nil
+	}
+}
+
+// parseUDP unwraps the link and IP headers from a captured packet, returning
+// it if it is a complete UDP packet
+func parseUDP(linkType LinkType, data []byte) (*Packet, bool) {
+	switch linkType {
+	case LinkTypeNull:
+		// the address family is in the capturing host's byte order, but the IP
+		// version check below is enough to tell what follows
+		if len(data) < 4 {
+			return nil, false
+		}
+		data = data[4:]
+	case LinkTypeEthernet:
+		if len(data) < 14 {
+			return nil, false
+		}
+		etherType := binary.BigEndian.Uint16(data[12:])
+		data = data[14:]
+		// skip a VLAN tag
+		if etherType == 0x8100 && len(data) >= 4 {
+			data = data[4:]
+		}
+	case LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil, false
+		}
+		data = data[16:]
+	}
+	if len(data) < 1 {
+		return nil, false
+	}
+
+	var src, dst net.IP
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return nil, false
+		}
+		headerLen := int(data[0]&0xf) * 4
+		totalLen := int(binary.BigEndian.Uint16(data[2:]))
+		if data[9] != protocolUDP || headerLen < 20 || totalLen < headerLen || len(data) < totalLen {
+			return nil, false
+		}
+		// fragments other than the first one won't have a UDP header
+		if binary.BigEndian.Uint16(data[6:])&0x1fff != 0 {
+			return nil, false
+		}
+		src = net.IP(append([]byte(nil), data[12:16]...))
+		dst = net.IP(append([]byte(nil), data[16:20]...))
+		data = data[headerLen:totalLen]
+	case 6:
+		if len(data) < 40 {
+			return nil, false
+		}
+		// extension headers are not supported
+		payloadLen := int(binary.BigEndian.Uint16(data[4:]))
+		if data[6] != protocolUDP || len(data) < 40+payloadLen {
+			return nil, false
+		}
+		src = net.IP(append([]byte(nil), data[8:24]...))
+		dst = net.IP(append([]byte(nil), data[24:40]...))
+		data = data[40 : 40+payloadLen]
+	default:
+		return nil, false
+	}
+
+	if len(data) < udpHeaderLength {
+		return nil, false
+	}
+	udpLen := int(binary.BigEndian.Uint16(data[4:]))
+	if udpLen < udpHeaderLength || len(data) < udpLen {
+		return nil, false
+	}
+	return &Packet{
+		Src:     &net.UDPAddr{IP: src, Port: int(binary.BigEndian.Uint16(data[0:]))},
+		Dst:     &net.UDPAddr{IP: dst, Port: int(binary.BigEndian.Uint16(data[2:]))},
+		Payload: data[udpHeaderLength:udpLen],
+	}, true
+}
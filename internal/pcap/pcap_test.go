@@ -0,0 +1,159 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTrip(t *testing.T) {
+	now := time.Unix(1600000000, 123456789)
+	packets := []*Packet{
+		{
+			Time:    now,
+			Src:     &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 51821},
+			Dst:     &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2).To4(), Port: 51821},
+			Payload: []byte("hello"),
+		},
+		{
+			Time:    now.Add(time.Second),
+			Src:     &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 51821},
+			Dst:     &net.UDPAddr{IP: net.ParseIP("fe80::2"), Port: 51821},
+			Payload: []byte("world"),
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf)
+	require.NoError(t, err)
+	for _, p := range packets {
+		require.NoError(t, w.WritePacket(p))
+	}
+	assert.Error(t, w.WritePacket(&Packet{Src: packets[0].Src, Dst: packets[1].Dst}))
+	assert.True(t, IsPcap(buf.Bytes()))
+
+	r, err := NewReader(buf)
+	require.NoError(t, err)
+	for _, want := range packets {
+		got, err := r.Next()
+		require.NoError(t, err)
+		assert.True(t, want.Time.Equal(got.Time))
+		assert.Equal(t, want.Src, got.Src)
+		assert.Equal(t, want.Dst, got.Dst)
+		assert.Equal(t, want.Payload, got.Payload)
+	}
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReader_ethernetMicros(t *testing.T) {
+	buf := &bytes.Buffer{}
+	var header [globalHeaderLength]byte
+	binary.BigEndian.PutUint32(header[0:], magicMicros)
+	binary.BigEndian.PutUint32(header[20:], uint32(LinkTypeEthernet))
+	buf.Write(header[:])
+
+	record := func(frame []byte) {
+		var rh [recordHeaderLength]byte
+		binary.BigEndian.PutUint32(rh[0:], 1600000000)
+		binary.BigEndian.PutUint32(rh[4:], 5)
+		binary.BigEndian.PutUint32(rh[8:], uint32(len(frame)))
+		binary.BigEndian.PutUint32(rh[12:], uint32(len(frame)))
+		buf.Write(rh[:])
+		buf.Write(frame)
+	}
+	ipUDP := func(proto byte) []byte {
+		ip := []byte{
+			0x45, 0, 0, 20 + 8 + 2, 0, 0, 0, 0, 64, proto, 0, 0,
+			192, 168, 1, 1,
+			192, 168, 1, 2,
+		}
+		return append(ip, 0x12, 0x34, 0x56, 0x78, 0, 10, 0, 0, 'h', 'i')
+	}
+	ether := make([]byte, 14)
+	binary.BigEndian.PutUint16(ether[12:], 0x0800)
+	// a TCP packet should be skipped
+	record(append(append([]byte(nil), ether...), ipUDP(6)...))
+	record(append(append([]byte(nil), ether...), ipUDP(protocolUDP)...))
+
+	assert.True(t, IsPcap(buf.Bytes()))
+	r, err := NewReader(buf)
+	require.NoError(t, err)
+	p, err := r.Next()
+	require.NoError(t, err)
+	assert.Equal(t, time.Unix(1600000000, 5000), p.Time)
+	assert.Equal(t, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 1).To4(), Port: 0x1234}, p.Src)
+	assert.Equal(t, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2).To4(), Port: 0x5678}, p.Dst)
+	assert.Equal(t, []byte("hi"), p.Payload)
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestNewReader_errors(t *testing.T) {
+	_, err := NewReader(bytes.NewReader([]byte{1, 2}))
+	assert.Error(t, err)
+	_, err = NewReader(bytes.NewReader(make([]byte, globalHeaderLength)))
+	assert.Error(t, err)
+	assert.False(t, IsPcap(make([]byte, globalHeaderLength)))
+
+	var header [globalHeaderLength]byte
+	binary.LittleEndian.PutUint32(header[0:], magicMicros)
+	binary.LittleEndian.PutUint32(header[20:], 9999)
+	_, err = NewReader(bytes.NewReader(header[:]))
+	assert.Error(t, err)
+
+	binary.LittleEndian.PutUint32(header[20:], uint32(LinkTypeRaw))
+	r, err := NewReader(bytes.NewReader(append(header[:], 1, 2, 3)))
+	require.NoError(t, err)
+	_, err = r.Next()
+	assert.Error(t, err)
+	assert.NotEqual(t, io.EOF, err)
+}
+
+func TestReader_recordLength(t *testing.T) {
+	capture := func(snapLen, capLen uint32) io.Reader {
+		var header [globalHeaderLength]byte
+		binary.LittleEndian.PutUint32(header[0:], magicMicros)
+		binary.LittleEndian.PutUint32(header[16:], snapLen)
+		binary.LittleEndian.PutUint32(header[20:], uint32(LinkTypeRaw))
+		var rh [recordHeaderLength]byte
+		binary.LittleEndian.PutUint32(rh[8:], capLen)
+		binary.LittleEndian.PutUint32(rh[12:], capLen)
+		// the record is truncated, so reading it will fail either way
+		return bytes.NewReader(append(append(header[:], rh[:]...), 1, 2, 3))
+	}
+
+	tests := []struct {
+		name     string
+		snapLen  uint32
+		capLen   uint32
+		oversize bool
+	}{
+		{"within snaplen", 1500, 1500, false},
+		{"over snaplen", 1500, 1501, true},
+		{"no snaplen", 0, maxRecordLength, false},
+		{"over limit without snaplen", 0, maxRecordLength + 1, true},
+		{"huge snaplen", 0xffffffff, maxRecordLength + 1, true},
+		{"huge record", 65535, 0xffffffff, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewReader(capture(tt.snapLen, tt.capLen))
+			require.NoError(t, err)
+			_, err = r.Next()
+			require.Error(t, err)
+			assert.NotEqual(t, io.EOF, err)
+			if tt.oversize {
+				assert.Contains(t, err.Error(), "Corrupt pcap record")
+			} else {
+				assert.Contains(t, err.Error(), "Truncated pcap record")
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Writer writes UDP packets to a pcap capture, as bare IP packets like a
+// capture on a wireguard interface
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter creates a Writer, writing the capture header to w
+func NewWriter(w io.Writer) (*Writer, error) {
+	var header [globalHeaderLength]byte
+	binary.LittleEndian.PutUint32(header[0:], magicNanos)
+	// version 2.4
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	// snaplen
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], uint32(LinkTypeRaw))
+	if _, err := w.Write(header[:]); err != nil {
+		return nil, errors.Wrap(err, "Unable to write pcap header")
+	}
+	return &Writer{w: w}, nil
+}
+
+// WritePacket writes a UDP packet to the capture. The source and destination
+// must both be IPv4 or both be IPv6.
+func (w *Writer) WritePacket(p *Packet) error {
+	udpLen := udpHeaderLength + len(p.Payload)
+	var ip []byte
+	if src4, dst4 := p.Src.IP.To4(), p.Dst.IP.To4(); src4 != nil && dst4 != nil {
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+udpLen))
+		ip[8] = 64
+		ip[9] = protocolUDP
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+	} else if src4 == nil && dst4 == nil {
+		ip = make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(udpLen))
+		ip[6] = protocolUDP
+		ip[7] = 64
+		copy(ip[8:], p.Src.IP.To16())
+		copy(ip[24:], p.Dst.IP.To16())
+	} else {
+		return errors.Errorf("Mismatched address families: %v -> %v", p.Src, p.Dst)
+	}
+	// checksums are left as zero, which readers of the capture don't check
+	udp := make([]byte, udpHeaderLength)
+	binary.BigEndian.PutUint16(udp[0:], uint16(p.Src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(p.Dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpLen))
+
+	var header [recordHeaderLength]byte
+	frameLen := uint32(len(ip) + udpLen)
+	binary.LittleEndian.PutUint32(header[0:], uint32(p.Time.Unix()))
+	binary.LittleEndian.PutUint32(header[4:], uint32(p.Time.Nanosecond()))
+	binary.LittleEndian.PutUint32(header[8:], frameLen)
+	binary.LittleEndian.PutUint32(header[12:], frameLen)
+	for _, chunk := range [][]byte{header[:], ip, udp, p.Payload} {
+		if _, err := w.w.Write(chunk); err != nil {
+			return errors.Wrap(err, "Unable to write pcap record")
+		}
+	}
+	return nil
+}
@@ -79,7 +79,7 @@ func MemberMetadataFactFull(peer *wgtypes.Key, expires time.Time, name string, b
 		Attribute: fact.AttributeMemberMetadata,
 		Subject:   &fact.PeerSubject{Key: *peer},
 		Expires:   expires,
-		Value:     fact.BuildMemberMetadata(name, basic),
+		Value:     fact.BuildMemberMetadata(name, basic, false),
 	}
 }
 
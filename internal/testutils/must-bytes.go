@@ -2,6 +2,7 @@ package testutils
 
 import (
 	"math/rand"
+	"net"
 
 	"testing"
 
@@ -40,3 +41,19 @@ func MustRandBytes(t *testing.T, data []byte) []byte {
 	require.Equal(t, len(data), n)
 	return data
 }
+
+// MustCollidingKeys generates random keys until it finds two different ones
+// for which addr returns the same IP, which is only practical for small
+// address spaces
+func MustCollidingKeys(t *testing.T, addr func(wgtypes.Key) net.IP) (k1, k2 wgtypes.Key) {
+	seen := make(map[string]wgtypes.Key)
+	for i := 0; ; i++ {
+		require.Less(t, i, 100000, "should find a collision")
+		k := MustKey(t)
+		ip := addr(k).String()
+		if other, ok := seen[ip]; ok && other != k {
+			return other, k
+		}
+		seen[ip] = k
+	}
+}
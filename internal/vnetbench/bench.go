@@ -0,0 +1,424 @@
+// Package vnetbench runs many wirelink servers in process on a virtual network,
+// to measure how wirelink behaves as the number of peers grows.
+package vnetbench
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/internal/networking/vnet"
+	"github.com/fastcat/wirelink/server"
+	"github.com/fastcat/wirelink/trust"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// wgPort is the port on which every simulated wireguard tunnel listens
+const wgPort = 51820
+
+// leavesPerSubnet is how many leaves get tunnel addresses in each /24
+const leavesPerSubnet = 250
+
+// Options controls the shape of the simulated network and how long it is run
+type Options struct {
+	// Routers is how many nodes act as routers that every leaf is configured
+	// to connect to
+	Routers int `json:"routers"`
+	// Leaves is how many nodes are only configured to connect to the routers,
+	// and have to discover each other through wirelink
+	Leaves int `json:"leaves"`
+	// Gossip enables gossiping facts between leaves
+	Gossip       bool `json:"gossip"`
+	GossipFanout int  `json:"gossipFanout,omitempty"`
+	// TimeScale is how many times faster than real time the servers run: each
+	// of their periods is the default divided by it, as is the fact expiration
+	// quantum (see fact.ScaleExpirationQuantumForTests). Timings outside the
+	// servers, such as how long a wireguard handshake is valid, are not scaled.
+	TimeScale uint `json:"timeScale"`
+	// Timeout is how long to wait for the mesh to form
+	Timeout time.Duration `json:"timeoutNs"`
+	// Soak is how long to keep running after the mesh forms, to measure the
+	// steady state traffic
+	Soak time.Duration `json:"soakNs"`
+}
+
+// DefaultOptions are the options used for any zero values in the options
+// passed to Run
+var DefaultOptions = Options{
+	Routers:   1,
+	Leaves:    10,
+	TimeScale: 20,
+	Timeout:   time.Minute,
+	Soak:      5 * time.Second,
+}
+
+// scaled returns the duration of a server period when running at TimeScale
+func (o Options) scaled(d time.Duration) time.Duration {
+	return d / time.Duration(o.TimeScale)
+}
+
+func (o Options) withDefaults() Options {
+	if o.Routers <= 0 {
+		o.Routers = DefaultOptions.Routers
+	}
+	if o.Leaves <= 0 {
+		o.Leaves = DefaultOptions.Leaves
+	}
+	if o.TimeScale == 0 {
+		o.TimeScale = DefaultOptions.TimeScale
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultOptions.Timeout
+	}
+	if o.Soak < 0 {
+		o.Soak = 0
+	}
+	return o
+}
+
+// NodeResult is the measurements for a single node
+type NodeResult struct {
+	Name   string `json:"name"`
+	Router bool   `json:"router"`
+
+	PacketsSent     int64 `json:"packetsSent"`
+	BytesSent       int64 `json:"bytesSent"`
+	PacketsReceived int64 `json:"packetsReceived"`
+	BytesReceived   int64 `json:"bytesReceived"`
+	// PacketsPerMinute and BytesPerMinute are the rates sent during the soak
+	// period, or the whole run if there was no soak period, per minute of
+	// simulated time (see Options.TimeScale), so they are comparable to a real
+	// deployment
+	PacketsPerMinute float64 `json:"packetsPerMinute"`
+	BytesPerMinute   float64 `json:"bytesPerMinute"`
+
+	Chunks        int           `json:"chunks"`
+	ChunkTimeMean time.Duration `json:"chunkTimeMeanNs"`
+	Facts         int           `json:"facts"`
+
+	KnowledgeEntries int `json:"knowledgeEntries"`
+	KnowledgeBytes   int `json:"knowledgeBytes"`
+
+	Gossip server.GossipStats `json:"gossip"`
+}
+
+// Summary aggregates the node results
+type Summary struct {
+	PacketsPerNodePerMinute    float64 `json:"packetsPerNodePerMinute"`
+	MaxPacketsPerNodePerMinute float64 `json:"maxPacketsPerNodePerMinute"`
+	BytesPerNodePerMinute      float64 `json:"bytesPerNodePerMinute"`
+	MaxBytesPerNodePerMinute   float64 `json:"maxBytesPerNodePerMinute"`
+
+	Chunks        int           `json:"chunks"`
+	ChunkTimeMean time.Duration `json:"chunkTimeMeanNs"`
+	// CPUPerChunk is the CPU time used by the whole process, divided by the
+	// number of chunks processed, which includes all the other work the servers
+	// and the virtual network did
+	CPUPerChunk time.Duration `json:"cpuPerChunkNs"`
+
+	KnowledgeEntries  int `json:"knowledgeEntries"`
+	KnowledgeBytes    int `json:"knowledgeBytes"`
+	MaxKnowledgeBytes int `json:"maxKnowledgeBytes"`
+}
+
+// Result is the outcome of a benchmark run
+type Result struct {
+	Options Options `json:"options"`
+	// Converged is whether every leaf formed a direct connection to every other
+	// leaf before the timeout
+	Converged bool `json:"converged"`
+	// MeshTime is how long it took to form the full mesh, or the timeout if it
+	// didn't converge
+	MeshTime time.Duration `json:"meshTimeNs"`
+	// Elapsed is how long the servers ran in total
+	Elapsed time.Duration `json:"elapsedNs"`
+	// CPUTime is the CPU time used by the process while the servers ran
+	CPUTime time.Duration `json:"cpuTimeNs"`
+
+	Summary Summary      `json:"summary"`
+	Nodes   []NodeResult `json:"nodes"`
+}
+
+// WriteJSON writes the result as indented JSON
+func (r *Result) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// node is a single simulated host running a server
+type node struct {
+	name   string
+	router bool
+	host   *vnet.Host
+	tun    *vnet.Tunnel
+	pub    wgtypes.Key
+	phy    net.IP
+	tunnel net.IP
+	config *config.Server
+	server *server.LinkServer
+}
+
+func phyAddr(router bool, i int) net.IP {
+	if router {
+		return net.IPv4(100, 64, 0, byte(i+1))
+	}
+	return net.IPv4(100, 65, byte(i/leavesPerSubnet), byte(i%leavesPerSubnet+1))
+}
+
+func tunnelAddr(router bool, i int) net.IP {
+	if router {
+		return net.IPv4(192, 168, 0, byte(i+1))
+	}
+	return net.IPv4(192, 168, byte(1+i/leavesPerSubnet), byte(i%leavesPerSubnet+1))
+}
+
+// Run builds the simulated network, runs it until the mesh forms and then for
+// the soak period, and reports the measurements. As it changes the global fact
+// expiration quantum, it must not be run concurrently with anything else that
+// uses facts.
+func Run(opts Options) (*Result, error) {
+	opts = opts.withDefaults()
+	if opts.Leaves > 254*leavesPerSubnet {
+		return nil, errors.Errorf("too many leaves: %d", opts.Leaves)
+	}
+	if opts.Routers > 254 {
+		return nil, errors.Errorf("too many routers: %d", opts.Routers)
+	}
+
+	fact.ScaleExpirationQuantumForTests(opts.TimeScale)
+	defer fact.ScaleExpirationQuantumForTests(1)
+
+	w := vnet.NewWorld()
+	internet := w.CreateNetwork("internet")
+
+	nodes := make([]*node, 0, opts.Routers+opts.Leaves)
+	defer func() {
+		for _, n := range nodes {
+			if n.server != nil {
+				n.server.Close()
+			}
+			n.host.Close()
+		}
+	}()
+	addNode := func(router bool, i int) *node {
+		n := &node{
+			router: router,
+			phy:    phyAddr(router, i),
+			tunnel: tunnelAddr(router, i),
+		}
+		if router {
+			n.name = fmt.Sprintf("router%d", i+1)
+		} else {
+			n.name = fmt.Sprintf("leaf%d", i+1)
+		}
+		n.host = w.CreateHost(n.name)
+		eth := n.host.AddPhy("eth0")
+		eth.AddAddr(net.IPNet{IP: n.phy, Mask: net.CIDRMask(10, 32)})
+		eth.AttachToNetwork(internet)
+		n.tun = n.host.AddTun("wg0")
+		_, n.pub = n.tun.GenerateKeys()
+		n.tun.AddAddr(net.IPNet{IP: n.tunnel, Mask: net.CIDRMask(16, 32)})
+		n.tun.Listen(wgPort)
+		n.config = &config.Server{
+			Iface:        "wg0",
+			IsRouterNow:  router,
+			Gossip:       opts.Gossip,
+			GossipFanout: opts.GossipFanout,
+			Peers:        config.Peers{},
+		}
+		nodes = append(nodes, n)
+		return n
+	}
+
+	routers := make([]*node, opts.Routers)
+	for i := range routers {
+		routers[i] = addNode(true, i)
+	}
+	leaves := make([]*node, opts.Leaves)
+	for i := range leaves {
+		leaves[i] = addNode(false, i)
+	}
+
+	// routers know about everyone, leaves only know about routers
+	for _, r := range routers {
+		for _, n := range nodes {
+			if n == r {
+				r.config.Peers[n.pub] = &config.Peer{
+					Name:  n.name,
+					Trust: trust.Ptr(trust.Membership),
+				}
+				continue
+			}
+			p := &config.Peer{
+				Name:       n.name,
+				AllowedIPs: []net.IPNet{{IP: n.tunnel, Mask: net.CIDRMask(32, 32)}},
+			}
+			if n.router {
+				p.Trust = trust.Ptr(trust.Membership)
+				p.Endpoints = []config.PeerEndpoint{{Host: n.phy.String(), Port: wgPort}}
+			}
+			r.config.Peers[n.pub] = p
+		}
+		for _, l := range leaves {
+			l.config.Peers[r.pub] = &config.Peer{
+				Name:      r.name,
+				Trust:     trust.Ptr(trust.Membership),
+				Endpoints: []config.PeerEndpoint{{Host: r.phy.String(), Port: wgPort}},
+			}
+		}
+	}
+
+	for _, n := range nodes {
+		env := n.host.Wrap()
+		wgc, err := env.NewWgClient()
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to create wgctrl for %s", n.name)
+		}
+		if n.server, err = server.Create(env, wgc, n.config); err != nil {
+			return nil, errors.Wrapf(err, "unable to create server for %s", n.name)
+		}
+		n.server.ChunkPeriod = opts.scaled(server.DefaultChunkPeriod)
+		n.server.FactTTL = opts.scaled(server.DefaultFactTTL)
+		n.server.AlivePeriod = opts.scaled(server.DefaultAlivePeriod)
+		n.server.ProbePeriod = opts.scaled(server.DefaultProbePeriod)
+	}
+
+	cpuStart := cpuTime()
+	start := time.Now()
+	for _, n := range nodes {
+		if err := n.server.Start(); err != nil {
+			return nil, errors.Wrapf(err, "unable to start server for %s", n.name)
+		}
+	}
+
+	ret := &Result{Options: opts}
+	deadline := start.Add(opts.Timeout)
+	chunkPeriod := opts.scaled(server.DefaultChunkPeriod)
+	pollPeriod := chunkPeriod / 3
+	for {
+		if ret.Converged = meshed(leaves, chunkPeriod); ret.Converged {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			break
+		}
+		time.Sleep(pollPeriod)
+	}
+	ret.MeshTime = time.Since(start)
+
+	soakStart := time.Now()
+	meshTraffic := make([]vnet.TrafficStats, len(nodes))
+	for i, n := range nodes {
+		meshTraffic[i] = n.host.Traffic()
+	}
+	if opts.Soak > 0 {
+		time.Sleep(opts.Soak)
+	}
+
+	ret.Elapsed = time.Since(start)
+	ret.CPUTime = cpuTime() - cpuStart
+	rateWindow := time.Since(soakStart)
+	if opts.Soak == 0 {
+		rateWindow = ret.Elapsed
+		meshTraffic = make([]vnet.TrafficStats, len(nodes))
+	}
+	// measure the rates in simulated time
+	rateWindow *= time.Duration(opts.TimeScale)
+	for i, n := range nodes {
+		ret.Nodes = append(ret.Nodes, measure(n, meshTraffic[i], rateWindow))
+	}
+	ret.summarize()
+
+	for _, n := range nodes {
+		n.server.RequestStop()
+	}
+	return ret, nil
+}
+
+// meshed checks if every leaf has a recently active direct connection to every
+// other leaf
+func meshed(leaves []*node, recent time.Duration) bool {
+	for _, l := range leaves {
+		peers := l.tun.Peers()
+		for _, o := range leaves {
+			if o == l {
+				continue
+			}
+			p, ok := peers[o.pub.String()]
+			if !ok || p.Endpoint() == nil || time.Since(p.LastReceive()) > recent {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func perMinute(count int64, window time.Duration) float64 {
+	if window <= 0 {
+		return 0
+	}
+	return float64(count) * float64(time.Minute) / float64(window)
+}
+
+func measure(n *node, base vnet.TrafficStats, window time.Duration) NodeResult {
+	traffic := n.host.Traffic()
+	stats := n.server.Stats()
+	ret := NodeResult{
+		Name:             n.name,
+		Router:           n.router,
+		PacketsSent:      traffic.PacketsSent,
+		BytesSent:        traffic.BytesSent,
+		PacketsReceived:  traffic.PacketsReceived,
+		BytesReceived:    traffic.BytesReceived,
+		PacketsPerMinute: perMinute(traffic.PacketsSent-base.PacketsSent, window),
+		BytesPerMinute:   perMinute(traffic.BytesSent-base.BytesSent, window),
+		Chunks:           stats.Chunks,
+		Facts:            stats.Facts,
+		KnowledgeEntries: stats.KnowledgeEntries,
+		KnowledgeBytes:   stats.KnowledgeBytes,
+		Gossip:           stats.Gossip,
+	}
+	if stats.Chunks > 0 {
+		ret.ChunkTimeMean = stats.ChunkTime / time.Duration(stats.Chunks)
+	}
+	return ret
+}
+
+func (r *Result) summarize() {
+	s := Summary{}
+	var chunkTime time.Duration
+	for _, n := range r.Nodes {
+		s.PacketsPerNodePerMinute += n.PacketsPerMinute
+		if n.PacketsPerMinute > s.MaxPacketsPerNodePerMinute {
+			s.MaxPacketsPerNodePerMinute = n.PacketsPerMinute
+		}
+		s.BytesPerNodePerMinute += n.BytesPerMinute
+		if n.BytesPerMinute > s.MaxBytesPerNodePerMinute {
+			s.MaxBytesPerNodePerMinute = n.BytesPerMinute
+		}
+		s.Chunks += n.Chunks
+		chunkTime += n.ChunkTimeMean * time.Duration(n.Chunks)
+		s.KnowledgeEntries += n.KnowledgeEntries
+		s.KnowledgeBytes += n.KnowledgeBytes
+		if n.KnowledgeBytes > s.MaxKnowledgeBytes {
+			s.MaxKnowledgeBytes = n.KnowledgeBytes
+		}
+	}
+	if len(r.Nodes) > 0 {
+		s.PacketsPerNodePerMinute /= float64(len(r.Nodes))
+		s.BytesPerNodePerMinute /= float64(len(r.Nodes))
+	}
+	if s.Chunks > 0 {
+		s.ChunkTimeMean = chunkTime / time.Duration(s.Chunks)
+		s.CPUPerChunk = r.CPUTime / time.Duration(s.Chunks)
+	}
+	r.Summary = s
+}
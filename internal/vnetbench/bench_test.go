@@ -0,0 +1,141 @@
+package vnetbench
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/log"
+	"github.com/fastcat/wirelink/server"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	benchRouters = flag.Int("vnetbench.routers", 2, "number of routers for BenchmarkRun")
+	benchLeaves  = flag.Int("vnetbench.leaves", 20, "number of leaves for BenchmarkRun")
+	benchGossip  = flag.Bool("vnetbench.gossip", false, "enable gossip for BenchmarkRun")
+	benchScale   = flag.Uint("vnetbench.timescale", DefaultOptions.TimeScale, "how many times faster than real time BenchmarkRun runs")
+	benchTimeout = flag.Duration("vnetbench.timeout", DefaultOptions.Timeout, "mesh timeout for BenchmarkRun")
+	benchSoak    = flag.Duration("vnetbench.soak", DefaultOptions.Soak, "soak time for BenchmarkRun")
+	benchOut     = flag.String("vnetbench.out", "", "file to write BenchmarkRun JSON results to")
+	benchLog     = flag.String("vnetbench.log", "error", "log levels for BenchmarkRun, so logging doesn't dominate the measurements")
+)
+
+func TestRun(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping slow vnet test in short mode")
+	}
+
+	chunkPeriod := DefaultOptions.scaled(server.DefaultChunkPeriod)
+	r, err := Run(Options{
+		Routers: 1,
+		Leaves:  3,
+		Timeout: 20 * chunkPeriod,
+		Soak:    3 * chunkPeriod,
+	})
+	require.NoError(t, err)
+	assert.True(t, r.Converged)
+	assert.Less(t, int64(r.MeshTime), int64(r.Elapsed))
+	require.Len(t, r.Nodes, 4)
+	assert.True(t, r.Nodes[0].Router)
+	for _, n := range r.Nodes {
+		assert.NotZero(t, n.PacketsSent, n.Name)
+		assert.NotZero(t, n.PacketsReceived, n.Name)
+		assert.NotZero(t, n.PacketsPerMinute, n.Name)
+		assert.NotZero(t, n.Chunks, n.Name)
+		assert.NotZero(t, n.Facts, n.Name)
+		assert.NotZero(t, n.KnowledgeEntries, n.Name)
+	}
+	assert.NotZero(t, r.Summary.ChunkTimeMean)
+	assert.GreaterOrEqual(t, r.Summary.MaxPacketsPerNodePerMinute, r.Summary.PacketsPerNodePerMinute)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, r.WriteJSON(buf))
+	var decoded Result
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, *r, decoded)
+}
+
+func TestResult_summarize(t *testing.T) {
+	r := &Result{
+		CPUTime: 40 * time.Millisecond,
+		Nodes: []NodeResult{
+			{PacketsPerMinute: 10, BytesPerMinute: 1000, Chunks: 2, ChunkTimeMean: time.Millisecond, KnowledgeEntries: 3, KnowledgeBytes: 300},
+			{PacketsPerMinute: 30, BytesPerMinute: 2000, Chunks: 6, ChunkTimeMean: 3 * time.Millisecond, KnowledgeEntries: 5, KnowledgeBytes: 500},
+		},
+	}
+	r.summarize()
+	assert.Equal(t, Summary{
+		PacketsPerNodePerMinute:    20,
+		MaxPacketsPerNodePerMinute: 30,
+		BytesPerNodePerMinute:      1500,
+		MaxBytesPerNodePerMinute:   2000,
+		Chunks:                     8,
+		ChunkTimeMean:              2500 * time.Microsecond,
+		CPUPerChunk:                5 * time.Millisecond,
+		KnowledgeEntries:           8,
+		KnowledgeBytes:             800,
+		MaxKnowledgeBytes:          500,
+	}, r.Summary)
+}
+
+func TestAddrs(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 3*leavesPerSubnet; i++ {
+		for _, ip := range []string{phyAddr(false, i).String(), tunnelAddr(false, i).String()} {
+			assert.False(t, seen[ip], "duplicate address %s", ip)
+			seen[ip] = true
+		}
+	}
+	for i := 0; i < 254; i++ {
+		for _, ip := range []string{phyAddr(true, i).String(), tunnelAddr(true, i).String()} {
+			assert.False(t, seen[ip], "duplicate address %s", ip)
+			seen[ip] = true
+		}
+	}
+}
+
+// BenchmarkRun runs a large simulated network once per iteration, reporting
+// the scaling measurements as metrics, and optionally writing the full results
+// of the last run as JSON, e.g.:
+//
+//	go test ./internal/vnetbench -run=NONE -bench=Run -benchtime=1x \
+//		-vnetbench.leaves=300 -vnetbench.out=results.json
+func BenchmarkRun(b *testing.B) {
+	require.NoError(b, log.SetLevels(*benchLog))
+	defer log.ResetLevels()
+
+	var r *Result
+	var err error
+	for i := 0; i < b.N; i++ {
+		r, err = Run(Options{
+			Routers:   *benchRouters,
+			Leaves:    *benchLeaves,
+			Gossip:    *benchGossip,
+			TimeScale: *benchScale,
+			Timeout:   *benchTimeout,
+			Soak:      *benchSoak,
+		})
+		require.NoError(b, err)
+		if !r.Converged {
+			b.Errorf("mesh did not converge in %v", r.MeshTime)
+		}
+	}
+	b.ReportMetric(r.MeshTime.Seconds(), "mesh-s")
+	b.ReportMetric(r.Summary.PacketsPerNodePerMinute, "pkts/node/min")
+	b.ReportMetric(r.Summary.BytesPerNodePerMinute, "B/node/min")
+	b.ReportMetric(float64(r.Summary.CPUPerChunk.Microseconds()), "cpu-us/chunk")
+	b.ReportMetric(float64(r.Summary.MaxKnowledgeBytes), "knowledge-B/node")
+
+	if *benchOut != "" {
+		f, err := os.Create(*benchOut)
+		require.NoError(b, err)
+		defer f.Close()
+		require.NoError(b, r.WriteJSON(f))
+	}
+}
@@ -0,0 +1,18 @@
+//go:build linux
+// +build linux
+
+package vnetbench
+
+import (
+	"syscall"
+	"time"
+)
+
+// cpuTime returns the user+system CPU time used by the process so far
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
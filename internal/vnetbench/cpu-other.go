@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package vnetbench
+
+import "time"
+
+// cpuTime is not implemented on this platform
+func cpuTime() time.Duration {
+	return 0
+}
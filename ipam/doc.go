@@ -0,0 +1,3 @@
+// Package ipam allocates stable overlay host addresses to network members
+// from configured pools, and keeps a persistent record of the allocations.
+package ipam
@@ -0,0 +1,71 @@
+package ipam
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+
+	"github.com/fastcat/wirelink/util"
+)
+
+// Pool is a range of addresses to allocate host addresses from
+type Pool struct {
+	net.IPNet
+}
+
+// NewPool checks that the network is usable as a pool, i.e. that it has room
+// for at least one host address
+func NewPool(ipn net.IPNet) (*Pool, error) {
+	ip := util.NormalizeIP(ipn.IP)
+	ones, bits := ipn.Mask.Size()
+	if bits != 8*len(ip) {
+		return nil, errors.Errorf("Pool %v has a mismatched mask", ipn)
+	}
+	if ones > bits-2 {
+		return nil, errors.Errorf("Pool %v is too small", ipn)
+	}
+	return &Pool{net.IPNet{IP: ip.Mask(ipn.Mask), Mask: ipn.Mask}}, nil
+}
+
+// IsV4 is whether the pool is of IPv4 addresses
+func (p *Pool) IsV4() bool {
+	return len(p.IP) == net.IPv4len
+}
+
+// Host makes the host address network for an IP in the pool
+func (p *Pool) Host(ip net.IP) net.IPNet {
+	bits := 8 * len(p.IP)
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+// Next finds the lowest free host address in the pool. It never returns the
+// network address, nor for IPv4 the broadcast address. The IPs passed to used
+// are in normalized form, see util.NormalizeIP.
+func (p *Pool) Next(used func(net.IP) bool) (net.IP, error) {
+	ip := nextIP(p.IP)
+	for p.Contains(ip) {
+		next := nextIP(ip)
+		if p.IsV4() && !p.Contains(next) {
+			// ip is the broadcast address
+			break
+		}
+		if !used(ip) {
+			return ip, nil
+		}
+		ip = next
+	}
+	return nil, errors.Errorf("Pool %v is full", p.IPNet)
+}
+
+// nextIP returns a copy of the IP incremented by one, wrapping around at the
+// end of the address space
+func nextIP(ip net.IP) net.IP {
+	ret := append(net.IP(nil), ip...)
+	for i := len(ret) - 1; i >= 0; i-- {
+		ret[i]++
+		if ret[i] != 0 {
+			break
+		}
+	}
+	return ret
+}
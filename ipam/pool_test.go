@@ -0,0 +1,84 @@
+package ipam
+
+import (
+	"net"
+	"testing"
+
+	"github.com/fastcat/wirelink/internal/testutils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPool(t *testing.T) {
+	tests := []struct {
+		name    string
+		ipn     net.IPNet
+		want    net.IPNet
+		wantErr bool
+	}{
+		{"v4", testutils.MakeIPv4Net(10, 1, 2, 3, 24), testutils.MakeIPv4Net(10, 1, 2, 0, 24), false},
+		{"v6", testutils.MakeIPv6Net([]byte{0xfd, 1}, []byte{1}, 64), testutils.MakeIPv6Net([]byte{0xfd, 1}, nil, 64), false},
+		{"v4 /30", testutils.MakeIPv4Net(10, 1, 2, 0, 30), testutils.MakeIPv4Net(10, 1, 2, 0, 30), false},
+		{"v4 /31", testutils.MakeIPv4Net(10, 1, 2, 0, 31), net.IPNet{}, true},
+		{"v6 /127", testutils.MakeIPv6Net([]byte{0xfd, 1}, nil, 127), net.IPNet{}, true},
+		{"mismatched", net.IPNet{IP: net.IPv4(10, 1, 2, 0).To4(), Mask: net.CIDRMask(64, 128)}, net.IPNet{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewPool(tt.ipn)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want.String(), got.String())
+		})
+	}
+}
+
+func TestPool_Next(t *testing.T) {
+	used := func(ips ...string) func(net.IP) bool {
+		return func(ip net.IP) bool {
+			for _, s := range ips {
+				if net.ParseIP(s).Equal(ip) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	tests := []struct {
+		name    string
+		pool    string
+		used    func(net.IP) bool
+		want    string
+		wantErr bool
+	}{
+		{"v4 empty", "10.1.2.0/24", used(), "10.1.2.1", false},
+		{"v4 skips used", "10.1.2.0/24", used("10.1.2.1", "10.1.2.2"), "10.1.2.3", false},
+		{"v4 carries", "10.1.2.0/23", used("10.1.2.1", "10.1.2.255"), "10.1.2.2", false},
+		{"v4 full", "10.1.2.0/30", used("10.1.2.1", "10.1.2.2"), "", true},
+		{"v4 no broadcast", "10.1.2.0/30", used("10.1.2.1"), "10.1.2.2", false},
+		{"v6 empty", "fd00:1::/64", used(), "fd00:1::1", false},
+		{"v6 skips used", "fd00:1::/64", used("fd00:1::1"), "fd00:1::2", false},
+		{"v6 full", "fd00:1::/126", used("fd00:1::1", "fd00:1::2", "fd00:1::3"), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ipn, err := net.ParseCIDR(tt.pool)
+			require.NoError(t, err)
+			p, err := NewPool(*ipn)
+			require.NoError(t, err)
+			got, err := p.Next(tt.used)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got.String())
+			host := p.Host(got)
+			assert.Equal(t, tt.want+"/"+map[bool]string{true: "32", false: "128"}[p.IsV4()], host.String())
+		})
+	}
+}
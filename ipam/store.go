@@ -0,0 +1,175 @@
+package ipam
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/fastcat/wirelink/util"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// allocationData is the JSON form of one member's addresses
+type allocationData struct {
+	PublicKey string
+	Addresses []string
+}
+
+type storeData struct {
+	Allocations []allocationData
+}
+
+// Store is the persistent set of allocated addresses
+type Store struct {
+	file  *util.StoreFile
+	pools []*Pool
+	// keys keeps the allocation order, so the file is stable
+	keys        []wgtypes.Key
+	allocations map[wgtypes.Key][]net.IPNet
+}
+
+// LoadStore reads the allocations from the given file. A missing file is
+// treated as having no allocations.
+func LoadStore(path string, pools []*Pool) (*Store, error) {
+	s := &Store{
+		file:        util.NewStoreFile(path),
+		pools:       pools,
+		allocations: make(map[wgtypes.Key][]net.IPNet),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Unable to read address allocations %s", path)
+	}
+	var sd storeData
+	if err = json.Unmarshal(data, &sd); err != nil {
+		return nil, errors.Wrapf(err, "Unable to parse address allocations %s", path)
+	}
+	for _, ad := range sd.Allocations {
+		key, err := wgtypes.ParseKey(ad.PublicKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Bad address allocation key '%s'", ad.PublicKey)
+		}
+		var addrs []net.IPNet
+		for _, a := range ad.Addresses {
+			_, ipn, err := net.ParseCIDR(a)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Bad allocated address '%s'", a)
+			}
+			addrs = append(addrs, *ipn)
+		}
+		if _, ok := s.allocations[key]; !ok {
+			s.keys = append(s.keys, key)
+		}
+		s.allocations[key] = addrs
+	}
+	return s, nil
+}
+
+// MemoryOnly stops allocations from being written to the file, so that
+// addresses handed out during a dry run aren't kept reserved after it
+func (s *Store) MemoryOnly() {
+	s.file.MemoryOnly()
+}
+
+// Allocations returns the addresses allocated to each member
+func (s *Store) Allocations() map[wgtypes.Key][]net.IPNet {
+	ret := make(map[wgtypes.Key][]net.IPNet, len(s.allocations))
+	for k, v := range s.allocations {
+		ret[k] = v
+	}
+	return ret
+}
+
+// Pools returns the pools the store allocates from
+func (s *Store) Pools() []*Pool {
+	return s.pools
+}
+
+// Get returns the addresses allocated to a member, if any
+func (s *Store) Get(key wgtypes.Key) ([]net.IPNet, bool) {
+	addrs, ok := s.allocations[key]
+	return addrs, ok
+}
+
+// Allocate gives the member a host address from each pool for which need
+// returns true, or from every pool if need is nil, avoiding any addresses
+// already allocated, or for which used returns true, and saves the store. If
+// the member already has addresses, they are returned unchanged. If it needs
+// none, nothing is allocated.
+func (s *Store) Allocate(key wgtypes.Key, need func(*Pool) bool, used func(net.IP) bool) ([]net.IPNet, error) {
+	if addrs, ok := s.allocations[key]; ok {
+		return addrs, nil
+	}
+	taken := make(map[string]bool)
+	for _, addrs := range s.allocations {
+		for _, a := range addrs {
+			taken[string(util.NormalizeIP(a.IP))] = true
+		}
+	}
+	isUsed := func(ip net.IP) bool {
+		return taken[string(ip)] || used != nil && used(ip)
+	}
+	addrs := make([]net.IPNet, 0, len(s.pools))
+	for _, p := range s.pools {
+		if need != nil && !need(p) {
+			continue
+		}
+		ip, err := p.Next(isUsed)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, p.Host(ip))
+	}
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+	s.keys = append(s.keys, key)
+	s.allocations[key] = addrs
+	if err := s.save(); err != nil {
+		// don't keep an allocation we couldn't persist
+		s.keys = s.keys[:len(s.keys)-1]
+		delete(s.allocations, key)
+		return nil, err
+	}
+	return addrs, nil
+}
+
+// Release frees the addresses allocated to a member, if any, and saves the
+// store. If it can't be saved, the addresses are still freed until the next
+// restart.
+func (s *Store) Release(key wgtypes.Key) error {
+	if _, ok := s.allocations[key]; !ok {
+		return nil
+	}
+	delete(s.allocations, key)
+	for i, k := range s.keys {
+		if k == key {
+			s.keys = append(s.keys[:i], s.keys[i+1:]...)
+			break
+		}
+	}
+	return s.save()
+}
+
+// save writes the store to its file
+func (s *Store) save() error {
+	var sd storeData
+	for _, k := range s.keys {
+		ad := allocationData{PublicKey: k.String()}
+		for _, a := range s.allocations[k] {
+			ad.Addresses = append(ad.Addresses, a.String())
+		}
+		sd.Allocations = append(sd.Allocations, ad)
+	}
+	data, err := json.MarshalIndent(&sd, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Unable to encode address allocations")
+	}
+	return errors.Wrapf(s.file.Save(data), "Unable to save address allocations %s", s.file.Path())
+}
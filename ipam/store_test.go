@@ -0,0 +1,213 @@
+package ipam
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fastcat/wirelink/internal/testutils"
+	"github.com/fastcat/wirelink/util"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustPools(t *testing.T, cidrs ...string) []*Pool {
+	var ret []*Pool
+	for _, c := range cidrs {
+		_, ipn, err := net.ParseCIDR(c)
+		require.NoError(t, err)
+		p, err := NewPool(*ipn)
+		require.NoError(t, err)
+		ret = append(ret, p)
+	}
+	return ret
+}
+
+func addrStrings(addrs []net.IPNet) []string {
+	var ret []string
+	for _, a := range addrs {
+		ret = append(ret, a.String())
+	}
+	return ret
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wirelink-ipam")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "addresses.json")
+	pools := mustPools(t, "10.1.0.0/24", "fd00:1::/64")
+
+	s, err := LoadStore(path, pools)
+	require.NoError(t, err)
+	assert.Empty(t, s.Allocations())
+
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	k3 := testutils.MustKey(t)
+
+	addrs, err := s.Allocate(k1, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.1.0.1/32", "fd00:1::1/128"}, addrStrings(addrs))
+
+	// externally used addresses are skipped
+	addrs, err = s.Allocate(k2, nil, func(ip net.IP) bool { return ip.Equal(net.ParseIP("10.1.0.2")) })
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.1.0.3/32", "fd00:1::2/128"}, addrStrings(addrs))
+
+	// repeat allocations are stable
+	addrs, err = s.Allocate(k1, nil, func(net.IP) bool { return true })
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.1.0.1/32", "fd00:1::1/128"}, addrStrings(addrs))
+
+	// and persisted
+	s2, err := LoadStore(path, pools)
+	require.NoError(t, err)
+	assert.Equal(t, s.Allocations(), s2.Allocations())
+	addrs, ok := s2.Get(k2)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"10.1.0.3/32", "fd00:1::2/128"}, addrStrings(addrs))
+	_, ok = s2.Get(k3)
+	assert.False(t, ok)
+
+	// only allocates from the pools that are needed
+	addrs, err = s2.Allocate(k3, func(p *Pool) bool { return !p.IsV4() }, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"fd00:1::3/128"}, addrStrings(addrs))
+	require.NoError(t, s2.Release(k3))
+	addrs, err = s2.Allocate(k3, func(*Pool) bool { return false }, nil)
+	require.NoError(t, err)
+	assert.Empty(t, addrs)
+	_, ok = s2.Get(k3)
+	assert.False(t, ok)
+
+	// a full pool fails without recording anything
+	_, err = s2.Allocate(k3, nil, func(ip net.IP) bool { return len(ip) == net.IPv4len })
+	assert.Error(t, err)
+	_, ok = s2.Get(k3)
+	assert.False(t, ok)
+	assert.Len(t, s2.Allocations(), 2)
+}
+
+func TestStore_MemoryOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wirelink-ipam")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "addresses.json")
+	pools := mustPools(t, "10.1.0.0/24")
+
+	s, err := LoadStore(path, pools)
+	require.NoError(t, err)
+	k1 := testutils.MustKey(t)
+	_, err = s.Allocate(k1, nil, nil)
+	require.NoError(t, err)
+
+	s2, err := LoadStore(path, pools)
+	require.NoError(t, err)
+	s2.MemoryOnly()
+	k2 := testutils.MustKey(t)
+	addrs, err := s2.Allocate(k2, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.1.0.2/32"}, addrStrings(addrs))
+	assert.Len(t, s2.Allocations(), 2)
+
+	// the file still only has the first allocation
+	s3, err := LoadStore(path, pools)
+	require.NoError(t, err)
+	assert.Len(t, s3.Allocations(), 1)
+	_, ok := s3.Get(k2)
+	assert.False(t, ok)
+}
+
+func TestStore_Release(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wirelink-ipam")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "addresses.json")
+	pools := mustPools(t, "10.1.0.0/24")
+
+	s, err := LoadStore(path, pools)
+	require.NoError(t, err)
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	k3 := testutils.MustKey(t)
+	for _, k := range []wgtypes.Key{k1, k2, k3} {
+		_, err = s.Allocate(k, nil, nil)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, s.Release(k2))
+	_, ok := s.Get(k2)
+	assert.False(t, ok)
+	assert.Equal(t, []wgtypes.Key{k1, k3}, s.keys)
+	// releasing again does nothing
+	require.NoError(t, s.Release(k2))
+
+	// and the released address is reused
+	k4 := testutils.MustKey(t)
+	addrs, err := s.Allocate(k4, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.1.0.2/32"}, addrStrings(addrs))
+
+	s2, err := LoadStore(path, pools)
+	require.NoError(t, err)
+	assert.Equal(t, s.Allocations(), s2.Allocations())
+
+	// in memory only mode, the file keeps the allocation
+	s2.MemoryOnly()
+	require.NoError(t, s2.Release(k1))
+	assert.Len(t, s2.Allocations(), 2)
+	s3, err := LoadStore(path, pools)
+	require.NoError(t, err)
+	_, ok = s3.Get(k1)
+	assert.True(t, ok)
+
+	// a failed save still frees the addresses
+	s4, err := LoadStore(path, pools)
+	require.NoError(t, err)
+	s4.file = util.NewStoreFile(filepath.Join(dir, "missing", "addresses.json"))
+	assert.Error(t, s4.Release(k1))
+	_, ok = s4.Get(k1)
+	assert.False(t, ok)
+}
+
+func TestStore_saveFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wirelink-ipam")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := LoadStore(filepath.Join(dir, "missing", "addresses.json"), mustPools(t, "10.1.0.0/24"))
+	require.NoError(t, err)
+	_, err = s.Allocate(testutils.MustKey(t), nil, nil)
+	assert.Error(t, err)
+	assert.Empty(t, s.Allocations())
+	assert.Empty(t, s.keys)
+}
+
+func TestLoadStore_errors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wirelink-ipam")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"bad json", "{"},
+		{"bad key", `{"Allocations": [{"PublicKey": "bogus"}]}`},
+		{"bad address", `{"Allocations": [{"PublicKey": "` + wgtypes.Key{}.String() + `", "Addresses": ["bogus"]}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "addresses.json")
+			require.NoError(t, ioutil.WriteFile(path, []byte(tt.data), 0600))
+			_, err := LoadStore(path, nil)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Format is the output format for log messages
+type Format int
+
+const (
+	// FormatText writes plain text messages, with any fields appended as
+	// key=value pairs
+	FormatText Format = iota
+	// FormatJSON writes each message as a single line JSON object
+	FormatJSON
+	// FormatJournald sends messages directly to the systemd journal, with
+	// fields as native journal fields
+	FormatJournald
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatText:
+		return "text"
+	case FormatJSON:
+		return "json"
+	case FormatJournald:
+		return "journald"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseFormat converts the name of a format back into a Format
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "text":
+		return FormatText, nil
+	case "json":
+		return FormatJSON, nil
+	case "journald":
+		return FormatJournald, nil
+	default:
+		return FormatText, errors.Errorf("Unrecognized log format '%s'", name)
+	}
+}
+
+// entry is a single message to be logged
+type entry struct {
+	time      time.Time
+	level     Level
+	subsystem string
+	message   string
+	fields    Fields
+}
+
+// output is something that can write log entries
+type output interface {
+	write(*entry)
+}
+
+var outputAccess sync.RWMutex
+var currentFormat = FormatText
+var current output = &textOutput{stdout: os.Stdout, stderr: os.Stderr}
+
+func currentOutput() output {
+	outputAccess.RLock()
+	defer outputAccess.RUnlock()
+	return current
+}
+
+func setOutput(format Format, o output) {
+	outputAccess.Lock()
+	defer outputAccess.Unlock()
+	if closer, ok := current.(io.Closer); ok {
+		//nolint:errcheck // nothing useful to do if this fails
+		closer.Close()
+	}
+	currentFormat = format
+	current = o
+}
+
+// SetFormat changes the output format for all log messages. For
+// FormatJournald, this will fail if the journal socket cannot be opened.
+func SetFormat(format Format) error {
+	switch format {
+	case FormatText:
+		setOutput(format, &textOutput{stdout: os.Stdout, stderr: os.Stderr})
+	case FormatJSON:
+		setOutput(format, &jsonOutput{stdout: os.Stdout, stderr: os.Stderr})
+	case FormatJournald:
+		jo, err := newJournalOutput(journalSocket)
+		if err != nil {
+			return err
+		}
+		setOutput(format, jo)
+	default:
+		return errors.Errorf("Unrecognized log format %d", int(format))
+	}
+	return nil
+}
+
+// GetFormat returns the current output format
+func GetFormat() Format {
+	outputAccess.RLock()
+	defer outputAccess.RUnlock()
+	return currentFormat
+}
+
+// fieldValue converts a field value to something that will render usefully
+// in text or JSON, mostly so that things like keys don't render as byte arrays
+func fieldValue(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case nil, string, bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		return vv
+	case error:
+		return vv.Error()
+	case fmt.Stringer:
+		return vv.String()
+	default:
+		return fmt.Sprintf("%v", vv)
+	}
+}
+
+func sortedKeys(fields Fields) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// textOutput writes messages in the traditional format
+type textOutput struct {
+	access sync.Mutex
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func (o *textOutput) write(e *entry) {
+	var sb strings.Builder
+	if debugEnabled || e.level == LevelDebug {
+		sb.WriteString(debugOffset())
+		sb.WriteByte(' ')
+	}
+	sb.WriteString(strings.TrimSuffix(e.message, "\n"))
+	for _, k := range sortedKeys(e.fields) {
+		s := fmt.Sprintf("%v", fieldValue(e.fields[k]))
+		if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+			s = strconv.Quote(s)
+		}
+		sb.WriteByte(' ')
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(s)
+	}
+	sb.WriteByte('\n')
+
+	o.access.Lock()
+	defer o.access.Unlock()
+	w := o.stdout
+	if e.level >= LevelError {
+		w = o.stderr
+	}
+	//nolint:errcheck // errors are ignored
+	io.WriteString(w, sb.String())
+}
+
+// jsonOutput writes messages as JSON lines
+type jsonOutput struct {
+	access sync.Mutex
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func (o *jsonOutput) write(e *entry) {
+	data := make(map[string]interface{}, len(e.fields)+4)
+	for k, v := range e.fields {
+		data[k] = fieldValue(v)
+	}
+	// the standard keys win over any fields with the same name
+	data["time"] = e.time.Format(time.RFC3339Nano)
+	data["level"] = e.level.String()
+	data["msg"] = strings.TrimSuffix(e.message, "\n")
+	if e.subsystem != "" {
+		data["subsystem"] = e.subsystem
+	}
+	line, err := json.Marshal(data)
+	if err != nil {
+		// should never happen since fieldValue only returns simple values
+		line = []byte(strconv.Quote(fmt.Sprintf("%v", data)))
+	}
+	line = append(line, '\n')
+
+	o.access.Lock()
+	defer o.access.Unlock()
+	w := o.stdout
+	if e.level >= LevelError {
+		w = o.stderr
+	}
+	//nolint:errcheck // errors are ignored
+	w.Write(line)
+}
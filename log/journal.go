@@ -0,0 +1,119 @@
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// journalSocket is where journald listens for native protocol messages
+var journalSocket = "/run/systemd/journal/socket"
+
+// journalIdentifier is sent as SYSLOG_IDENTIFIER
+const journalIdentifier = "wirelink"
+
+// journalOutput sends messages to journald using its native protocol, see
+// https://systemd.io/JOURNAL_NATIVE_PROTOCOL/
+type journalOutput struct {
+	conn net.Conn
+	// fallback is used if sending to the journal fails
+	fallback output
+}
+
+func newJournalOutput(socket string) (*journalOutput, error) {
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to connect to journal at %s", socket)
+	}
+	return &journalOutput{
+		conn:     conn,
+		fallback: &textOutput{stdout: os.Stdout, stderr: os.Stderr},
+	}, nil
+}
+
+// journalPriority maps levels to syslog priorities
+func journalPriority(level Level) int {
+	switch level {
+	case LevelDebug:
+		return 7
+	case LevelInfo:
+		return 6
+	default:
+		return 3
+	}
+}
+
+// journalFieldName converts a field name to the restricted form journald
+// accepts: upper case letters, digits, and underscores, not starting with an
+// underscore (those are reserved for trusted fields)
+func journalFieldName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		default:
+			return '_'
+		}
+	}, name)
+	name = strings.TrimLeft(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "F_" + name
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+func appendJournalField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if strings.IndexByte(value, '\n') < 0 {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	// values with newlines have to use the binary format
+	buf.WriteByte('\n')
+	//nolint:errcheck // writes to a bytes.Buffer can't fail
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+func (o *journalOutput) encode(e *entry) []byte {
+	var buf bytes.Buffer
+	appendJournalField(&buf, "MESSAGE", strings.TrimSuffix(e.message, "\n"))
+	appendJournalField(&buf, "PRIORITY", fmt.Sprintf("%d", journalPriority(e.level)))
+	appendJournalField(&buf, "SYSLOG_IDENTIFIER", journalIdentifier)
+	if e.subsystem != "" {
+		appendJournalField(&buf, "WIRELINK_SUBSYSTEM", e.subsystem)
+	}
+	for _, k := range sortedKeys(e.fields) {
+		name := journalFieldName(k)
+		switch name {
+		case "MESSAGE", "PRIORITY", "SYSLOG_IDENTIFIER", "WIRELINK_SUBSYSTEM":
+			// don't let fields clobber the standard ones
+			name = "WIRELINK_" + name
+		}
+		appendJournalField(&buf, name, fmt.Sprintf("%v", fieldValue(e.fields[k])))
+	}
+	return buf.Bytes()
+}
+
+func (o *journalOutput) write(e *entry) {
+	if _, err := o.conn.Write(o.encode(e)); err != nil {
+		o.fallback.write(e)
+	}
+}
+
+func (o *journalOutput) Close() error {
+	return o.conn.Close()
+}
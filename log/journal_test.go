@@ -0,0 +1,74 @@
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournalFieldName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"peer", "PEER"},
+		{"peer-key", "PEER_KEY"},
+		{"_trusted", "TRUSTED"},
+		{"2fa", "F_2FA"},
+		{"", "F_"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, journalFieldName(tt.name))
+		})
+	}
+}
+
+func TestJournalOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wirelink-journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "socket")
+
+	server, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.NoError(t, err)
+	defer server.Close()
+
+	jo, err := newJournalOutput(socket)
+	require.NoError(t, err)
+	defer jo.Close()
+
+	jo.write(&entry{
+		time:      time.Now(),
+		level:     LevelError,
+		subsystem: "trust",
+		message:   "two\nlines\n",
+		fields:    Fields{"peer": "alice", "message": "clash"},
+	})
+
+	buf := make([]byte, 4096)
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := server.Read(buf)
+	require.NoError(t, err)
+
+	var want bytes.Buffer
+	want.WriteString("MESSAGE\n")
+	require.NoError(t, binary.Write(&want, binary.LittleEndian, uint64(len("two\nlines"))))
+	want.WriteString("two\nlines\n")
+	want.WriteString("PRIORITY=3\nSYSLOG_IDENTIFIER=wirelink\nWIRELINK_SUBSYSTEM=trust\n")
+	want.WriteString("WIRELINK_MESSAGE=clash\nPEER=alice\n")
+	assert.Equal(t, want.String(), string(buf[:n]))
+}
+
+func TestNewJournalOutput_missing(t *testing.T) {
+	_, err := newJournalOutput(filepath.Join(os.TempDir(), "wirelink-no-such-journal"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,128 @@
+package log
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Level is the severity of a log message
+type Level int
+
+const (
+	// LevelDebug is for detailed messages that are normally hidden
+	LevelDebug Level = iota
+	// LevelInfo is for normal operational messages
+	LevelInfo
+	// LevelError is for problems
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseLevel converts the name of a level back into a Level
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelInfo, errors.Errorf("Unrecognized log level '%s'", name)
+	}
+}
+
+var levelAccess sync.RWMutex
+var defaultLevel = LevelInfo
+var subsystemLevels = map[string]Level{}
+
+func setDefaultLevel(level Level) {
+	levelAccess.Lock()
+	defaultLevel = level
+	levelAccess.Unlock()
+}
+
+// SetLevel sets the minimum level that will be logged for the given subsystem,
+// or the default for all subsystems if the subsystem is empty.
+func SetLevel(subsystem string, level Level) {
+	levelAccess.Lock()
+	defer levelAccess.Unlock()
+	if subsystem == "" {
+		defaultLevel = level
+	} else {
+		subsystemLevels[subsystem] = level
+	}
+}
+
+// ResetLevels clears all the per-subsystem levels and sets the default level
+// back to what it would be from SetDebug.
+func ResetLevels() {
+	levelAccess.Lock()
+	defer levelAccess.Unlock()
+	subsystemLevels = map[string]Level{}
+	if debugEnabled {
+		defaultLevel = LevelDebug
+	} else {
+		defaultLevel = LevelInfo
+	}
+}
+
+// SetLevels parses a level specification and applies it. The specification is
+// a comma separated list of either `subsystem=level` entries, or bare levels
+// which set the default level, e.g. `info,trust=debug`.
+func SetLevels(spec string) error {
+	type entry struct {
+		subsystem string
+		level     Level
+	}
+	var entries []entry
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		var e entry
+		levelName := item
+		if eq := strings.IndexByte(item, '='); eq >= 0 {
+			e.subsystem = strings.TrimSpace(item[:eq])
+			levelName = item[eq+1:]
+			if e.subsystem == "" {
+				return errors.Errorf("Missing subsystem in log level '%s'", item)
+			}
+		}
+		var err error
+		if e.level, err = ParseLevel(levelName); err != nil {
+			return err
+		}
+		entries = append(entries, e)
+	}
+	// don't apply anything unless it all parsed
+	for _, e := range entries {
+		SetLevel(e.subsystem, e.level)
+	}
+	return nil
+}
+
+// levelFor gets the minimum level to log for a subsystem
+func levelFor(subsystem string) Level {
+	levelAccess.RLock()
+	defer levelAccess.RUnlock()
+	if level, ok := subsystemLevels[subsystem]; ok {
+		return level
+	}
+	return defaultLevel
+}
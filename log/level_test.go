@@ -0,0 +1,82 @@
+package log
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Level
+		wantErr bool
+	}{
+		{"debug", LevelDebug, false},
+		{"Info", LevelInfo, false},
+		{" error ", LevelError, false},
+		{"verbose", LevelInfo, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLevel(tt.name)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestSetLevels(t *testing.T) {
+	defer ResetLevels()
+
+	tests := []struct {
+		name    string
+		spec    string
+		want    map[string]Level
+		wantErr bool
+	}{
+		{"empty", "", map[string]Level{"": LevelInfo, "trust": LevelInfo}, false},
+		{"default only", "error", map[string]Level{"": LevelError, "trust": LevelError}, false},
+		{
+			"mixed",
+			"info, trust=debug,apply=error",
+			map[string]Level{"": LevelInfo, "trust": LevelDebug, "apply": LevelError, "server": LevelInfo},
+			false,
+		},
+		{"bad level", "trust=loud", map[string]Level{"": LevelInfo, "trust": LevelInfo}, true},
+		{"missing subsystem", "error,=debug", map[string]Level{"": LevelInfo}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetDebug(false)
+			ResetLevels()
+			err := SetLevels(tt.spec)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			for subsystem, level := range tt.want {
+				assert.Equal(t, level, levelFor(subsystem), "level for '%s'", subsystem)
+			}
+		})
+	}
+}
+
+func TestSetDebug_levels(t *testing.T) {
+	defer SetDebug(debugEnabled)
+	defer ResetLevels()
+
+	ResetLevels()
+	SetLevel("trust", LevelError)
+	SetDebug(true)
+	assert.Equal(t, LevelDebug, levelFor("server"))
+	assert.Equal(t, LevelError, levelFor("trust"), "explicit levels should override debug")
+	SetDebug(false)
+	assert.Equal(t, LevelInfo, levelFor("server"))
+}
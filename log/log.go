@@ -1,52 +1,38 @@
-// Package log is a bit of a ridiculous package to have, but the built in `log` package
-// always writes to stderr, and fancy structured logging isn't what this tool needs
+// Package log is a bit of a ridiculous package to have, but the built in `log`
+// package always writes to stderr. It provides simple printf style logging,
+// with optional structured fields, per-subsystem levels, and alternate output
+// formats (JSON lines or the native journald protocol) for feeding log
+// pipelines.
 package log
 
 import (
-	"fmt"
-	"os"
 	"time"
 )
 
-// TODO: copy efficient buffer management from core `log` package
-
 // Info writes a formatted string with an appended newline to Stdout.
 // errors are ignored.
 func Info(format string, a ...interface{}) {
-	if format[len(format)-1] != '\n' {
-		format = format + "\n"
-	}
-	if debugEnabled {
-		// format = time.Now().Format(debugStampFormat) + " " + format
-		format = debugOffset() + " " + format
-	}
-	os.Stdout.WriteString(fmt.Sprintf(format, a...))
+	root.Info(format, a...)
 }
 
 // Error writes a formatted string with an appended newline to Stderr.
 // errors are ignored.
 func Error(format string, a ...interface{}) {
-	if format[len(format)-1] != '\n' {
-		format = format + "\n"
-	}
-	if debugEnabled {
-		// format = time.Now().Format(debugStampFormat) + " " + format
-		format = debugOffset() + " " + format
-	}
-	os.Stderr.WriteString(fmt.Sprintf(format, a...))
+	root.Error(format, a...)
 }
 
 var debugEnabled bool
-var debugReference time.Time
-
-// similar to RFC3339
-// const debugStampFormat = "2006-01-02T15:04:05.999"
+var debugReference = time.Now()
 
-// SetDebug controls whether Debug does anything
+// SetDebug controls whether Debug does anything, and sets the default level
+// for all subsystems that don't have an explicit level set.
 func SetDebug(enabled bool) {
 	debugEnabled = enabled
 	if enabled {
 		debugReference = time.Now()
+		setDefaultLevel(LevelDebug)
+	} else {
+		setDefaultLevel(LevelInfo)
 	}
 }
 
@@ -62,13 +48,5 @@ func IsDebug() bool {
 // Debug writes a formatted string with an appended newline to Stdout, if enabled.
 // errors are ignored.
 func Debug(format string, a ...interface{}) {
-	if !debugEnabled {
-		return
-	}
-	if format[len(format)-1] != '\n' {
-		format = format + "\n"
-	}
-	// format = time.Now().Format(debugStampFormat) + " " + format
-	format = debugOffset() + " " + format
-	os.Stdout.WriteString(fmt.Sprintf(format, a...))
+	root.Debug(format, a...)
 }
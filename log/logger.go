@@ -0,0 +1,79 @@
+package log
+
+import (
+	"fmt"
+	"time"
+)
+
+// Fields holds structured data to attach to log messages
+type Fields map[string]interface{}
+
+// Logger writes log messages for a subsystem, with optional fields attached to
+// every message. Loggers are immutable, and so safe to share.
+type Logger struct {
+	subsystem string
+	fields    Fields
+}
+
+// root is the Logger used by the package level functions
+var root = &Logger{}
+
+// For returns a Logger for the named subsystem, whose level can be controlled
+// separately from the others with SetLevel.
+func For(subsystem string) *Logger {
+	return &Logger{subsystem: subsystem}
+}
+
+// With returns a new Logger that adds the given fields to every message, in
+// addition to any fields already on this Logger.
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{subsystem: l.subsystem, fields: merged}
+}
+
+// Subsystem returns the name of the subsystem for the Logger
+func (l *Logger) Subsystem() string {
+	return l.subsystem
+}
+
+// Enabled checks if messages at the given level will be written, so that
+// callers can avoid building expensive fields for messages that will be
+// discarded.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= levelFor(l.subsystem)
+}
+
+// Debug writes a formatted message at LevelDebug
+func (l *Logger) Debug(format string, a ...interface{}) {
+	l.log(LevelDebug, format, a)
+}
+
+// Info writes a formatted message at LevelInfo
+func (l *Logger) Info(format string, a ...interface{}) {
+	l.log(LevelInfo, format, a)
+}
+
+// Error writes a formatted message at LevelError
+func (l *Logger) Error(format string, a ...interface{}) {
+	l.log(LevelError, format, a)
+}
+
+func (l *Logger) log(level Level, format string, a []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	e := &entry{
+		time:      time.Now(),
+		level:     level,
+		subsystem: l.subsystem,
+		message:   fmt.Sprintf(format, a...),
+		fields:    l.fields,
+	}
+	currentOutput().write(e)
+}
@@ -0,0 +1,142 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// captureOutput replaces the current output with one of the given format
+// writing to buffers, returning the buffers and a func to restore the original
+// output.
+func captureOutput(format Format) (stdout, stderr *bytes.Buffer, restore func()) {
+	stdout, stderr = &bytes.Buffer{}, &bytes.Buffer{}
+	var o output
+	switch format {
+	case FormatJSON:
+		o = &jsonOutput{stdout: stdout, stderr: stderr}
+	default:
+		o = &textOutput{stdout: stdout, stderr: stderr}
+	}
+	outputAccess.Lock()
+	oldFormat, oldOutput := currentFormat, current
+	currentFormat, current = format, o
+	outputAccess.Unlock()
+	wasDebug := debugEnabled
+	debugEnabled = false
+	return stdout, stderr, func() {
+		debugEnabled = wasDebug
+		outputAccess.Lock()
+		currentFormat, current = oldFormat, oldOutput
+		outputAccess.Unlock()
+		ResetLevels()
+	}
+}
+
+type stringer struct{}
+
+func (stringer) String() string { return "stringy" }
+
+func TestLogger_text(t *testing.T) {
+	stdout, stderr, restore := captureOutput(FormatText)
+	defer restore()
+	SetLevel("", LevelInfo)
+
+	l := For("trust").With(Fields{"peer": "alice", "note": "two words"})
+	l.Info("accepted %d", 1)
+	l.Debug("hidden")
+	l.With(Fields{"err": errors.New("boom"), "s": stringer{}}).Error("failed")
+	Info("plain\n")
+
+	assert.Equal(t, "accepted 1 note=\"two words\" peer=alice\nplain\n", stdout.String())
+	assert.Equal(t, "failed err=boom note=\"two words\" peer=alice s=stringy\n", stderr.String())
+}
+
+func TestLogger_levels(t *testing.T) {
+	stdout, _, restore := captureOutput(FormatText)
+	defer restore()
+	SetLevel("", LevelInfo)
+	SetLevel("trust", LevelDebug)
+	SetLevel("apply", LevelError)
+
+	trust, apply := For("trust"), For("apply")
+	assert.True(t, trust.Enabled(LevelDebug))
+	assert.False(t, apply.Enabled(LevelInfo))
+	assert.False(t, root.Enabled(LevelDebug))
+
+	trust.Debug("trust debug")
+	apply.Info("apply info")
+	Debug("root debug")
+
+	out := stdout.String()
+	assert.Contains(t, out, "trust debug\n")
+	assert.NotContains(t, out, "apply info")
+	assert.NotContains(t, out, "root debug")
+}
+
+func TestLogger_With(t *testing.T) {
+	base := For("server").With(Fields{"a": 1, "b": 2})
+	derived := base.With(Fields{"b": 3, "c": 4})
+	assert.Equal(t, Fields{"a": 1, "b": 2}, base.fields, "With should not modify the original")
+	assert.Equal(t, Fields{"a": 1, "b": 3, "c": 4}, derived.fields)
+	assert.Equal(t, "server", derived.Subsystem())
+}
+
+func TestLogger_json(t *testing.T) {
+	stdout, stderr, restore := captureOutput(FormatJSON)
+	defer restore()
+	SetLevel("", LevelInfo)
+
+	ip := net.ParseIP("fe80::1")
+	For("trust").With(Fields{"peer": "alice", "ip": ip, "msg": "ignored", "n": 3}).Info("rejected")
+	Error("oops")
+
+	var got map[string]interface{}
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &got))
+	assert.Equal(t, "rejected", got["msg"])
+	assert.Equal(t, "info", got["level"])
+	assert.Equal(t, "trust", got["subsystem"])
+	assert.Equal(t, "alice", got["peer"])
+	assert.Equal(t, "fe80::1", got["ip"])
+	assert.Equal(t, 3.0, got["n"])
+	assert.NotEmpty(t, got["time"])
+
+	lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+	require.Len(t, lines, 1)
+	got = nil
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &got))
+	assert.Equal(t, "oops", got["msg"])
+	assert.Equal(t, "error", got["level"])
+	assert.NotContains(t, got, "subsystem")
+}
+
+func TestParseFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Format
+		wantErr bool
+	}{
+		{"", FormatText, false},
+		{"text", FormatText, false},
+		{"JSON", FormatJSON, false},
+		{"journald", FormatJournald, false},
+		{"xml", FormatText, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseFormat(tt.name)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,4 @@
+// Package roster provides a membership roster for a network, which is signed
+// offline with an administrator held ed25519 root key, and split into pages so
+// that it can be distributed with the normal fact exchange.
+package roster
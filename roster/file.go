@@ -0,0 +1,68 @@
+package roster
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Write saves the pages, one per line, in base64
+func Write(w io.Writer, pages []*Page) error {
+	for _, p := range pages {
+		data, err := p.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if _, err = fmt.Fprintln(w, base64.StdEncoding.EncodeToString(data)); err != nil {
+			return errors.Wrap(err, "Unable to write roster")
+		}
+	}
+	return nil
+}
+
+// Read loads pages in the format Write produces, verifying each one against
+// the root key. Blank lines and lines starting with '#' are ignored.
+func Read(r io.Reader, root ed25519.PublicKey) ([]*Page, error) {
+	var pages []*Page
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to decode roster page on line %d", line)
+		}
+		p := &Page{}
+		if err = p.UnmarshalBinary(data); err != nil {
+			return nil, errors.Wrapf(err, "Unable to parse roster page on line %d", line)
+		}
+		if !p.Verify(root) {
+			return nil, errors.Errorf("Roster page on line %d has a bad signature", line)
+		}
+		pages = append(pages, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Unable to read roster")
+	}
+	return pages, nil
+}
+
+// ReadFile loads and verifies pages from a file
+func ReadFile(path string, root ed25519.PublicKey) ([]*Page, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to open roster file %s", path)
+	}
+	defer f.Close()
+	return Read(f, root)
+}
@@ -0,0 +1,56 @@
+package roster
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteRead(t *testing.T) {
+	priv, err := GenerateKey()
+	require.NoError(t, err)
+	pub := priv.Public().(ed25519.PublicKey)
+	other, err := GenerateKey()
+	require.NoError(t, err)
+
+	pages, err := Sign(priv, 5, time.Now().Add(time.Hour), testMembers(t, 50))
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("# roster serial 5\n\n")
+	require.NoError(t, Write(buf, pages))
+	text := buf.String()
+
+	got, err := Read(strings.NewReader(text), pub)
+	require.NoError(t, err)
+	require.Len(t, got, len(pages))
+	for i := range got {
+		assert.Equal(t, pages[i].Signature, got[i].Signature)
+	}
+
+	_, err = Read(strings.NewReader(text), other.Public().(ed25519.PublicKey))
+	assert.Error(t, err)
+	_, err = Read(strings.NewReader("garbage!\n"), pub)
+	assert.Error(t, err)
+	_, err = Read(strings.NewReader("AAAA\n"), pub)
+	assert.Error(t, err)
+
+	dir, err := ioutil.TempDir("", "roster-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "roster")
+	require.NoError(t, ioutil.WriteFile(path, []byte(text), 0644))
+	got, err = ReadFile(path, pub)
+	require.NoError(t, err)
+	assert.Len(t, got, len(pages))
+	_, err = ReadFile(filepath.Join(dir, "missing"), pub)
+	assert.Error(t, err)
+}
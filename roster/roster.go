@@ -0,0 +1,237 @@
+package roster
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/fastcat/wirelink/fact"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// signaturePrefix separates roster signatures from any other use of the key
+const signaturePrefix = "wirelink roster v2\x00"
+
+// factOverhead is the most space the attribute, TTL, and subject take in a fact
+// about a peer
+const factOverhead = 1 + binary.MaxVarintLen16 + wgtypes.KeyLen
+
+// MaxPageSize is the largest encoded page that will fit in a fact in a signed
+// group: the group limit, minus room for the one byte gossip header fact, the
+// fact overhead, and the value length prefix
+const MaxPageSize = fact.SignedGroupMaxSafeInnerLength -
+	(factOverhead + 1) - factOverhead - binary.MaxVarintLen16
+
+// Member is a single peer listed in the roster
+type Member struct {
+	PublicKey  wgtypes.Key
+	Name       string
+	AllowedIPs []net.IPNet
+}
+
+// Page is one signed part of a roster. All the pages with the same Serial
+// together make up the full roster.
+type Page struct {
+	Serial uint64
+	// NotAfter is when the roster stops being valid, so that the holder of the
+	// root key can revoke it by not signing a new one
+	NotAfter time.Time
+	Index    int
+	Count    int
+	Members  []Member
+	// Signature is the ed25519 signature of the rest of the page
+	Signature []byte
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	l := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:l]...)
+}
+
+func appendMember(buf []byte, m *Member) []byte {
+	buf = append(buf, m.PublicKey[:]...)
+	buf = appendUvarint(buf, uint64(len(m.Name)))
+	buf = append(buf, m.Name...)
+	buf = appendUvarint(buf, uint64(len(m.AllowedIPs)))
+	for _, aip := range m.AllowedIPs {
+		ip := aip.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		ones, _ := aip.Mask.Size()
+		buf = append(buf, byte(len(ip)))
+		buf = append(buf, ip...)
+		buf = append(buf, byte(ones))
+	}
+	return buf
+}
+
+// body is the signed part of the page
+func (p *Page) body() []byte {
+	buf := make([]byte, 0, MaxPageSize)
+	buf = appendUvarint(buf, p.Serial)
+	buf = appendUvarint(buf, uint64(p.NotAfter.Unix()))
+	buf = appendUvarint(buf, uint64(p.Index))
+	buf = appendUvarint(buf, uint64(p.Count))
+	buf = appendUvarint(buf, uint64(len(p.Members)))
+	for i := range p.Members {
+		buf = appendMember(buf, &p.Members[i])
+	}
+	return buf
+}
+
+// MarshalBinary encodes the page, including its signature
+func (p *Page) MarshalBinary() ([]byte, error) {
+	if len(p.Signature) != ed25519.SignatureSize {
+		return nil, errors.Errorf("Roster page is not signed")
+	}
+	return append(p.body(), p.Signature...), nil
+}
+
+// UnmarshalBinary decodes a page, without verifying its signature
+func (p *Page) UnmarshalBinary(data []byte) error {
+	if len(data) < ed25519.SignatureSize {
+		return errors.Errorf("Roster page too short: %d bytes", len(data))
+	}
+	body := bytes.NewReader(data[:len(data)-ed25519.SignatureSize])
+	readUvarint := func(what string, max uint64) (uint64, error) {
+		v, err := binary.ReadUvarint(body)
+		if err != nil {
+			return 0, errors.Wrapf(err, "Unable to read roster %s", what)
+		} else if v > max {
+			return 0, errors.Errorf("Roster %s out of range: %d", what, v)
+		}
+		return v, nil
+	}
+	var err error
+	var v uint64
+	if p.Serial, err = readUvarint("serial", ^uint64(0)); err != nil {
+		return err
+	}
+	if v, err = readUvarint("expiration", math.MaxInt64); err != nil {
+		return err
+	}
+	p.NotAfter = time.Unix(int64(v), 0)
+	if v, err = readUvarint("page index", MaxPageSize); err != nil {
+		return err
+	}
+	p.Index = int(v)
+	if v, err = readUvarint("page count", MaxPageSize); err != nil {
+		return err
+	}
+	p.Count = int(v)
+	if p.Index >= p.Count {
+		return errors.Errorf("Roster page index %d out of range for %d pages", p.Index, p.Count)
+	}
+	numMembers, err := readUvarint("member count", MaxPageSize)
+	if err != nil {
+		return err
+	}
+	p.Members = make([]Member, numMembers)
+	for i := range p.Members {
+		m := &p.Members[i]
+		if _, err = io.ReadFull(body, m.PublicKey[:]); err != nil {
+			return errors.Wrap(err, "Unable to read roster member key")
+		}
+		if v, err = readUvarint("member name length", MaxPageSize); err != nil {
+			return err
+		}
+		name := make([]byte, v)
+		if _, err = io.ReadFull(body, name); err != nil {
+			return errors.Wrap(err, "Unable to read roster member name")
+		}
+		m.Name = string(name)
+		if v, err = readUvarint("member AllowedIPs count", MaxPageSize); err != nil {
+			return err
+		}
+		m.AllowedIPs = make([]net.IPNet, v)
+		for j := range m.AllowedIPs {
+			ipLen, err := body.ReadByte()
+			if err != nil {
+				return errors.Wrap(err, "Unable to read roster AllowedIP")
+			} else if ipLen != net.IPv4len && ipLen != net.IPv6len {
+				return errors.Errorf("Invalid roster AllowedIP length %d", ipLen)
+			}
+			ip := make(net.IP, ipLen)
+			if _, err = io.ReadFull(body, ip); err != nil {
+				return errors.Wrap(err, "Unable to read roster AllowedIP")
+			}
+			ones, err := body.ReadByte()
+			if err != nil {
+				return errors.Wrap(err, "Unable to read roster AllowedIP")
+			} else if int(ones) > 8*int(ipLen) {
+				return errors.Errorf("Invalid roster AllowedIP prefix length %d", ones)
+			}
+			m.AllowedIPs[j] = net.IPNet{IP: ip, Mask: net.CIDRMask(int(ones), 8*int(ipLen))}
+		}
+	}
+	if body.Len() != 0 {
+		return errors.Errorf("Roster page has %d extra bytes", body.Len())
+	}
+	p.Signature = append([]byte(nil), data[len(data)-ed25519.SignatureSize:]...)
+	return nil
+}
+
+func (p *Page) signedMessage() []byte {
+	return append([]byte(signaturePrefix), p.body()...)
+}
+
+// Expired checks if the page is past its signed expiration
+func (p *Page) Expired(now time.Time) bool {
+	return !p.NotAfter.After(now)
+}
+
+// Verify checks the page signature against the root key
+func (p *Page) Verify(root ed25519.PublicKey) bool {
+	return len(root) == ed25519.PublicKeySize &&
+		len(p.Signature) == ed25519.SignatureSize &&
+		ed25519.Verify(root, p.signedMessage(), p.Signature)
+}
+
+// Fact wraps the page in a fact to send to peers
+func (p *Page) Fact(root ed25519.PublicKey, expires time.Time) (*fact.Fact, error) {
+	data, err := p.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	subject := &fact.PeerSubject{}
+	copy(subject.Key[:], root)
+	return &fact.Fact{
+		Attribute: fact.AttributeRoster,
+		Subject:   subject,
+		Value:     &fact.RosterValue{Data: data},
+		Expires:   expires,
+	}, nil
+}
+
+// FromFact parses and verifies a roster page from a fact. It fails if the fact
+// is not a roster page signed by the given root key.
+func FromFact(f *fact.Fact, root ed25519.PublicKey) (*Page, error) {
+	if f.Attribute != fact.AttributeRoster {
+		return nil, errors.Errorf("Not a roster fact: %v", f.Attribute)
+	}
+	ps, ok := f.Subject.(*fact.PeerSubject)
+	if !ok || !bytes.Equal(ps.Key[:], root) {
+		return nil, errors.Errorf("Roster fact is not for our root key")
+	}
+	rv, ok := f.Value.(*fact.RosterValue)
+	if !ok {
+		return nil, errors.Errorf("Roster fact has wrong value type: %T", f.Value)
+	}
+	p := &Page{}
+	if err := p.UnmarshalBinary(rv.Data); err != nil {
+		return nil, err
+	}
+	if !p.Verify(root) {
+		return nil, errors.Errorf("Roster page %d/%d of serial %d has a bad signature", p.Index+1, p.Count, p.Serial)
+	}
+	return p, nil
+}
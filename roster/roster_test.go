@@ -0,0 +1,143 @@
+package roster
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/internal/testutils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testMembers(t *testing.T, n int) []Member {
+	ret := make([]Member, n)
+	for i := range ret {
+		ret[i] = Member{
+			PublicKey: testutils.MustKey(t),
+			Name:      "member",
+			AllowedIPs: []net.IPNet{
+				testutils.MakeIPv4Net(10, byte(i), 0, 0, 24),
+				testutils.MakeIPv6Net([]byte{0xfd, byte(i)}, []byte{1}, 64),
+			},
+		}
+	}
+	return ret
+}
+
+func TestPage_MarshalBinary(t *testing.T) {
+	priv, err := GenerateKey()
+	require.NoError(t, err)
+	pub := priv.Public().(ed25519.PublicKey)
+
+	pages, err := Sign(priv, 7, time.Now().Add(time.Hour), testMembers(t, 3))
+	require.NoError(t, err)
+	require.Len(t, pages, 1)
+	page := pages[0]
+	assert.True(t, page.Verify(pub))
+
+	data, err := page.MarshalBinary()
+	require.NoError(t, err)
+	assert.LessOrEqual(t, len(data), MaxPageSize)
+
+	parsed := &Page{}
+	require.NoError(t, parsed.UnmarshalBinary(data))
+	assert.Equal(t, page.Serial, parsed.Serial)
+	assert.Equal(t, page.NotAfter, parsed.NotAfter)
+	assert.Equal(t, page.Index, parsed.Index)
+	assert.Equal(t, page.Count, parsed.Count)
+	assert.Equal(t, page.Signature, parsed.Signature)
+	require.Len(t, parsed.Members, len(page.Members))
+	for i, m := range parsed.Members {
+		assert.Equal(t, page.Members[i].PublicKey, m.PublicKey)
+		assert.Equal(t, page.Members[i].Name, m.Name)
+		require.Len(t, m.AllowedIPs, len(page.Members[i].AllowedIPs))
+		for j, aip := range m.AllowedIPs {
+			assert.Equal(t, page.Members[i].AllowedIPs[j].String(), aip.String())
+		}
+	}
+	assert.True(t, parsed.Verify(pub))
+
+	// tampering with any part breaks the signature
+	for _, i := range []int{0, len(data) / 2, len(data) - 1} {
+		bad := append([]byte(nil), data...)
+		bad[i] ^= 1
+		badPage := &Page{}
+		if badPage.UnmarshalBinary(bad) == nil {
+			assert.False(t, badPage.Verify(pub), "tampered byte %d", i)
+		}
+	}
+
+	// wrong key doesn't verify
+	other, err := GenerateKey()
+	require.NoError(t, err)
+	assert.False(t, parsed.Verify(other.Public().(ed25519.PublicKey)))
+
+	unsigned := &Page{Serial: 1, Count: 1}
+	_, err = unsigned.MarshalBinary()
+	assert.Error(t, err)
+}
+
+func TestPage_UnmarshalBinary_errors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short", make([]byte, 10)},
+		{"index out of range", append([]byte{1, 1, 1, 0}, make([]byte, 64)...)},
+		{"truncated member", append([]byte{1, 0, 1, 1, 2, 3}, make([]byte, 64)...)},
+		{"extra bytes", append([]byte{1, 0, 1, 0, 9}, make([]byte, 64)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Error(t, (&Page{}).UnmarshalBinary(tt.data))
+		})
+	}
+}
+
+func TestFromFact(t *testing.T) {
+	now := time.Now()
+	priv, err := GenerateKey()
+	require.NoError(t, err)
+	pub := priv.Public().(ed25519.PublicKey)
+	other, err := GenerateKey()
+	require.NoError(t, err)
+
+	pages, err := Sign(priv, 1, time.Now().Add(time.Hour), testMembers(t, 2))
+	require.NoError(t, err)
+	f, err := pages[0].Fact(pub, now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, fact.AttributeRoster, f.Attribute)
+
+	// round trip through the wire format
+	data, err := f.MarshalBinary()
+	require.NoError(t, err)
+	decoded := &fact.Fact{}
+	require.NoError(t, decoded.DecodeFrom(len(data), now, bytes.NewBuffer(data)))
+
+	page, err := FromFact(decoded, pub)
+	require.NoError(t, err)
+	assert.Equal(t, pages[0].Members[0].PublicKey, page.Members[0].PublicKey)
+
+	_, err = FromFact(decoded, other.Public().(ed25519.PublicKey))
+	assert.Error(t, err, "wrong root key")
+
+	otherPages, err := Sign(other, 1, time.Now().Add(time.Hour), testMembers(t, 1))
+	require.NoError(t, err)
+	forged, err := otherPages[0].Fact(pub, now.Add(time.Minute))
+	require.NoError(t, err)
+	_, err = FromFact(forged, pub)
+	assert.Error(t, err, "signed by the wrong key")
+
+	_, err = FromFact(&fact.Fact{
+		Attribute: fact.AttributeMember,
+		Subject:   decoded.Subject,
+		Value:     &fact.EmptyValue{},
+	}, pub)
+	assert.Error(t, err, "wrong attribute")
+}
@@ -0,0 +1,82 @@
+package roster
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/fastcat/wirelink/util"
+)
+
+type serialData struct {
+	Serial uint64
+}
+
+// SerialStore persists the highest roster serial that has been used, so that
+// older rosters, which anyone may have kept a copy of, are rejected even after
+// a restart
+type SerialStore struct {
+	access  sync.Mutex
+	file    *util.StoreFile
+	highest uint64
+}
+
+// LoadSerialStore reads the highest serial from the given file. A missing file
+// is treated as not having seen any roster. An empty path makes a store that
+// is only kept in memory.
+func LoadSerialStore(path string) (*SerialStore, error) {
+	s := &SerialStore{file: util.NewStoreFile(path)}
+	if path == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Unable to read roster serial %s", path)
+	}
+	var sd serialData
+	if err = json.Unmarshal(data, &sd); err != nil {
+		return nil, errors.Wrapf(err, "Unable to parse roster serial %s", path)
+	}
+	s.highest = sd.Serial
+	return s, nil
+}
+
+// MemoryOnly stops higher serials from being written to the file, so that a
+// roster seen during a dry run doesn't make an older one be rejected after it
+func (s *SerialStore) MemoryOnly() {
+	s.file.MemoryOnly()
+}
+
+// Highest returns the highest serial that has been used
+func (s *SerialStore) Highest() uint64 {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return s.highest
+}
+
+// Update raises the highest serial, if the given one is higher, and saves the
+// store, returning whether it changed. If it can't be saved, the new serial is
+// still used until the next restart.
+func (s *SerialStore) Update(serial uint64) (bool, error) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if serial <= s.highest {
+		return false, nil
+	}
+	s.highest = serial
+	return true, s.save()
+}
+
+// save writes the store to its file
+func (s *SerialStore) save() error {
+	data, err := json.MarshalIndent(&serialData{Serial: s.highest}, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Unable to encode roster serial")
+	}
+	return errors.Wrapf(s.file.Save(data), "Unable to save roster serial %s", s.file.Path())
+}
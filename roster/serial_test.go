@@ -0,0 +1,61 @@
+package roster
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSerialStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wirelink-roster")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "roster-serial.json")
+
+	s, err := LoadSerialStore(path)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), s.Highest())
+
+	changed, err := s.Update(3)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	changed, err = s.Update(2)
+	require.NoError(t, err)
+	assert.False(t, changed, "should not go back to an older serial")
+	changed, err = s.Update(3)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, uint64(3), s.Highest())
+
+	// the serial survives reloading
+	s, err = LoadSerialStore(path)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), s.Highest())
+
+	// memory only changes are not saved
+	s.MemoryOnly()
+	changed, err = s.Update(5)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, uint64(5), s.Highest())
+	s, err = LoadSerialStore(path)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), s.Highest())
+
+	// no path is memory only
+	s, err = LoadSerialStore("")
+	require.NoError(t, err)
+	changed, err = s.Update(1)
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("{"), 0600))
+	_, err = LoadSerialStore(path)
+	assert.Error(t, err)
+	_, err = LoadSerialStore(dir)
+	assert.Error(t, err)
+}
@@ -0,0 +1,124 @@
+package roster
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// pageHeaderMax is the most space the serial, expiration, index, and counts
+// can take in a page body
+const pageHeaderMax = 5 * binary.MaxVarintLen64
+
+// GenerateKey creates a new random root key
+func GenerateKey() (ed25519.PrivateKey, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	return priv, errors.Wrap(err, "Unable to generate roster key")
+}
+
+// EncodePrivateKey formats a root private key as base64 of its seed
+func EncodePrivateKey(priv ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(priv.Seed())
+}
+
+// EncodePublicKey formats a root public key as base64
+func EncodePublicKey(pub ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(pub)
+}
+
+// ParsePrivateKey parses a root private key from the format EncodePrivateKey
+// produces
+func ParsePrivateKey(s string) (ed25519.PrivateKey, error) {
+	seed, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to decode roster private key")
+	} else if len(seed) != ed25519.SeedSize {
+		return nil, errors.Errorf("Roster private key has wrong length %d", len(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ParsePublicKey parses a root public key from the format EncodePublicKey
+// produces
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	pub, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to decode roster public key")
+	} else if len(pub) != ed25519.PublicKeySize {
+		return nil, errors.Errorf("Roster public key has wrong length %d", len(pub))
+	}
+	return ed25519.PublicKey(pub), nil
+}
+
+// Sign splits the members into as many pages as are needed to fit each one in
+// a fact, and signs each page with the root key, valid until notAfter, which is
+// kept to the second.
+func Sign(priv ed25519.PrivateKey, serial uint64, notAfter time.Time, members []Member) ([]*Page, error) {
+	if notAfter.Unix() < 0 {
+		return nil, errors.Errorf("Roster expiration %v is out of range", notAfter)
+	}
+	notAfter = time.Unix(notAfter.Unix(), 0)
+	var pages []*Page
+	page := &Page{Serial: serial, NotAfter: notAfter}
+	size := pageHeaderMax + ed25519.SignatureSize
+	for i := range members {
+		msize := len(appendMember(nil, &members[i]))
+		if pageHeaderMax+ed25519.SignatureSize+msize > MaxPageSize {
+			return nil, errors.Errorf("Roster member %s is too large to fit in a page", members[i].PublicKey)
+		}
+		if size+msize > MaxPageSize {
+			pages = append(pages, page)
+			page = &Page{Serial: serial, NotAfter: notAfter}
+			size = pageHeaderMax + ed25519.SignatureSize
+		}
+		page.Members = append(page.Members, members[i])
+		size += msize
+	}
+	pages = append(pages, page)
+
+	for i, p := range pages {
+		p.Index = i
+		p.Count = len(pages)
+		p.Signature = ed25519.Sign(priv, p.signedMessage())
+	}
+	return pages, nil
+}
+
+// Current finds the newest unexpired roster for which all the pages are
+// present, and returns its serial and members. Pages must already have been
+// verified.
+func Current(pages []*Page, now time.Time) (serial uint64, members []Member, ok bool) {
+	bySerial := make(map[uint64]map[int]*Page)
+	for _, p := range pages {
+		if p.Expired(now) {
+			continue
+		}
+		if bySerial[p.Serial] == nil {
+			bySerial[p.Serial] = make(map[int]*Page)
+		}
+		bySerial[p.Serial][p.Index] = p
+	}
+	for s, ps := range bySerial {
+		if ok && s < serial {
+			continue
+		}
+		complete := true
+		for i := 0; complete && i < len(ps); i++ {
+			p := ps[i]
+			complete = p != nil && p.Count == len(ps)
+		}
+		if !complete {
+			continue
+		}
+		serial, ok = s, true
+		members = members[:0]
+		for i := 0; i < len(ps); i++ {
+			members = append(members, ps[i].Members...)
+		}
+	}
+	return
+}
@@ -0,0 +1,120 @@
+package roster
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeys(t *testing.T) {
+	priv, err := GenerateKey()
+	require.NoError(t, err)
+	pub := priv.Public().(ed25519.PublicKey)
+
+	parsedPriv, err := ParsePrivateKey(EncodePrivateKey(priv))
+	require.NoError(t, err)
+	assert.Equal(t, priv, parsedPriv)
+
+	parsedPub, err := ParsePublicKey(EncodePublicKey(pub))
+	require.NoError(t, err)
+	assert.Equal(t, pub, parsedPub)
+
+	_, err = ParsePrivateKey("not base64!")
+	assert.Error(t, err)
+	_, err = ParsePrivateKey(EncodePublicKey(pub[:16]))
+	assert.Error(t, err)
+	_, err = ParsePublicKey("not base64!")
+	assert.Error(t, err)
+	_, err = ParsePublicKey(EncodePrivateKey(priv) + "AAAA")
+	assert.Error(t, err)
+}
+
+func TestSign(t *testing.T) {
+	priv, err := GenerateKey()
+	require.NoError(t, err)
+	pub := priv.Public().(ed25519.PublicKey)
+	notAfter := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name      string
+		members   int
+		wantMulti bool
+	}{
+		{"empty", 0, false},
+		{"one page", 10, false},
+		{"many pages", 100, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			members := testMembers(t, tt.members)
+			pages, err := Sign(priv, 3, notAfter, members)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantMulti, len(pages) > 1)
+			var all []Member
+			for i, p := range pages {
+				assert.Equal(t, uint64(3), p.Serial)
+				assert.Equal(t, notAfter.Unix(), p.NotAfter.Unix())
+				assert.Equal(t, i, p.Index)
+				assert.Equal(t, len(pages), p.Count)
+				assert.True(t, p.Verify(pub))
+				data, err := p.MarshalBinary()
+				require.NoError(t, err)
+				assert.LessOrEqual(t, len(data), MaxPageSize)
+				all = append(all, p.Members...)
+			}
+			assert.Equal(t, len(members), len(all))
+		})
+	}
+
+	huge := testMembers(t, 1)
+	huge[0].Name = strings.Repeat("x", MaxPageSize)
+	_, err = Sign(priv, 1, notAfter, huge)
+	assert.Error(t, err)
+}
+
+func TestCurrent(t *testing.T) {
+	now := time.Now()
+	priv, err := GenerateKey()
+	require.NoError(t, err)
+
+	members := testMembers(t, 100)
+	v1, err := Sign(priv, 1, now.Add(time.Hour), members[:10])
+	require.NoError(t, err)
+	v2, err := Sign(priv, 2, now.Add(time.Hour), members)
+	require.NoError(t, err)
+	require.True(t, len(v2) > 1)
+	v3, err := Sign(priv, 3, now, members[:5])
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		pages       []*Page
+		wantSerial  uint64
+		wantMembers int
+		wantOK      bool
+	}{
+		{"none", nil, 0, 0, false},
+		{"v1", v1, 1, 10, true},
+		{"v2", v2, 2, 100, true},
+		{"both", append(append([]*Page{}, v2...), v1...), 2, 100, true},
+		{"v2 incomplete", append(append([]*Page{}, v1...), v2[1:]...), 1, 10, true},
+		{"only incomplete", v2[1:], 0, 0, false},
+		{"v3 expired", append(append([]*Page{}, v1...), v3...), 1, 10, true},
+		{"only expired", v3, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serial, got, ok := Current(tt.pages, now)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.wantSerial, serial)
+			assert.Len(t, got, tt.wantMembers)
+		})
+	}
+
+	_, err = Sign(priv, 4, time.Unix(-1, 0), members)
+	assert.Error(t, err)
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"github.com/fastcat/wirelink/fact"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// ackTimeout is how long we wait for a peer to ack a group before we consider
+// the facts in it to be lost and in need of re-sending
+const ackTimeout = time.Second
+
+// ackHelloBackoffAfter is how many hellos we send to a peer that has never
+// sent us an ack before we slow down, as it may be running an older version
+// that doesn't understand them
+const ackHelloBackoffAfter = 3
+
+// ackHelloBackoffFactor is how much slower we send hellos to peers that don't
+// answer them
+const ackHelloBackoffFactor = 10
+
+type groupNonce = [chacha20poly1305.NonceSizeX]byte
+
+// pendingGroup is a signed group we sent to a peer that has not been acked
+type pendingGroup struct {
+	sent    time.Time
+	expires time.Time
+	facts   []fact.Key
+}
+
+// peerAcks tracks the ack state for a single peer
+type peerAcks struct {
+	// capable is set once we have seen the peer send an ack, until then we
+	// neither send it acks nor expect any from it
+	capable   bool
+	hellos    int
+	nextHello time.Time
+	// pending maps the nonces of groups we sent to the peer to their state
+	pending map[groupNonce]*pendingGroup
+	// unconfirmed maps facts to the most recent pending group they were sent in
+	unconfirmed map[fact.Key]*pendingGroup
+}
+
+func (pa *peerAcks) drop(nonce groupNonce, pg *pendingGroup) {
+	delete(pa.pending, nonce)
+	for _, k := range pg.facts {
+		if pa.unconfirmed[k] == pg {
+			delete(pa.unconfirmed, k)
+		}
+	}
+}
+
+// ackTracker keeps the state of acknowledged delivery for all peers.
+// It is safe to call methods on a nil ackTracker: peers will never be
+// considered capable, and delivery will be assumed as it is for older peers.
+type ackTracker struct {
+	access sync.Mutex
+	peers  map[wgtypes.Key]*peerAcks
+}
+
+func newAckTracker() *ackTracker {
+	return &ackTracker{
+		peers: make(map[wgtypes.Key]*peerAcks),
+	}
+}
+
+func (at *ackTracker) get(peer wgtypes.Key) *peerAcks {
+	pa, ok := at.peers[peer]
+	if !ok {
+		pa = &peerAcks{
+			pending:     make(map[groupNonce]*pendingGroup),
+			unconfirmed: make(map[fact.Key]*pendingGroup),
+		}
+		at.peers[peer] = pa
+	}
+	return pa
+}
+
+// isCapable returns whether the peer has shown it understands acks
+func (at *ackTracker) isCapable(peer wgtypes.Key) bool {
+	if at == nil {
+		return false
+	}
+	at.access.Lock()
+	defer at.access.Unlock()
+	pa, ok := at.peers[peer]
+	return ok && pa.capable
+}
+
+// helloDue returns whether we should send an empty ack to the peer to let it
+// know we understand acks, and records that we did so if true
+func (at *ackTracker) helloDue(peer wgtypes.Key, now time.Time, period time.Duration) bool {
+	if at == nil {
+		return false
+	}
+	at.access.Lock()
+	defer at.access.Unlock()
+	pa := at.get(peer)
+	if pa.capable || now.Before(pa.nextHello) {
+		return false
+	}
+	pa.hellos++
+	if pa.hellos >= ackHelloBackoffAfter {
+		pa.nextHello = now.Add(period * ackHelloBackoffFactor)
+	} else {
+		pa.nextHello = now.Add(period)
+	}
+	return true
+}
+
+// sent records that we sent a group of facts to the peer, if it is capable of
+// acking it
+func (at *ackTracker) sent(peer wgtypes.Key, nonce groupNonce, facts []*fact.Fact, now time.Time) {
+	if at == nil || len(facts) == 0 {
+		return
+	}
+	at.access.Lock()
+	defer at.access.Unlock()
+	pa, ok := at.peers[peer]
+	if !ok || !pa.capable {
+		return
+	}
+	pg := &pendingGroup{
+		sent:  now,
+		facts: make([]fact.Key, 0, len(facts)),
+	}
+	for _, f := range facts {
+		k := fact.KeyOf(f)
+		pg.facts = append(pg.facts, k)
+		pa.unconfirmed[k] = pg
+		if f.Expires.After(pg.expires) {
+			pg.expires = f.Expires
+		}
+	}
+	pa.pending[nonce] = pg
+}
+
+// acked records an ack received from the peer, which also marks it as capable,
+// returning how many facts were confirmed by it
+func (at *ackTracker) acked(peer wgtypes.Key, nonce groupNonce) int {
+	if at == nil {
+		return 0
+	}
+	at.access.Lock()
+	defer at.access.Unlock()
+	pa := at.get(peer)
+	pa.capable = true
+	pg, ok := pa.pending[nonce]
+	if !ok {
+		// hello, late, duplicate, or bogus
+		return 0
+	}
+	pa.drop(nonce, pg)
+	return len(pg.facts)
+}
+
+// unconfirmed returns whether a fact sent to the peer has gone unacked for too
+// long, and so should be re-sent
+func (at *ackTracker) unconfirmed(peer wgtypes.Key, key fact.Key, now time.Time) bool {
+	if at == nil {
+		return false
+	}
+	at.access.Lock()
+	defer at.access.Unlock()
+	pa, ok := at.peers[peer]
+	if !ok || !pa.capable {
+		return false
+	}
+	pg, ok := pa.unconfirmed[key]
+	return ok && now.Sub(pg.sent) >= ackTimeout
+}
+
+// pendingCount returns how many facts sent to the peer are awaiting an ack
+func (at *ackTracker) pendingCount(peer wgtypes.Key) int {
+	if at == nil {
+		return 0
+	}
+	at.access.Lock()
+	defer at.access.Unlock()
+	pa, ok := at.peers[peer]
+	if !ok {
+		return 0
+	}
+	return len(pa.unconfirmed)
+}
+
+// reset forgets all pending groups for the peer, but not its capability
+func (at *ackTracker) reset(peer wgtypes.Key) {
+	if at == nil {
+		return
+	}
+	at.access.Lock()
+	defer at.access.Unlock()
+	if pa, ok := at.peers[peer]; ok {
+		for nonce, pg := range pa.pending {
+			pa.drop(nonce, pg)
+		}
+	}
+}
+
+// expire forgets pending groups whose facts have all expired
+func (at *ackTracker) expire(now time.Time) {
+	if at == nil {
+		return
+	}
+	at.access.Lock()
+	defer at.access.Unlock()
+	for _, pa := range at.peers {
+		for nonce, pg := range pa.pending {
+			if now.After(pg.expires) {
+				pa.drop(nonce, pg)
+			}
+		}
+	}
+}
+
+// handleAck processes ack facts received from a peer, returning true if the
+// fact was an ack fact, which should not be processed any further
+func (s *LinkServer) handleAck(source wgtypes.Key, f *fact.Fact) bool {
+	if f.Attribute != fact.AttributeAck {
+		return false
+	}
+	av, ok := f.Value.(*fact.AckValue)
+	if !ok {
+		logger.Error("Ack fact has wrong value type: %T", f.Value)
+		return true
+	}
+	if ps, ok := f.Subject.(*fact.PeerSubject); !ok || ps.Key != source {
+		logger.Error("Ignoring ack from %s with mismatched subject %v", s.peerName(source), f.Subject)
+		return true
+	}
+	if n := s.peerKnowledge.ackState().acked(source, av.Nonce); n > 0 {
+		logger.Debug("Peer %s confirmed %d facts", s.peerName(source), n)
+	}
+	return true
+}
+
+// ackFact makes the fact for an ack of the given group, or a hello if the
+// nonce is all zeros
+func (s *LinkServer) ackFact(nonce groupNonce, now time.Time) *fact.Fact {
+	return &fact.Fact{
+		Attribute: fact.AttributeAck,
+		Subject:   &fact.PeerSubject{Key: s.signer.PublicKey},
+		Value:     &fact.AckValue{Nonce: nonce},
+		Expires:   now.Add(s.ChunkPeriod),
+	}
+}
+
+// sendAck sends an ack for a group received from the peer
+func (s *LinkServer) sendAck(peer wgtypes.Key, nonce groupNonce, now time.Time) error {
+	return s.sendStandalone(peer, s.ackFact(nonce, now), now)
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/autopeer"
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/fact"
+	netmocks "github.com/fastcat/wirelink/internal/networking/mocks"
+	"github.com/fastcat/wirelink/internal/testutils"
+	factutils "github.com/fastcat/wirelink/internal/testutils/facts"
+	"github.com/fastcat/wirelink/signing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAckTracker(t *testing.T) {
+	now := time.Now()
+	period := time.Second
+	expires := now.Add(DefaultFactTTL)
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	f1 := factutils.AliveFact(&k2, expires)
+	f2 := factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &k2, expires)
+	n1 := groupNonce{1}
+	n2 := groupNonce{2}
+
+	at := newAckTracker()
+
+	// nothing is tracked until the peer shows it understands acks
+	assert.False(t, at.isCapable(k1))
+	at.sent(k1, n1, []*fact.Fact{f1, f2}, now)
+	assert.Zero(t, at.pendingCount(k1))
+	assert.False(t, at.unconfirmed(k1, fact.KeyOf(f1), now.Add(ackTimeout)))
+
+	// hellos back off for peers that never answer
+	for i := 0; i < ackHelloBackoffAfter; i++ {
+		assert.True(t, at.helloDue(k1, now.Add(time.Duration(i)*period), period))
+		assert.False(t, at.helloDue(k1, now.Add(time.Duration(i)*period+period/2), period))
+	}
+	assert.False(t, at.helloDue(k1, now.Add(ackHelloBackoffAfter*period), period))
+
+	// a hello marks the peer capable, and stops us sending more
+	assert.Zero(t, at.acked(k1, groupNonce{}))
+	assert.True(t, at.isCapable(k1))
+	assert.False(t, at.helloDue(k1, now.Add(time.Hour), period))
+
+	at.sent(k1, n1, []*fact.Fact{f1, f2}, now)
+	assert.Equal(t, 2, at.pendingCount(k1))
+	assert.False(t, at.unconfirmed(k1, fact.KeyOf(f1), now), "should give the peer time to ack")
+	assert.True(t, at.unconfirmed(k1, fact.KeyOf(f1), now.Add(ackTimeout)))
+
+	// re-sending one fact in a new group moves it there
+	at.sent(k1, n2, []*fact.Fact{f1}, now.Add(ackTimeout))
+	assert.False(t, at.unconfirmed(k1, fact.KeyOf(f1), now.Add(ackTimeout)))
+	assert.True(t, at.unconfirmed(k1, fact.KeyOf(f2), now.Add(ackTimeout)))
+
+	// acking the first group only confirms what was last sent in it
+	assert.Equal(t, 2, at.acked(k1, n1))
+	assert.Equal(t, 1, at.pendingCount(k1))
+	assert.False(t, at.unconfirmed(k1, fact.KeyOf(f2), now.Add(ackTimeout)))
+	assert.True(t, at.unconfirmed(k1, fact.KeyOf(f1), now.Add(2*ackTimeout)))
+	// duplicate acks are ignored
+	assert.Zero(t, at.acked(k1, n1))
+
+	// pending groups are forgotten when their facts expire
+	at.expire(expires.Add(time.Second))
+	assert.Zero(t, at.pendingCount(k1))
+
+	// reset forgets pending groups, but not capability
+	at.sent(k1, n1, []*fact.Fact{f1}, now)
+	at.reset(k1)
+	assert.Zero(t, at.pendingCount(k1))
+	assert.True(t, at.isCapable(k1))
+
+	// nil tracker is safe to use
+	var nilAT *ackTracker
+	assert.False(t, nilAT.isCapable(k1))
+	assert.False(t, nilAT.helloDue(k1, now, period))
+	nilAT.sent(k1, n1, []*fact.Fact{f1}, now)
+	assert.Zero(t, nilAT.acked(k1, n1))
+	assert.False(t, nilAT.unconfirmed(k1, fact.KeyOf(f1), now))
+	assert.Zero(t, nilAT.pendingCount(k1))
+	nilAT.reset(k1)
+	nilAT.expire(now)
+}
+
+func TestPeerKnowledgeSet_peerNeeds_unacked(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(DefaultFactTTL)
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	peer := &wgtypes.Peer{PublicKey: k1}
+	f := factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &k2, expires)
+	sg := &fact.Fact{
+		Attribute: fact.AttributeSignedGroup,
+		Value:     &fact.SignedGroupValue{Nonce: groupNonce{1}},
+	}
+
+	pks := newPKS()
+	pks.acks.acked(k1, groupNonce{})
+
+	pks.upsertSent(peer, f)
+	pks.sentGroup(k1, sg, []*fact.Fact{f}, now.Add(-ackTimeout))
+	assert.True(t, pks.peerNeeds(peer, f, DefaultChunkPeriod, now), "unacked fact should be re-sent")
+
+	pks.acks.acked(k1, groupNonce{1})
+	assert.False(t, pks.peerNeeds(peer, f, DefaultChunkPeriod, now), "acked fact should not be re-sent")
+}
+
+// expectAck sets up a mock to expect an ack fact sent to the given peer
+func expectAck(
+	t *testing.T,
+	conn *netmocks.UDPConn,
+	now time.Time,
+	from, to wgtypes.Key,
+	nonce groupNonce,
+) *mock.Call {
+	dest := &net.UDPAddr{
+		IP: autopeer.AutoAddress(to),
+	}
+	isAck := func(packet []byte) bool {
+		f := &fact.Fact{}
+		if err := f.DecodeFrom(0, now, bytes.NewBuffer(packet)); err != nil {
+			return false
+		}
+		sgv, ok := f.Value.(*fact.SignedGroupValue)
+		if !ok {
+			return false
+		}
+		inner, err := sgv.ParseInner(now)
+		if err != nil || len(inner) != 1 {
+			return false
+		}
+		av, ok := inner[0].Value.(*fact.AckValue)
+		return ok &&
+			inner[0].Attribute == fact.AttributeAck &&
+			*inner[0].Subject.(*fact.PeerSubject) == fact.PeerSubject{Key: from} &&
+			av.Nonce == nonce
+	}
+	return conn.On("WriteToUDP", mock.MatchedBy(isAck), dest).Return(1, nil)
+}
+
+func TestLinkServer_handleAck(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(DefaultFactTTL)
+
+	localPrivKey, _ := testutils.MustKeyPair(t)
+	remoteKey := testutils.MustKey(t)
+	otherKey := testutils.MustKey(t)
+
+	ackFact := func(subject wgtypes.Key) *fact.Fact {
+		return &fact.Fact{
+			Attribute: fact.AttributeAck,
+			Subject:   &fact.PeerSubject{Key: subject},
+			Value:     &fact.AckValue{Nonce: groupNonce{1}},
+			Expires:   expires,
+		}
+	}
+
+	tests := []struct {
+		name        string
+		f           *fact.Fact
+		want        bool
+		wantCapable bool
+	}{
+		{"not ack", factutils.AliveFact(&remoteKey, expires), false, false},
+		{"ack", ackFact(remoteKey), true, true},
+		{"spoofed ack", ackFact(otherKey), true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &LinkServer{
+				config:        &config.Server{},
+				peerConfig:    newPeerConfigSet(),
+				peerKnowledge: newPKS(),
+				signer:        signing.New(&localPrivKey),
+			}
+			assert.Equal(t, tt.want, s.handleAck(remoteKey, tt.f))
+			assert.Equal(t, tt.wantCapable, s.peerKnowledge.acks.isCapable(remoteKey))
+		})
+	}
+}
+
+func TestLinkServer_processSignedGroup_acks(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(DefaultFactTTL)
+
+	localPrivKey, localPubKey := testutils.MustKeyPair(t)
+	remotePrivKey, remotePubKey := testutils.MustKeyPair(t)
+	remoteSigner := signing.New(&remotePrivKey)
+	source := &net.UDPAddr{IP: autopeer.AutoAddress(remotePubKey)}
+
+	makeGroup := func(t *testing.T, facts ...*fact.Fact) (*fact.Fact, groupNonce) {
+		ga := fact.NewAccumulator(fact.SignedGroupMaxSafeInnerLength, now)
+		for _, f := range facts {
+			require.Nil(t, ga.AddFact(f))
+		}
+		groups, err := ga.MakeSignedGroups(remoteSigner, &localPubKey)
+		require.Nil(t, err)
+		require.Len(t, groups, 1)
+		// round trip it so it looks like what we'd receive
+		p, err := groups[0].MarshalBinaryNow(now)
+		require.Nil(t, err)
+		f := &fact.Fact{}
+		require.Nil(t, f.DecodeFrom(0, now, bytes.NewBuffer(p)))
+		return f, f.Value.(*fact.SignedGroupValue).Nonce
+	}
+	alive := factutils.AliveFact(&remotePubKey, expires)
+	hello := &fact.Fact{
+		Attribute: fact.AttributeAck,
+		Subject:   &fact.PeerSubject{Key: remotePubKey},
+		Value:     &fact.AckValue{},
+		Expires:   expires,
+	}
+
+	tests := []struct {
+		name       string
+		capable    bool
+		facts      []*fact.Fact
+		wantAck    bool
+		wantPassed int
+	}{
+		{"incapable peer", false, []*fact.Fact{alive}, false, 1},
+		{"capable peer", true, []*fact.Fact{alive}, true, 1},
+		{"hello only", false, []*fact.Fact{hello}, false, 0},
+		{"hello and fact", false, []*fact.Fact{hello, alive}, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &netmocks.UDPConn{}
+			conn.Test(t)
+			g, nonce := makeGroup(t, tt.facts...)
+			if tt.wantAck {
+				conn.On("SetWriteDeadline", mock.Anything).Return(nil)
+				expectAck(t, conn, now, localPubKey, remotePubKey, nonce).Once()
+			}
+			s := &LinkServer{
+				config:        &config.Server{},
+				conn:          conn,
+				peerConfig:    newPeerConfigSet(),
+				peerKnowledge: newPKS(),
+				signer:        signing.New(&localPrivKey),
+				ChunkPeriod:   time.Second,
+			}
+			if tt.capable {
+				s.peerKnowledge.acks.acked(remotePubKey, groupNonce{})
+			}
+			packets := make(chan *ReceivedFact, len(tt.facts))
+			err := s.processSignedGroup(g, source, now, packets)
+			assert.Nil(t, err)
+			assert.Len(t, packets, tt.wantPassed)
+			conn.AssertExpectations(t)
+		})
+	}
+}
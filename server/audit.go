@@ -0,0 +1,127 @@
+package server
+
+import (
+	"time"
+
+	"github.com/fastcat/wirelink/audit"
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/internal"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// configureDevice applies a config change to the wireguard device, and if that
+// succeeds, records what it changed in the audit log. The `prev` peers are the
+// device state before the change, and `factsByPeer` are the facts that led to
+// it. In dry run mode, the device is left alone, and the changes are instead
+// logged and kept as pending. Otherwise, destructive changes are subject to
+// the safety limits.
+func (s *LinkServer) configureDevice(
+	cfg wgtypes.Config,
+	prev []wgtypes.Peer,
+	factsByPeer map[wgtypes.Key][]*fact.Fact,
+	reason string,
+) error {
+	if s.config.DryRun {
+		s.recordDryRun(cfg, prev, factsByPeer, reason, s.now())
+		return nil
+	}
+	if cfg = s.guardChanges(cfg, prev, s.now()); len(cfg.Peers) == 0 {
+		return nil
+	}
+	if err := s.ctrl.ConfigureDevice(s.config.Iface, cfg); err != nil {
+		return err
+	}
+	s.recordChanges(cfg, prev, factsByPeer, reason, s.now())
+	return nil
+}
+
+func (s *LinkServer) recordChanges(
+	cfg wgtypes.Config,
+	prev []wgtypes.Peer,
+	factsByPeer map[wgtypes.Key][]*fact.Fact,
+	reason string,
+	now time.Time,
+) {
+	if s.audit == nil {
+		return
+	}
+	changes := s.changeEntries(cfg, prev, factsByPeer, reason, now)
+	for i := range cfg.Peers {
+		for _, e := range changes[cfg.Peers[i].PublicKey] {
+			s.audit.Record(e)
+		}
+	}
+}
+
+// recordDryRun logs the changes we would have made to the device, if they
+// differ from what we last would have done, and keeps them for the status
+// output
+func (s *LinkServer) recordDryRun(
+	cfg wgtypes.Config,
+	prev []wgtypes.Peer,
+	factsByPeer map[wgtypes.Key][]*fact.Fact,
+	reason string,
+	now time.Time,
+) {
+	changes := s.changeEntries(cfg, prev, factsByPeer, reason, now)
+	for i := range cfg.Peers {
+		key := cfg.Peers[i].PublicKey
+		if !s.dryRun.record(key, changes[key]) {
+			continue
+		}
+		for _, e := range changes[key] {
+			logger.Info("Dry run: would apply %s", e)
+		}
+		logger.Debug("Dry run: would configure peer %s: %+v", s.peerName(key), cfg.Peers[i])
+	}
+}
+
+// changeEntries computes the audit entries for each peer in a config change
+func (s *LinkServer) changeEntries(
+	cfg wgtypes.Config,
+	prev []wgtypes.Peer,
+	factsByPeer map[wgtypes.Key][]*fact.Fact,
+	reason string,
+	now time.Time,
+) map[wgtypes.Key][]*audit.Entry {
+	ret := make(map[wgtypes.Key][]*audit.Entry, len(cfg.Peers))
+	peers := make(map[wgtypes.Key]*wgtypes.Peer, len(prev))
+	for i := range prev {
+		peers[prev[i].PublicKey] = &prev[i]
+	}
+	describe := func(f *fact.Fact) string {
+		return f.FancyString(s.subjectName, now)
+	}
+	for i := range cfg.Peers {
+		pcfg := &cfg.Peers[i]
+		for _, e := range audit.Changes(peers[pcfg.PublicKey], pcfg, factsByPeer[pcfg.PublicKey], describe, s.factSourceNames) {
+			e.Time = now
+			e.PeerName = s.peerName(pcfg.PublicKey)
+			e.Reason = reason
+			ret[pcfg.PublicKey] = append(ret[pcfg.PublicKey], e)
+		}
+	}
+	return ret
+}
+
+// auditedClient wraps the wireguard client so that changes made through it by
+// other packages are recorded in the audit log
+type auditedClient struct {
+	internal.WgClient
+	s      *LinkServer
+	prev   []wgtypes.Peer
+	reason string
+}
+
+func (c *auditedClient) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	if c.s.config.DryRun {
+		c.s.recordDryRun(cfg, c.prev, nil, c.reason, c.s.now())
+		return nil
+	}
+	if err := c.WgClient.ConfigureDevice(name, cfg); err != nil {
+		return err
+	}
+	c.s.recordChanges(cfg, c.prev, nil, c.reason, c.s.now())
+	return nil
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/audit"
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/internal/mocks"
+	"github.com/fastcat/wirelink/internal/testutils"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryAudit is an audit.Recorder that keeps entries in memory for tests
+type memoryAudit struct {
+	access  sync.Mutex
+	entries []*audit.Entry
+}
+
+func (m *memoryAudit) Record(e *audit.Entry) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	m.entries = append(m.entries, e)
+}
+
+func TestLinkServer_configureDevice(t *testing.T) {
+	now := time.Now()
+	wgIface := "wg0"
+	peerKey := testutils.MustKey(t)
+	aip := testutils.MakeIPv4Net(10, 2, 0, 0, 16)
+	aipFact := &fact.Fact{
+		Attribute: fact.AttributeAllowedCidrV4,
+		Subject:   &fact.PeerSubject{Key: peerKey},
+		Value:     &fact.IPNetValue{IPNet: aip},
+		Expires:   now.Add(time.Minute),
+	}
+	prev := []wgtypes.Peer{{PublicKey: peerKey}}
+	cfg := wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: peerKey, AllowedIPs: []net.IPNet{aip}}}}
+
+	tests := []struct {
+		name      string
+		err       error
+		wantEntry bool
+	}{
+		{"success", nil, true},
+		{"failure", errors.New("nope"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := &mocks.WgClient{}
+			ctrl.Test(t)
+			ctrl.On("ConfigureDevice", wgIface, cfg).Return(tt.err).Once()
+			recorder := &memoryAudit{}
+			s := &LinkServer{
+				config: buildConfig(wgIface).withPeer(peerKey, &config.Peer{Name: "bob"}).Build(),
+				ctrl:   ctrl,
+				audit:  recorder,
+			}
+
+			err := s.configureDevice(cfg, prev, map[wgtypes.Key][]*fact.Fact{peerKey: {aipFact}}, "testing")
+			assert.Equal(t, tt.err, err)
+			ctrl.AssertExpectations(t)
+			if !tt.wantEntry {
+				assert.Empty(t, recorder.entries)
+				return
+			}
+			require.Len(t, recorder.entries, 1)
+			e := recorder.entries[0]
+			assert.Equal(t, audit.AllowedIPsChanged, e.Action)
+			assert.Equal(t, "bob", e.PeerName)
+			assert.Equal(t, "testing", e.Reason)
+			assert.Equal(t, []string{aip.String()}, e.Added)
+			require.Len(t, e.Facts, 1)
+			assert.Contains(t, e.Facts[0], "s:bob")
+			assert.False(t, e.Time.IsZero())
+		})
+	}
+
+	// nil audit is safe
+	ctrl := &mocks.WgClient{}
+	ctrl.Test(t)
+	ctrl.On("ConfigureDevice", wgIface, cfg).Return(nil).Once()
+	s := &LinkServer{config: buildConfig(wgIface).Build(), ctrl: ctrl}
+	assert.NoError(t, s.configureDevice(cfg, prev, nil, "testing"))
+	ctrl.AssertExpectations(t)
+}
+
+func TestAuditedClient(t *testing.T) {
+	wgIface := "wg0"
+	peerKey := testutils.MustKey(t)
+	aip := testutils.MakeIPv4Net(10, 2, 0, 0, 16)
+	cfg := wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: peerKey, AllowedIPs: []net.IPNet{aip}}}}
+
+	ctrl := &mocks.WgClient{}
+	ctrl.Test(t)
+	ctrl.On("ConfigureDevice", wgIface, cfg).Return(nil).Once()
+	recorder := &memoryAudit{}
+	s := &LinkServer{
+		config: buildConfig(wgIface).Build(),
+		ctrl:   ctrl,
+		audit:  recorder,
+	}
+
+	ac := &auditedClient{s.ctrl, s, []wgtypes.Peer{{PublicKey: peerKey}}, "startup"}
+	require.NoError(t, ac.ConfigureDevice(wgIface, cfg))
+	ctrl.AssertExpectations(t)
+	require.Len(t, recorder.entries, 1)
+	assert.Equal(t, "startup", recorder.entries[0].Reason)
+	assert.Equal(t, peerKey.String(), recorder.entries[0].PeerName)
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// detectCollisions finds which of the device's peers, and the other valid
+// peers we may add, have an auto address that is shared with another peer or
+// with us, and logs when that changes. Since wireguard can only route an
+// address to one peer, we leave these addresses out of the AllowedIPs. It is
+// only used from the configure loop.
+func (s *LinkServer) detectCollisions(dev *wgtypes.Device, validPeers map[wgtypes.Key]bool) map[wgtypes.Key]bool {
+	keys := make([]wgtypes.Key, 0, 1+len(dev.Peers)+len(validPeers))
+	keys = append(keys, dev.PublicKey)
+	for i := range dev.Peers {
+		keys = append(keys, dev.Peers[i].PublicKey)
+	}
+	for peer, valid := range validPeers {
+		if valid {
+			keys = append(keys, peer)
+		}
+	}
+	colliding := s.scheme.Collisions(keys...)
+
+	for peer := range colliding {
+		if !s.collisions[peer] {
+			logger.Error("Auto address %v of %s collides with another peer, it will not be used",
+				s.scheme.Address(peer), s.peerName(peer))
+		}
+	}
+	for peer := range s.collisions {
+		if !colliding[peer] {
+			logger.Info("Auto address %v of %s no longer collides with another peer",
+				s.scheme.Address(peer), s.peerName(peer))
+		}
+	}
+	s.collisions = colliding
+	return colliding
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/fastcat/wirelink/autopeer"
+	"github.com/fastcat/wirelink/internal/mocks"
+	"github.com/fastcat/wirelink/internal/testutils"
+	"github.com/fastcat/wirelink/signing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestLinkServer_detectCollisions(t *testing.T) {
+	v4ll, err := autopeer.ParseScheme(autopeer.SchemeIPv4LinkLocal)
+	require.NoError(t, err)
+	c1, c2 := testutils.MustCollidingKeys(t, v4ll.Address)
+	self := testutils.MustKey(t)
+	k1 := testutils.MustKey(t)
+
+	tests := []struct {
+		name       string
+		scheme     *autopeer.Scheme
+		self       wgtypes.Key
+		peers      []wgtypes.Key
+		validPeers map[wgtypes.Key]bool
+		want       map[wgtypes.Key]bool
+	}{
+		{
+			"default scheme",
+			nil,
+			self,
+			[]wgtypes.Key{k1, c1, c2},
+			nil,
+			map[wgtypes.Key]bool{},
+		},
+		{
+			"no collisions",
+			v4ll,
+			self,
+			[]wgtypes.Key{k1, c1},
+			map[wgtypes.Key]bool{k1: true},
+			map[wgtypes.Key]bool{},
+		},
+		{
+			"device peers",
+			v4ll,
+			self,
+			[]wgtypes.Key{k1, c1, c2},
+			nil,
+			map[wgtypes.Key]bool{c1: true, c2: true},
+		},
+		{
+			"with self",
+			v4ll,
+			c1,
+			[]wgtypes.Key{k1, c2},
+			nil,
+			map[wgtypes.Key]bool{c1: true, c2: true},
+		},
+		{
+			"with new peer",
+			v4ll,
+			self,
+			[]wgtypes.Key{k1, c1},
+			map[wgtypes.Key]bool{k1: true, c1: true, c2: true},
+			map[wgtypes.Key]bool{c1: true, c2: true},
+		},
+		{
+			"invalid new peer",
+			v4ll,
+			self,
+			[]wgtypes.Key{k1, c1},
+			map[wgtypes.Key]bool{c2: false},
+			map[wgtypes.Key]bool{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev := &wgtypes.Device{PublicKey: tt.self}
+			for _, k := range tt.peers {
+				dev.Peers = append(dev.Peers, wgtypes.Peer{PublicKey: k})
+			}
+			s := &LinkServer{
+				scheme:     tt.scheme,
+				config:     buildConfig("wg0").Build(),
+				peerConfig: newPeerConfigSet(),
+				// start with stale state to exercise the change logging
+				collisions: map[wgtypes.Key]bool{k1: true},
+			}
+			got := s.detectCollisions(dev, tt.validPeers)
+			if len(tt.want) == 0 {
+				assert.Empty(t, got)
+				assert.Empty(t, s.collisions)
+			} else {
+				assert.Equal(t, tt.want, got)
+				assert.Equal(t, tt.want, s.collisions)
+			}
+		})
+	}
+}
+
+func TestLinkServer_configurePeer_colliding(t *testing.T) {
+	v4ll, err := autopeer.ParseScheme(autopeer.SchemeIPv4LinkLocal)
+	require.NoError(t, err)
+	localKey := testutils.MustKey(t)
+	peerKey := testutils.MustKey(t)
+	wgIface := "wg0"
+
+	tests := []struct {
+		name      string
+		colliding bool
+		want      []net.IPNet
+	}{
+		{"only auto address", false, []net.IPNet{v4ll.AddressNet(peerKey)}},
+		{"skip colliding", true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := &mocks.WgClient{}
+			ctrl.Test(t)
+			if tt.want != nil {
+				ctrl.On("ConfigureDevice", wgIface, wgtypes.Config{
+					Peers: []wgtypes.PeerConfig{{
+						PublicKey:         peerKey,
+						UpdateOnly:        true,
+						ReplaceAllowedIPs: true,
+						AllowedIPs:        tt.want,
+					}},
+				}).Return(nil)
+			}
+			s := &LinkServer{
+				stateAccess:   &sync.Mutex{},
+				config:        buildConfig(wgIface).Build(),
+				ctrl:          ctrl,
+				scheme:        v4ll,
+				peerKnowledge: newPKS(),
+				signer:        &signing.Signer{PublicKey: localKey},
+			}
+			peer := &wgtypes.Peer{PublicKey: peerKey}
+			state := makePCS(t, false, false, true)
+			// allowDeconfigure would restrict the peer to just its auto address
+			_, err := s.configurePeer(state, peer, nil, true, false, false, tt.colliding, nil)
+			require.NoError(t, err)
+			ctrl.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fastcat/wirelink/fact"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// compactHelloBackoffAfter is how many hellos we send to a peer that has never
+// sent us a compact group before we slow down, as it may be running an older
+// version that doesn't understand them
+const compactHelloBackoffAfter = 3
+
+// compactHelloBackoffFactor is how much slower we send hellos to peers that
+// don't answer them
+const compactHelloBackoffFactor = 10
+
+// peerCompact tracks whether a single peer understands compact groups
+type peerCompact struct {
+	// capable is set once we have seen the peer send a compact group
+	capable   bool
+	hellos    int
+	nextHello time.Time
+	replied   time.Time
+}
+
+// compactTracker keeps track of which peers we can send facts to in the compact
+// encoding, with facts in subject groups.
+// It is safe to call methods on a nil compactTracker, no peers will be capable.
+type compactTracker struct {
+	access sync.Mutex
+	peers  map[wgtypes.Key]*peerCompact
+}
+
+func newCompactTracker() *compactTracker {
+	return &compactTracker{
+		peers: make(map[wgtypes.Key]*peerCompact),
+	}
+}
+
+func (ct *compactTracker) get(peer wgtypes.Key) *peerCompact {
+	pc, ok := ct.peers[peer]
+	if !ok {
+		pc = &peerCompact{}
+		ct.peers[peer] = pc
+	}
+	return pc
+}
+
+// isCapable returns whether the peer has shown it understands compact groups
+func (ct *compactTracker) isCapable(peer wgtypes.Key) bool {
+	if ct == nil {
+		return false
+	}
+	ct.access.Lock()
+	defer ct.access.Unlock()
+	pc, ok := ct.peers[peer]
+	return ok && pc.capable
+}
+
+// helloDue returns whether we should send a hello to the peer to find out if
+// it understands compact groups, and records that we did so if true
+func (ct *compactTracker) helloDue(peer wgtypes.Key, now time.Time, period time.Duration) bool {
+	if ct == nil {
+		return false
+	}
+	ct.access.Lock()
+	defer ct.access.Unlock()
+	pc := ct.get(peer)
+	if pc.capable || now.Before(pc.nextHello) {
+		return false
+	}
+	pc.hellos++
+	if pc.hellos >= compactHelloBackoffAfter {
+		pc.nextHello = now.Add(period * compactHelloBackoffFactor)
+	} else {
+		pc.nextHello = now.Add(period)
+	}
+	return true
+}
+
+// received records a compact group received from the peer, marking it as
+// capable, and returns whether we should reply to a hello from it
+func (ct *compactTracker) received(peer wgtypes.Key, hello bool, now time.Time, period time.Duration) bool {
+	if ct == nil {
+		return false
+	}
+	ct.access.Lock()
+	defer ct.access.Unlock()
+	pc := ct.get(peer)
+	pc.capable = true
+	if !hello || now.Sub(pc.replied) < period {
+		return false
+	}
+	pc.replied = now
+	return true
+}
+
+// trim forgets peers for which keep returns false
+func (ct *compactTracker) trim(keep func(wgtypes.Key) bool) {
+	if ct == nil {
+		return
+	}
+	ct.access.Lock()
+	defer ct.access.Unlock()
+	for k := range ct.peers {
+		if !keep(k) {
+			delete(ct.peers, k)
+		}
+	}
+}
+
+// newAccumulator makes a fact accumulator for groups to send to a peer, using
+// the compact encoding if the peer understands it
+func (s *LinkServer) newAccumulator(peer wgtypes.Key, maxGroupLen int, now time.Time) *fact.GroupAccumulator {
+	ga := fact.NewAccumulator(maxGroupLen, now)
+	ga.SetCompact(s.compact.isCapable(peer))
+	return ga
+}
+
+// handleCompact processes a compact group received from a peer. A group with
+// no facts is a hello, which we answer so the peer knows we understand them.
+func (s *LinkServer) handleCompact(source wgtypes.Key, facts int, now time.Time) {
+	if !s.compact.received(source, facts == 0, now, s.AlivePeriod) {
+		return
+	}
+	if err := s.sendCompactHello(source, now); err != nil {
+		logger.Error("Unable to send compact hello to %s: %v", s.peerName(source), err)
+	}
+}
+
+// sendCompactHello sends a hello to a peer to find out if it understands
+// compact groups, or to answer its hello
+func (s *LinkServer) sendCompactHello(peer wgtypes.Key, now time.Time) error {
+	hello, err := fact.MakeCompactHello(s.signer, &peer)
+	if err != nil {
+		return err
+	}
+	return s.sendGroups(peer, []*fact.Fact{hello}, now)
+}
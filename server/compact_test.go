@@ -0,0 +1,293 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/fastcat/wirelink/autopeer"
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/fact"
+	netmocks "github.com/fastcat/wirelink/internal/networking/mocks"
+	"github.com/fastcat/wirelink/internal/testutils"
+	factutils "github.com/fastcat/wirelink/internal/testutils/facts"
+	"github.com/fastcat/wirelink/signing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactTracker(t *testing.T) {
+	now := time.Now()
+	period := time.Second
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+
+	ct := newCompactTracker()
+
+	// hellos back off for peers that never answer
+	for i := 0; i < compactHelloBackoffAfter; i++ {
+		assert.True(t, ct.helloDue(k1, now.Add(time.Duration(i)*period), period))
+		assert.False(t, ct.helloDue(k1, now.Add(time.Duration(i)*period+period/2), period))
+	}
+	assert.False(t, ct.helloDue(k1, now.Add(compactHelloBackoffAfter*period), period))
+
+	// hellos are answered, but not too often
+	assert.False(t, ct.isCapable(k1))
+	assert.True(t, ct.received(k1, true, now, period))
+	assert.True(t, ct.isCapable(k1))
+	assert.False(t, ct.received(k1, true, now.Add(period/2), period))
+	assert.False(t, ct.received(k1, false, now.Add(period), period))
+	assert.True(t, ct.received(k1, true, now.Add(period), period))
+	assert.False(t, ct.helloDue(k1, now.Add(time.Hour), period))
+
+	// any compact group shows the peer is capable
+	assert.False(t, ct.received(k2, false, now, period))
+	assert.True(t, ct.isCapable(k2))
+
+	ct.trim(func(k wgtypes.Key) bool { return k == k1 })
+	assert.True(t, ct.isCapable(k1))
+	assert.False(t, ct.isCapable(k2))
+
+	// nil tracker is safe to use
+	var nilCT *compactTracker
+	assert.False(t, nilCT.isCapable(k1))
+	assert.False(t, nilCT.helloDue(k1, now, period))
+	assert.False(t, nilCT.received(k1, true, now, period))
+	nilCT.trim(func(wgtypes.Key) bool { return false })
+}
+
+func TestLinkServer_newAccumulator(t *testing.T) {
+	now := time.Now()
+	capable := testutils.MustKey(t)
+	other := testutils.MustKey(t)
+	expires := now.Add(DefaultFactTTL)
+	priv, _ := testutils.MustKeyPair(t)
+
+	s := &LinkServer{
+		signer:  signing.New(&priv),
+		compact: newCompactTracker(),
+	}
+	s.compact.received(capable, false, now, DefaultAlivePeriod)
+
+	for _, peer := range []wgtypes.Key{capable, other} {
+		ga := s.newAccumulator(peer, fact.SignedGroupMaxSafeInnerLength, now)
+		require.Nil(t, ga.AddFact(factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &other, expires)))
+		require.Nil(t, ga.AddFact(factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &other, expires)))
+		groups, err := ga.MakeSignedGroups(s.signer, &peer)
+		require.Nil(t, err)
+		require.Len(t, groups, 1)
+		inner, compact, err := groups[0].Value.(*fact.SignedGroupValue).ParseInnerWithEncoding(now)
+		require.Nil(t, err)
+		assert.Len(t, inner, 2)
+		assert.Equal(t, peer == capable, compact)
+	}
+}
+
+// expectCompactHello sets up a mock to expect a compact hello sent to the
+// given peer
+func expectCompactHello(
+	t *testing.T,
+	conn *netmocks.UDPConn,
+	now time.Time,
+	from, to wgtypes.Key,
+) *mock.Call {
+	dest := &net.UDPAddr{
+		IP: autopeer.AutoAddress(to),
+	}
+	isHello := func(packet []byte) bool {
+		f := &fact.Fact{}
+		if err := f.DecodeFrom(0, now, bytes.NewBuffer(packet)); err != nil {
+			return false
+		}
+		sgv, ok := f.Value.(*fact.SignedGroupValue)
+		if !ok || *f.Subject.(*fact.PeerSubject) != (fact.PeerSubject{Key: from}) {
+			return false
+		}
+		inner, compact, err := sgv.ParseInnerWithEncoding(now)
+		return err == nil && compact && len(inner) == 0
+	}
+	return conn.On("WriteToUDP", mock.MatchedBy(isHello), dest).Return(0, nil)
+}
+
+func TestLinkServer_processSignedGroup_compact(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(DefaultFactTTL)
+
+	localPrivKey, localPubKey := testutils.MustKeyPair(t)
+	remotePrivKey, remotePubKey := testutils.MustKeyPair(t)
+	otherKey := testutils.MustKey(t)
+	remoteSigner := signing.New(&remotePrivKey)
+	source := &net.UDPAddr{IP: autopeer.AutoAddress(remotePubKey)}
+
+	roundTrip := func(t *testing.T, g *fact.Fact) *fact.Fact {
+		p, err := g.MarshalBinaryNow(now)
+		require.Nil(t, err)
+		f := &fact.Fact{}
+		require.Nil(t, f.DecodeFrom(0, now, bytes.NewBuffer(p)))
+		return f
+	}
+	makeGroup := func(t *testing.T, compact bool) *fact.Fact {
+		ga := fact.NewAccumulator(fact.SignedGroupMaxSafeInnerLength, now)
+		ga.SetCompact(compact)
+		require.Nil(t, ga.AddFact(factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &otherKey, expires)))
+		groups, err := ga.MakeSignedGroups(remoteSigner, &localPubKey)
+		require.Nil(t, err)
+		require.Len(t, groups, 1)
+		return roundTrip(t, groups[0])
+	}
+	makeHello := func(t *testing.T) *fact.Fact {
+		hello, err := fact.MakeCompactHello(remoteSigner, &localPubKey)
+		require.Nil(t, err)
+		return roundTrip(t, hello)
+	}
+
+	tests := []struct {
+		name        string
+		group       func(t *testing.T) *fact.Fact
+		wantFacts   int
+		wantHello   bool
+		wantCapable bool
+	}{
+		{"plain", func(t *testing.T) *fact.Fact { return makeGroup(t, false) }, 1, false, false},
+		{"compact", func(t *testing.T) *fact.Fact { return makeGroup(t, true) }, 1, false, true},
+		{"hello", makeHello, 0, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &netmocks.UDPConn{}
+			conn.Test(t)
+			if tt.wantHello {
+				conn.On("SetWriteDeadline", mock.Anything).Return(nil)
+				expectCompactHello(t, conn, now, localPubKey, remotePubKey).Once()
+			}
+			s := &LinkServer{
+				config:        &config.Server{},
+				conn:          conn,
+				peerConfig:    newPeerConfigSet(),
+				peerKnowledge: newPKS(),
+				compact:       newCompactTracker(),
+				signer:        signing.New(&localPrivKey),
+				ChunkPeriod:   time.Second,
+				AlivePeriod:   DefaultAlivePeriod,
+			}
+			packets := make(chan *ReceivedFact, 1)
+			err := s.processSignedGroup(tt.group(t), source, now, packets)
+			assert.Nil(t, err)
+			close(packets)
+			n := 0
+			for range packets {
+				n++
+			}
+			assert.Equal(t, tt.wantFacts, n)
+			assert.Equal(t, tt.wantCapable, s.compact.isCapable(remotePubKey))
+			conn.AssertExpectations(t)
+		})
+	}
+}
+
+func TestLinkServer_broadcastFacts_compact(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(DefaultFactTTL)
+	localPrivKey, localPubKey := testutils.MustKeyPair(t)
+	remoteKey := testutils.MustKey(t)
+	otherKey := testutils.MustKey(t)
+	facts := []*fact.Fact{
+		factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &otherKey, expires),
+		factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &localPubKey, expires),
+		factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &otherKey, expires),
+	}
+
+	tests := []struct {
+		name        string
+		capable     bool
+		wantCompact bool
+		wantHello   bool
+	}{
+		{"new peer gets hello", false, false, true},
+		{"capable peer gets compact groups", true, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var access sync.Mutex
+			var groups, hellos, compactGroups, received int
+			conn := &netmocks.UDPConn{}
+			conn.Test(t)
+			conn.On("SetWriteDeadline", mock.Anything).Return(nil)
+			conn.On("WriteToUDP", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				f := &fact.Fact{}
+				require.Nil(t, f.DecodeFrom(0, now, bytes.NewBuffer(args.Get(0).([]byte))))
+				inner, compact, err := f.Value.(*fact.SignedGroupValue).ParseInnerWithEncoding(now)
+				require.Nil(t, err)
+				access.Lock()
+				defer access.Unlock()
+				if compact && len(inner) == 0 {
+					hellos++
+					return
+				}
+				endpoints := 0
+				for _, innerFact := range inner {
+					if innerFact.Attribute == fact.AttributeEndpointV4 {
+						endpoints++
+					}
+				}
+				if endpoints == 0 {
+					// standalone groups, such as ack hellos
+					return
+				}
+				received += endpoints
+				groups++
+				if compact {
+					compactGroups++
+				}
+			}).Return(0, nil)
+
+			s := &LinkServer{
+				bootID: uuid.Must(uuid.NewRandom()),
+				config: &config.Server{
+					Peers: config.Peers{
+						remoteKey: &config.Peer{FactExchanger: true},
+					},
+				},
+				conn:          conn,
+				peerKnowledge: newPKS(),
+				peerConfig:    newPeerConfigSet(),
+				signer:        signing.New(&localPrivKey),
+				compact:       newCompactTracker(),
+				stateAccess:   &sync.Mutex{},
+				FactTTL:       DefaultFactTTL,
+				ChunkPeriod:   DefaultChunkPeriod,
+				AlivePeriod:   DefaultAlivePeriod,
+			}
+			if tt.capable {
+				s.compact.received(remoteKey, false, now, s.AlivePeriod)
+			}
+			peers := []wgtypes.Peer{{
+				PublicKey:         remoteKey,
+				Endpoint:          testutils.RandUDP4Addr(t),
+				LastHandshakeTime: now,
+			}}
+			// the mock doesn't report the right send lengths, so ignore errors
+			s.broadcastFacts(localPubKey, peers, facts, now, time.Second)
+			assert.Equal(t, len(facts), received)
+			assert.NotZero(t, groups)
+			if tt.wantCompact {
+				assert.Equal(t, groups, compactGroups)
+			} else {
+				assert.Zero(t, compactGroups)
+			}
+			if tt.wantHello {
+				assert.Equal(t, 1, hellos)
+			} else {
+				assert.Zero(t, hellos)
+			}
+		})
+	}
+}
@@ -6,7 +6,6 @@ import (
 
 	"github.com/fastcat/wirelink/config"
 	"github.com/fastcat/wirelink/fact"
-	"github.com/fastcat/wirelink/log"
 	"github.com/fastcat/wirelink/peerfacts"
 	"github.com/fastcat/wirelink/trust"
 	"github.com/fastcat/wirelink/util"
@@ -22,8 +21,14 @@ func (s *LinkServer) deviceState() (dev *wgtypes.Device, err error) {
 	return s.ctrl.Device(s.config.Iface)
 }
 
-func (s *LinkServer) collectFacts(dev *wgtypes.Device, now time.Time) (ret []*fact.Fact, err error) {
-	log.Debug("Collecting facts...")
+// collectFacts gathers the locally known facts, from the device and from the
+// static config, along with the provenance of each.
+func (s *LinkServer) collectFacts(
+	dev *wgtypes.Device,
+	now time.Time,
+) (ret []*fact.Fact, prov fact.Provenance, err error) {
+	logger.Debug("Collecting facts...")
+	prov = make(fact.Provenance)
 
 	// facts about the local node
 	ret, err = peerfacts.DeviceFacts(dev, now, s.FactTTL, s.config, s.net)
@@ -33,10 +38,11 @@ func (s *LinkServer) collectFacts(dev *wgtypes.Device, now time.Time) (ret []*fa
 
 	// facts the local node knows about peers configured in the wireguard device
 	//TODO: find a better way to figure out if we should trust our local AIP list
-	localTrust := s.config.Peers.Trust(dev.PublicKey, trust.Untrusted)
+	peers := s.succeededPeers()
+	localTrust := peers.Trust(dev.PublicKey, trust.Untrusted)
 	useLocalAIPs := s.config.IsRouterNow || localTrust >= trust.AllowedIPs
 	useLocalMembership := s.config.IsRouterNow || localTrust >= trust.Membership
-	log.Debug("Using local AIP/membership: %v/%v", useLocalAIPs, useLocalMembership)
+	logger.Debug("Using local AIP/membership: %v/%v", useLocalAIPs, useLocalMembership)
 	for _, peer := range dev.Peers {
 		var pf []*fact.Fact
 		pf, err = peerfacts.LocalFacts(&peer, s.FactTTL, useLocalAIPs, useLocalMembership, now)
@@ -45,12 +51,15 @@ func (s *LinkServer) collectFacts(dev *wgtypes.Device, now time.Time) (ret []*fa
 		}
 		ret = append(ret, pf...)
 	}
+	for _, f := range ret {
+		prov.Add(f, fact.LocalSource)
+	}
 
 	expires := now.Add(s.FactTTL)
 
 	// static facts from the config
 	// these may duplicate other known facts, higher layers will dedupe
-	for pk, pc := range s.config.Peers {
+	for pk, pc := range peers {
 		// statically configured peers are always valid members
 
 		memberFactIdx := fact.SliceIndexOf(ret, func(f *fact.Fact) bool {
@@ -73,18 +82,44 @@ func (s *LinkServer) collectFacts(dev *wgtypes.Device, now time.Time) (ret []*fa
 			ret = append(ret, f)
 		}
 
-		if len(pc.Name) > 0 || pc.Basic {
+		if len(pc.Name) > 0 || pc.Basic || pc.Relay {
 			// we have metadata, replace it with a metadata member fact
 			f.Attribute = fact.AttributeMemberMetadata
-			f.Value = fact.BuildMemberMetadata(pc.Name, pc.Basic)
-			log.Debug("Collected member metadata: for %s: %v", pc.Name, f.Value)
+			f.Value = fact.BuildMemberMetadata(pc.Name, pc.Basic, pc.Relay)
+			logger.Debug("Collected member metadata: for %s: %v", pc.Name, f.Value)
 		}
+		prov.Add(f, fact.ConfigSource)
+		numFacts := len(ret)
 		ret = s.handlePeerConfigAllowedIPs(pk, pc, expires, ret)
 		// skip endpoint lookups for self
 		// if other peers need these as static facts, they would have it in their config
 		if pk != dev.PublicKey {
 			ret = s.handlePeerConfigEndpoints(pk, pc, expires, ret)
 		}
+		for _, sf := range ret[numFacts:] {
+			prov.Add(sf, fact.ConfigSource)
+		}
+	}
+
+	// nodes that joined with our tokens are like statically configured peers
+	numFacts := len(ret)
+	ret = append(ret, s.enrollmentFacts(expires)...)
+	// as are the addresses we allocated
+	ret = append(ret, s.addressFacts(expires)...)
+	for _, ef := range ret[numFacts:] {
+		prov.Add(ef, fact.ConfigSource)
+	}
+
+	// successions we announce or know about
+	for _, sf := range s.successionFacts(dev.PublicKey, expires) {
+		ret = append(ret, sf)
+		prov.Add(sf, fact.ConfigSource)
+	}
+
+	// signed roster pages from the config, which we distribute to peers
+	for _, rf := range s.rosterFacts(expires) {
+		ret = append(ret, rf)
+		prov.Add(rf, fact.ConfigSource)
 	}
 
 	return
@@ -113,7 +148,7 @@ func (s *LinkServer) handlePeerConfigAllowedIPs(
 				Value:     &fact.IPNetValue{IPNet: aip},
 			}
 			// not worth logging this, it will happen on every loop
-			// log.Debug("Tracking static fact: %v", staticFact)
+			// logger.Debug("Tracking static fact: %v", staticFact)
 			facts = append(facts, staticFact)
 		}
 	}
@@ -130,7 +165,7 @@ func (s *LinkServer) handlePeerConfigEndpoints(
 
 	// only do static lookups for dead peers
 	if pcs, ok := s.peerConfig.Get(pk); ok && (pcs.IsAlive() || pcs.IsHealthy()) {
-		log.Debug("Skipping static lookup for OK peer %s", s.peerName(pk))
+		logger.Debug("Skipping static lookup for OK peer %s", s.peerName(pk))
 		return
 	}
 
@@ -166,7 +201,7 @@ func (s *LinkServer) handlePeerConfigEndpoints(
 				Expires:   expires,
 				Value:     &fact.IPPortValue{IP: nip, Port: ep.Port},
 			}
-			log.Debug("Tracking static fact: %v", staticFact)
+			logger.Debug("Tracking static fact: %v", staticFact)
 			facts = append(facts, staticFact)
 		}
 	}
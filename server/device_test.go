@@ -268,7 +268,7 @@ func TestLinkServer_collectFacts(t *testing.T) {
 				peerConfig: tt.fields.peerConfig,
 				FactTTL:    DefaultFactTTL,
 			}
-			gotRet, err := s.collectFacts(tt.args.dev, now)
+			gotRet, gotProv, err := s.collectFacts(tt.args.dev, now)
 			if tt.wantErr {
 				require.NotNil(t, err)
 			} else {
@@ -279,6 +279,15 @@ func TestLinkServer_collectFacts(t *testing.T) {
 			for _, f := range tt.wantRet {
 				assert.Contains(t, gotRet, f)
 			}
+			for _, f := range gotRet {
+				sources := gotProv.Sources(f)
+				assert.NotEmpty(t, sources, "fact should have a source: %v", f)
+				ps, ok := f.Subject.(*fact.PeerSubject)
+				if ok && tt.fields.config.Peers.Has(ps.Key) &&
+					(f.Attribute == fact.AttributeMember || f.Attribute == fact.AttributeMemberMetadata) {
+					assert.Contains(t, sources, fact.SourceExpiry{Source: fact.ConfigSource, Expires: f.Expires})
+				}
+			}
 			env.AssertExpectations(t)
 		})
 	}
@@ -0,0 +1,355 @@
+package server
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/trust"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// digestBackoffAfter is how many rounds of digests we send to a peer that has
+// never sent us one before we slow down, as it may be running an older version
+// that doesn't understand them
+const digestBackoffAfter = 3
+
+// digestBackoffFactor is how much slower we send digests to peers that don't
+// send them back
+const digestBackoffFactor = 10
+
+// digestResyncMaxBackoff limits how many digest periods apart we will forget
+// what a peer knows about a subject, when its digest keeps disagreeing with ours
+// even after we re-send our facts. This is normal when the peers trust
+// different sources, and so will never agree.
+const digestResyncMaxBackoff = 16
+
+// subjectDigests tracks the digest exchange with a peer for a single subject
+type subjectDigests struct {
+	// replied is when we last replied to a digest about the subject, so that two
+	// peers that persistently disagree don't bounce digests back and forth
+	replied time.Time
+	// synced is set when the last digest we got about the subject matched ours
+	synced bool
+	// resyncs counts how many times in a row we have forgotten what the peer
+	// knows about the subject due to a mismatch, nextResync is when we may do so
+	// again
+	resyncs    int
+	nextResync time.Time
+}
+
+// peerDigests tracks the digest exchange state for a single peer
+type peerDigests struct {
+	// capable is set once we have seen the peer send a digest
+	capable  bool
+	rounds   int
+	nextSend time.Time
+	subjects map[wgtypes.Key]*subjectDigests
+}
+
+func (pd *peerDigests) subject(subject wgtypes.Key) *subjectDigests {
+	sd, ok := pd.subjects[subject]
+	if !ok {
+		sd = &subjectDigests{}
+		pd.subjects[subject] = sd
+	}
+	return sd
+}
+
+// digestTracker keeps the digests of the current fact set, and the state of
+// the digest exchange with each peer.
+// It is safe to call methods on a nil digestTracker, they will do nothing.
+type digestTracker struct {
+	access sync.Mutex
+	// local and horizons are replaced, never modified, when the fact set changes
+	local    map[wgtypes.Key]fact.DigestValue
+	horizons map[wgtypes.Key]time.Time
+	peers    map[wgtypes.Key]*peerDigests
+}
+
+func newDigestTracker() *digestTracker {
+	return &digestTracker{
+		peers: make(map[wgtypes.Key]*peerDigests),
+	}
+}
+
+func (dt *digestTracker) get(peer wgtypes.Key) *peerDigests {
+	pd, ok := dt.peers[peer]
+	if !ok {
+		pd = &peerDigests{subjects: make(map[wgtypes.Key]*subjectDigests)}
+		dt.peers[peer] = pd
+	}
+	return pd
+}
+
+// update recomputes the local digests and their horizons from the current fact
+// set
+func (dt *digestTracker) update(facts []*fact.Fact) {
+	if dt == nil {
+		return
+	}
+	local := fact.Digests(facts)
+	horizons := fact.DigestHorizons(facts)
+	dt.access.Lock()
+	defer dt.access.Unlock()
+	dt.local = local
+	dt.horizons = horizons
+}
+
+// renew recomputes just the horizons of the local digests, for when facts have
+// been renewed, which doesn't change the digests themselves
+func (dt *digestTracker) renew(facts []*fact.Fact) {
+	if dt == nil {
+		return
+	}
+	horizons := fact.DigestHorizons(facts)
+	dt.access.Lock()
+	defer dt.access.Unlock()
+	dt.horizons = horizons
+}
+
+// current returns the local digests and their horizons, which must not be
+// modified
+func (dt *digestTracker) current() (map[wgtypes.Key]fact.DigestValue, map[wgtypes.Key]time.Time) {
+	if dt == nil {
+		return nil, nil
+	}
+	dt.access.Lock()
+	defer dt.access.Unlock()
+	return dt.local, dt.horizons
+}
+
+// due returns whether it is time to send our digests to the peer, and records
+// that we did so if true
+func (dt *digestTracker) due(peer wgtypes.Key, now time.Time, period time.Duration) bool {
+	if dt == nil {
+		return false
+	}
+	dt.access.Lock()
+	defer dt.access.Unlock()
+	pd := dt.get(peer)
+	if now.Before(pd.nextSend) {
+		return false
+	}
+	pd.rounds++
+	if !pd.capable && pd.rounds >= digestBackoffAfter {
+		pd.nextSend = now.Add(period * digestBackoffFactor)
+	} else {
+		pd.nextSend = now.Add(period)
+	}
+	return true
+}
+
+// received compares a digest from a peer with our own, returning whether they
+// differ, and if so whether we should forget what the peer knows about the
+// subject, which backs off if they keep differing, and whether we should reply
+// with our digest for the subject
+func (dt *digestTracker) received(
+	peer, subject wgtypes.Key,
+	dv *fact.DigestValue,
+	now time.Time,
+	period time.Duration,
+) (mismatch, forget, reply bool) {
+	if dt == nil {
+		return false, false, false
+	}
+	dt.access.Lock()
+	defer dt.access.Unlock()
+	pd := dt.get(peer)
+	pd.capable = true
+	sd := pd.subject(subject)
+	// a missing local digest is the zero value, which will never match
+	if dt.local[subject] == *dv {
+		sd.synced = true
+		sd.resyncs = 0
+		sd.nextResync = time.Time{}
+		return false, false, false
+	}
+	sd.synced = false
+	if !now.Before(sd.nextResync) {
+		forget = true
+		backoff := digestResyncMaxBackoff
+		if sd.resyncs < 4 {
+			backoff = 1 << sd.resyncs
+		}
+		sd.resyncs++
+		sd.nextResync = now.Add(period * time.Duration(backoff))
+	}
+	if now.Sub(sd.replied) >= period {
+		sd.replied = now
+		reply = true
+	}
+	return true, forget, reply
+}
+
+// synced checks if the last digest we got from the peer about the subject
+// matched ours. If so, the peer renews the facts it has about the subject when
+// it gets our digests, and we don't need to re-send them as they expire.
+func (dt *digestTracker) synced(peer, subject wgtypes.Key) bool {
+	if dt == nil {
+		return false
+	}
+	dt.access.Lock()
+	defer dt.access.Unlock()
+	pd, ok := dt.peers[peer]
+	if !ok {
+		return false
+	}
+	sd, ok := pd.subjects[subject]
+	return ok && sd.synced
+}
+
+// trim removes state for peers we no longer need to track
+func (dt *digestTracker) trim(keep func(wgtypes.Key) bool) {
+	if dt == nil {
+		return
+	}
+	dt.access.Lock()
+	defer dt.access.Unlock()
+	for k := range dt.peers {
+		if !keep(k) {
+			delete(dt.peers, k)
+		}
+	}
+}
+
+// digestFact makes the fact to send for the digest of a subject. Its
+// expiration is the horizon of the digest: when the first of the facts that go
+// into it would expire. Peers that have the same digest use this to renew their
+// own copies of those facts.
+func (s *LinkServer) digestFact(
+	subject wgtypes.Key,
+	dv fact.DigestValue,
+	horizon time.Time,
+	now time.Time,
+) *fact.Fact {
+	if horizon.IsZero() {
+		// we don't have any facts about the subject, so nothing to renew
+		horizon = now.Add(s.AlivePeriod)
+	}
+	return &fact.Fact{
+		Attribute: fact.AttributeDigest,
+		Subject:   &fact.PeerSubject{Key: subject},
+		Value:     &dv,
+		Expires:   horizon,
+	}
+}
+
+// makeDigestGroups creates the signed groups with our digests to send to a
+// peer, leaving out the digest for the peer itself, as we never send it facts
+// about itself. These are kept separate from other facts as older peers will
+// reject the whole group.
+func (s *LinkServer) makeDigestGroups(peer wgtypes.Key, now time.Time) ([]*fact.Fact, error) {
+	digests, horizons := s.digests.current()
+	subjects := make([]wgtypes.Key, 0, len(digests))
+	for subject := range digests {
+		// skip subjects whose facts are all about to expire
+		if subject != peer && horizons[subject].After(now) {
+			subjects = append(subjects, subject)
+		}
+	}
+	if len(subjects) == 0 {
+		return nil, nil
+	}
+	sort.Slice(subjects, func(i, j int) bool {
+		return bytes.Compare(subjects[i][:], subjects[j][:]) < 0
+	})
+	ga := fact.NewAccumulator(fact.SignedGroupMaxSafeInnerLength, now)
+	for _, subject := range subjects {
+		if err := ga.AddFact(s.digestFact(subject, digests[subject], horizons[subject], now)); err != nil {
+			return nil, err
+		}
+	}
+	return ga.MakeSignedGroups(s.signer, &peer)
+}
+
+// handleDigest processes digest facts received from a peer, returning true if
+// the fact was a digest fact. If the peer's digest matches ours, it also
+// returns renew, and the fact should be passed on so that renewFromDigest can
+// use it to renew our copies of the facts it covers. Otherwise we forget what
+// we think the peer knows about the subject, so that our next broadcast will
+// push our facts to it, and reply with our digest so that it will do the same.
+func (s *LinkServer) handleDigest(source wgtypes.Key, f *fact.Fact, now time.Time) (handled, renew bool) {
+	if f.Attribute != fact.AttributeDigest {
+		return false, false
+	}
+	dv, ok := f.Value.(*fact.DigestValue)
+	if !ok {
+		logger.Error("Digest fact has wrong value type: %T", f.Value)
+		return true, false
+	}
+	ps, ok := f.Subject.(*fact.PeerSubject)
+	if !ok {
+		logger.Error("Digest fact has wrong subject type: %T", f.Subject)
+		return true, false
+	}
+
+	mismatch, forget, reply := s.digests.received(source, ps.Key, dv, now, s.AlivePeriod)
+	if !mismatch {
+		return true, true
+	}
+	if forget {
+		logger.Debug("Peer %s disagrees about %s, resyncing", s.peerName(source), s.peerName(ps.Key))
+		s.peerKnowledge.forgetSubject(source, ps)
+	}
+	if reply {
+		digests, horizons := s.digests.current()
+		err := s.sendStandalone(source, s.digestFact(ps.Key, digests[ps.Key], horizons[ps.Key], now), now)
+		if err != nil {
+			logger.Error("Unable to send digest to %s: %v", s.peerName(source), err)
+		}
+	}
+	return true, false
+}
+
+// renewFromDigest handles a digest from a peer that matched ours: the peer
+// has the same facts about the subject as we do, until at least the expiration
+// of the digest fact. We renew our copies of those facts to that time, as if
+// the peer had sent them all to us again, subject to the same trust checks, and
+// record that the peer knows them. This, not re-sending facts as they expire,
+// is what keeps peers that exchange digests in sync.
+func (s *LinkServer) renewFromDigest(
+	store *fact.Store,
+	prov fact.Provenance,
+	rf *ReceivedFact,
+	pl peerLookup,
+	evaluator trust.Evaluator,
+	now time.Time,
+) {
+	sourceKey, ok := pl.get(rf.source.IP)
+	if !ok {
+		return
+	}
+	ps := rf.fact.Subject.(*fact.PeerSubject)
+	facts := store.BySubject(ps)
+	// the store may have changed since the digest arrived
+	if fact.Digests(facts)[ps.Key] != *rf.fact.Value.(*fact.DigestValue) {
+		return
+	}
+	expires := rf.fact.Expires
+	if limit := now.Add(s.FactTTL); expires.After(limit) {
+		expires = limit
+	}
+	for _, f := range facts {
+		if !fact.Digestible(f) {
+			continue
+		}
+		renewed := &fact.Fact{
+			Attribute: f.Attribute,
+			Subject:   f.Subject,
+			Value:     f.Value,
+			Expires:   expires,
+		}
+		s.peerKnowledge.upsertReceived(&ReceivedFact{fact: renewed, source: rf.source}, pl)
+		if !f.Expires.Before(expires) {
+			continue
+		}
+		if ok, _, _ := s.acceptReceived(renewed, rf.source, pl, evaluator, now); ok {
+			store.Upsert(renewed)
+			prov.Add(renewed, fact.PeerSource(sourceKey))
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/autopeer"
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/fact"
+	netmocks "github.com/fastcat/wirelink/internal/networking/mocks"
+	"github.com/fastcat/wirelink/internal/testutils"
+	factutils "github.com/fastcat/wirelink/internal/testutils/facts"
+	"github.com/fastcat/wirelink/signing"
+	"github.com/fastcat/wirelink/trust"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDigestTracker(t *testing.T) {
+	now := time.Now()
+	period := time.Second
+	expires := now.Add(DefaultFactTTL)
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	k3 := testutils.MustKey(t)
+
+	ep := factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &k2, expires)
+	dt := newDigestTracker()
+	dt.update([]*fact.Fact{ep})
+	local, horizons := dt.current()
+	require.Contains(t, local, k2)
+	mine := local[k2]
+	assert.Equal(t, expires, horizons[k2])
+
+	// renewals move the horizon but not the digest
+	renewed := *ep
+	renewed.Expires = expires.Add(time.Minute)
+	dt.renew([]*fact.Fact{&renewed})
+	local, horizons = dt.current()
+	assert.Equal(t, mine, local[k2])
+	assert.Equal(t, renewed.Expires, horizons[k2])
+
+	// digests back off for peers that never send them
+	for i := 0; i < digestBackoffAfter; i++ {
+		assert.True(t, dt.due(k1, now.Add(time.Duration(i)*period), period))
+		assert.False(t, dt.due(k1, now.Add(time.Duration(i)*period+period/2), period))
+	}
+	assert.False(t, dt.due(k1, now.Add(digestBackoffAfter*period), period))
+
+	// a matching digest marks the peer capable, and the subject synced
+	assert.False(t, dt.synced(k1, k2))
+	mismatch, forget, reply := dt.received(k1, k2, &mine, now, period)
+	assert.False(t, mismatch)
+	assert.False(t, forget)
+	assert.False(t, reply)
+	assert.True(t, dt.peers[k1].capable)
+	assert.True(t, dt.synced(k1, k2))
+
+	// a different digest, or one for a subject we don't know, needs a reply,
+	// but not too often
+	other := fact.DigestValue{Hash: [16]byte{1}}
+	mismatch, forget, reply = dt.received(k1, k2, &other, now, period)
+	assert.True(t, mismatch)
+	assert.True(t, forget)
+	assert.True(t, reply)
+	assert.False(t, dt.synced(k1, k2))
+	mismatch, forget, reply = dt.received(k1, k2, &other, now.Add(period/2), period)
+	assert.True(t, mismatch)
+	assert.False(t, forget)
+	assert.False(t, reply)
+	mismatch, forget, reply = dt.received(k1, k3, &other, now.Add(period/2), period)
+	assert.True(t, mismatch)
+	assert.True(t, forget)
+	assert.True(t, reply)
+
+	// if it keeps disagreeing, we back off forgetting, up to a limit
+	at := now
+	for i := 0; i < 8; i++ {
+		backoff := 1 << i
+		if backoff > digestResyncMaxBackoff {
+			backoff = digestResyncMaxBackoff
+		}
+		at = at.Add(period * time.Duration(backoff))
+		mismatch, forget, _ = dt.received(k1, k2, &other, at.Add(-period/2), period)
+		assert.True(t, mismatch)
+		assert.False(t, forget, "round %d", i)
+		mismatch, forget, _ = dt.received(k1, k2, &other, at, period)
+		assert.True(t, mismatch)
+		assert.True(t, forget, "round %d", i)
+	}
+
+	// agreeing resets the backoff
+	dt.received(k1, k2, &mine, at, period)
+	_, forget, _ = dt.received(k1, k2, &other, at, period)
+	assert.True(t, forget)
+
+	dt.trim(func(k wgtypes.Key) bool { return k != k1 })
+	assert.Empty(t, dt.peers)
+
+	// nil tracker is safe to use
+	var nilDT *digestTracker
+	nilDT.update(nil)
+	nilDT.renew(nil)
+	local, horizons = nilDT.current()
+	assert.Nil(t, local)
+	assert.Nil(t, horizons)
+	assert.False(t, nilDT.due(k1, now, period))
+	mismatch, forget, reply = nilDT.received(k1, k2, &mine, now, period)
+	assert.False(t, mismatch)
+	assert.False(t, forget)
+	assert.False(t, reply)
+	assert.False(t, nilDT.synced(k1, k2))
+	nilDT.trim(func(wgtypes.Key) bool { return false })
+}
+
+func TestPeerKnowledgeSet_forgetSubject(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(DefaultFactTTL)
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	k3 := testutils.MustKey(t)
+	peer := &wgtypes.Peer{PublicKey: k1}
+	ep2 := factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &k2, expires)
+	ep3 := factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &k3, expires)
+	alive2 := factutils.AliveFact(&k2, expires)
+
+	pks := newPKS().mockPeerKnows(&k1, ep2).mockPeerKnows(&k1, ep3).mockPeerKnows(&k1, alive2)
+	pks.forgetSubject(k1, &fact.PeerSubject{Key: k2})
+	assert.False(t, pks.peerKnows(peer, ep2, 0))
+	assert.True(t, pks.peerKnows(peer, ep3, 0))
+	assert.True(t, pks.peerKnows(peer, alive2, 0), "should not forget alive")
+
+	var nilPKS *peerKnowledgeSet
+	nilPKS.forgetSubject(k1, &fact.PeerSubject{Key: k2})
+}
+
+func TestLinkServer_makeDigestGroups(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(DefaultFactTTL)
+	localPrivKey, _ := testutils.MustKeyPair(t)
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+
+	s := &LinkServer{
+		signer:      signing.New(&localPrivKey),
+		digests:     newDigestTracker(),
+		AlivePeriod: DefaultAlivePeriod,
+	}
+	groups, err := s.makeDigestGroups(k1, now)
+	assert.Nil(t, err)
+	assert.Empty(t, groups)
+
+	s.digests.update([]*fact.Fact{
+		factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &k1, expires),
+		factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &k2, expires),
+	})
+	groups, err = s.makeDigestGroups(k1, now)
+	require.Nil(t, err)
+	require.Len(t, groups, 1)
+	inner, err := groups[0].Value.(*fact.SignedGroupValue).ParseInner(now)
+	require.Nil(t, err)
+	require.Len(t, inner, 1, "should not send a peer the digest about itself")
+	assert.Equal(t, fact.AttributeDigest, inner[0].Attribute)
+	assert.Equal(t, &fact.PeerSubject{Key: k2}, inner[0].Subject)
+	digests, _ := s.digests.current()
+	dv := digests[k2]
+	assert.Equal(t, &dv, inner[0].Value)
+	// the digest expires when the first fact in it does
+	assert.Equal(t, expires.Truncate(time.Second), inner[0].Expires.Truncate(time.Second))
+}
+
+// expectDigest sets up a mock to expect a digest fact sent to the given peer
+func expectDigest(
+	t *testing.T,
+	conn *netmocks.UDPConn,
+	now time.Time,
+	to, subject wgtypes.Key,
+	dv fact.DigestValue,
+) *mock.Call {
+	dest := &net.UDPAddr{
+		IP: autopeer.AutoAddress(to),
+	}
+	isDigest := func(packet []byte) bool {
+		f := &fact.Fact{}
+		if err := f.DecodeFrom(0, now, bytes.NewBuffer(packet)); err != nil {
+			return false
+		}
+		sgv, ok := f.Value.(*fact.SignedGroupValue)
+		if !ok {
+			return false
+		}
+		inner, err := sgv.ParseInner(now)
+		if err != nil || len(inner) != 1 {
+			return false
+		}
+		got, ok := inner[0].Value.(*fact.DigestValue)
+		return ok &&
+			inner[0].Attribute == fact.AttributeDigest &&
+			*inner[0].Subject.(*fact.PeerSubject) == fact.PeerSubject{Key: subject} &&
+			*got == dv
+	}
+	return conn.On("WriteToUDP", mock.MatchedBy(isDigest), dest).Return(1, nil)
+}
+
+func TestLinkServer_handleDigest(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(DefaultFactTTL)
+
+	localPrivKey, _ := testutils.MustKeyPair(t)
+	remoteKey := testutils.MustKey(t)
+	subjectKey := testutils.MustKey(t)
+	ep := factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &subjectKey, expires)
+	mine := fact.Digests([]*fact.Fact{ep})[subjectKey]
+	theirs := fact.DigestValue{Hash: [16]byte{1}}
+
+	digestFact := func(dv fact.DigestValue) *fact.Fact {
+		return &fact.Fact{
+			Attribute: fact.AttributeDigest,
+			Subject:   &fact.PeerSubject{Key: subjectKey},
+			Value:     &dv,
+			Expires:   expires,
+		}
+	}
+
+	tests := []struct {
+		name        string
+		f           *fact.Fact
+		resynced    bool
+		wantHandled bool
+		wantRenew   bool
+		expectReply bool
+		wantKnows   bool
+	}{
+		{"not digest", factutils.AliveFact(&remoteKey, expires), false, false, false, false, true},
+		{"matching", digestFact(mine), false, true, true, false, true},
+		{"different", digestFact(theirs), false, true, false, true, false},
+		{"different, recently resynced", digestFact(theirs), true, true, false, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &netmocks.UDPConn{}
+			conn.Test(t)
+			if tt.expectReply {
+				conn.On("SetWriteDeadline", mock.Anything).Return(nil)
+				expectDigest(t, conn, now, remoteKey, subjectKey, mine).Once()
+			}
+			s := &LinkServer{
+				config:        &config.Server{},
+				conn:          conn,
+				peerConfig:    newPeerConfigSet(),
+				peerKnowledge: newPKS(),
+				digests:       newDigestTracker(),
+				signer:        signing.New(&localPrivKey),
+				ChunkPeriod:   time.Second,
+				AlivePeriod:   DefaultAlivePeriod,
+			}
+			s.digests.update([]*fact.Fact{ep})
+			if tt.resynced {
+				s.digests.received(remoteKey, subjectKey, &theirs, now.Add(-time.Second), s.AlivePeriod)
+			}
+			s.peerKnowledge.mockPeerKnows(&remoteKey, ep)
+			handled, renew := s.handleDigest(remoteKey, tt.f, now)
+			assert.Equal(t, tt.wantHandled, handled)
+			assert.Equal(t, tt.wantRenew, renew)
+			conn.AssertExpectations(t)
+			assert.Equal(t, tt.wantKnows, s.peerKnowledge.peerKnows(&wgtypes.Peer{PublicKey: remoteKey}, ep, 0))
+		})
+	}
+}
+
+func TestLinkServer_renewFromDigest(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(time.Minute)
+	horizon := now.Add(DefaultFactTTL / 2)
+
+	remoteKey := testutils.MustKey(t)
+	subjectKey := testutils.MustKey(t)
+	remoteAddr := net.UDPAddr{IP: autopeer.AutoAddress(remoteKey), Port: 1}
+	ep := factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &subjectKey, expires)
+	aip := factutils.AllowedIPFactFull(testutils.RandIPNet(t, net.IPv4len, nil, nil, 32), &subjectKey, expires)
+	later := factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &subjectKey, horizon.Add(time.Minute))
+	facts := []*fact.Fact{ep, aip, later}
+	mine := fact.Digests(facts)[subjectKey]
+
+	digestFact := func(dv fact.DigestValue, expires time.Time) *ReceivedFact {
+		return &ReceivedFact{
+			fact: &fact.Fact{
+				Attribute: fact.AttributeDigest,
+				Subject:   &fact.PeerSubject{Key: subjectKey},
+				Value:     &dv,
+				Expires:   expires,
+			},
+			source: remoteAddr,
+		}
+	}
+
+	tests := []struct {
+		name string
+		rf   *ReceivedFact
+		// the remote is only trusted to tell us about endpoints
+		trusted   trust.Level
+		wantEP    time.Time
+		wantAIP   time.Time
+		wantKnows bool
+	}{
+		{"matching, trusted", digestFact(mine, horizon), trust.AllowedIPs, horizon, horizon, true},
+		{"matching, untrusted for AIPs", digestFact(mine, horizon), trust.Endpoint, horizon, expires, true},
+		{"matching, capped", digestFact(mine, now.Add(time.Hour)), trust.AllowedIPs, now.Add(DefaultFactTTL), now.Add(DefaultFactTTL), true},
+		{"different", digestFact(fact.DigestValue{}, horizon), trust.AllowedIPs, expires, expires, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := fact.NewStore()
+			for _, f := range facts {
+				store.Upsert(f)
+			}
+			prov := fact.Provenance{}
+			pl := createFromKeys(nil, remoteKey)
+			evaluator := trust.CreateComposite(trust.FirstOnly,
+				config.CreateTrustEvaluator(map[wgtypes.Key]*config.Peer{
+					remoteKey: {Trust: &tt.trusted},
+				}, nil),
+				trust.CreateRouteBasedTrust([]wgtypes.Peer{{PublicKey: remoteKey}, {PublicKey: subjectKey}}, nil),
+			)
+			s := &LinkServer{
+				peerKnowledge: newPKS(),
+				FactTTL:       DefaultFactTTL,
+			}
+
+			s.renewFromDigest(store, prov, tt.rf, pl, evaluator, now)
+
+			got, ok := store.Get(ep)
+			require.True(t, ok)
+			assert.Equal(t, tt.wantEP, got.Expires)
+			got, ok = store.Get(aip)
+			require.True(t, ok)
+			assert.Equal(t, tt.wantAIP, got.Expires)
+			got, ok = store.Get(later)
+			require.True(t, ok)
+			assert.False(t, got.Expires.Before(later.Expires), "should never shorten facts")
+
+			peer := &wgtypes.Peer{PublicKey: remoteKey}
+			assert.Equal(t, tt.wantKnows, s.peerKnowledge.peerKnows(peer, ep, 0))
+			assert.Equal(t, tt.wantKnows, s.peerKnowledge.peerKnows(peer, aip, 0))
+		})
+	}
+}
+
+func TestLinkServer_refreshWindow(t *testing.T) {
+	expires := time.Now().Add(DefaultFactTTL)
+	peerKey := testutils.MustKey(t)
+	syncedKey := testutils.MustKey(t)
+	otherKey := testutils.MustKey(t)
+	synced := factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &syncedKey, expires)
+	other := factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &otherKey, expires)
+
+	s := &LinkServer{
+		digests:     newDigestTracker(),
+		ChunkPeriod: DefaultChunkPeriod,
+	}
+	s.digests.update([]*fact.Fact{synced, other})
+	digests, _ := s.digests.current()
+	dv := digests[syncedKey]
+	s.digests.received(peerKey, syncedKey, &dv, time.Now(), DefaultAlivePeriod)
+
+	assert.Zero(t, s.refreshWindow(peerKey, synced))
+	assert.Equal(t, DefaultChunkPeriod+time.Second, s.refreshWindow(peerKey, other))
+	assert.Equal(t, DefaultChunkPeriod+time.Second, s.refreshWindow(peerKey, factutils.AliveFact(&syncedKey, expires)))
+}
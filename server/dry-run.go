@@ -0,0 +1,103 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fastcat/wirelink/audit"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// dryRunTracker holds the device changes we would have made, had we not been
+// in dry run mode. As the device is never changed, the same changes will
+// usually be computed over and over, so this only keeps the latest for each
+// peer.
+type dryRunTracker struct {
+	access  sync.Mutex
+	pending map[wgtypes.Key][]*audit.Entry
+	// recorded is the peers that have had changes recorded since the current
+	// configure pass began
+	recorded map[wgtypes.Key]bool
+}
+
+func newDryRunTracker() *dryRunTracker {
+	return &dryRunTracker{
+		pending:  make(map[wgtypes.Key][]*audit.Entry),
+		recorded: make(map[wgtypes.Key]bool),
+	}
+}
+
+// begin starts a configure pass. A nil tracker ignores this.
+func (dt *dryRunTracker) begin() {
+	if dt == nil {
+		return
+	}
+	dt.access.Lock()
+	defer dt.access.Unlock()
+	dt.recorded = make(map[wgtypes.Key]bool)
+}
+
+// finish ends a configure pass, dropping the pending changes for the peers
+// that had none recorded during it, as they are no longer needed, and returns
+// those peers. A nil tracker ignores this.
+func (dt *dryRunTracker) finish() []wgtypes.Key {
+	if dt == nil {
+		return nil
+	}
+	dt.access.Lock()
+	defer dt.access.Unlock()
+	var ret []wgtypes.Key
+	for peer := range dt.pending {
+		if !dt.recorded[peer] {
+			delete(dt.pending, peer)
+			ret = append(ret, peer)
+		}
+	}
+	return ret
+}
+
+// record replaces the pending changes for a peer, returning whether they are
+// different from what was pending before. A nil tracker ignores everything.
+func (dt *dryRunTracker) record(peer wgtypes.Key, entries []*audit.Entry) bool {
+	if dt == nil {
+		return false
+	}
+	dt.access.Lock()
+	defer dt.access.Unlock()
+	prev := dt.pending[peer]
+	dt.recorded[peer] = true
+	if len(entries) == 0 {
+		delete(dt.pending, peer)
+	} else {
+		dt.pending[peer] = entries
+	}
+	return describeEntries(prev) != describeEntries(entries)
+}
+
+// describe formats all the pending changes, one per line, in a stable order
+func (dt *dryRunTracker) describe() []string {
+	if dt == nil {
+		return nil
+	}
+	dt.access.Lock()
+	defer dt.access.Unlock()
+	ret := make([]string, 0, len(dt.pending))
+	for _, entries := range dt.pending {
+		for _, e := range entries {
+			ret = append(ret, e.String())
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func describeEntries(entries []*audit.Entry) string {
+	var sb strings.Builder
+	for _, e := range entries {
+		sb.WriteString(e.String())
+		sb.WriteRune('\n')
+	}
+	return sb.String()
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/audit"
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/internal/mocks"
+	"github.com/fastcat/wirelink/internal/testutils"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDryRunTracker(t *testing.T) {
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	e1 := &audit.Entry{Action: audit.PeerAdded, PeerName: "alice"}
+	e2 := &audit.Entry{Action: audit.EndpointChanged, PeerName: "bob", Current: []string{"192.0.2.1:1"}}
+	e2b := &audit.Entry{Action: audit.EndpointChanged, PeerName: "bob", Current: []string{"192.0.2.2:1"}}
+
+	dt := newDryRunTracker()
+	assert.Empty(t, dt.describe())
+	assert.True(t, dt.record(k1, []*audit.Entry{e1}))
+	assert.False(t, dt.record(k1, []*audit.Entry{e1}), "repeat is not a change")
+	assert.True(t, dt.record(k2, []*audit.Entry{e2}))
+	assert.Equal(t, []string{e2.String(), e1.String()}, dt.describe())
+	assert.True(t, dt.record(k2, []*audit.Entry{e2b}))
+	assert.Equal(t, []string{e2b.String(), e1.String()}, dt.describe())
+	assert.True(t, dt.record(k1, nil), "clearing is a change")
+	assert.False(t, dt.record(k1, nil))
+	assert.Equal(t, []string{e2b.String()}, dt.describe())
+
+	// changes that aren't recorded again in a configure pass are dropped
+	dt.begin()
+	assert.True(t, dt.record(k1, []*audit.Entry{e1}))
+	assert.Equal(t, []wgtypes.Key{k2}, dt.finish())
+	assert.Equal(t, []string{e1.String()}, dt.describe())
+	dt.begin()
+	assert.False(t, dt.record(k1, []*audit.Entry{e1}))
+	assert.Empty(t, dt.finish())
+	assert.Equal(t, []string{e1.String()}, dt.describe())
+	dt.begin()
+	assert.Equal(t, []wgtypes.Key{k1}, dt.finish())
+	assert.Empty(t, dt.describe())
+
+	// nil tracker is safe
+	var nilTracker *dryRunTracker
+	assert.False(t, nilTracker.record(k1, []*audit.Entry{e1}))
+	assert.Empty(t, nilTracker.describe())
+	nilTracker.begin()
+	assert.Empty(t, nilTracker.finish())
+}
+
+func TestLinkServer_configureDevice_dryRun(t *testing.T) {
+	now := time.Now()
+	wgIface := "wg0"
+	peerKey := testutils.MustKey(t)
+	aip := testutils.MakeIPv4Net(10, 2, 0, 0, 16)
+	aipFact := &fact.Fact{
+		Attribute: fact.AttributeAllowedCidrV4,
+		Subject:   &fact.PeerSubject{Key: peerKey},
+		Value:     &fact.IPNetValue{IPNet: aip},
+		Expires:   now.Add(time.Minute),
+	}
+	prev := []wgtypes.Peer{{PublicKey: peerKey}}
+	cfg := wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: peerKey, AllowedIPs: []net.IPNet{aip}}}}
+
+	// no ConfigureDevice expectation: the mock will fail the test if it is called
+	ctrl := &mocks.WgClient{}
+	ctrl.Test(t)
+	recorder := &memoryAudit{}
+	conf := buildConfig(wgIface).withPeer(peerKey, &config.Peer{Name: "bob"}).Build()
+	conf.DryRun = true
+	s := &LinkServer{
+		config:      conf,
+		ctrl:        ctrl,
+		audit:       recorder,
+		dryRun:      newDryRunTracker(),
+		peerConfig:  newPeerConfigSet(),
+		stateAccess: &sync.Mutex{},
+	}
+
+	require.NoError(t, s.configureDevice(cfg, prev, map[wgtypes.Key][]*fact.Fact{peerKey: {aipFact}}, "testing"))
+	ac := &auditedClient{s.ctrl, s, prev, "startup"}
+	require.NoError(t, ac.ConfigureDevice(wgIface, cfg))
+	ctrl.AssertExpectations(t)
+	assert.Empty(t, recorder.entries, "dry run changes should not be audited")
+
+	pending := s.dryRun.describe()
+	require.Len(t, pending, 1)
+	assert.Contains(t, pending[0], string(audit.AllowedIPsChanged))
+	assert.Contains(t, pending[0], "bob")
+	assert.Contains(t, pending[0], "startup", "should keep the latest change")
+
+	assert.Contains(t, s.formatFacts(now, nil), "\nPending changes (dry run):\n"+pending[0]+"\n")
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/fastcat/wirelink/apply"
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/enroll"
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/internal/clock"
+	"github.com/fastcat/wirelink/internal/networking"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// enrollTracker holds the secret for the join tokens we issue, and the nodes
+// that have joined with them
+type enrollTracker struct {
+	access sync.Mutex
+	secret []byte
+	store  *enroll.Store
+}
+
+// newEnrollTracker loads the token secret and the enrollments. In dry run
+// mode, a missing secret is not created, and new enrollments are only kept in
+// memory, as we don't change anything.
+func newEnrollTracker(keyFile, storeFile string, dryRun bool) (*enrollTracker, error) {
+	var secret []byte
+	var err error
+	if dryRun {
+		secret, err = enroll.LoadSecret(keyFile)
+		if os.IsNotExist(errors.Cause(err)) {
+			// we don't serve join requests in dry run mode, so don't need it
+			err = nil
+		}
+	} else {
+		secret, err = enroll.LoadOrCreateSecret(keyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	store, err := enroll.LoadStore(storeFile)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		store.MemoryOnly()
+	}
+	return &enrollTracker{secret: secret, store: store}, nil
+}
+
+// enrollments returns the current enrollments, a nil tracker has none
+func (et *enrollTracker) enrollments() []*enroll.Enrollment {
+	if et == nil {
+		return nil
+	}
+	et.access.Lock()
+	defer et.access.Unlock()
+	return append([]*enroll.Enrollment(nil), et.store.Enrollments()...)
+}
+
+// join validates a join request, with the proof that the node holds the token,
+// and records the enrollment, returning whether it was new. A node that already
+// joined with the token may repeat its request, even after the token expires.
+func (et *enrollTracker) join(key wgtypes.Key, token *enroll.Token, proof []byte, now time.Time) (bool, error) {
+	et.access.Lock()
+	defer et.access.Unlock()
+	if len(et.secret) == 0 {
+		return false, errors.New("No token secret to verify join requests with")
+	}
+	if err := token.VerifyProof(et.secret, key, proof); err != nil {
+		return false, err
+	}
+	if user, used := et.store.Used(token); used {
+		if user != key {
+			return false, errors.Errorf("Join token %s was already used by %s", token.IDString(), user)
+		}
+		return false, nil
+	}
+	if token.Expired(now) {
+		return false, errors.Errorf("Join token %s expired at %v", token.IDString(), token.Expires)
+	}
+	return et.store.Enroll(key, token, now)
+}
+
+// enrollmentFacts makes the membership facts for the nodes that joined with
+// our tokens, like the facts for statically configured peers
+func (s *LinkServer) enrollmentFacts(expires time.Time) (ret []*fact.Fact) {
+	for _, e := range s.enrollments.enrollments() {
+		// the static config takes precedence
+		if s.config.Peers.Has(e.PublicKey) {
+			continue
+		}
+		f := &fact.Fact{
+			Attribute: fact.AttributeMember,
+			Subject:   &fact.PeerSubject{Key: e.PublicKey},
+			Value:     &fact.EmptyValue{},
+			Expires:   expires,
+		}
+		if e.Name != "" {
+			f.Attribute = fact.AttributeMemberMetadata
+			f.Value = fact.BuildMemberMetadata(e.Name, false, false)
+		}
+		ret = append(ret, f)
+		ret = s.handlePeerConfigAllowedIPs(e.PublicKey, &config.Peer{AllowedIPs: e.AllowedIPs}, expires, ret)
+	}
+	return
+}
+
+// readJoinRequests listens for join requests from new nodes, until the server
+// is stopped
+func (s *LinkServer) readJoinRequests(conn networking.UDPConn) error {
+	packets := make(chan *networking.UDPPacket, 1)
+	rCtx, rCancel := context.WithCancel(s.ctx)
+	defer rCancel()
+	s.AddHandler(func(ctx context.Context) error {
+		return conn.ReadPackets(rCtx, fact.UDPMaxSafePayload*2, packets)
+	})
+
+	for packet := range packets {
+		if packet.Err != nil {
+			return errors.Wrap(packet.Err, "Failed to read from join socket, giving up")
+		}
+		if err := s.handleJoinRequest(packet.Data, packet.Addr, packet.Time); err != nil {
+			logger.Error("Rejected join request from %v: %v", packet.Addr, err)
+		}
+	}
+	return nil
+}
+
+// handleJoinRequest verifies a join request and enrolls the node that sent it
+func (s *LinkServer) handleJoinRequest(data []byte, source *net.UDPAddr, now time.Time) error {
+	key, token, proof, err := enroll.ParseRequest(s.signer, data, now)
+	if err != nil {
+		return err
+	}
+	if token.Router != s.signer.PublicKey {
+		return errors.Errorf("Join token %s is for %s", token.IDString(), s.peerName(token.Router))
+	}
+	added, err := s.enrollments.join(key, token, proof, now)
+	if err != nil {
+		return err
+	}
+	if added {
+		logger.Info("Enrolled %s as '%s' from %v with join token %s", key, token.Name, source, token.IDString())
+	} else {
+		logger.Debug("Repeated join request from %s", s.peerName(key))
+	}
+	return nil
+}
+
+// joinNetwork sends join requests with our token until we have a healthy
+// connection to the node that issued it
+func (s *LinkServer) joinNetwork(token *enroll.Token) error {
+	conn, err := s.net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return errors.Wrap(err, "Unable to open socket to send join requests")
+	}
+	defer conn.Close()
+
+	ticker := clock.Or(s.clock).NewTicker(s.ChunkPeriod)
+	defer ticker.Stop()
+	logger.Info("Joining the network through %s at %s", token.Router, token.Endpoint)
+
+	for {
+		now := s.now()
+		dev, err := s.deviceState()
+		if err != nil {
+			return errors.Wrap(err, "Unable to load device state to join the network")
+		}
+		if hasHealthyPeer(dev, token.Router, now) {
+			logger.Info("Joined the network through %s", s.peerName(token.Router))
+			return nil
+		}
+		if err = s.sendJoinRequest(conn, token, now); err != nil {
+			logger.Error("Unable to send join request: %v", err)
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return nil
+		case <-ticker.Chan():
+		}
+	}
+}
+
+// hasHealthyPeer checks if the device has a healthy handshake with the peer
+func hasHealthyPeer(dev *wgtypes.Device, key wgtypes.Key, now time.Time) bool {
+	for i := range dev.Peers {
+		if dev.Peers[i].PublicKey == key {
+			return apply.IsHandshakeHealthy(dev.Peers[i].LastHandshakeTime, now)
+		}
+	}
+	return false
+}
+
+func (s *LinkServer) sendJoinRequest(conn networking.UDPConn, token *enroll.Token, now time.Time) error {
+	// resolve every time, in case DNS wasn't available at first
+	addr, err := net.ResolveUDPAddr("udp", token.JoinAddr())
+	if err != nil {
+		return errors.Wrapf(err, "Unable to resolve %s", token.JoinAddr())
+	}
+	packet, err := enroll.MakeRequest(s.signer, token, now)
+	if err != nil {
+		return err
+	}
+	if _, err = conn.WriteToUDP(packet, addr); err != nil {
+		return errors.Wrapf(err, "Unable to send join request to %v", addr)
+	}
+	return nil
+}
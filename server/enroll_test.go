@@ -0,0 +1,283 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/enroll"
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/internal/testutils"
+	"github.com/fastcat/wirelink/signing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustEnrollTracker(t *testing.T) (*enrollTracker, []byte, func()) {
+	dir, err := ioutil.TempDir("", "wirelink-enroll")
+	require.NoError(t, err)
+	et, err := newEnrollTracker(filepath.Join(dir, "token.key"), filepath.Join(dir, "enrolled.json"), false)
+	if err != nil {
+		os.RemoveAll(dir)
+	}
+	require.NoError(t, err)
+	return et, et.secret, func() { os.RemoveAll(dir) }
+}
+
+func mustJoinToken(t *testing.T, secret []byte, router wgtypes.Key, name string, aips []net.IPNet, expires time.Time) *enroll.Token {
+	token, err := enroll.NewToken(router, "192.0.2.1:51820", 51822, name, aips, expires)
+	require.NoError(t, err)
+	_, err = token.Sign(secret)
+	require.NoError(t, err)
+	return token
+}
+
+// mustJoin enrolls a key with a token, as if the holder of the token had
+// sent a join request from that key
+func mustJoin(t *testing.T, et *enrollTracker, key wgtypes.Key, token *enroll.Token, now time.Time) {
+	proofText, err := token.Proof(key)
+	require.NoError(t, err)
+	parsed, proof, err := enroll.ParseProof(proofText)
+	require.NoError(t, err)
+	_, err = et.join(key, parsed, proof, now)
+	require.NoError(t, err)
+}
+
+func TestLinkServer_handleJoinRequest(t *testing.T) {
+	now := time.Now()
+	routerPriv, routerPub := testutils.MustKeyPair(t)
+	node1Priv, node1Pub := testutils.MustKeyPair(t)
+	node2Priv, _ := testutils.MustKeyPair(t)
+	node1 := signing.New(&node1Priv)
+	node2 := signing.New(&node2Priv)
+	otherSecret := testutils.MustRandBytes(t, make([]byte, 32))
+	source := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 12345}
+
+	type request struct {
+		signer  *signing.Signer
+		token   func(secret []byte) *enroll.Token
+		wantErr bool
+	}
+	goodToken := func(secret []byte) *enroll.Token {
+		return mustJoinToken(t, secret, routerPub, "laptop", nil, now.Add(time.Hour))
+	}
+
+	tests := []struct {
+		name     string
+		requests func(good func([]byte) *enroll.Token) []request
+		want     []wgtypes.Key
+	}{
+		{
+			"good",
+			func(good func([]byte) *enroll.Token) []request {
+				return []request{{node1, good, false}}
+			},
+			[]wgtypes.Key{node1Pub},
+		},
+		{
+			"repeated",
+			func(good func([]byte) *enroll.Token) []request {
+				return []request{{node1, good, false}, {node1, good, false}}
+			},
+			[]wgtypes.Key{node1Pub},
+		},
+		{
+			"reused by another node",
+			func(good func([]byte) *enroll.Token) []request {
+				return []request{{node1, good, false}, {node2, good, true}}
+			},
+			[]wgtypes.Key{node1Pub},
+		},
+		{
+			"expired",
+			func(good func([]byte) *enroll.Token) []request {
+				return []request{{node1, func(secret []byte) *enroll.Token {
+					return mustJoinToken(t, secret, routerPub, "laptop", nil, now.Add(-time.Second))
+				}, true}}
+			},
+			nil,
+		},
+		{
+			"other router",
+			func(good func([]byte) *enroll.Token) []request {
+				return []request{{node1, func(secret []byte) *enroll.Token {
+					return mustJoinToken(t, secret, testutils.MustKey(t), "laptop", nil, now.Add(time.Hour))
+				}, true}}
+			},
+			nil,
+		},
+		{
+			"forged",
+			func(good func([]byte) *enroll.Token) []request {
+				return []request{{node1, func([]byte) *enroll.Token {
+					return goodToken(otherSecret)
+				}, true}}
+			},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			et, secret, cleanup := mustEnrollTracker(t)
+			defer cleanup()
+			s := &LinkServer{
+				config:      &config.Server{},
+				signer:      signing.New(&routerPriv),
+				enrollments: et,
+			}
+			// make the token once so that repeated requests use the same one
+			token := goodToken(secret)
+			good := func([]byte) *enroll.Token { return token }
+			for i, r := range tt.requests(good) {
+				packet, err := enroll.MakeRequest(r.signer, r.token(secret), now)
+				require.NoError(t, err)
+				err = s.handleJoinRequest(packet, source, now)
+				if r.wantErr {
+					assert.Error(t, err, "request %d", i)
+				} else {
+					assert.NoError(t, err, "request %d", i)
+				}
+			}
+			var got []wgtypes.Key
+			for _, e := range et.enrollments() {
+				got = append(got, e.PublicKey)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestLinkServer_handleJoinRequest_stolenProof(t *testing.T) {
+	now := time.Now()
+	routerPriv, routerPub := testutils.MustKeyPair(t)
+	node1Priv, node1Pub := testutils.MustKeyPair(t)
+	node2Priv, _ := testutils.MustKeyPair(t)
+	node1 := signing.New(&node1Priv)
+	node2 := signing.New(&node2Priv)
+	source := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 12345}
+
+	et, secret, cleanup := mustEnrollTracker(t)
+	defer cleanup()
+	s := &LinkServer{
+		config:      &config.Server{},
+		signer:      signing.New(&routerPriv),
+		enrollments: et,
+	}
+	token := mustJoinToken(t, secret, routerPub, "laptop", nil, now.Add(time.Hour))
+
+	// node2 copies node1's request off the wire and sends it as its own
+	packet, err := enroll.MakeRequest(node1, token, now)
+	require.NoError(t, err)
+	proofText, err := token.Proof(node1Pub)
+	require.NoError(t, err)
+
+	ga := fact.NewAccumulator(fact.SignedGroupMaxSafeInnerLength, now)
+	require.NoError(t, ga.AddFact(&fact.Fact{
+		Attribute: fact.AttributeJoinRequest,
+		Subject:   &fact.PeerSubject{Key: node2.PublicKey},
+		Value:     &fact.JoinValue{Data: []byte(proofText)},
+		Expires:   now.Add(time.Minute),
+	}))
+	groups, err := ga.MakeSignedGroups(node2, &routerPub)
+	require.NoError(t, err)
+	stolen, err := groups[0].MarshalBinaryNow(now)
+	require.NoError(t, err)
+	assert.Error(t, s.handleJoinRequest(stolen, source, now))
+	assert.Empty(t, et.enrollments())
+
+	// and the real node can still join
+	assert.NoError(t, s.handleJoinRequest(packet, source, now))
+	require.Len(t, et.enrollments(), 1)
+	assert.Equal(t, node1Pub, et.enrollments()[0].PublicKey)
+}
+
+func TestNewEnrollTracker_dryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wirelink-enroll")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "token.key")
+	storeFile := filepath.Join(dir, "enrolled.json")
+	now := time.Now()
+
+	// without a secret, joins are refused, and no secret is created
+	et, err := newEnrollTracker(keyFile, storeFile, true)
+	require.NoError(t, err)
+	assert.Empty(t, et.secret)
+	token := mustJoinToken(t, testutils.MustRandBytes(t, make([]byte, 32)), testutils.MustKey(t), "", nil, now.Add(time.Hour))
+	key := testutils.MustKey(t)
+	proofText, err := token.Proof(key)
+	require.NoError(t, err)
+	parsed, proof, err := enroll.ParseProof(proofText)
+	require.NoError(t, err)
+	_, err = et.join(key, parsed, proof, now)
+	assert.Error(t, err)
+
+	// with a secret, enrollments are only kept in memory
+	secret, err := enroll.LoadOrCreateSecret(keyFile)
+	require.NoError(t, err)
+	et, err = newEnrollTracker(keyFile, storeFile, true)
+	require.NoError(t, err)
+	assert.Equal(t, secret, et.secret)
+	mustJoin(t, et, key, mustJoinToken(t, secret, testutils.MustKey(t), "", nil, now.Add(time.Hour)), now)
+	assert.Len(t, et.store.Enrollments(), 1)
+
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "token.key", entries[0].Name())
+}
+
+func TestLinkServer_enrollmentFacts(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(time.Minute)
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	k3 := testutils.MustKey(t)
+	ipn4 := testutils.MakeIPv4Net(10, 1, 0, 0, 16)
+
+	et, secret, cleanup := mustEnrollTracker(t)
+	defer cleanup()
+	router := testutils.MustKey(t)
+	mustJoin(t, et, k1, mustJoinToken(t, secret, router, "alice", []net.IPNet{ipn4}, expires), now)
+	mustJoin(t, et, k2, mustJoinToken(t, secret, router, "", nil, expires), now)
+	mustJoin(t, et, k3, mustJoinToken(t, secret, router, "carol", nil, expires), now)
+
+	s := &LinkServer{
+		config: &config.Server{
+			Peers: config.Peers{k3: &config.Peer{Name: "static"}},
+		},
+		enrollments: et,
+	}
+	got := s.enrollmentFacts(expires)
+	assert.ElementsMatch(t, []*fact.Fact{
+		{
+			Attribute: fact.AttributeMemberMetadata,
+			Subject:   &fact.PeerSubject{Key: k1},
+			Value:     fact.BuildMemberMetadata("alice", false, false),
+			Expires:   expires,
+		},
+		{
+			Attribute: fact.AttributeAllowedCidrV4,
+			Subject:   &fact.PeerSubject{Key: k1},
+			Value:     &fact.IPNetValue{IPNet: ipn4},
+			Expires:   expires,
+		},
+		{
+			Attribute: fact.AttributeMember,
+			Subject:   &fact.PeerSubject{Key: k2},
+			Value:     &fact.EmptyValue{},
+			Expires:   expires,
+		},
+	}, got)
+
+	// no tracker, no facts
+	s.enrollments = nil
+	assert.Empty(t, s.enrollmentFacts(expires))
+}
@@ -0,0 +1,367 @@
+package server
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/fastcat/wirelink/apply"
+	"github.com/fastcat/wirelink/fact"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// gossipMaxHops is how many times a fact may be gossiped from peer to peer
+// before it stops spreading
+const gossipMaxHops = 3
+
+// gossipFreshRounds is for how many chunk periods after we first learn a fact
+// we will gossip it
+const gossipFreshRounds = 3
+
+// gossipHelloBackoffAfter is how many hellos we send to a peer that has never
+// sent us one before we slow down, as it may be running an older version that
+// doesn't understand gossip
+const gossipHelloBackoffAfter = 3
+
+// gossipHelloBackoffFactor is how much slower we send hellos to peers that
+// don't answer them
+const gossipHelloBackoffFactor = 10
+
+// GossipStats counts gossip activity, so that how quickly it spreads facts,
+// and at what cost, can be measured
+type GossipStats struct {
+	// Rounds is how many broadcasts gossiped to at least one peer
+	Rounds int
+	// Groups is how many signed groups of gossiped facts were sent
+	Groups int
+	// FactsSent is how many facts were gossiped, counting each peer separately
+	FactsSent int
+	// FactsReceived is how many gossiped facts were received
+	FactsReceived int
+}
+
+// gossipInfo is what we know about how we learned a fact
+type gossipInfo struct {
+	learned time.Time
+	hops    uint8
+}
+
+// peerGossip tracks the gossip capability of a single peer
+type peerGossip struct {
+	// capable is set once we have seen the peer send any gossip
+	capable   bool
+	hellos    int
+	nextHello time.Time
+	replied   time.Time
+}
+
+// gossipTracker keeps the state for gossiping facts to peers.
+// It is safe to call methods on a nil gossipTracker, they will do nothing.
+type gossipTracker struct {
+	access sync.Mutex
+	facts  map[fact.Key]gossipInfo
+	peers  map[wgtypes.Key]*peerGossip
+	stats  GossipStats
+	rand   *rand.Rand
+}
+
+// gossipSeed mixes the local public key into a seed taken from the time, so
+// that nodes sharing a (fake) clock still choose different peers to gossip to
+func gossipSeed(now time.Time, local wgtypes.Key) int64 {
+	seed := now.UnixNano()
+	for i := 0; i+8 <= len(local); i += 8 {
+		seed ^= int64(binary.LittleEndian.Uint64(local[i : i+8]))
+	}
+	return seed
+}
+
+// newGossipTracker creates a gossipTracker whose choice of peers is seeded
+// with the given value, see gossipSeed
+func newGossipTracker(seed int64) *gossipTracker {
+	return &gossipTracker{
+		facts: make(map[fact.Key]gossipInfo),
+		peers: make(map[wgtypes.Key]*peerGossip),
+		rand:  rand.New(rand.NewSource(seed)),
+	}
+}
+
+// reseed restarts the choice of peers from the given seed
+func (gt *gossipTracker) reseed(seed int64) {
+	if gt == nil {
+		return
+	}
+	gt.access.Lock()
+	defer gt.access.Unlock()
+	gt.rand.Seed(seed)
+}
+
+func (gt *gossipTracker) get(peer wgtypes.Key) *peerGossip {
+	pg, ok := gt.peers[peer]
+	if !ok {
+		pg = &peerGossip{}
+		gt.peers[peer] = pg
+	}
+	return pg
+}
+
+// learned records that we have a fact, and how many hops it was gossiped to
+// reach us, keeping the first time we learned it and the shortest path
+func (gt *gossipTracker) learned(f *fact.Fact, hops uint8, now time.Time) {
+	if gt == nil {
+		return
+	}
+	k := fact.KeyOf(f)
+	gt.access.Lock()
+	defer gt.access.Unlock()
+	gi, ok := gt.facts[k]
+	if !ok {
+		gt.facts[k] = gossipInfo{learned: now, hops: hops}
+	} else if hops < gi.hops {
+		gi.hops = hops
+		gt.facts[k] = gi
+	}
+}
+
+// forget drops what we know about a fact that is no longer in the fact set
+func (gt *gossipTracker) forget(f *fact.Fact) {
+	if gt == nil {
+		return
+	}
+	gt.access.Lock()
+	defer gt.access.Unlock()
+	delete(gt.facts, fact.KeyOf(f))
+}
+
+// fresh returns how many hops a fact has traveled, and whether it was learned
+// recently enough and close enough to its source to gossip
+func (gt *gossipTracker) fresh(f *fact.Fact, now time.Time, window time.Duration) (uint8, bool) {
+	if gt == nil {
+		return 0, false
+	}
+	gt.access.Lock()
+	defer gt.access.Unlock()
+	gi, ok := gt.facts[fact.KeyOf(f)]
+	return gi.hops, ok && gi.hops < gossipMaxHops && now.Sub(gi.learned) < window
+}
+
+// isCapable returns whether the peer has shown it understands gossip
+func (gt *gossipTracker) isCapable(peer wgtypes.Key) bool {
+	if gt == nil {
+		return false
+	}
+	gt.access.Lock()
+	defer gt.access.Unlock()
+	pg, ok := gt.peers[peer]
+	return ok && pg.capable
+}
+
+// helloDue returns whether we should send a hello to the peer to find out if
+// it understands gossip, and records that we did so if true
+func (gt *gossipTracker) helloDue(peer wgtypes.Key, now time.Time, period time.Duration) bool {
+	if gt == nil {
+		return false
+	}
+	gt.access.Lock()
+	defer gt.access.Unlock()
+	pg := gt.get(peer)
+	if pg.capable || now.Before(pg.nextHello) {
+		return false
+	}
+	pg.hellos++
+	if pg.hellos >= gossipHelloBackoffAfter {
+		pg.nextHello = now.Add(period * gossipHelloBackoffFactor)
+	} else {
+		pg.nextHello = now.Add(period)
+	}
+	return true
+}
+
+// received records gossip received from the peer, marking it as capable, and
+// returns whether we should reply to a hello from it
+func (gt *gossipTracker) received(peer wgtypes.Key, hello bool, facts int, now time.Time, period time.Duration) bool {
+	if gt == nil {
+		return false
+	}
+	gt.access.Lock()
+	defer gt.access.Unlock()
+	pg := gt.get(peer)
+	pg.capable = true
+	gt.stats.FactsReceived += facts
+	if !hello || now.Sub(pg.replied) < period {
+		return false
+	}
+	pg.replied = now
+	return true
+}
+
+// choose picks up to n of the candidates at random
+func (gt *gossipTracker) choose(candidates []*wgtypes.Peer, n int) []*wgtypes.Peer {
+	if gt == nil || n <= 0 {
+		return nil
+	}
+	gt.access.Lock()
+	defer gt.access.Unlock()
+	gt.rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	return candidates
+}
+
+// sent records gossip sent to a peer in the stats
+func (gt *gossipTracker) sent(groups, facts int) {
+	if gt == nil {
+		return
+	}
+	gt.access.Lock()
+	defer gt.access.Unlock()
+	gt.stats.Groups += groups
+	gt.stats.FactsSent += facts
+}
+
+// round records a gossip round in the stats
+func (gt *gossipTracker) round() {
+	if gt == nil {
+		return
+	}
+	gt.access.Lock()
+	defer gt.access.Unlock()
+	gt.stats.Rounds++
+}
+
+// GossipStats returns the counts of gossip activity so far
+func (s *LinkServer) GossipStats() GossipStats {
+	if s.gossip == nil {
+		return GossipStats{}
+	}
+	s.gossip.access.Lock()
+	defer s.gossip.access.Unlock()
+	return s.gossip.stats
+}
+
+// gossipMarker makes the fact that goes at the start of a group of gossiped
+// facts, or alone as a hello
+func (s *LinkServer) gossipMarker(hops uint8, now time.Time) *fact.Fact {
+	return &fact.Fact{
+		Attribute: fact.AttributeGossip,
+		Subject:   &fact.PeerSubject{Key: s.signer.PublicKey},
+		Value:     &fact.GossipValue{Hops: hops},
+		Expires:   now.Add(s.ChunkPeriod),
+	}
+}
+
+// gossipEnabled returns whether we are configured to gossip facts, and to how
+// many peers per round
+func (s *LinkServer) gossipEnabled() bool {
+	enabled, _ := s.gossipConfig()
+	return enabled
+}
+
+func (s *LinkServer) gossipConfig() (bool, int) {
+	// protect against tests mutating config while we read it
+	s.stateAccess.Lock()
+	defer s.stateAccess.Unlock()
+	return s.config.Gossip, s.config.GossipFanout
+}
+
+// gossipTargets picks which peers to gossip to this round: healthy peers that
+// understand gossip, and aren't already getting all our facts
+func (s *LinkServer) gossipTargets(peers []wgtypes.Peer, levels []sendLevel, now time.Time) map[wgtypes.Key]bool {
+	enabled, fanout := s.gossipConfig()
+	if !enabled {
+		return nil
+	}
+	var candidates []*wgtypes.Peer
+	for i := range peers {
+		p := &peers[i]
+		if levels[i] != sendPing || !apply.IsHandshakeHealthy(p.LastHandshakeTime, now) || !s.gossip.isCapable(p.PublicKey) {
+			continue
+		}
+		candidates = append(candidates, p)
+	}
+	chosen := s.gossip.choose(candidates, fanout)
+	if len(chosen) == 0 {
+		return nil
+	}
+	s.gossip.round()
+	ret := make(map[wgtypes.Key]bool, len(chosen))
+	for _, p := range chosen {
+		ret[p.PublicKey] = true
+	}
+	return ret
+}
+
+// makeGossipGroups creates the signed groups of fresh facts to gossip to a
+// peer, grouped by how many hops they will have traveled once it receives them
+func (s *LinkServer) makeGossipGroups(p *wgtypes.Peer, facts []*fact.Fact, now time.Time) ([]*fact.Fact, [][]*fact.Fact, error) {
+	window := gossipFreshRounds * s.ChunkPeriod
+	byHops := make(map[uint8][]*fact.Fact)
+	for _, f := range facts {
+		if ps, ok := f.Subject.(*fact.PeerSubject); ok && ps.Key == p.PublicKey {
+			continue
+		}
+		hops, ok := s.gossip.fresh(f, now, window)
+		if !ok || !s.peerKnowledge.peerNeeds(p, f, s.refreshWindow(p.PublicKey, f), now) {
+			continue
+		}
+		byHops[hops+1] = append(byHops[hops+1], f)
+	}
+
+	var groups []*fact.Fact
+	var contents [][]*fact.Fact
+	count := 0
+	for hops := uint8(1); hops <= gossipMaxHops; hops++ {
+		if len(byHops[hops]) == 0 {
+			continue
+		}
+		ga := s.newAccumulator(p.PublicKey, fact.SignedGroupMaxSafeInnerLength, now)
+		if err := ga.SetHeader(s.gossipMarker(hops, now)); err != nil {
+			return nil, nil, err
+		}
+		for _, f := range byHops[hops] {
+			if err := ga.AddFact(f); err != nil {
+				return nil, nil, err
+			}
+			s.peerKnowledge.upsertSent(p, f)
+			count++
+		}
+		g, c, err := ga.MakeSignedGroupsWithContents(s.signer, &p.PublicKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		groups = append(groups, g...)
+		contents = append(contents, c...)
+	}
+	s.gossip.sent(len(groups), count)
+	return groups, contents, nil
+}
+
+// handleGossip processes a gossip marker received from a peer, returning how
+// many hops the facts with it have traveled, and true if the fact was a gossip
+// marker, which should not be processed any further. A marker alone in a group
+// is a hello, which we answer so the peer knows we understand gossip.
+func (s *LinkServer) handleGossip(source wgtypes.Key, f *fact.Fact, groupLen int, now time.Time) (uint8, bool) {
+	if f.Attribute != fact.AttributeGossip {
+		return 0, false
+	}
+	gv, ok := f.Value.(*fact.GossipValue)
+	if !ok {
+		logger.Error("Gossip fact has wrong value type: %T", f.Value)
+		return 0, true
+	}
+	if ps, ok := f.Subject.(*fact.PeerSubject); !ok || ps.Key != source {
+		logger.Error("Ignoring gossip from %s with mismatched subject %v", s.peerName(source), f.Subject)
+		return 0, true
+	}
+	hello := groupLen == 1
+	if s.gossip.received(source, hello, groupLen-1, now, s.AlivePeriod) {
+		if err := s.sendStandalone(source, s.gossipMarker(0, now), now); err != nil {
+			logger.Error("Unable to send gossip hello to %s: %v", s.peerName(source), err)
+		}
+	}
+	return gv.Hops, true
+}
@@ -0,0 +1,343 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/autopeer"
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/internal/clock"
+	netmocks "github.com/fastcat/wirelink/internal/networking/mocks"
+	"github.com/fastcat/wirelink/internal/testutils"
+	factutils "github.com/fastcat/wirelink/internal/testutils/facts"
+	"github.com/fastcat/wirelink/signing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGossipTracker(t *testing.T) {
+	now := time.Now()
+	period := time.Second
+	expires := now.Add(DefaultFactTTL)
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	f1 := factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &k2, expires)
+	f2 := factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &k2, expires)
+	f3 := factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &k2, expires)
+
+	gt := newGossipTracker(1)
+
+	// facts are fresh for a while after we first learn them, if they haven't
+	// traveled too far
+	gt.learned(f1, 0, now)
+	gt.learned(f2, gossipMaxHops, now)
+	gt.learned(f1, 2, now.Add(period))
+	hops, ok := gt.fresh(f1, now.Add(period), 2*period)
+	assert.True(t, ok)
+	assert.Zero(t, hops, "should keep the shortest path")
+	_, ok = gt.fresh(f1, now.Add(2*period), 2*period)
+	assert.False(t, ok, "should keep the first time it was learned")
+	_, ok = gt.fresh(f2, now, 2*period)
+	assert.False(t, ok, "should stop after max hops")
+	_, ok = gt.fresh(f3, now, 2*period)
+	assert.False(t, ok)
+	gt.learned(f2, 1, now)
+	hops, ok = gt.fresh(f2, now, 2*period)
+	assert.True(t, ok, "should take a shorter path")
+	assert.Equal(t, uint8(1), hops)
+
+	gt.forget(f1)
+	assert.NotContains(t, gt.facts, fact.KeyOf(f1))
+	assert.Contains(t, gt.facts, fact.KeyOf(f2))
+
+	// hellos back off for peers that never answer
+	for i := 0; i < gossipHelloBackoffAfter; i++ {
+		assert.True(t, gt.helloDue(k1, now.Add(time.Duration(i)*period), period))
+		assert.False(t, gt.helloDue(k1, now.Add(time.Duration(i)*period+period/2), period))
+	}
+	assert.False(t, gt.helloDue(k1, now.Add(gossipHelloBackoffAfter*period), period))
+
+	// hellos are answered, but not too often
+	assert.False(t, gt.isCapable(k1))
+	assert.True(t, gt.received(k1, true, 0, now, period))
+	assert.True(t, gt.isCapable(k1))
+	assert.False(t, gt.received(k1, true, 0, now.Add(period/2), period))
+	assert.False(t, gt.received(k1, false, 3, now.Add(period), period))
+	assert.True(t, gt.received(k1, true, 0, now.Add(period), period))
+	assert.False(t, gt.helloDue(k1, now.Add(time.Hour), period))
+
+	peers := []*wgtypes.Peer{{}, {}, {}}
+	assert.Len(t, gt.choose(peers, 2), 2)
+	assert.Len(t, gt.choose(peers, 5), 3)
+	gt.round()
+	gt.sent(2, 5)
+	assert.Equal(t, GossipStats{Rounds: 1, Groups: 2, FactsSent: 5, FactsReceived: 3}, gt.stats)
+
+	// nil tracker is safe to use
+	var nilGT *gossipTracker
+	nilGT.learned(f1, 0, now)
+	nilGT.forget(f1)
+	_, ok = nilGT.fresh(f1, now, period)
+	assert.False(t, ok)
+	assert.False(t, nilGT.isCapable(k1))
+	assert.False(t, nilGT.helloDue(k1, now, period))
+	assert.False(t, nilGT.received(k1, true, 0, now, period))
+	assert.Nil(t, nilGT.choose(peers, 2))
+	nilGT.round()
+	nilGT.sent(1, 1)
+	assert.Equal(t, GossipStats{}, (&LinkServer{}).GossipStats())
+}
+
+func TestGossipTracker_choose_seeded(t *testing.T) {
+	peers := make([]*wgtypes.Peer, 10)
+	for i := range peers {
+		peers[i] = &wgtypes.Peer{PublicKey: testutils.MustKey(t)}
+	}
+	chosen := func(s *LinkServer) []*wgtypes.Peer {
+		var ret []*wgtypes.Peer
+		for i := 0; i < 5; i++ {
+			ret = append(ret, s.gossip.choose(append([]*wgtypes.Peer(nil), peers...), 3)...)
+		}
+		return ret
+	}
+
+	// the same server using fake clocks that start at the same time makes the
+	// same choices, regardless of how it was first seeded
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	key1 := testutils.MustKey(t)
+	key2 := testutils.MustKey(t)
+	s1 := &LinkServer{signer: signing.New(&key1), gossip: newGossipTracker(1)}
+	s1.UseClock(clock.NewFake(start))
+	s1b := &LinkServer{signer: signing.New(&key1), gossip: newGossipTracker(2)}
+	s1b.UseClock(clock.NewFake(start))
+	assert.Equal(t, chosen(s1), chosen(s1b))
+
+	// different servers sharing a clock make different choices
+	s2 := &LinkServer{signer: signing.New(&key2), gossip: newGossipTracker(1)}
+	s2.UseClock(clock.NewFake(start))
+	s1.UseClock(clock.NewFake(start))
+	assert.NotEqual(t, chosen(s1), chosen(s2))
+
+	// the same server makes different choices at a different time
+	s3 := &LinkServer{signer: signing.New(&key1), gossip: newGossipTracker(1)}
+	s3.UseClock(clock.NewFake(start.Add(time.Second)))
+	s1.UseClock(clock.NewFake(start))
+	assert.NotEqual(t, chosen(s1), chosen(s3))
+}
+
+func TestLinkServer_gossipTargets(t *testing.T) {
+	now := time.Now()
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	k3 := testutils.MustKey(t)
+	k4 := testutils.MustKey(t)
+	peers := []wgtypes.Peer{
+		{PublicKey: k1, LastHandshakeTime: now},
+		{PublicKey: k2, LastHandshakeTime: now},
+		{PublicKey: k3},
+		{PublicKey: k4, LastHandshakeTime: now},
+	}
+	levels := []sendLevel{sendPing, sendFacts, sendPing, sendPing}
+
+	tests := []struct {
+		name   string
+		gossip bool
+		fanout int
+		want   int
+	}{
+		{"disabled", false, 3, 0},
+		{"enabled", true, 3, 1},
+		{"zero fanout", true, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &LinkServer{
+				config:      &config.Server{Gossip: tt.gossip, GossipFanout: tt.fanout},
+				stateAccess: &sync.Mutex{},
+				gossip:      newGossipTracker(1),
+			}
+			// k4 is healthy but has never shown it understands gossip, k2 is
+			// getting full facts and k3 is unhealthy
+			for _, k := range []wgtypes.Key{k1, k2, k3} {
+				s.gossip.received(k, false, 0, now, time.Second)
+			}
+			got := s.gossipTargets(peers, levels, now)
+			assert.Len(t, got, tt.want)
+			if tt.want > 0 {
+				assert.True(t, got[k1])
+				assert.Equal(t, 1, s.GossipStats().Rounds)
+			}
+		})
+	}
+}
+
+func TestLinkServer_makeGossipGroups(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(DefaultFactTTL)
+	localPrivKey, localPubKey := testutils.MustKeyPair(t)
+	remoteKey := testutils.MustKey(t)
+	otherKey := testutils.MustKey(t)
+	peer := &wgtypes.Peer{PublicKey: remoteKey}
+
+	fresh0 := factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &otherKey, expires)
+	fresh1 := factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &otherKey, expires)
+	stale := factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &otherKey, expires)
+	tooFar := factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &otherKey, expires)
+	known := factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &otherKey, expires)
+	aboutPeer := factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &remoteKey, expires)
+	facts := []*fact.Fact{fresh0, fresh1, stale, tooFar, known, aboutPeer}
+
+	s := &LinkServer{
+		signer:        signing.New(&localPrivKey),
+		peerKnowledge: newPKS().mockPeerKnows(&remoteKey, known),
+		gossip:        newGossipTracker(1),
+		ChunkPeriod:   time.Second,
+	}
+	s.gossip.learned(fresh0, 0, now)
+	s.gossip.learned(fresh1, 1, now)
+	s.gossip.learned(stale, 0, now.Add(-gossipFreshRounds*s.ChunkPeriod))
+	s.gossip.learned(tooFar, gossipMaxHops, now)
+	s.gossip.learned(known, 0, now)
+	s.gossip.learned(aboutPeer, 0, now)
+
+	groups, contents, err := s.makeGossipGroups(peer, facts, now)
+	require.Nil(t, err)
+	require.Len(t, groups, 2)
+	assert.Equal(t, [][]*fact.Fact{{fresh0}, {fresh1}}, contents)
+	for i, g := range groups {
+		inner, err := g.Value.(*fact.SignedGroupValue).ParseInner(now)
+		require.Nil(t, err)
+		require.Len(t, inner, 2)
+		assert.Equal(t, fact.AttributeGossip, inner[0].Attribute)
+		assert.Equal(t, &fact.PeerSubject{Key: localPubKey}, inner[0].Subject)
+		assert.Equal(t, &fact.GossipValue{Hops: uint8(i + 1)}, inner[0].Value)
+	}
+	assert.True(t, s.peerKnowledge.peerKnows(peer, fresh0, 0))
+	assert.Equal(t, GossipStats{Groups: 2, FactsSent: 2}, s.GossipStats())
+
+	// nothing more to send once the peer has it
+	groups, _, err = s.makeGossipGroups(peer, facts, now)
+	require.Nil(t, err)
+	assert.Empty(t, groups)
+}
+
+// expectGossipHello sets up a mock to expect a gossip hello sent to the given
+// peer
+func expectGossipHello(
+	t *testing.T,
+	conn *netmocks.UDPConn,
+	now time.Time,
+	from, to wgtypes.Key,
+) *mock.Call {
+	dest := &net.UDPAddr{
+		IP: autopeer.AutoAddress(to),
+	}
+	isHello := func(packet []byte) bool {
+		f := &fact.Fact{}
+		if err := f.DecodeFrom(0, now, bytes.NewBuffer(packet)); err != nil {
+			return false
+		}
+		sgv, ok := f.Value.(*fact.SignedGroupValue)
+		if !ok {
+			return false
+		}
+		inner, err := sgv.ParseInner(now)
+		if err != nil || len(inner) != 1 {
+			return false
+		}
+		gv, ok := inner[0].Value.(*fact.GossipValue)
+		return ok &&
+			inner[0].Attribute == fact.AttributeGossip &&
+			*inner[0].Subject.(*fact.PeerSubject) == fact.PeerSubject{Key: from} &&
+			gv.Hops == 0
+	}
+	return conn.On("WriteToUDP", mock.MatchedBy(isHello), dest).Return(1, nil)
+}
+
+func TestLinkServer_processSignedGroup_gossip(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(DefaultFactTTL)
+
+	localPrivKey, localPubKey := testutils.MustKeyPair(t)
+	remotePrivKey, remotePubKey := testutils.MustKeyPair(t)
+	otherKey := testutils.MustKey(t)
+	remoteSigner := signing.New(&remotePrivKey)
+	source := &net.UDPAddr{IP: autopeer.AutoAddress(remotePubKey)}
+
+	makeGroup := func(t *testing.T, facts ...*fact.Fact) *fact.Fact {
+		ga := fact.NewAccumulator(fact.SignedGroupMaxSafeInnerLength, now)
+		for _, f := range facts {
+			require.Nil(t, ga.AddFact(f))
+		}
+		groups, err := ga.MakeSignedGroups(remoteSigner, &localPubKey)
+		require.Nil(t, err)
+		require.Len(t, groups, 1)
+		// round trip it so it looks like what we'd receive
+		p, err := groups[0].MarshalBinaryNow(now)
+		require.Nil(t, err)
+		f := &fact.Fact{}
+		require.Nil(t, f.DecodeFrom(0, now, bytes.NewBuffer(p)))
+		return f
+	}
+	marker := func(subject wgtypes.Key, hops uint8) *fact.Fact {
+		return &fact.Fact{
+			Attribute: fact.AttributeGossip,
+			Subject:   &fact.PeerSubject{Key: subject},
+			Value:     &fact.GossipValue{Hops: hops},
+			Expires:   expires,
+		}
+	}
+	ep := factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &otherKey, expires)
+
+	tests := []struct {
+		name        string
+		facts       []*fact.Fact
+		wantHello   bool
+		wantCapable bool
+		wantHops    []uint8
+	}{
+		{"plain", []*fact.Fact{ep}, false, false, []uint8{0}},
+		{"hello", []*fact.Fact{marker(remotePubKey, 0)}, true, true, []uint8{}},
+		{"gossip", []*fact.Fact{marker(remotePubKey, 2), ep}, false, true, []uint8{2}},
+		{"spoofed", []*fact.Fact{marker(otherKey, 2), ep}, false, false, []uint8{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &netmocks.UDPConn{}
+			conn.Test(t)
+			if tt.wantHello {
+				conn.On("SetWriteDeadline", mock.Anything).Return(nil)
+				expectGossipHello(t, conn, now, localPubKey, remotePubKey).Once()
+			}
+			s := &LinkServer{
+				config:        &config.Server{},
+				conn:          conn,
+				peerConfig:    newPeerConfigSet(),
+				peerKnowledge: newPKS(),
+				gossip:        newGossipTracker(1),
+				signer:        signing.New(&localPrivKey),
+				ChunkPeriod:   time.Second,
+				AlivePeriod:   DefaultAlivePeriod,
+			}
+			packets := make(chan *ReceivedFact, len(tt.facts))
+			err := s.processSignedGroup(makeGroup(t, tt.facts...), source, now, packets)
+			assert.Nil(t, err)
+			close(packets)
+			hops := []uint8{}
+			for rf := range packets {
+				hops = append(hops, rf.hops)
+			}
+			assert.Equal(t, tt.wantHops, hops)
+			assert.Equal(t, tt.wantCapable, s.gossip.isCapable(remotePubKey))
+			conn.AssertExpectations(t)
+		})
+	}
+}
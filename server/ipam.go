@@ -0,0 +1,328 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fastcat/wirelink/apply"
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/ipam"
+	"github.com/fastcat/wirelink/trust"
+	"github.com/fastcat/wirelink/util"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// addressTracker holds the host addresses we have allocated to members. The
+// configure loop allocates them, and fact collection publishes them.
+type addressTracker struct {
+	access sync.Mutex
+	store  *ipam.Store
+}
+
+// newAddressTracker loads the allocations from the given file. In dry run
+// mode, new allocations are only kept in memory, as we don't change anything.
+func newAddressTracker(path string, pools []*ipam.Pool, dryRun bool) (*addressTracker, error) {
+	store, err := ipam.LoadStore(path, pools)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		store.MemoryOnly()
+	}
+	return &addressTracker{store: store}, nil
+}
+
+// allocations returns the current allocations, a nil tracker has none
+func (at *addressTracker) allocations() map[wgtypes.Key][]net.IPNet {
+	if at == nil {
+		return nil
+	}
+	at.access.Lock()
+	defer at.access.Unlock()
+	return at.store.Allocations()
+}
+
+// allocate gives the member addresses from the pools it needs, if it doesn't
+// have any yet, returning the new addresses, or nil if it already had some
+func (at *addressTracker) allocate(
+	key wgtypes.Key,
+	need func(*ipam.Pool) bool,
+	used func(net.IP) bool,
+) ([]net.IPNet, error) {
+	at.access.Lock()
+	defer at.access.Unlock()
+	if _, ok := at.store.Get(key); ok {
+		return nil, nil
+	}
+	return at.store.Allocate(key, need, used)
+}
+
+// release frees the addresses allocated to a member
+func (at *addressTracker) release(key wgtypes.Key) error {
+	at.access.Lock()
+	defer at.access.Unlock()
+	return at.store.Release(key)
+}
+
+// pools returns the pools we allocate from
+func (at *addressTracker) pools() []*ipam.Pool {
+	at.access.Lock()
+	defer at.access.Unlock()
+	return at.store.Pools()
+}
+
+// addressFacts makes the AllowedIPs facts for the addresses we allocated
+func (s *LinkServer) addressFacts(expires time.Time) (ret []*fact.Fact) {
+	for key, addrs := range s.addresses.allocations() {
+		ret = s.handlePeerConfigAllowedIPs(key, &config.Peer{AllowedIPs: addrs}, expires, ret)
+	}
+	return
+}
+
+// allocateAddresses gives each valid member a host address from each of our
+// pools for an address family it has no AllowedIPs in, adding the facts for
+// them so they can be used right away. Before that, it releases allocations
+// that lost a conflict with another router's, and, once settled, those of
+// peers that are no longer valid members. Only routers trusted for Membership
+// allocate addresses, as other nodes have no say in what the members are.
+func (s *LinkServer) allocateAddresses(
+	dev *wgtypes.Device,
+	factsByPeer map[wgtypes.Key][]*fact.Fact,
+	validPeers map[wgtypes.Key]bool,
+	settled bool,
+	now time.Time,
+) {
+	if s.addresses == nil || !s.isAddressAllocator(dev.PublicKey) {
+		return
+	}
+
+	s.releaseAddresses(factsByPeer, validPeers, settled)
+
+	// allocate in a stable order, so restarts with an empty file come out the same
+	var needed []wgtypes.Key
+	needs := make(map[wgtypes.Key]func(*ipam.Pool) bool)
+	for key := range validPeers {
+		if key == dev.PublicKey {
+			continue
+		}
+		hasV4, hasV6 := allowedIPFamilies(factsByPeer[key])
+		need := func(p *ipam.Pool) bool {
+			if p.IsV4() {
+				return !hasV4
+			}
+			return !hasV6
+		}
+		for _, p := range s.addresses.pools() {
+			if need(p) {
+				needed = append(needed, key)
+				needs[key] = need
+				break
+			}
+		}
+	}
+	if len(needed) == 0 {
+		return
+	}
+	sort.Slice(needed, func(i, j int) bool { return bytes.Compare(needed[i][:], needed[j][:]) < 0 })
+
+	used := s.usedAddresses(dev, factsByPeer)
+	expires := now.Add(s.FactTTL)
+	for _, key := range needed {
+		addrs, err := s.addresses.allocate(key, needs[key], func(ip net.IP) bool { return used[string(ip)] })
+		if err != nil {
+			logger.Error("Unable to allocate addresses for %s: %v", s.peerName(key), err)
+			continue
+		}
+		if addrs == nil {
+			// already allocated, the facts will come around from collection soon
+			continue
+		}
+		logger.Info("Allocated %v to %s", addrs, s.peerName(key))
+		factsByPeer[key] = s.handlePeerConfigAllowedIPs(key, &config.Peer{AllowedIPs: addrs}, expires, appendToGroup(factsByPeer[key]))
+	}
+}
+
+// releaseAddresses frees our allocations that conflict with another router's,
+// as each router allocates from the facts it has, and so two of them can pick
+// the same address, or each give one to the same member, before they hear of
+// the other's choice. It also frees those of peers that are no longer valid,
+// but only once settled, i.e. when we have been running long enough to have
+// heard about all the members.
+func (s *LinkServer) releaseAddresses(
+	factsByPeer map[wgtypes.Key][]*fact.Fact,
+	validPeers map[wgtypes.Key]bool,
+	settled bool,
+) {
+	pools := s.addresses.pools()
+	for key, addrs := range s.addresses.allocations() {
+		var reason string
+		if !validPeers[key] {
+			if !settled {
+				continue
+			}
+			reason = "no longer a valid member"
+		} else if losesAllocationConflict(key, addrs, pools, factsByPeer) {
+			reason = "conflicts with another allocation"
+		} else {
+			continue
+		}
+		logger.Info("Releasing %v from %s: %s", addrs, s.peerName(key), reason)
+		if err := s.addresses.release(key); err != nil {
+			logger.Error("Unable to save releasing addresses from %s: %v", s.peerName(key), err)
+		}
+	}
+}
+
+// losesAllocationConflict checks if the addresses we allocated to a member
+// should give way to another allocation. When the member has another host
+// address from one of the same pools, the lowest address wins, and when
+// another peer has one of the same addresses, the peer with the lowest key
+// wins, so that every router comes to the same decision.
+func losesAllocationConflict(
+	key wgtypes.Key,
+	addrs []net.IPNet,
+	pools []*ipam.Pool,
+	factsByPeer map[wgtypes.Key][]*fact.Fact,
+) bool {
+	ours := make(map[string]bool, len(addrs))
+	for _, a := range addrs {
+		ours[string(util.NormalizeIP(a.IP))] = true
+	}
+	for peer, facts := range factsByPeer {
+		for _, f := range facts {
+			ip := hostAddress(f)
+			if ip == nil {
+				continue
+			}
+			if peer != key {
+				if ours[string(ip)] && bytes.Compare(peer[:], key[:]) < 0 {
+					return true
+				}
+				continue
+			}
+			if ours[string(ip)] {
+				continue
+			}
+			for _, a := range addrs {
+				for _, p := range pools {
+					if p.Contains(ip) && p.Contains(a.IP) && bytes.Compare(ip, util.NormalizeIP(a.IP)) < 0 {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// hostAddress returns the normalized IP of an AllowedIPs fact for a single
+// host, or nil if the fact is not one
+func hostAddress(f *fact.Fact) net.IP {
+	if f.Attribute != fact.AttributeAllowedCidrV4 && f.Attribute != fact.AttributeAllowedCidrV6 {
+		return nil
+	}
+	ipn, ok := f.Value.(*fact.IPNetValue)
+	if !ok {
+		return nil
+	}
+	if ones, bits := ipn.Mask.Size(); ones != bits {
+		return nil
+	}
+	return util.NormalizeIP(ipn.IP)
+}
+
+// isAddressAllocator checks if we are a router that is trusted for Membership,
+// and so should allocate addresses to members
+func (s *LinkServer) isAddressAllocator(self wgtypes.Key) bool {
+	s.stateAccess.Lock()
+	defer s.stateAccess.Unlock()
+	return s.config.IsRouterNow && s.config.Peers.Trust(self, trust.Untrusted) >= trust.Membership
+}
+
+// allowedIPFamilies checks which address families the facts have AllowedIPs in
+func allowedIPFamilies(facts []*fact.Fact) (v4, v6 bool) {
+	for _, f := range facts {
+		switch f.Attribute {
+		case fact.AttributeAllowedCidrV4:
+			v4 = true
+		case fact.AttributeAllowedCidrV6:
+			v6 = true
+		}
+	}
+	return
+}
+
+// usedAddresses collects the IPs that are already in use and so can't be
+// allocated: those in any AllowedIPs, and those on the local interface
+func (s *LinkServer) usedAddresses(dev *wgtypes.Device, factsByPeer map[wgtypes.Key][]*fact.Fact) map[string]bool {
+	used := make(map[string]bool)
+	for _, facts := range factsByPeer {
+		for _, f := range facts {
+			if f.Attribute != fact.AttributeAllowedCidrV4 && f.Attribute != fact.AttributeAllowedCidrV6 {
+				continue
+			}
+			if ipn, ok := f.Value.(*fact.IPNetValue); ok {
+				used[string(util.NormalizeIP(ipn.IP))] = true
+			}
+		}
+	}
+	if iface, err := s.net.InterfaceByName(dev.Name); err != nil {
+		logger.Error("Unable to get interface info for %s: %v", dev.Name, err)
+	} else if addrs, err := iface.Addrs(); err != nil {
+		logger.Error("Unable to get addresses for %s: %v", dev.Name, err)
+	} else {
+		for _, a := range addrs {
+			used[string(util.NormalizeIP(a.IP))] = true
+		}
+	}
+	return used
+}
+
+// assignLocalAddresses adds the host addresses we have been allocated to the
+// local interface, if configured to do so
+func (s *LinkServer) assignLocalAddresses(dev *wgtypes.Device, factsByPeer map[wgtypes.Key][]*fact.Fact) {
+	if !s.config.AssignAddress {
+		return
+	}
+	var addrs []net.IPNet
+	for _, f := range factsByPeer[dev.PublicKey] {
+		if f.Attribute != fact.AttributeAllowedCidrV4 && f.Attribute != fact.AttributeAllowedCidrV6 {
+			continue
+		}
+		ipn, ok := f.Value.(*fact.IPNetValue)
+		if !ok {
+			continue
+		}
+		// only host addresses are ours, wider AllowedIPs are networks we route
+		if ones, bits := ipn.Mask.Size(); ones != bits || s.assignedAddrs[ipn.String()] {
+			continue
+		}
+		addrs = append(addrs, ipn.IPNet)
+	}
+	if len(addrs) == 0 {
+		return
+	}
+	if s.config.DryRun {
+		logger.Info("Dry run: would add %v to %s", addrs, dev.Name)
+		return
+	}
+	added, err := apply.EnsureLocalAddrs(s.net, dev, addrs)
+	for _, a := range added {
+		logger.Info("Added allocated address %v to %s", a, dev.Name)
+	}
+	if err != nil {
+		logger.Error("Unable to add allocated addresses: %v", err)
+		return
+	}
+	if s.assignedAddrs == nil {
+		s.assignedAddrs = make(map[string]bool)
+	}
+	for _, a := range addrs {
+		s.assignedAddrs[a.String()] = true
+	}
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/internal/networking/mocks"
+	"github.com/fastcat/wirelink/internal/testutils"
+	factutils "github.com/fastcat/wirelink/internal/testutils/facts"
+	"github.com/fastcat/wirelink/ipam"
+	"github.com/fastcat/wirelink/trust"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustAddressTracker(t *testing.T, cidrs ...string) (*addressTracker, func()) {
+	var pools []*ipam.Pool
+	for _, c := range cidrs {
+		_, ipn, err := net.ParseCIDR(c)
+		require.NoError(t, err)
+		p, err := ipam.NewPool(*ipn)
+		require.NoError(t, err)
+		pools = append(pools, p)
+	}
+	dir, err := ioutil.TempDir("", "wirelink-ipam")
+	require.NoError(t, err)
+	at, err := newAddressTracker(filepath.Join(dir, "addresses.json"), pools, false)
+	if err != nil {
+		os.RemoveAll(dir)
+	}
+	require.NoError(t, err)
+	return at, func() { os.RemoveAll(dir) }
+}
+
+func TestLinkServer_allocateAddresses(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(DefaultFactTTL)
+	self := testutils.MustKey(t)
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	k3 := testutils.MustKey(t)
+	k4 := testutils.MustKey(t)
+	dev := &wgtypes.Device{Name: "wg0", PublicKey: self}
+
+	at, cleanup := mustAddressTracker(t, "10.1.0.0/24", "fd00:1::/64")
+	defer cleanup()
+	env := &mocks.Environment{}
+	env.Test(t)
+	env.WithSimpleInterfaces(map[string]net.IPNet{"wg0": testutils.MakeIPv4Net(10, 1, 0, 1, 24)})
+
+	s := &LinkServer{
+		stateAccess: &sync.Mutex{},
+		config: &config.Server{
+			// only a router trusted for membership allocates addresses
+			IsRouterNow: false,
+			Peers:       config.Peers{self: &config.Peer{Trust: trust.Ptr(trust.Membership)}},
+		},
+		net:       env,
+		addresses: at,
+		FactTTL:   DefaultFactTTL,
+	}
+
+	factsByPeer := map[wgtypes.Key][]*fact.Fact{
+		self: {factutils.MemberFactFull(&self, expires)},
+		k1:   {factutils.MemberFactFull(&k1, expires)},
+		// k2 has static AllowedIPs already
+		k2: {
+			factutils.MemberFactFull(&k2, expires),
+			factutils.AllowedIPFactFull(testutils.MakeIPv4Net(10, 1, 0, 2, 32), &k2, expires),
+		},
+		// k3 is not a valid member
+		k3: {factutils.MemberFactFull(&k3, expires)},
+		// k4 has a static IPv4 address, but not an IPv6 one
+		k4: {
+			factutils.MemberFactFull(&k4, expires),
+			factutils.AllowedIPFactFull(testutils.MakeIPv4Net(192, 168, 0, 4, 32), &k4, expires),
+		},
+	}
+	validPeers := map[wgtypes.Key]bool{self: true, k1: true, k2: true, k4: true}
+
+	s.allocateAddresses(dev, factsByPeer, validPeers, true, now)
+	assert.Empty(t, at.allocations(), "should not allocate when not a router")
+	s.config.IsRouterNow = true
+	s.config.Peers[self].Trust = trust.Ptr(trust.AllowedIPs)
+	s.allocateAddresses(dev, factsByPeer, validPeers, true, now)
+	assert.Empty(t, at.allocations(), "should not allocate without membership trust")
+	s.config.Peers[self].Trust = trust.Ptr(trust.Membership)
+
+	s.allocateAddresses(dev, factsByPeer, validPeers, true, now)
+	// IPv6 addresses go to k1, k2, and k4 in key order
+	v6 := make(map[wgtypes.Key]net.IPNet)
+	sorted := []wgtypes.Key{k1, k2, k4}
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i][:], sorted[j][:]) < 0 })
+	for i, k := range sorted {
+		v6[k] = net.IPNet{IP: net.ParseIP(fmt.Sprintf("fd00:1::%d", i+1)), Mask: net.CIDRMask(128, 128)}
+	}
+	// the IPv4 one skips the interface address and the one k2 has
+	want := []*fact.Fact{
+		factutils.MemberFactFull(&k1, expires),
+		factutils.AllowedIPFactFull(testutils.MakeIPv4Net(10, 1, 0, 3, 32), &k1, expires),
+		factutils.AllowedIPFactFull(v6[k1], &k1, expires),
+	}
+	assert.Equal(t, want, factsByPeer[k1])
+	assert.Len(t, factsByPeer[self], 1)
+	// members with only IPv4 AllowedIPs just get an IPv6 address
+	require.Len(t, factsByPeer[k2], 3)
+	assert.Equal(t, factutils.AllowedIPFactFull(v6[k2], &k2, expires), factsByPeer[k2][2])
+	require.Len(t, factsByPeer[k4], 3)
+	assert.Equal(t, factutils.AllowedIPFactFull(v6[k4], &k4, expires), factsByPeer[k4][2])
+	assert.Len(t, factsByPeer[k3], 1)
+
+	allocs := at.allocations()
+	assert.Len(t, allocs, 3)
+	assert.Contains(t, allocs, k1)
+	assert.Contains(t, allocs, k2)
+	assert.Contains(t, allocs, k4)
+
+	// existing allocations are left for fact collection to publish
+	factsByPeer[k1] = factsByPeer[k1][:1]
+	s.allocateAddresses(dev, factsByPeer, validPeers, true, now)
+	assert.Len(t, factsByPeer[k1], 1)
+	assert.ElementsMatch(t, []*fact.Fact{
+		want[1], want[2], factsByPeer[k2][2], factsByPeer[k4][2],
+	}, s.addressFacts(expires))
+
+	// no tracker, no change
+	s.addresses = nil
+	s.allocateAddresses(dev, factsByPeer, validPeers, true, now)
+	assert.Len(t, factsByPeer[k1], 1)
+	assert.Empty(t, s.addressFacts(expires))
+}
+
+func TestLinkServer_releaseAddresses(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(DefaultFactTTL)
+	low := testutils.MustKey(t)
+	high := testutils.MustKey(t)
+	if bytes.Compare(low[:], high[:]) > 0 {
+		low, high = high, low
+	}
+	host := func(d byte) net.IPNet { return testutils.MakeIPv4Net(10, 1, 0, d, 32) }
+	// our allocation is 10.1.0.5
+	below5 := func(ip net.IP) bool { return ip[3] < 5 }
+
+	type other struct {
+		peer wgtypes.Key
+		addr net.IPNet
+	}
+	tests := []struct {
+		name        string
+		member      wgtypes.Key
+		valid       bool
+		settled     bool
+		others      []other
+		wantRelease bool
+	}{
+		{"valid", high, true, true, nil, false},
+		{"invalid before settled", high, false, false, nil, false},
+		{"invalid", high, false, true, nil, true},
+		{"address taken by lower key", high, true, true, []other{{low, host(5)}}, true},
+		{"address taken by higher key", low, true, true, []other{{high, host(5)}}, false},
+		{"lower address for member", high, true, true, []other{{high, host(2)}}, true},
+		{"higher address for member", high, true, true, []other{{high, host(9)}}, false},
+		{"address outside pool for member", high, true, true, []other{{high, testutils.MakeIPv4Net(192, 168, 0, 1, 32)}}, false},
+		{"network for member", high, true, true, []other{{high, testutils.MakeIPv4Net(10, 1, 0, 0, 24)}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at, cleanup := mustAddressTracker(t, "10.1.0.0/24")
+			defer cleanup()
+			addrs, err := at.allocate(tt.member, nil, below5)
+			require.NoError(t, err)
+			require.Equal(t, []net.IPNet{host(5)}, addrs)
+			s := &LinkServer{
+				config:    &config.Server{},
+				addresses: at,
+			}
+
+			factsByPeer := map[wgtypes.Key][]*fact.Fact{
+				tt.member: {
+					factutils.MemberFactFull(&tt.member, expires),
+					factutils.AllowedIPFactFull(host(5), &tt.member, expires),
+				},
+			}
+			for _, o := range tt.others {
+				factsByPeer[o.peer] = append(factsByPeer[o.peer], factutils.AllowedIPFactFull(o.addr, &o.peer, expires))
+			}
+			validPeers := map[wgtypes.Key]bool{}
+			if tt.valid {
+				validPeers[tt.member] = true
+			}
+
+			s.releaseAddresses(factsByPeer, validPeers, tt.settled)
+			_, kept := at.allocations()[tt.member]
+			assert.Equal(t, !tt.wantRelease, kept)
+		})
+	}
+}
+
+func TestLinkServer_assignLocalAddresses(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(DefaultFactTTL)
+	self := testutils.MustKey(t)
+	dev := &wgtypes.Device{Name: "wg0", PublicKey: self}
+	host := testutils.MakeIPv4Net(10, 1, 0, 5, 32)
+	routed := testutils.MakeIPv4Net(192, 168, 1, 0, 24)
+	factsByPeer := map[wgtypes.Key][]*fact.Fact{
+		self: {
+			factutils.MemberFactFull(&self, expires),
+			factutils.AllowedIPFactFull(host, &self, expires),
+			factutils.AllowedIPFactFull(routed, &self, expires),
+		},
+	}
+
+	tests := []struct {
+		name    string
+		assign  bool
+		dryRun  bool
+		wantAdd bool
+	}{
+		{"disabled", false, false, false},
+		{"dry run", true, true, false},
+		{"assign", true, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := &mocks.Environment{}
+			env.Test(t)
+			if tt.wantAdd {
+				ii := env.WithSimpleInterfaces(map[string]net.IPNet{"wg0": testutils.MakeIPv4Net(192, 0, 2, 1, 24)})
+				ii["wg0"].On("AddAddr", host).Return(nil).Once()
+			}
+			s := &LinkServer{
+				config: &config.Server{AssignAddress: tt.assign, DryRun: tt.dryRun},
+				net:    env,
+			}
+			s.assignLocalAddresses(dev, factsByPeer)
+			// the second time does nothing
+			s.assignLocalAddresses(dev, factsByPeer)
+			env.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/util"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// detectNAT checks whether routers see us at an endpoint that isn't one of
+// our local addresses and listen port, which means we are behind NAT, and
+// logs when that changes. It is only used from the configure loop.
+// The result is for the whole node, and so applies to all peers, even those on
+// a local network, as the endpoint facts don't record which peer saw them.
+func (s *LinkServer) detectNAT(dev *wgtypes.Device, selfFacts []*fact.Fact) bool {
+	var observed []*fact.IPPortValue
+	for _, f := range selfFacts {
+		if f.Attribute != fact.AttributeEndpointV4 && f.Attribute != fact.AttributeEndpointV6 {
+			continue
+		}
+		if ipp, ok := f.Value.(*fact.IPPortValue); ok {
+			observed = append(observed, ipp)
+		}
+	}
+
+	var natEndpoint *fact.IPPortValue
+	if len(observed) > 0 {
+		local, ok := s.localAddrs()
+		if !ok {
+			// keep the previous state until we can check again
+			return s.natted
+		}
+		for _, ipp := range observed {
+			if ipp.Port != dev.ListenPort || !local[string(util.NormalizeIP(ipp.IP))] {
+				natEndpoint = ipp
+				break
+			}
+		}
+	}
+
+	natted := natEndpoint != nil
+	if natted && !s.natted {
+		logger.Info("Detected we are behind NAT: seen at %v", natEndpoint)
+	} else if !natted && s.natted {
+		logger.Info("No longer behind NAT")
+	}
+	s.natted = natted
+	return natted
+}
+
+// localAddrs gets the set of addresses on all the local interfaces, as
+// normalized IPs converted to strings
+func (s *LinkServer) localAddrs() (map[string]bool, bool) {
+	ifaces, err := s.net.Interfaces()
+	if err != nil {
+		logger.Error("Unable to get local interfaces: %v", err)
+		return nil, false
+	}
+	ret := make(map[string]bool)
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			logger.Error("Unable to get addresses for %s: %v", iface.Name(), err)
+			return nil, false
+		}
+		for _, a := range addrs {
+			ret[string(util.NormalizeIP(a.IP))] = true
+		}
+	}
+	return ret, true
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/apply"
+	"github.com/fastcat/wirelink/autopeer"
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/internal/mocks"
+	netmocks "github.com/fastcat/wirelink/internal/networking/mocks"
+	"github.com/fastcat/wirelink/internal/testutils"
+	factutils "github.com/fastcat/wirelink/internal/testutils/facts"
+	"github.com/fastcat/wirelink/signing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestLinkServer_detectNAT(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(DefaultFactTTL)
+	self := testutils.MustKey(t)
+	port := 51820
+	dev := &wgtypes.Device{Name: "wg0", PublicKey: self, ListenPort: port}
+	localIP := net.IPv4(192, 168, 1, 2)
+	publicIP := net.IPv4(203, 0, 113, 7)
+
+	tests := []struct {
+		name   string
+		natted bool
+		facts  []*fact.Fact
+		want   bool
+	}{
+		{
+			"no endpoints",
+			false,
+			nil,
+			false,
+		},
+		{
+			"local endpoint",
+			false,
+			[]*fact.Fact{
+				factutils.EndpointFactFull(&net.UDPAddr{IP: localIP, Port: port}, &self, expires),
+			},
+			false,
+		},
+		{
+			"other address",
+			false,
+			[]*fact.Fact{
+				factutils.EndpointFactFull(&net.UDPAddr{IP: localIP, Port: port}, &self, expires),
+				factutils.EndpointFactFull(&net.UDPAddr{IP: publicIP, Port: port}, &self, expires),
+			},
+			true,
+		},
+		{
+			"other port",
+			false,
+			[]*fact.Fact{
+				factutils.EndpointFactFull(&net.UDPAddr{IP: localIP, Port: 40000}, &self, expires),
+			},
+			true,
+		},
+		{
+			"no longer natted",
+			true,
+			[]*fact.Fact{
+				factutils.EndpointFactFull(&net.UDPAddr{IP: localIP, Port: port}, &self, expires),
+			},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := &netmocks.Environment{}
+			env.WithSimpleInterfaces(map[string]net.IPNet{
+				"eth0": testutils.MakeIPv4Net(192, 168, 1, 2, 24),
+				"wg0":  testutils.MakeIPv4Net(10, 0, 0, 1, 24),
+			})
+			env.WithKnownInterfaces()
+			env.Test(t)
+			s := &LinkServer{
+				net:    env,
+				natted: tt.natted,
+			}
+			got := s.detectNAT(dev, tt.facts)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.want, s.natted)
+		})
+	}
+}
+
+func TestLinkServer_configurePeer_keepalive(t *testing.T) {
+	localKey := testutils.MustKey(t)
+	peerKey := testutils.MustKey(t)
+	wgIface := "wg0"
+	on := apply.NATKeepalive
+	off := time.Duration(0)
+
+	tests := []struct {
+		name      string
+		healthy   bool
+		natted    bool
+		keepalive time.Duration
+		// ours is whether we set the keepalive ourselves, earlier
+		ours bool
+		// oursFailed is whether setting it ourselves failed to configure the
+		// device
+		oursFailed bool
+		want       *time.Duration
+	}{
+		{"add when natted", true, true, 0, false, false, &on},
+		{"add when natted and link is down", false, true, 0, false, false, &on},
+		{"keep when natted", true, true, apply.NATKeepalive, true, false, nil},
+		{"keep when link is down", false, true, apply.NATKeepalive, true, false, nil},
+		{"remove when not natted", true, false, apply.NATKeepalive, true, false, &off},
+		{"keep configured when not natted", true, false, apply.NATKeepalive, false, false, nil},
+		{"keep configured when ours failed", true, false, apply.NATKeepalive, true, true, nil},
+		{"nothing when not natted", true, false, 0, false, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := &mocks.WgClient{}
+			ctrl.Test(t)
+			expectKeepalive := func(want *time.Duration, err error) {
+				ctrl.On("ConfigureDevice", wgIface, wgtypes.Config{
+					Peers: []wgtypes.PeerConfig{{
+						PublicKey:                   peerKey,
+						UpdateOnly:                  true,
+						PersistentKeepaliveInterval: want,
+					}},
+				}).Return(err).Once()
+			}
+			s := &LinkServer{
+				stateAccess:   &sync.Mutex{},
+				config:        buildConfig(wgIface).Build(),
+				ctrl:          ctrl,
+				peerKnowledge: newPKS(),
+				signer:        &signing.Signer{PublicKey: localKey},
+			}
+			peer := &wgtypes.Peer{
+				PublicKey:  peerKey,
+				AllowedIPs: []net.IPNet{autopeer.AutoAddressNet(peerKey)},
+			}
+			state := makePCS(t, tt.healthy, tt.healthy, true)
+			if tt.ours {
+				var setErr error
+				if tt.oursFailed {
+					setErr = errors.New("configure failed")
+				}
+				expectKeepalive(&on, setErr)
+				var err error
+				state, err = s.configurePeer(state, peer, nil, false, false, true, false, nil)
+				require.Equal(t, setErr, err)
+			}
+			peer.PersistentKeepaliveInterval = tt.keepalive
+			if tt.want != nil {
+				expectKeepalive(tt.want, nil)
+			}
+			_, err := s.configurePeer(state, peer, nil, false, false, tt.natted, false, nil)
+			require.NoError(t, err)
+			ctrl.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,349 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/fastcat/wirelink/fact"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// pathProbeResolution is how close the path probe search gets to the largest
+// payload that works before it stops
+const pathProbeResolution = 64
+
+// pathProbeAttempts is how many probes of the same size in a row have to be
+// lost before we decide it doesn't get through, as a single probe can be lost
+// for all sorts of other reasons
+const pathProbeAttempts = 3
+
+// pathMinPayload is the smallest payload the path probe search will try, if
+// even the safe default payload doesn't get through to a peer
+const pathMinPayload = 576
+
+// pathRecheckPeriod is how long after finishing a search for the largest
+// working payload to a peer before we check whether it has grown
+const pathRecheckPeriod = 10 * time.Minute
+
+// pathState tracks the search for the largest payload that gets through to a
+// single peer
+type pathState struct {
+	// confirmed is the largest payload a probe has shown gets through, or zero
+	// if none has yet
+	confirmed int
+	// failed is the smallest payload a probe has shown doesn't get through, or
+	// zero if none has since we last started a search
+	failed int
+	// probing is the payload size of the outstanding probe, if any
+	probing int
+	// losses is how many probes of the size being probed have been lost in a
+	// row, and retry is that size, when it is to be probed again
+	losses    int
+	retry     int
+	nextProbe time.Time
+	// recheck is set when the search is done, and we are waiting until
+	// nextProbe to check the path hasn't changed
+	recheck bool
+	// belowSafe is set when probes of the safe default payload have been lost,
+	// so the search has to look for something smaller
+	belowSafe bool
+}
+
+// pathTracker keeps the largest payload known to work for each peer, and the
+// state of the path probes used to find it. It is safe to call methods on a
+// nil pathTracker: it will do nothing and report the safe default payload.
+type pathTracker struct {
+	access sync.Mutex
+	// max is the largest payload our interface MTU allows, or zero if not known
+	max   int
+	peers map[wgtypes.Key]*pathState
+}
+
+func newPathTracker() *pathTracker {
+	return &pathTracker{
+		peers: make(map[wgtypes.Key]*pathState),
+	}
+}
+
+// limit caps a payload size to what the interface allows
+func (pt *pathTracker) limit(payload int) int {
+	if pt.max > 0 && payload > pt.max {
+		return pt.max
+	}
+	return payload
+}
+
+// payload returns the largest payload size we should send to the given peer,
+// which is the safe default until a probe confirms some other size works
+func (pt *pathTracker) payload(peer wgtypes.Key) int {
+	if pt == nil {
+		return fact.UDPMaxSafePayload
+	}
+	pt.access.Lock()
+	defer pt.access.Unlock()
+	if ps, ok := pt.peers[peer]; ok && ps.confirmed > 0 {
+		return pt.limit(ps.confirmed)
+	}
+	return pt.limit(fact.UDPMaxSafePayload)
+}
+
+// setMax records the largest payload our interface allows
+func (pt *pathTracker) setMax(max int) {
+	if pt == nil {
+		return
+	}
+	pt.access.Lock()
+	defer pt.access.Unlock()
+	if max != pt.max {
+		// the search bounds may be wrong now
+		for _, ps := range pt.peers {
+			ps.failed = 0
+			ps.losses = 0
+			ps.retry = 0
+			ps.recheck = false
+			ps.nextProbe = time.Time{}
+		}
+	}
+	pt.max = max
+}
+
+// nextRequest returns the payload size to probe the given peer with, if it is
+// time to send it one, and records the probe as outstanding. Any probe still
+// outstanding from the previous call is considered lost, and is tried again
+// until pathProbeAttempts of them have been lost.
+func (pt *pathTracker) nextRequest(peer wgtypes.Key, now time.Time) (int, bool) {
+	if pt == nil {
+		return 0, false
+	}
+	pt.access.Lock()
+	defer pt.access.Unlock()
+	ps, ok := pt.peers[peer]
+	if !ok {
+		ps = &pathState{}
+		pt.peers[peer] = ps
+	}
+	if ps.probing != 0 {
+		lost := ps.probing
+		ps.probing = 0
+		ps.losses++
+		if ps.losses < pathProbeAttempts {
+			ps.retry = lost
+		} else {
+			ps.losses = 0
+			if lost <= ps.confirmed {
+				// the path has changed, so we don't know what works any more
+				ps.confirmed = 0
+			}
+			ps.failed = lost
+			if lost <= fact.UDPMaxSafePayload {
+				ps.belowSafe = true
+			}
+		}
+	}
+	if now.Before(ps.nextProbe) {
+		return 0, false
+	}
+	if ps.retry != 0 {
+		ps.probing = ps.retry
+		ps.retry = 0
+		return ps.probing, true
+	}
+	if ps.recheck {
+		// make sure what we're using still works before searching again
+		ps.recheck = false
+		ps.failed = 0
+		if ps.confirmed != 0 {
+			ps.probing = ps.confirmed
+			return ps.probing, true
+		}
+	}
+
+	floor := fact.UDPMaxSafePayload
+	if ps.belowSafe {
+		floor = pathMinPayload
+	}
+	lo := ps.confirmed
+	if lo < floor {
+		lo = floor
+	}
+	hi := ps.failed
+	if hi == 0 {
+		hi = pt.limit(fact.UDPMaxPayload) + 1
+	}
+	if hi-lo <= pathProbeResolution && !ps.belowSafe && ps.confirmed < lo && hi > lo {
+		// nothing bigger works, so make sure the safe default does, before we
+		// go looking for something smaller
+		ps.probing = lo
+		return ps.probing, true
+	}
+	if hi-lo <= pathProbeResolution {
+		// done searching, check again later in case the path changes
+		ps.recheck = true
+		ps.nextProbe = now.Add(pathRecheckPeriod)
+		return 0, false
+	}
+	// try the largest size first, as that is what works most of the time, then
+	// search between what works and what doesn't
+	size := hi - 1
+	if ps.failed != 0 {
+		size = (lo + hi) / 2
+	}
+	ps.probing = size
+	return size, true
+}
+
+// handleReply records the reply to a path probe, returning true if it
+// increased the payload size we use for the peer
+func (pt *pathTracker) handleReply(peer wgtypes.Key, size int) bool {
+	if pt == nil {
+		return false
+	}
+	pt.access.Lock()
+	defer pt.access.Unlock()
+	ps, ok := pt.peers[peer]
+	if !ok || ps.probing == 0 || size != ps.probing {
+		// late, duplicate, or bogus
+		return false
+	}
+	ps.probing = 0
+	ps.losses = 0
+	if size >= fact.UDPMaxSafePayload {
+		ps.belowSafe = false
+	}
+	if size <= ps.confirmed {
+		return false
+	}
+	ps.confirmed = size
+	return true
+}
+
+// trim removes state for peers we no longer need to track
+func (pt *pathTracker) trim(keep func(wgtypes.Key) bool) {
+	if pt == nil {
+		return
+	}
+	pt.access.Lock()
+	defer pt.access.Unlock()
+	for k := range pt.peers {
+		if !keep(k) {
+			delete(pt.peers, k)
+		}
+	}
+}
+
+// interfacePayload gets the largest payload the MTU of the wireguard
+// interface allows, or zero if it can't be determined
+func (s *LinkServer) interfacePayload(dev *wgtypes.Device) int {
+	iface, err := s.net.InterfaceByName(dev.Name)
+	if err != nil {
+		logger.Error("Unable to get interface info for %s: %v", dev.Name, err)
+		return 0
+	}
+	mtu := iface.MTU()
+	if mtu <= 0 {
+		return 0
+	}
+	return fact.UDPPayloadForMTU(mtu)
+}
+
+// probePaths sends path probes to peers, to find the largest payload we can
+// send to each of them
+func (s *LinkServer) probePaths(dev *wgtypes.Device, now time.Time) {
+	if s.paths == nil {
+		return
+	}
+	s.paths.setMax(s.interfacePayload(dev))
+	for i := range dev.Peers {
+		p := &dev.Peers[i]
+		if !s.shouldProbe(p, now) {
+			continue
+		}
+		size, ok := s.paths.nextRequest(p.PublicKey, now)
+		if !ok {
+			continue
+		}
+		groups, err := s.pathProbe(p.PublicKey, dev.PublicKey, size, now)
+		if err == nil {
+			err = s.sendGroups(p.PublicKey, groups, now)
+		}
+		if err != nil {
+			logger.Error("Unable to send path probe to %s: %v", s.peerName(p.PublicKey), err)
+		}
+	}
+}
+
+// pathProbe builds the signed group for a path probe, padded so that it is
+// the given payload size
+func (s *LinkServer) pathProbe(peer, self wgtypes.Key, size int, now time.Time) ([]*fact.Fact, error) {
+	pv := &fact.PathProbeValue{Size: uint16(size)}
+	f := &fact.Fact{
+		Attribute: fact.AttributePathProbe,
+		Subject:   &fact.PeerSubject{Key: self},
+		Value:     pv,
+		Expires:   now.Add(s.ProbePeriod),
+	}
+	// the padding length is variable length encoded, so it may take a couple
+	// tries to get it right
+	for i := 0; i < 3; i++ {
+		ga := fact.NewAccumulator(fact.SignedGroupMaxInnerLength(size), now)
+		if err := ga.AddFact(f); err != nil {
+			return nil, err
+		}
+		groups, err := ga.MakeSignedGroups(s.signer, &peer)
+		if err != nil {
+			return nil, err
+		}
+		packet, err := groups[0].MarshalBinaryNow(now)
+		if err != nil {
+			return nil, err
+		}
+		if len(packet) == size {
+			return groups, nil
+		}
+		padding := len(pv.Padding) + size - len(packet)
+		if padding < 0 {
+			break
+		}
+		pv.Padding = make([]byte, padding)
+	}
+	return nil, errors.Errorf("Unable to make a path probe of %d bytes", size)
+}
+
+// handlePathProbe processes path probe facts received from a peer, returning
+// true if the fact was a path probe fact, which should not be processed any
+// further
+func (s *LinkServer) handlePathProbe(source wgtypes.Key, f *fact.Fact, now time.Time) bool {
+	if f.Attribute != fact.AttributePathProbe && f.Attribute != fact.AttributePathProbeReply {
+		return false
+	}
+	pv, ok := f.Value.(*fact.PathProbeValue)
+	if !ok {
+		logger.Error("Path probe fact has wrong value type: %T", f.Value)
+		return true
+	}
+	if ps, ok := f.Subject.(*fact.PeerSubject); !ok || ps.Key != source {
+		logger.Error("Ignoring path probe from %s with mismatched subject %v", s.peerName(source), f.Subject)
+		return true
+	}
+
+	if f.Attribute == fact.AttributePathProbeReply {
+		if s.paths.handleReply(source, int(pv.Size)) {
+			logger.Debug("Path to %s supports %d byte packets", s.peerName(source), pv.Size)
+		}
+		return true
+	}
+
+	reply := &fact.Fact{
+		Attribute: fact.AttributePathProbeReply,
+		Subject:   &fact.PeerSubject{Key: s.signer.PublicKey},
+		Value:     &fact.PathProbeValue{Size: pv.Size},
+		Expires:   now.Add(s.ProbePeriod),
+	}
+	if err := s.sendStandalone(source, reply, now); err != nil {
+		logger.Error("Unable to reply to path probe from %s: %v", s.peerName(source), err)
+	}
+	return true
+}
@@ -0,0 +1,303 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/autopeer"
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/fact"
+	netmocks "github.com/fastcat/wirelink/internal/networking/mocks"
+	"github.com/fastcat/wirelink/internal/testutils"
+	"github.com/fastcat/wirelink/signing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathTracker(t *testing.T) {
+	now := time.Now()
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	wgMax := fact.UDPPayloadForMTU(1420)
+
+	pt := newPathTracker()
+	pt.setMax(wgMax)
+	assert.Equal(t, fact.UDPMaxSafePayload, pt.payload(k1))
+
+	// tries the largest size first
+	size, ok := pt.nextRequest(k1, now)
+	require.True(t, ok)
+	assert.Equal(t, wgMax, size)
+	assert.False(t, pt.handleReply(k1, size-1), "should ignore replies for other sizes")
+	assert.True(t, pt.handleReply(k1, size))
+	assert.False(t, pt.handleReply(k1, size), "should ignore duplicate replies")
+	assert.Equal(t, wgMax, pt.payload(k1))
+
+	// nothing left to search
+	_, ok = pt.nextRequest(k1, now)
+	assert.False(t, ok)
+	_, ok = pt.nextRequest(k1, now.Add(pathRecheckPeriod/2))
+	assert.False(t, ok)
+
+	// but it checks the path still works later
+	now = now.Add(pathRecheckPeriod)
+	size, ok = pt.nextRequest(k1, now)
+	require.True(t, ok)
+	assert.Equal(t, wgMax, size)
+	// a lost probe is tried again, and one reply is enough
+	for i := 1; i < pathProbeAttempts; i++ {
+		size, ok = pt.nextRequest(k1, now)
+		require.True(t, ok)
+		assert.Equal(t, wgMax, size)
+		assert.Equal(t, wgMax, pt.payload(k1))
+	}
+	assert.False(t, pt.handleReply(k1, size))
+	assert.Equal(t, wgMax, pt.payload(k1))
+	_, ok = pt.nextRequest(k1, now)
+	assert.False(t, ok)
+	now = now.Add(pathRecheckPeriod)
+	size, ok = pt.nextRequest(k1, now)
+	require.True(t, ok)
+	assert.Equal(t, wgMax, size)
+	// but it goes back to the safe size if enough are lost in a row
+	for i := 1; i < pathProbeAttempts; i++ {
+		size, ok = pt.nextRequest(k1, now)
+		require.True(t, ok)
+		assert.Equal(t, wgMax, size)
+	}
+	size, ok = pt.nextRequest(k1, now)
+	require.True(t, ok)
+	assert.Equal(t, fact.UDPMaxSafePayload, pt.payload(k1))
+	assert.Equal(t, (fact.UDPMaxSafePayload+wgMax)/2, size)
+
+	// peers that never reply stay at the safe size, and the search ends
+	pt.setMax(fact.UDPMaxPayload)
+	probes := 0
+	for {
+		if _, ok := pt.nextRequest(k2, now); !ok {
+			break
+		}
+		probes++
+		require.Less(t, probes, 20*pathProbeAttempts, "search should end")
+	}
+	assert.Equal(t, fact.UDPMaxSafePayload, pt.payload(k2))
+
+	// interfaces with a small MTU limit the payload
+	pt.setMax(1000)
+	assert.Equal(t, 1000, pt.payload(k2))
+
+	pt.trim(func(k wgtypes.Key) bool { return k == k1 })
+	assert.Len(t, pt.peers, 1)
+
+	// nil tracker is safe to use
+	var nilPT *pathTracker
+	nilPT.setMax(wgMax)
+	_, ok = nilPT.nextRequest(k1, now)
+	assert.False(t, ok)
+	assert.False(t, nilPT.handleReply(k1, wgMax))
+	nilPT.trim(func(wgtypes.Key) bool { return false })
+	assert.Equal(t, fact.UDPMaxSafePayload, nilPT.payload(k1))
+}
+
+func TestPathTracker_belowSafe(t *testing.T) {
+	now := time.Now()
+	k1 := testutils.MustKey(t)
+	pathMax := 1000
+
+	pt := newPathTracker()
+	pt.setMax(fact.UDPPayloadForMTU(1420))
+
+	// search answering only the probes that fit the path
+	replied := false
+	search := func() {
+		for probes := 0; ; probes++ {
+			require.Less(t, probes, 20*pathProbeAttempts, "search should end")
+			size, ok := pt.nextRequest(k1, now)
+			if !ok {
+				return
+			}
+			if size <= pathMax {
+				pt.handleReply(k1, size)
+				replied = true
+			} else if !replied {
+				// until something smaller is confirmed, we stay at the safe size
+				assert.Equal(t, fact.UDPMaxSafePayload, pt.payload(k1))
+			}
+		}
+	}
+
+	search()
+	assert.LessOrEqual(t, pt.payload(k1), pathMax)
+	assert.Greater(t, pt.payload(k1), pathMax-pathProbeResolution)
+	found := pt.payload(k1)
+
+	// the recheck keeps what works, even though it is below the safe size
+	now = now.Add(pathRecheckPeriod)
+	search()
+	assert.Equal(t, found, pt.payload(k1))
+
+	// and finds it when the path gets bigger again
+	pathMax = 1400
+	now = now.Add(pathRecheckPeriod)
+	search()
+	assert.LessOrEqual(t, pt.payload(k1), pathMax)
+	assert.Greater(t, pt.payload(k1), pathMax-pathProbeResolution)
+}
+
+func TestLinkServer_pathProbe(t *testing.T) {
+	now := time.Now()
+	localPrivKey, localPubKey := testutils.MustKeyPair(t)
+	remoteKey := testutils.MustKey(t)
+	s := &LinkServer{
+		signer:      signing.New(&localPrivKey),
+		ProbePeriod: DefaultProbePeriod,
+	}
+
+	for _, size := range []int{fact.UDPMaxSafePayload + 1, 1372, 5000, fact.UDPMaxPayload} {
+		groups, err := s.pathProbe(remoteKey, localPubKey, size, now)
+		require.NoError(t, err)
+		require.Len(t, groups, 1)
+		packet, err := groups[0].MarshalBinaryNow(now)
+		require.NoError(t, err)
+		assert.Len(t, packet, size)
+
+		inner, err := groups[0].Value.(*fact.SignedGroupValue).ParseInner(now)
+		require.NoError(t, err)
+		require.Len(t, inner, 1)
+		assert.Equal(t, fact.AttributePathProbe, inner[0].Attribute)
+		assert.Equal(t, uint16(size), inner[0].Value.(*fact.PathProbeValue).Size)
+	}
+}
+
+// expectPathProbe sets up a mock to expect a path probe fact sent to the
+// given peer
+func expectPathProbe(
+	t *testing.T,
+	conn *netmocks.UDPConn,
+	now time.Time,
+	from, to wgtypes.Key,
+	attr fact.Attribute,
+	size int,
+) *mock.Call {
+	dest := &net.UDPAddr{IP: autopeer.AutoAddress(to)}
+	isProbe := func(packet []byte) bool {
+		f := &fact.Fact{}
+		if err := f.DecodeFrom(0, now, bytes.NewBuffer(packet)); err != nil {
+			return false
+		}
+		sgv, ok := f.Value.(*fact.SignedGroupValue)
+		if !ok {
+			return false
+		}
+		inner, err := sgv.ParseInner(now)
+		if err != nil || len(inner) != 1 {
+			return false
+		}
+		pv, ok := inner[0].Value.(*fact.PathProbeValue)
+		return ok &&
+			inner[0].Attribute == attr &&
+			*inner[0].Subject.(*fact.PeerSubject) == fact.PeerSubject{Key: from} &&
+			int(pv.Size) == size &&
+			(attr != fact.AttributePathProbe || len(packet) == size)
+	}
+	return conn.On("WriteToUDP", mock.MatchedBy(isProbe), dest).Return(size, nil)
+}
+
+func TestLinkServer_probePaths(t *testing.T) {
+	now := time.Now()
+	localPrivKey, localPubKey := testutils.MustKeyPair(t)
+	remoteKey := testutils.MustKey(t)
+	dev := &wgtypes.Device{
+		Name:      "wg0",
+		PublicKey: localPubKey,
+		Peers: []wgtypes.Peer{
+			{PublicKey: remoteKey, Endpoint: testutils.RandUDP4Addr(t), LastHandshakeTime: now},
+		},
+	}
+	wgMax := fact.UDPPayloadForMTU(1420)
+
+	env := &netmocks.Environment{}
+	env.WithSimpleInterfaces(map[string]net.IPNet{"wg0": testutils.MakeIPv4Net(10, 0, 0, 1, 24)})["wg0"].WithMTU(1420)
+	env.Test(t)
+	conn := &netmocks.UDPConn{}
+	conn.Test(t)
+	conn.On("SetWriteDeadline", mock.Anything).Return(nil)
+	expectPathProbe(t, conn, now, localPubKey, remoteKey, fact.AttributePathProbe, wgMax).Once()
+
+	s := &LinkServer{
+		config:      &config.Server{},
+		net:         env,
+		conn:        conn,
+		peerConfig:  newPeerConfigSet(),
+		signer:      signing.New(&localPrivKey),
+		paths:       newPathTracker(),
+		stateAccess: &sync.Mutex{},
+		ChunkPeriod: DefaultChunkPeriod,
+		ProbePeriod: DefaultProbePeriod,
+	}
+	s.probePaths(dev, now)
+	conn.AssertExpectations(t)
+	assert.Equal(t, fact.UDPMaxSafePayload, s.paths.payload(remoteKey))
+
+	// reply comes back
+	assert.True(t, s.handlePathProbe(remoteKey, &fact.Fact{
+		Attribute: fact.AttributePathProbeReply,
+		Subject:   &fact.PeerSubject{Key: remoteKey},
+		Value:     &fact.PathProbeValue{Size: uint16(wgMax)},
+		Expires:   now.Add(DefaultProbePeriod),
+	}, now))
+	assert.Equal(t, wgMax, s.paths.payload(remoteKey))
+}
+
+func TestLinkServer_handlePathProbe(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(DefaultProbePeriod)
+	localPrivKey, localPubKey := testutils.MustKeyPair(t)
+	remoteKey := testutils.MustKey(t)
+	otherKey := testutils.MustKey(t)
+
+	conn := &netmocks.UDPConn{}
+	conn.Test(t)
+	conn.On("SetWriteDeadline", mock.Anything).Return(nil)
+	expectPathProbe(t, conn, now, localPubKey, remoteKey, fact.AttributePathProbeReply, 2000).Once()
+
+	s := &LinkServer{
+		config:      &config.Server{},
+		conn:        conn,
+		peerConfig:  newPeerConfigSet(),
+		signer:      signing.New(&localPrivKey),
+		paths:       newPathTracker(),
+		ChunkPeriod: DefaultChunkPeriod,
+		ProbePeriod: DefaultProbePeriod,
+	}
+
+	// not a path probe
+	assert.False(t, s.handlePathProbe(remoteKey, &fact.Fact{
+		Attribute: fact.AttributeMember,
+		Subject:   &fact.PeerSubject{Key: remoteKey},
+		Value:     &fact.EmptyValue{},
+		Expires:   expires,
+	}, now))
+	// wrong subject is ignored
+	assert.True(t, s.handlePathProbe(remoteKey, &fact.Fact{
+		Attribute: fact.AttributePathProbe,
+		Subject:   &fact.PeerSubject{Key: otherKey},
+		Value:     &fact.PathProbeValue{Size: 2000},
+		Expires:   expires,
+	}, now))
+	// requests get a reply without the padding
+	assert.True(t, s.handlePathProbe(remoteKey, &fact.Fact{
+		Attribute: fact.AttributePathProbe,
+		Subject:   &fact.PeerSubject{Key: remoteKey},
+		Value:     &fact.PathProbeValue{Size: 2000, Padding: make([]byte, 1900)},
+		Expires:   expires,
+	}, now))
+	conn.AssertExpectations(t)
+}
@@ -30,7 +30,12 @@ func (pcs *peerConfigSet) Trim(keep func(key wgtypes.Key) bool) {
 	}
 }
 
+// Get returns the state for the given peer, if any. It is safe to call on a
+// nil set, which will never have any state.
 func (pcs *peerConfigSet) Get(key wgtypes.Key) (ret *apply.PeerConfigState, ok bool) {
+	if pcs == nil {
+		return nil, false
+	}
 	pcs.psm.Lock()
 	ret, ok = pcs.peerStates[key]
 	pcs.psm.Unlock()
@@ -16,25 +16,25 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-func (s *LinkServer) configurePeers(factsRefreshed <-chan []*fact.Fact) error {
+func (s *LinkServer) configurePeers(factsRefreshed <-chan *factSnapshot) error {
 	// avoid deconfiguring peers until we've been running long enough
 	// for everyone we're connected to to tell us everything
-	startTime := time.Now()
+	startTime := s.now()
 
-	var facts []*fact.Fact
+	var snapshot *factSnapshot
 	var ok bool
 
 FACTLOOP:
 	for {
 		select {
 
-		case facts, ok = <-factsRefreshed:
+		case snapshot, ok = <-factsRefreshed:
 			if !ok {
 				// input closed, we're done
 				break FACTLOOP
 			}
-			now := time.Now()
-			log.Debug("Got a new fact set of length %d", len(facts))
+			now := s.now()
+			logger.Debug("Got a new fact set of length %d", len(snapshot.facts))
 
 			dev, err := s.deviceState()
 			if err != nil {
@@ -43,10 +43,14 @@ FACTLOOP:
 				return errors.Wrap(err, "Unable to load device state, giving up")
 			}
 
-			s.configurePeersOnce(facts, dev, startTime, now)
+			s.configurePeersOnce(snapshot, dev, startTime, now)
 
 		case <-s.printRequested:
-			log.Info("%s", s.formatFacts(time.Now(), facts))
+			var facts []*fact.Fact
+			if snapshot != nil {
+				facts = snapshot.facts
+			}
+			logger.Info("%s", s.formatFacts(s.now(), facts))
 		}
 	}
 
@@ -68,10 +72,19 @@ func (s *LinkServer) collectPeerFlags(
 	localPeers[dev.PublicKey] = true
 	validPeers[dev.PublicKey] = true
 
-	// statically configured peers are all valid
-	for k := range s.config.Peers {
+	// statically configured peers are all valid, including those that replaced
+	// them
+	for k := range s.succeededPeers() {
+		validPeers[k] = true
+	}
+	// as are the members of the signed roster, and the nodes that joined with
+	// our tokens
+	for k := range s.rosterMembers {
 		validPeers[k] = true
 	}
+	for _, e := range s.enrollments.enrollments() {
+		validPeers[e.PublicKey] = true
+	}
 
 	// loop over the local peers once to update their current state flags
 	// before we modify anything. this is important for some race conditions
@@ -83,21 +96,44 @@ func (s *LinkServer) collectPeerFlags(
 		// if we have no info about a local peer, flag it for deletion
 		if !ok && !validPeers[peer.PublicKey] {
 			removePeer[peer.PublicKey] = true
-			log.Debug("Flagging peer %s for removal: not valid", peer.PublicKey)
+			logger.Debug("Flagging peer %s for removal: not valid", peer.PublicKey)
 		}
 		// alive check uses 0 for the maxTTL, as we just care whether the alive fact
 		// is still valid now
-		newAlive, aliveUntil, bootID := s.peerKnowledge.peerAlive(peer.PublicKey)
+		newAlive, aliveUntil, bootID := s.peerKnowledge.peerAlive(peer.PublicKey, now)
 		ps, _ := s.peerConfig.Get(peer.PublicKey)
 		ps = ps.Update(peer, s.peerConfigName(peer.PublicKey), newAlive, aliveUntil, bootID, now, peerFacts)
+		if lq := s.probes.quality(peer.PublicKey); lq != ps.LinkQuality() {
+			ps = ps.WithLinkQuality(lq)
+		}
 		s.peerConfig.Set(peer.PublicKey, ps)
 	}
 
+	// with a quorum, count the votes of the Membership sources for each peer
+	useQuorum := s.config.MembershipQuorum > 1
+	if useQuorum {
+		prov := s.currentProvenance()
+		s.memberVotes = make(map[wgtypes.Key]int, len(factsByPeer))
+		for peer, factGroup := range factsByPeer {
+			s.memberVotes[peer] = s.membershipVotes(dev.PublicKey, peer, factGroup, prov, now)
+		}
+	} else {
+		s.memberVotes = nil
+	}
+
 	// loop over the facts to identify valid and invalid peers from that list
 	for peer, factGroup := range factsByPeer {
 		// don't flag for removal anything already identified as valid
 		if validPeers[peer] {
 			continue
+		} else if useQuorum {
+			if s.hasMembershipQuorum(s.memberVotes[peer], localPeers[peer]) {
+				validPeers[peer] = true
+			} else {
+				removePeer[peer] = true
+				logger.Debug("Flagging peer %s for removal from %s: %d membership votes",
+					peer, dev.PublicKey, s.memberVotes[peer])
+			}
 		} else if fact.SliceHas(factGroup, func(f *fact.Fact) bool {
 			return f.Attribute == fact.AttributeMember || f.Attribute == fact.AttributeMemberMetadata
 		}) {
@@ -105,7 +141,7 @@ func (s *LinkServer) collectPeerFlags(
 		} else {
 			// TODO: maybe only flag this if localPeer[peer], to reduce log noise in some corner cases
 			removePeer[peer] = true
-			log.Debug("Flagging peer %s for removal from %s: no membership", peer, dev.PublicKey)
+			logger.Debug("Flagging peer %s for removal from %s: no membership", peer, dev.PublicKey)
 		}
 	}
 
@@ -118,11 +154,34 @@ func (s *LinkServer) collectPeerFlags(
 	return
 }
 
-func (s *LinkServer) configurePeersOnce(newFacts []*fact.Fact, dev *wgtypes.Device, startTime, now time.Time) {
-	factsByPeer := groupFactsByPeer(newFacts)
+func (s *LinkServer) configurePeersOnce(snapshot *factSnapshot, dev *wgtypes.Device, startTime, now time.Time) {
+	s.dryRun.begin()
+
+	// the snapshot is shared with the broadcast stage, and allocating addresses
+	// below adds to the groups, so work on a copy
+	factsByPeer := make(map[wgtypes.Key][]*fact.Fact, len(snapshot.byPeer))
+	for k, facts := range snapshot.byPeer {
+		factsByPeer[k] = facts
+	}
+	// replace the roster pages with the facts they represent
+	factsByPeer = s.applyRoster(factsByPeer, snapshot.roster, now)
+	// and move what we know about replaced keys to their successors
+	factsByPeer = s.applySuccession(factsByPeer, snapshot.successors, dev, now)
 
 	localPeers, removePeer, validPeers := s.collectPeerFlags(now, dev, factsByPeer)
 
+	// give members without AllowedIPs addresses from our pools, and take any
+	// given to us. Allocations for peers that are no longer members are only
+	// released once we have had time to hear about all of them.
+	s.allocateAddresses(dev, factsByPeer, validPeers, now.Sub(startTime) > s.FactTTL, now)
+	s.assignLocalAddresses(dev, factsByPeer)
+
+	// peers can't reach us through NAT unless we keep the mapping open
+	natted := s.detectNAT(dev, factsByPeer[dev.PublicKey])
+
+	// peers can't be given an auto address that another peer (or we) also has
+	colliding := s.detectCollisions(dev, validPeers)
+
 	// don't need the group members to cancel when one of them fails
 	var eg errgroup.Group
 
@@ -137,17 +196,31 @@ func (s *LinkServer) configurePeersOnce(newFacts []*fact.Fact, dev *wgtypes.Devi
 	// deconfigure also requires that we are not listed as an AIP trust source
 	allowDeconfigure := startedAndNotRouter && selfTrust < trust.AllowedIPs
 
+	// peers we can't reach directly can have their AIPs moved to a relay peer,
+	// but only if we would also be able to move them back later
+	configFacts := factsByPeer
+	if allowDeconfigure {
+		configFacts = s.addRelayFacts(dev, factsByPeer, now)
+	} else {
+		s.relays = nil
+	}
+
+	// when multiple peers (e.g. redundant routers) claim the same AllowedIP, pick
+	// which one should hold it, so that we fail over when the current holder
+	// goes down instead of flapping the AIP between them
+	aipOwners := s.chooseAllowedIPOwners(dev, configFacts)
+
 	updatePeer := func(peer *wgtypes.Peer, allowAdd bool) {
-		factGroup, ok := factsByPeer[peer.PublicKey]
+		factGroup, ok := configFacts[peer.PublicKey]
 		if !ok {
 			// should never get here
-			log.Error("BUG detected: updating unknown peer: %s", s.peerName(peer.PublicKey))
+			logger.Error("BUG detected: updating unknown peer: %s", s.peerName(peer.PublicKey))
 			return
 		}
 
 		pcs, _ := s.peerConfig.Get(peer.PublicKey)
 		eg.Go(func() error {
-			newState, err := s.configurePeer(pcs, peer, factGroup, allowDeconfigure, allowAdd)
+			newState, err := s.configurePeer(pcs, peer, factGroup, allowDeconfigure, allowAdd, natted, colliding[peer.PublicKey], aipOwners)
 			// `configurePeer` always returns the new state, even if it also returns an error
 			s.peerConfig.Set(peer.PublicKey, newState)
 			return err
@@ -176,11 +249,11 @@ func (s *LinkServer) configurePeersOnce(newFacts []*fact.Fact, dev *wgtypes.Devi
 		}
 		// should not be possible to have peer in valid and remove sets
 		if removePeer[peer] {
-			log.Error("BUG detected: have peer both valid and to-delete: %s", s.peerName(peer))
+			logger.Error("BUG detected: have peer both valid and to-delete: %s", s.peerName(peer))
 			continue
 		}
 
-		log.Info("Adding new local peer %s", s.peerName(peer))
+		logger.Info("Adding new local peer %s", s.peerName(peer))
 		updatePeer(&wgtypes.Peer{PublicKey: peer}, true)
 	}
 
@@ -197,7 +270,7 @@ func (s *LinkServer) configurePeersOnce(newFacts []*fact.Fact, dev *wgtypes.Devi
 				!localPeers[peer] {
 				continue
 			}
-			log.Error("BUG detected: trust source wants to remove peer: %s (%v)", s.peerName(peer))
+			logger.Error("BUG detected: trust source wants to remove peer: %s (%v)", s.peerName(peer))
 			allowDelete = false
 		}
 	}
@@ -208,6 +281,77 @@ func (s *LinkServer) configurePeersOnce(newFacts []*fact.Fact, dev *wgtypes.Devi
 	//nolint:errcheck // we don't actually care if any of the routines failed,
 	// just that they finished
 	eg.Wait()
+
+	// peers that no longer need changing don't get configured at all, so don't
+	// leave what we would have changed before pending for them
+	for _, peer := range s.dryRun.finish() {
+		logger.Info("Dry run: would no longer change peer %s", s.peerName(peer))
+	}
+}
+
+// addRelayFacts picks relays for peers we can't reach directly, and returns a
+// copy of factsByPeer where the relays have the AllowedIP facts of the peers
+// they are relaying for added to their own. It also asks the candidate relays
+// whether they can reach each target, and logs any changes in which peers are
+// being relayed.
+func (s *LinkServer) addRelayFacts(
+	dev *wgtypes.Device,
+	factsByPeer map[wgtypes.Key][]*fact.Fact,
+	now time.Time,
+) map[wgtypes.Key][]*fact.Fact {
+	candidates, targets := apply.RelayCandidates(dev.Peers, factsByPeer, s.peerConfig.Get, s.config.Peers.IsRelay)
+	s.askReach(candidates, targets, now)
+	relays := apply.ChooseRelays(
+		dev.Peers, factsByPeer, s.peerConfig.Get, s.config.Peers.IsRelay,
+		s.probes.quality,
+		func(relay, target wgtypes.Key) (apply.LinkQuality, bool) { return s.reach.get(relay, target, now) },
+	)
+
+	for target, relay := range relays {
+		if prev, ok := s.relays[target]; !ok || prev != relay {
+			logger.Info("Relaying peer %s through %s", s.peerName(target), s.peerName(relay))
+		}
+	}
+	for target := range s.relays {
+		if _, ok := relays[target]; !ok {
+			logger.Info("No longer relaying peer %s", s.peerName(target))
+		}
+	}
+	s.relays = relays
+
+	relayFacts := apply.RelayFacts(relays, factsByPeer)
+	if len(relayFacts) == 0 {
+		return factsByPeer
+	}
+	ret := make(map[wgtypes.Key][]*fact.Fact, len(factsByPeer))
+	for k, facts := range factsByPeer {
+		ret[k] = facts
+	}
+	for k, facts := range relayFacts {
+		// make a new slice so we don't modify the one we were given
+		merged := make([]*fact.Fact, 0, len(ret[k])+len(facts))
+		merged = append(merged, ret[k]...)
+		ret[k] = append(merged, facts...)
+	}
+	return ret
+}
+
+// chooseAllowedIPOwners wraps apply.ChooseAllowedIPOwners, logging any
+// AllowedIPs that are going to move from one peer to another
+func (s *LinkServer) chooseAllowedIPOwners(
+	dev *wgtypes.Device,
+	factsByPeer map[wgtypes.Key][]*fact.Fact,
+) apply.AllowedIPOwners {
+	owners := apply.ChooseAllowedIPOwners(dev.Peers, factsByPeer, s.peerConfig.Get)
+	for _, peer := range dev.Peers {
+		for _, aip := range peer.AllowedIPs {
+			owner, ok := owners.OwnerOfIPNet(aip)
+			if ok && owner != peer.PublicKey {
+				logger.Info("Failing over AIP %v from %s to %s", aip, s.peerName(peer.PublicKey), s.peerName(owner))
+			}
+		}
+	}
+	return owners
 }
 
 func (s *LinkServer) peerHealthyEnough(now time.Time, key wgtypes.Key) bool {
@@ -224,11 +368,11 @@ func (s *LinkServer) peerHealthyEnough(now time.Time, key wgtypes.Key) bool {
 	if !isHealthy ||
 		aliveFor < aliveForMin ||
 		stillAliveFor <= stillAliveForMin {
-		log.Debug("Maybe not safe to delete peers: %s is not healthy (!%v {%v} || %v < %v || %v <= %v)",
+		logger.Debug("Maybe not safe to delete peers: %s is not healthy (!%v {%v} || %v < %v || %v <= %v)",
 			key, isHealthy, pcs.IsAlive(), aliveFor, aliveForMin, stillAliveFor, stillAliveForMin)
 		return false
 	}
-	log.Debug("Healthy enough: %s: %v >= %v && %v > %v",
+	logger.Debug("Healthy enough: %s: %v >= %v && %v > %v",
 		key, aliveFor, aliveForMin, stillAliveFor, stillAliveForMin)
 	return true
 }
@@ -237,7 +381,7 @@ func (s *LinkServer) peerHealthyEnough(now time.Time, key wgtypes.Key) bool {
 // whether any peer deletion should happen, and deletes the flagged peers that
 // are safe to delete. For peer deletion to happen, there needs to be a peer
 // with Membership trust that has been online & healthy long enough to believe
-// we have all its facts. The caller is responsible for checking the local node
+// we have all its facts, or a complete signed roster. The caller is responsible for checking the local node
 // state for deletion safety, e.g. uptime and local trust mode. For an
 // individual peer to be deleted, it needs to be flagged for deletion, and must
 // not be statically configured (as it would just get immediately re-added in
@@ -249,31 +393,39 @@ func (s *LinkServer) deletePeers(
 ) (err error) {
 	doDelPeers := false
 	anyMemberTrust := false
-	for pk, pc := range s.config.Peers {
+	peers := s.succeededPeers()
+	for pk, pc := range peers {
 		if pc.Trust == nil || *pc.Trust < trust.Membership {
 			continue
 		}
 		anyMemberTrust = true
 		if s.peerHealthyEnough(now, pk) {
 			doDelPeers = true
-			log.Debug("Safe to delete peers from %s: %s is healthy", dev.PublicKey, pk)
+			logger.Debug("Safe to delete peers from %s: %s is healthy", dev.PublicKey, pk)
 			break
 		}
 	}
 
+	// a complete signed roster is an authoritative membership source
+	if !doDelPeers && s.rosterMembers != nil {
+		anyMemberTrust = true
+		doDelPeers = true
+		logger.Debug("Safe to delete peers from %s: have signed roster %d", dev.PublicKey, s.rosterSerial)
+	}
+
 	if !anyMemberTrust {
 		// if we're in full-auto mode, check for a router as a trust source
 		for _, peer := range dev.Peers {
 			if detect.IsPeerRouter(&peer) && s.peerHealthyEnough(now, peer.PublicKey) {
 				doDelPeers = true
-				log.Debug("Safe to delete peers from %s: %s is healthy (router)", dev.PublicKey, peer)
+				logger.Debug("Safe to delete peers from %s: %s is healthy (router)", dev.PublicKey, peer)
 				break
 			}
 		}
 	}
 
 	if !doDelPeers {
-		log.Debug("Not safe to delete peers from %s", dev.PublicKey)
+		logger.Debug("Not safe to delete peers from %s", dev.PublicKey)
 		return
 	}
 
@@ -283,7 +435,7 @@ func (s *LinkServer) deletePeers(
 			continue
 		}
 		// don't delete statically configured peers, they'd just get re-added
-		if s.config.Peers.Has(peer.PublicKey) {
+		if peers.Has(peer.PublicKey) {
 			continue
 		}
 		// don't delete routers if we have no other sources of membership trust
@@ -291,7 +443,7 @@ func (s *LinkServer) deletePeers(
 		if detect.IsPeerRouter(&peer) && !anyMemberTrust {
 			continue
 		}
-		log.Info("Removing peer: %s", s.peerName(peer.PublicKey))
+		logger.Info("Removing peer: %s", s.peerName(peer.PublicKey))
 		cfg.Peers = append(cfg.Peers, wgtypes.PeerConfig{
 			PublicKey: peer.PublicKey,
 			Remove:    true,
@@ -303,9 +455,9 @@ func (s *LinkServer) deletePeers(
 	if len(cfg.Peers) != 0 {
 		s.stateAccess.Lock()
 		defer s.stateAccess.Unlock()
-		err = s.ctrl.ConfigureDevice(s.config.Iface, cfg)
+		err = s.configureDevice(cfg, dev.Peers, nil, "no longer a member")
 		if err != nil {
-			log.Error("Unable to delete peers: %v", err)
+			logger.Error("Unable to delete peers: %v", err)
 		}
 	}
 
@@ -328,8 +480,11 @@ func (s *LinkServer) configurePeer(
 	facts []*fact.Fact,
 	allowDeconfigure bool,
 	allowAdd bool,
+	natted bool,
+	colliding bool,
+	aipOwners apply.AllowedIPOwners,
 ) (state *apply.PeerConfigState, err error) {
-	now := time.Now()
+	now := s.now()
 	peerName := s.peerName(peer.PublicKey)
 	state = inputState.EnsureNotNil()
 
@@ -340,8 +495,11 @@ func (s *LinkServer) configurePeer(
 
 	var pcfg *wgtypes.PeerConfig
 	logged := false
+	// reason is recorded in the audit log for any changes we make
+	var reason string
 
 	if state.IsHealthy() {
+		reason = "peer is healthy"
 		// don't setup the AllowedIPs until it's healthy and, unless it's basic,
 		// alive, as we don't want to start routing traffic to it if it won't
 		// accept it and reciprocate.
@@ -349,38 +507,40 @@ func (s *LinkServer) configurePeer(
 		// this is a transient state that should clear soon, and so we leave it as
 		// hysteresis, esp. in case we miss alive pings a little.
 		if s.readyForAllowedIPs(now, state, peer) {
-			pcfg = apply.EnsureAllowedIPs(peer, facts, pcfg, allowDeconfigure)
+			pcfg = apply.EnsureAllowedIPs(peer, facts, pcfg, allowDeconfigure, aipOwners, s.scheme)
 			if pcfg != nil && (len(pcfg.AllowedIPs) > 0 || pcfg.ReplaceAllowedIPs) {
 				if pcfg.ReplaceAllowedIPs {
-					log.Info("Resetting AIPs on peer %s: %d -> %d", peerName, len(peer.AllowedIPs), len(pcfg.AllowedIPs))
+					logger.Info("Resetting AIPs on peer %s: %d -> %d", peerName, len(peer.AllowedIPs), len(pcfg.AllowedIPs))
 				} else {
-					log.Info("Adding AIPs to peer %s: %d", peerName, len(pcfg.AllowedIPs))
+					logger.Info("Adding AIPs to peer %s: %d", peerName, len(pcfg.AllowedIPs))
 				}
 				logged = true
 			}
 		}
 	} else {
+		reason = "peer is not healthy"
 		// we assume caller has set `allowDeconfigure` in awareness of any local
 		// node aspects. There should be no harm in deconfiguring a dead router,
 		// as it won't work to route packets while it's dead, and we'll reconfigure
-		// it as soon as it comes back online.
-		if allowDeconfigure {
-			pcfg = apply.OnlyAutoIP(peer, pcfg)
+		// it as soon as it comes back online. Peers with a colliding auto address
+		// are left alone, as restricting them to it would take it from the other.
+		if allowDeconfigure && !colliding {
+			pcfg = apply.OnlyAutoIP(peer, pcfg, s.scheme)
 			if pcfg != nil && pcfg.ReplaceAllowedIPs {
-				log.Info("Restricting peer to be IPv6-LL only: %s", peerName)
+				logger.Info("Restricting peer to be auto address only: %s", peerName)
 				logged = true
 			}
 		}
 
-		if state.TimeForNextEndpoint() {
+		if state.TimeForNextEndpoint(now) {
 			nextEndpoint := state.NextEndpoint(facts, now)
 			if nextEndpoint == nil {
-				log.Debug("Time for new EP for %s, but none known", peerName)
+				logger.Debug("Time for new EP for %s, but none known", peerName)
 			} else if util.UDPEqualIPPort(nextEndpoint, peer.Endpoint) {
 				// don't poke the config if it already has the same endpoint, e.g. there is only one known to try
-				log.Debug("Time for new EP for %s, but no alternate known", peerName)
+				logger.Debug("Time for new EP for %s, but no alternate known", peerName)
 			} else {
-				log.Info("Trying EP for %s: %v", peerName, nextEndpoint)
+				logger.Info("Trying EP for %s: %v", peerName, nextEndpoint)
 				logged = true
 				if pcfg == nil {
 					pcfg = &wgtypes.PeerConfig{PublicKey: peer.PublicKey}
@@ -393,34 +553,74 @@ func (s *LinkServer) configurePeer(
 		}
 	}
 
-	var addedAIP bool
-	pcfg, addedAIP = apply.EnsurePeerAutoIP(peer, pcfg)
-	if addedAIP {
-		log.Info("Adding IPv6-LL to %s", peerName)
+	// the auto address of a colliding peer can only be routed to one of them,
+	// so we don't give it to any
+	if !colliding {
+		var addedAIP bool
+		pcfg, addedAIP = apply.EnsurePeerAutoIP(peer, pcfg, s.scheme)
+		if addedAIP {
+			logger.Info("Adding auto address to %s", peerName)
+			logged = true
+		}
+	}
+
+	// keep the link open through NAT, including while it is down, as that is
+	// when the mapping is most likely to have been lost. The state recording
+	// whether we set it is only kept once the device has the matching config.
+	keepaliveState, pcfg, changedKeepalive := state.EnsureKeepalive(peer, pcfg, natted)
+	if changedKeepalive {
+		if natted {
+			logger.Info("Adding NAT keepalive to %s", peerName)
+		} else {
+			logger.Info("Removing NAT keepalive from %s", peerName)
+		}
 		logged = true
 	}
 
+	// basic peers don't run wirelink, so they can't derive the key
+	if psk, ok := s.pairPSK(peer, now); ok && !s.config.Peers.IsBasic(peer.PublicKey) && !state.IsBasic() {
+		var changedPSK bool
+		pcfg, changedPSK = apply.EnsurePSK(peer, pcfg, psk)
+		if changedPSK {
+			// never log the key itself
+			logger.Info("Setting preshared key for %s", peerName)
+			logged = true
+		}
+	}
+
 	if pcfg == nil {
+		state = keepaliveState
 		return
 	}
 
 	pcfg.UpdateOnly = !allowAdd
+	if allowAdd {
+		reason = "new member"
+	}
 
 	//TODO: this is a hack to make test assertions stable, find a better way
-	if log.IsDebug() {
+	if logger.Enabled(log.LevelDebug) {
 		util.SortIPNetSlice(pcfg.AllowedIPs)
 	}
 
-	log.Debug("Applying peer configuration: %v", *pcfg)
-	err = s.ctrl.ConfigureDevice(s.config.Iface, wgtypes.Config{
-		Peers: []wgtypes.PeerConfig{*pcfg},
-	})
+	logger.Debug("Applying peer configuration: %v", *pcfg)
+	var prev []wgtypes.Peer
+	if !allowAdd {
+		prev = []wgtypes.Peer{*peer}
+	}
+	err = s.configureDevice(
+		wgtypes.Config{Peers: []wgtypes.PeerConfig{*pcfg}},
+		prev,
+		map[wgtypes.Key][]*fact.Fact{peer.PublicKey: facts},
+		reason,
+	)
 	if err != nil {
-		log.Error("Failed to configure peer %s: %+v: %v", peerName, *pcfg, err)
+		logger.Error("Failed to configure peer %s: %+v: %v", peerName, *pcfg, err)
 		return
 	} else if !logged {
-		log.Info("WAT: applied unknown peer config change to %s: %+v", peerName, *pcfg)
+		logger.Info("WAT: applied unknown peer config change to %s: %+v", peerName, *pcfg)
 	}
+	state = keepaliveState
 
 	return
 }
@@ -48,7 +48,7 @@ func TestLinkServer_configurePeers(t *testing.T) {
 		signer        *signing.Signer
 	}
 	type args struct {
-		factsRefreshed <-chan []*fact.Fact
+		factsRefreshed <-chan *factSnapshot
 	}
 	tests := []struct {
 		name    string
@@ -101,10 +101,18 @@ func TestLinkServer_configurePeersOnce(t *testing.T) {
 	remoteController1Key := testutils.MustKey(t)
 	remoteController2Key := testutils.MustKey(t)
 	remoteLeaf1Key := testutils.MustKey(t)
+	remoteLeaf2Key := testutils.MustKey(t)
 
 	leaf1Endpoint := testutils.RandUDP4Addr(t)
+	leaf2Endpoint := testutils.RandUDP4Addr(t)
 	leaf1AIP32 := testutils.RandIPNet(t, net.IPv4len, nil, nil, 32)
 	leaf1AIP32wrong := testutils.RandIPNet(t, net.IPv4len, nil, nil, 32)
+	sharedAIP := testutils.RandIPNet(t, net.IPv4len, nil, nil, 24)
+
+	pskSecret := testutils.MustRandBytes(t, make([]byte, 32))
+	// long enough that the epoch can't change while the test runs
+	pskRotation := 1000 * 24 * time.Hour
+	leaf1PSK := apply.PairPSK(pskSecret, localKey, remoteLeaf1Key, apply.PSKEpoch(now, pskRotation))
 
 	// t.Logf("Local is %s", localKey)
 	// t.Logf("Remote trusted 1 is %s", remoteController1Key)
@@ -116,6 +124,7 @@ func TestLinkServer_configurePeersOnce(t *testing.T) {
 		ctrl          func(*testing.T) *mocks.WgClient
 		peerKnowledge *peerKnowledgeSet
 		peerStates    map[wgtypes.Key]*apply.PeerConfigState
+		reach         *reachTracker
 	}
 	type args struct {
 		newFacts  []*fact.Fact
@@ -159,6 +168,7 @@ func TestLinkServer_configurePeersOnce(t *testing.T) {
 				},
 				newPKS(),
 				map[wgtypes.Key]*apply.PeerConfigState{},
+				nil,
 			},
 			args{
 				[]*fact.Fact{
@@ -172,6 +182,111 @@ func TestLinkServer_configurePeersOnce(t *testing.T) {
 				now,
 			},
 		},
+		{
+			"add new peer with preshared key",
+			fields{
+				buildConfig(wgIface).withPeer(remoteController1Key, &config.Peer{
+					Trust: trust.Ptr(trust.Membership),
+				}).withPSK(pskSecret, pskRotation).Build(),
+				func(t *testing.T) *mocks.WgClient {
+					ret := &mocks.WgClient{}
+					ret.On("ConfigureDevice", wgIface, wgtypes.Config{
+						Peers: []wgtypes.PeerConfig{
+							{
+								PublicKey:         remoteLeaf1Key,
+								AllowedIPs:        []net.IPNet{autopeer.AutoAddressNet(remoteLeaf1Key)},
+								ReplaceAllowedIPs: true,
+								PresharedKey:      &leaf1PSK,
+							},
+						},
+					}).Return(nil)
+					return ret
+				},
+				newPKS(),
+				map[wgtypes.Key]*apply.PeerConfigState{},
+				nil,
+			},
+			args{
+				[]*fact.Fact{
+					factutils.MemberFactFull(&remoteLeaf1Key, expiresFuture),
+				},
+				&wgtypes.Device{
+					Name:      wgIface,
+					PublicKey: localKey,
+				},
+				startTime,
+				now,
+			},
+		},
+		{
+			"rotate preshared key on existing peer",
+			fields{
+				buildConfig(wgIface).withPeer(remoteController1Key, &config.Peer{
+					Trust: trust.Ptr(trust.Membership),
+				}).withPSK(pskSecret, pskRotation).Build(),
+				func(t *testing.T) *mocks.WgClient {
+					ret := &mocks.WgClient{}
+					ret.On("ConfigureDevice", wgIface, wgtypes.Config{
+						Peers: []wgtypes.PeerConfig{
+							{
+								PublicKey:    remoteLeaf1Key,
+								UpdateOnly:   true,
+								PresharedKey: &leaf1PSK,
+							},
+						},
+					}).Return(nil)
+					return ret
+				},
+				newPKS(),
+				map[wgtypes.Key]*apply.PeerConfigState{},
+				nil,
+			},
+			args{
+				[]*fact.Fact{
+					factutils.MemberFactFull(&remoteLeaf1Key, expiresFuture),
+				},
+				&wgtypes.Device{
+					Name:      wgIface,
+					PublicKey: localKey,
+					Peers: []wgtypes.Peer{
+						{
+							PublicKey:    remoteLeaf1Key,
+							AllowedIPs:   []net.IPNet{autopeer.AutoAddressNet(remoteLeaf1Key)},
+							PresharedKey: apply.PairPSK(pskSecret, localKey, remoteLeaf1Key, 0),
+						},
+					},
+				},
+				startTime,
+				now,
+			},
+		},
+		{
+			"no preshared key for basic peer",
+			fields{
+				buildConfig(wgIface).withPeer(remoteLeaf1Key, &config.Peer{
+					Basic: true,
+				}).withPSK(pskSecret, pskRotation).Build(),
+				nil,
+				newPKS(),
+				map[wgtypes.Key]*apply.PeerConfigState{},
+				nil,
+			},
+			args{
+				nil,
+				&wgtypes.Device{
+					Name:      wgIface,
+					PublicKey: localKey,
+					Peers: []wgtypes.Peer{
+						{
+							PublicKey:  remoteLeaf1Key,
+							AllowedIPs: []net.IPNet{autopeer.AutoAddressNet(remoteLeaf1Key)},
+						},
+					},
+				},
+				startTime,
+				now,
+			},
+		},
 		{
 			// should still only add the basic peer since we don't have a handshake yet,
 			// no AIPs in the initial setup, but do add an endpoint
@@ -197,6 +312,7 @@ func TestLinkServer_configurePeersOnce(t *testing.T) {
 				},
 				newPKS(),
 				map[wgtypes.Key]*apply.PeerConfigState{},
+				nil,
 			},
 			args{
 				[]*fact.Fact{
@@ -234,6 +350,7 @@ func TestLinkServer_configurePeersOnce(t *testing.T) {
 				map[wgtypes.Key]*apply.PeerConfigState{
 					remoteController1Key: makePCS(t, true, true, true),
 				},
+				nil,
 			},
 			args{
 				[]*fact.Fact{
@@ -271,6 +388,7 @@ func TestLinkServer_configurePeersOnce(t *testing.T) {
 					remoteController1Key: makePCS(t, true, true, true),
 					remoteController2Key: makePCS(t, false, false, false),
 				},
+				nil,
 			},
 			args{
 				[]*fact.Fact{
@@ -315,6 +433,7 @@ func TestLinkServer_configurePeersOnce(t *testing.T) {
 				map[wgtypes.Key]*apply.PeerConfigState{
 					// nothing here because this routine _updates_ PCS, not uses it
 				},
+				nil,
 			},
 			args{
 				[]*fact.Fact{
@@ -364,6 +483,7 @@ func TestLinkServer_configurePeersOnce(t *testing.T) {
 				map[wgtypes.Key]*apply.PeerConfigState{
 					// nothing here because this routine _updates_ PCS, not uses it
 				},
+				nil,
 			},
 			args{
 				[]*fact.Fact{
@@ -401,6 +521,7 @@ func TestLinkServer_configurePeersOnce(t *testing.T) {
 				},
 				newPKS(),
 				map[wgtypes.Key]*apply.PeerConfigState{},
+				nil,
 			},
 			args{
 				[]*fact.Fact{
@@ -448,6 +569,7 @@ func TestLinkServer_configurePeersOnce(t *testing.T) {
 				},
 				newPKS(),
 				map[wgtypes.Key]*apply.PeerConfigState{},
+				nil,
 			},
 			args{
 				[]*fact.Fact{
@@ -473,6 +595,183 @@ func TestLinkServer_configurePeersOnce(t *testing.T) {
 				now,
 			},
 		},
+		{
+			"keep shared aip on healthy-alive holder",
+			fields{
+				buildConfig(wgIface).Build(),
+				func(t *testing.T) *mocks.WgClient {
+					ret := &mocks.WgClient{}
+					// should not move the AIP back and forth
+					return ret
+				},
+				newPKS().
+					mockPeerAlive(remoteLeaf1Key, expiresFuture, nil).
+					mockPeerAlive(remoteLeaf2Key, expiresFuture, nil),
+				map[wgtypes.Key]*apply.PeerConfigState{},
+				nil,
+			},
+			args{
+				[]*fact.Fact{
+					factutils.MemberFactFull(&remoteLeaf1Key, expiresFuture),
+					factutils.MemberFactFull(&remoteLeaf2Key, expiresFuture),
+					factutils.AllowedIPFactFull(sharedAIP, &remoteLeaf1Key, expiresFuture),
+					factutils.AllowedIPFactFull(sharedAIP, &remoteLeaf2Key, expiresFuture),
+				},
+				&wgtypes.Device{
+					Name:      wgIface,
+					PublicKey: localKey,
+					Peers: []wgtypes.Peer{
+						{
+							PublicKey: remoteLeaf1Key,
+							AllowedIPs: []net.IPNet{
+								autopeer.AutoAddressNet(remoteLeaf1Key),
+								sharedAIP,
+							},
+							Endpoint:          leaf1Endpoint,
+							LastHandshakeTime: now,
+						},
+						{
+							PublicKey:         remoteLeaf2Key,
+							AllowedIPs:        []net.IPNet{autopeer.AutoAddressNet(remoteLeaf2Key)},
+							Endpoint:          leaf2Endpoint,
+							LastHandshakeTime: now,
+						},
+					},
+				},
+				startTime,
+				now,
+			},
+		},
+		{
+			"fail over shared aip from unhealthy holder",
+			fields{
+				buildConfig(wgIface).Build(),
+				func(t *testing.T) *mocks.WgClient {
+					ret := &mocks.WgClient{}
+					ret.On("ConfigureDevice", wgIface, wgtypes.Config{
+						Peers: []wgtypes.PeerConfig{
+							{
+								PublicKey:  remoteLeaf2Key,
+								AllowedIPs: []net.IPNet{sharedAIP},
+								UpdateOnly: true,
+							},
+						},
+					}).Return(nil)
+					ret.On("ConfigureDevice", wgIface, wgtypes.Config{
+						Peers: []wgtypes.PeerConfig{
+							{
+								PublicKey:         remoteLeaf1Key,
+								AllowedIPs:        []net.IPNet{autopeer.AutoAddressNet(remoteLeaf1Key)},
+								ReplaceAllowedIPs: true,
+								UpdateOnly:        true,
+							},
+						},
+					}).Return(nil)
+					return ret
+				},
+				newPKS().mockPeerAlive(remoteLeaf2Key, expiresFuture, nil),
+				map[wgtypes.Key]*apply.PeerConfigState{},
+				nil,
+			},
+			args{
+				[]*fact.Fact{
+					factutils.MemberFactFull(&remoteLeaf1Key, expiresFuture),
+					factutils.MemberFactFull(&remoteLeaf2Key, expiresFuture),
+					factutils.AllowedIPFactFull(sharedAIP, &remoteLeaf1Key, expiresFuture),
+					factutils.AllowedIPFactFull(sharedAIP, &remoteLeaf2Key, expiresFuture),
+				},
+				&wgtypes.Device{
+					Name:      wgIface,
+					PublicKey: localKey,
+					Peers: []wgtypes.Peer{
+						{
+							PublicKey: remoteLeaf1Key,
+							AllowedIPs: []net.IPNet{
+								autopeer.AutoAddressNet(remoteLeaf1Key),
+								sharedAIP,
+							},
+							Endpoint:          leaf1Endpoint,
+							LastHandshakeTime: unhealthyAgo,
+						},
+						{
+							PublicKey:         remoteLeaf2Key,
+							AllowedIPs:        []net.IPNet{autopeer.AutoAddressNet(remoteLeaf2Key)},
+							Endpoint:          leaf2Endpoint,
+							LastHandshakeTime: now,
+						},
+					},
+				},
+				startTime,
+				now,
+			},
+		},
+		{
+			"relay aip for unhealthy peer",
+			fields{
+				buildConfig(wgIface).Build(),
+				func(t *testing.T) *mocks.WgClient {
+					ret := &mocks.WgClient{}
+					ret.On("ConfigureDevice", wgIface, wgtypes.Config{
+						Peers: []wgtypes.PeerConfig{
+							{
+								PublicKey:  remoteLeaf2Key,
+								AllowedIPs: []net.IPNet{leaf1AIP32},
+								UpdateOnly: true,
+							},
+						},
+					}).Return(nil)
+					ret.On("ConfigureDevice", wgIface, wgtypes.Config{
+						Peers: []wgtypes.PeerConfig{
+							{
+								PublicKey:         remoteLeaf1Key,
+								AllowedIPs:        []net.IPNet{autopeer.AutoAddressNet(remoteLeaf1Key)},
+								ReplaceAllowedIPs: true,
+								UpdateOnly:        true,
+							},
+						},
+					}).Return(nil)
+					return ret
+				},
+				newPKS().mockPeerAlive(remoteLeaf2Key, expiresFuture, nil),
+				map[wgtypes.Key]*apply.PeerConfigState{},
+				newReachTracker().mockReport(remoteLeaf2Key, remoteLeaf1Key, apply.LinkQuality{}, now, expiresFuture),
+			},
+			args{
+				[]*fact.Fact{
+					factutils.MemberFactFull(&remoteLeaf1Key, expiresFuture),
+					{
+						Attribute: fact.AttributeMemberMetadata,
+						Subject:   &fact.PeerSubject{Key: remoteLeaf2Key},
+						Expires:   expiresFuture,
+						Value:     fact.BuildMemberMetadata("relay", false, true),
+					},
+					factutils.AllowedIPFactFull(leaf1AIP32, &remoteLeaf1Key, expiresFuture),
+				},
+				&wgtypes.Device{
+					Name:      wgIface,
+					PublicKey: localKey,
+					Peers: []wgtypes.Peer{
+						{
+							PublicKey: remoteLeaf1Key,
+							AllowedIPs: []net.IPNet{
+								autopeer.AutoAddressNet(remoteLeaf1Key),
+								leaf1AIP32,
+							},
+							Endpoint:          leaf1Endpoint,
+							LastHandshakeTime: unhealthyAgo,
+						},
+						{
+							PublicKey:         remoteLeaf2Key,
+							AllowedIPs:        []net.IPNet{autopeer.AutoAddressNet(remoteLeaf2Key)},
+							Endpoint:          leaf2Endpoint,
+							LastHandshakeTime: now,
+						},
+					},
+				},
+				startTime,
+				now,
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -496,9 +795,11 @@ func TestLinkServer_configurePeersOnce(t *testing.T) {
 					psm:        &sync.Mutex{},
 					peerStates: tt.fields.peerStates,
 				},
-				signer: &signing.Signer{PublicKey: localKey},
+				signer:      &signing.Signer{PublicKey: localKey},
+				reach:       tt.fields.reach,
+				ProbePeriod: DefaultProbePeriod,
 			}
-			s.configurePeersOnce(tt.args.newFacts, tt.args.dev, tt.args.startTime, tt.args.now)
+			s.configurePeersOnce(newFactSnapshot(storeOf(tt.args.newFacts...)), tt.args.dev, tt.args.startTime, tt.args.now)
 
 			if ctrl != nil {
 				ctrl.AssertExpectations(t)
@@ -730,6 +1031,7 @@ func TestLinkServer_configurePeer(t *testing.T) {
 		facts            []*fact.Fact
 		allowDeconfigure bool
 		allowAdd         bool
+		natted           bool
 	}
 	tests := []struct {
 		name      string
@@ -757,7 +1059,7 @@ func TestLinkServer_configurePeer(t *testing.T) {
 				peerConfig:    tt.fields.peerConfig,
 				signer:        tt.fields.signer,
 			}
-			gotState, err := s.configurePeer(tt.args.inputState, tt.args.peer, tt.args.facts, tt.args.allowDeconfigure, tt.args.allowAdd)
+			gotState, err := s.configurePeer(tt.args.inputState, tt.args.peer, tt.args.facts, tt.args.allowDeconfigure, tt.args.allowAdd, tt.args.natted, false, nil)
 			if tt.wantErr {
 				require.NotNil(t, err, "LinkServer.configurePeer() error")
 			} else {
@@ -3,11 +3,11 @@ package server
 import (
 	"sync"
 	"time"
+	"unsafe"
 
 	"github.com/google/uuid"
 
 	"github.com/fastcat/wirelink/fact"
-	"github.com/fastcat/wirelink/log"
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
@@ -29,6 +29,9 @@ type peerKnowledgeSet struct {
 	data    map[peerKnowledgeKey]time.Time
 	bootIDs map[wgtypes.Key]uuid.UUID
 	access  *sync.RWMutex
+	// acks tracks which sent facts are pending confirmation, for peers that
+	// support acknowledged delivery
+	acks *ackTracker
 }
 
 func newPKS() *peerKnowledgeSet {
@@ -36,6 +39,7 @@ func newPKS() *peerKnowledgeSet {
 		data:    make(map[peerKnowledgeKey]time.Time),
 		bootIDs: make(map[wgtypes.Key]uuid.UUID),
 		access:  new(sync.RWMutex),
+		acks:    newAckTracker(),
 	}
 }
 
@@ -64,13 +68,14 @@ func (pks *peerKnowledgeSet) upsertReceived(rf *ReceivedFact, pl peerLookup) boo
 		// note that this is intentionally different from how the alive logging elsewhere works
 		if !oldIDOk || !uvOk || oldID != uv.UUID {
 			// TODO: use peername here
-			log.Debug("Detected bootID change from %v, pruning knowledge", k.peer)
+			logger.Debug("Detected bootID change from %v, pruning knowledge", k.peer)
 			// boot id changed, prune everything we think this peer knows
 			for dk := range pks.data {
 				if dk.peer == k.peer {
 					delete(pks.data, dk)
 				}
 			}
+			pks.acks.reset(k.peer)
 		}
 		if uvOk {
 			pks.bootIDs[k.peer] = uv.UUID
@@ -84,6 +89,8 @@ func (pks *peerKnowledgeSet) upsertReceived(rf *ReceivedFact, pl peerLookup) boo
 	return false
 }
 
+// upsertSent records that we sent a fact to a peer, assuming it will arrive. For
+// peers that support acks, the assumption is checked by `sentGroup`.
 func (pks *peerKnowledgeSet) upsertSent(peer *wgtypes.Peer, f *fact.Fact) bool {
 	k := peerKnowledgeKey{
 		Key:  fact.KeyOf(f),
@@ -99,8 +106,40 @@ func (pks *peerKnowledgeSet) upsertSent(peer *wgtypes.Peer, f *fact.Fact) bool {
 	return false
 }
 
-func (pks *peerKnowledgeSet) expire() (count int) {
-	now := time.Now()
+// forgetSubject forgets what we think the peer knows about the subject, other
+// than whether it is alive, so that it will be re-sent
+func (pks *peerKnowledgeSet) forgetSubject(peer wgtypes.Key, subject fact.Subject) {
+	if pks == nil {
+		return
+	}
+	pks.access.Lock()
+	defer pks.access.Unlock()
+	for k := range pks.data {
+		if k.peer == peer && k.HasSubject(subject) && !k.IsAttribute(fact.AttributeAlive) {
+			delete(pks.data, k)
+		}
+	}
+}
+
+// ackState returns the tracker for acknowledged delivery, which is safe to
+// call on a nil set
+func (pks *peerKnowledgeSet) ackState() *ackTracker {
+	if pks == nil {
+		return nil
+	}
+	return pks.acks
+}
+
+// sentGroup records the facts in a signed group sent to a peer, so that they
+// will be re-sent if the peer doesn't ack it
+func (pks *peerKnowledgeSet) sentGroup(peer wgtypes.Key, sg *fact.Fact, facts []*fact.Fact, now time.Time) {
+	if sgv, ok := sg.Value.(*fact.SignedGroupValue); ok {
+		pks.acks.sent(peer, sgv.Nonce, facts, now)
+	}
+}
+
+func (pks *peerKnowledgeSet) expire(now time.Time) (count int) {
+	pks.acks.expire(now)
 	pks.access.Lock()
 	defer pks.access.Unlock()
 	for key, value := range pks.data {
@@ -112,6 +151,20 @@ func (pks *peerKnowledgeSet) expire() (count int) {
 	return
 }
 
+// size returns how many facts we are tracking as known by peers, and an
+// estimate of how much memory that uses
+func (pks *peerKnowledgeSet) size() (entries, bytes int) {
+	if pks == nil {
+		return 0, 0
+	}
+	pks.access.RLock()
+	defer pks.access.RUnlock()
+	for k := range pks.data {
+		bytes += k.Size() + int(unsafe.Sizeof(k.peer)+unsafe.Sizeof(time.Time{}))
+	}
+	return len(pks.data), bytes
+}
+
 // peerKnows returns that a peer knows a fact if we think it knows it (not pruned by `expire`),
 // and its expiration is no more than hysteresis behind the local fact (or later than it)
 func (pks *peerKnowledgeSet) peerKnows(peer *wgtypes.Peer, f *fact.Fact, hysteresis time.Duration) bool {
@@ -126,8 +179,9 @@ func (pks *peerKnowledgeSet) peerKnows(peer *wgtypes.Peer, f *fact.Fact, hystere
 }
 
 // peerNeeds returns that a peer needs a fact if it either doesn't know it at all,
-// or if it is going to forget it within maxTTL and the local fact will expire later
-func (pks *peerKnowledgeSet) peerNeeds(peer *wgtypes.Peer, f *fact.Fact, maxTTL time.Duration) bool {
+// or if it is going to forget it within maxTTL and the local fact will expire later,
+// or if we sent it and the peer has not acked it
+func (pks *peerKnowledgeSet) peerNeeds(peer *wgtypes.Peer, f *fact.Fact, maxTTL time.Duration, now time.Time) bool {
 	k := peerKnowledgeKey{
 		Key:  fact.KeyOf(f),
 		peer: peer.PublicKey,
@@ -135,7 +189,8 @@ func (pks *peerKnowledgeSet) peerNeeds(peer *wgtypes.Peer, f *fact.Fact, maxTTL
 	pks.access.RLock()
 	e, ok := pks.data[k]
 	pks.access.RUnlock()
-	return !ok || time.Now().Add(maxTTL).After(e) && e.Before(f.Expires)
+	return !ok || now.Add(maxTTL).After(e) && e.Before(f.Expires) ||
+		pks.acks.unconfirmed(peer.PublicKey, k.Key, now)
 }
 
 func aliveKey(peer wgtypes.Key) peerKnowledgeKey {
@@ -152,7 +207,7 @@ func aliveKey(peer wgtypes.Key) peerKnowledgeKey {
 
 // peerAlive returns whether we have received an alive fact from the peer,
 // its expiration if so, and its last known boot id if any
-func (pks *peerKnowledgeSet) peerAlive(peer wgtypes.Key) (alive bool, until time.Time, bootID *uuid.UUID) {
+func (pks *peerKnowledgeSet) peerAlive(peer wgtypes.Key, now time.Time) (alive bool, until time.Time, bootID *uuid.UUID) {
 	k := aliveKey(peer)
 	pks.access.RLock()
 	e, eok := pks.data[k]
@@ -163,7 +218,7 @@ func (pks *peerKnowledgeSet) peerAlive(peer wgtypes.Key) (alive bool, until time
 		idRet = nil
 	}
 	// a peer is alive if it has sent us a null fact that has not expired
-	return eok && time.Now().Before(e), e, idRet
+	return eok && now.Before(e), e, idRet
 }
 
 // forcePing forgets that we have sent a ping to the peer, forcing it to be re-sent
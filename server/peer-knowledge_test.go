@@ -82,7 +82,7 @@ func Test_peerKnowledgeSet_upsertReceived(t *testing.T) {
 					fact:   facts.EndpointFactFull(ep1, &k1, expires),
 					source: k1source,
 				},
-				createFromKeys(k1),
+				createFromKeys(nil, k1),
 			},
 			true,
 			fields{
@@ -105,7 +105,7 @@ func Test_peerKnowledgeSet_upsertReceived(t *testing.T) {
 					fact:   facts.EndpointFactFull(ep1, &k1, oldExpires),
 					source: k1source,
 				},
-				createFromKeys(k1),
+				createFromKeys(nil, k1),
 			},
 			false,
 			fields{
@@ -130,7 +130,7 @@ func Test_peerKnowledgeSet_upsertReceived(t *testing.T) {
 					fact:   facts.AliveFactFull(&k1, expires, uuid2),
 					source: k1source,
 				},
-				createFromKeys(k1),
+				createFromKeys(nil, k1),
 			},
 			true,
 			fields{
@@ -248,7 +248,7 @@ func Test_peerKnowledgeSet_expire(t *testing.T) {
 				data:   tt.fields.data,
 				access: &sync.RWMutex{},
 			}
-			assert.Equal(t, tt.wantCount, pks.expire())
+			assert.Equal(t, tt.wantCount, pks.expire(now))
 			assert.Equal(t, tt.wantFields.data, pks.data)
 		})
 	}
@@ -331,6 +331,7 @@ func Test_peerKnowledgeSet_peerNeeds(t *testing.T) {
 		peer   *wgtypes.Peer
 		f      *fact.Fact
 		maxTTL time.Duration
+		now    time.Time
 	}
 	tests := []struct {
 		name   string
@@ -347,7 +348,7 @@ func Test_peerKnowledgeSet_peerNeeds(t *testing.T) {
 				bootIDs: tt.fields.bootIDs,
 				access:  &sync.RWMutex{},
 			}
-			assert.Equal(t, tt.want, pks.peerNeeds(tt.args.peer, tt.args.f, tt.args.maxTTL))
+			assert.Equal(t, tt.want, pks.peerNeeds(tt.args.peer, tt.args.f, tt.args.maxTTL, tt.args.now))
 		})
 	}
 }
@@ -360,7 +361,12 @@ func Test_peerKnowledgeSet_peerAlive(t *testing.T) {
 	}
 	type args struct {
 		peer wgtypes.Key
+		now  time.Time
 	}
+	now := time.Now()
+	until := now.Add(DefaultFactTTL)
+	k1 := testutils.MustKey(t)
+	bootID := uuid.Must(uuid.NewRandom())
 	tests := []struct {
 		name       string
 		fields     fields
@@ -369,7 +375,30 @@ func Test_peerKnowledgeSet_peerAlive(t *testing.T) {
 		wantUntil  time.Time
 		wantBootID *uuid.UUID
 	}{
-		// TODO: Add test cases.
+		{
+			"unknown",
+			fields{map[peerKnowledgeKey]time.Time{}, map[wgtypes.Key]uuid.UUID{}, &sync.RWMutex{}},
+			args{k1, now},
+			false,
+			time.Time{},
+			nil,
+		},
+		{
+			"alive",
+			fields{map[peerKnowledgeKey]time.Time{aliveKey(k1): until}, map[wgtypes.Key]uuid.UUID{k1: bootID}, &sync.RWMutex{}},
+			args{k1, now},
+			true,
+			until,
+			&bootID,
+		},
+		{
+			"alive later",
+			fields{map[peerKnowledgeKey]time.Time{aliveKey(k1): until}, map[wgtypes.Key]uuid.UUID{k1: bootID}, &sync.RWMutex{}},
+			args{k1, until},
+			false,
+			until,
+			&bootID,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -378,7 +407,7 @@ func Test_peerKnowledgeSet_peerAlive(t *testing.T) {
 				bootIDs: tt.fields.bootIDs,
 				access:  tt.fields.access,
 			}
-			gotAlive, aliveUntil, gotBootID := pks.peerAlive(tt.args.peer)
+			gotAlive, aliveUntil, gotBootID := pks.peerAlive(tt.args.peer, tt.args.now)
 			assert.Equal(t, tt.wantAlive, gotAlive)
 			assert.Equal(t, tt.wantUntil, aliveUntil)
 			assert.Equal(t, tt.wantBootID, gotBootID)
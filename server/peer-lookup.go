@@ -8,35 +8,32 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-// peerLookup is a map of IPv6-LL address to peer public key
+// peerLookup is a map of auto address to peer public key
 type peerLookup map[[net.IPv6len]byte]wgtypes.Key
 
-func createFromPeers(peers ...wgtypes.Peer) peerLookup {
-	ret := make(peerLookup)
-	ret.addPeers(peers...)
-	return ret
-}
-
-func createFromKeys(peers ...wgtypes.Key) peerLookup {
-	ret := make(peerLookup)
-	ret.addKeys(peers...)
-	return ret
-}
-
-func (pl peerLookup) addPeers(peers ...wgtypes.Peer) {
-	for _, peer := range peers {
-		var k [net.IPv6len]byte
-		copy(k[:], autopeer.AutoAddress(peer.PublicKey).To16())
-		pl[k] = peer.PublicKey
+func createFromPeers(scheme *autopeer.Scheme, peers ...wgtypes.Peer) peerLookup {
+	keys := make([]wgtypes.Key, len(peers))
+	for i := range peers {
+		keys[i] = peers[i].PublicKey
 	}
+	return createFromKeys(scheme, keys...)
 }
 
-func (pl peerLookup) addKeys(peers ...wgtypes.Key) {
+// createFromKeys builds a lookup of the auto addresses of the given peers,
+// leaving out any address shared by more than one of them, as we can't tell
+// which peer it belongs to
+func createFromKeys(scheme *autopeer.Scheme, peers ...wgtypes.Key) peerLookup {
+	ret := make(peerLookup)
+	colliding := scheme.Collisions(peers...)
 	for _, peer := range peers {
+		if colliding[peer] {
+			continue
+		}
 		var k [net.IPv6len]byte
-		copy(k[:], autopeer.AutoAddress(peer).To16())
-		pl[k] = peer
+		copy(k[:], scheme.Address(peer).To16())
+		ret[k] = peer
 	}
+	return ret
 }
 
 func (pl peerLookup) get(ip net.IP) (peer wgtypes.Key, ok bool) {
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/fastcat/wirelink/autopeer"
+	"github.com/fastcat/wirelink/internal/testutils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func Test_createFromKeys(t *testing.T) {
+	v4ll, err := autopeer.ParseScheme(autopeer.SchemeIPv4LinkLocal)
+	require.NoError(t, err)
+	c1, c2 := testutils.MustCollidingKeys(t, v4ll.Address)
+	k1 := testutils.MustKey(t)
+
+	pl := createFromKeys(nil, k1, c1)
+	got, ok := pl.get(autopeer.AutoAddress(k1))
+	assert.True(t, ok)
+	assert.Equal(t, k1, got)
+	_, ok = pl.get(v4ll.Address(k1))
+	assert.False(t, ok)
+
+	pl = createFromPeers(v4ll, wgtypes.Peer{PublicKey: k1}, wgtypes.Peer{PublicKey: c1}, wgtypes.Peer{PublicKey: c2})
+	got, ok = pl.get(v4ll.Address(k1))
+	assert.True(t, ok)
+	assert.Equal(t, k1, got)
+	_, ok = pl.get(v4ll.Address(c1))
+	assert.False(t, ok, "colliding address should not map to either peer")
+}
@@ -0,0 +1,339 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/fastcat/wirelink/apply"
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/internal/clock"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// DefaultProbePeriod is how often we send echo requests to measure link quality
+const DefaultProbePeriod = 10 * time.Second
+
+// probeWindow is how many recent probes are used to compute loss
+const probeWindow = 20
+
+// probeBackoffAfter is how many probes we send to a peer that has never
+// answered one before we slow down, as it may be running an older version that
+// doesn't understand them
+const probeBackoffAfter = 3
+
+// probeBackoffFactor is how much slower we probe peers that don't answer
+const probeBackoffFactor = 10
+
+// peerProbes tracks the probe state for a single peer
+type peerProbes struct {
+	nextSeq     uint32
+	outstanding map[uint32]time.Time
+	// results has the outcomes of the most recent probes, true for answered
+	results []bool
+	// capable is set once we have seen the peer send or answer a probe
+	capable    bool
+	unanswered int
+	nextProbe  time.Time
+	lastRTT    time.Duration
+	quality    apply.LinkQuality
+}
+
+func (pp *peerProbes) record(answered bool) {
+	pp.results = append(pp.results, answered)
+	if len(pp.results) > probeWindow {
+		pp.results = pp.results[len(pp.results)-probeWindow:]
+	}
+	lost := 0
+	for _, r := range pp.results {
+		if !r {
+			lost++
+		}
+	}
+	pp.quality.Loss = float64(lost) / float64(len(pp.results))
+}
+
+// probeTracker keeps the state of echo probes for all peers.
+// It is safe to call methods on a nil probeTracker, they will do nothing.
+type probeTracker struct {
+	access sync.Mutex
+	peers  map[wgtypes.Key]*peerProbes
+}
+
+func newProbeTracker() *probeTracker {
+	return &probeTracker{
+		peers: make(map[wgtypes.Key]*peerProbes),
+	}
+}
+
+func (pt *probeTracker) get(peer wgtypes.Key) *peerProbes {
+	pp, ok := pt.peers[peer]
+	if !ok {
+		pp = &peerProbes{outstanding: make(map[uint32]time.Time)}
+		pt.peers[peer] = pp
+	}
+	return pp
+}
+
+// nextRequest returns the value to send in a probe to the given peer, if it is
+// time to send it one, and records the probe as outstanding.
+func (pt *probeTracker) nextRequest(peer wgtypes.Key, now time.Time, period time.Duration) (*fact.EchoValue, bool) {
+	if pt == nil {
+		return nil, false
+	}
+	pt.access.Lock()
+	defer pt.access.Unlock()
+	pp := pt.get(peer)
+	if now.Before(pp.nextProbe) {
+		return nil, false
+	}
+	seq := pp.nextSeq
+	pp.nextSeq++
+	pp.outstanding[seq] = now
+	if !pp.capable && pp.unanswered >= probeBackoffAfter {
+		pp.nextProbe = now.Add(period * probeBackoffFactor)
+	} else {
+		pp.nextProbe = now.Add(period)
+	}
+	return &fact.EchoValue{Sequence: seq, Sent: now}, true
+}
+
+// expire records any probes older than the timeout as lost
+func (pt *probeTracker) expire(now time.Time, timeout time.Duration) {
+	if pt == nil {
+		return
+	}
+	pt.access.Lock()
+	defer pt.access.Unlock()
+	for _, pp := range pt.peers {
+		for seq, sent := range pp.outstanding {
+			if now.Sub(sent) < timeout {
+				continue
+			}
+			delete(pp.outstanding, seq)
+			pp.unanswered++
+			pp.record(false)
+		}
+	}
+}
+
+// handleReply records the reply to a probe, returning the measured RTT if it
+// matched an outstanding probe
+func (pt *probeTracker) handleReply(peer wgtypes.Key, ev *fact.EchoValue, now time.Time) (time.Duration, bool) {
+	if pt == nil {
+		return 0, false
+	}
+	pt.access.Lock()
+	defer pt.access.Unlock()
+	pp := pt.get(peer)
+	pp.capable = true
+	sent, ok := pp.outstanding[ev.Sequence]
+	if !ok {
+		// late, duplicate, or bogus
+		return 0, false
+	}
+	delete(pp.outstanding, ev.Sequence)
+	pp.unanswered = 0
+
+	rtt := now.Sub(sent)
+	if rtt < 0 {
+		rtt = 0
+	}
+	q := &pp.quality
+	if q.Samples == 0 {
+		q.RTT = rtt
+	} else {
+		// smoothing per RFC 6298
+		q.RTT += (rtt - q.RTT) / 8
+		// jitter per RFC 3550
+		d := rtt - pp.lastRTT
+		if d < 0 {
+			d = -d
+		}
+		q.Jitter += (d - q.Jitter) / 16
+	}
+	q.Samples++
+	pp.lastRTT = rtt
+	pp.record(true)
+	return rtt, true
+}
+
+// markCapable records that a peer understands probes, because it sent us one
+func (pt *probeTracker) markCapable(peer wgtypes.Key) {
+	if pt == nil {
+		return
+	}
+	pt.access.Lock()
+	defer pt.access.Unlock()
+	pt.get(peer).capable = true
+}
+
+// quality returns the current LinkQuality for the peer, which will be empty
+// if the peer has not been shown to understand probes
+func (pt *probeTracker) quality(peer wgtypes.Key) apply.LinkQuality {
+	if pt == nil {
+		return apply.LinkQuality{}
+	}
+	pt.access.Lock()
+	defer pt.access.Unlock()
+	pp, ok := pt.peers[peer]
+	if !ok || !pp.capable {
+		return apply.LinkQuality{}
+	}
+	return pp.quality
+}
+
+// trim removes state for peers we no longer need to track
+func (pt *probeTracker) trim(keep func(wgtypes.Key) bool) {
+	if pt == nil {
+		return
+	}
+	pt.access.Lock()
+	defer pt.access.Unlock()
+	for k := range pt.peers {
+		if !keep(k) {
+			delete(pt.peers, k)
+		}
+	}
+}
+
+func (s *LinkServer) probePeers() error {
+	ticker := clock.Or(s.clock).NewTicker(s.ProbePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return nil
+		case now := <-ticker.Chan():
+			dev, err := s.deviceState()
+			if err != nil {
+				// this probably means the interface is down
+				// the log message will be printed by the main app as it exits
+				return errors.Wrap(err, "Unable to load device state, giving up")
+			}
+			s.probePeersOnce(dev, now)
+		}
+	}
+}
+
+func (s *LinkServer) probePeersOnce(dev *wgtypes.Device, now time.Time) {
+	// replies need to come back before we'd send the next probe
+	s.probes.expire(now, s.ProbePeriod/2)
+
+	present := make(map[wgtypes.Key]bool, len(dev.Peers))
+	for i := range dev.Peers {
+		p := &dev.Peers[i]
+		present[p.PublicKey] = true
+		if !s.shouldProbe(p, now) {
+			continue
+		}
+		ev, ok := s.probes.nextRequest(p.PublicKey, now, s.ProbePeriod)
+		if !ok {
+			continue
+		}
+		err := s.sendEcho(p.PublicKey, dev.PublicKey, fact.AttributeEchoRequest, ev, now)
+		if err != nil {
+			logger.Error("Unable to send probe to %s: %v", s.peerName(p.PublicKey), err)
+		}
+	}
+	s.probes.trim(func(k wgtypes.Key) bool { return present[k] })
+
+	s.probePaths(dev, now)
+	s.paths.trim(func(k wgtypes.Key) bool { return present[k] })
+}
+
+// shouldProbe checks whether a peer looks like it is connected and running
+// wirelink, so that it will answer probes
+func (s *LinkServer) shouldProbe(p *wgtypes.Peer, now time.Time) bool {
+	if p.Endpoint == nil || !apply.IsHandshakeHealthy(p.LastHandshakeTime, now) {
+		return false
+	}
+	if pcs, _ := s.peerConfig.Get(p.PublicKey); pcs.IsBasic() {
+		return false
+	}
+	// protect against tests mutating config while we read it
+	s.stateAccess.Lock()
+	defer s.stateAccess.Unlock()
+	return !s.config.Peers.IsBasic(p.PublicKey)
+}
+
+// handleEcho processes echo facts received from a peer, returning true if the
+// fact was an echo fact, which should not be processed any further
+func (s *LinkServer) handleEcho(source wgtypes.Key, f *fact.Fact, now time.Time) bool {
+	if f.Attribute != fact.AttributeEchoRequest && f.Attribute != fact.AttributeEchoReply {
+		return false
+	}
+	ev, ok := f.Value.(*fact.EchoValue)
+	if !ok {
+		logger.Error("Echo fact has wrong value type: %T", f.Value)
+		return true
+	}
+	if ps, ok := f.Subject.(*fact.PeerSubject); !ok || ps.Key != source {
+		logger.Error("Ignoring echo from %s with mismatched subject %v", s.peerName(source), f.Subject)
+		return true
+	}
+
+	if f.Attribute == fact.AttributeEchoReply {
+		if rtt, ok := s.probes.handleReply(source, ev, now); ok {
+			logger.Debug("Probe to %s: %v", s.peerName(source), rtt)
+		}
+		return true
+	}
+
+	s.probes.markCapable(source)
+	err := s.sendEcho(source, s.signer.PublicKey, fact.AttributeEchoReply, ev, now)
+	if err != nil {
+		logger.Error("Unable to reply to probe from %s: %v", s.peerName(source), err)
+	}
+	return true
+}
+
+// sendEcho sends an echo fact to a peer
+func (s *LinkServer) sendEcho(
+	peer, self wgtypes.Key,
+	attr fact.Attribute,
+	ev *fact.EchoValue,
+	now time.Time,
+) error {
+	f := &fact.Fact{
+		Attribute: attr,
+		Subject:   &fact.PeerSubject{Key: self},
+		Value:     ev,
+		Expires:   now.Add(s.ProbePeriod),
+	}
+	return s.sendStandalone(peer, f, now)
+}
+
+// signStandalone puts a single fact in its own signed group for a peer, so
+// that older peers which don't recognize it will only discard that packet
+func (s *LinkServer) signStandalone(peer wgtypes.Key, f *fact.Fact, now time.Time) ([]*fact.Fact, error) {
+	ga := fact.NewAccumulator(fact.SignedGroupMaxSafeInnerLength, now)
+	if err := ga.AddFact(f); err != nil {
+		return nil, err
+	}
+	return ga.MakeSignedGroups(s.signer, &peer)
+}
+
+// sendStandalone sends a single fact to a peer in its own signed group
+func (s *LinkServer) sendStandalone(peer wgtypes.Key, f *fact.Fact, now time.Time) error {
+	groups, err := s.signStandalone(peer, f, now)
+	if err != nil {
+		return err
+	}
+	return s.sendGroups(peer, groups, now)
+}
+
+// sendGroups sends already signed groups to a peer
+func (s *LinkServer) sendGroups(peer wgtypes.Key, groups []*fact.Fact, now time.Time) error {
+	//nolint:errcheck // don't care if this fails
+	s.conn.SetWriteDeadline(now.Add(s.ChunkPeriod))
+	p := &wgtypes.Peer{PublicKey: peer}
+	for _, g := range groups {
+		if err := s.sendFact(p, g, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
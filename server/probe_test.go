@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/apply"
+	"github.com/fastcat/wirelink/autopeer"
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/fact"
+	netmocks "github.com/fastcat/wirelink/internal/networking/mocks"
+	"github.com/fastcat/wirelink/internal/testutils"
+	factutils "github.com/fastcat/wirelink/internal/testutils/facts"
+	"github.com/fastcat/wirelink/signing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeTracker(t *testing.T) {
+	now := time.Now()
+	period := time.Second
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+
+	pt := newProbeTracker()
+
+	ev, ok := pt.nextRequest(k1, now, period)
+	require.True(t, ok)
+	assert.Equal(t, uint32(0), ev.Sequence)
+	_, ok = pt.nextRequest(k1, now.Add(period/2), period)
+	assert.False(t, ok, "should not probe again before the period")
+
+	// no data until we get a reply
+	assert.Equal(t, apply.LinkQuality{}, pt.quality(k1))
+
+	rtt, ok := pt.handleReply(k1, ev, now.Add(10*time.Millisecond))
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Millisecond, rtt)
+	assert.Equal(t, apply.LinkQuality{Samples: 1, RTT: 10 * time.Millisecond}, pt.quality(k1))
+
+	// duplicate replies are ignored
+	_, ok = pt.handleReply(k1, ev, now.Add(20*time.Millisecond))
+	assert.False(t, ok)
+
+	now = now.Add(period)
+	ev, ok = pt.nextRequest(k1, now, period)
+	require.True(t, ok)
+	assert.Equal(t, uint32(1), ev.Sequence)
+	_, ok = pt.handleReply(k1, ev, now.Add(26*time.Millisecond))
+	assert.True(t, ok)
+	q := pt.quality(k1)
+	assert.Equal(t, 2, q.Samples)
+	assert.Equal(t, 12*time.Millisecond, q.RTT)
+	assert.Equal(t, time.Millisecond, q.Jitter)
+	assert.Zero(t, q.Loss)
+
+	// a lost probe
+	now = now.Add(period)
+	_, ok = pt.nextRequest(k1, now, period)
+	require.True(t, ok)
+	pt.expire(now.Add(period/4), period/2)
+	assert.Zero(t, pt.quality(k1).Loss, "should not expire probes early")
+	pt.expire(now.Add(period/2), period/2)
+	assert.InDelta(t, 1.0/3, pt.quality(k1).Loss, 0.001)
+
+	// peers that never answer get probed less often
+	now2 := now
+	for i := 0; i < probeBackoffAfter; i++ {
+		_, ok = pt.nextRequest(k2, now2, period)
+		require.True(t, ok)
+		now2 = now2.Add(period)
+		pt.expire(now2, period/2)
+	}
+	_, ok = pt.nextRequest(k2, now2, period)
+	require.True(t, ok)
+	now2 = now2.Add(period)
+	pt.expire(now2, period/2)
+	_, ok = pt.nextRequest(k2, now2, period)
+	assert.False(t, ok, "should back off probing unresponsive peer")
+	assert.Equal(t, apply.LinkQuality{}, pt.quality(k2), "should not report quality for incapable peer")
+
+	// but not once they send us a probe
+	pt.markCapable(k2)
+	assert.Equal(t, 1.0, pt.quality(k2).Loss)
+
+	pt.trim(func(k wgtypes.Key) bool { return k == k2 })
+	assert.Equal(t, apply.LinkQuality{}, pt.quality(k1))
+	assert.NotEqual(t, apply.LinkQuality{}, pt.quality(k2))
+
+	// nil tracker is safe to use
+	var nilPT *probeTracker
+	_, ok = nilPT.nextRequest(k1, now, period)
+	assert.False(t, ok)
+	_, ok = nilPT.handleReply(k1, ev, now)
+	assert.False(t, ok)
+	nilPT.expire(now, period)
+	nilPT.markCapable(k1)
+	nilPT.trim(func(wgtypes.Key) bool { return false })
+	assert.Equal(t, apply.LinkQuality{}, nilPT.quality(k1))
+}
+
+// expectEcho sets up a mock to expect an echo fact sent to the given peer
+func expectEcho(
+	t *testing.T,
+	conn *netmocks.UDPConn,
+	now time.Time,
+	port int,
+	from, to wgtypes.Key,
+	attr fact.Attribute,
+	check func(*fact.EchoValue) bool,
+) *mock.Call {
+	dest := &net.UDPAddr{
+		IP:   autopeer.AutoAddress(to),
+		Port: port,
+	}
+	isEcho := func(packet []byte) bool {
+		f := &fact.Fact{}
+		if err := f.DecodeFrom(0, now, bytes.NewBuffer(packet)); err != nil {
+			return false
+		}
+		sgv, ok := f.Value.(*fact.SignedGroupValue)
+		if !ok {
+			return false
+		}
+		inner, err := sgv.ParseInner(now)
+		if err != nil || len(inner) != 1 {
+			return false
+		}
+		ev, ok := inner[0].Value.(*fact.EchoValue)
+		return ok &&
+			inner[0].Attribute == attr &&
+			*inner[0].Subject.(*fact.PeerSubject) == fact.PeerSubject{Key: from} &&
+			check(ev)
+	}
+	return conn.On("WriteToUDP", mock.MatchedBy(isEcho), dest).Return(1, nil)
+}
+
+func TestLinkServer_probePeersOnce(t *testing.T) {
+	now := time.Now()
+	period := time.Second
+
+	localPrivKey, localPubKey := testutils.MustKeyPair(t)
+	healthyKey := testutils.MustKey(t)
+	unhealthyKey := testutils.MustKey(t)
+	noEPKey := testutils.MustKey(t)
+	basicKey := testutils.MustKey(t)
+
+	dev := &wgtypes.Device{
+		PublicKey: localPubKey,
+		Peers: []wgtypes.Peer{
+			{PublicKey: healthyKey, Endpoint: testutils.RandUDP4Addr(t), LastHandshakeTime: now},
+			{PublicKey: unhealthyKey, Endpoint: testutils.RandUDP4Addr(t), LastHandshakeTime: now.Add(-time.Hour)},
+			{PublicKey: noEPKey, LastHandshakeTime: now},
+			{PublicKey: basicKey, Endpoint: testutils.RandUDP4Addr(t), LastHandshakeTime: now},
+		},
+	}
+
+	conn := &netmocks.UDPConn{}
+	conn.Test(t)
+	conn.On("SetWriteDeadline", mock.Anything).Return(nil)
+	expectEcho(t, conn, now, 0, localPubKey, healthyKey, fact.AttributeEchoRequest, func(ev *fact.EchoValue) bool {
+		return ev.Sequence == 0
+	}).Once()
+
+	s := &LinkServer{
+		config: &config.Server{
+			Peers: config.Peers{basicKey: &config.Peer{Basic: true}},
+		},
+		conn:        conn,
+		peerConfig:  newPeerConfigSet(),
+		signer:      signing.New(&localPrivKey),
+		probes:      newProbeTracker(),
+		stateAccess: &sync.Mutex{},
+		ChunkPeriod: period,
+		ProbePeriod: period,
+	}
+
+	s.probePeersOnce(dev, now)
+	// too soon for another probe
+	s.probePeersOnce(dev, now.Add(period/2))
+	conn.AssertExpectations(t)
+
+	// peers that go away are forgotten
+	s.probePeersOnce(&wgtypes.Device{PublicKey: localPubKey}, now.Add(period/2))
+	assert.Empty(t, s.probes.peers)
+}
+
+func TestLinkServer_handleEcho(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(DefaultFactTTL)
+
+	localPrivKey, localPubKey := testutils.MustKeyPair(t)
+	remoteKey := testutils.MustKey(t)
+	otherKey := testutils.MustKey(t)
+	ev := &fact.EchoValue{Sequence: 42, Sent: now.Add(-time.Second)}
+
+	echoFact := func(attr fact.Attribute, subject wgtypes.Key) *fact.Fact {
+		return &fact.Fact{
+			Attribute: attr,
+			Subject:   &fact.PeerSubject{Key: subject},
+			Value:     ev,
+			Expires:   expires,
+		}
+	}
+
+	tests := []struct {
+		name        string
+		f           *fact.Fact
+		want        bool
+		expectReply bool
+		wantCapable bool
+	}{
+		{"not echo", factutils.AliveFact(&remoteKey, expires), false, false, false},
+		{"request", echoFact(fact.AttributeEchoRequest, remoteKey), true, true, true},
+		{"reply", echoFact(fact.AttributeEchoReply, remoteKey), true, false, true},
+		{"spoofed request", echoFact(fact.AttributeEchoRequest, otherKey), true, false, false},
+		{"spoofed reply", echoFact(fact.AttributeEchoReply, otherKey), true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &netmocks.UDPConn{}
+			conn.Test(t)
+			if tt.expectReply {
+				conn.On("SetWriteDeadline", mock.Anything).Return(nil)
+				expectEcho(t, conn, now, 0, localPubKey, remoteKey, fact.AttributeEchoReply, func(got *fact.EchoValue) bool {
+					return got.Sequence == ev.Sequence && got.Sent.Equal(ev.Sent)
+				}).Once()
+			}
+			s := &LinkServer{
+				config:      &config.Server{},
+				conn:        conn,
+				peerConfig:  newPeerConfigSet(),
+				signer:      signing.New(&localPrivKey),
+				probes:      newProbeTracker(),
+				ChunkPeriod: time.Second,
+				ProbePeriod: time.Second,
+			}
+			assert.Equal(t, tt.want, s.handleEcho(remoteKey, tt.f, now))
+			conn.AssertExpectations(t)
+			_, capable := s.probes.peers[remoteKey]
+			assert.Equal(t, tt.wantCapable, capable && s.probes.peers[remoteKey].capable)
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fastcat/wirelink/fact"
+)
+
+// currentProvenance returns the provenance of the most recently processed fact
+// set. The returned value must not be modified.
+func (s *LinkServer) currentProvenance() fact.Provenance {
+	s.provenanceAccess.RLock()
+	defer s.provenanceAccess.RUnlock()
+	return s.provenance
+}
+
+// setProvenance replaces the current provenance. The provenance must not be
+// modified after this.
+func (s *LinkServer) setProvenance(prov fact.Provenance) {
+	s.provenanceAccess.Lock()
+	defer s.provenanceAccess.Unlock()
+	s.provenance = prov
+}
+
+// sourceName formats a fact source, using the peer name for peer sources
+func (s *LinkServer) sourceName(source fact.Source) string {
+	if source.Kind == fact.SourcePeer {
+		return s.peerName(source.Peer)
+	}
+	return source.String()
+}
+
+// factSourceNames returns the names of the sources for a fact, if known
+func (s *LinkServer) factSourceNames(f *fact.Fact) []string {
+	sources := s.currentProvenance().Sources(f)
+	if len(sources) == 0 {
+		return nil
+	}
+	ret := make([]string, 0, len(sources))
+	for _, se := range sources {
+		ret = append(ret, s.sourceName(se.Source))
+	}
+	return ret
+}
+
+// describeSources formats the sources of a fact along with how long until
+// each of them expires, or returns an empty string if none are known
+func (s *LinkServer) describeSources(f *fact.Fact, now time.Time) string {
+	sources := s.currentProvenance().Sources(f)
+	if len(sources) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(sources))
+	for _, se := range sources {
+		parts = append(parts, fmt.Sprintf("%s (%.0fs)", s.sourceName(se.Source), se.Expires.Sub(now).Seconds()))
+	}
+	return strings.Join(parts, ", ")
+}
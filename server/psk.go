@@ -0,0 +1,48 @@
+package server
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/fastcat/wirelink/apply"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// pskTrySlot is how long the end of a pair that adapts to the other's clock
+// tries each acceptable preshared key for, when it doesn't have a working
+// handshake near a rotation boundary
+const pskTrySlot = 30 * time.Second
+
+// pairPSK derives the preshared key we should be using with a peer at the
+// given time, if preshared keys are enabled.
+//
+// Near the boundary between two rotation periods, the keys for both are
+// acceptable, to allow for the clocks of the pair disagreeing. The end of the
+// pair with the greater public key always uses its own clock, and the other
+// end adapts to it: while the handshake is unhealthy, it alternates between
+// the two keys until one works, and it won't go back to the earlier key while
+// the handshake is healthy.
+func (s *LinkServer) pairPSK(peer *wgtypes.Peer, now time.Time) (psk wgtypes.Key, ok bool) {
+	if len(s.config.PSKSecret) == 0 || s.config.PSKRotation <= 0 {
+		return
+	}
+	self := s.signer.PublicKey
+	epoch := apply.PSKEpoch(now, s.config.PSKRotation)
+	first, last := apply.PSKEpochs(now, s.config.PSKRotation)
+	if first == last || bytes.Compare(self[:], peer.PublicKey[:]) > 0 {
+		return apply.PairPSK(s.config.PSKSecret, self, peer.PublicKey, epoch), true
+	}
+	if apply.IsHandshakeHealthy(peer.LastHandshakeTime, now) {
+		if later := apply.PairPSK(s.config.PSKSecret, self, peer.PublicKey, last); peer.PresharedKey == later {
+			return later, true
+		}
+		return apply.PairPSK(s.config.PSKSecret, self, peer.PublicKey, epoch), true
+	}
+	if now.UnixNano()/int64(pskTrySlot)%2 == 0 {
+		epoch = first
+	} else {
+		epoch = last
+	}
+	return apply.PairPSK(s.config.PSKSecret, self, peer.PublicKey, epoch), true
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/apply"
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/internal/testutils"
+	"github.com/fastcat/wirelink/signing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkServer_pairPSK(t *testing.T) {
+	// far from a rotation boundary
+	now := time.Unix(0, 0).Add(1000*time.Hour + 30*time.Minute)
+	secret := testutils.MustRandBytes(t, make([]byte, 32))
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+
+	disabled := &LinkServer{
+		config: &config.Server{},
+		signer: &signing.Signer{PublicKey: k1},
+	}
+	_, ok := disabled.pairPSK(&wgtypes.Peer{PublicKey: k2}, now)
+	assert.False(t, ok)
+
+	s1 := &LinkServer{
+		config: &config.Server{PSKSecret: secret, PSKRotation: time.Hour},
+		signer: &signing.Signer{PublicKey: k1},
+	}
+	s2 := &LinkServer{
+		config: &config.Server{PSKSecret: secret, PSKRotation: time.Hour},
+		signer: &signing.Signer{PublicKey: k2},
+	}
+	psk1, ok := s1.pairPSK(&wgtypes.Peer{PublicKey: k2}, now)
+	assert.True(t, ok)
+	assert.Equal(t, apply.PairPSK(secret, k1, k2, apply.PSKEpoch(now, time.Hour)), psk1)
+	// both ends of the pair agree
+	psk2, ok := s2.pairPSK(&wgtypes.Peer{PublicKey: k1}, now)
+	assert.True(t, ok)
+	assert.Equal(t, psk1, psk2)
+	// and it changes in the next rotation period
+	psk3, _ := s1.pairPSK(&wgtypes.Peer{PublicKey: k2}, now.Add(time.Hour))
+	assert.NotEqual(t, psk1, psk3)
+}
+
+func TestLinkServer_pairPSK_skew(t *testing.T) {
+	secret := testutils.MustRandBytes(t, make([]byte, 32))
+	// k1 adapts to k2
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	if bytes.Compare(k1[:], k2[:]) > 0 {
+		k1, k2 = k2, k1
+	}
+	rotation := time.Hour
+	boundary := time.Unix(0, 0).Add(1000 * rotation)
+	step := 5 * time.Second
+
+	// the clock of k2 is off by skew
+	for _, skew := range []time.Duration{-4 * time.Minute, -time.Second, time.Second, 4 * time.Minute} {
+		t.Run(skew.String(), func(t *testing.T) {
+			s1 := &LinkServer{
+				config: &config.Server{PSKSecret: secret, PSKRotation: rotation},
+				signer: &signing.Signer{PublicKey: k1},
+			}
+			s2 := &LinkServer{
+				config: &config.Server{PSKSecret: secret, PSKRotation: rotation},
+				signer: &signing.Signer{PublicKey: k2},
+			}
+			// each end's device state for the other, starting out with a working
+			// handshake with the key from before the boundary
+			start := boundary.Add(-2 * apply.PSKGrace)
+			p1 := &wgtypes.Peer{
+				PublicKey:         k2,
+				PresharedKey:      apply.PairPSK(secret, k1, k2, 999),
+				LastHandshakeTime: start,
+			}
+			p2 := &wgtypes.Peer{
+				PublicKey:         k1,
+				PresharedKey:      p1.PresharedKey,
+				LastHandshakeTime: start.Add(skew),
+			}
+			lastHandshake := start
+			for now := start; now.Before(boundary.Add(2 * apply.PSKGrace)); now = now.Add(step) {
+				p1.PresharedKey, _ = s1.pairPSK(p1, now)
+				p2.PresharedKey, _ = s2.pairPSK(p2, now.Add(skew))
+				// handshakes only work when both ends have the same key
+				if p1.PresharedKey == p2.PresharedKey {
+					lastHandshake = now
+					p1.LastHandshakeTime = now
+					p2.LastHandshakeTime = now.Add(skew)
+				}
+				require.True(t, now.Sub(lastHandshake) < apply.HandshakeValidity+pskTrySlot+step,
+					"handshakes should not fail for long, at %v", now.Sub(boundary))
+			}
+			assert.Equal(t, apply.PairPSK(secret, k1, k2, 1000), p1.PresharedKey)
+			assert.Equal(t, p1.PresharedKey, p2.PresharedKey)
+		})
+	}
+}
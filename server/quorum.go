@@ -0,0 +1,252 @@
+package server
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/trust"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// voteTracker keeps the membership votes we have received directly from
+// Membership sources, and when we next need to send ours to each peer.
+// It is safe to call methods on a nil voteTracker, they will do nothing.
+type voteTracker struct {
+	access sync.Mutex
+	// votes maps each member to the sources voting for it, and when their vote
+	// expires
+	votes    map[wgtypes.Key]map[wgtypes.Key]time.Time
+	nextSend map[wgtypes.Key]time.Time
+}
+
+func newVoteTracker() *voteTracker {
+	return &voteTracker{
+		votes:    make(map[wgtypes.Key]map[wgtypes.Key]time.Time),
+		nextSend: make(map[wgtypes.Key]time.Time),
+	}
+}
+
+// record notes a vote from a source for a member, until it expires
+func (vt *voteTracker) record(voter, member wgtypes.Key, expires time.Time) {
+	if vt == nil {
+		return
+	}
+	vt.access.Lock()
+	defer vt.access.Unlock()
+	mv, ok := vt.votes[member]
+	if !ok {
+		mv = make(map[wgtypes.Key]time.Time)
+		vt.votes[member] = mv
+	}
+	mv[voter] = expires
+}
+
+// voters returns the sources with a current vote for the member, dropping any
+// expired votes
+func (vt *voteTracker) voters(member wgtypes.Key, now time.Time) []wgtypes.Key {
+	if vt == nil {
+		return nil
+	}
+	vt.access.Lock()
+	defer vt.access.Unlock()
+	mv := vt.votes[member]
+	ret := make([]wgtypes.Key, 0, len(mv))
+	for voter, expires := range mv {
+		if expires.After(now) {
+			ret = append(ret, voter)
+		} else {
+			delete(mv, voter)
+		}
+	}
+	if len(mv) == 0 {
+		delete(vt.votes, member)
+	}
+	return ret
+}
+
+// due checks if it is time to send our votes to a peer, and if so, sets when
+// we should next send them
+func (vt *voteTracker) due(peer wgtypes.Key, now time.Time, period time.Duration) bool {
+	if vt == nil {
+		return false
+	}
+	vt.access.Lock()
+	defer vt.access.Unlock()
+	if now.Before(vt.nextSend[peer]) {
+		return false
+	}
+	vt.nextSend[peer] = now.Add(period)
+	return true
+}
+
+// trim removes the send state for peers that keep says we no longer need
+func (vt *voteTracker) trim(keep func(wgtypes.Key) bool) {
+	if vt == nil {
+		return
+	}
+	vt.access.Lock()
+	defer vt.access.Unlock()
+	for k := range vt.nextSend {
+		if !keep(k) {
+			delete(vt.nextSend, k)
+		}
+	}
+}
+
+// isMembershipSource checks if the local node is configured as a Membership
+// source, and so has a vote of its own
+func (s *LinkServer) isMembershipSource(self wgtypes.Key) bool {
+	s.stateAccess.Lock()
+	defer s.stateAccess.Unlock()
+	return s.config.Peers.Trust(self, trust.Untrusted) >= trust.Membership
+}
+
+// assertsMembership checks if we assert the membership of a peer ourselves,
+// from our own config or device, rather than just relaying membership facts
+// we received from other sources
+func assertsMembership(facts []*fact.Fact, prov fact.Provenance) bool {
+	for _, f := range facts {
+		if f.Attribute != fact.AttributeMember && f.Attribute != fact.AttributeMemberMetadata {
+			continue
+		}
+		for _, se := range prov.Sources(f) {
+			if se.Source.Kind == fact.SourceLocal || se.Source.Kind == fact.SourceConfig {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// makeVoteFacts makes the vote facts for the peers whose membership we assert
+// ourselves, if we are a Membership source
+func (s *LinkServer) makeVoteFacts(self wgtypes.Key, facts []*fact.Fact, now time.Time) []*fact.Fact {
+	if !s.isMembershipSource(self) {
+		return nil
+	}
+	prov := s.currentProvenance()
+	byPeer := make(map[wgtypes.Key][]*fact.Fact)
+	for _, f := range facts {
+		if ps, ok := f.Subject.(*fact.PeerSubject); ok && ps.Key != self {
+			byPeer[ps.Key] = append(byPeer[ps.Key], f)
+		}
+	}
+	members := make([]wgtypes.Key, 0, len(byPeer))
+	for peer, peerFacts := range byPeer {
+		if assertsMembership(peerFacts, prov) {
+			members = append(members, peer)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return bytes.Compare(members[i][:], members[j][:]) < 0
+	})
+	ret := make([]*fact.Fact, 0, len(members))
+	for _, member := range members {
+		ret = append(ret, &fact.Fact{
+			Subject:   &fact.PeerSubject{Key: self},
+			Attribute: fact.AttributeVote,
+			Value:     &fact.VoteValue{Key: member},
+			Expires:   now.Add(s.FactTTL),
+		})
+	}
+	return ret
+}
+
+// makeVoteGroups packs our votes into signed groups for a peer, leaving out
+// our vote for the peer itself
+func (s *LinkServer) makeVoteGroups(peer wgtypes.Key, votes []*fact.Fact, now time.Time) ([]*fact.Fact, error) {
+	ga := fact.NewAccumulator(fact.SignedGroupMaxSafeInnerLength, now)
+	empty := true
+	for _, v := range votes {
+		if v.Value.(*fact.VoteValue).Key == peer {
+			continue
+		}
+		if err := ga.AddFact(v); err != nil {
+			return nil, err
+		}
+		empty = false
+	}
+	if empty {
+		return nil, nil
+	}
+	return ga.MakeSignedGroups(s.signer, &peer)
+}
+
+// handleVote processes vote facts received from a peer, returning true if the
+// fact was a vote fact. Votes are only counted from the Membership source that
+// sent them, and are never stored or forwarded.
+func (s *LinkServer) handleVote(source wgtypes.Key, f *fact.Fact, now time.Time) bool {
+	if f.Attribute != fact.AttributeVote {
+		return false
+	}
+	vv, ok := f.Value.(*fact.VoteValue)
+	if !ok {
+		logger.Error("Vote fact has wrong value type: %T", f.Value)
+		return true
+	}
+	if ps, ok := f.Subject.(*fact.PeerSubject); !ok || ps.Key != source {
+		logger.Error("Ignoring vote from %s with mismatched subject %v", s.peerName(source), f.Subject)
+		return true
+	}
+	s.stateAccess.Lock()
+	level := s.config.Peers.Trust(source, trust.Untrusted)
+	s.stateAccess.Unlock()
+	if level < trust.Membership {
+		return true
+	}
+	// don't let a vote last longer than one of our own facts would
+	expires := f.Expires
+	if limit := now.Add(s.FactTTL); expires.After(limit) {
+		expires = limit
+	}
+	s.votes.record(source, vv.Key, expires)
+	return true
+}
+
+// membershipVotes counts how many of the configured Membership sources are
+// asserting that a peer is a member. Other sources only count if they have
+// sent us their vote for the peer themselves, as every node relays the
+// membership facts it has accepted, and so who sent us a membership fact
+// doesn't tell us who asserts it. Our own assertion counts as a vote from the
+// local node, if it is itself configured as a Membership source.
+func (s *LinkServer) membershipVotes(
+	self, peer wgtypes.Key,
+	facts []*fact.Fact,
+	prov fact.Provenance,
+	now time.Time,
+) int {
+	voters := make(map[wgtypes.Key]bool)
+	if assertsMembership(facts, prov) {
+		voters[self] = true
+	}
+	for _, voter := range s.votes.voters(peer, now) {
+		voters[voter] = true
+	}
+	s.stateAccess.Lock()
+	defer s.stateAccess.Unlock()
+	count := 0
+	for voter := range voters {
+		if s.config.Peers.Trust(voter, trust.Untrusted) >= trust.Membership {
+			count++
+		}
+	}
+	return count
+}
+
+// hasMembershipQuorum decides whether a peer should be a member, given its
+// vote count. New peers need a full quorum to be added, but once added, a peer
+// is only removed when a quorum of the sources no longer assert it, so that a
+// single source going offline doesn't cause peers to flap.
+func (s *LinkServer) hasMembershipQuorum(votes int, isLocal bool) bool {
+	s.stateAccess.Lock()
+	defer s.stateAccess.Unlock()
+	if !isLocal {
+		return votes >= s.config.MembershipQuorum
+	}
+	sources := s.config.Peers.CountTrustedAt(trust.Membership)
+	return votes > sources-s.config.MembershipQuorum
+}
@@ -0,0 +1,406 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/internal/testutils"
+	factutils "github.com/fastcat/wirelink/internal/testutils/facts"
+	"github.com/fastcat/wirelink/signing"
+	"github.com/fastcat/wirelink/trust"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func memberFact(key wgtypes.Key, expires time.Time) *fact.Fact {
+	return &fact.Fact{
+		Attribute: fact.AttributeMember,
+		Subject:   &fact.PeerSubject{Key: key},
+		Value:     &fact.EmptyValue{},
+		Expires:   expires,
+	}
+}
+
+func TestVoteTracker(t *testing.T) {
+	now := time.Now()
+	period := time.Second
+	voter1 := testutils.MustKey(t)
+	voter2 := testutils.MustKey(t)
+	member := testutils.MustKey(t)
+
+	var nilTracker *voteTracker
+	nilTracker.record(voter1, member, now.Add(time.Minute))
+	assert.Empty(t, nilTracker.voters(member, now))
+	assert.False(t, nilTracker.due(voter1, now, period))
+	nilTracker.trim(func(wgtypes.Key) bool { return false })
+
+	vt := newVoteTracker()
+	assert.Empty(t, vt.voters(member, now))
+	vt.record(voter1, member, now.Add(time.Minute))
+	vt.record(voter2, member, now.Add(time.Second))
+	assert.ElementsMatch(t, []wgtypes.Key{voter1, voter2}, vt.voters(member, now))
+	assert.Empty(t, vt.voters(voter1, now), "votes are per member")
+	assert.Equal(t, []wgtypes.Key{voter1}, vt.voters(member, now.Add(time.Second)))
+	// renewing a vote extends it
+	vt.record(voter1, member, now.Add(2*time.Minute))
+	assert.Equal(t, []wgtypes.Key{voter1}, vt.voters(member, now.Add(90*time.Second)))
+	assert.Empty(t, vt.voters(member, now.Add(2*time.Minute)))
+	assert.Empty(t, vt.votes, "expired votes should be dropped")
+
+	assert.True(t, vt.due(voter1, now, period))
+	assert.False(t, vt.due(voter1, now.Add(period/2), period))
+	assert.True(t, vt.due(voter2, now, period))
+	assert.True(t, vt.due(voter1, now.Add(period), period))
+	vt.trim(func(k wgtypes.Key) bool { return k == voter2 })
+	assert.True(t, vt.due(voter1, now.Add(period*3/2), period), "trimmed peers are due again")
+	assert.False(t, vt.due(voter2, now.Add(period/2), period))
+}
+
+func TestLinkServer_makeVoteFacts(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(time.Minute)
+	localPrivKey, self := testutils.MustKeyPair(t)
+	configured := testutils.MustKey(t)
+	local := testutils.MustKey(t)
+	relayed := testutils.MustKey(t)
+
+	configuredFact := memberFact(configured, expires)
+	localFact := memberFact(local, expires)
+	relayedFact := memberFact(relayed, expires)
+	endpointFact := factutils.EndpointFactFull(testutils.RandUDP4Addr(t), &relayed, expires)
+	selfFact := memberFact(self, expires)
+	facts := []*fact.Fact{configuredFact, localFact, relayedFact, endpointFact, selfFact}
+	prov := fact.Provenance{}
+	prov.Add(configuredFact, fact.ConfigSource)
+	prov.Add(localFact, fact.LocalSource)
+	prov.Add(relayedFact, fact.PeerSource(configured))
+	prov.Add(endpointFact, fact.LocalSource)
+	prov.Add(selfFact, fact.ConfigSource)
+
+	membership := &config.Peer{Trust: trust.Ptr(trust.Membership)}
+	s := &LinkServer{
+		config:      &config.Server{Peers: config.Peers{}},
+		stateAccess: &sync.Mutex{},
+		signer:      signing.New(&localPrivKey),
+		provenance:  prov,
+		FactTTL:     DefaultFactTTL,
+	}
+	assert.Empty(t, s.makeVoteFacts(self, facts, now), "should not vote if not a Membership source")
+
+	s.config.Peers[self] = membership
+	votes := s.makeVoteFacts(self, facts, now)
+	want := map[wgtypes.Key]bool{configured: true, local: true}
+	require.Len(t, votes, len(want))
+	for _, v := range votes {
+		assert.Equal(t, fact.AttributeVote, v.Attribute)
+		assert.Equal(t, &fact.PeerSubject{Key: self}, v.Subject)
+		assert.Equal(t, now.Add(DefaultFactTTL), v.Expires)
+		assert.True(t, want[v.Value.(*fact.VoteValue).Key], "unexpected vote %v", v.Value)
+	}
+
+	groups, err := s.makeVoteGroups(configured, votes, now)
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+	inner, err := groups[0].Value.(*fact.SignedGroupValue).ParseInner(now)
+	require.NoError(t, err)
+	require.Len(t, inner, 1, "should not send a peer the vote for itself")
+	assert.Equal(t, &fact.VoteValue{Key: local}, inner[0].Value)
+
+	groups, err = s.makeVoteGroups(local, votes[:0], now)
+	assert.NoError(t, err)
+	assert.Empty(t, groups)
+}
+
+func TestLinkServer_handleVote(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(DefaultFactTTL)
+	source := testutils.MustKey(t)
+	untrusted := testutils.MustKey(t)
+	member := testutils.MustKey(t)
+
+	voteFact := func(subject wgtypes.Key, expires time.Time) *fact.Fact {
+		return &fact.Fact{
+			Attribute: fact.AttributeVote,
+			Subject:   &fact.PeerSubject{Key: subject},
+			Value:     &fact.VoteValue{Key: member},
+			Expires:   expires,
+		}
+	}
+
+	tests := []struct {
+		name        string
+		source      wgtypes.Key
+		f           *fact.Fact
+		want        bool
+		wantVoters  []wgtypes.Key
+		wantExpires time.Time
+	}{
+		{"not vote", source, factutils.AliveFact(&source, expires), false, nil, time.Time{}},
+		{"vote", source, voteFact(source, expires), true, []wgtypes.Key{source}, expires},
+		{"spoofed vote", untrusted, voteFact(source, expires), true, nil, time.Time{}},
+		{"untrusted vote", untrusted, voteFact(untrusted, expires), true, nil, time.Time{}},
+		{"long vote", source, voteFact(source, now.Add(time.Hour)), true, []wgtypes.Key{source}, expires},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &LinkServer{
+				config: &config.Server{Peers: config.Peers{
+					source: &config.Peer{Trust: trust.Ptr(trust.Membership)},
+				}},
+				stateAccess: &sync.Mutex{},
+				votes:       newVoteTracker(),
+				FactTTL:     DefaultFactTTL,
+			}
+			assert.Equal(t, tt.want, s.handleVote(tt.source, tt.f, now))
+			assert.ElementsMatch(t, tt.wantVoters, s.votes.voters(member, now))
+			if len(tt.wantVoters) != 0 {
+				assert.Equal(t, tt.wantExpires, s.votes.votes[member][source])
+			}
+		})
+	}
+}
+
+func TestLinkServer_membershipVotes(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(time.Minute)
+	self := testutils.MustKey(t)
+	r1 := testutils.MustKey(t)
+	r2 := testutils.MustKey(t)
+	other := testutils.MustKey(t)
+	peer := testutils.MustKey(t)
+
+	member := memberFact(peer, expires)
+	metadata := &fact.Fact{
+		Attribute: fact.AttributeMemberMetadata,
+		Subject:   &fact.PeerSubject{Key: peer},
+		Value:     fact.BuildMemberMetadata("bob", false, false),
+		Expires:   expires,
+	}
+	endpoint := &fact.Fact{
+		Attribute: fact.AttributeEndpointV4,
+		Subject:   &fact.PeerSubject{Key: peer},
+		Value:     &fact.IPPortValue{IP: testutils.RandUDP4Addr(t).IP, Port: 1},
+		Expires:   expires,
+	}
+
+	membership := &config.Peer{Trust: trust.Ptr(trust.Membership)}
+	peers := config.Peers{self: membership, r1: membership, r2: membership}
+
+	tests := []struct {
+		name    string
+		peers   config.Peers
+		facts   []*fact.Fact
+		sources map[*fact.Fact][]fact.Source
+		votes   map[wgtypes.Key]time.Time
+		want    int
+	}{
+		{
+			"no facts",
+			peers,
+			nil,
+			nil,
+			nil,
+			0,
+		},
+		{
+			"self and direct votes",
+			peers,
+			[]*fact.Fact{member, metadata, endpoint},
+			map[*fact.Fact][]fact.Source{
+				member:   {fact.PeerSource(r1), fact.LocalSource},
+				metadata: {fact.PeerSource(r1), fact.PeerSource(r2)},
+				endpoint: {fact.PeerSource(other)},
+			},
+			map[wgtypes.Key]time.Time{r1: expires, r2: expires},
+			3,
+		},
+		{
+			"relayed facts don't vote",
+			peers,
+			[]*fact.Fact{member, metadata},
+			map[*fact.Fact][]fact.Source{
+				member:   {fact.PeerSource(r1), fact.PeerSource(r2)},
+				metadata: {fact.PeerSource(r2)},
+			},
+			map[wgtypes.Key]time.Time{r1: expires},
+			1,
+		},
+		{
+			"untrusted sources don't vote",
+			peers,
+			[]*fact.Fact{member},
+			map[*fact.Fact][]fact.Source{
+				member: {fact.PeerSource(other)},
+			},
+			map[wgtypes.Key]time.Time{other: expires},
+			0,
+		},
+		{
+			"expired votes don't count",
+			peers,
+			[]*fact.Fact{member},
+			map[*fact.Fact][]fact.Source{
+				member: {fact.PeerSource(r1)},
+			},
+			map[wgtypes.Key]time.Time{r1: now},
+			0,
+		},
+		{
+			"config votes for self",
+			peers,
+			[]*fact.Fact{member},
+			map[*fact.Fact][]fact.Source{
+				member: {fact.ConfigSource},
+			},
+			nil,
+			1,
+		},
+		{
+			"local only votes if self is a source",
+			config.Peers{r1: membership},
+			[]*fact.Fact{member},
+			map[*fact.Fact][]fact.Source{
+				member: {fact.LocalSource},
+			},
+			nil,
+			0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prov := fact.Provenance{}
+			for f, sources := range tt.sources {
+				for _, source := range sources {
+					prov.Add(f, source)
+				}
+			}
+			s := &LinkServer{
+				stateAccess: &sync.Mutex{},
+				config:      &config.Server{Peers: tt.peers},
+				votes:       newVoteTracker(),
+			}
+			for voter, voteExpires := range tt.votes {
+				s.votes.record(voter, peer, voteExpires)
+			}
+			assert.Equal(t, tt.want, s.membershipVotes(self, peer, tt.facts, prov, now))
+		})
+	}
+}
+
+func TestLinkServer_hasMembershipQuorum(t *testing.T) {
+	membership := &config.Peer{Trust: trust.Ptr(trust.Membership)}
+	s := &LinkServer{stateAccess: &sync.Mutex{}, config: &config.Server{
+		MembershipQuorum: 2,
+		Peers: config.Peers{
+			testutils.MustKey(t): membership,
+			testutils.MustKey(t): membership,
+			testutils.MustKey(t): membership,
+		},
+	}}
+
+	tests := []struct {
+		votes   int
+		isLocal bool
+		want    bool
+	}{
+		{0, false, false},
+		{1, false, false},
+		{2, false, true},
+		{3, false, true},
+		{0, true, false},
+		{1, true, false},
+		{2, true, true},
+		{3, true, true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, s.hasMembershipQuorum(tt.votes, tt.isLocal), "votes=%d local=%v", tt.votes, tt.isLocal)
+	}
+}
+
+func TestLinkServer_collectPeerFlags_quorum(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(time.Minute)
+	self := testutils.MustKey(t)
+	r1 := testutils.MustKey(t)
+	r2 := testutils.MustKey(t)
+	r3 := testutils.MustKey(t)
+	newAgreed := testutils.MustKey(t)
+	newSingle := testutils.MustKey(t)
+	localKept := testutils.MustKey(t)
+	localLost := testutils.MustKey(t)
+
+	membership := &config.Peer{Trust: trust.Ptr(trust.Membership)}
+	conf := buildConfig("wg0").
+		withPeer(r1, membership).
+		withPeer(r2, membership).
+		withPeer(r3, membership).
+		Build()
+	conf.MembershipQuorum = 2
+
+	votes := map[wgtypes.Key][]wgtypes.Key{
+		newAgreed: {r1, r2},
+		newSingle: {r1},
+		localKept: {r3, r2},
+		localLost: {r1},
+	}
+	prov := fact.Provenance{}
+	factsByPeer := make(map[wgtypes.Key][]*fact.Fact)
+	s := &LinkServer{
+		config:        conf,
+		stateAccess:   &sync.Mutex{},
+		peerConfig:    newPeerConfigSet(),
+		peerKnowledge: newPKS(),
+		votes:         newVoteTracker(),
+	}
+	for peer, voters := range votes {
+		f := memberFact(peer, expires)
+		for _, voter := range voters {
+			s.votes.record(voter, peer, expires)
+		}
+		// every source relays the membership facts it has, but that doesn't count
+		// as a vote
+		prov.Add(f, fact.PeerSource(r1))
+		prov.Add(f, fact.PeerSource(r2))
+		prov.Add(f, fact.PeerSource(r3))
+		factsByPeer[peer] = []*fact.Fact{f}
+	}
+	s.provenance = prov
+	dev := &wgtypes.Device{
+		PublicKey: self,
+		Peers: []wgtypes.Peer{
+			{PublicKey: r1},
+			{PublicKey: localKept},
+			{PublicKey: localLost},
+		},
+	}
+
+	_, removePeer, validPeers := s.collectPeerFlags(now, dev, factsByPeer)
+
+	assert.True(t, validPeers[newAgreed])
+	assert.True(t, validPeers[localKept])
+	// one source asserting a peer isn't enough, even if the others relay it
+	assert.False(t, validPeers[newSingle])
+	assert.True(t, removePeer[newSingle])
+	assert.False(t, validPeers[localLost])
+	assert.True(t, removePeer[localLost])
+	assert.Equal(t, map[wgtypes.Key]int{newAgreed: 2, newSingle: 1, localKept: 2, localLost: 1}, s.memberVotes)
+	status := s.formatFacts(now, nil)
+	assert.Contains(t, status, fmt.Sprintf("\nPeer %s is ", localKept))
+	assert.Contains(t, status, ", 2/2 membership votes")
+	assert.Contains(t, status, ", 1/2 membership votes")
+
+	// without a quorum, any one source is enough
+	s.config.MembershipQuorum = 0
+	_, removePeer, validPeers = s.collectPeerFlags(now, dev, factsByPeer)
+	assert.True(t, validPeers[newSingle])
+	assert.True(t, validPeers[localLost])
+	assert.Empty(t, removePeer)
+	assert.Nil(t, s.memberVotes)
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fastcat/wirelink/apply"
+	"github.com/fastcat/wirelink/fact"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// reachReportPeriods is how many probe periods a relay's report of its link to
+// a target is good for
+const reachReportPeriods = 3
+
+type reachPair struct {
+	relay, target wgtypes.Key
+}
+
+type reachReport struct {
+	quality apply.LinkQuality
+	expires time.Time
+}
+
+// reachTracker keeps what candidate relays have told us about their links to
+// peers we can't reach directly, and when we last asked them.
+// It is safe to call methods on a nil reachTracker, they will do nothing.
+type reachTracker struct {
+	access  sync.Mutex
+	asked   map[reachPair]time.Time
+	reports map[reachPair]reachReport
+}
+
+func newReachTracker() *reachTracker {
+	return &reachTracker{
+		asked:   make(map[reachPair]time.Time),
+		reports: make(map[reachPair]reachReport),
+	}
+}
+
+// shouldAsk checks if it is time to ask the relay about the target again, and
+// if so records that we are doing so
+func (rt *reachTracker) shouldAsk(relay, target wgtypes.Key, now time.Time, period time.Duration) bool {
+	if rt == nil {
+		return false
+	}
+	rt.access.Lock()
+	defer rt.access.Unlock()
+	k := reachPair{relay, target}
+	if last, ok := rt.asked[k]; ok && now.Sub(last) < period {
+		return false
+	}
+	rt.asked[k] = now
+	return true
+}
+
+// record stores a report from a relay, if we asked it about the target
+func (rt *reachTracker) record(relay, target wgtypes.Key, lq apply.LinkQuality, expires time.Time) bool {
+	if rt == nil {
+		return false
+	}
+	rt.access.Lock()
+	defer rt.access.Unlock()
+	k := reachPair{relay, target}
+	if _, ok := rt.asked[k]; !ok {
+		return false
+	}
+	rt.reports[k] = reachReport{lq, expires}
+	return true
+}
+
+// get returns the last report from the relay about the target, if it has not
+// expired
+func (rt *reachTracker) get(relay, target wgtypes.Key, now time.Time) (apply.LinkQuality, bool) {
+	if rt == nil {
+		return apply.LinkQuality{}, false
+	}
+	rt.access.Lock()
+	defer rt.access.Unlock()
+	r, ok := rt.reports[reachPair{relay, target}]
+	if !ok || !now.Before(r.expires) {
+		return apply.LinkQuality{}, false
+	}
+	return r.quality, true
+}
+
+// trim removes state for relay/target pairs we no longer need to track
+func (rt *reachTracker) trim(keep func(relay, target wgtypes.Key) bool) {
+	if rt == nil {
+		return
+	}
+	rt.access.Lock()
+	defer rt.access.Unlock()
+	for k := range rt.asked {
+		if !keep(k.relay, k.target) {
+			delete(rt.asked, k)
+		}
+	}
+	for k := range rt.reports {
+		if !keep(k.relay, k.target) {
+			delete(rt.reports, k)
+		}
+	}
+}
+
+// askReach sends reach requests to each candidate relay about each target
+// that needs one, at most once per probe period, and forgets about any others
+func (s *LinkServer) askReach(relays, targets []*wgtypes.Peer, now time.Time) {
+	wanted := make(map[reachPair]bool, len(relays)*len(targets))
+	for _, r := range relays {
+		for _, t := range targets {
+			if r.PublicKey == t.PublicKey {
+				continue
+			}
+			wanted[reachPair{r.PublicKey, t.PublicKey}] = true
+			if !s.reach.shouldAsk(r.PublicKey, t.PublicKey, now, s.ProbePeriod) {
+				continue
+			}
+			err := s.sendReach(r.PublicKey, fact.AttributeReachRequest, &fact.ReachValue{Target: t.PublicKey}, now)
+			if err != nil {
+				logger.Error("Unable to ask %s about %s: %v", s.peerName(r.PublicKey), s.peerName(t.PublicKey), err)
+			}
+		}
+	}
+	s.reach.trim(func(relay, target wgtypes.Key) bool { return wanted[reachPair{relay, target}] })
+}
+
+// handleReach processes reach facts received from a peer, returning true if
+// the fact was a reach fact, which should not be processed any further
+func (s *LinkServer) handleReach(source wgtypes.Key, f *fact.Fact, now time.Time) bool {
+	if f.Attribute != fact.AttributeReachRequest && f.Attribute != fact.AttributeReachReply {
+		return false
+	}
+	rv, ok := f.Value.(*fact.ReachValue)
+	if !ok {
+		logger.Error("Reach fact has wrong value type: %T", f.Value)
+		return true
+	}
+	if ps, ok := f.Subject.(*fact.PeerSubject); !ok || ps.Key != source {
+		logger.Error("Ignoring reach from %s with mismatched subject %v", s.peerName(source), f.Subject)
+		return true
+	}
+
+	if f.Attribute == fact.AttributeReachReply {
+		lq := apply.LinkQuality{RTT: rv.RTT, Loss: rv.Loss}
+		if rv.Measured {
+			lq.Samples = 1
+		}
+		// don't let the relay make its report last longer than we would ask for
+		expires := f.Expires
+		if limit := now.Add(reachReportPeriods * s.ProbePeriod); expires.After(limit) {
+			expires = limit
+		}
+		if s.reach.record(source, rv.Target, lq, expires) {
+			logger.Debug("Relay %s reaches %s: %v", s.peerName(source), s.peerName(rv.Target), lq)
+		}
+		return true
+	}
+
+	// only answer if we can actually carry traffic to the target
+	if rv.Target == source || rv.Target == s.signer.PublicKey {
+		return true
+	}
+	if state, _ := s.peerConfig.Get(rv.Target); !state.IsHealthy() {
+		return true
+	}
+	lq := s.probes.quality(rv.Target)
+	reply := &fact.ReachValue{
+		Target:   rv.Target,
+		Measured: lq.IsMeasured(),
+		RTT:      lq.RTT,
+		Loss:     lq.Loss,
+	}
+	if err := s.sendReach(source, fact.AttributeReachReply, reply, now); err != nil {
+		logger.Error("Unable to reply to reach request from %s: %v", s.peerName(source), err)
+	}
+	return true
+}
+
+// sendReach sends a reach fact to a peer
+func (s *LinkServer) sendReach(peer wgtypes.Key, attr fact.Attribute, rv *fact.ReachValue, now time.Time) error {
+	f := &fact.Fact{
+		Attribute: attr,
+		Subject:   &fact.PeerSubject{Key: s.signer.PublicKey},
+		Value:     rv,
+		Expires:   now.Add(reachReportPeriods * s.ProbePeriod),
+	}
+	return s.sendStandalone(peer, f, now)
+}
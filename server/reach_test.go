@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/apply"
+	"github.com/fastcat/wirelink/autopeer"
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/fact"
+	netmocks "github.com/fastcat/wirelink/internal/networking/mocks"
+	"github.com/fastcat/wirelink/internal/testutils"
+	factutils "github.com/fastcat/wirelink/internal/testutils/facts"
+	"github.com/fastcat/wirelink/signing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// mockReport updates the reachTracker as if we had asked the relay about the
+// target and it had replied
+func (rt *reachTracker) mockReport(relay, target wgtypes.Key, lq apply.LinkQuality, now, expires time.Time) *reachTracker {
+	rt.asked[reachPair{relay, target}] = now
+	rt.reports[reachPair{relay, target}] = reachReport{lq, expires}
+	return rt
+}
+
+func TestReachTracker(t *testing.T) {
+	now := time.Now()
+	period := time.Second
+	relay := testutils.MustKey(t)
+	target := testutils.MustKey(t)
+	other := testutils.MustKey(t)
+	lq := apply.LinkQuality{Samples: 1, RTT: time.Millisecond}
+
+	rt := newReachTracker()
+
+	assert.False(t, rt.record(relay, target, lq, now.Add(period)), "should ignore unrequested reports")
+	_, ok := rt.get(relay, target, now)
+	assert.False(t, ok)
+
+	assert.True(t, rt.shouldAsk(relay, target, now, period))
+	assert.False(t, rt.shouldAsk(relay, target, now.Add(period/2), period))
+	assert.True(t, rt.shouldAsk(relay, other, now, period))
+
+	assert.True(t, rt.record(relay, target, lq, now.Add(period)))
+	got, ok := rt.get(relay, target, now)
+	assert.True(t, ok)
+	assert.Equal(t, lq, got)
+	_, ok = rt.get(relay, target, now.Add(period))
+	assert.False(t, ok, "reports should expire")
+
+	assert.True(t, rt.shouldAsk(relay, target, now.Add(period), period))
+
+	rt.trim(func(_, t wgtypes.Key) bool { return t == other })
+	assert.NotContains(t, rt.asked, reachPair{relay, target})
+	assert.NotContains(t, rt.reports, reachPair{relay, target})
+	assert.Contains(t, rt.asked, reachPair{relay, other})
+
+	var nilRT *reachTracker
+	assert.False(t, nilRT.shouldAsk(relay, target, now, period))
+	assert.False(t, nilRT.record(relay, target, lq, now))
+	_, ok = nilRT.get(relay, target, now)
+	assert.False(t, ok)
+	nilRT.trim(func(_, _ wgtypes.Key) bool { return false })
+}
+
+func expectReach(
+	t *testing.T,
+	conn *netmocks.UDPConn,
+	now time.Time,
+	from, to wgtypes.Key,
+	attr fact.Attribute,
+	check func(*fact.ReachValue) bool,
+) *mock.Call {
+	dest := &net.UDPAddr{IP: autopeer.AutoAddress(to)}
+	isReach := func(packet []byte) bool {
+		f := &fact.Fact{}
+		if err := f.DecodeFrom(0, now, bytes.NewBuffer(packet)); err != nil {
+			return false
+		}
+		sgv, ok := f.Value.(*fact.SignedGroupValue)
+		if !ok {
+			return false
+		}
+		inner, err := sgv.ParseInner(now)
+		if err != nil || len(inner) != 1 {
+			return false
+		}
+		rv, ok := inner[0].Value.(*fact.ReachValue)
+		return ok &&
+			inner[0].Attribute == attr &&
+			*inner[0].Subject.(*fact.PeerSubject) == fact.PeerSubject{Key: from} &&
+			check(rv)
+	}
+	return conn.On("WriteToUDP", mock.MatchedBy(isReach), dest).Return(1, nil)
+}
+
+func TestLinkServer_handleReach(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(DefaultFactTTL)
+
+	localPrivKey, localPubKey := testutils.MustKeyPair(t)
+	remoteKey := testutils.MustKey(t)
+	healthyKey := testutils.MustKey(t)
+	unhealthyKey := testutils.MustKey(t)
+	lq := apply.LinkQuality{Samples: 5, RTT: 20 * time.Millisecond, Loss: 0.25}
+
+	healthy := (&apply.PeerConfigState{}).Update(
+		&wgtypes.Peer{PublicKey: healthyKey, Endpoint: testutils.RandUDP4Addr(t), LastHandshakeTime: now},
+		"", true, expires, nil, now, nil,
+	)
+
+	reachFact := func(attr fact.Attribute, subject wgtypes.Key, rv *fact.ReachValue) *fact.Fact {
+		return &fact.Fact{
+			Attribute: attr,
+			Subject:   &fact.PeerSubject{Key: subject},
+			Value:     rv,
+			Expires:   expires,
+		}
+	}
+
+	tests := []struct {
+		name        string
+		f           *fact.Fact
+		asked       bool
+		want        bool
+		expectReply func(*fact.ReachValue) bool
+		wantReport  bool
+	}{
+		{"not reach", factutils.AliveFact(&remoteKey, expires), false, false, nil, false},
+		{
+			"request for healthy peer",
+			reachFact(fact.AttributeReachRequest, remoteKey, &fact.ReachValue{Target: healthyKey}),
+			false, true,
+			func(rv *fact.ReachValue) bool {
+				return rv.Target == healthyKey && rv.Measured && rv.RTT == lq.RTT && rv.Loss == lq.Loss
+			},
+			false,
+		},
+		{
+			"request for unhealthy peer",
+			reachFact(fact.AttributeReachRequest, remoteKey, &fact.ReachValue{Target: unhealthyKey}),
+			false, true, nil, false,
+		},
+		{
+			"spoofed request",
+			reachFact(fact.AttributeReachRequest, healthyKey, &fact.ReachValue{Target: healthyKey}),
+			false, true, nil, false,
+		},
+		{
+			"reply",
+			reachFact(fact.AttributeReachReply, remoteKey, &fact.ReachValue{Target: healthyKey, Measured: true, RTT: lq.RTT}),
+			true, true, nil, true,
+		},
+		{
+			"unrequested reply",
+			reachFact(fact.AttributeReachReply, remoteKey, &fact.ReachValue{Target: healthyKey, Measured: true, RTT: lq.RTT}),
+			false, true, nil, false,
+		},
+		{
+			"spoofed reply",
+			reachFact(fact.AttributeReachReply, healthyKey, &fact.ReachValue{Target: healthyKey, Measured: true, RTT: lq.RTT}),
+			true, true, nil, false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &netmocks.UDPConn{}
+			conn.Test(t)
+			if tt.expectReply != nil {
+				conn.On("SetWriteDeadline", mock.Anything).Return(nil)
+				expectReach(t, conn, now, localPubKey, remoteKey, fact.AttributeReachReply, tt.expectReply).Once()
+			}
+			s := &LinkServer{
+				config:      &config.Server{},
+				conn:        conn,
+				peerConfig:  newPeerConfigSet(),
+				signer:      signing.New(&localPrivKey),
+				probes:      newProbeTracker(),
+				reach:       newReachTracker(),
+				ChunkPeriod: time.Second,
+				ProbePeriod: time.Second,
+			}
+			s.peerConfig.Set(healthyKey, healthy)
+			s.probes.get(healthyKey).capable = true
+			s.probes.get(healthyKey).quality = lq
+			if tt.asked {
+				s.reach.shouldAsk(remoteKey, healthyKey, now, s.ProbePeriod)
+			}
+
+			assert.Equal(t, tt.want, s.handleReach(remoteKey, tt.f, now))
+			conn.AssertExpectations(t)
+
+			got, ok := s.reach.get(remoteKey, healthyKey, now)
+			assert.Equal(t, tt.wantReport, ok)
+			if tt.wantReport {
+				assert.Equal(t, apply.LinkQuality{Samples: 1, RTT: lq.RTT}, got)
+				// the report should be capped to our own expiration
+				_, ok = s.reach.get(remoteKey, healthyKey, now.Add(reachReportPeriods*s.ProbePeriod))
+				assert.False(t, ok)
+			}
+		})
+	}
+}
+
+func TestLinkServer_askReach(t *testing.T) {
+	now := time.Now()
+
+	localPrivKey, localPubKey := testutils.MustKeyPair(t)
+	relayKey := testutils.MustKey(t)
+	targetKey := testutils.MustKey(t)
+	staleKey := testutils.MustKey(t)
+
+	conn := &netmocks.UDPConn{}
+	conn.Test(t)
+	conn.On("SetWriteDeadline", mock.Anything).Return(nil)
+	expectReach(t, conn, now, localPubKey, relayKey, fact.AttributeReachRequest, func(rv *fact.ReachValue) bool {
+		return rv.Target == targetKey
+	}).Once()
+
+	s := &LinkServer{
+		config:      &config.Server{},
+		conn:        conn,
+		signer:      signing.New(&localPrivKey),
+		reach:       newReachTracker(),
+		ChunkPeriod: time.Second,
+		ProbePeriod: time.Second,
+	}
+	s.reach.mockReport(relayKey, staleKey, apply.LinkQuality{}, now, now.Add(time.Second))
+
+	relays := []*wgtypes.Peer{{PublicKey: relayKey}}
+	targets := []*wgtypes.Peer{{PublicKey: targetKey}, {PublicKey: relayKey}}
+	s.askReach(relays, targets, now)
+	// shouldn't ask again until the next period
+	s.askReach(relays, targets, now.Add(s.ProbePeriod/2))
+	conn.AssertExpectations(t)
+
+	assert.NotContains(t, s.reach.asked, reachPair{relayKey, staleKey})
+	assert.NotContains(t, s.reach.reports, reachPair{relayKey, staleKey})
+}
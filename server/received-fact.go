@@ -13,6 +13,9 @@ import (
 type ReceivedFact struct {
 	fact   *fact.Fact
 	source net.UDPAddr
+	// hops is how many times the fact was gossiped before it reached us, or
+	// zero if it came directly from its source
+	hops uint8
 }
 
 func (rf *ReceivedFact) String() string {
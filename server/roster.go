@@ -0,0 +1,153 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/roster"
+	"github.com/fastcat/wirelink/util"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// rosterFacts wraps the locally configured roster pages as facts to send to
+// peers
+func (s *LinkServer) rosterFacts(expires time.Time) []*fact.Fact {
+	ret := make([]*fact.Fact, 0, len(s.config.Roster))
+	for _, p := range s.config.Roster {
+		f, err := p.Fact(s.config.RosterKey, expires)
+		if err != nil {
+			logger.Error("Unable to make roster fact: %v", err)
+			continue
+		}
+		ret = append(ret, f)
+	}
+	return ret
+}
+
+// acceptRosterFact checks whether a received roster fact is a valid page
+// signed by the configured root key, which is neither past its signed
+// expiration nor older than the newest roster we have used. Roster facts don't
+// depend on who sent them, so any peer may relay them.
+func (s *LinkServer) acceptRosterFact(f *fact.Fact, now time.Time) bool {
+	if s.config.RosterKey == nil {
+		return false
+	}
+	p, err := roster.FromFact(f, s.config.RosterKey)
+	if err != nil {
+		logger.Error("Rejecting roster page: %v", err)
+		return false
+	}
+	return s.usableRosterPage(p, now)
+}
+
+// usableRosterPage checks that a verified roster page is neither past its
+// signed expiration nor older than the newest roster we have used. As anyone
+// can keep a copy of an old roster, and the fact expiration is not signed,
+// these are what stop an old roster from being replayed.
+func (s *LinkServer) usableRosterPage(p *roster.Page, now time.Time) bool {
+	if p.Expired(now) {
+		logger.Debug("Ignoring roster page %d/%d of serial %d: expired at %v", p.Index+1, p.Count, p.Serial, p.NotAfter)
+		return false
+	}
+	if s.rosterSerials != nil {
+		if highest := s.rosterSerials.Highest(); p.Serial < highest {
+			logger.Debug("Ignoring roster page %d/%d of serial %d: older than %d", p.Index+1, p.Count, p.Serial, highest)
+			return false
+		}
+	}
+	return true
+}
+
+// applyRoster removes the roster facts, which must be all of those in the
+// grouped facts, and replaces them with Membership and AllowedIPs facts for the
+// members of the newest complete roster, which expire along with the roster
+// pages. Once a roster is used, older ones are not. The given groups are not
+// modified.
+func (s *LinkServer) applyRoster(
+	factsByPeer map[wgtypes.Key][]*fact.Fact,
+	rosterFacts []*fact.Fact,
+	now time.Time,
+) map[wgtypes.Key][]*fact.Fact {
+	if len(rosterFacts) == 0 && s.rosterMembers == nil {
+		return factsByPeer
+	}
+	ret := withoutAttribute(factsByPeer, fact.AttributeRoster, rosterFacts)
+	var pages []*roster.Page
+	expires := make(map[uint64]time.Time)
+	for _, f := range rosterFacts {
+		if s.config.RosterKey == nil {
+			continue
+		}
+		p, err := roster.FromFact(f, s.config.RosterKey)
+		if err != nil {
+			// should have been filtered when it was received
+			logger.Error("BUG detected: invalid roster page in fact set: %v", err)
+			continue
+		}
+		// pages can expire, or be superseded, after they were received
+		if !s.usableRosterPage(p, now) {
+			continue
+		}
+		pages = append(pages, p)
+		// the roster expires when its first page does, or when it is signed to
+		pageExpires := f.Expires
+		if p.NotAfter.Before(pageExpires) {
+			pageExpires = p.NotAfter
+		}
+		if e, ok := expires[p.Serial]; !ok || pageExpires.Before(e) {
+			expires[p.Serial] = pageExpires
+		}
+	}
+
+	serial, members, ok := roster.Current(pages, now)
+	if !ok {
+		if s.rosterMembers != nil {
+			logger.Info("Signed roster %d expired", s.rosterSerial)
+		}
+		s.rosterMembers = nil
+		s.rosterSerial = 0
+		return ret
+	}
+	if s.rosterMembers == nil || serial != s.rosterSerial {
+		logger.Info("Using signed roster %d with %d members", serial, len(members))
+	}
+	if s.rosterSerials != nil {
+		if _, err := s.rosterSerials.Update(serial); err != nil {
+			logger.Error("Unable to record roster serial %d: %v", serial, err)
+		}
+	}
+	s.rosterMembers = make(map[wgtypes.Key]bool, len(members))
+	s.rosterSerial = serial
+	for _, m := range members {
+		s.rosterMembers[m.PublicKey] = true
+		ret[m.PublicKey] = appendToGroup(ret[m.PublicKey], memberFacts(&m, expires[serial])...)
+	}
+	return ret
+}
+
+// memberFacts converts a roster entry to the facts it represents
+func memberFacts(m *roster.Member, expires time.Time) []*fact.Fact {
+	subject := &fact.PeerSubject{Key: m.PublicKey}
+	ret := make([]*fact.Fact, 0, 1+len(m.AllowedIPs))
+	ret = append(ret, &fact.Fact{
+		Attribute: fact.AttributeMemberMetadata,
+		Subject:   subject,
+		Value:     fact.BuildMemberMetadata(m.Name, false, false),
+		Expires:   expires,
+	})
+	for _, aip := range m.AllowedIPs {
+		attr := fact.AttributeAllowedCidrV6
+		if len(util.NormalizeIP(aip.IP)) == net.IPv4len {
+			attr = fact.AttributeAllowedCidrV4
+		}
+		ret = append(ret, &fact.Fact{
+			Attribute: attr,
+			Subject:   subject,
+			Value:     &fact.IPNetValue{IPNet: aip},
+			Expires:   expires,
+		})
+	}
+	return ret
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/internal/testutils"
+	"github.com/fastcat/wirelink/roster"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustRosterFacts(
+	t *testing.T,
+	priv ed25519.PrivateKey,
+	root ed25519.PublicKey,
+	serial uint64,
+	notAfter time.Time,
+	members []roster.Member,
+	expires time.Time,
+) []*fact.Fact {
+	pages, err := roster.Sign(priv, serial, notAfter, members)
+	require.NoError(t, err)
+	ret := make([]*fact.Fact, len(pages))
+	for i, p := range pages {
+		ret[i], err = p.Fact(root, expires)
+		require.NoError(t, err)
+	}
+	return ret
+}
+
+func TestLinkServer_acceptRosterFact(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(time.Minute)
+	notAfter := now.Add(time.Hour)
+	priv, err := roster.GenerateKey()
+	require.NoError(t, err)
+	root := priv.Public().(ed25519.PublicKey)
+	other, err := roster.GenerateKey()
+	require.NoError(t, err)
+	members := []roster.Member{{PublicKey: testutils.MustKey(t), Name: "alice"}}
+
+	good := mustRosterFacts(t, priv, root, 2, notAfter, members, expires)[0]
+	forged := mustRosterFacts(t, other, root, 2, notAfter, members, expires)[0]
+	expired := mustRosterFacts(t, priv, root, 2, now, members, expires)[0]
+	old := mustRosterFacts(t, priv, root, 1, notAfter, members, expires)[0]
+
+	tests := []struct {
+		name    string
+		key     ed25519.PublicKey
+		highest uint64
+		f       *fact.Fact
+		want    bool
+	}{
+		{"no root key", nil, 0, good, false},
+		{"good", root, 0, good, true},
+		{"current", root, 2, good, true},
+		{"forged", root, 0, forged, false},
+		{"other root", other.Public().(ed25519.PublicKey), 0, good, false},
+		{"signed expiration passed", root, 0, expired, false},
+		{"older than used", root, 2, old, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serials, err := roster.LoadSerialStore("")
+			require.NoError(t, err)
+			_, err = serials.Update(tt.highest)
+			require.NoError(t, err)
+			s := &LinkServer{config: &config.Server{RosterKey: tt.key}, rosterSerials: serials}
+			assert.Equal(t, tt.want, s.acceptRosterFact(tt.f, now))
+		})
+	}
+}
+
+func TestLinkServer_applyRoster(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(time.Minute)
+	priv, err := roster.GenerateKey()
+	require.NoError(t, err)
+	root := priv.Public().(ed25519.PublicKey)
+
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	ipn4 := testutils.MakeIPv4Net(10, 1, 0, 0, 16)
+	ipn6 := testutils.MakeIPv6Net([]byte{0xfd, 1}, []byte{1}, 64)
+	notAfter := now.Add(time.Hour)
+	v1 := mustRosterFacts(t, priv, root, 1, notAfter, []roster.Member{
+		{PublicKey: k1, Name: "alice", AllowedIPs: []net.IPNet{ipn4, ipn6}},
+	}, expires)
+	v2 := mustRosterFacts(t, priv, root, 2, notAfter, []roster.Member{
+		{PublicKey: k2, Name: "bob"},
+	}, expires)
+	other := memberFact(testutils.MustKey(t), expires)
+
+	serials, err := roster.LoadSerialStore("")
+	require.NoError(t, err)
+	s := &LinkServer{config: &config.Server{RosterKey: root}, rosterSerials: serials}
+	apply := func(facts ...*fact.Fact) map[wgtypes.Key][]*fact.Fact {
+		snapshot := snapshotOf(facts...)
+		return s.applyRoster(snapshot.byPeer, snapshot.roster, now)
+	}
+	otherKey := other.Subject.(*fact.PeerSubject).Key
+	var rootKey wgtypes.Key
+	copy(rootKey[:], root)
+
+	// no roster: facts pass through
+	got := apply(other)
+	assert.Equal(t, map[wgtypes.Key][]*fact.Fact{otherKey: {other}}, got)
+	assert.Nil(t, s.rosterMembers)
+
+	snapshot := snapshotOf(append([]*fact.Fact{other}, v1...)...)
+	got = s.applyRoster(snapshot.byPeer, snapshot.roster, now)
+	assert.Equal(t, map[wgtypes.Key]bool{k1: true}, s.rosterMembers)
+	assert.Equal(t, uint64(1), s.rosterSerial)
+	assert.Len(t, got, 2)
+	assert.Equal(t, []*fact.Fact{other}, got[otherKey])
+	require.Len(t, got[k1], 3)
+	assert.Equal(t, &fact.Fact{
+		Attribute: fact.AttributeMemberMetadata,
+		Subject:   &fact.PeerSubject{Key: k1},
+		Value:     fact.BuildMemberMetadata("alice", false, false),
+		Expires:   expires,
+	}, got[k1][0])
+	assert.Equal(t, fact.AttributeAllowedCidrV4, got[k1][1].Attribute)
+	assert.Equal(t, ipn4.String(), got[k1][1].Value.(*fact.IPNetValue).IPNet.String())
+	assert.Equal(t, fact.AttributeAllowedCidrV6, got[k1][2].Attribute)
+	assert.Equal(t, ipn6.String(), got[k1][2].Value.(*fact.IPNetValue).IPNet.String())
+	for _, f := range got[k1] {
+		assert.Equal(t, expires, f.Expires)
+	}
+	// the snapshot is shared with other stages, so must not be modified
+	assert.Len(t, snapshot.byPeer[rootKey], len(v1))
+	assert.NotContains(t, snapshot.byPeer, k1)
+
+	// newer serial replaces it
+	got = apply(append(append([]*fact.Fact{}, v1...), v2...)...)
+	assert.Equal(t, map[wgtypes.Key]bool{k2: true}, s.rosterMembers)
+	assert.Equal(t, uint64(2), s.rosterSerial)
+	require.Len(t, got, 1)
+	assert.Len(t, got[k2], 1)
+
+	assert.Equal(t, uint64(2), serials.Highest())
+
+	// roster going away clears it
+	apply()
+	assert.Nil(t, s.rosterMembers)
+
+	// an older roster can't be replayed once a newer one has been used
+	got = apply(v1...)
+	assert.Nil(t, s.rosterMembers)
+	assert.Empty(t, got)
+
+	// the roster expires when it is signed to, if that is before the pages do
+	soon := now.Add(30 * time.Second)
+	v3 := mustRosterFacts(t, priv, root, 3, soon, []roster.Member{{PublicKey: k1, Name: "alice"}}, expires)
+	got = apply(v3...)
+	assert.Equal(t, map[wgtypes.Key]bool{k1: true}, s.rosterMembers)
+	require.Len(t, got[k1], 1)
+	assert.Equal(t, soon.Unix(), got[k1][0].Expires.Unix())
+	// and isn't used after that
+	got = s.applyRoster(snapshotOf(v3...).byPeer, snapshotOf(v3...).roster, soon)
+	assert.Nil(t, s.rosterMembers)
+	assert.Empty(t, got)
+
+	// without a root key, roster facts are dropped
+	s.config.RosterKey = nil
+	got = apply(v1...)
+	assert.Empty(t, got)
+	assert.Nil(t, s.rosterMembers)
+}
+
+func TestLinkServer_collectPeerFlags_roster(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(time.Minute)
+	priv, err := roster.GenerateKey()
+	require.NoError(t, err)
+	root := priv.Public().(ed25519.PublicKey)
+	self := testutils.MustKey(t)
+	listed := testutils.MustKey(t)
+	unlisted := testutils.MustKey(t)
+
+	conf := buildConfig("wg0").Build()
+	conf.RosterKey = root
+	s := &LinkServer{
+		config:        conf,
+		stateAccess:   &sync.Mutex{},
+		peerConfig:    newPeerConfigSet(),
+		peerKnowledge: newPKS(),
+	}
+	facts := mustRosterFacts(t, priv, root, 3, expires.Add(time.Hour), []roster.Member{{PublicKey: listed, Name: "listed"}}, expires)
+	facts = append(facts, &fact.Fact{
+		Attribute: fact.AttributeEndpointV4,
+		Subject:   &fact.PeerSubject{Key: unlisted},
+		Value:     &fact.IPPortValue{IP: testutils.RandUDP4Addr(t).IP, Port: 1},
+		Expires:   expires,
+	})
+	dev := &wgtypes.Device{
+		PublicKey: self,
+		Peers:     []wgtypes.Peer{{PublicKey: unlisted}},
+	}
+
+	snapshot := snapshotOf(facts...)
+	factsByPeer := s.applyRoster(snapshot.byPeer, snapshot.roster, now)
+	_, removePeer, validPeers := s.collectPeerFlags(now, dev, factsByPeer)
+	assert.True(t, validPeers[listed])
+	assert.False(t, removePeer[listed])
+	assert.False(t, validPeers[unlisted])
+	assert.True(t, removePeer[unlisted])
+	var rootKey wgtypes.Key
+	copy(rootKey[:], root)
+	assert.NotContains(t, factsByPeer, rootKey)
+	assert.Contains(t, s.formatFacts(now, nil), "\nSigned roster 3 has 1 members")
+}
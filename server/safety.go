@@ -0,0 +1,304 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/fastcat/wirelink/apply"
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/util"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// holdData is the JSON form of a safety hold
+type holdData struct {
+	Since  time.Time
+	Reason string
+}
+
+// safetyBreaker tracks recent destructive changes to the device against the
+// configured limits. If a change would exceed them, it trips into a hold
+// state, in which no destructive changes are allowed until it is cleared.
+// The hold is recorded in a file, if there is one, so that restarting doesn't
+// clear it, as a restart with a broken config is one of the things it is
+// there to protect against.
+type safetyBreaker struct {
+	access       sync.Mutex
+	peerRemovals []time.Time
+	aipRemovals  []time.Time
+	heldSince    time.Time
+	heldReason   string
+	path         string
+	// memoryOnly stops the breaker from saving or removing the hold file
+	memoryOnly bool
+}
+
+// newSafetyBreaker makes a breaker that only keeps its hold in memory
+func newSafetyBreaker() *safetyBreaker {
+	return &safetyBreaker{memoryOnly: true}
+}
+
+// loadSafetyBreaker makes a breaker that records its hold in the given file,
+// starting out held if the file records a hold. In dry run mode, the file is
+// read, but never changed.
+func loadSafetyBreaker(path string, dryRun bool) (*safetyBreaker, error) {
+	sb := &safetyBreaker{
+		path:       path,
+		memoryOnly: dryRun || path == "",
+	}
+	if path == "" {
+		return sb, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return sb, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Unable to read safety hold %s", path)
+	}
+	var hd holdData
+	if err = json.Unmarshal(data, &hd); err != nil {
+		return nil, errors.Wrapf(err, "Unable to parse safety hold %s", path)
+	}
+	sb.heldSince = hd.Since
+	sb.heldReason = hd.Reason
+	if sb.heldReason == "" {
+		sb.heldReason = "held"
+	}
+	if sb.heldSince.IsZero() {
+		// keep it held even if the file doesn't say since when
+		sb.heldSince = time.Unix(0, 0)
+	}
+	logger.Error("SAFETY HOLD since %v: %s: no peers or AllowedIPs will be removed until the hold is cleared (SIGUSR2)",
+		sb.heldSince, sb.heldReason)
+	return sb, nil
+}
+
+// allow checks whether the given number of removals may be made now, and if so
+// records them. If they would exceed a limit, it trips the hold instead. A nil
+// breaker allows everything.
+func (sb *safetyBreaker) allow(
+	limits config.SafetyLimits,
+	peerRemovals, aipRemovals int,
+	now time.Time,
+) bool {
+	if sb == nil || peerRemovals == 0 && aipRemovals == 0 {
+		return true
+	}
+	sb.access.Lock()
+	defer sb.access.Unlock()
+	if !sb.heldSince.IsZero() {
+		return false
+	}
+	if !limits.Enabled() {
+		return true
+	}
+	since := now.Add(-limits.Window)
+	sb.peerRemovals = trimTimes(sb.peerRemovals, since)
+	sb.aipRemovals = trimTimes(sb.aipRemovals, since)
+	if limits.MaxPeerRemovals > 0 && len(sb.peerRemovals)+peerRemovals > limits.MaxPeerRemovals {
+		sb.trip(now, fmt.Sprintf("removing %d peers would exceed the limit of %d per %v (%d already removed)",
+			peerRemovals, limits.MaxPeerRemovals, limits.Window, len(sb.peerRemovals)))
+		return false
+	}
+	if limits.MaxAIPRemovals > 0 && len(sb.aipRemovals)+aipRemovals > limits.MaxAIPRemovals {
+		sb.trip(now, fmt.Sprintf("removing %d AllowedIPs would exceed the limit of %d per %v (%d already removed)",
+			aipRemovals, limits.MaxAIPRemovals, limits.Window, len(sb.aipRemovals)))
+		return false
+	}
+	for i := 0; i < peerRemovals; i++ {
+		sb.peerRemovals = append(sb.peerRemovals, now)
+	}
+	for i := 0; i < aipRemovals; i++ {
+		sb.aipRemovals = append(sb.aipRemovals, now)
+	}
+	return true
+}
+
+func (sb *safetyBreaker) trip(now time.Time, reason string) {
+	sb.heldSince = now
+	sb.heldReason = reason
+	logger.Error("SAFETY HOLD: %s: no peers or AllowedIPs will be removed until the hold is cleared (SIGUSR2)", reason)
+	if sb.memoryOnly {
+		return
+	}
+	data, err := json.MarshalIndent(&holdData{Since: now, Reason: reason}, "", "  ")
+	if err == nil {
+		err = util.WriteFileAtomic(sb.path, data, 0600)
+	}
+	if err != nil {
+		logger.Error("Unable to save safety hold %s, it will not last across a restart: %v", sb.path, err)
+	}
+}
+
+// clear releases the hold, if any, and forgets the recent removals, returning
+// whether there was a hold to clear
+func (sb *safetyBreaker) clear() bool {
+	if sb == nil {
+		return false
+	}
+	sb.access.Lock()
+	defer sb.access.Unlock()
+	held := !sb.heldSince.IsZero()
+	sb.heldSince = time.Time{}
+	sb.heldReason = ""
+	sb.peerRemovals = nil
+	sb.aipRemovals = nil
+	if !sb.memoryOnly {
+		if err := os.Remove(sb.path); err != nil && !os.IsNotExist(err) {
+			logger.Error("Unable to remove safety hold %s, it will come back after a restart: %v", sb.path, err)
+		}
+	}
+	return held
+}
+
+// held returns the reason for the hold, if there is one
+func (sb *safetyBreaker) held() (reason string, since time.Time, ok bool) {
+	if sb == nil {
+		return "", time.Time{}, false
+	}
+	sb.access.Lock()
+	defer sb.access.Unlock()
+	return sb.heldReason, sb.heldSince, !sb.heldSince.IsZero()
+}
+
+// trimTimes drops the times from the (sorted) list that are before since
+func trimTimes(times []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(since) {
+		i++
+	}
+	return times[i:]
+}
+
+// ClearSafetyHold releases the server from a safety hold, allowing it to
+// remove peers and AllowedIPs again
+func (s *LinkServer) ClearSafetyHold() {
+	if s.safety.clear() {
+		logger.Info("Safety hold cleared by operator")
+	} else {
+		logger.Info("Safety hold clear requested, but there was no hold")
+	}
+}
+
+// guardChanges checks the destructive parts of a config change against the
+// safety limits, and strips them out if they are not allowed. Removing a peer
+// that is statically configured and has a healthy handshake is never allowed.
+// The `prev` peers are the device state before the change.
+//
+// Giving a peer an AllowedIP that another peer has makes wireguard move it,
+// so that counts as removing it from the other peer.
+func (s *LinkServer) guardChanges(cfg wgtypes.Config, prev []wgtypes.Peer, now time.Time) wgtypes.Config {
+	peers := make(map[wgtypes.Key]*wgtypes.Peer, len(prev))
+	owners := make(map[string]wgtypes.Key)
+	for i := range prev {
+		peers[prev[i].PublicKey] = &prev[i]
+		for _, ipn := range prev[i].AllowedIPs {
+			owners[ipn.String()] = prev[i].PublicKey
+		}
+	}
+
+	ret := cfg
+	ret.Peers = make([]wgtypes.PeerConfig, 0, len(cfg.Peers))
+	removing := make(map[wgtypes.Key]bool)
+	for _, pcfg := range cfg.Peers {
+		peer := peers[pcfg.PublicKey]
+		if pcfg.Remove {
+			if peer != nil && s.config.Peers.Has(pcfg.PublicKey) && apply.IsHandshakeHealthy(peer.LastHandshakeTime, now) {
+				logger.Error("Refusing to remove healthy static peer %s", s.peerName(pcfg.PublicKey))
+				continue
+			}
+			removing[pcfg.PublicKey] = true
+		}
+		ret.Peers = append(ret.Peers, pcfg)
+	}
+	// count each AllowedIP removed from each peer once, whether it is removed
+	// explicitly, moved to another peer, or both
+	aipRemovals := make(map[string]bool)
+	for _, pcfg := range ret.Peers {
+		if pcfg.Remove {
+			continue
+		}
+		if peer := peers[pcfg.PublicKey]; pcfg.ReplaceAllowedIPs && peer != nil {
+			for _, ipn := range removedIPNets(peer.AllowedIPs, pcfg.AllowedIPs) {
+				aipRemovals[pcfg.PublicKey.String()+" "+ipn.String()] = true
+			}
+		}
+		for _, ipn := range movedIPNets(pcfg, owners) {
+			// AllowedIPs of removed peers go with them, and aren't counted
+			// separately
+			if owner := owners[ipn.String()]; !removing[owner] {
+				aipRemovals[owner.String()+" "+ipn.String()] = true
+			}
+		}
+	}
+
+	_, _, wasHeld := s.safety.held()
+	if s.safety.allow(s.config.Safety, len(removing), len(aipRemovals), now) {
+		return ret
+	}
+	// say what is being held back when the hold engages, but not on every
+	// change after that
+	logHeld := logger.Debug
+	if !wasHeld {
+		logHeld = logger.Error
+	}
+
+	// keep only the non-destructive parts of the change
+	safe := ret.Peers[:0]
+	for _, pcfg := range ret.Peers {
+		if pcfg.Remove {
+			logHeld("SAFETY HOLD: not removing peer %s", s.peerName(pcfg.PublicKey))
+			continue
+		}
+		if peer := peers[pcfg.PublicKey]; pcfg.ReplaceAllowedIPs && peer != nil {
+			if removed := removedIPNets(peer.AllowedIPs, pcfg.AllowedIPs); len(removed) > 0 {
+				logHeld("SAFETY HOLD: not removing AllowedIPs %v from peer %s", removed, s.peerName(pcfg.PublicKey))
+				pcfg.ReplaceAllowedIPs = false
+				// still add the AllowedIPs it doesn't have yet
+				pcfg.AllowedIPs = removedIPNets(pcfg.AllowedIPs, peer.AllowedIPs)
+			}
+		}
+		if moved := movedIPNets(pcfg, owners); len(moved) > 0 {
+			logHeld("SAFETY HOLD: not moving AllowedIPs %v to peer %s", moved, s.peerName(pcfg.PublicKey))
+			pcfg.AllowedIPs = removedIPNets(pcfg.AllowedIPs, moved)
+		}
+		safe = append(safe, pcfg)
+	}
+	ret.Peers = safe
+	return ret
+}
+
+// movedIPNets returns the AllowedIPs in the config for a peer that owners says
+// another peer has, which wireguard will take away from that peer
+func movedIPNets(pcfg wgtypes.PeerConfig, owners map[string]wgtypes.Key) []net.IPNet {
+	var ret []net.IPNet
+	for _, ipn := range pcfg.AllowedIPs {
+		if owner, ok := owners[ipn.String()]; ok && owner != pcfg.PublicKey {
+			ret = append(ret, ipn)
+		}
+	}
+	return ret
+}
+
+// removedIPNets returns the entries in prev that are not in next
+func removedIPNets(prev, next []net.IPNet) []net.IPNet {
+	in := make(map[string]bool, len(next))
+	for _, ipn := range next {
+		in[ipn.String()] = true
+	}
+	var ret []net.IPNet
+	for _, ipn := range prev {
+		if !in[ipn.String()] {
+			ret = append(ret, ipn)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/internal/mocks"
+	"github.com/fastcat/wirelink/internal/testutils"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSafetyBreaker_allow(t *testing.T) {
+	now := time.Now()
+	limits := config.SafetyLimits{MaxPeerRemovals: 2, MaxAIPRemovals: 5, Window: time.Minute}
+
+	type step struct {
+		offset         time.Duration
+		peers, aips    int
+		limits         config.SafetyLimits
+		want           bool
+		wantHeld       bool
+		clearAfterward bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"no limits", []step{
+			{0, 100, 100, config.SafetyLimits{}, true, false, false},
+		}},
+		{"nothing destructive while held", []step{
+			{0, 3, 0, limits, false, true, false},
+			{time.Hour, 0, 0, limits, true, true, false},
+		}},
+		{"peer limit", []step{
+			{0, 1, 0, limits, true, false, false},
+			{time.Second, 1, 0, limits, true, false, false},
+			{2 * time.Second, 1, 0, limits, false, true, false},
+			{time.Hour, 1, 0, limits, false, true, true},
+			{time.Hour, 1, 0, limits, true, false, false},
+		}},
+		{"aip limit window", []step{
+			{0, 0, 5, limits, true, false, false},
+			{30 * time.Second, 0, 1, limits, false, true, true},
+			{30 * time.Second, 0, 5, limits, true, false, false},
+			{91 * time.Second, 0, 5, limits, true, false, false},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sb := newSafetyBreaker()
+			for i, s := range tt.steps {
+				assert.Equal(t, s.want, sb.allow(s.limits, s.peers, s.aips, now.Add(s.offset)), "allow step %d", i)
+				_, _, held := sb.held()
+				assert.Equal(t, s.wantHeld, held, "held step %d", i)
+				if s.clearAfterward {
+					assert.True(t, sb.clear())
+				}
+			}
+		})
+	}
+
+	// nil breaker allows everything
+	var nilBreaker *safetyBreaker
+	assert.True(t, nilBreaker.allow(limits, 100, 100, now))
+	assert.False(t, nilBreaker.clear())
+	_, _, held := nilBreaker.held()
+	assert.False(t, held)
+}
+
+func TestLoadSafetyBreaker(t *testing.T) {
+	now := time.Now()
+	limits := config.SafetyLimits{MaxPeerRemovals: 1, Window: time.Minute}
+	dir, err := ioutil.TempDir("", "wirelink-safety")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "safety-hold.json")
+
+	sb, err := loadSafetyBreaker(path, false)
+	require.NoError(t, err)
+	_, _, held := sb.held()
+	assert.False(t, held)
+	assert.False(t, sb.allow(limits, 2, 0, now))
+
+	// the hold lasts across a restart
+	sb, err = loadSafetyBreaker(path, false)
+	require.NoError(t, err)
+	reason, since, held := sb.held()
+	assert.True(t, held)
+	assert.Contains(t, reason, "removing 2 peers")
+	assert.True(t, since.Equal(now))
+	assert.False(t, sb.allow(limits, 1, 0, now))
+
+	// until it is cleared
+	assert.True(t, sb.clear())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+	sb, err = loadSafetyBreaker(path, false)
+	require.NoError(t, err)
+	_, _, held = sb.held()
+	assert.False(t, held)
+
+	// dry run doesn't record a hold
+	sb, err = loadSafetyBreaker(path, true)
+	require.NoError(t, err)
+	assert.False(t, sb.allow(limits, 2, 0, now))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("{"), 0600))
+	_, err = loadSafetyBreaker(path, false)
+	assert.Error(t, err)
+}
+
+func TestLinkServer_guardChanges(t *testing.T) {
+	now := time.Now()
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	k3 := testutils.MustKey(t)
+	ipn1 := testutils.MakeIPv4Net(10, 1, 0, 0, 16)
+	ipn2 := testutils.MakeIPv4Net(10, 2, 0, 0, 16)
+	ipn3 := testutils.MakeIPv4Net(10, 3, 0, 0, 16)
+
+	prev := []wgtypes.Peer{
+		{PublicKey: k1, LastHandshakeTime: now.Add(-time.Second), AllowedIPs: []net.IPNet{ipn1, ipn2}},
+		{PublicKey: k2, AllowedIPs: []net.IPNet{ipn1}},
+	}
+	removeBoth := wgtypes.Config{Peers: []wgtypes.PeerConfig{
+		{PublicKey: k1, Remove: true},
+		{PublicKey: k2, Remove: true},
+	}}
+	replaceAIPs := wgtypes.Config{Peers: []wgtypes.PeerConfig{
+		{PublicKey: k1, ReplaceAllowedIPs: true, AllowedIPs: []net.IPNet{ipn3}},
+	}}
+	// wireguard moves AllowedIPs to the new peer from the ones that have them
+	moveAIPs := wgtypes.Config{Peers: []wgtypes.PeerConfig{
+		{PublicKey: k3, AllowedIPs: []net.IPNet{ipn1, ipn2, ipn3}},
+	}}
+	moveAndRemoveAIP := wgtypes.Config{Peers: []wgtypes.PeerConfig{
+		{PublicKey: k1, ReplaceAllowedIPs: true, AllowedIPs: []net.IPNet{ipn1}},
+		{PublicKey: k2, AllowedIPs: []net.IPNet{ipn2}},
+	}}
+	moveFromRemoved := wgtypes.Config{Peers: []wgtypes.PeerConfig{
+		{PublicKey: k1, Remove: true},
+		{PublicKey: k3, AllowedIPs: []net.IPNet{ipn2}},
+	}}
+
+	tests := []struct {
+		name string
+		conf *config.Server
+		cfg  wgtypes.Config
+		want wgtypes.Config
+		held bool
+	}{
+		{
+			"no limits",
+			buildConfig("wg0").Build(),
+			removeBoth,
+			removeBoth,
+			false,
+		},
+		{
+			"healthy static peer",
+			buildConfig("wg0").withPeer(k1, &config.Peer{}).withPeer(k2, &config.Peer{}).Build(),
+			removeBoth,
+			wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: k2, Remove: true}}},
+			false,
+		},
+		{
+			"too many peer removals",
+			&config.Server{Safety: config.SafetyLimits{MaxPeerRemovals: 1, Window: time.Minute}},
+			removeBoth,
+			wgtypes.Config{Peers: []wgtypes.PeerConfig{}},
+			true,
+		},
+		{
+			"aip removals within limit",
+			&config.Server{Safety: config.SafetyLimits{MaxAIPRemovals: 2, Window: time.Minute}},
+			replaceAIPs,
+			replaceAIPs,
+			false,
+		},
+		{
+			"too many aip removals",
+			&config.Server{Safety: config.SafetyLimits{MaxAIPRemovals: 1, Window: time.Minute}},
+			replaceAIPs,
+			wgtypes.Config{Peers: []wgtypes.PeerConfig{
+				{PublicKey: k1, AllowedIPs: []net.IPNet{ipn3}},
+			}},
+			true,
+		},
+		{
+			"too many aip moves",
+			&config.Server{Safety: config.SafetyLimits{MaxAIPRemovals: 1, Window: time.Minute}},
+			moveAIPs,
+			wgtypes.Config{Peers: []wgtypes.PeerConfig{
+				{PublicKey: k3, AllowedIPs: []net.IPNet{ipn3}},
+			}},
+			true,
+		},
+		{
+			"aip moved and removed counts once",
+			&config.Server{Safety: config.SafetyLimits{MaxAIPRemovals: 2, Window: time.Minute}},
+			moveAndRemoveAIP,
+			moveAndRemoveAIP,
+			false,
+		},
+		{
+			"aip moves from removed peers",
+			&config.Server{Safety: config.SafetyLimits{MaxPeerRemovals: 1, MaxAIPRemovals: 1, Window: time.Minute}},
+			moveFromRemoved,
+			moveFromRemoved,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &LinkServer{
+				config: tt.conf,
+				safety: newSafetyBreaker(),
+			}
+			got := s.guardChanges(tt.cfg, prev, now)
+			assert.Equal(t, tt.want, got)
+			_, _, held := s.safety.held()
+			assert.Equal(t, tt.held, held)
+		})
+	}
+}
+
+func TestLinkServer_configureDevice_safetyHold(t *testing.T) {
+	k1 := testutils.MustKey(t)
+	prev := []wgtypes.Peer{{PublicKey: k1}}
+	cfg := wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: k1, Remove: true}}}
+
+	// no ConfigureDevice expectation while held: the mock will fail the test if it is called
+	ctrl := &mocks.WgClient{}
+	ctrl.Test(t)
+	conf := buildConfig("wg0").Build()
+	conf.Safety = config.SafetyLimits{MaxPeerRemovals: 1, Window: time.Minute}
+	s := &LinkServer{
+		config: conf,
+		ctrl:   ctrl,
+		safety: newSafetyBreaker(),
+	}
+	s.safety.allow(conf.Safety, 2, 0, time.Now())
+	require.NoError(t, s.configureDevice(cfg, prev, nil, "testing"))
+	ctrl.AssertExpectations(t)
+
+	s.ClearSafetyHold()
+	ctrl.On("ConfigureDevice", "wg0", cfg).Return(nil).Once()
+	require.NoError(t, s.configureDevice(cfg, prev, nil, "testing"))
+	ctrl.AssertExpectations(t)
+}
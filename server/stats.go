@@ -0,0 +1,58 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Stats summarizes the work the server has done, so that how it scales with
+// the number of peers can be measured
+type Stats struct {
+	// Chunks is how many chunks of received facts have been processed
+	Chunks int
+	// ChunkTime is the total time spent processing chunks
+	ChunkTime time.Duration
+	// Facts is how many facts were in the fact set after the last chunk
+	Facts int
+	// KnowledgeEntries is how many facts we are tracking as known by peers
+	KnowledgeEntries int
+	// KnowledgeBytes is an estimate of the memory used to track what peers know
+	KnowledgeBytes int
+	// Gossip is the gossip activity, if gossip is enabled
+	Gossip GossipStats
+}
+
+// chunkStats counts the work done processing chunks of received facts.
+// It is safe to call methods on a nil chunkStats, they will do nothing.
+type chunkStats struct {
+	access sync.Mutex
+	chunks int
+	time   time.Duration
+	facts  int
+}
+
+func (cs *chunkStats) record(elapsed time.Duration, facts int) {
+	if cs == nil {
+		return
+	}
+	cs.access.Lock()
+	defer cs.access.Unlock()
+	cs.chunks++
+	cs.time += elapsed
+	cs.facts = facts
+}
+
+// Stats returns a snapshot of the server's work counters
+func (s *LinkServer) Stats() Stats {
+	var ret Stats
+	if s.chunkStats != nil {
+		s.chunkStats.access.Lock()
+		ret.Chunks = s.chunkStats.chunks
+		ret.ChunkTime = s.chunkStats.time
+		ret.Facts = s.chunkStats.facts
+		s.chunkStats.access.Unlock()
+	}
+	ret.KnowledgeEntries, ret.KnowledgeBytes = s.peerKnowledge.size()
+	ret.Gossip = s.GossipStats()
+	return ret
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/fastcat/wirelink/internal/testutils"
+	"github.com/fastcat/wirelink/internal/testutils/facts"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinkServer_Stats(t *testing.T) {
+	now := time.Now()
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+
+	tests := []struct {
+		name    string
+		server  *LinkServer
+		chunks  []int
+		want    Stats
+		wantMem bool
+	}{
+		{
+			"empty",
+			&LinkServer{},
+			nil,
+			Stats{},
+			false,
+		},
+		{
+			"chunks and knowledge",
+			&LinkServer{
+				chunkStats: &chunkStats{},
+				peerKnowledge: &peerKnowledgeSet{
+					data: map[peerKnowledgeKey]time.Time{
+						keyOf(facts.EndpointFactFull(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, &k1, now), k2): now,
+						keyOf(facts.AliveFactFull(&k2, now, uuid.Must(uuid.NewRandom())), k1):                          now,
+					},
+					bootIDs: map[wgtypes.Key]uuid.UUID{},
+					access:  &sync.RWMutex{},
+				},
+			},
+			[]int{3, 5},
+			Stats{
+				Chunks:           2,
+				ChunkTime:        3 * time.Millisecond,
+				Facts:            5,
+				KnowledgeEntries: 2,
+			},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, n := range tt.chunks {
+				tt.server.chunkStats.record(time.Duration(i+1)*time.Millisecond, n)
+			}
+			got := tt.server.Stats()
+			if tt.wantMem {
+				assert.Greater(t, got.KnowledgeBytes, 2*(2*wgtypes.KeyLen))
+			} else {
+				assert.Zero(t, got.KnowledgeBytes)
+			}
+			got.KnowledgeBytes = 0
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/fact"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// successionTracker remembers which keys have been replaced by which, so that
+// trust and membership carry over to the new key even after the facts about
+// the old one are gone. The configure loop updates it, and fact processing
+// reads it.
+type successionTracker struct {
+	access sync.Mutex
+	// successors maps old keys to the keys that replaced them
+	successors map[wgtypes.Key]wgtypes.Key
+	// upSince is when the successor of each old key was first seen alive
+	upSince map[wgtypes.Key]time.Time
+	// retired is the old keys whose grace period has passed
+	retired map[wgtypes.Key]bool
+}
+
+func newSuccessionTracker() *successionTracker {
+	return &successionTracker{
+		successors: make(map[wgtypes.Key]wgtypes.Key),
+		upSince:    make(map[wgtypes.Key]time.Time),
+		retired:    make(map[wgtypes.Key]bool),
+	}
+}
+
+// record adds a succession, returning whether it is new. The first successor
+// seen for a key is kept.
+func (st *successionTracker) record(old, successor wgtypes.Key) bool {
+	st.access.Lock()
+	defer st.access.Unlock()
+	if current, ok := st.successors[old]; ok {
+		if current != successor {
+			logger.Error("Ignoring successor %s for %s, already succeeded by %s", successor, old, current)
+		}
+		return false
+	}
+	st.successors[old] = successor
+	return true
+}
+
+// state returns copies of the successions and the retired keys, a nil
+// tracker has none
+func (st *successionTracker) state() (successors map[wgtypes.Key]wgtypes.Key, retired map[wgtypes.Key]bool) {
+	if st == nil {
+		return nil, nil
+	}
+	st.access.Lock()
+	defer st.access.Unlock()
+	successors = make(map[wgtypes.Key]wgtypes.Key, len(st.successors))
+	for k, v := range st.successors {
+		successors[k] = v
+	}
+	retired = make(map[wgtypes.Key]bool, len(st.retired))
+	for k := range st.retired {
+		retired[k] = true
+	}
+	return
+}
+
+// retire starts the grace period for each old key once its successor is
+// alive, and retires it when the grace period is over, returning the newly
+// retired keys
+func (st *successionTracker) retire(now time.Time, grace time.Duration, alive func(wgtypes.Key) bool) (retired []wgtypes.Key) {
+	st.access.Lock()
+	defer st.access.Unlock()
+	for old, successor := range st.successors {
+		if st.retired[old] {
+			continue
+		}
+		since, ok := st.upSince[old]
+		if !ok {
+			if !alive(successor) {
+				continue
+			}
+			since = now
+			st.upSince[old] = since
+		}
+		if now.Sub(since) >= grace {
+			st.retired[old] = true
+			retired = append(retired, old)
+		}
+	}
+	return
+}
+
+// succeededPeers is the static peer config, with the config for each replaced
+// key copied to its successor, and without any retired keys. As successions are
+// only accepted from the key being replaced, a successor never gets more trust
+// than the key that announced it.
+func (s *LinkServer) succeededPeers() config.Peers {
+	successors, retired := s.successions.state()
+	if len(successors) == 0 {
+		return s.config.Peers
+	}
+	ret := make(config.Peers, len(s.config.Peers)+len(successors))
+	for k, pc := range s.config.Peers {
+		ret[k] = pc
+	}
+	// repeat to follow chains of successions
+	for changed := true; changed; {
+		changed = false
+		for old, successor := range successors {
+			if pc, ok := ret[old]; ok && !ret.Has(successor) {
+				ret[successor] = pc
+				changed = true
+			}
+		}
+	}
+	for k := range retired {
+		delete(ret, k)
+	}
+	return ret
+}
+
+// successionFacts makes the fact announcing our own successor, if we have one
+func (s *LinkServer) successionFacts(self wgtypes.Key, expires time.Time) (ret []*fact.Fact) {
+	if s.config.Successor != nil {
+		ret = append(ret, successorFact(self, *s.config.Successor, expires))
+	}
+	return
+}
+
+func successorFact(old, successor wgtypes.Key, expires time.Time) *fact.Fact {
+	return &fact.Fact{
+		Attribute: fact.AttributeSuccessor,
+		Subject:   &fact.PeerSubject{Key: old},
+		Value:     &fact.SuccessorValue{Key: successor},
+		Expires:   expires,
+	}
+}
+
+// acceptSuccessorFact checks if a received successor fact should be trusted:
+// it must come directly from the key being replaced, as that is the only key
+// that can sign for itself, and anyone else could use a succession to take
+// over the old key's trust
+func (s *LinkServer) acceptSuccessorFact(f *fact.Fact, source wgtypes.Key, fromPeer bool) bool {
+	ps, ok := f.Subject.(*fact.PeerSubject)
+	if !ok {
+		return false
+	}
+	sv, ok := f.Value.(*fact.SuccessorValue)
+	if !ok || sv.Key == ps.Key {
+		return false
+	}
+	return fromPeer && source == ps.Key
+}
+
+// withoutRelayedSuccessions removes the successor facts for keys other than
+// our own, as peers won't accept them from us. The given slice is not
+// modified.
+func withoutRelayedSuccessions(self wgtypes.Key, facts []*fact.Fact) []*fact.Fact {
+	relayed := func(f *fact.Fact) bool {
+		if f.Attribute != fact.AttributeSuccessor {
+			return false
+		}
+		ps, ok := f.Subject.(*fact.PeerSubject)
+		return !ok || ps.Key != self
+	}
+	if !fact.SliceHas(facts, relayed) {
+		return facts
+	}
+	ret := make([]*fact.Fact, 0, len(facts))
+	for _, f := range facts {
+		if !relayed(f) {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// successionGrace is how long to keep a replaced key after its successor
+// comes up
+func (s *LinkServer) successionGrace() time.Duration {
+	if s.config.SuccessionGrace > 0 {
+		return s.config.SuccessionGrace
+	}
+	return config.DefaultSuccessionGrace
+}
+
+// applySuccession removes the successor facts, which must be all of those in
+// the grouped facts, recording the successions they announce, and transfers
+// the membership, name, and AllowedIPs of each replaced key to its successor.
+// Once a replaced key is retired, all the facts about it are dropped. The given
+// groups are not modified.
+func (s *LinkServer) applySuccession(
+	factsByPeer map[wgtypes.Key][]*fact.Fact,
+	successorFacts []*fact.Fact,
+	dev *wgtypes.Device,
+	now time.Time,
+) map[wgtypes.Key][]*fact.Fact {
+	if s.successions == nil {
+		return factsByPeer
+	}
+	ret := withoutAttribute(factsByPeer, fact.AttributeSuccessor, successorFacts)
+	for _, f := range successorFacts {
+		old := f.Subject.(*fact.PeerSubject).Key
+		successor := f.Value.(*fact.SuccessorValue).Key
+		if old == dev.PublicKey {
+			// we don't replace ourselves
+			continue
+		}
+		if s.successions.record(old, successor) {
+			logger.Info("Peer %s is succeeded by %s", s.peerName(old), successor)
+		}
+	}
+
+	newlyRetired := s.successions.retire(now, s.successionGrace(), func(k wgtypes.Key) bool {
+		alive, _, _ := s.peerKnowledge.peerAlive(k, now)
+		return alive
+	})
+	for _, old := range newlyRetired {
+		logger.Info("Retiring replaced peer %s", s.peerName(old))
+	}
+
+	successors, retired := s.successions.state()
+	if len(successors) == 0 {
+		return ret
+	}
+	// follow chains of successions to the current key
+	current := func(k wgtypes.Key) wgtypes.Key {
+		successor, ok := successors[k]
+		for i := 0; ok && i < len(successors); i++ {
+			k = successor
+			successor, ok = successors[k]
+		}
+		return k
+	}
+
+	// only the groups for replaced keys need to be looked at
+	for old := range successors {
+		group := ret[old]
+		if len(group) == 0 {
+			continue
+		}
+		successor := current(old)
+		have := make(map[string]bool, len(ret[successor]))
+		for _, f := range ret[successor] {
+			have[successionFactKey(successor, f)] = true
+		}
+		var derived []*fact.Fact
+		for _, f := range group {
+			switch f.Attribute {
+			case fact.AttributeMember, fact.AttributeMemberMetadata,
+				fact.AttributeAllowedCidrV4, fact.AttributeAllowedCidrV6:
+				key := successionFactKey(successor, f)
+				if !have[key] {
+					have[key] = true
+					derived = append(derived, &fact.Fact{
+						Attribute: f.Attribute,
+						Subject:   &fact.PeerSubject{Key: successor},
+						Value:     f.Value,
+						Expires:   f.Expires,
+					})
+				}
+			}
+		}
+		if len(derived) > 0 {
+			ret[successor] = appendToGroup(ret[successor], derived...)
+		}
+	}
+	for old := range retired {
+		delete(ret, old)
+	}
+	return ret
+}
+
+func successionFactKey(subject wgtypes.Key, f *fact.Fact) string {
+	return string(subject[:]) + string(f.Attribute) + f.Value.String()
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fastcat/wirelink/config"
+	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/internal/testutils"
+	factutils "github.com/fastcat/wirelink/internal/testutils/facts"
+	"github.com/fastcat/wirelink/trust"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_successionTracker_retire(t *testing.T) {
+	now := time.Now()
+	grace := time.Minute
+	old := testutils.MustKey(t)
+	successor := testutils.MustKey(t)
+
+	st := newSuccessionTracker()
+	assert.True(t, st.record(old, successor))
+	assert.False(t, st.record(old, successor))
+	// the first successor sticks
+	assert.False(t, st.record(old, testutils.MustKey(t)))
+
+	alive := false
+	isAlive := func(k wgtypes.Key) bool {
+		assert.Equal(t, successor, k)
+		return alive
+	}
+
+	// grace doesn't start until the successor is alive
+	assert.Empty(t, st.retire(now, grace, isAlive))
+	assert.Empty(t, st.retire(now.Add(2*grace), grace, isAlive))
+	alive = true
+	assert.Empty(t, st.retire(now.Add(2*grace), grace, isAlive))
+	// and continues even if it goes away again
+	alive = false
+	assert.Empty(t, st.retire(now.Add(2*grace+grace/2), grace, isAlive))
+	assert.Equal(t, []wgtypes.Key{old}, st.retire(now.Add(3*grace), grace, isAlive))
+	assert.Empty(t, st.retire(now.Add(4*grace), grace, isAlive))
+
+	successors, retired := st.state()
+	assert.Equal(t, map[wgtypes.Key]wgtypes.Key{old: successor}, successors)
+	assert.Equal(t, map[wgtypes.Key]bool{old: true}, retired)
+
+	// nil tracker is empty
+	successors, retired = (*successionTracker)(nil).state()
+	assert.Empty(t, successors)
+	assert.Empty(t, retired)
+}
+
+func TestLinkServer_succeededPeers(t *testing.T) {
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	k3 := testutils.MustKey(t)
+	k4 := testutils.MustKey(t)
+	unknown := testutils.MustKey(t)
+	p1 := &config.Peer{Name: "one", Trust: trust.Ptr(trust.Membership)}
+	p4 := &config.Peer{Name: "four"}
+
+	st := newSuccessionTracker()
+	s := &LinkServer{
+		config:      &config.Server{Peers: config.Peers{k1: p1, k4: p4}},
+		successions: st,
+	}
+	assert.Equal(t, s.config.Peers, s.succeededPeers())
+
+	// chains are followed
+	st.record(k2, k3)
+	st.record(k1, k2)
+	// keys that already have config keep it
+	st.record(k3, k4)
+	// nothing to transfer
+	st.record(unknown, testutils.MustKey(t))
+	assert.Equal(t, config.Peers{k1: p1, k2: p1, k3: p1, k4: p4}, s.succeededPeers())
+
+	st.retired[k1] = true
+	assert.Equal(t, config.Peers{k2: p1, k3: p1, k4: p4}, s.succeededPeers())
+	// the config itself is unchanged
+	assert.Equal(t, config.Peers{k1: p1, k4: p4}, s.config.Peers)
+}
+
+func TestLinkServer_acceptSuccessorFact(t *testing.T) {
+	expires := time.Now().Add(time.Minute)
+	old := testutils.MustKey(t)
+	successor := testutils.MustKey(t)
+	other := testutils.MustKey(t)
+	good := successorFact(old, successor, expires)
+
+	tests := []struct {
+		name     string
+		f        *fact.Fact
+		source   wgtypes.Key
+		fromPeer bool
+		want     bool
+	}{
+		{"from old key", good, old, true, true},
+		// even a Membership source can't hand another key's trust to a successor
+		{"relayed", good, other, true, false},
+		{"from successor", good, successor, true, false},
+		{"unknown source", good, old, false, false},
+		{"self succession", successorFact(old, old, expires), old, true, false},
+		{"wrong value", &fact.Fact{
+			Attribute: fact.AttributeSuccessor,
+			Subject:   &fact.PeerSubject{Key: old},
+			Value:     &fact.EmptyValue{},
+			Expires:   expires,
+		}, old, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &LinkServer{config: &config.Server{}}
+			assert.Equal(t, tt.want, s.acceptSuccessorFact(tt.f, tt.source, tt.fromPeer))
+		})
+	}
+}
+
+func TestLinkServer_successionFacts(t *testing.T) {
+	expires := time.Now().Add(time.Minute)
+	self := testutils.MustKey(t)
+	next := testutils.MustKey(t)
+	old := testutils.MustKey(t)
+	successor := testutils.MustKey(t)
+
+	st := newSuccessionTracker()
+	st.record(old, successor)
+	s := &LinkServer{
+		config:      &config.Server{Successor: &next},
+		successions: st,
+	}
+	assert.Equal(t, []*fact.Fact{
+		successorFact(self, next, expires),
+	}, s.successionFacts(self, expires), "should only announce our own successor")
+
+	s.config.Successor = nil
+	assert.Empty(t, s.successionFacts(self, expires))
+}
+
+func Test_withoutRelayedSuccessions(t *testing.T) {
+	expires := time.Now().Add(time.Minute)
+	self := testutils.MustKey(t)
+	other := testutils.MustKey(t)
+
+	own := successorFact(self, testutils.MustKey(t), expires)
+	relayed := successorFact(other, testutils.MustKey(t), expires)
+	member := memberFact(other, expires)
+
+	facts := []*fact.Fact{member, own}
+	assert.Equal(t, facts, withoutRelayedSuccessions(self, facts))
+	facts = []*fact.Fact{member, relayed, own}
+	assert.Equal(t, []*fact.Fact{member, own}, withoutRelayedSuccessions(self, facts))
+	assert.Equal(t, []*fact.Fact{member, relayed, own}, facts, "input should not be modified")
+}
+
+func TestLinkServer_applySuccession(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(time.Minute)
+	self := testutils.MustKey(t)
+	old := testutils.MustKey(t)
+	successor := testutils.MustKey(t)
+	other := testutils.MustKey(t)
+	dev := &wgtypes.Device{PublicKey: self}
+	aip := testutils.MakeIPv4Net(10, 1, 0, 5, 32)
+
+	oldFacts := []*fact.Fact{
+		factutils.MemberMetadataFactFull(&old, expires, "laptop", false),
+		factutils.AllowedIPFactFull(aip, &old, expires),
+		factutils.EndpointFactFull(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51820}, &old, expires),
+	}
+	otherFacts := []*fact.Fact{
+		factutils.MemberFactFull(&other, expires),
+	}
+	// endpoints are not transferred, and the successor may already have some facts
+	successorFacts := []*fact.Fact{
+		factutils.AllowedIPFactFull(aip, &successor, expires),
+	}
+	var input []*fact.Fact
+	input = append(input, oldFacts...)
+	input = append(input, otherFacts...)
+	input = append(input, successorFacts...)
+	input = append(input,
+		successorFact(old, successor, expires),
+		// we never replace ourselves
+		successorFact(self, other, expires),
+	)
+
+	grace := time.Minute
+	s := &LinkServer{
+		config:        &config.Server{SuccessionGrace: grace},
+		successions:   newSuccessionTracker(),
+		peerKnowledge: newPKS(),
+	}
+
+	snapshot := snapshotOf(input...)
+	apply := func(now time.Time) []*fact.Fact {
+		var ret []*fact.Fact
+		for _, group := range s.applySuccession(snapshot.byPeer, snapshot.successors, dev, now) {
+			ret = append(ret, group...)
+		}
+		return ret
+	}
+
+	var want []*fact.Fact
+	want = append(want, oldFacts...)
+	want = append(want, otherFacts...)
+	want = append(want, successorFacts...)
+	want = append(want, factutils.MemberMetadataFactFull(&successor, expires, "laptop", false))
+	assert.ElementsMatch(t, want, apply(now))
+	successors, _ := s.successions.state()
+	assert.Equal(t, map[wgtypes.Key]wgtypes.Key{old: successor}, successors)
+
+	// once the successor is up, and the grace period is over, the old key is dropped
+	s.peerKnowledge.mockPeerAlive(successor, now.Add(2*grace), nil)
+	assert.ElementsMatch(t, want, apply(now))
+	assert.ElementsMatch(t, want[len(oldFacts):], apply(now.Add(grace)))
+	// the snapshot is shared with other stages, so must not be modified
+	assert.ElementsMatch(t, input, snapshot.facts)
+	assert.Len(t, snapshot.byPeer[successor], len(successorFacts))
+
+	// without a tracker, nothing changes
+	s.successions = nil
+	assert.Equal(t, snapshot.byPeer, s.applySuccession(snapshot.byPeer, snapshot.successors, dev, now))
+}
@@ -4,16 +4,19 @@ import (
 	"bytes"
 	"context"
 	"net"
+	"sort"
 	"time"
 
 	"github.com/pkg/errors"
 
-	"github.com/fastcat/wirelink/autopeer"
 	"github.com/fastcat/wirelink/config"
 	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/internal/clock"
 	"github.com/fastcat/wirelink/internal/networking"
 	"github.com/fastcat/wirelink/log"
 	"github.com/fastcat/wirelink/trust"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 func (s *LinkServer) readPackets(received chan<- *ReceivedFact) error {
@@ -24,7 +27,7 @@ func (s *LinkServer) readPackets(received chan<- *ReceivedFact) error {
 	rCtx, rCancel := context.WithCancel(s.ctx)
 	defer rCancel()
 	s.AddHandler(func(ctx context.Context) error {
-		return s.conn.ReadPackets(rCtx, fact.UDPMaxSafePayload*2, packets)
+		return s.conn.ReadPackets(rCtx, fact.UDPMaxPayload*2, packets)
 	})
 
 	for packet := range packets {
@@ -36,18 +39,18 @@ func (s *LinkServer) readPackets(received chan<- *ReceivedFact) error {
 		pp := &fact.Fact{}
 		err := pp.DecodeFrom(len(packet.Data), packet.Time, bytes.NewBuffer(packet.Data))
 		if err != nil {
-			log.Error("Unable to decode fact: %v %v", err, packet.Data)
+			logger.Error("Unable to decode fact: %v %v", err, packet.Data)
 			continue
 		}
 		if pp.Attribute == fact.AttributeSignedGroup {
 			err = s.processSignedGroup(pp, packet.Addr, packet.Time, received)
 			if err != nil {
-				log.Error("Unable to process SignedGroup from %v: %v", packet.Addr, err)
+				logger.Error("Unable to process SignedGroup from %v: %v", packet.Addr, err)
 			}
 		} else {
 			// if we had a peerLookup, we could map the source IP to a name here,
 			// but creating that is unnecessarily expensive for this rare error
-			log.Error("Ignoring unsigned fact from %v", packet.Addr)
+			logger.Error("Ignoring unsigned fact from %v", packet.Addr)
 		}
 	}
 
@@ -72,7 +75,7 @@ func (s *LinkServer) processSignedGroup(
 		return errors.Errorf("SignedGroup has non-SignedGroupValue: %T", f.Value)
 	}
 
-	if !autopeer.AutoAddress(ps.Key).Equal(source.IP) {
+	if !s.scheme.Address(ps.Key).Equal(source.IP) {
 		return errors.Errorf("SignedGroup source %v does not match key %v", source.IP, ps.Key)
 	}
 	// TODO: check the key is locally known/trusted
@@ -86,13 +89,47 @@ func (s *LinkServer) processSignedGroup(
 		return errors.Errorf("Unknown error validating SignedGroup")
 	}
 
-	inner, err := pv.ParseInner(now)
+	inner, compact, err := pv.ParseInnerWithEncoding(now)
 	if err != nil {
 		return errors.Wrapf(err, "Unable to parse SignedGroup inner")
 	}
-	// log.Debug("Received SGF of length %d/%d from %v", len(pv.InnerBytes), len(inner), source)
+	if compact {
+		s.handleCompact(ps.Key, len(inner), now)
+	}
+	// logger.Debug("Received SGF of length %d/%d from %v", len(pv.InnerBytes), len(inner), source)
+	needsAck := false
+	var hops uint8
 	for _, innerFact := range inner {
-		packets <- &ReceivedFact{fact: innerFact, source: *source}
+		// a gossip marker applies to the facts that follow it in the group
+		if h, ok := s.handleGossip(ps.Key, innerFact, len(inner), now); ok {
+			hops = h
+			continue
+		}
+		// echo, path probe, reach, vote, and ack facts are handled immediately and
+		// not passed on
+		if s.handleEcho(ps.Key, innerFact, now) ||
+			s.handlePathProbe(ps.Key, innerFact, now) ||
+			s.handleReach(ps.Key, innerFact, now) ||
+			s.handleVote(ps.Key, innerFact, now) ||
+			s.handleAck(ps.Key, innerFact) {
+			continue
+		}
+		// digests are too, unless they match ours, when they renew our facts
+		if handled, renew := s.handleDigest(ps.Key, innerFact, now); handled {
+			if renew {
+				packets <- &ReceivedFact{fact: innerFact, source: *source}
+			}
+			continue
+		}
+		needsAck = true
+		packets <- &ReceivedFact{fact: innerFact, source: *source, hops: hops}
+	}
+	// only ack groups with facts to confirm, and only to peers that will
+	// understand it
+	if needsAck && s.peerKnowledge.ackState().isCapable(ps.Key) {
+		if err := s.sendAck(ps.Key, pv.Nonce, now); err != nil {
+			logger.Error("Unable to send ack to %s: %v", s.peerName(ps.Key), err)
+		}
 	}
 	return nil
 }
@@ -111,7 +148,7 @@ func (s *LinkServer) chunkPackets(
 	// TODO: using a ticker here is not ideal, as we can't reset its phase to
 	// match when we send a chunk downstream, but using a timer involves more
 	// boilerplate
-	chunkTicker := time.NewTicker(s.ChunkPeriod)
+	chunkTicker := clock.Or(s.clock).NewTicker(s.ChunkPeriod)
 	defer chunkTicker.Stop()
 
 	// send an empty chunk once at startup to prime things
@@ -136,7 +173,7 @@ func (s *LinkServer) chunkPackets(
 				}
 			}
 
-		case <-chunkTicker.C:
+		case <-chunkTicker.Chan():
 			sendBuffer = true
 		}
 
@@ -152,64 +189,123 @@ func (s *LinkServer) chunkPackets(
 }
 
 // pruneRemovedLocalFacts finds the difference between lastLocal and newLocal,
-// and returns chunk less any matching facts
-func pruneRemovedLocalFacts(chunk, lastLocal, newLocal []*fact.Fact) []*fact.Fact {
-	removed := make(map[fact.Key]bool, len(lastLocal))
+// and removes any matching facts from the store. The local sources for the
+// removed facts are removed from prov, and if it shows that some other peer
+// still asserts one of them, it is kept, but with its expiration reduced to
+// match the remaining sources.
+func pruneRemovedLocalFacts(store *fact.Store, lastLocal, newLocal []*fact.Fact, prov fact.Provenance) {
+	removed := make(map[fact.Key]*fact.Fact, len(lastLocal))
 	for _, f := range lastLocal {
-		removed[fact.KeyOf(f)] = true
+		removed[fact.KeyOf(f)] = f
 	}
 	for _, f := range newLocal {
 		delete(removed, fact.KeyOf(f))
 	}
-	filtered := make([]*fact.Fact, 0, len(chunk)-len(removed))
-	for _, f := range chunk {
-		if !removed[fact.KeyOf(f)] {
-			filtered = append(filtered, f)
-		} else {
-			log.Debug("Pruning removed local fact: %v", f)
+	for _, lf := range removed {
+		f, ok := store.Get(lf)
+		if !ok {
+			continue
+		}
+		prov.Remove(f, fact.LocalSource)
+		prov.Remove(f, fact.ConfigSource)
+		expires, ok := prov.Expires(f)
+		if !ok {
+			logger.Debug("Pruning removed local fact: %v", f)
+			store.Remove(f)
+			continue
+		}
+		if f.Expires.After(expires) {
+			logger.Debug("Keeping removed local fact with remote sources: %v", f)
+			store.Replace(&fact.Fact{
+				Attribute: f.Attribute,
+				Subject:   f.Subject,
+				Value:     f.Value,
+				Expires:   expires,
+			})
 		}
 	}
-	return filtered
 }
 
 func (s *LinkServer) processChunks(
 	newFacts <-chan []*ReceivedFact,
-	factsRefreshed chan<- []*fact.Fact,
+	factsRefreshed chan<- *factSnapshot,
 ) error {
 	defer close(factsRefreshed)
 
-	var currentFacts []*fact.Fact
+	store := fact.NewStore()
 	var lastLocalFacts []*fact.Fact
 
 	for chunk := range newFacts {
-		now := time.Now()
+		now := s.now()
+		// the processing time is measured with the real clock, as it is measuring
+		// our performance, not simulated time
+		start := time.Now()
 
-		uniqueFacts, newLocalFacts, err := s.processOneChunk(currentFacts, lastLocalFacts, chunk, now)
+		snapshot, newLocalFacts, err := s.processOneChunk(store, lastLocalFacts, chunk, now)
 		if err != nil {
 			return err
 		}
+		s.chunkStats.record(time.Since(start), len(snapshot.facts))
 		lastLocalFacts = newLocalFacts
-		currentFacts = uniqueFacts
 
-		factsRefreshed <- uniqueFacts
+		factsRefreshed <- snapshot
 	}
 
 	return nil
 }
 
+// factSnapshot is the fact set after processing a chunk, as it is passed to
+// the later pipeline stages. It is shared between them, and so must not be
+// modified.
+type factSnapshot struct {
+	// facts is all the facts, with the facts about each subject next to each
+	// other, so they can be put in subject groups without sorting them
+	facts []*fact.Fact
+	// byPeer is the same facts, grouped by the key of their subject
+	byPeer map[wgtypes.Key][]*fact.Fact
+	// roster and successors are the facts with those attributes, which are
+	// replaced with the facts they represent before configuring peers
+	roster     []*fact.Fact
+	successors []*fact.Fact
+}
+
+// newFactSnapshot captures the facts in the store, using its indexes instead
+// of grouping and searching all the facts again
+func newFactSnapshot(store *fact.Store) *factSnapshot {
+	byPeer := store.GroupByPeer()
+	keys := make([]wgtypes.Key, 0, len(byPeer))
+	for k := range byPeer {
+		keys = append(keys, k)
+	}
+	// keep the order stable from one chunk to the next
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i][:], keys[j][:]) < 0
+	})
+	facts := make([]*fact.Fact, 0, store.Len())
+	for _, k := range keys {
+		facts = append(facts, byPeer[k]...)
+	}
+	return &factSnapshot{
+		facts:      facts,
+		byPeer:     byPeer,
+		roster:     store.ByAttribute(fact.AttributeRoster),
+		successors: store.ByAttribute(fact.AttributeSuccessor),
+	}
+}
+
+// processOneChunk updates the store with the current local facts and the
+// trusted facts from the chunk, and returns a snapshot of all the facts in it,
+// along with the new local facts. The changes this makes to the store are used
+// to update the other state that depends on the fact set.
 func (s *LinkServer) processOneChunk(
-	currentFacts, lastLocalFacts []*fact.Fact,
+	store *fact.Store,
+	lastLocalFacts []*fact.Fact,
 	chunk []*ReceivedFact,
 	now time.Time,
-) (uniqueFacts, newLocalFacts []*fact.Fact, err error) {
-	// accumulate all the still valid and newly valid facts
-	newFactsChunk := make([]*fact.Fact, 0, len(currentFacts)+len(chunk))
-	// add all the not-expired facts
-	for _, f := range currentFacts {
-		if now.Before(f.Expires) {
-			newFactsChunk = append(newFactsChunk, f)
-		}
-	}
+) (snapshot *factSnapshot, newLocalFacts []*fact.Fact, err error) {
+	// drop everything that has expired
+	store.Expire(now)
+
 	dev, err := s.deviceState()
 	if err != nil {
 		// this probably means the interface is down
@@ -218,55 +314,170 @@ func (s *LinkServer) processOneChunk(
 	}
 	s.UpdateRouterState(dev, true)
 
-	newLocalFacts, err = s.collectFacts(dev, now)
+	prov := s.currentProvenance().Clone()
+	prov.Expire(now)
+
+	var localProv fact.Provenance
+	newLocalFacts, localProv, err = s.collectFacts(dev, now)
 	if err != nil {
-		log.Error("Unable to collect local facts: %v", err)
+		logger.Error("Unable to collect local facts: %v", err)
 	}
 	// might still have gotten something before the error tho
-	if len(newLocalFacts) != 0 {
-		newFactsChunk = append(newFactsChunk, newLocalFacts...)
+	for _, f := range newLocalFacts {
+		store.Upsert(f)
 	}
 	// only prune if we retrieved local facts without error
 	if err == nil {
-		// TODO: this may cause us to remove facts received remotely if we used to
-		// also source them locally, but no longer do, even if they are still valid remotely.
-		// unclear how big an issue this is. at the very least, the remote should
-		// eventually re-send them and we'll re-add them, but it might cause
-		// service disruptions
-		newFactsChunk = pruneRemovedLocalFacts(newFactsChunk, lastLocalFacts, newLocalFacts)
+		// the provenance lets this keep facts we used to source locally, but
+		// which are still valid from other peers
+		pruneRemovedLocalFacts(store, lastLocalFacts, newLocalFacts, prov)
 	} else {
-		// something went wrong keep original even though we appended the new data to the combined chunk
+		// something went wrong keep original even though we added the new data to the store
 		newLocalFacts = lastLocalFacts
 	}
 
-	pl := createFromPeers(dev.Peers...)
+	prov.Merge(localProv)
+
+	pl := createFromPeers(s.scheme, dev.Peers...)
 
 	evaluator := trust.CreateComposite(trust.FirstOnly,
 		// TODO: we can cache the config trust to avoid some re-computation
-		config.CreateTrustEvaluator(s.config.Peers),
-		trust.CreateRouteBasedTrust(dev.Peers),
+		config.CreateTrustEvaluator(s.succeededPeers(), s.scheme),
+		trust.CreateRouteBasedTrust(dev.Peers, s.scheme),
 	)
 	// add all the new not-expired and _trusted_ facts
+	accepted := make([]*ReceivedFact, 0, len(chunk))
 	for _, rf := range chunk {
-		// add to what the peer knows, even if we otherwise discard the information
-		s.peerKnowledge.upsertReceived(rf, pl)
-
 		if now.After(rf.fact.Expires) {
 			continue
 		}
+		if rf.fact.Attribute == fact.AttributeDigest {
+			s.renewFromDigest(store, prov, rf, pl, evaluator, now)
+			continue
+		}
+
+		// add to what the peer knows, even if we otherwise discard the information
+		s.peerKnowledge.upsertReceived(rf, pl)
 
-		level := evaluator.TrustLevel(rf.fact, rf.source)
-		known := evaluator.IsKnown(rf.fact.Subject)
-		if trust.ShouldAccept(rf.fact.Attribute, known, level) {
-			newFactsChunk = append(newFactsChunk, rf.fact)
-			// 	log.Debug("Accepting %v", rf)
-			// } else {
-			// 	log.Debug("Rejecting %v", rf)
+		ok, known, level := s.acceptReceived(rf.fact, rf.source, pl, evaluator, now)
+		if ok {
+			store.Upsert(rf.fact)
+			accepted = append(accepted, rf)
+			if sourceKey, ok := pl.get(rf.source.IP); ok {
+				prov.Add(rf.fact, fact.PeerSource(sourceKey))
+			}
+		}
+		if trustLog.Enabled(log.LevelDebug) {
+			s.logTrustDecision(rf, pl, known, level, ok, now)
 		}
 	}
-	uniqueFacts = fact.MergeList(newFactsChunk)
+	snapshot = newFactSnapshot(store)
+	prov.Trim(snapshot.facts)
+	s.setProvenance(prov)
+
+	s.applyStoreChanges(store.Changes(), snapshot.facts, now)
+	// facts learned this round are fresh for gossip, which has to come after
+	// applying the changes in case a fact was removed and then re-added
+	for _, f := range newLocalFacts {
+		s.gossip.learned(f, 0, now)
+	}
+	for _, rf := range accepted {
+		s.gossip.learned(rf.fact, rf.hops, now)
+	}
+
 	// at this point, ignore any prior error we got
 	err = nil
-	// TODO: log new/removed facts, ignoring TTL
 	return
 }
+
+// acceptReceived decides whether to accept a fact received from a peer into
+// the store, returning whether the subject is known and the source's trust
+// level, if those were needed to decide
+func (s *LinkServer) acceptReceived(
+	f *fact.Fact,
+	source net.UDPAddr,
+	pl peerLookup,
+	evaluator trust.Evaluator,
+	now time.Time,
+) (ok, known bool, level *trust.Level) {
+	switch f.Attribute {
+	case fact.AttributeRoster:
+		// roster pages carry their own signature, so it doesn't matter who sent them
+		ok = s.acceptRosterFact(f, now)
+	case fact.AttributeSuccessor:
+		// successions are only trusted from the key being replaced, not by level
+		sourceKey, fromPeer := pl.get(source.IP)
+		ok = s.acceptSuccessorFact(f, sourceKey, fromPeer)
+	default:
+		level = evaluator.TrustLevel(f, source)
+		known = evaluator.IsKnown(f.Subject)
+		ok = trust.ShouldAccept(f.Attribute, known, level)
+	}
+	return
+}
+
+// applyStoreChanges updates the state that depends on the fact set, based on
+// the changes made to it
+func (s *LinkServer) applyStoreChanges(changes []fact.Change, facts []*fact.Fact, now time.Time) {
+	membershipChanged := false
+	debug := logger.Enabled(log.LevelDebug)
+	for _, c := range changes {
+		switch c.Kind {
+		case fact.ChangeAdded:
+			membershipChanged = true
+		case fact.ChangeExpired, fact.ChangeRemoved:
+			membershipChanged = true
+			s.gossip.forget(c.Fact)
+		default:
+			continue
+		}
+		if debug {
+			logger.Debug("Fact %s: %s", c.Kind, c.Fact.FancyString(s.subjectName, now))
+		}
+	}
+	// digests ignore TTLs, so renewals only change their horizons
+	if membershipChanged {
+		s.digests.update(facts)
+	} else if len(changes) > 0 {
+		s.digests.renew(facts)
+	}
+}
+
+// logTrustDecision emits a structured debug message describing whether a
+// received fact was accepted, and the inputs to that decision
+func (s *LinkServer) logTrustDecision(
+	rf *ReceivedFact,
+	pl peerLookup,
+	known bool,
+	level *trust.Level,
+	accepted bool,
+	now time.Time,
+) {
+	fields := log.Fields{
+		"source":    rf.source.String(),
+		"attribute": string(rune(rf.fact.Attribute)),
+		"value":     rf.fact.Value,
+		"known":     known,
+		"accepted":  accepted,
+		"trust":     "none",
+	}
+	if level != nil {
+		fields["trust"] = *level
+	}
+	if sourceKey, ok := pl.get(rf.source.IP); ok {
+		fields["source_peer"] = s.peerName(sourceKey)
+		fields["source_key"] = sourceKey
+	}
+	if ps, ok := rf.fact.Subject.(*fact.PeerSubject); ok {
+		fields["peer"] = s.peerName(ps.Key)
+		fields["key"] = ps.Key
+	} else {
+		fields["subject"] = rf.fact.Subject
+	}
+	l := trustLog.With(fields)
+	if accepted {
+		l.Debug("Accepted fact %s", rf.fact.FancyString(s.subjectName, now))
+	} else {
+		l.Debug("Rejected fact %s", rf.fact.FancyString(s.subjectName, now))
+	}
+}
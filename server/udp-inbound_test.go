@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"crypto/ed25519"
 	"fmt"
 	"math/rand"
 	"net"
@@ -12,12 +13,15 @@ import (
 	"github.com/fastcat/wirelink/autopeer"
 	"github.com/fastcat/wirelink/config"
 	"github.com/fastcat/wirelink/fact"
+	"github.com/fastcat/wirelink/internal/clock"
 	"github.com/fastcat/wirelink/internal/mocks"
 	"github.com/fastcat/wirelink/internal/networking"
 	netmocks "github.com/fastcat/wirelink/internal/networking/mocks"
 	"github.com/fastcat/wirelink/internal/testutils"
 	"github.com/fastcat/wirelink/internal/testutils/facts"
+	"github.com/fastcat/wirelink/roster"
 	"github.com/fastcat/wirelink/signing"
+	"github.com/fastcat/wirelink/trust"
 	"github.com/fastcat/wirelink/util"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -289,6 +293,32 @@ func TestLinkServer_processSignedGroup(t *testing.T) {
 				rf(facts.EndpointFactFull(properSource, &remotePubKey, expires)),
 			},
 		},
+		{
+			"echo consumed",
+			fields{
+				signer: localSigner,
+			},
+			args{
+				&fact.Fact{
+					Attribute: fact.AttributeSignedGroup,
+					Subject:   &fact.PeerSubject{Key: remotePubKey},
+					Value: svgFromFacts(
+						facts.AliveFact(&remotePubKey, expires),
+						&fact.Fact{
+							Attribute: fact.AttributeEchoReply,
+							Subject:   &fact.PeerSubject{Key: remotePubKey},
+							Value:     &fact.EchoValue{Sequence: 1, Sent: now},
+							Expires:   expires,
+						},
+					),
+				},
+				properSource,
+			},
+			require.NoError,
+			[]*ReceivedFact{
+				rf(facts.AliveFact(&remotePubKey, expires)),
+			},
+		},
 		{
 			"corrupt",
 			fields{
@@ -388,8 +418,8 @@ func TestLinkServer_chunkPackets(t *testing.T) {
 		for len(randRfs) <= index {
 			k := testutils.MustKey(t)
 			randRfs = append(randRfs, &ReceivedFact{
-				facts.AliveFact(&k, expires),
-				*testutils.RandUDP4Addr(t),
+				fact:   facts.AliveFact(&k, expires),
+				source: *testutils.RandUDP4Addr(t),
 			})
 		}
 		return randRfs[index]
@@ -473,8 +503,8 @@ func TestLinkServer_chunkPackets_slow(t *testing.T) {
 		for len(randRfs) <= index {
 			k := testutils.MustKey(t)
 			randRfs = append(randRfs, &ReceivedFact{
-				facts.AliveFact(&k, expires),
-				*testutils.RandUDP4Addr(t),
+				fact:   facts.AliveFact(&k, expires),
+				source: *testutils.RandUDP4Addr(t),
 			})
 		}
 		return randRfs[index]
@@ -663,27 +693,78 @@ func TestLinkServer_chunkPackets_slow(t *testing.T) {
 	}
 }
 
+func TestLinkServer_chunkPackets_fakeClock(t *testing.T) {
+	now := time.Now()
+	k := testutils.MustKey(t)
+	rf := &ReceivedFact{
+		fact:   facts.AliveFact(&k, now.Add(DefaultFactTTL)),
+		source: *testutils.RandUDP4Addr(t),
+	}
+
+	fc := clock.NewFake(now)
+	s := &LinkServer{ChunkPeriod: time.Hour}
+	s.UseClock(fc)
+
+	packets := make(chan *ReceivedFact, 1)
+	newFacts := make(chan []*ReceivedFact, 1)
+	eg := &errgroup.Group{}
+	eg.Go(func() error { return s.chunkPackets(packets, newFacts, 10) })
+
+	// the priming chunk is sent after the ticker is started
+	assert.Empty(t, <-newFacts)
+	require.Equal(t, 1, fc.Tickers())
+
+	packets <- rf
+	// simulated hours pass immediately, the first one may tick before the
+	// packet is buffered
+	var chunk []*ReceivedFact
+	for i := 0; i < 10 && len(chunk) == 0; i++ {
+		fc.Advance(time.Hour)
+		select {
+		case chunk = <-newFacts:
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	assert.Equal(t, []*ReceivedFact{rf}, chunk)
+
+	close(packets)
+	require.NoError(t, eg.Wait())
+}
+
 func Test_pruneRemovedLocalFacts(t *testing.T) {
 	now := time.Now()
 	expires := now.Add(DefaultFactTTL)
+	remoteExpires := now.Add(DefaultFactTTL / 2)
 
 	k1 := testutils.MustKey(t)
 	k2 := testutils.MustKey(t)
+	k3 := testutils.MustKey(t)
+
+	provFor := func(f *fact.Fact, sources ...fact.Source) fact.Provenance {
+		prov := make(fact.Provenance)
+		for _, s := range sources {
+			prov.Add(f, s)
+		}
+		return prov
+	}
 
 	type args struct {
 		chunk     []*fact.Fact
 		lastLocal []*fact.Fact
 		newLocal  []*fact.Fact
+		prov      fact.Provenance
 	}
 	tests := []struct {
-		name string
-		args args
-		want []*fact.Fact
+		name     string
+		args     args
+		want     []*fact.Fact
+		wantProv fact.Provenance
 	}{
 		{
 			"empty",
 			args{},
 			[]*fact.Fact{},
+			nil,
 		},
 		{
 			"remote only",
@@ -695,77 +776,140 @@ func Test_pruneRemovedLocalFacts(t *testing.T) {
 			[]*fact.Fact{
 				facts.AliveFact(&k1, expires),
 			},
+			nil,
 		},
 		{
 			"retained local in chunk",
 			args{
-				[]*fact.Fact{
-					facts.AliveFact(&k1, expires),
-				},
-				[]*fact.Fact{
-					facts.AliveFact(&k1, expires),
-				},
-				[]*fact.Fact{
-					facts.AliveFact(&k1, expires),
-				},
+				chunk:     []*fact.Fact{facts.AliveFact(&k1, expires)},
+				lastLocal: []*fact.Fact{facts.AliveFact(&k1, expires)},
+				newLocal:  []*fact.Fact{facts.AliveFact(&k1, expires)},
 			},
 			[]*fact.Fact{
 				facts.AliveFact(&k1, expires),
 			},
+			nil,
 		},
 		{
 			"retained local not in chunk",
 			args{
-				[]*fact.Fact{
-					facts.AliveFact(&k2, expires),
-				},
-				[]*fact.Fact{
-					facts.AliveFact(&k1, expires),
-				},
-				[]*fact.Fact{
-					facts.AliveFact(&k1, expires),
-				},
+				chunk:     []*fact.Fact{facts.AliveFact(&k2, expires)},
+				lastLocal: []*fact.Fact{facts.AliveFact(&k1, expires)},
+				newLocal:  []*fact.Fact{facts.AliveFact(&k1, expires)},
 			},
 			[]*fact.Fact{
 				facts.AliveFact(&k2, expires),
 			},
+			nil,
 		},
 		{
 			"removed local in chunk",
 			args{
-				[]*fact.Fact{
-					facts.AliveFact(&k1, expires),
-				},
-				[]*fact.Fact{
-					facts.AliveFact(&k1, expires),
-				},
-				[]*fact.Fact{},
+				chunk:     []*fact.Fact{facts.AliveFact(&k1, expires)},
+				lastLocal: []*fact.Fact{facts.AliveFact(&k1, expires)},
+				newLocal:  []*fact.Fact{},
 			},
 			[]*fact.Fact{},
+			nil,
 		},
 		{
 			"removed local not in chunk",
 			args{
-				[]*fact.Fact{
-					facts.AliveFact(&k1, expires),
-				},
-				[]*fact.Fact{
-					facts.AliveFact(&k2, expires),
-				},
-				[]*fact.Fact{},
+				chunk:     []*fact.Fact{facts.AliveFact(&k1, expires)},
+				lastLocal: []*fact.Fact{facts.AliveFact(&k2, expires)},
+				newLocal:  []*fact.Fact{},
 			},
 			[]*fact.Fact{
 				facts.AliveFact(&k1, expires),
 			},
+			nil,
+		},
+		{
+			"removed local only",
+			args{
+				chunk:     []*fact.Fact{facts.AliveFact(&k1, expires)},
+				lastLocal: []*fact.Fact{facts.AliveFact(&k1, expires)},
+				newLocal:  []*fact.Fact{},
+				prov:      provFor(facts.AliveFact(&k1, expires), fact.LocalSource, fact.ConfigSource),
+			},
+			[]*fact.Fact{},
+			fact.Provenance{},
+		},
+		{
+			"removed local still remote",
+			args{
+				chunk:     []*fact.Fact{facts.AliveFact(&k1, expires)},
+				lastLocal: []*fact.Fact{facts.AliveFact(&k1, expires)},
+				newLocal:  []*fact.Fact{},
+				prov: func() fact.Provenance {
+					prov := provFor(facts.AliveFact(&k1, expires), fact.LocalSource)
+					prov.Add(facts.AliveFact(&k1, remoteExpires), fact.PeerSource(k3))
+					return prov
+				}(),
+			},
+			[]*fact.Fact{
+				facts.AliveFact(&k1, remoteExpires),
+			},
+			provFor(facts.AliveFact(&k1, remoteExpires), fact.PeerSource(k3)),
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			assert.Equal(t, tt.want, pruneRemovedLocalFacts(tt.args.chunk, tt.args.lastLocal, tt.args.newLocal))
+			store := storeOf(tt.args.chunk...)
+			pruneRemovedLocalFacts(store, tt.args.lastLocal, tt.args.newLocal, tt.args.prov)
+			assert.Equal(t, tt.want, store.Facts())
+			if tt.wantProv != nil {
+				assert.Equal(t, tt.wantProv, tt.args.prov)
+			}
 		})
 	}
 }
 
+// storeOf makes a fact store with the given facts in it, and no pending changes
+func storeOf(facts ...*fact.Fact) *fact.Store {
+	store := fact.NewStore()
+	for _, f := range facts {
+		store.Upsert(f)
+	}
+	store.Changes()
+	return store
+}
+
+func snapshotOf(facts ...*fact.Fact) *factSnapshot {
+	return newFactSnapshot(storeOf(facts...))
+}
+
+func Test_newFactSnapshot(t *testing.T) {
+	expires := time.Now().Add(DefaultFactTTL)
+	k1 := testutils.MustKey(t)
+	k2 := testutils.MustKey(t)
+	k3 := testutils.MustKey(t)
+	ep1 := facts.EndpointFactFull(testutils.RandUDP4Addr(t), &k1, expires)
+	ep2 := facts.EndpointFactFull(testutils.RandUDP4Addr(t), &k2, expires)
+	m1 := memberFact(k1, expires)
+	succ := successorFact(k2, k3, expires)
+
+	snapshot := snapshotOf(ep1, ep2, m1, succ)
+	assert.ElementsMatch(t, []*fact.Fact{ep1, ep2, m1, succ}, snapshot.facts)
+	assert.Len(t, snapshot.byPeer, 2)
+	assert.ElementsMatch(t, []*fact.Fact{ep1, m1}, snapshot.byPeer[k1])
+	assert.ElementsMatch(t, []*fact.Fact{ep2, succ}, snapshot.byPeer[k2])
+	assert.Empty(t, snapshot.roster)
+	assert.Equal(t, []*fact.Fact{succ}, snapshot.successors)
+
+	// facts about each subject are together in the flat list
+	seen := make(map[wgtypes.Key]bool)
+	var last wgtypes.Key
+	for _, f := range snapshot.facts {
+		k := f.Subject.(*fact.PeerSubject).Key
+		if k != last {
+			assert.False(t, seen[k], "facts about %s should be together", k)
+			seen[k] = true
+			last = k
+		}
+	}
+}
+
 func TestLinkServer_processOneChunk(t *testing.T) {
 	now := time.Now()
 	expires := now.Add(DefaultFactTTL)
@@ -780,6 +924,17 @@ func TestLinkServer_processOneChunk(t *testing.T) {
 	}
 	alternateEndpoint := testutils.RandUDP4Addr(t)
 
+	rosterPriv, err := roster.GenerateKey()
+	require.NoError(t, err)
+	rosterRoot := rosterPriv.Public().(ed25519.PublicKey)
+	forgedPriv, err := roster.GenerateKey()
+	require.NoError(t, err)
+	rosterMembers := []roster.Member{{PublicKey: testutils.MustKey(t), Name: "alice"}}
+	rosterPage := mustRosterFacts(t, rosterPriv, rosterRoot, 1, expires.Add(time.Hour), rosterMembers, expires)[0]
+	ownSuccessor := successorFact(remoteKey, testutils.MustKey(t), expires)
+	otherSuccessor := successorFact(testutils.MustKey(t), testutils.MustKey(t), expires)
+	forgedPage := mustRosterFacts(t, forgedPriv, rosterRoot, 2, expires.Add(time.Hour), rosterMembers, expires)[0]
+
 	rf := func(f *fact.Fact) *ReceivedFact {
 		return &ReceivedFact{
 			fact:   f,
@@ -877,6 +1032,68 @@ func TestLinkServer_processOneChunk(t *testing.T) {
 			nil,
 			require.NoError,
 		},
+		{
+			"received roster pages",
+			fields{
+				&config.Server{Iface: wgIface, RosterKey: rosterRoot},
+				&netmocks.Environment{},
+				mockDevice(&wgtypes.Device{
+					Peers: []wgtypes.Peer{
+						{
+							PublicKey:  remoteKey,
+							AllowedIPs: []net.IPNet{autopeer.AutoAddressNet(remoteKey)},
+						},
+					},
+				}),
+				nil,
+			},
+			args{
+				chunk: []*ReceivedFact{
+					rf(rosterPage),
+					rf(forgedPage),
+				},
+			},
+			[]*fact.Fact{
+				rosterPage,
+			},
+			nil,
+			require.NoError,
+		},
+		{
+			"received successors",
+			fields{
+				&config.Server{
+					Iface: wgIface,
+					Peers: config.Peers{remoteKey: &config.Peer{Trust: trust.Ptr(trust.Membership)}},
+				},
+				&netmocks.Environment{},
+				mockDevice(&wgtypes.Device{
+					Peers: []wgtypes.Peer{
+						{
+							PublicKey:  remoteKey,
+							AllowedIPs: []net.IPNet{autopeer.AutoAddressNet(remoteKey)},
+						},
+					},
+				}),
+				nil,
+			},
+			args{
+				chunk: []*ReceivedFact{
+					// a peer can name its own successor
+					rf(ownSuccessor),
+					// but not that of another peer, even as a Membership source
+					rf(otherSuccessor),
+				},
+			},
+			[]*fact.Fact{
+				memberFact(remoteKey, expires),
+				ownSuccessor,
+			},
+			[]*fact.Fact{
+				memberFact(remoteKey, expires),
+			},
+			require.NoError,
+		},
 		{
 			"merge new remote with new local endpoint",
 			fields{
@@ -989,12 +1206,61 @@ func TestLinkServer_processOneChunk(t *testing.T) {
 				FactTTL:       DefaultFactTTL,
 				ChunkPeriod:   DefaultChunkPeriod,
 			}
-			gotUniqueFacts, gotNewLocalFacts, err := s.processOneChunk(tt.args.currentFacts, tt.args.lastLocalFacts, tt.args.chunk, now)
+			gotSnapshot, gotNewLocalFacts, err := s.processOneChunk(storeOf(tt.args.currentFacts...), tt.args.lastLocalFacts, tt.args.chunk, now)
 			tt.assertion(t, err)
 			ctrl.AssertExpectations(t)
 			tt.fields.net.AssertExpectations(t)
-			assert.Equal(t, tt.wantUniqueFacts, gotUniqueFacts)
+			var gotUniqueFacts []*fact.Fact
+			if gotSnapshot != nil {
+				gotUniqueFacts = gotSnapshot.facts
+			}
+			assert.ElementsMatch(t, tt.wantUniqueFacts, gotUniqueFacts)
 			assert.Equal(t, tt.wantNewLocalFacts, gotNewLocalFacts)
+			prov := s.currentProvenance()
+			for _, f := range gotUniqueFacts {
+				assert.NotEmpty(t, prov.Sources(f), "fact should have a source: %v", f)
+			}
+			assert.Len(t, prov, len(gotUniqueFacts), "provenance should be trimmed")
 		})
 	}
 }
+
+func TestLinkServer_applyStoreChanges(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(DefaultFactTTL)
+	k := testutils.MustKey(t)
+	addr := testutils.RandUDP4Addr(t)
+	ep := facts.EndpointFactFull(addr, &k, expires)
+	renewed := facts.EndpointFactFull(addr, &k, expires.Add(time.Second))
+
+	s := &LinkServer{
+		config:  &config.Server{},
+		digests: newDigestTracker(),
+		gossip:  newGossipTracker(1),
+	}
+	store := fact.NewStore()
+
+	store.Upsert(ep)
+	s.applyStoreChanges(store.Changes(), store.Facts(), now)
+	digest, horizons := s.digests.current()
+	require.Contains(t, digest, k)
+	assert.Equal(t, expires, horizons[k])
+
+	// renewals don't change the digests, only their horizons
+	s.gossip.learned(ep, 0, now)
+	store.Upsert(renewed)
+	s.applyStoreChanges(store.Changes(), store.Facts(), now)
+	gotDigest, horizons := s.digests.current()
+	assert.Equal(t, digest, gotDigest)
+	assert.Equal(t, renewed.Expires, horizons[k])
+	_, fresh := s.gossip.fresh(ep, now, time.Second)
+	assert.True(t, fresh)
+
+	store.Expire(expires.Add(time.Hour))
+	s.applyStoreChanges(store.Changes(), store.Facts(), now)
+	digest, horizons = s.digests.current()
+	assert.Empty(t, digest)
+	assert.Empty(t, horizons)
+	_, fresh = s.gossip.fresh(ep, now, time.Second)
+	assert.False(t, fresh, "expired facts should be forgotten")
+}
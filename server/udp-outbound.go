@@ -10,16 +10,14 @@ import (
 	"golang.org/x/sync/errgroup"
 
 	"github.com/fastcat/wirelink/apply"
-	"github.com/fastcat/wirelink/autopeer"
 	"github.com/fastcat/wirelink/detect"
 	"github.com/fastcat/wirelink/fact"
-	"github.com/fastcat/wirelink/log"
 	"github.com/fastcat/wirelink/trust"
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-func (s *LinkServer) broadcastFactUpdates(factsRefreshed <-chan []*fact.Fact) error {
+func (s *LinkServer) broadcastFactUpdates(factsRefreshed <-chan *factSnapshot) error {
 	// TODO: naming here is confusing with the `newFacts` channel
 	for newFacts := range factsRefreshed {
 		dev, err := s.deviceState()
@@ -35,15 +33,15 @@ func (s *LinkServer) broadcastFactUpdates(factsRefreshed <-chan []*fact.Fact) er
 	return nil
 }
 
-func (s *LinkServer) broadcastFactUpdatesOnce(newFacts []*fact.Fact, dev *wgtypes.Device) {
-	now := time.Now()
-	_, errs := s.broadcastFacts(dev.PublicKey, dev.Peers, newFacts, now, s.ChunkPeriod-time.Second)
+func (s *LinkServer) broadcastFactUpdatesOnce(newFacts *factSnapshot, dev *wgtypes.Device) {
+	now := s.now()
+	_, errs := s.broadcastFacts(dev.PublicKey, dev.Peers, newFacts.facts, now, s.ChunkPeriod-time.Second)
 	if errs != nil {
 		// don't print more than a handful of errors
 		if len(errs) > 5 {
-			log.Error("Failed to send some facts: %v ...", errs)
+			logger.Error("Failed to send some facts: %v ...", errs)
 		} else {
-			log.Error("Failed to send some facts: %v", errs)
+			logger.Error("Failed to send some facts: %v", errs)
 		}
 	}
 }
@@ -56,11 +54,11 @@ const (
 	sendFacts
 )
 
-func (s *LinkServer) shouldSendTo(p *wgtypes.Peer) sendLevel {
+func (s *LinkServer) shouldSendTo(p *wgtypes.Peer, now time.Time) sendLevel {
 	// don't try to send info to the peer if the wireguard interface doesn't have
 	// an endpoint for it: this will just get rejected by the kernel
 	if p.Endpoint == nil {
-		log.Debug("Don't send to %s: no wg endpoint", s.peerName(p.PublicKey))
+		logger.Debug("Don't send to %s: no wg endpoint", s.peerName(p.PublicKey))
 		return sendNothing
 	}
 
@@ -82,7 +80,7 @@ func (s *LinkServer) shouldSendTo(p *wgtypes.Peer) sendLevel {
 
 	// if neither end is special or chatty, just send pings to keep the connection alive
 	if !s.config.Chatty && !s.config.IsRouterNow {
-		log.Debug("Don't send to %s: not special, not chatty, not router", s.peerName(p.PublicKey))
+		logger.Debug("Don't send to %s: not special, not chatty, not router", s.peerName(p.PublicKey))
 		return sendPing
 	}
 
@@ -92,7 +90,7 @@ func (s *LinkServer) shouldSendTo(p *wgtypes.Peer) sendLevel {
 	// and only fall back on nothing if we don't think we can make a connection
 
 	// if the handshake is healthy (and we are chatty and/or router), send all our info to the peer
-	if apply.IsHandshakeHealthy(p.LastHandshakeTime) {
+	if apply.IsHandshakeHealthy(p.LastHandshakeTime, now) {
 		return sendFacts
 	}
 
@@ -101,41 +99,59 @@ func (s *LinkServer) shouldSendTo(p *wgtypes.Peer) sendLevel {
 	return sendPing
 }
 
-func (s *LinkServer) prepareFactsForPeer(p *wgtypes.Peer, facts []*fact.Fact, ga *fact.GroupAccumulator) {
+func (s *LinkServer) prepareFactsForPeer(
+	p *wgtypes.Peer,
+	facts []*fact.Fact,
+	tellEndpoints bool,
+	ga *fact.GroupAccumulator,
+	now time.Time,
+) {
 	for _, f := range facts {
 		// don't tell peers things about themselves
-		// they won't accept it unless we are a router,
-		// the only way this would be useful would be to tell them their external endpoint,
-		// but that's only useful if they can tell others and we can't, but if they can tell others,
-		// then those others don't need to know it because they are already connected
+		// they won't accept it unless we are a router, and the only thing that is
+		// useful is their external endpoint, which lets them detect they are
+		// behind NAT
 		if ps, ok := f.Subject.(*fact.PeerSubject); ok && *ps == (fact.PeerSubject{Key: p.PublicKey}) {
-			continue
+			if !tellEndpoints || (f.Attribute != fact.AttributeEndpointV4 && f.Attribute != fact.AttributeEndpointV6) {
+				continue
+			}
 		}
 		// don't tell peers other things they already know
-		if !s.peerKnowledge.peerNeeds(p, f, s.ChunkPeriod+time.Second) {
-			// log.Debug("Peer %s already knows %v", s.peerName(p.PublicKey), f)
+		if !s.peerKnowledge.peerNeeds(p, f, s.refreshWindow(p.PublicKey, f), now) {
+			// logger.Debug("Peer %s already knows %v", s.peerName(p.PublicKey), f)
 			continue
 		}
 		err := ga.AddFact(f)
 		if err != nil {
-			log.Error("Unable to add fact to group: %v", err)
+			logger.Error("Unable to add fact to group: %v", err)
 		} else {
-			log.Debug("Peer %s needs %v", s.peerName(p.PublicKey), f)
-			// assume we will successfully send and peer will accept the info
-			// if these assumptions are wrong, re-sending more often is unlikely to help
+			logger.Debug("Peer %s needs %v", s.peerName(p.PublicKey), f)
+			// assume we will successfully send and peer will accept the info,
+			// for peers that support acks this will be checked when they reply
 			s.peerKnowledge.upsertSent(p, f)
 		}
 	}
 }
 
-func (s *LinkServer) addPingFor(p *wgtypes.Peer, ping *fact.Fact, ga *fact.GroupAccumulator) {
+// refreshWindow returns how long before a peer would forget a fact we should
+// send it again. Peers that exchange digests with us renew the facts about
+// subjects where our digests match, so those are only sent again if the peer
+// actually forgets them.
+func (s *LinkServer) refreshWindow(peer wgtypes.Key, f *fact.Fact) time.Duration {
+	if ps, ok := f.Subject.(*fact.PeerSubject); ok && fact.Digestible(f) && s.digests.synced(peer, ps.Key) {
+		return 0
+	}
+	return s.ChunkPeriod + time.Second
+}
+
+func (s *LinkServer) addPingFor(p *wgtypes.Peer, ping *fact.Fact, ga *fact.GroupAccumulator, now time.Time) {
 	var addedPing bool
 	var addPingErr error
 	// we want alive facts to live for the normal FactTTL, but we want to send them every AlivePeriod
 	// so the "forgetting window" is the difference between those
 	// we don't need to add the extra ChunkPeriod+1 buffer in this case
-	if s.peerKnowledge.peerNeeds(p, ping, s.FactTTL-s.AlivePeriod) {
-		log.Debug("Peer %s needs ping", s.peerName(p.PublicKey))
+	if s.peerKnowledge.peerNeeds(p, ping, s.FactTTL-s.AlivePeriod, now) {
+		logger.Debug("Peer %s needs ping", s.peerName(p.PublicKey))
 		addPingErr = ga.AddFact(ping)
 		addedPing = true
 	} else {
@@ -144,11 +160,11 @@ func (s *LinkServer) addPingFor(p *wgtypes.Peer, ping *fact.Fact, ga *fact.Group
 		// so that we don't send another packet again quite so soon
 		addedPing, addPingErr = ga.AddFactIfRoom(ping)
 		if addedPing {
-			log.Debug("Opportunistically sending ping to %s", s.peerName(p.PublicKey))
+			logger.Debug("Opportunistically sending ping to %s", s.peerName(p.PublicKey))
 		}
 	}
 	if addPingErr != nil {
-		log.Error("Unable to add ping fact to group: %v", addPingErr)
+		logger.Error("Unable to add ping fact to group: %v", addPingErr)
 	} else if addedPing {
 		// assume we will successfully send and peer will accept the info
 		// if these assumptions are wrong, re-sending more often is unlikely to help
@@ -158,6 +174,9 @@ func (s *LinkServer) addPingFor(p *wgtypes.Peer, ping *fact.Fact, ga *fact.Group
 
 // broadcastFacts tries to send every fact to every peer
 // it returns the number of sends performed
+// the facts about each subject should be next to each other, as they are in a
+// factSnapshot, so they can share a subject group for peers that understand the
+// compact encoding
 func (s *LinkServer) broadcastFacts(
 	self wgtypes.Key,
 	peers []wgtypes.Peer,
@@ -178,34 +197,136 @@ func (s *LinkServer) broadcastFacts(
 		Expires:   now.Add(s.FactTTL),
 	}
 
+	levels := make([]sendLevel, len(peers))
+	for i := range peers {
+		levels[i] = s.shouldSendTo(&peers[i], now)
+	}
+	// routers tell peers the endpoints they see them at
+	s.stateAccess.Lock()
+	tellEndpoints := s.config.IsRouterNow
+	s.stateAccess.Unlock()
+	gossipTo := s.gossipTargets(peers, levels, now)
+	votes := s.makeVoteFacts(self, facts, now)
+	// successions are only accepted directly from the key being replaced, so we
+	// only send our own, and send it to peers that only get pings too
+	facts = withoutRelayedSuccessions(self, facts)
+	successions := s.successionFacts(self, now.Add(s.FactTTL))
+
+	present := make(map[wgtypes.Key]bool, len(peers))
 	for i := range peers {
 		// avoid closure binding problems
 		p := &peers[i]
+		present[p.PublicKey] = true
 
-		sendLevel := s.shouldSendTo(p)
+		sendLevel := levels[i]
 		if sendLevel == sendNothing {
 			continue
 		}
 
-		ga := fact.NewAccumulator(fact.SignedGroupMaxSafeInnerLength, now)
+		// size the groups for what we know gets through to the peer
+		ga := s.newAccumulator(p.PublicKey, fact.SignedGroupMaxInnerLength(s.paths.payload(p.PublicKey)), now)
 
 		if sendLevel >= sendFacts {
-			s.prepareFactsForPeer(p, facts, ga)
+			s.prepareFactsForPeer(p, facts, tellEndpoints, ga, now)
 		}
 
-		s.addPingFor(p, ping, ga)
+		s.addPingFor(p, ping, ga, now)
 
-		signedGroupFacts, err := ga.MakeSignedGroups(s.signer, &p.PublicKey)
+		signedGroupFacts, contents, err := ga.MakeSignedGroupsWithContents(s.signer, &p.PublicKey)
 		if err != nil {
-			log.Error("Unable to sign groups: %v", err)
+			logger.Error("Unable to sign groups: %v", err)
 			continue
 		}
+		// spread recently learned facts to a few random peers that aren't
+		// getting all our facts anyways
+		if gossipTo[p.PublicKey] {
+			gossipGroups, gossipContents, err := s.makeGossipGroups(p, facts, now)
+			if err != nil {
+				logger.Error("Unable to make gossip groups: %v", err)
+			} else {
+				signedGroupFacts = append(signedGroupFacts, gossipGroups...)
+				contents = append(contents, gossipContents...)
+			}
+		}
+		for j, sgf := range signedGroupFacts {
+			s.peerKnowledge.sentGroup(p.PublicKey, sgf, contents[j], now)
+		}
+
+		// find out which peers we can gossip to, only when we're sending them
+		// something anyways
+		if len(signedGroupFacts) > 0 && s.gossipEnabled() && sendLevel == sendPing &&
+			apply.IsHandshakeHealthy(p.LastHandshakeTime, now) &&
+			s.gossip.helloDue(p.PublicKey, now, s.AlivePeriod) {
+			hello, err := s.signStandalone(p.PublicKey, s.gossipMarker(0, now), now)
+			if err != nil {
+				logger.Error("Unable to sign gossip hello: %v", err)
+			} else {
+				signedGroupFacts = append(signedGroupFacts, hello...)
+			}
+		}
+
+		// tell peers that only get pings that we are being replaced, when we're
+		// sending them something anyways
+		if len(signedGroupFacts) > 0 && sendLevel == sendPing {
+			for _, sf := range successions {
+				groups, err := s.signStandalone(p.PublicKey, sf, now)
+				if err != nil {
+					logger.Error("Unable to sign succession: %v", err)
+				} else {
+					signedGroupFacts = append(signedGroupFacts, groups...)
+				}
+			}
+		}
+
+		// let peers that might support acks know that we do too, but only when
+		// we're sending them something anyways
+		if len(signedGroupFacts) > 0 && s.peerKnowledge.ackState().helloDue(p.PublicKey, now, s.AlivePeriod) {
+			hello, err := s.signStandalone(p.PublicKey, s.ackFact(groupNonce{}, now), now)
+			if err != nil {
+				logger.Error("Unable to sign ack hello: %v", err)
+			} else {
+				signedGroupFacts = append(signedGroupFacts, hello...)
+			}
+		}
+
+		// find out if the peer understands the compact encoding, only when
+		// we're sending it something anyways
+		if len(signedGroupFacts) > 0 && s.compact.helloDue(p.PublicKey, now, s.AlivePeriod) {
+			hello, err := fact.MakeCompactHello(s.signer, &p.PublicKey)
+			if err != nil {
+				logger.Error("Unable to sign compact hello: %v", err)
+			} else {
+				signedGroupFacts = append(signedGroupFacts, hello)
+			}
+		}
 
-		// log.Debug("Sending %d SGFs to %s", len(signedGroupFacts), s.peerName(p.PublicKey))
+		// periodically send digests so the peer can tell if it is missing
+		// anything, or if we are
+		if sendLevel >= sendFacts && s.digests.due(p.PublicKey, now, s.AlivePeriod) {
+			digests, err := s.makeDigestGroups(p.PublicKey, now)
+			if err != nil {
+				logger.Error("Unable to make digest groups: %v", err)
+			} else {
+				signedGroupFacts = append(signedGroupFacts, digests...)
+			}
+		}
+
+		// Membership sources send their votes directly, even to peers that only get
+		// pings, as relayed membership facts don't count towards a quorum
+		if len(votes) != 0 && s.votes.due(p.PublicKey, now, s.AlivePeriod) {
+			voteGroups, err := s.makeVoteGroups(p.PublicKey, votes, now)
+			if err != nil {
+				logger.Error("Unable to make vote groups: %v", err)
+			} else {
+				signedGroupFacts = append(signedGroupFacts, voteGroups...)
+			}
+		}
+
+		// logger.Debug("Sending %d SGFs to %s", len(signedGroupFacts), s.peerName(p.PublicKey))
 		for j := range signedGroupFacts {
 			sgf := signedGroupFacts[j]
 			sg.Go(func() error {
-				// log.Debug("Sending SGF of length %d to %s", len(sgf.Value.(*fact.SignedGroupValue).InnerBytes), s.peerName(p.PublicKey))
+				// logger.Debug("Sending SGF of length %d to %s", len(sgf.Value.(*fact.SignedGroupValue).InnerBytes), s.peerName(p.PublicKey))
 				err := s.sendFact(p, sgf, now)
 				errs <- err
 				return err
@@ -213,6 +334,10 @@ func (s *LinkServer) broadcastFacts(
 		}
 	}
 
+	s.digests.trim(func(k wgtypes.Key) bool { return present[k] })
+	s.compact.trim(func(k wgtypes.Key) bool { return present[k] })
+	s.votes.trim(func(k wgtypes.Key) bool { return present[k] })
+
 	var wg errgroup.Group
 	var counter int32
 	var errlist []error
@@ -246,7 +371,7 @@ func (s *LinkServer) sendFact(peer *wgtypes.Peer, f *fact.Fact, now time.Time) e
 		return err
 	}
 	addr := net.UDPAddr{
-		IP: autopeer.AutoAddress(peer.PublicKey),
+		IP: s.scheme.Address(peer.PublicKey),
 		// NOTE: we assume peers use the same port we do
 		Port: s.addr.Port,
 		Zone: s.addr.Zone,
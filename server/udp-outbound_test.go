@@ -25,6 +25,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
@@ -158,7 +159,7 @@ func TestLinkServer_shouldSendTo(t *testing.T) {
 				stateAccess: &sync.Mutex{},
 				peerConfig:  newPeerConfigSet(),
 			}
-			assert.Equal(t, tt.want, s.shouldSendTo(tt.args.p))
+			assert.Equal(t, tt.want, s.shouldSendTo(tt.args.p, now))
 		})
 	}
 }
@@ -230,6 +231,40 @@ func TestLinkServer_broadcastFacts(t *testing.T) {
 		).Return(len(sgvBytes), nil)
 	}
 
+	helloServer := &LinkServer{signer: signing.New(&localPrivateKey), ChunkPeriod: DefaultChunkPeriod}
+	helloGroups, err := helloServer.signStandalone(remotePublicKey, helloServer.ackFact(groupNonce{}, now), now)
+	require.Nil(t, err)
+	require.Len(t, helloGroups, 1)
+	helloLen := len(util.MustBytes(helloGroups[0].MarshalBinaryNow(now)))
+	expectHello := func(t *testing.T, conn *netmocks.UDPConn) *mock.Call {
+		dest := &net.UDPAddr{
+			IP:   autopeer.AutoAddress(remotePublicKey),
+			Port: port,
+			Zone: wgIface,
+		}
+		checkHello := func(packet []byte) bool {
+			f := &fact.Fact{}
+			if err := f.DecodeFrom(0, now, bytes.NewBuffer(packet)); err != nil {
+				return false
+			}
+			pSGV, ok := f.Value.(*fact.SignedGroupValue)
+			if !ok {
+				return false
+			}
+			inner, err := pSGV.ParseInner(now)
+			if err != nil || len(inner) != 1 || inner[0].Attribute != fact.AttributeAck {
+				return false
+			}
+			av, ok := inner[0].Value.(*fact.AckValue)
+			return ok && av.Nonce == groupNonce{}
+		}
+		return conn.On(
+			"WriteToUDP",
+			mock.MatchedBy(checkHello),
+			dest,
+		).Return(helloLen, nil).Once()
+	}
+
 	type fields struct {
 		bootID        uuid.UUID
 		config        *config.Server
@@ -297,6 +332,7 @@ func TestLinkServer_broadcastFacts(t *testing.T) {
 					ret := &netmocks.UDPConn{}
 					expectSWD(ret)
 					expectSGVOf(t, ret, facts.AliveFactFull(&localPublicKey, expires, bootID))
+					expectHello(t, ret)
 					return ret
 				},
 				net.UDPAddr{
@@ -321,7 +357,7 @@ func TestLinkServer_broadcastFacts(t *testing.T) {
 				now,
 				timeout,
 			},
-			1,
+			2,
 			nil,
 		},
 		{
@@ -343,6 +379,7 @@ func TestLinkServer_broadcastFacts(t *testing.T) {
 						facts.EndpointFactFull(localEP, &localPublicKey, expires),
 						facts.AliveFactFull(&localPublicKey, expires, bootID),
 					)
+					expectHello(t, ret)
 					return ret
 				},
 				net.UDPAddr{
@@ -369,7 +406,7 @@ func TestLinkServer_broadcastFacts(t *testing.T) {
 				now,
 				timeout,
 			},
-			1,
+			2,
 			nil,
 		},
 		{
@@ -428,6 +465,7 @@ func TestLinkServer_broadcastFacts(t *testing.T) {
 						facts.EndpointFactFull(localEP, &localPublicKey, expires),
 						facts.AliveFactFull(&localPublicKey, expires, bootID),
 					)
+					expectHello(t, ret)
 					return ret
 				},
 				net.UDPAddr{
@@ -458,7 +496,53 @@ func TestLinkServer_broadcastFacts(t *testing.T) {
 				now,
 				timeout,
 			},
-			1,
+			2,
+			nil,
+		},
+		{
+			"router tells peer its endpoint",
+			fields{
+				bootID,
+				&config.Server{
+					Iface:       wgIface,
+					IsRouterNow: true,
+				},
+				func(t *testing.T) *netmocks.UDPConn {
+					ret := &netmocks.UDPConn{}
+					expectSWD(ret)
+					expectSGVOf(t, ret,
+						facts.EndpointFactFull(remoteEP1, &remotePublicKey, expires),
+						facts.AliveFactFull(&localPublicKey, expires, bootID),
+					)
+					expectHello(t, ret)
+					return ret
+				},
+				net.UDPAddr{
+					Port: port,
+					Zone: wgIface,
+				},
+				func(t *testing.T) *mocks.WgClient {
+					ret := &mocks.WgClient{}
+					return ret
+				},
+				newPKS(),
+				signing.New(&localPrivateKey),
+			},
+			args{
+				localPublicKey,
+				[]wgtypes.Peer{{
+					PublicKey:         remotePublicKey,
+					Endpoint:          remoteEP1,
+					LastHandshakeTime: now,
+				}},
+				[]*fact.Fact{
+					facts.EndpointFactFull(remoteEP1, &remotePublicKey, expires),
+					facts.MemberFactFull(&remotePublicKey, expires),
+				},
+				now,
+				timeout,
+			},
+			2,
 			nil,
 		},
 		// TODO: test for sending enough facts it splits into two SGFs, make sure
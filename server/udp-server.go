@@ -5,6 +5,7 @@ package server
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -14,17 +15,27 @@ import (
 	"golang.org/x/sync/errgroup"
 
 	"github.com/fastcat/wirelink/apply"
+	"github.com/fastcat/wirelink/audit"
 	"github.com/fastcat/wirelink/autopeer"
 	"github.com/fastcat/wirelink/config"
 	"github.com/fastcat/wirelink/fact"
 	"github.com/fastcat/wirelink/internal"
+	"github.com/fastcat/wirelink/internal/clock"
 	"github.com/fastcat/wirelink/internal/networking"
 	"github.com/fastcat/wirelink/log"
+	"github.com/fastcat/wirelink/roster"
 	"github.com/fastcat/wirelink/signing"
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+// logger is used for most logging in the server package
+var logger = log.For("server")
+
+// trustLog is used to log trust decisions, so that they can be enabled
+// separately from the rest of the server's debug logging
+var trustLog = log.For("trust")
+
 // LinkServer represents the server component of wirelink
 // sending/receiving on a socket
 type LinkServer struct {
@@ -35,6 +46,11 @@ type LinkServer struct {
 	conn        networking.UDPConn
 	addr        net.UDPAddr
 	ctrl        internal.WgClient
+	// scheme is how the auto addresses we and our peers use are derived from
+	// keys, nil for the default IPv6 link-local scheme
+	scheme *autopeer.Scheme
+	// joinConn listens for join requests, if we issue join tokens
+	joinConn networking.UDPConn
 
 	eg     *errgroup.Group
 	ctx    context.Context
@@ -45,6 +61,68 @@ type LinkServer struct {
 	peerKnowledge *peerKnowledgeSet
 	peerConfig    *peerConfigSet
 	signer        *signing.Signer
+	// probes tracks echo probes used to measure link quality
+	probes *probeTracker
+	// paths tracks the largest payload that gets through to each peer
+	paths *pathTracker
+	// reach tracks what relays have told us about their links to other peers
+	reach *reachTracker
+	// digests tracks the digests of our facts and their exchange with peers
+	digests *digestTracker
+	// votes tracks the membership votes sent to us by Membership sources
+	votes *voteTracker
+	// gossip tracks recently learned facts and which peers we can gossip them to
+	gossip *gossipTracker
+	// compact tracks which peers understand the compact encoding for groups
+	compact *compactTracker
+	// chunkStats counts the work done processing received facts
+	chunkStats *chunkStats
+	// dryRun holds the device changes we would have made in dry run mode
+	dryRun *dryRunTracker
+	// safety holds destructive device changes if they exceed the configured limits
+	safety *safetyBreaker
+	// enrollments holds the nodes that joined with our join tokens, nil if we
+	// don't issue them
+	enrollments *enrollTracker
+	// addresses holds the host addresses we allocate to members, nil if we
+	// don't have any pools
+	addresses *addressTracker
+	// successions tracks keys that have been replaced by new ones
+	successions *successionTracker
+	// assignedAddrs is which of our allocated addresses we have added to the
+	// local interface, only accessed from the configure loop
+	assignedAddrs map[string]bool
+	// clock is the source of the current time, if nil the system time is used
+	clock clock.Clock
+
+	// provenance tracks the sources of each fact in the current fact set
+	provenance       fact.Provenance
+	provenanceAccess sync.RWMutex
+
+	// audit records the changes we make to the device
+	audit audit.Recorder
+
+	// relays tracks which peers are being relayed through which other peers,
+	// only accessed from the configurePeers goroutine
+	relays map[wgtypes.Key]wgtypes.Key
+	// memberVotes is how many Membership sources assert each peer, when using a
+	// membership quorum. Like relays, it is only used from the configure loop.
+	memberVotes map[wgtypes.Key]int
+	// rosterMembers is the set of peers listed in the current complete signed
+	// roster, or nil if there isn't one, and rosterSerial is its serial. Like
+	// relays, these are only used from the configure loop.
+	rosterMembers map[wgtypes.Key]bool
+	rosterSerial  uint64
+	// rosterSerials records the newest roster serial we have used, so that we
+	// reject older ones even after a restart
+	rosterSerials *roster.SerialStore
+	// collisions is the set of peers whose auto address is shared with
+	// another peer or ourselves, as of the last time we checked, also only used
+	// from the configure loop
+	collisions map[wgtypes.Key]bool
+	// natted is whether we last detected that we are behind NAT, which is
+	// also only used from the configure loop
+	natted bool
 
 	// channel for asking it to print out its current info
 	printRequested chan struct{}
@@ -54,6 +132,7 @@ type LinkServer struct {
 	FactTTL     time.Duration
 	ChunkPeriod time.Duration
 	AlivePeriod time.Duration
+	ProbePeriod time.Duration
 }
 
 // MaxChunk is the max number of packets to receive before processing them
@@ -86,11 +165,52 @@ func Create(
 		config.Port = device.ListenPort + 1
 	}
 
-	ip := autopeer.AutoAddress(device.PublicKey)
+	scheme := config.AutoAddress
 	addr := net.UDPAddr{
-		IP:   ip,
+		IP:   scheme.Address(device.PublicKey),
 		Port: config.Port,
-		Zone: device.Name,
+		Zone: scheme.Zone(device.Name),
+	}
+
+	var enrollments *enrollTracker
+	if config.TokenKeyFile != "" {
+		if enrollments, err = newEnrollTracker(config.TokenKeyFile, config.EnrollmentFile, config.DryRun); err != nil {
+			return nil, err
+		}
+		if config.JoinPort <= 0 {
+			config.JoinPort = config.Port + 1
+		}
+	}
+
+	var addresses *addressTracker
+	if len(config.AddressPools) != 0 {
+		if addresses, err = newAddressTracker(config.AddressFile, config.AddressPools, config.DryRun); err != nil {
+			return nil, err
+		}
+	}
+
+	var rosterSerials *roster.SerialStore
+	if config.RosterKey != nil {
+		if rosterSerials, err = roster.LoadSerialStore(config.RosterSerialFile); err != nil {
+			return nil, err
+		}
+		if config.DryRun {
+			rosterSerials.MemoryOnly()
+		}
+	}
+
+	safety, err := loadSafetyBreaker(config.SafetyHoldFile, config.DryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	var recorder audit.Recorder
+	if config.AuditFile != "" {
+		if recorder, err = audit.NewFileRecorder(config.AuditFile, audit.DefaultMaxSize, audit.DefaultKeep); err != nil {
+			return nil, err
+		}
+	} else {
+		recorder = audit.NewLogRecorder()
 	}
 
 	eg, egCtx := errgroup.WithContext(context.Background())
@@ -103,6 +223,7 @@ func Create(
 		conn:        nil, // this will be filled in by `Start()`
 		addr:        addr,
 		ctrl:        ctrl,
+		scheme:      scheme,
 		stateAccess: new(sync.Mutex),
 
 		eg:     eg,
@@ -112,11 +233,28 @@ func Create(
 		peerKnowledge:  newPKS(),
 		peerConfig:     newPeerConfigSet(),
 		signer:         signing.New(&device.PrivateKey),
+		probes:         newProbeTracker(),
+		paths:          newPathTracker(),
+		reach:          newReachTracker(),
+		digests:        newDigestTracker(),
+		votes:          newVoteTracker(),
+		gossip:         newGossipTracker(gossipSeed(clock.Real.Now(), device.PublicKey)),
+		compact:        newCompactTracker(),
+		chunkStats:     &chunkStats{},
+		dryRun:         newDryRunTracker(),
+		safety:         safety,
+		enrollments:    enrollments,
+		addresses:      addresses,
+		rosterSerials:  rosterSerials,
+		successions:    newSuccessionTracker(),
+		clock:          clock.Real,
+		audit:          recorder,
 		printRequested: make(chan struct{}, 1),
 
 		FactTTL:     DefaultFactTTL,
 		ChunkPeriod: DefaultChunkPeriod,
 		AlivePeriod: DefaultAlivePeriod,
+		ProbePeriod: DefaultProbePeriod,
 	}
 
 	return ret, nil
@@ -138,25 +276,44 @@ func (s *LinkServer) Start() (err error) {
 		return errors.Wrap(err, "Unable to load device state to initialize server")
 	}
 
-	// have to make sure we have the local IPv6-LL address configured before we can use it
-	if setLL, err := apply.EnsureLocalAutoIP(s.net, device); err != nil {
+	// have to make sure we have the local auto address configured before we can use it
+	if s.config.DryRun {
+		logger.Info("Dry run: the wireguard device will not be changed")
+		if hasLL, err := apply.HasLocalAutoIP(s.net, device, s.scheme); err != nil {
+			return err
+		} else if !hasLL {
+			// we can't listen without it, so there's nothing useful to observe
+			return errors.Errorf("Dry run: auto address %v is missing from %s, it must be added manually",
+				s.scheme.Address(device.PublicKey), device.Name)
+		}
+	} else if setLL, err := apply.EnsureLocalAutoIP(s.net, device, s.scheme); err != nil {
 		return err
 	} else if setLL {
-		log.Info("Configured IPv6-LL address on local interface")
+		logger.Info("Configured auto address on local interface")
 	}
 
-	if peerips, err := apply.EnsurePeersAutoIP(s.ctrl, device); err != nil {
+	auditedCtrl := &auditedClient{s.ctrl, s, device.Peers, "startup"}
+	if peerips, err := apply.EnsurePeersAutoIP(auditedCtrl, device, s.scheme); err != nil {
 		return err
 	} else if peerips > 0 {
-		log.Info("Added IPv6-LL for %d peers", peerips)
+		logger.Info("Added auto address for %d peers", peerips)
 	}
 
-	// only listen on the local ipv6 auto address on the specific interface
-	s.conn, err = s.net.ListenUDP("udp6", &s.addr)
+	// only listen on the local auto address on the specific interface
+	s.conn, err = s.net.ListenUDP(s.scheme.Network(), &s.addr)
 	if err != nil {
 		return err
 	}
 
+	if s.enrollments != nil && s.config.DryRun {
+		logger.Info("Dry run: not listening for join requests")
+	} else if s.enrollments != nil {
+		s.joinConn, err = s.net.ListenUDP("udp", &net.UDPAddr{Port: s.config.JoinPort})
+		if err != nil {
+			return errors.Wrap(err, "Unable to listen for join requests")
+		}
+	}
+
 	s.UpdateRouterState(device, false)
 
 	// ok, network resources are initialized, start all the goroutines!
@@ -167,9 +324,9 @@ func (s *LinkServer) Start() (err error) {
 	newFacts := make(chan []*ReceivedFact, 1)
 	s.eg.Go(func() error { return s.chunkPackets(packets, newFacts, MaxChunk) })
 
-	factsRefreshed := make(chan []*fact.Fact, 1)
-	factsRefreshedForBroadcast := make(chan []*fact.Fact, 1)
-	factsRefreshedForConfig := make(chan []*fact.Fact, 1)
+	factsRefreshed := make(chan *factSnapshot, 1)
+	factsRefreshedForBroadcast := make(chan *factSnapshot, 1)
+	factsRefreshedForConfig := make(chan *factSnapshot, 1)
 
 	s.eg.Go(func() error { return s.processChunks(newFacts, factsRefreshed) })
 
@@ -183,6 +340,19 @@ func (s *LinkServer) Start() (err error) {
 
 	s.eg.Go(func() error { return s.configurePeers(factsRefreshedForConfig) })
 
+	s.eg.Go(func() error { return s.probePeers() })
+
+	if s.joinConn != nil {
+		s.eg.Go(func() error { return s.readJoinRequests(s.joinConn) })
+	}
+	if token := s.config.Join; token != nil {
+		if s.config.DryRun {
+			logger.Info("Dry run: not sending join requests")
+		} else {
+			s.eg.Go(func() error { return s.joinNetwork(token) })
+		}
+	}
+
 	return nil
 }
 
@@ -201,7 +371,7 @@ func (s *LinkServer) RequestPrint() {
 
 // multiplexFactChunks copies values from input to each output. It will only
 // work smoothly if the outputs are buffered so that it doesn't block much
-func multiplexFactChunks(input <-chan []*fact.Fact, outputs ...chan<- []*fact.Fact) error {
+func multiplexFactChunks(input <-chan *factSnapshot, outputs ...chan<- *factSnapshot) error {
 	for _, output := range outputs {
 		defer close(output)
 	}
@@ -234,10 +404,16 @@ func (s *LinkServer) Stop() {
 
 	if s.conn != nil {
 		if err := s.conn.Close(); err != nil {
-			log.Error("Failed to close server socket: %v", err)
+			logger.Error("Failed to close server socket: %v", err)
 		}
 		s.conn = nil
 	}
+	if s.joinConn != nil {
+		if err := s.joinConn.Close(); err != nil {
+			logger.Error("Failed to close join socket: %v", err)
+		}
+		s.joinConn = nil
+	}
 
 	// leave eg & ctx around so we can inspect them after stopping
 	// s.eg = nil
@@ -256,10 +432,17 @@ func (s *LinkServer) Close() {
 		s.ctrl = nil
 	}
 
+	if closer, ok := s.audit.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logger.Error("Unable to close audit log: %v", err)
+		}
+		s.audit = nil
+	}
+
 	if s.net != nil {
 		err := s.net.Close()
 		if err != nil {
-			log.Error("Unable to close network: %v", err)
+			logger.Error("Unable to close network: %v", err)
 		}
 		s.net = nil
 	}
@@ -267,9 +450,9 @@ func (s *LinkServer) Close() {
 	if s.eg != nil {
 		err := s.eg.Wait()
 		if err == nil {
-			log.Info("Server closed gracefully")
+			logger.Info("Server closed gracefully")
 		} else {
-			log.Error("Server exiting after failure")
+			logger.Error("Server exiting after failure")
 		}
 		s.eg = nil
 	}
@@ -286,6 +469,25 @@ func (s *LinkServer) Wait() error {
 	return nil
 }
 
+// UseClock replaces the source of time for the server, so that tests and
+// simulations can control how time passes. It must be called before Start.
+// The random choices the server makes are reseeded from the new clock and the
+// local key, so that simulations using a fake clock are repeatable, but
+// different servers still make different choices.
+func (s *LinkServer) UseClock(c clock.Clock) {
+	s.clock = c
+	var local wgtypes.Key
+	if s.signer != nil {
+		local = s.signer.PublicKey
+	}
+	s.gossip.reseed(gossipSeed(clock.Or(c).Now(), local))
+}
+
+// now returns the current time according to the server's clock
+func (s *LinkServer) now() time.Time {
+	return clock.Or(s.clock).Now()
+}
+
 // Address returns the local IP address on which the server listens
 func (s *LinkServer) Address() net.IP {
 	return s.addr.IP
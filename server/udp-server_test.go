@@ -26,6 +26,21 @@ func TestCreate(t *testing.T) {
 	wgIface := fmt.Sprintf("wg%d", rand.Int())
 	p := rand.Intn(65536)
 	privateKey, publicKey := testutils.MustKeyPair(t)
+	v4ll, err := autopeer.ParseScheme(autopeer.SchemeIPv4LinkLocal)
+	require.NoError(t, err)
+	mockDevice := func(t *testing.T) *mocks.WgClient {
+		ret := &mocks.WgClient{}
+		ret.On("Device", wgIface).Return(
+			&wgtypes.Device{
+				Name:       wgIface,
+				ListenPort: p,
+				PrivateKey: privateKey,
+				PublicKey:  publicKey,
+			},
+			nil,
+		)
+		return ret
+	}
 
 	type args struct {
 		ctrl   func(*testing.T) *mocks.WgClient
@@ -40,19 +55,7 @@ func TestCreate(t *testing.T) {
 		{
 			"basic",
 			args{
-				func(t *testing.T) *mocks.WgClient {
-					ret := &mocks.WgClient{}
-					ret.On("Device", wgIface).Return(
-						&wgtypes.Device{
-							Name:       wgIface,
-							ListenPort: p,
-							PrivateKey: privateKey,
-							PublicKey:  publicKey,
-						},
-						nil,
-					)
-					return ret
-				},
+				mockDevice,
 				&config.Server{
 					Iface: wgIface,
 				},
@@ -71,6 +74,30 @@ func TestCreate(t *testing.T) {
 			},
 			require.NoError,
 		},
+		{
+			"ipv4 link-local",
+			args{
+				mockDevice,
+				&config.Server{
+					Iface:       wgIface,
+					AutoAddress: v4ll,
+				},
+			},
+			&LinkServer{
+				config: &config.Server{
+					Iface:       wgIface,
+					Port:        p + 1,
+					AutoAddress: v4ll,
+				},
+				addr: net.UDPAddr{
+					IP:   v4ll.Address(publicKey),
+					Port: p + 1,
+				},
+				scheme: v4ll,
+				signer: signing.New(&privateKey),
+			},
+			require.NoError,
+		},
 		// TODO: pre-selected port
 		// TODO: error paths
 	}
@@ -89,6 +116,7 @@ func TestCreate(t *testing.T) {
 				assert.Equal(t, tt.want.net, got.net)
 				assert.Equal(t, tt.want.conn, got.conn)
 				assert.Equal(t, tt.want.addr, got.addr)
+				assert.Equal(t, tt.want.scheme, got.scheme)
 				assert.NotNil(t, got.stateAccess)
 				assert.NotNil(t, got.eg)
 				assert.NotNil(t, got.ctx)
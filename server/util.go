@@ -2,13 +2,13 @@ package server
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/fastcat/wirelink/apply"
 	"github.com/fastcat/wirelink/detect"
 	"github.com/fastcat/wirelink/fact"
-	"github.com/fastcat/wirelink/log"
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
@@ -30,6 +30,14 @@ func (s *LinkServer) peerName(peer wgtypes.Key) string {
 	return peer.String()
 }
 
+// subjectName formats a fact subject, using the peer name for peer subjects
+func (s *LinkServer) subjectName(fs fact.Subject) string {
+	if ps, ok := fs.(*fact.PeerSubject); ok {
+		return s.peerName(ps.Key)
+	}
+	return fs.String()
+}
+
 func (s *LinkServer) formatFacts(
 	now time.Time,
 	facts []*fact.Fact,
@@ -38,18 +46,16 @@ func (s *LinkServer) formatFacts(
 	facts = fact.SortedCopy(facts)
 	var str strings.Builder
 	str.WriteString("Current facts:")
-	peerNamer := func(fs fact.Subject) string {
-		if ps, ok := fs.(*fact.PeerSubject); ok {
-			return s.peerName(ps.Key)
-		}
-		return fs.String()
-	}
 	// protect against tests mutating config while we read it
 	s.stateAccess.Lock()
 	defer s.stateAccess.Unlock()
 	for _, fact := range facts {
 		str.WriteRune('\n')
-		str.WriteString(fact.FancyString(peerNamer, now))
+		str.WriteString(fact.FancyString(s.subjectName, now))
+		if sources := s.describeSources(fact, now); sources != "" {
+			str.WriteString(" from ")
+			str.WriteString(sources)
+		}
 	}
 	str.WriteString("\nCurrent peers:")
 	s.peerConfig.ForEach(func(k wgtypes.Key, pcs *apply.PeerConfigState) {
@@ -61,27 +67,94 @@ func (s *LinkServer) formatFacts(
 			}
 		}
 		fmt.Fprintf(&str, "\nPeer %s is %s", peerName, pcs.Describe(now))
+		if votes, ok := s.memberVotes[k]; ok {
+			fmt.Fprintf(&str, ", %d/%d membership votes", votes, s.config.MembershipQuorum)
+		}
+		if n := s.peerKnowledge.ackState().pendingCount(k); n > 0 {
+			fmt.Fprintf(&str, ", %d facts awaiting ack", n)
+		}
 	})
+	// can't do this inside the ForEach as peerName needs the peerConfig lock
+	relayed := make([]string, 0, len(s.relays))
+	for target, relay := range s.relays {
+		relayed = append(relayed, fmt.Sprintf("\nPeer %s is relayed through %s", s.peerName(target), s.peerName(relay)))
+	}
+	sort.Strings(relayed)
+	for _, r := range relayed {
+		str.WriteString(r)
+	}
+	if s.rosterMembers != nil {
+		fmt.Fprintf(&str, "\nSigned roster %d has %d members", s.rosterSerial, len(s.rosterMembers))
+	}
+	successors, retired := s.successions.state()
+	succeeded := make([]string, 0, len(successors))
+	for old, successor := range successors {
+		line := fmt.Sprintf("\nPeer %s is succeeded by %s", s.peerName(old), s.peerName(successor))
+		if retired[old] {
+			line += " (retired)"
+		}
+		succeeded = append(succeeded, line)
+	}
+	sort.Strings(succeeded)
+	for _, line := range succeeded {
+		str.WriteString(line)
+	}
+	if reason, since, held := s.safety.held(); held {
+		fmt.Fprintf(&str, "\nSAFETY HOLD since %s: %s", since.Format(time.RFC3339), reason)
+	}
+	if s.config.DryRun {
+		str.WriteString("\nPending changes (dry run):")
+		for _, change := range s.dryRun.describe() {
+			str.WriteString("\n")
+			str.WriteString(change)
+		}
+	}
 	str.WriteString("\nSelf: ")
 	str.WriteString(s.Describe())
 	return str.String()
 }
 
-// groupFactsByPeer takes a list of facts and groups them by the public key in
-// their Subject. Any facts that don't have a PeerSubject will be logged as an error,
-// but otherwise ignored.
-func groupFactsByPeer(facts []*fact.Fact) map[wgtypes.Key][]*fact.Fact {
-	factsByPeer := make(map[wgtypes.Key][]*fact.Fact)
+// withoutAttribute copies the grouped facts without those with the given
+// attribute, which must all be in the given list. Only the groups that had
+// such facts are copied, the rest are shared.
+func withoutAttribute(
+	factsByPeer map[wgtypes.Key][]*fact.Fact,
+	attr fact.Attribute,
+	facts []*fact.Fact,
+) map[wgtypes.Key][]*fact.Fact {
+	ret := make(map[wgtypes.Key][]*fact.Fact, len(factsByPeer))
+	for k, group := range factsByPeer {
+		ret[k] = group
+	}
 	for _, f := range facts {
 		ps, ok := f.Subject.(*fact.PeerSubject)
 		if !ok {
-			// WAT
-			log.Error("WAT: fact subject is a %T: %v", f.Subject, f)
 			continue
 		}
-		factsByPeer[ps.Key] = append(factsByPeer[ps.Key], f)
+		group, ok := ret[ps.Key]
+		if !ok || !fact.SliceHas(group, func(f *fact.Fact) bool { return f.Attribute == attr }) {
+			// already filtered
+			continue
+		}
+		filtered := make([]*fact.Fact, 0, len(group)-1)
+		for _, gf := range group {
+			if gf.Attribute != attr {
+				filtered = append(filtered, gf)
+			}
+		}
+		if len(filtered) == 0 {
+			delete(ret, ps.Key)
+		} else {
+			ret[ps.Key] = filtered
+		}
 	}
-	return factsByPeer
+	return ret
+}
+
+// appendToGroup appends facts to a group from a fact snapshot, copying it
+// instead of possibly modifying the shared backing array
+func appendToGroup(group []*fact.Fact, facts ...*fact.Fact) []*fact.Fact {
+	return append(group[:len(group):len(group)], facts...)
 }
 
 // UpdateRouterState will update `s.config.IsRouterNow` based on the device state,
@@ -96,7 +169,7 @@ func (s *LinkServer) UpdateRouterState(dev *wgtypes.Device, logChanges bool) {
 				if newValue {
 					newState = "router"
 				}
-				log.Info("Detected we are now a %s", newState)
+				logger.Info("Detected we are now a %s", newState)
 			}
 			s.config.IsRouterNow = newValue
 		}
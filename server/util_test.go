@@ -26,6 +26,7 @@ func TestLinkServer_formatFacts(t *testing.T) {
 	// constant data here so that we can have constant string asserts easily
 	k1s := "GLTtd/FIr9+BfZJ+mFlel97VK0ED33ENxDDUPV/ck3A="
 	k1 := testutils.MustParseKey(t, k1s)
+	k2 := testutils.MustKey(t)
 	ep1 := &net.UDPAddr{
 		IP:   util.NormalizeIP(net.IPv4(100, 1, 2, 3)),
 		Port: 1234,
@@ -47,6 +48,7 @@ func TestLinkServer_formatFacts(t *testing.T) {
 	type fields struct {
 		config     *config.Server
 		peerConfig *peerConfigSet
+		relays     map[wgtypes.Key]wgtypes.Key
 	}
 	type args struct {
 		facts []*fact.Fact
@@ -63,6 +65,7 @@ func TestLinkServer_formatFacts(t *testing.T) {
 			fields{
 				&config.Server{},
 				newPeerConfigSet(),
+				nil,
 			},
 			args{nil},
 			fmt.Sprintf("Current facts:\nCurrent peers:\nSelf: Version %s on {} [<nil>]:0 (leaf, quiet)", internal.Version),
@@ -73,6 +76,7 @@ func TestLinkServer_formatFacts(t *testing.T) {
 			fields{
 				&config.Server{},
 				newPeerConfigSet(),
+				nil,
 			},
 			args{[]*fact.Fact{
 				facts.EndpointFactFull(ep1, &k1, expires),
@@ -92,6 +96,7 @@ func TestLinkServer_formatFacts(t *testing.T) {
 			fields{
 				&config.Server{},
 				newPeerConfigSet(),
+				nil,
 			},
 			args{[]*fact.Fact{
 				facts.EndpointFactFull(ep1, &k1, expires),
@@ -119,6 +124,7 @@ func TestLinkServer_formatFacts(t *testing.T) {
 					},
 					&sync.Mutex{},
 				},
+				nil,
 			},
 			args{},
 			fmt.Sprintf(
@@ -132,6 +138,28 @@ func TestLinkServer_formatFacts(t *testing.T) {
 			),
 			false,
 		},
+		{
+			"relayed peer",
+			fields{
+				&config.Server{
+					Peers: config.Peers{
+						k1: &config.Peer{Name: "target"},
+						k2: &config.Peer{Name: "relay"},
+					},
+				},
+				newPeerConfigSet(),
+				map[wgtypes.Key]wgtypes.Key{k1: k2},
+			},
+			args{},
+			fmt.Sprintf(
+				"Current facts:\n"+
+					"Current peers:\n"+
+					"Peer target is relayed through relay\n"+
+					"Self: Version %s on {} [<nil>]:0 (leaf, quiet)",
+				internal.Version,
+			),
+			false,
+		},
 		// TODO: Add test cases.
 	}
 	for _, tt := range tests {
@@ -139,6 +167,7 @@ func TestLinkServer_formatFacts(t *testing.T) {
 			s := &LinkServer{
 				config:      tt.fields.config,
 				peerConfig:  tt.fields.peerConfig,
+				relays:      tt.fields.relays,
 				stateAccess: &sync.Mutex{},
 			}
 			got := s.formatFacts(now, tt.args.facts)
@@ -151,6 +180,44 @@ func TestLinkServer_formatFacts(t *testing.T) {
 	}
 }
 
+func TestLinkServer_formatFacts_provenance(t *testing.T) {
+	now := time.Now()
+	k1s := "GLTtd/FIr9+BfZJ+mFlel97VK0ED33ENxDDUPV/ck3A="
+	k1 := testutils.MustParseKey(t, k1s)
+	k2 := testutils.MustKey(t)
+	ep1 := &net.UDPAddr{
+		IP:   util.NormalizeIP(net.IPv4(100, 1, 2, 3)),
+		Port: 1234,
+	}
+	f := facts.EndpointFactFull(ep1, &k1, now.Add(DefaultFactTTL))
+	remote := *f
+	remote.Expires = now.Add(120 * time.Second)
+
+	prov := fact.Provenance{}
+	prov.Add(f, fact.LocalSource)
+	prov.Add(&remote, fact.PeerSource(k2))
+
+	s := &LinkServer{
+		config: &config.Server{
+			Peers: config.Peers{
+				k2: &config.Peer{Name: "bob"},
+			},
+		},
+		peerConfig:  newPeerConfigSet(),
+		stateAccess: &sync.Mutex{},
+		provenance:  prov,
+	}
+	got := s.formatFacts(now, []*fact.Fact{f})
+	assert.Equal(t, fmt.Sprintf(
+		"Current facts:\n"+
+			"{a:e s:%s v:100.1.2.3:1234 ttl:255.000} from local (255s), bob (120s)\n"+
+			"Current peers:\n"+
+			"Self: Version %s on {} [<nil>]:0 (leaf, quiet)",
+		k1s,
+		internal.Version,
+	), got)
+}
+
 func TestLinkServer_UpdateRouterState(t *testing.T) {
 	type fields struct {
 		config *config.Server
@@ -62,6 +62,15 @@ func (c *configBuilder) withPeer(key wgtypes.Key, peer *config.Peer) *configBuil
 	return c
 }
 
+func (c *configBuilder) withPSK(secret []byte, rotation time.Duration) *configBuilder {
+	if c == nil {
+		c = &configBuilder{}
+	}
+	c.PSKSecret = secret
+	c.PSKRotation = rotation
+	return c
+}
+
 func (c *configBuilder) Build() *config.Server {
 	return (*config.Server)(c)
 }
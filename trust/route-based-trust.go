@@ -17,20 +17,29 @@ import (
 // endpoint information, "routers" (peers with an AllowedIP whose CIDR mask is
 // shorter than the IP length) are allowed to provide AllowedIPs for other
 // peers, and nobody is allowed to provide new peers (peer public keys must be
-// added by the administrator)
-func CreateRouteBasedTrust(peers []wgtypes.Peer) Evaluator {
+// added by the administrator). Peers are recognized by their address in the
+// given auto address scheme, and addresses shared by more than one peer are
+// not recognized at all.
+func CreateRouteBasedTrust(peers []wgtypes.Peer, scheme *autopeer.Scheme) Evaluator {
 	ret := routeBasedTrust{
 		peersByIP:  make(map[[net.IPv6len]byte]*peerWithAddr),
 		peersByKey: make(map[wgtypes.Key]*peerWithAddr),
 	}
+	keys := make([]wgtypes.Key, len(peers))
 	for i := range peers {
-		a := autopeer.AutoAddress(peers[i].PublicKey)
+		keys[i] = peers[i].PublicKey
+	}
+	colliding := scheme.Collisions(keys...)
+	for i := range peers {
+		a := scheme.Address(peers[i].PublicKey)
 		// need to take the address of the array element not a local var
 		pwa := peerWithAddr{
 			peer: &peers[i],
 			ip:   a,
 		}
-		ret.peersByIP[util.IPToBytes(a)] = &pwa
+		if !colliding[peers[i].PublicKey] {
+			ret.peersByIP[util.IPToBytes(a)] = &pwa
+		}
 		ret.peersByKey[peers[i].PublicKey] = &pwa
 	}
 	return &ret
@@ -59,7 +68,7 @@ func (rbt *routeBasedTrust) TrustLevel(f *fact.Fact, source net.UDPAddr) *Level
 	peer, ok := rbt.peersByIP[util.IPToBytes(source.IP)]
 	if !ok {
 		// strangely unrecognized, suggests a router peer is forwarding packets from
-		// other peers' IPv6-LL address to us
+		// other peers' auto address to us
 		return nil
 	}
 
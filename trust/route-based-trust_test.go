@@ -9,6 +9,7 @@ import (
 	"github.com/fastcat/wirelink/fact"
 	"github.com/fastcat/wirelink/internal/testutils"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
@@ -17,6 +18,10 @@ func Test_routeBasedTrust_TrustLevel(t *testing.T) {
 	k2 := testutils.MustKey(t)
 	k3 := testutils.MustKey(t)
 
+	v4ll, err := autopeer.ParseScheme(autopeer.SchemeIPv4LinkLocal)
+	require.NoError(t, err)
+	c1, c2 := testutils.MustCollidingKeys(t, v4ll.Address)
+
 	peerAddr := func(k wgtypes.Key) net.UDPAddr {
 		return net.UDPAddr{IP: autopeer.AutoAddress(k), Port: rand.Intn(65535)}
 	}
@@ -60,34 +65,60 @@ func Test_routeBasedTrust_TrustLevel(t *testing.T) {
 	tests := []struct {
 		name string
 		// fields fields
-		peers []wgtypes.Peer
-		args  args
-		want  *Level
+		peers  []wgtypes.Peer
+		scheme *autopeer.Scheme
+		args   args
+		want   *Level
 	}{
 		{
 			"unknown",
 			peerList(k1),
+			nil,
 			mkArgs(k2, k3),
 			nil,
 		},
 		{
 			"known leaf self info",
 			peerList(k1),
+			nil,
 			mkArgs(k1, k1),
 			Ptr(Endpoint),
 		},
 		{
 			"known leaf other info",
 			peerList(k1),
+			nil,
 			mkArgs(k2, k1),
 			Ptr(Endpoint),
 		},
 		{
 			"known router",
 			routerList(k1),
+			nil,
 			mkArgs(k2, k1),
 			Ptr(Membership),
 		},
+		{
+			"ipv4 link-local leaf",
+			peerList(k1),
+			v4ll,
+			args{factAbout(k1), net.UDPAddr{IP: v4ll.Address(k1), Port: 1}},
+			Ptr(Endpoint),
+		},
+		{
+			"wrong scheme",
+			peerList(k1),
+			v4ll,
+			mkArgs(k1, k1),
+			nil,
+		},
+		{
+			"colliding leaf",
+			peerList(c1, c2),
+			v4ll,
+			args{factAbout(c1), net.UDPAddr{IP: v4ll.Address(c1), Port: 1}},
+			nil,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -95,7 +126,7 @@ func Test_routeBasedTrust_TrustLevel(t *testing.T) {
 			// 	peersByIP:  tt.fields.peersByIP,
 			// 	peersByKey: tt.fields.peersByKey,
 			// }
-			rbt := CreateRouteBasedTrust(tt.peers)
+			rbt := CreateRouteBasedTrust(tt.peers, tt.scheme)
 			got := rbt.TrustLevel(tt.args.f, tt.args.source)
 			assert.Equal(t, tt.want, got, "want %v got %v", tt.want, got)
 		})
@@ -133,7 +164,7 @@ func Test_routeBasedTrust_IsKnown(t *testing.T) {
 			// 	peersByIP:  tt.fields.peersByIP,
 			// 	peersByKey: tt.fields.peersByKey,
 			// }
-			rbt := CreateRouteBasedTrust(tt.peers)
+			rbt := CreateRouteBasedTrust(tt.peers, nil)
 			got := rbt.IsKnown(tt.args.s)
 			assert.Equal(t, tt.want, got)
 		})
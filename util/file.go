@@ -0,0 +1,77 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// WriteFileAtomic writes data to a temporary file next to path, syncs it, and
+// renames it into place, so that the file at path is never left partially
+// written, even if we crash part way through
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// StoreFile is the file a persistent store is saved to, replacing it
+// atomically each time with WriteFileAtomic. A StoreFile can be made memory
+// only, after which saving does nothing, leaving the file as it was. It is safe
+// for concurrent use.
+type StoreFile struct {
+	path       string
+	access     sync.Mutex
+	memoryOnly bool
+}
+
+// NewStoreFile creates a StoreFile that saves to the given path. An empty path
+// makes it memory only.
+func NewStoreFile(path string) *StoreFile {
+	return &StoreFile{path: path, memoryOnly: path == ""}
+}
+
+// Path returns the path of the file
+func (f *StoreFile) Path() string {
+	return f.path
+}
+
+// MemoryOnly makes any further saves do nothing
+func (f *StoreFile) MemoryOnly() {
+	f.access.Lock()
+	defer f.access.Unlock()
+	f.memoryOnly = true
+}
+
+// Save replaces the file with the given data, unless it is memory only
+func (f *StoreFile) Save(data []byte) error {
+	f.access.Lock()
+	defer f.access.Unlock()
+	if f.memoryOnly {
+		return nil
+	}
+	return WriteFileAtomic(f.path, data, 0600)
+}
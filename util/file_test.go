@@ -0,0 +1,72 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wirelink-util")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "data.json")
+
+	require.NoError(t, WriteFileAtomic(path, []byte("one"), 0600))
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "one", string(data))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// replaces the old contents
+	require.NoError(t, WriteFileAtomic(path, []byte("two"), 0600))
+	data, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "two", string(data))
+
+	// and leaves no temporary files behind
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	assert.Error(t, WriteFileAtomic(filepath.Join(dir, "missing", "data.json"), []byte("three"), 0600))
+	// can't rename a file over a directory
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0700))
+	assert.Error(t, WriteFileAtomic(filepath.Join(dir, "sub"), []byte("four"), 0600))
+	entries, err = ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestStoreFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wirelink-util")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "data.json")
+
+	f := NewStoreFile(path)
+	assert.Equal(t, path, f.Path())
+	require.NoError(t, f.Save([]byte("one")))
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "one", string(data))
+
+	// memory only leaves the file alone
+	f.MemoryOnly()
+	require.NoError(t, f.Save([]byte("two")))
+	data, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "one", string(data))
+
+	// as does no path
+	require.NoError(t, NewStoreFile("").Save([]byte("three")))
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
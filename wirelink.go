@@ -11,6 +11,31 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == cmd.DecodeCommand {
+		err := cmd.NewDecode(os.Args, os.Stdin, os.Stdout).Run()
+		if err != nil && err != pflag.ErrHelp {
+			fmt.Fprintf(os.Stderr, "Fatal error: %v", err)
+			defer os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == cmd.RosterCommand {
+		err := cmd.NewRoster(os.Args, os.Stdin, os.Stdout).Run()
+		if err != nil && err != pflag.ErrHelp {
+			fmt.Fprintf(os.Stderr, "Fatal error: %v", err)
+			defer os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == cmd.TokenCommand {
+		err := cmd.NewToken(os.Args, host.MustCreateHost(), os.Stdout).Run()
+		if err != nil && err != pflag.ErrHelp {
+			fmt.Fprintf(os.Stderr, "Fatal error: %v", err)
+			defer os.Exit(1)
+		}
+		return
+	}
+
 	cmd := cmd.New(os.Args)
 	err := cmd.Init(host.MustCreateHost())
 	// don't print on error just because help was requested